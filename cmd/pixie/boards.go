@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/davejbax/pixie/internal/board"
+	"github.com/spf13/cobra"
+)
+
+func newBoardsCommand(opts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "boards",
+		Short: "Inspect board quirk profiles",
+	}
+
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "profiles",
+			Short: "List built-in board profiles",
+			RunE: func(_ *cobra.Command, _ []string) error {
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "PROFILE\tARCH\tBOOT\tDESCRIPTION")
+
+				for _, name := range board.Profiles() {
+					profile, err := board.LookupProfile(name)
+					if err != nil {
+						return err //nolint:wrapcheck
+					}
+
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, profile.Arch, profile.Boot, profile.Description)
+				}
+
+				return w.Flush() //nolint:wrapcheck
+			},
+		},
+		&cobra.Command{
+			Use:   "list",
+			Short: "List configured boards and the firmware files served for them",
+			RunE: func(_ *cobra.Command, _ []string) error {
+				boards, err := board.New(opts.config.Boards)
+				if err != nil {
+					return fmt.Errorf("failed to load boards: %w", err)
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "BOARD\tARCH\tBOOT\tFIRMWARE FILES")
+
+				for _, b := range boards {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", b.Name, b.Profile.Arch, b.Profile.Boot, strings.Join(b.Files(), ","))
+				}
+
+				return w.Flush() //nolint:wrapcheck
+			},
+		},
+	)
+
+	return cmd
+}
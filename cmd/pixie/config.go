@@ -1,38 +1,416 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"os"
+	"slices"
 
 	"github.com/creasty/defaults"
+	"github.com/davejbax/pixie/internal/acl"
+	"github.com/davejbax/pixie/internal/api"
+	"github.com/davejbax/pixie/internal/autoinstall"
+	"github.com/davejbax/pixie/internal/board"
+	"github.com/davejbax/pixie/internal/bootloader"
+	"github.com/davejbax/pixie/internal/bootsession"
+	"github.com/davejbax/pixie/internal/catalog"
+	"github.com/davejbax/pixie/internal/cmdline"
+	"github.com/davejbax/pixie/internal/configfile"
+	"github.com/davejbax/pixie/internal/configschema"
+	"github.com/davejbax/pixie/internal/dhcp"
 	"github.com/davejbax/pixie/internal/distro"
-	"github.com/davejbax/pixie/internal/grub"
+	"github.com/davejbax/pixie/internal/dns"
+	"github.com/davejbax/pixie/internal/dnsreg"
+	"github.com/davejbax/pixie/internal/drain"
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/httpserver"
+	"github.com/davejbax/pixie/internal/kube"
+	"github.com/davejbax/pixie/internal/logging"
+	"github.com/davejbax/pixie/internal/maintenance"
+	"github.com/davejbax/pixie/internal/netif"
+	"github.com/davejbax/pixie/internal/notify"
+	"github.com/davejbax/pixie/internal/oci"
+	"github.com/davejbax/pixie/internal/quirks"
+	"github.com/davejbax/pixie/internal/reconcile"
+	"github.com/davejbax/pixie/internal/requestlog"
+	"github.com/davejbax/pixie/internal/sockets"
+	"github.com/davejbax/pixie/internal/storage"
+	"github.com/davejbax/pixie/internal/store"
+	"github.com/davejbax/pixie/internal/tftp"
+	"github.com/davejbax/pixie/internal/urlsign"
+	"github.com/davejbax/pixie/internal/wol"
+	"github.com/davejbax/pixie/pkg/grub"
+	"github.com/davejbax/pixie/pkg/iso"
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+// Roles of a pixie instance
+const (
+	rolePrimary = "primary"
+	roleReplica = "replica"
+)
+
+var (
+	errUnknownRole        = errors.New("unknown role")
+	errUnknownGrubProfile = errors.New("GRUB profile is not in config")
+)
+
 type config struct {
+	// Either 'primary', or 'replica' for instances that serve distros from an artifact
+	// store shared with (or synced from) the primary, but never download them. Replicas
+	// refresh the active distros from the store instead of reconciling.
+	Role string `default:"primary"`
+
+	// Defaults suit Linux and other Unix-like systems. On Windows, the temp directory
+	// defaults to 'pixie' in the user's temp directory, and the storage directory to
+	// 'pixie' in %ProgramData%.
 	TempDir    string `mapstructure:"temp_directory" default:"/var/tmp/pixie"`
 	StorageDir string `mapstructure:"storage_directory" default:"/var/lib/pixie"`
 
+	// Directory of extra files to serve over TFTP and HTTP, e.g. firmware or iPXE
+	// scripts. Files are served at their path relative to the directory. This is
+	// shorthand for the first of StaticDirs, without a prefix or override.
+	StaticDir string `mapstructure:"static_directory"`
+
+	// Directories of extra files to serve over TFTP and HTTP. Where several have a file
+	// at the same path, directories that override generated files come first, and
+	// otherwise the first listed wins.
+	StaticDirs []catalog.StaticDir `mapstructure:"static_dirs"`
+
+	// Where runtime state (one-shot assignments, install statuses, hosts created through
+	// the API, DHCP leases and clients) is kept
+	State store.Config
+
+	// Where downloaded distros are kept. Keeping them in an object store lets several
+	// pixie instances share them, and serve them straight from the store.
+	Artifacts storage.Config `mapstructure:"artifact_storage"`
+
+	// Limits on the disk space used by the storage directory. Unused distro versions are
+	// evicted to make space for downloads, least recently used first.
+	StorageQuota distro.QuotaConfig `mapstructure:"storage_quota"`
+
+	// Per-subsystem log levels, and a file that logs are written to as well as stderr.
+	// Changes need a restart to take effect.
+	Log logging.Config
+
+	// GRUB images to generate. Changes need a restart to take effect.
 	Grub grub.Config
 
+	// Alternative GRUB configs, e.g. with other modules or arches, that hosts can boot
+	// with instead of the default, and that ISOs can be built with. Each profile's
+	// files are served from 'boot/grub/profiles/<name>'. Changes need a restart to take
+	// effect.
+	GrubProfiles map[string]*grub.Config `mapstructure:"grub_profiles"`
+
+	ISO  iso.Options
+	TFTP tftp.Config
+	HTTP httpserver.Config
+
+	// Sockets passed by the service manager, which let pixie serve privileged ports
+	// without root. Each server's port is checked on startup, so that failures to bind
+	// are reported together, with hints on running without root.
+	Sockets sockets.Config
+
+	// Waiting on shutdown for TFTP and HTTP downloads in progress to finish, so that a
+	// machine isn't cut off halfway through downloading its initrd
+	Drain drain.Config
+
+	// Logging of each file request served over TFTP and HTTP
+	RequestLog requestlog.Config `mapstructure:"request_log"`
+
+	// Correlation of each machine's DHCP offer and file requests into boot sessions, which
+	// the API shows
+	BootSessions bootsession.Config `mapstructure:"boot_sessions"`
+
+	UBoot bootloader.UBootConfig `mapstructure:"uboot"`
+
+	// Timeout, default entry and submenus of the boot menus served to clients
+	Menu bootloader.MenuConfig
+
+	// Authoritative DHCP server, for networks without an existing DHCP server
+	DHCP dhcp.Config
+
+	// ProxyDHCP server, for pointing PXE clients at pixie alongside an existing DHCP server
+	ProxyDHCP dhcp.ProxyConfig `mapstructure:"proxy_dhcp"`
+
+	// ProxyDHCPv6 server, for pointing UEFI clients booting over IPv6 at pixie alongside
+	// an existing DHCPv6 server or SLAAC. It can run alongside either DHCP server.
+	ProxyDHCPv6 dhcp.ProxyV6Config `mapstructure:"proxy_dhcpv6"`
+
+	// Addresses advertised to clients on each network interface (such as a VLAN
+	// sub-interface), by interface name, for servers on several networks. Unless the DHCP
+	// or ProxyDHCP server has a server_ip or interface, each client is given the address
+	// of the interface its request arrived on as the next server; unless the HTTP server
+	// has a public_url, clients are referred to it at the interface's address on their
+	// network. Interfaces not listed use their own first address.
+	Interfaces map[string]*netif.Config
+
+	// Which clients the TFTP, HTTP and DHCP servers answer, by source address and MAC
+	// prefix. The management API is protected by its tokens instead.
+	Access acl.Config
+
+	// Workarounds for buggy client firmware, matched by DHCP vendor class, client
+	// architecture or MAC prefix, e.g. small TFTP blocks or a different boot file
+	Quirks []quirks.Rule
+
+	// Optional DNS responder for provisioning networks without DNS
+	DNS dns.Config
+
+	// Registration of hosts' names and addresses in DNS when they report a successful
+	// install, by dynamic update or webhook
+	DNSRegistration dnsreg.Config `mapstructure:"dns_registration"`
+
+	// Where Wake-on-LAN magic packets sent by 'pixie hosts wake' and the API go
+	WakeOnLAN wol.Config `mapstructure:"wake_on_lan"`
+
 	Distros map[string]*distro.Config
+
+	// Credentials of OCI registries that distros are pulled from, and that ISO and
+	// entrypoint images are pushed to
+	OCI oci.Config `mapstructure:"oci"`
+
+	// Distros and hosts read from the Kubernetes cluster that pixie runs in, in addition
+	// to those in this file. Changes are applied while serving.
+	Kubernetes kube.Config
+
+	// Periodic distro reconciliation while serving
+	Reconcile reconcile.Config
+
+	// Management API for external automation
+	API api.Config
+
+	// Webhooks, MQTT brokers and NATS servers that boot events are sent to
+	Notify notify.Config
+
+	// Kernel arguments for all distros. Distro and host arguments are merged over these:
+	// an argument replaces any earlier argument of the same name, and '-name' removes it.
+	KernelArgs []string `mapstructure:"kernel_args"`
+
+	// Per-host boot configuration, matched by MAC address, SMBIOS UUID, or IP range
+	Hosts []hosts.Config
+
+	// Where hosts' automation templates read secrets (from files, the environment or
+	// Vault) and external data from
+	Templates autoinstall.Sources
+
+	// Signed, expiring URLs for hosts' automation files, which may contain secrets
+	SignedURLs urlsign.Config `mapstructure:"signed_urls"`
+
+	// Directory of further hosts, one per YAML or JSON file named after the host. If
+	// set, 'pixie hosts' writes hosts here rather than to the state store. Changes are
+	// applied while serving.
+	HostsDir string `mapstructure:"hosts_directory"`
+
+	// Settings shared by groups of hosts, which may inherit from each other
+	Profiles []hosts.Profile
+
+	// Profile used to boot clients that match no host. If empty, such clients are
+	// offered every distro.
+	DefaultProfile string `mapstructure:"default_profile"`
+
+	// Boards with device-specific boot quirks, keyed by an arbitrary name
+	Boards map[string]*board.Config
+
+	// Windows during which new distro versions and entrypoint images become active.
+	// If empty, updates become active immediately.
+	MaintenanceWindows maintenance.Schedule `mapstructure:"maintenance_windows"`
+
+	// Further sites (e.g. a lab and a production network) that this pixie serves, kept
+	// apart from each other and from the top level, by name. A site's settings are merged
+	// over the top-level ones, except that distros, hosts, the hosts directory, profiles
+	// and Kubernetes definitions aren't inherited, and logging, sockets, sites and the age
+	// key file can't be set. Each site keeps its state and distros in its own storage
+	// directory, which defaults to 'sites/<name>' in the top-level one, and its servers
+	// must listen on addresses or interfaces of their own. 'pixie serve' serves every
+	// site, and other commands act on the site selected with --site.
+	Sites map[string]map[string]any
+
+	// File containing the age key that config files encrypted with SOPS, and values that
+	// are armored age files, are decrypted with. It must be set in the config file itself,
+	// unencrypted. If empty, the key is read from where SOPS reads it: SOPS_AGE_KEY,
+	// SOPS_AGE_KEY_FILE or 'sops/age/keys.txt' in the user's config directory.
+	AgeKeyFile string `mapstructure:"age_key_file"`
+
+	// Name of the site that the config is of, or empty for the top level
+	site string
+
+	// Files and directories that the config was read from, including those included by
+	// the 'include' key
+	sources *configfile.Sources
 }
 
-func loadConfig(path string) (*config, error) {
-	viper.SetConfigFile(path)
-	if err := viper.ReadInConfig(); err != nil {
+// replica returns whether the instance is a replica, rather than the primary
+func (c *config) replica() (bool, error) {
+	switch c.Role {
+	case rolePrimary:
+		return false, nil
+	case roleReplica:
+		return true, nil
+	default:
+		return false, fmt.Errorf("'%s': %w", c.Role, errUnknownRole)
+	}
+}
+
+// grubProfile returns the named GRUB profile, or the default GRUB config if the name is
+// empty. Images built from either embed the modules needed by any distro's menu entries,
+// as well as the configured modules.
+func (c *config) grubProfile(name string) (*grub.Config, error) {
+	profile := &c.Grub
+	if name != "" {
+		var ok bool
+		if profile, ok = c.GrubProfiles[name]; !ok {
+			return nil, fmt.Errorf("'%s': %w", name, errUnknownGrubProfile)
+		}
+	}
+
+	withDistroModules := *profile
+	withDistroModules.Modules = slices.Clone(profile.Modules)
+
+	for _, distroName := range slices.Sorted(maps.Keys(c.Distros)) {
+		for _, module := range c.Distros[distroName].GrubModules {
+			if !slices.Contains(withDistroModules.Modules, module) {
+				withDistroModules.Modules = append(withDistroModules.Modules, module)
+			}
+		}
+	}
+
+	return &withDistroModules, nil
+}
+
+// kernelArgs returns the global kernel arguments, including those for the serial
+// console. The configured arguments are merged over the console's, so can replace them.
+func (c *config) kernelArgs() []string {
+	return cmdline.Merge(c.Grub.Serial.KernelArgs(), c.KernelArgs)
+}
+
+// staticDirs returns the static directories, in order of precedence
+func (c *config) staticDirs() []catalog.StaticDir {
+	if c.StaticDir == "" {
+		return c.StaticDirs
+	}
+
+	return append([]catalog.StaticDir{{Path: c.StaticDir}}, c.StaticDirs...)
+}
+
+func loadConfig(path string, site string) (*config, error) {
+	return readConfig(viper.GetViper(), path, site)
+}
+
+// readConfig reads the config at the given path, and the files it includes, into v, and
+// decodes it. If a site is named, the site's config is returned instead of the top-level
+// config.
+func readConfig(v *viper.Viper, path string, site string) (*config, error) {
+	values, sources, err := configfile.Load(path)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	if site != "" {
+		if values, err = siteValues(path, values, sources, site); err != nil {
+			return nil, err
+		}
+	}
+
+	config, err := decodeConfig(v, path, values, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	config.site = site
+
+	return config, nil
+}
+
+// decodeConfig decodes the config values read from the given path into a config, with
+// defaults for anything unset
+func decodeConfig(v *viper.Viper, path string, values map[string]any, sources *configfile.Sources) (*config, error) {
+	if err := v.MergeConfigMap(values); err != nil {
 		return nil, fmt.Errorf("failed to read config from '%s': %w", path, err)
 	}
 
-	config := &config{}
+	config := &config{sources: sources}
 
 	if err := defaults.Set(config); err != nil {
 		return nil, fmt.Errorf("failed to set config defaults: %w", err)
 	}
 
-	if err := viper.Unmarshal(config); err != nil {
+	setPlatformDefaults(config)
+
+	// Unknown keys are rejected, so that typos don't silently fall back to defaults
+	if err := v.UnmarshalExact(config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
+	// Profiles are created as they're decoded, so their defaults are filled in afterwards
+	for name, profile := range config.GrubProfiles {
+		if profile == nil {
+			profile = &grub.Config{}
+			config.GrubProfiles[name] = profile
+		}
+
+		if err := defaults.Set(profile); err != nil {
+			return nil, fmt.Errorf("failed to set defaults of GRUB profile '%s': %w", name, err)
+		}
+	}
+
 	return config, nil
 }
+
+func newConfigCommand(_ *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the config format",
+
+		// None of these commands need a config file to exist
+		PersistentPreRunE: func(_ *cobra.Command, _ []string) error {
+			return nil
+		},
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "schema",
+		Short: "Print a JSON Schema for the config file, for editors and CI validation",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+
+			schema := configschema.Generate(&config{}, "pixie config")
+
+			// Includes are merged before the config is decoded, so aren't a config field
+			schema.Properties[configfile.IncludeKey] = &configschema.Schema{
+				Type:  []string{"string", "array"},
+				Items: &configschema.Schema{Type: "string"},
+			}
+
+			// Sites have the same settings as the top level, except those of the process
+			site := *schema
+			site.Schema = ""
+			site.Title = ""
+			site.Properties = maps.Clone(schema.Properties)
+
+			for _, key := range processSettings {
+				delete(site.Properties, key)
+			}
+
+			delete(site.Properties, configfile.IncludeKey)
+
+			schema.Properties["sites"] = &configschema.Schema{Type: "object", AdditionalProperties: &site}
+
+			return encoder.Encode(schema) //nolint:wrapcheck
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "crds",
+		Short: "Print Kubernetes manifests for the Distro and Host custom resources, and a role to read them",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			_, err := fmt.Fprint(os.Stdout, kube.Manifests)
+			return err //nolint:wrapcheck
+		},
+	})
+
+	return cmd
+}
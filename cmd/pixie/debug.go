@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/davejbax/pixie/internal/bootloader"
+	"github.com/davejbax/pixie/pkg/efipe"
+	"github.com/davejbax/pixie/pkg/grub"
+	"github.com/spf13/cobra"
+)
+
+// Names of the PE section characteristics shown by 'pixie debug dump-pe'
+var sectionCharacteristics = []struct {
+	flag uint32
+	name string
+}{
+	{pe.IMAGE_SCN_CNT_CODE, "code"},
+	{pe.IMAGE_SCN_CNT_INITIALIZED_DATA, "data"},
+	{pe.IMAGE_SCN_CNT_UNINITIALIZED_DATA, "bss"},
+	{pe.IMAGE_SCN_MEM_DISCARDABLE, "discardable"},
+	{pe.IMAGE_SCN_MEM_EXECUTE, "exec"},
+	{pe.IMAGE_SCN_MEM_READ, "read"},
+	{pe.IMAGE_SCN_MEM_WRITE, "write"},
+}
+
+// grubImageOptions selects the GRUB image that debug commands build from the config
+type grubImageOptions struct {
+	arch    string
+	prefix  string
+	profile string
+}
+
+func (o *grubImageOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&o.arch, "arch", "x86_64", "Architecture of the GRUB image to build")
+	cmd.Flags().StringVar(&o.prefix, "prefix", bootloader.GRUBTFTPPrefix, "GRUB prefix to embed in the image")
+	cmd.Flags().StringVar(&o.profile, "profile", "", "GRUB profile to build the image with, rather than the default GRUB config")
+}
+
+// build lays out the GRUB image. The returned function closes the kernel.
+func (o *grubImageOptions) build(opts *rootOptions) (*grub.Image, func(), error) {
+	config, err := opts.config.grubProfile(o.profile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	image, cleanup, err := grub.NewImageFromConfig(config, o.arch, o.prefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create GRUB image from config: %w", err)
+	}
+
+	return image, cleanup, nil
+}
+
+func newDebugCommand(opts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "debug",
+		Short: "Inspect the images that pixie builds",
+	}
+
+	cmd.AddCommand(
+		newDebugDumpELFCommand(opts),
+		newDebugDumpPECommand(opts),
+	)
+
+	return cmd
+}
+
+func newDebugDumpELFCommand(opts *rootOptions) *cobra.Command {
+	image := &grubImageOptions{}
+	symbols := false
+	relocations := false
+
+	cmd := &cobra.Command{
+		Use:   "dump-elf",
+		Short: "Print how the GRUB kernel's ELF sections and modules are laid out in the EFI image built from the config",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			grubImage, cleanup, err := image.build(opts)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+
+			layout, err := grubImage.Layout()
+			if err != nil {
+				return fmt.Errorf("failed to get GRUB image layout: %w", err)
+			}
+
+			return printGRUBLayout(os.Stdout, layout, symbols, relocations)
+		},
+	}
+
+	image.addFlags(cmd)
+	cmd.Flags().BoolVar(&symbols, "symbols", false, "Also print the kernel's symbols, before and after relocation")
+	cmd.Flags().BoolVar(&relocations, "relocations", false, "Also print the relocations applied to the kernel's sections")
+
+	return cmd
+}
+
+func newDebugDumpPECommand(opts *rootOptions) *cobra.Command {
+	image := &grubImageOptions{}
+	relocations := false
+
+	cmd := &cobra.Command{
+		Use:   "dump-pe [file]",
+		Short: "Print the PE headers, sections and base relocations of an EFI image, or of the image built from the config",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			var r io.ReaderAt
+
+			if len(args) == 1 {
+				file, err := os.Open(args[0])
+				if err != nil {
+					return fmt.Errorf("failed to open EFI image: %w", err)
+				}
+				defer file.Close()
+
+				r = file
+			} else {
+				grubImage, cleanup, err := image.build(opts)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+
+				efi, err := efipe.New(grubImage, grubImage.PEHeaderSize())
+				if err != nil {
+					return fmt.Errorf("failed to create EFI PE image: %w", err)
+				}
+
+				buf := &bytes.Buffer{}
+				if _, err := efi.WriteTo(buf); err != nil {
+					return fmt.Errorf("failed to write EFI PE image: %w", err)
+				}
+
+				r = bytes.NewReader(buf.Bytes())
+			}
+
+			layout, err := efipe.ReadLayout(r)
+			if err != nil {
+				return fmt.Errorf("failed to read EFI image: %w", err)
+			}
+
+			return printPELayout(os.Stdout, layout, relocations)
+		},
+	}
+
+	image.addFlags(cmd)
+	cmd.Flags().BoolVar(&relocations, "relocations", false, "Also print every base relocation, rather than a count per page")
+
+	return cmd
+}
+
+func printGRUBLayout(out io.Writer, layout *grub.Layout, symbols bool, relocations bool) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Header size:\t0x%x\n", layout.HeaderSize)
+	fmt.Fprintf(w, "Image size:\t0x%x\n", layout.Size)
+	fmt.Fprintf(w, "Entrypoint:\t0x%x\n", layout.Entrypoint)
+
+	fmt.Fprintln(w, "\nSECTION\tELF SECTION\tINDEX\tELF ADDRESS\tADDRESS\tSIZE\tRELOCATIONS")
+
+	for _, section := range layout.Sections {
+		fmt.Fprintf(w, "%s\t\t\t\t0x%08x\t0x%x\t\n", section.Name, section.Address, section.Size)
+
+		for _, elfSection := range section.ELFSections {
+			fmt.Fprintf(w, "\t%s\t%d\t0x%08x\t0x%08x\t0x%x\t%d\n", elfSection.Name, elfSection.Index, elfSection.OriginalAddress, elfSection.Address, elfSection.Size, elfSection.Relocations)
+		}
+	}
+
+	fmt.Fprintln(w, "\nMODULE\tTYPE\tSIZE")
+
+	for _, mod := range layout.Modules {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", mod.Name, mod.Type, mod.Size)
+	}
+
+	if symbols {
+		fmt.Fprintln(w, "\nSYMBOL\tSECTION\tELF VALUE\tVALUE")
+
+		for _, symb := range layout.Symbols {
+			fmt.Fprintf(w, "%s\t%s\t0x%08x\t0x%08x\n", symb.Name, symb.Section, symb.OriginalValue, symb.Value)
+		}
+	}
+
+	if relocations {
+		fmt.Fprintln(w, "\nSECTION\tTYPE\tADDRESS\tSYMBOL\tADDEND\tLOADER")
+
+		for _, reloc := range layout.Relocations {
+			fmt.Fprintf(w, "%s\t%s\t0x%08x\t%s\t%d\t%t\n", reloc.Section, reloc.Type, reloc.Address, reloc.Symbol, reloc.Addend, reloc.Loader)
+		}
+	}
+
+	return w.Flush() //nolint:wrapcheck
+}
+
+func printPELayout(out io.Writer, layout *efipe.Layout, relocations bool) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Machine:\t0x%04x\n", uint16(layout.Machine))
+	fmt.Fprintf(w, "Subsystem:\t%d\n", layout.Subsystem)
+	fmt.Fprintf(w, "Entrypoint:\t0x%x\n", layout.Entrypoint)
+	fmt.Fprintf(w, "Base of code:\t0x%x\n", layout.BaseOfCode)
+	fmt.Fprintf(w, "Headers size:\t0x%x\n", layout.SizeOfHeaders)
+	fmt.Fprintf(w, "Image size:\t0x%x\n", layout.SizeOfImage)
+
+	fmt.Fprintln(w, "\nSECTION\tADDRESS\tVIRTUAL SIZE\tOFFSET\tSIZE\tCHARACTERISTICS")
+
+	for _, section := range layout.Sections {
+		fmt.Fprintf(w, "%s\t0x%08x\t0x%x\t0x%08x\t0x%x\t%s\n", section.Name, section.VirtualAddress, section.VirtualSize, section.Offset, section.Size, characteristicNames(section.Characteristics))
+	}
+
+	fmt.Fprintln(w, "\nPAGE\tRELOCATIONS")
+
+	for _, block := range layout.RelocationBlocks {
+		if !relocations {
+			fmt.Fprintf(w, "0x%08x\t%d\n", block.PageRVA, len(block.Relocations))
+			continue
+		}
+
+		for _, reloc := range block.Relocations {
+			fmt.Fprintf(w, "0x%08x\t0x%08x (type %d)\n", block.PageRVA, reloc.FileOffset, reloc.Kind)
+		}
+	}
+
+	return w.Flush() //nolint:wrapcheck
+}
+
+func characteristicNames(characteristics uint32) string {
+	names := []string{}
+
+	for _, characteristic := range sectionCharacteristics {
+		if characteristics&characteristic.flag != 0 {
+			names = append(names, characteristic.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+
+	"github.com/davejbax/pixie/internal/artifact"
+	"github.com/davejbax/pixie/internal/catalog"
+	"github.com/davejbax/pixie/internal/dhcp"
+	"github.com/davejbax/pixie/pkg/efipe"
+	"github.com/spf13/cobra"
+)
+
+// Port that DHCP clients fetch boot files from over TFTP, which can't be changed in offers
+const standardTFTPPort = "69"
+
+var errNotIPv4 = errors.New("DHCPv4 servers need pixie's IPv4 address")
+
+func newDHCPConfigCommand(opts *rootOptions) *cobra.Command {
+	formats := []string{dhcp.SnippetDnsmasq, dhcp.SnippetISC, dhcp.SnippetKea}
+
+	cmd := &cobra.Command{
+		Use:   "dhcp-config <dnsmasq|isc|kea>",
+		Short: "Print the config that another DHCP server needs for PXE clients to boot from pixie",
+		Long: `Print a config snippet for an existing DHCP server (dnsmasq, ISC dhcpd, or Kea's
+DHCPv4 server, as JSON) that offers PXE clients the boot file for their architecture, on
+pixie's TFTP server, as pixie's own DHCP and ProxyDHCP servers would. UEFI HTTP boot
+clients are offered the same files as URLs on pixie's HTTP server, and hosts with GRUB
+profiles (matched by MAC address) are offered the profile's files.
+
+The snippet reflects the current config, so it should be generated again when boot files,
+addresses or hosts' GRUB profiles change.`,
+		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		ValidArgs: formats,
+		RunE: func(_ *cobra.Command, args []string) error {
+			snippet, err := newDHCPSnippet(opts)
+			if err != nil {
+				return err
+			}
+
+			return snippet.Write(os.Stdout, args[0]) //nolint:wrapcheck
+		},
+	}
+
+	return cmd
+}
+
+// newDHCPSnippet describes the boot files and servers that pixie offers PXE clients
+func newDHCPSnippet(opts *rootOptions) (*dhcp.Snippet, error) {
+	bootloaders, err := newBootloaders(opts, artifact.NewCache())
+	if err != nil {
+		return nil, err
+	}
+
+	stateDB, err := openStateDB(opts.config)
+	if err != nil {
+		return nil, err
+	}
+
+	if stateDB != nil {
+		defer stateDB.Close()
+	}
+
+	hostStore, err := openHostStore(opts.config, stateDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open host store: %w", err)
+	}
+
+	hostTable, err := newHostTable(opts.config, hostStore.Configs())
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL, err := httpBaseURL(opts.config)
+	if err != nil {
+		return nil, err
+	}
+
+	serverIP, err := httpServerIP(opts.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine TFTP server address: %w", err)
+	}
+
+	if serverIP.To4() == nil {
+		return nil, fmt.Errorf("'%s': %w", serverIP, errNotIPv4)
+	}
+
+	if _, port, err := net.SplitHostPort(opts.config.TFTP.Address); err == nil && port != standardTFTPPort {
+		opts.logger.Warn("TFTP server isn't on the standard port, which PXE clients always use",
+			"address", opts.config.TFTP.Address,
+		)
+	}
+
+	files, err := catalog.New(opts.logger.With("subsystem", "catalog"), bootloaders, nil, hostTable, nil, nil, nil, opts.config.kernelArgs(), baseURL, nil, &opts.config.Menu, &opts.config.Templates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file catalog: %w", err)
+	}
+
+	biosBootFile := opts.config.DHCP.BIOSBootFile
+	if opts.config.ProxyDHCP.Enabled {
+		biosBootFile = opts.config.ProxyDHCP.BIOSBootFile
+	}
+
+	snippet := &dhcp.Snippet{
+		ServerIP:     serverIP.To4(),
+		BaseURL:      baseURL,
+		BootFiles:    files.BootFiles(),
+		BIOSBootFile: biosBootFile,
+	}
+
+	machines := []efipe.Machine{}
+	for _, bl := range bootloaders {
+		machines = append(machines, bl.Machines()...)
+	}
+
+	slices.Sort(machines)
+	machines = slices.Compact(machines)
+
+	profiles := make(map[string]*dhcp.SnippetProfile)
+
+	for _, host := range hostTable.Hosts() {
+		if host.GrubProfile == "" || host.MAC() == nil {
+			continue
+		}
+
+		profile, ok := profiles[host.GrubProfile]
+		if !ok {
+			// Machine types without an entrypoint in the profile are offered the default
+			profile = &dhcp.SnippetProfile{Name: host.GrubProfile, BootFiles: make(map[efipe.Machine]string)}
+			for _, machine := range machines {
+				if bootFile, ok := files.BootFile(machine, host.MAC(), "", nil); ok {
+					profile.BootFiles[machine] = bootFile
+				}
+			}
+
+			profiles[host.GrubProfile] = profile
+		}
+
+		profile.MACs = append(profile.MACs, host.MAC())
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(profiles)) {
+		snippet.Profiles = append(snippet.Profiles, profiles[name])
+	}
+
+	return snippet, nil
+}
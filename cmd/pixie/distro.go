@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/davejbax/pixie/internal/distro"
+	"github.com/davejbax/pixie/internal/reconcile"
+	"github.com/spf13/cobra"
+)
+
+func newDistroCommand(opts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "distro",
+		Short: "Inspect, approve and roll back the downloaded versions of distros",
+		Long: `Inspect, approve and roll back the downloaded versions of distros.
+
+Each version that a reconcile activates is recorded in the distro's history, and the
+last few versions are kept (see storage_quota.keep_versions), so that a distro can be
+rolled back if a new version breaks installs. Distros with auto_update disabled are only
+updated to new versions once they're approved.`,
+	}
+
+	cmd.AddCommand(
+		newDistroHistoryCommand(opts),
+		newDistroRollbackCommand(opts),
+		newDistroUnpinCommand(opts),
+		newDistroApproveCommand(opts),
+	)
+
+	return cmd
+}
+
+func newDistroManager(opts *rootOptions) (*distro.Manager, error) {
+	artifacts, err := openArtifactStore(opts.config)
+	if err != nil {
+		return nil, err
+	}
+
+	manager, err := distro.NewManager(opts.logger.With("subsystem", "distro"), opts.config.StorageDir, artifacts, &opts.config.StorageQuota, opts.config.Distros, opts.config.MaintenanceWindows, &opts.config.OCI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create distro manager: %w", err)
+	}
+
+	return manager, nil
+}
+
+func newDistroHistoryCommand(opts *rootOptions) *cobra.Command {
+	format := outputFormatTable
+
+	cmd := &cobra.Command{
+		Use:   "history <name>",
+		Short: "List the versions of a distro that have been active, oldest first",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			manager, err := newDistroManager(opts)
+			if err != nil {
+				return err
+			}
+
+			versions, err := manager.History(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to read distro history: %w", err)
+			}
+
+			if format == outputFormatJSON {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+
+				return encoder.Encode(versions) //nolint:wrapcheck
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ARCH\tHASH\tVERSION\tACTIVATED\tSTATUS")
+
+			for _, version := range versions {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+					version.Arch,
+					shortHash(version.Hash),
+					orDash(version.Version),
+					version.Activated.Format(time.RFC3339),
+					versionStatus(version),
+				)
+			}
+
+			return w.Flush() //nolint:wrapcheck
+		},
+	}
+
+	cmd.Flags().VarP(&format, "output", "o", "Output format")
+
+	return cmd
+}
+
+// versionStatus describes whether a version is active and can be rolled back to
+func versionStatus(version *distro.Version) string {
+	statuses := []string{}
+
+	if version.Active {
+		statuses = append(statuses, "active")
+	}
+
+	if version.Pinned {
+		statuses = append(statuses, "pinned")
+	}
+
+	if !version.Stored {
+		statuses = append(statuses, "deleted")
+	}
+
+	return orDash(strings.Join(statuses, ", "))
+}
+
+func newDistroRollbackCommand(opts *rootOptions) *cobra.Command {
+	arch := ""
+	hash := ""
+
+	cmd := &cobra.Command{
+		Use:   "rollback <name>",
+		Short: "Make an earlier version of a distro active again, and keep it until the distro is unpinned",
+		Long: `Make an earlier version of a distro active again: by default, the latest version
+before the active one whose files are still stored, or with --to, the version whose hash
+starts with the given prefix (as listed by 'pixie distro history').
+
+The distro is pinned to the version, so that reconciles keep it active rather than
+updating it again, until 'pixie distro unpin' is run. The pixie running on this machine
+is then asked to reconcile, so that it serves the version and regenerates its boot
+configs; replicas pick it up when they next refresh.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manager, err := newDistroManager(opts)
+			if err != nil {
+				return err
+			}
+
+			versions, err := manager.Rollback(args[0], arch, hash)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			for _, version := range versions {
+				opts.logger.Info("rolled back distro",
+					"distro", args[0],
+					"arch", version.Arch,
+					"hash", version.Hash,
+					"activated", version.Activated,
+				)
+			}
+
+			notifyServer(cmd.Context(), opts)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&arch, "arch", "", "Only roll back this arch of the distro (default: every arch)")
+	cmd.Flags().StringVar(&hash, "to", "", "Hash, or hash prefix, of the version to roll back to (requires --arch if the distro has several arches)")
+
+	return cmd
+}
+
+func newDistroUnpinCommand(opts *rootOptions) *cobra.Command {
+	arch := ""
+
+	cmd := &cobra.Command{
+		Use:   "unpin <name>",
+		Short: "Let reconciles update a distro that was rolled back again",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manager, err := newDistroManager(opts)
+			if err != nil {
+				return err
+			}
+
+			arches, err := manager.Unpin(args[0], arch)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			if len(arches) == 0 {
+				opts.logger.Info("distro isn't pinned",
+					"distro", args[0],
+				)
+
+				return nil
+			}
+
+			opts.logger.Info("unpinned distro",
+				"distro", args[0],
+				"arches", arches,
+			)
+
+			notifyServer(cmd.Context(), opts)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&arch, "arch", "", "Only unpin this arch of the distro (default: every arch)")
+
+	return cmd
+}
+
+func newDistroApproveCommand(opts *rootOptions) *cobra.Command {
+	arch := ""
+
+	cmd := &cobra.Command{
+		Use:   "approve <name>",
+		Short: "Approve the new version of a distro that isn't updated automatically",
+		Long: `Approve the new version of a distro with auto_update disabled, as reported by
+'pixie status', so that the next reconcile downloads and activates it (subject to
+maintenance windows). The pixie running on this machine is then asked to reconcile.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			manager, err := newDistroManager(opts)
+			if err != nil {
+				return err
+			}
+
+			approved, err := manager.Approve(args[0], arch)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			if len(approved) == 0 {
+				opts.logger.Info("no new version of distro awaits approval",
+					"distro", args[0],
+				)
+
+				return nil
+			}
+
+			for arch, hash := range approved {
+				opts.logger.Info("approved new version of distro",
+					"distro", args[0],
+					"arch", arch,
+					"hash", hash,
+				)
+			}
+
+			notifyServer(cmd.Context(), opts)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&arch, "arch", "", "Only approve the new version of this arch of the distro (default: every arch)")
+
+	return cmd
+}
+
+// notifyServer asks the pixie running on this machine to reconcile, so that it applies
+// changes to the active distro versions now, rather than at its next reconcile. Failures
+// are only logged, as pixie may not be running.
+func notifyServer(ctx context.Context, opts *rootOptions) {
+	token := ""
+	if len(opts.config.API.Tokens) > 0 {
+		token = opts.config.API.Tokens[0]
+	}
+
+	if err := requestReconcile(ctx, opts.config, token); err != nil {
+		opts.logger.Warn("failed to ask the running pixie to reconcile; it applies the change at its next reconcile",
+			"error", err,
+		)
+
+		return
+	}
+
+	opts.logger.Info("asked the running pixie to reconcile")
+}
+
+func requestReconcile(ctx context.Context, config *config, token string) error {
+	serverURL, err := localAPIURL(config)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, serverURL+reconcile.Path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create reconcile request: %w", err)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request reconcile: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("%s: %w", resp.Status, errStatusRequest)
+	}
+
+	return nil
+}
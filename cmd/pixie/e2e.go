@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/davejbax/pixie/internal/e2e"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const defaultE2EExpect = `(?i)anaconda|starting installer`
+
+var errUnknownDistro = errors.New("distro is not in config")
+
+func newE2ECommand(opts *rootOptions) *cobra.Command {
+	targets := []string{}
+	distro := ""
+	expect := ""
+	timeout := time.Duration(0)
+	workDirectory := ""
+	firmware := map[string]string{}
+
+	cmd := &cobra.Command{
+		Use:   "e2e",
+		Short: "Boot ephemeral QEMU VMs from pixie on a private network, and check that they reach the installer",
+		Long: `Boot ephemeral QEMU VMs from pixie on a private network, and check that they reach the installer.
+
+This creates a network namespace with a bridge, and runs pixie inside it with the
+current config, modified to serve DHCP on the bridge. Each target VM network boots from
+pixie, and passes once the expected pattern appears on its serial console.
+
+Requires root (or CAP_NET_ADMIN), iproute2, QEMU, and UEFI firmware images for the UEFI
+targets. The BIOS target isn't booted by default, as it needs a BIOS boot file to be
+configured for DHCP or proxyDHCP.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			pattern, err := regexp.Compile(expect)
+			if err != nil {
+				return fmt.Errorf("invalid expect pattern: %w", err)
+			}
+
+			if workDirectory == "" {
+				workDirectory, err = os.MkdirTemp("", "pixie-e2e-*")
+			} else {
+				err = os.MkdirAll(workDirectory, 0o755)
+			}
+
+			if err != nil {
+				return fmt.Errorf("failed to create work directory: %w", err)
+			}
+
+			configPath, err := writeE2EConfig(workDirectory, distro, false)
+			if err != nil {
+				return err
+			}
+
+			pixiePath, err := os.Executable()
+			if err != nil {
+				return fmt.Errorf("failed to find pixie executable: %w", err)
+			}
+
+			results, runErr := e2e.Run(cmd.Context(), opts.logger, &e2e.Options{
+				PixiePath:     pixiePath,
+				ConfigPath:    configPath,
+				Targets:       targets,
+				Firmware:      firmware,
+				Expect:        pattern,
+				Timeout:       timeout,
+				WorkDirectory: workDirectory,
+			})
+
+			if err := printE2EResults(results); err != nil {
+				return err
+			}
+
+			if runErr != nil {
+				return fmt.Errorf("end-to-end test failed: %w", runErr)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&targets, "target", e2e.DefaultTargets(), "Targets to boot (any of "+strings.Join(e2e.Targets(), ", ")+")")
+	cmd.Flags().StringVar(&distro, "distro", "", "Only serve the named distro from config, so that VMs boot its installer")
+	cmd.Flags().StringVar(&expect, "expect", defaultE2EExpect, "Pattern in the serial console output that marks a successful boot")
+	cmd.Flags().DurationVar(&timeout, "timeout", 10*time.Minute, "How long each VM has to reach the expected pattern")
+	cmd.Flags().StringVar(&workDirectory, "work-dir", "", "Directory for logs and generated config (defaults to a new temporary directory)")
+	cmd.Flags().StringToStringVar(&firmware, "firmware", map[string]string{}, "Firmware image to use for a target, as target=path")
+
+	return cmd
+}
+
+func printE2EResults(results []*e2e.Result) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tRESULT\tDURATION\tLOG")
+
+	for _, result := range results {
+		status := "pass"
+		if result.Err != nil {
+			status = "fail: " + result.Err.Error()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Target, status, result.Duration.Round(time.Second), result.LogPath)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write results: %w", err)
+	}
+
+	return nil
+}
+
+// writeE2EConfig writes a copy of the current config, modified to serve DHCP on the
+// end-to-end test network. If serial is set, GRUB is also made to use the serial
+// console, so that its menu can be seen in the VMs' logs.
+//
+// Any BIOS boot file configured for DHCP or proxyDHCP is offered by the test DHCP server,
+// so that BIOS targets can boot.
+func writeE2EConfig(workDirectory string, distro string, serial bool) (string, error) {
+	rangeStart, rangeEnd := e2e.DHCPRange()
+
+	biosBootFile := viper.GetString("dhcp.bios_boot_file")
+	if biosBootFile == "" {
+		biosBootFile = viper.GetString("proxy_dhcp.bios_boot_file")
+	}
+
+	settings := viper.AllSettings()
+	settings["dhcp"] = map[string]any{
+		"enabled":        true,
+		"server_ip":      e2e.ServerIP(),
+		"range_start":    rangeStart,
+		"range_end":      rangeEnd,
+		"bios_boot_file": biosBootFile,
+	}
+	settings["proxy_dhcp"] = map[string]any{"enabled": false}
+
+	if serial {
+		grubSettings, _ := settings["grub"].(map[string]any)
+		if grubSettings == nil {
+			grubSettings = map[string]any{}
+		}
+
+		serialSettings, _ := grubSettings["serial"].(map[string]any)
+		if serialSettings == nil {
+			serialSettings = map[string]any{}
+		}
+
+		serialSettings["enabled"] = true
+		grubSettings["serial"] = serialSettings
+		settings["grub"] = grubSettings
+	}
+
+	if distro != "" {
+		distros, _ := settings["distros"].(map[string]any)
+
+		distroConfig, ok := distros[distro]
+		if !ok {
+			return "", fmt.Errorf("'%s': %w", distro, errUnknownDistro)
+		}
+
+		settings["distros"] = map[string]any{distro: distroConfig}
+	}
+
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return "", fmt.Errorf("failed to copy config: %w", err)
+	}
+
+	configPath := filepath.Join(workDirectory, "config.yaml")
+	if err := v.WriteConfigAs(configPath); err != nil {
+		return "", fmt.Errorf("failed to write end-to-end test config: %w", err)
+	}
+
+	return configPath, nil
+}
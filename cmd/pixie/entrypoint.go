@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/davejbax/pixie/internal/bootloader"
+	"github.com/davejbax/pixie/internal/entrypoint"
+	"github.com/davejbax/pixie/internal/oci"
+	"github.com/davejbax/pixie/pkg/efipe"
+	"github.com/davejbax/pixie/pkg/grub"
+	"github.com/spf13/cobra"
+)
+
+const entrypointDirectory = "entrypoints"
+
+func newEntrypointStore(opts *rootOptions) *entrypoint.Store {
+	return entrypoint.NewStore(filepath.Join(opts.config.StorageDir, entrypointDirectory))
+}
+
+func newEntrypointCommand(opts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "entrypoint",
+		Short: "Manage the EFI entrypoint images served to clients",
+	}
+
+	cmd.AddCommand(
+		newEntrypointBuildCommand(opts),
+		newEntrypointListCommand(opts),
+		newEntrypointSwitchCommand(opts),
+		newEntrypointRollbackCommand(opts),
+		newEntrypointPromoteCommand(opts),
+	)
+
+	return cmd
+}
+
+func newEntrypointBuildCommand(opts *rootOptions) *cobra.Command {
+	arch := ""
+	prefix := ""
+	force := false
+	push := ""
+
+	cmd := &cobra.Command{
+		Use:   "build",
+		Short: "Build a new EFI entrypoint image and make it active, keeping the previous image as a fallback",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			grubConfig, err := opts.config.grubProfile("")
+			if err != nil {
+				return err
+			}
+
+			grubImage, cleanup, err := grub.NewImageFromConfig(grubConfig, arch, prefix)
+			if err != nil {
+				return fmt.Errorf("failed to create GRUB image from config: %w", err)
+			}
+			defer cleanup()
+
+			efi, err := efipe.New(grubImage, grubImage.PEHeaderSize())
+			if err != nil {
+				return fmt.Errorf("failed to create EFI PE image: %w", err)
+			}
+
+			windowOpen, err := opts.config.MaintenanceWindows.Open(time.Now())
+			if err != nil {
+				return fmt.Errorf("failed to check maintenance windows: %w", err)
+			}
+
+			slot, err := newEntrypointStore(opts).Install(arch, efi, force || windowOpen)
+			if err != nil {
+				return fmt.Errorf("failed to install entrypoint image: %w", err)
+			}
+
+			opts.logger.Info("successfully built entrypoint image",
+				"arch", arch,
+				"slot", slot,
+				"activated", force || windowOpen,
+			)
+
+			if push == "" {
+				return nil
+			}
+
+			path, err := newEntrypointStore(opts).ImagePath(arch, slot)
+			if err != nil {
+				return fmt.Errorf("failed to find entrypoint image: %w", err)
+			}
+
+			return pushArtifact(opts, push, oci.ArtifactTypeEFI, oci.File{Path: path, Title: "pixie-" + arch + ".efi"})
+		},
+	}
+
+	cmd.Flags().StringVar(&arch, "arch", "x86_64", "Architecture to build the entrypoint image for")
+	cmd.Flags().StringVar(&prefix, "prefix", bootloader.GRUBTFTPPrefix, "GRUB prefix to embed in the entrypoint image")
+	cmd.Flags().BoolVar(&force, "force", false, "Activate the image immediately, even outside of maintenance windows")
+	cmd.Flags().StringVar(&push, "push", "", "Also push the image to an OCI registry as an artifact with this reference, e.g. 'ghcr.io/example/pixie-efi:v1'")
+
+	return cmd
+}
+
+func newEntrypointListCommand(opts *rootOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List entrypoint image slots for every arch",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			store := newEntrypointStore(opts)
+
+			arches, err := store.Arches()
+			if err != nil {
+				return fmt.Errorf("failed to list entrypoint arches: %w", err)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ARCH\tSLOT\tSTATUS\tBUILT\tSIZE\tSHA256")
+
+			for _, arch := range arches {
+				state, err := store.State(arch)
+				if err != nil {
+					return fmt.Errorf("failed to get entrypoint state for arch '%s': %w", arch, err)
+				}
+
+				for _, slot := range []entrypoint.Slot{entrypoint.SlotA, entrypoint.SlotB, entrypoint.SlotStaged} {
+					info, ok := state.Slots[slot]
+					if !ok {
+						continue
+					}
+
+					status := ""
+					switch slot {
+					case state.Active:
+						status = "active"
+					case state.Staged:
+						status = "staged"
+					}
+
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", arch, slot, status, info.BuiltAt.Format(time.RFC3339), info.Size, info.SHA256)
+				}
+			}
+
+			return w.Flush() //nolint:wrapcheck
+		},
+	}
+}
+
+func newEntrypointSwitchCommand(opts *rootOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "switch <arch> <a|b>",
+		Short: "Switch the entrypoint image served for an arch to the given slot",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			slot, err := entrypoint.ParseSlot(args[1])
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			if err := newEntrypointStore(opts).Switch(args[0], slot); err != nil {
+				return fmt.Errorf("failed to switch entrypoint slot: %w", err)
+			}
+
+			opts.logger.Info("switched active entrypoint image",
+				"arch", args[0],
+				"slot", slot,
+			)
+
+			return nil
+		},
+	}
+}
+
+func newEntrypointRollbackCommand(opts *rootOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "rollback <arch>",
+		Short: "Switch the entrypoint image served for an arch back to the previous image",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			slot, err := newEntrypointStore(opts).Rollback(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to roll back entrypoint image: %w", err)
+			}
+
+			opts.logger.Info("rolled back entrypoint image",
+				"arch", args[0],
+				"slot", slot,
+			)
+
+			return nil
+		},
+	}
+}
+
+func newEntrypointPromoteCommand(opts *rootOptions) *cobra.Command {
+	force := false
+
+	cmd := &cobra.Command{
+		Use:   "promote",
+		Short: "Activate staged entrypoint images if a maintenance window is open",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			windowOpen, err := opts.config.MaintenanceWindows.Open(time.Now())
+			if err != nil {
+				return fmt.Errorf("failed to check maintenance windows: %w", err)
+			}
+
+			if !windowOpen && !force {
+				opts.logger.Info("not promoting staged entrypoint images, as no maintenance window is open")
+				return nil
+			}
+
+			store := newEntrypointStore(opts)
+
+			arches, err := store.Arches()
+			if err != nil {
+				return fmt.Errorf("failed to list entrypoint arches: %w", err)
+			}
+
+			for _, arch := range arches {
+				promoted, err := store.Promote(arch)
+				if err != nil {
+					return fmt.Errorf("failed to promote staged entrypoint for arch '%s': %w", arch, err)
+				}
+
+				if promoted {
+					opts.logger.Info("promoted staged entrypoint image",
+						"arch", arch,
+					)
+				}
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&force, "force", false, "Promote staged images even outside of maintenance windows")
+
+	return cmd
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/davejbax/pixie/internal/artifact"
+	"github.com/davejbax/pixie/internal/catalog"
+	"github.com/davejbax/pixie/internal/export"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var errNoExportDestination = errors.New("--dest is required")
+
+func newExportCommand(opts *rootOptions) *cobra.Command {
+	dest := ""
+	options := &export.Options{}
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Copy the files that pixie serves into a directory served by another TFTP or HTTP server",
+		Long: `Copy the files that pixie serves over TFTP and HTTP into a directory, such as
+/var/lib/tftpboot, so that an existing server (e.g. dnsmasq or nginx) can serve them
+instead. The directory gets the same tree as pixie serves: bootloader entrypoints and
+files, generated configs (including those of hosts matched by MAC address), distro
+kernels, initrds and installation trees, static files, and hosts' automation files.
+
+Files that are already up to date are left alone, so the export can be run again after
+each reconcile. Configs are generated as for a client that pixie knows nothing about, so
+hosts matched by UUID or CIDR, and one-shot assignments, aren't applied.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			if dest == "" {
+				return errNoExportDestination
+			}
+
+			files, err := newExportCatalog(opts)
+			if err != nil {
+				return err
+			}
+
+			exporter := export.New(opts.logger.With("subsystem", "export"), dest, options, os.Stdout)
+
+			if err := files.Export(exporter.Write); err != nil {
+				return fmt.Errorf("failed to export files: %w", err)
+			}
+
+			result, err := exporter.Finish()
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			message := "exported files"
+			if options.DryRun {
+				message = "would export files"
+			}
+
+			opts.logger.Info(message,
+				"dest", dest,
+				"written", result.Written,
+				"unchanged", result.Unchanged,
+				"deleted", result.Deleted,
+				"size", formatSize(result.Bytes),
+			)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&dest, "dest", "", "Directory to copy the files into")
+	cmd.Flags().BoolVar(&options.Delete, "delete", false, "Delete files in the directory that pixie doesn't serve")
+	cmd.Flags().BoolVar(&options.DryRun, "dry-run", false, "Only print the files that would be written and deleted")
+
+	return cmd
+}
+
+// newExportCatalog creates a catalog of the files served with the active distros. It has
+// no client registry, one-shot store or audit log, so that exporting files has no effect
+// on hosts' state.
+func newExportCatalog(opts *rootOptions) (*catalog.Catalog, error) {
+	bootloaders, err := newBootloaders(opts, artifact.NewCache())
+	if err != nil {
+		return nil, err
+	}
+
+	manager, err := newDistroManager(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	distros, err := manager.Active()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load distros: %w", err)
+	}
+
+	stateDB, err := openStateDB(opts.config)
+	if err != nil {
+		return nil, err
+	}
+
+	if stateDB != nil {
+		defer stateDB.Close()
+	}
+
+	hostStore, err := openHostStore(opts.config, stateDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open host store: %w", err)
+	}
+
+	hostTable, err := newHostTable(opts.config, hostStore.Configs())
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL, err := httpBaseURL(opts.config)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := catalog.New(opts.logger.With("subsystem", "catalog"), bootloaders, distros, hostTable, nil, nil, nil, opts.config.kernelArgs(), baseURL, opts.config.staticDirs(), &opts.config.Menu, &opts.config.Templates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file catalog: %w", err)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/davejbax/pixie/pkg/grub"
+	"github.com/spf13/cobra"
+)
+
+var errEmptyPassword = errors.New("password must not be empty")
+
+func newGrubCommand(_ *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "grub",
+		Short: "GRUB helpers",
+
+		// None of these commands need a config file to exist
+		PersistentPreRunE: func(_ *cobra.Command, _ []string) error {
+			return nil
+		},
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "hash-password",
+		Short: "Hash a password read from standard input, for use as a GRUB superuser's password_hash",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			fmt.Fprint(os.Stderr, "Enter password: ")
+
+			password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && password == "" {
+				return fmt.Errorf("failed to read password: %w", err)
+			}
+
+			password = strings.TrimRight(password, "\r\n")
+			if password == "" {
+				return errEmptyPassword
+			}
+
+			hash, err := grub.HashPassword(password)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			_, err = fmt.Fprintln(os.Stdout, hash)
+			return err //nolint:wrapcheck
+		},
+	})
+
+	return cmd
+}
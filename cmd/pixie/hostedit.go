@@ -0,0 +1,621 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/davejbax/pixie/internal/bmc"
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/oneshot"
+	"github.com/davejbax/pixie/internal/store"
+	"github.com/davejbax/pixie/internal/wol"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Where a host is defined, as listed by 'pixie hosts list'
+const (
+	hostSourceConfig    = "config"
+	hostSourceDirectory = "directory"
+	hostSourceStore     = "store"
+)
+
+var (
+	errHostExists      = errors.New("host already exists")
+	errUnknownHost     = errors.New("unknown host")
+	errConfigHost      = errors.New("host is defined in the config file, and must be changed there")
+	errNoNextBoot      = errors.New("either --distro or --once must be given")
+	errUnmatchedClient = errors.New("no host has MAC address")
+	errNoHostMAC       = errors.New("host isn't matched by MAC address, so can't be woken")
+	errNoBMC           = errors.New("host has no BMC")
+)
+
+// hostWriter is where the CLI writes hosts: the hosts directory, if one is configured,
+// and otherwise the state store
+type hostWriter interface {
+	Get(name string) (hosts.Config, bool)
+	Put(config hosts.Config) error
+	Delete(name string) error
+}
+
+// hostEditor opens what is needed to change hosts, and validates changes against the
+// rest of the config
+type hostEditor struct {
+	opts *rootOptions
+
+	stateDB   *store.DB
+	hostStore *hosts.Store
+	writer    hostWriter
+
+	// Description of where hosts are written, for messages
+	destination string
+}
+
+func openHostEditor(opts *rootOptions) (*hostEditor, error) {
+	stateDB, err := openStateDB(opts.config)
+	if err != nil {
+		return nil, err
+	}
+
+	hostStore, err := openHostStore(opts.config, stateDB)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open host store: %w", err)
+	}
+
+	editor := &hostEditor{
+		opts:        opts,
+		stateDB:     stateDB,
+		hostStore:   hostStore,
+		writer:      hostStore,
+		destination: "state store",
+	}
+
+	if opts.config.HostsDir != "" {
+		directory, err := hosts.OpenDirectory(opts.config.HostsDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open hosts directory: %w", err)
+		}
+
+		editor.writer = directory
+		editor.destination = "hosts directory"
+	}
+
+	return editor, nil
+}
+
+func (e *hostEditor) Close() {
+	if e.stateDB != nil {
+		_ = e.stateDB.Close()
+	}
+}
+
+// table builds the host table from all sources
+func (e *hostEditor) table() (*hosts.Table, error) {
+	return newHostTable(e.opts.config, e.hostStore.Configs())
+}
+
+// put saves a host, restoring the previous hosts if the result is invalid
+func (e *hostEditor) put(config hosts.Config) error {
+	previous, existed := e.writer.Get(config.Name)
+
+	if err := e.writer.Put(config); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	if _, err := e.table(); err != nil {
+		if existed {
+			err = errors.Join(err, e.writer.Put(previous))
+		} else {
+			err = errors.Join(err, e.writer.Delete(config.Name))
+		}
+
+		return fmt.Errorf("invalid host: %w", err)
+	}
+
+	return nil
+}
+
+// putAll saves several hosts, restoring the previous hosts if any is invalid
+func (e *hostEditor) putAll(configs []hosts.Config) error {
+	var restore []func() error
+
+	rollback := func(err error) error {
+		for i := len(restore) - 1; i >= 0; i-- {
+			err = errors.Join(err, restore[i]())
+		}
+
+		return err
+	}
+
+	for _, config := range configs {
+		previous, existed := e.writer.Get(config.Name)
+
+		if err := e.writer.Put(config); err != nil {
+			return rollback(err)
+		}
+
+		if existed {
+			restore = append(restore, func() error { return e.writer.Put(previous) })
+		} else {
+			restore = append(restore, func() error { return e.writer.Delete(config.Name) })
+		}
+	}
+
+	if _, err := e.table(); err != nil {
+		return fmt.Errorf("invalid hosts: %w", rollback(err))
+	}
+
+	return nil
+}
+
+// source returns where the named host is defined
+func (e *hostEditor) source(name string) string {
+	if _, ok := e.hostStore.Get(name); ok {
+		return hostSourceStore
+	}
+
+	if directory, ok := e.writer.(*hosts.Directory); ok {
+		if _, ok := directory.Get(name); ok {
+			return hostSourceDirectory
+		}
+	}
+
+	return hostSourceConfig
+}
+
+// editable returns the host's config, if it is one that the CLI can change
+func (e *hostEditor) editable(name string) (hosts.Config, error) {
+	if config, ok := e.writer.Get(name); ok {
+		return config, nil
+	}
+
+	hostTable, err := e.table()
+	if err != nil {
+		return hosts.Config{}, err
+	}
+
+	if _, ok := hostTable.Get(name); ok {
+		return hosts.Config{}, fmt.Errorf("'%s': %w", name, errConfigHost)
+	}
+
+	return hosts.Config{}, fmt.Errorf("'%s': %w", name, errUnknownHost)
+}
+
+// hostFlags are the settings of a host that can be given on the command line
+type hostFlags struct {
+	mac, uuid, cidr string
+	profile         string
+	distro          string
+	args            []string
+	automation      string
+	vars            map[string]string
+	localBootFirst  bool
+}
+
+func (f *hostFlags) register(flags *pflag.FlagSet) {
+	flags.StringVar(&f.mac, "mac", "", "MAC address of the host's boot interface")
+	flags.StringVar(&f.uuid, "uuid", "", "SMBIOS system UUID of the host")
+	flags.StringVar(&f.cidr, "cidr", "", "Range of IP addresses that the host config applies to")
+	flags.StringVar(&f.profile, "profile", "", "Profile to take settings from")
+	flags.StringVar(&f.distro, "distro", "", "Distro to boot")
+	flags.StringArrayVar(&f.args, "arg", nil, "Kernel argument (may be repeated)")
+	flags.StringVar(&f.automation, "automation", "", "Path of the install automation file to serve to the host, relative to the templates directory")
+	flags.StringToStringVar(&f.vars, "var", nil, "Automation template variable, as name=value (may be repeated)")
+	flags.BoolVar(&f.localBootFirst, "local-boot-first", false, "Boot from local disk by default, offering the distro as a second choice")
+}
+
+// apply sets the settings whose flags were given on the host config
+func (f *hostFlags) apply(flags *pflag.FlagSet, config *hosts.Config) {
+	if flags.Changed("mac") {
+		config.MAC = f.mac
+	}
+
+	if flags.Changed("uuid") {
+		config.UUID = f.uuid
+	}
+
+	if flags.Changed("cidr") {
+		config.CIDR = f.cidr
+	}
+
+	if flags.Changed("profile") {
+		config.Profile = f.profile
+	}
+
+	if flags.Changed("distro") {
+		config.Distro = f.distro
+	}
+
+	if flags.Changed("arg") {
+		config.Args = f.args
+	}
+
+	if flags.Changed("automation") {
+		config.Automation = f.automation
+	}
+
+	if flags.Changed("var") {
+		config.Vars = make(map[string]any, len(f.vars))
+		for name, value := range f.vars {
+			config.Vars[strings.ToLower(name)] = value
+		}
+	}
+
+	if flags.Changed("local-boot-first") {
+		localBootFirst := f.localBootFirst
+		config.LocalBootFirst = &localBootFirst
+	}
+}
+
+func newHostsListCommand(opts *rootOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List all hosts, and where each is defined",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			editor, err := openHostEditor(opts)
+			if err != nil {
+				return err
+			}
+			defer editor.Close()
+
+			hostTable, err := editor.table()
+			if err != nil {
+				return err
+			}
+
+			oneshots, err := openOneShotStore(opts.config, editor.stateDB)
+			if err != nil {
+				return fmt.Errorf("failed to open one-shot assignment store: %w", err)
+			}
+
+			hostList := slices.Clone(hostTable.Hosts())
+			slices.SortFunc(hostList, func(a, b *hosts.Host) int {
+				return strings.Compare(a.Name, b.Name)
+			})
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "HOST\tSOURCE\tMATCH\tPROFILE\tDISTRO\tONE-SHOT")
+
+			for _, host := range hostList {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+					host.Name,
+					editor.source(host.Name),
+					describeMatch(host),
+					orDash(host.Profile),
+					orDash(host.Distro),
+					describeOneshot(oneshots, host.Name),
+				)
+			}
+
+			return w.Flush() //nolint:wrapcheck
+		},
+	}
+}
+
+// describeMatch describes how clients are matched to the host
+func describeMatch(host *hosts.Host) string {
+	switch prefix, ok := host.CIDR(); {
+	case host.MAC() != nil:
+		return host.MAC().String()
+	case host.UUID() != "":
+		return host.UUID()
+	case ok:
+		return prefix.String()
+	default:
+		return "-"
+	}
+}
+
+func newHostsAddCommand(opts *rootOptions) *cobra.Command {
+	flags := &hostFlags{}
+
+	cmd := &cobra.Command{
+		Use:   "add <name>",
+		Short: "Add a host to the hosts directory or state store",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			editor, err := openHostEditor(opts)
+			if err != nil {
+				return err
+			}
+			defer editor.Close()
+
+			hostTable, err := editor.table()
+			if err != nil {
+				return err
+			}
+
+			if _, ok := hostTable.Get(args[0]); ok {
+				return fmt.Errorf("'%s': %w", args[0], errHostExists)
+			}
+
+			config := hosts.Config{Name: args[0]}
+			flags.apply(cmd.Flags(), &config)
+
+			if err := editor.put(config); err != nil {
+				return err
+			}
+
+			fmt.Printf("Added host '%s' to the %s\n", config.Name, editor.destination)
+
+			return nil
+		},
+	}
+
+	flags.register(cmd.Flags())
+
+	return cmd
+}
+
+func newHostsUpdateCommand(opts *rootOptions) *cobra.Command {
+	flags := &hostFlags{}
+
+	cmd := &cobra.Command{
+		Use:   "update <name>",
+		Short: "Change the settings given by flags on a host added with 'pixie hosts add'",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			editor, err := openHostEditor(opts)
+			if err != nil {
+				return err
+			}
+			defer editor.Close()
+
+			config, err := editor.editable(args[0])
+			if err != nil {
+				return err
+			}
+
+			flags.apply(cmd.Flags(), &config)
+
+			if err := editor.put(config); err != nil {
+				return err
+			}
+
+			fmt.Printf("Updated host '%s' in the %s\n", config.Name, editor.destination)
+
+			return nil
+		},
+	}
+
+	flags.register(cmd.Flags())
+
+	return cmd
+}
+
+func newHostsDeleteCommand(opts *rootOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete <name>",
+		Short: "Delete a host added with 'pixie hosts add'",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			editor, err := openHostEditor(opts)
+			if err != nil {
+				return err
+			}
+			defer editor.Close()
+
+			if _, err := editor.editable(args[0]); err != nil {
+				return err
+			}
+
+			if err := editor.writer.Delete(args[0]); err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			fmt.Printf("Deleted host '%s' from the %s\n", args[0], editor.destination)
+
+			return nil
+		},
+	}
+}
+
+func newHostsSetNextBootCommand(opts *rootOptions) *cobra.Command {
+	var (
+		distro  string
+		once    bool
+		until   string
+		netboot bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "set-next-boot <mac|name>",
+		Short: "Choose what a host boots next",
+		Long: `Choose what a host boots next.
+
+With --once, the host boots the installer of the given distro (or of its own distro)
+once, and then boots from local disk. Otherwise, the host's distro is changed, which is
+only possible for hosts added with 'pixie hosts add'.
+
+With --netboot, the host is then made to network boot once and power-cycled through its
+BMC, so that it boots what was chosen straight away.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if distro == "" && !once {
+				return errNoNextBoot
+			}
+
+			if _, ok := opts.config.Distros[distro]; distro != "" && !ok {
+				return fmt.Errorf("'%s': %w", distro, errUnknownDistro)
+			}
+
+			editor, err := openHostEditor(opts)
+			if err != nil {
+				return err
+			}
+			defer editor.Close()
+
+			hostTable, err := editor.table()
+			if err != nil {
+				return err
+			}
+
+			name, err := resolveHost(hostTable, args[0])
+			if err != nil {
+				return err
+			}
+
+			if !once {
+				config, err := editor.editable(name)
+				if err != nil {
+					return err
+				}
+
+				config.Distro = distro
+
+				if err := editor.put(config); err != nil {
+					return err
+				}
+
+				fmt.Printf("Host '%s' now boots '%s'\n", name, distro)
+
+				if netboot {
+					return netbootHost(cmd.Context(), hostTable, name)
+				}
+
+				return nil
+			}
+
+			condition, err := oneshot.ParseUntil(until)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			oneshots, err := openOneShotStore(opts.config, editor.stateDB)
+			if err != nil {
+				return fmt.Errorf("failed to open one-shot assignment store: %w", err)
+			}
+
+			if _, err := oneshots.Assign(name, condition, distro); err != nil {
+				return fmt.Errorf("failed to save one-shot assignment: %w", err)
+			}
+
+			fmt.Printf("Host '%s' boots its installer once, until %s\n", name, condition)
+
+			if netboot {
+				return netbootHost(cmd.Context(), hostTable, name)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&distro, "distro", "", "Distro to boot")
+	cmd.Flags().BoolVar(&once, "once", false, "Boot the installer once, and then boot from local disk")
+	cmd.Flags().StringVar(&until, "until", string(oneshot.UntilFirstBoot), "With --once, when to switch to local disk: 'first-boot' or 'completion'")
+	cmd.Flags().BoolVar(&netboot, "netboot", false, "Network boot the host now, through its BMC")
+
+	return cmd
+}
+
+func newHostsWakeCommand(opts *rootOptions) *cobra.Command {
+	var address string
+
+	cmd := &cobra.Command{
+		Use:   "wake <mac|name>...",
+		Short: "Wake machines with Wake-on-LAN magic packets",
+		Long: `Wake machines with Wake-on-LAN magic packets, by MAC address or host name.
+
+Together with 'pixie hosts set-next-boot --once', this reinstalls machines remotely.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			config := opts.config.WakeOnLAN
+			if address != "" {
+				config.Address = address
+			}
+
+			// Hosts are only loaded if machines are given by name
+			var hostTable *hosts.Table
+			if slices.ContainsFunc(args, func(arg string) bool {
+				_, err := net.ParseMAC(arg)
+				return err != nil
+			}) {
+				editor, err := openHostEditor(opts)
+				if err != nil {
+					return err
+				}
+				defer editor.Close()
+
+				if hostTable, err = editor.table(); err != nil {
+					return err
+				}
+			}
+
+			macs := make([]net.HardwareAddr, 0, len(args))
+
+			for _, arg := range args {
+				if mac, err := net.ParseMAC(arg); err == nil {
+					macs = append(macs, mac)
+					continue
+				}
+
+				host, ok := hostTable.Get(arg)
+				if !ok {
+					return fmt.Errorf("'%s': %w", arg, errUnknownHost)
+				}
+
+				if host.MAC() == nil {
+					return fmt.Errorf("'%s': %w", arg, errNoHostMAC)
+				}
+
+				macs = append(macs, host.MAC())
+			}
+
+			for i, mac := range macs {
+				if err := wol.Wake(&config, mac); err != nil {
+					return err //nolint:wrapcheck
+				}
+
+				fmt.Printf("Sent magic packet for '%s' to %s\n", args[i], config.Address)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&address, "address", "", "Address to send magic packets to, instead of the configured one")
+
+	return cmd
+}
+
+// netbootHost makes the named host network boot once and power-cycles it through its BMC
+func netbootHost(ctx context.Context, hostTable *hosts.Table, name string) error {
+	host, ok := hostTable.Get(name)
+	if !ok || host.BMC == nil {
+		return fmt.Errorf("'%s': %w", name, errNoBMC)
+	}
+
+	if err := bmc.Netboot(ctx, host.BMC); err != nil {
+		return fmt.Errorf("failed to network boot host '%s': %w", name, err)
+	}
+
+	fmt.Printf("Host '%s' set to network boot and power-cycled\n", name)
+
+	return nil
+}
+
+// resolveHost returns the name of the host given by name or MAC address
+func resolveHost(hostTable *hosts.Table, nameOrMAC string) (string, error) {
+	if _, ok := hostTable.Get(nameOrMAC); ok {
+		return nameOrMAC, nil
+	}
+
+	mac, err := net.ParseMAC(nameOrMAC)
+	if err != nil {
+		return "", fmt.Errorf("'%s': %w", nameOrMAC, errUnknownHost)
+	}
+
+	host := hostTable.Match(mac, "", nil)
+	if host == nil || host.MAC().String() != mac.String() {
+		return "", fmt.Errorf("%w '%s'", errUnmatchedClient, mac)
+	}
+
+	return host.Name, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/spf13/cobra"
+)
+
+// Formats of inventory files
+const (
+	inventoryCSV  = "csv"
+	inventoryJSON = "json"
+)
+
+var (
+	errUnknownInventoryFormat = errors.New("unknown inventory format, expected 'csv' or 'json'")
+	errInventoryNoName        = errors.New("inventory entry has no name or hostname")
+	errInventoryDuplicate     = errors.New("inventory names a host more than once")
+	errInventoryInvalidIP     = errors.New("invalid IP address")
+)
+
+// Inventory columns that set host fields. All other columns become host variables.
+var inventoryFields = map[string]func(config *hosts.Config, value string) error{
+	"name":     func(config *hosts.Config, value string) error { config.Name = value; return nil },
+	"hostname": func(config *hosts.Config, value string) error { config.Name = value; return nil },
+	"mac":      func(config *hosts.Config, value string) error { config.MAC = value; return nil },
+	"uuid":     func(config *hosts.Config, value string) error { config.UUID = value; return nil },
+	"cidr":     func(config *hosts.Config, value string) error { config.CIDR = value; return nil },
+	"profile":  func(config *hosts.Config, value string) error { config.Profile = value; return nil },
+	"distro":   func(config *hosts.Config, value string) error { config.Distro = value; return nil },
+	"ip": func(config *hosts.Config, value string) error {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return fmt.Errorf("'%s': %w", value, errInventoryInvalidIP)
+		}
+
+		config.CIDR = netip.PrefixFrom(addr, addr.BitLen()).String()
+
+		return nil
+	},
+}
+
+func newHostsImportCommand(opts *rootOptions) *cobra.Command {
+	var (
+		format  string
+		profile string
+		replace bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Add hosts from a CSV or JSON inventory, e.g. exported from an asset database",
+		Long: `Add hosts from a CSV or JSON inventory, e.g. exported from an asset database.
+
+CSV files must have a header row, and JSON files must hold an array of objects. The
+'name' (or 'hostname'), 'mac', 'uuid', 'ip', 'cidr', 'profile' and 'distro' columns set
+the corresponding host settings; an 'ip' matches the host by that address alone. Every
+other column, such as 'role' or 'rack', becomes a host variable, for use in automation
+templates as '{{ .Vars.rack }}' and in kernel arguments as '{vars.rack}'.
+
+All hosts are added, or none are if any is invalid.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			if format == "" {
+				format = strings.TrimPrefix(strings.ToLower(filepath.Ext(args[0])), ".")
+			}
+
+			configs, err := readInventory(args[0], format)
+			if err != nil {
+				return err
+			}
+
+			editor, err := openHostEditor(opts)
+			if err != nil {
+				return err
+			}
+			defer editor.Close()
+
+			hostTable, err := editor.table()
+			if err != nil {
+				return err
+			}
+
+			for i := range configs {
+				if configs[i].Profile == "" {
+					configs[i].Profile = profile
+				}
+
+				if _, ok := hostTable.Get(configs[i].Name); ok && !replace {
+					return fmt.Errorf("'%s': %w", configs[i].Name, errHostExists)
+				}
+			}
+
+			if err := editor.putAll(configs); err != nil {
+				return err
+			}
+
+			fmt.Printf("Imported %d hosts to the %s\n", len(configs), editor.destination)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", "", "Format of the inventory: 'csv' or 'json' (default: from the file extension)")
+	cmd.Flags().StringVar(&profile, "profile", "", "Profile of hosts whose entries don't name one")
+	cmd.Flags().BoolVar(&replace, "replace", false, "Replace hosts added previously that have the same names")
+
+	return cmd
+}
+
+// readInventory reads host configs from an inventory file
+func readInventory(path string, format string) ([]hosts.Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open inventory: %w", err)
+	}
+	defer file.Close()
+
+	var entries []map[string]any
+
+	switch format {
+	case inventoryCSV:
+		entries, err = readInventoryCSV(file)
+	case inventoryJSON:
+		err = json.NewDecoder(file).Decode(&entries)
+	default:
+		return nil, fmt.Errorf("'%s': %w", format, errUnknownInventoryFormat)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory: %w", err)
+	}
+
+	configs := make([]hosts.Config, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+
+	for i, entry := range entries {
+		config, err := inventoryHost(entry)
+		if err != nil {
+			return nil, fmt.Errorf("inventory entry %d: %w", i+1, err)
+		}
+
+		if seen[config.Name] {
+			return nil, fmt.Errorf("'%s': %w", config.Name, errInventoryDuplicate)
+		}
+
+		seen[config.Name] = true
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// readInventoryCSV reads the rows of a CSV file as maps keyed by the header row
+func readInventoryCSV(r io.Reader) ([]map[string]any, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	var entries []map[string]any
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		entry := make(map[string]any, len(header))
+		for i, column := range header {
+			if record[i] != "" {
+				entry[column] = record[i]
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+}
+
+// inventoryHost converts an inventory entry to a host config. Variable names are
+// lower-cased, as they are when read from config files.
+func inventoryHost(entry map[string]any) (hosts.Config, error) {
+	config := hosts.Config{}
+
+	for column, value := range entry {
+		column = strings.ToLower(strings.TrimSpace(column))
+
+		if set, ok := inventoryFields[column]; ok {
+			if err := set(&config, fmt.Sprint(value)); err != nil {
+				return hosts.Config{}, err
+			}
+
+			continue
+		}
+
+		if config.Vars == nil {
+			config.Vars = make(map[string]any)
+		}
+
+		config.Vars[column] = value
+	}
+
+	if config.Name == "" {
+		return hosts.Config{}, errInventoryNoName
+	}
+
+	// Inventories often list MAC addresses in other formats, e.g. with dashes
+	if config.MAC != "" {
+		if mac, err := net.ParseMAC(config.MAC); err == nil {
+			config.MAC = mac.String()
+		}
+	}
+
+	return config, nil
+}
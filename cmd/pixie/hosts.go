@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/davejbax/pixie/internal/audit"
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/hoststatus"
+	"github.com/davejbax/pixie/internal/netroot"
+	"github.com/davejbax/pixie/internal/oneshot"
+	"github.com/spf13/cobra"
+)
+
+func newHostsCommand(opts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "hosts",
+		Short: "Inspect and manage hosts and their installs",
+		Long: `Inspect and manage hosts and their installs.
+
+Hosts added with 'pixie hosts add' are written to the hosts directory, if one is
+configured, and otherwise to the state store. A running pixie applies changes to the
+hosts directory as they are made, and changes to the state store on SIGHUP.`,
+	}
+
+	cmd.AddCommand(
+		newHostsListCommand(opts),
+		newHostsAddCommand(opts),
+		newHostsImportCommand(opts),
+		newHostsUpdateCommand(opts),
+		newHostsDeleteCommand(opts),
+		newHostsSetNextBootCommand(opts),
+		newHostsWakeCommand(opts),
+		&cobra.Command{
+			Use:   "status [host...]",
+			Short: "Show the install status last reported by each host",
+			RunE: func(_ *cobra.Command, args []string) error {
+				stateDB, err := openStateDB(opts.config)
+				if err != nil {
+					return err
+				}
+
+				if stateDB != nil {
+					defer stateDB.Close()
+				}
+
+				statuses, err := openHostStatusStore(opts.config, stateDB)
+				if err != nil {
+					return fmt.Errorf("failed to open host status store: %w", err)
+				}
+
+				oneshots, err := openOneShotStore(opts.config, stateDB)
+				if err != nil {
+					return fmt.Errorf("failed to open one-shot assignment store: %w", err)
+				}
+
+				reports := statuses.Reports()
+				slices.SortFunc(reports, func(a, b hoststatus.Report) int {
+					return strings.Compare(a.Host, b.Host)
+				})
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "HOST\tSTATUS\tREPORTED\tONE-SHOT\tMESSAGE")
+
+				for _, report := range reports {
+					if len(args) > 0 && !slices.Contains(args, report.Host) {
+						continue
+					}
+
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+						report.Host,
+						report.Status,
+						report.Time.Local().Format(time.DateTime),
+						describeOneshot(oneshots, report.Host),
+						report.Message,
+					)
+				}
+
+				return w.Flush() //nolint:wrapcheck
+			},
+		},
+		&cobra.Command{
+			Use:   "history <mac|host>",
+			Short: "Show the boot timeline of a machine, by MAC address or host name",
+			Args:  cobra.ExactArgs(1),
+			RunE: func(_ *cobra.Command, args []string) error {
+				match := func(event *audit.Event) bool {
+					return event.Host == args[0]
+				}
+
+				if mac, err := net.ParseMAC(args[0]); err == nil {
+					match = func(event *audit.Event) bool {
+						return event.MAC == mac.String()
+					}
+				}
+
+				events, err := audit.Read(filepath.Join(opts.config.StorageDir, auditLogPath), match)
+				if err != nil {
+					return err //nolint:wrapcheck
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "TIME\tEVENT\tHOST\tMAC\tIP\tDETAIL")
+
+				for _, event := range events {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+						event.Time.Local().Format(time.DateTime),
+						event.Type,
+						orDash(event.Host),
+						orDash(event.MAC),
+						orDash(event.IP),
+						event.Detail,
+					)
+				}
+
+				return w.Flush() //nolint:wrapcheck
+			},
+		},
+		&cobra.Command{
+			Use:   "exports",
+			Short: "Print /etc/exports lines for the NFS roots of diskless hosts",
+			Args:  cobra.NoArgs,
+			RunE: func(_ *cobra.Command, _ []string) error {
+				stateDB, err := openStateDB(opts.config)
+				if err != nil {
+					return err
+				}
+
+				if stateDB != nil {
+					defer stateDB.Close()
+				}
+
+				hostStore, err := openHostStore(opts.config, stateDB)
+				if err != nil {
+					return fmt.Errorf("failed to open host store: %w", err)
+				}
+
+				hostTable, err := newHostTable(opts.config, hostStore.Configs())
+				if err != nil {
+					return err
+				}
+
+				hostList := slices.Clone(hostTable.Hosts())
+				slices.SortFunc(hostList, func(a, b *hosts.Host) int {
+					return strings.Compare(a.Name, b.Name)
+				})
+
+				exports := []*netroot.Export{}
+				for _, host := range hostList {
+					if host.Root == nil {
+						continue
+					}
+
+					cidr, _ := host.CIDR()
+					if export, ok := host.Root.Export(host.Name, cidr); ok {
+						exports = append(exports, export)
+					}
+				}
+
+				fmt.Print("# Generated by pixie. Do not edit.\n" + netroot.ExportsFile(exports))
+
+				return nil
+			},
+		},
+	)
+
+	return cmd
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+func describeOneshot(store *oneshot.Store, host string) string {
+	assignment, ok := store.Get(host)
+	switch {
+	case !ok:
+		return "-"
+	case assignment.Pending() && assignment.Distro != "":
+		return "pending (" + assignment.Distro + ", until " + string(assignment.Until) + ")"
+	case assignment.Pending():
+		return "pending (until " + string(assignment.Until) + ")"
+	default:
+		return "complete"
+	}
+}
@@ -1,72 +1,341 @@
 package main
 
 import (
-	"debug/pe"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 
+	"github.com/davejbax/pixie/internal/autoinstall"
+	"github.com/davejbax/pixie/internal/bootloader"
+	"github.com/davejbax/pixie/internal/catalog"
+	"github.com/davejbax/pixie/internal/cmdline"
 	"github.com/davejbax/pixie/internal/distro"
-	"github.com/davejbax/pixie/internal/efipe"
-	"github.com/davejbax/pixie/internal/grub"
-	"github.com/davejbax/pixie/internal/iso"
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/initrd"
+	"github.com/davejbax/pixie/internal/oci"
+	"github.com/davejbax/pixie/pkg/efipe"
+	"github.com/davejbax/pixie/pkg/grub"
+	"github.com/davejbax/pixie/pkg/iso"
 	"github.com/spf13/cobra"
 )
 
 func newISOCommand(opts *rootOptions) *cobra.Command {
 	outputPath := ""
+	push := ""
+	profile := ""
+	installer := &installerOptions{}
 
 	cmd := &cobra.Command{
 		Use:   "iso",
 		Short: "Generate bootable ISO images",
 		RunE: func(_ *cobra.Command, _ []string) error {
-			manager, err := distro.NewManager(opts.logger, opts.config.StorageDir, opts.config.Distros)
+			grubConfig, err := opts.config.grubProfile(profile)
 			if err != nil {
-				return fmt.Errorf("failed to create distro manager: %w", err)
+				return err
 			}
 
-			distros, err := manager.Reconcile(2)
-			if err != nil {
-				return fmt.Errorf("failed to reconcile distros: %w", err)
+			// GRUB loads its config from the ISO, unless the profile says otherwise
+			prefix := "(cd0)"
+			if grubConfig.Prefix != "" {
+				prefix = grubConfig.Prefix
 			}
 
-			// TODO: add distros to ISO
-			_ = distros
+			artifacts, err := openArtifactStore(opts.config)
+			if err != nil {
+				return err
+			}
 
-			grubImage, cleanup, err := grub.NewImageFromConfig(&opts.config.Grub, "x86_64", "(cd0)")
+			manager, err := distro.NewManager(opts.logger.With("subsystem", "distro"), opts.config.StorageDir, artifacts, &opts.config.StorageQuota, opts.config.Distros, opts.config.MaintenanceWindows, &opts.config.OCI, nil)
 			if err != nil {
-				return fmt.Errorf("failed to create GRUB image from config: %w", err)
+				return fmt.Errorf("failed to create distro manager: %w", err)
 			}
-			defer cleanup()
 
-			efi, err := efipe.New(grubImage, grubImage.PEHeaderSize())
+			replica, err := opts.config.replica()
 			if err != nil {
-				return fmt.Errorf("failed to create EFI PE image: %w", err)
+				return err
+			}
+
+			// Replicas never download distros, so use those the primary has downloaded
+			var distros []*distro.Distro
+			if replica {
+				distros, err = manager.Active()
+			} else {
+				distros, err = manager.Reconcile(2)
 			}
 
-			output, err := os.OpenFile(outputPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
 			if err != nil {
-				return fmt.Errorf("could not open output ISO file: %w", err)
+				return fmt.Errorf("failed to reconcile distros: %w", err)
 			}
 
-			builder := iso.NewBuilder(opts.config.TempDir)
+			builder := iso.NewBuilder(opts.config.TempDir, &opts.config.ISO)
 
-			if err := builder.AddEFIEntrypoint(efi, pe.IMAGE_FILE_MACHINE_AMD64); err != nil {
-				return fmt.Errorf("failed to add EFI entrypoint: %w", err)
+			if installer.distro != "" {
+				if err := addInstaller(opts, builder, grubConfig, distros, installer); err != nil {
+					return fmt.Errorf("failed to add installer to ISO: %w", err)
+				}
 			}
 
+			for _, arch := range grubConfig.Arch {
+				grubImage, cleanup, err := grub.NewImageFromConfig(grubConfig, arch, prefix)
+				if err != nil {
+					return fmt.Errorf("failed to create GRUB image from config for arch '%s': %w", arch, err)
+				}
+				defer cleanup()
+
+				efi, err := efipe.New(grubImage, grubImage.PEHeaderSize())
+				if err != nil {
+					return fmt.Errorf("failed to create EFI PE image for arch '%s': %w", arch, err)
+				}
+
+				if err := builder.AddEFIEntrypoint(efi, grubImage.Machine()); err != nil {
+					return fmt.Errorf("failed to add EFI entrypoint for arch '%s': %w", arch, err)
+				}
+
+				opts.logger.Debug("added EFI entrypoint to ISO",
+					"arch", arch,
+				)
+			}
+
+			output, err := os.OpenFile(outputPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+			if err != nil {
+				return fmt.Errorf("could not open output ISO file: %w", err)
+			}
+			defer output.Close()
+
 			if err := builder.Build(output); err != nil {
 				return fmt.Errorf("ISO build failed: %w", err)
 			}
 
+			if err := output.Close(); err != nil {
+				return fmt.Errorf("failed to close output ISO file: %w", err)
+			}
+
 			opts.logger.Info("successfully created ISO image",
 				"path", outputPath,
 			)
 
+			if push != "" {
+				return pushArtifact(opts, push, oci.ArtifactTypeISO, oci.File{Path: outputPath})
+			}
+
 			return nil
 		},
 	}
 
 	cmd.Flags().StringVarP(&outputPath, "output", "o", "pixie.iso", "Path to output ISO file")
+	cmd.Flags().StringVar(&installer.distro, "distro", "", "Build a standalone installer ISO that boots this distro")
+	cmd.Flags().StringVar(&installer.arch, "arch", "", "Arch of the installer distro (default: the first configured)")
+	cmd.Flags().StringVar(&installer.host, "host", "", "Embed the automation file and kernel arguments of this host in the installer")
+	cmd.Flags().StringVar(&profile, "profile", "", "Build the ISO's GRUB images with this GRUB profile, rather than the default GRUB config")
+	cmd.Flags().StringVar(&push, "push", "", "Push the ISO to an OCI registry as an artifact with this reference, e.g. 'ghcr.io/example/pixie-iso:v1'")
 
 	return cmd
 }
+
+const (
+	installerKernelPath = "pixie/vmlinuz"
+	installerInitrdPath = "pixie/initrd.img"
+
+	// Path in the installer's initrd of the host's automation file
+	installerAutomationPath = "/pixie/automation"
+)
+
+var errInstallerUnsupported = errors.New("only distros booting a Linux kernel can be installed from an ISO")
+
+// installerOptions select the distro booted by a standalone installer ISO
+type installerOptions struct {
+	distro string
+	arch   string
+	host   string
+}
+
+// addInstaller adds the distro's kernel and initrd to the ISO, along with a GRUB config
+// booting them. If a host is given, its automation file is appended to the initrd, so
+// that the install needs no automation server.
+func installerDistro(distros []*distro.Distro, installer *installerOptions) (*distro.Distro, error) {
+	for _, d := range distros {
+		if d.Name() == installer.distro && (installer.arch == "" || d.Arch() == installer.arch) {
+			return d, nil
+		}
+	}
+
+	if installer.arch != "" {
+		return nil, fmt.Errorf("'%s' (%s): %w", installer.distro, installer.arch, errUnknownDistro)
+	}
+
+	return nil, fmt.Errorf("'%s': %w", installer.distro, errUnknownDistro)
+}
+
+// installerInitrd returns the distro's initrd with the automation file appended, if
+// there is one. The appended archive starts at a multiple of four bytes, as the kernel
+// requires.
+func installerInitrd(d *distro.Distro, automation []byte) (*iso.File, error) {
+	var archive []byte
+	if automation != nil {
+		buff := &bytes.Buffer{}
+		if err := initrd.Pack(buff, []initrd.File{{
+			Path:        installerAutomationPath,
+			Permissions: 0o600,
+			Data:        automation,
+		}}); err != nil {
+			return nil, fmt.Errorf("failed to pack automation file: %w", err)
+		}
+
+		archive = buff.Bytes()
+	}
+
+	if !d.HasInitrd() {
+		return &iso.File{
+			Path: installerInitrdPath,
+			Size: int64(len(archive)),
+			Open: func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(archive)), nil },
+		}, nil
+	}
+
+	base, err := d.Initrd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open initrd: %w", err)
+	}
+	base.Close()
+
+	if archive != nil {
+		archive = append(make([]byte, (4-base.Size()%4)%4), archive...)
+	}
+
+	return &iso.File{
+		Path: installerInitrdPath,
+		Size: base.Size() + int64(len(archive)),
+		Open: func() (io.ReadCloser, error) {
+			base, err := d.Initrd()
+			if err != nil {
+				return nil, err //nolint:wrapcheck
+			}
+
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(base, bytes.NewReader(archive)), base}, nil
+		},
+	}, nil
+}
+
+func addInstaller(opts *rootOptions, builder *iso.Builder, grubConfig *grub.Config, distros []*distro.Distro, installer *installerOptions) error {
+	d, err := installerDistro(distros, installer)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := d.WimbootFiles(); ok || d.Chainload() {
+		return fmt.Errorf("distro '%s': %w", d.Name(), errInstallerUnsupported)
+	}
+
+	var host *hosts.Host
+	if installer.host != "" {
+		hostTable, err := newHostTable(opts.config, nil)
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+		if host, ok = hostTable.Get(installer.host); !ok {
+			return fmt.Errorf("'%s': %w", installer.host, errUnknownHost)
+		}
+	}
+
+	// Install trees are too large to put on the ISO, so they're fetched from the server
+	repoURL := ""
+	if d.HasTree() {
+		baseURL, err := httpBaseURL(opts.config)
+		if err != nil {
+			return fmt.Errorf("distro '%s' installs from a tree served over HTTP: %w", d.Name(), err)
+		}
+
+		repoURL = catalog.TreeURL(baseURL, d)
+	}
+
+	var automation []byte
+	automationURL := ""
+	if host != nil && host.Automation != "" {
+		// The automation file may link to the server, if there is one. Its report URLs
+		// are signed with the key in this machine's storage directory, so are only
+		// accepted by a server sharing that key.
+		baseURL, _ := httpBaseURL(opts.config)
+
+		reporter, err := newURLSigner(opts.config)
+		if err != nil {
+			return err
+		}
+
+		buff := &bytes.Buffer{}
+		if err := autoinstall.Render(buff, host.Automation, autoinstall.NewData(host, baseURL, reporter, &opts.config.Templates)); err != nil {
+			return fmt.Errorf("failed to render automation file for host '%s': %w", host.Name, err)
+		}
+
+		automation = buff.Bytes()
+		automationURL = "file:" + installerAutomationPath
+	}
+
+	layers := [][]string{d.InstallArgs(repoURL, automationURL), opts.config.kernelArgs(), d.KernelArgs()}
+	if host != nil {
+		layers = append(layers, host.ArgLayers...)
+	}
+
+	entry := &bootloader.MenuEntry{
+		Title:   d.Name(),
+		Kernel:  installerKernelPath,
+		Args:    cmdline.Merge(layers...),
+		Modules: d.GrubModules(),
+	}
+
+	kernel, err := d.Kernel()
+	if err != nil {
+		return fmt.Errorf("failed to open kernel: %w", err)
+	}
+	kernel.Close()
+
+	builder.AddFile(&iso.File{
+		Path: installerKernelPath,
+		Size: kernel.Size(),
+		Open: func() (io.ReadCloser, error) { return d.Kernel() }, //nolint:wrapcheck
+	})
+
+	if d.HasInitrd() || automation != nil {
+		initrdFile, err := installerInitrd(d, automation)
+		if err != nil {
+			return err
+		}
+
+		entry.Initrd = installerInitrdPath
+		builder.AddFile(initrdFile)
+	}
+
+	grubLoader, err := bootloader.NewGRUB(grubConfig, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	menuConfig := &bytes.Buffer{}
+	if err := grubLoader.Config(menuConfig, &bootloader.ConfigTarget{}, &bootloader.Menu{
+		Timeout: opts.config.Menu.Timeout,
+		Entries: []*bootloader.MenuEntry{entry},
+	}); err != nil {
+		return fmt.Errorf("failed to generate GRUB config: %w", err)
+	}
+
+	builder.AddFile(&iso.File{
+		Path: "grub.cfg",
+		Size: int64(menuConfig.Len()),
+		Open: func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(menuConfig.Bytes())), nil },
+	})
+
+	opts.logger.Info("added installer to ISO",
+		"distro", d.Name(),
+		"arch", d.Arch(),
+		"version", d.Version(),
+		"host", installer.host,
+	)
+
+	return nil
+}
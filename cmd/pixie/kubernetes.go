@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/creasty/defaults"
+	"github.com/davejbax/pixie/internal/distro"
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/kube"
+	"github.com/davejbax/pixie/internal/maintenance"
+	"github.com/spf13/viper"
+)
+
+var errDuplicateDistro = errors.New("distro is defined more than once")
+
+// kubernetesFragment is the part of the config that can be set by entries of the
+// Kubernetes ConfigMap
+type kubernetesFragment struct {
+	Distros            map[string]*distro.Config
+	Hosts              []hosts.Config
+	Profiles           []hosts.Profile
+	KernelArgs         []string             `mapstructure:"kernel_args"`
+	DefaultProfile     string               `mapstructure:"default_profile"`
+	MaintenanceWindows maintenance.Schedule `mapstructure:"maintenance_windows"`
+}
+
+// openKubernetesSource reads the definitions in the Kubernetes cluster that pixie runs
+// in, if enabled, and merges them into the config
+func openKubernetesSource(ctx context.Context, opts *rootOptions) error {
+	if !opts.config.Kubernetes.Enabled {
+		return nil
+	}
+
+	source, err := kube.NewSource(opts.logger.With("subsystem", "kubernetes"), &opts.config.Kubernetes)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	if err := source.Sync(ctx); err != nil {
+		return fmt.Errorf("failed to read definitions from Kubernetes: %w", err)
+	}
+
+	merged, err := withKubernetes(opts.config, source.Definitions())
+	if err != nil {
+		return err
+	}
+
+	opts.config = merged
+	opts.kube = source
+
+	return nil
+}
+
+// withKubernetes returns a copy of the config with the definitions read from Kubernetes
+// merged in. Distros, hosts and profiles are added to those in the config, and other
+// settings in ConfigMap entries replace those in the config. Later entries (by key) take
+// precedence.
+func withKubernetes(base *config, definitions *kube.Definitions) (*config, error) {
+	merged := *base
+	merged.Distros = maps.Clone(base.Distros)
+	merged.Hosts = slices.Clone(base.Hosts)
+	merged.Profiles = slices.Clone(base.Profiles)
+
+	if merged.Distros == nil {
+		merged.Distros = make(map[string]*distro.Config)
+	}
+
+	for _, fragment := range definitions.Fragments {
+		v := viper.New()
+		v.SetConfigType("yaml")
+
+		// As JSON is a subset of YAML, both are read as YAML
+		if err := v.ReadConfig(strings.NewReader(fragment.Data)); err != nil {
+			return nil, fmt.Errorf("failed to read ConfigMap entry '%s': %w", fragment.Key, err)
+		}
+
+		var values kubernetesFragment
+		if err := decodeKubernetes(v, &values); err != nil {
+			return nil, fmt.Errorf("failed to decode ConfigMap entry '%s': %w", fragment.Key, err)
+		}
+
+		for name, config := range values.Distros {
+			if err := addDistro(&merged, name, config); err != nil {
+				return nil, err
+			}
+		}
+
+		merged.Hosts = append(merged.Hosts, values.Hosts...)
+		merged.Profiles = append(merged.Profiles, values.Profiles...)
+
+		if values.KernelArgs != nil {
+			merged.KernelArgs = values.KernelArgs
+		}
+
+		if values.DefaultProfile != "" {
+			merged.DefaultProfile = values.DefaultProfile
+		}
+
+		if values.MaintenanceWindows != nil {
+			merged.MaintenanceWindows = values.MaintenanceWindows
+		}
+	}
+
+	for _, resource := range definitions.Distros {
+		var config distro.Config
+		if err := decodeResource(resource.Spec, &config); err != nil {
+			return nil, fmt.Errorf("failed to decode Distro '%s': %w", resource.Name, err)
+		}
+
+		if err := addDistro(&merged, resource.Name, &config); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, resource := range definitions.Hosts {
+		var config hosts.Config
+		if err := decodeResource(resource.Spec, &config); err != nil {
+			return nil, fmt.Errorf("failed to decode Host '%s': %w", resource.Name, err)
+		}
+
+		config.Name = resource.Name
+		merged.Hosts = append(merged.Hosts, config)
+	}
+
+	return &merged, nil
+}
+
+func addDistro(c *config, name string, distroConfig *distro.Config) error {
+	if _, ok := c.Distros[name]; ok {
+		return fmt.Errorf("'%s': %w", name, errDuplicateDistro)
+	}
+
+	c.Distros[name] = distroConfig
+
+	return nil
+}
+
+// decodeResource decodes the spec of a custom resource in the same way as the config
+// file
+func decodeResource(spec map[string]any, output any) error {
+	v := viper.New()
+	if err := v.MergeConfigMap(spec); err != nil {
+		return fmt.Errorf("failed to read spec: %w", err)
+	}
+
+	return decodeKubernetes(v, output)
+}
+
+func decodeKubernetes(v *viper.Viper, output any) error {
+	if err := defaults.Set(output); err != nil {
+		return fmt.Errorf("failed to set defaults: %w", err)
+	}
+
+	// Unknown keys are rejected, as they are in the config file
+	return v.UnmarshalExact(output) //nolint:wrapcheck
+}
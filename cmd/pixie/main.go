@@ -3,16 +3,18 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"os"
 	"strings"
 
+	"github.com/davejbax/pixie/internal/kube"
+	"github.com/davejbax/pixie/internal/logging"
+	"github.com/davejbax/pixie/internal/starconfig"
 	"github.com/spf13/cobra"
 )
 
-const defaultConfigPath = "/etc/pixie/config.yaml"
-
 func main() {
 	root := newRootCommand()
 	if err := root.Execute(); err != nil {
@@ -21,8 +23,18 @@ func main() {
 }
 
 type rootOptions struct {
-	logger *slog.Logger
-	config *config
+	logger     *slog.Logger
+	config     *config
+	configPath string
+
+	// Site selected with --site, or empty for the top level
+	site string
+
+	// Source of definitions read from Kubernetes, if enabled
+	kube *kube.Source
+
+	// Closes the log file, if logs are written to one
+	logFile io.Closer
 }
 
 func newRootCommand() *cobra.Command {
@@ -30,31 +42,64 @@ func newRootCommand() *cobra.Command {
 
 	level := logLevelFlag{Level: slog.LevelWarn}
 	format := logHandlerFlagText
-	configPath := ""
 
 	cmd := &cobra.Command{
 		Use:           "pixie",
 		Short:         "Pixie is a PXE boot server with declarative configuration",
 		SilenceErrors: false,
 		SilenceUsage:  true,
-		PersistentPreRunE: func(_ *cobra.Command, _ []string) error {
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
 			opts.logger = slog.New(format.CreateHandler(level.Level))
 
 			var err error
-			opts.config, err = loadConfig(configPath)
+			opts.config, err = loadConfig(opts.configPath, opts.site)
 			if err != nil {
 				return err
 			}
 
-			return nil
+			// Once the config is loaded, the logger can have per-subsystem levels and a file
+			opts.logger, opts.logFile, err = logging.New(&opts.config.Log, level.Level, string(format))
+			if err != nil {
+				return fmt.Errorf("failed to set up logging: %w", err)
+			}
+
+			if opts.site != "" {
+				opts.logger = opts.logger.With("site", opts.site)
+			}
+
+			return openKubernetesSource(cmd.Context(), opts)
+		},
+		PersistentPostRunE: func(_ *cobra.Command, _ []string) error {
+			if opts.logFile == nil {
+				return nil
+			}
+
+			return opts.logFile.Close() //nolint:wrapcheck
 		},
 	}
 
 	cmd.PersistentFlags().Var(&level, "level", "Log output level")
 	cmd.PersistentFlags().Var(&format, "format", "Log output format")
-	cmd.PersistentFlags().StringVar(&configPath, "config", defaultConfigPath, "Path to config file to use")
-
-	cmd.AddCommand(newISOCommand(opts))
+	cmd.PersistentFlags().StringVar(&opts.configPath, "config", defaultConfigPath, "Path to config file to use (YAML, or Starlark if it ends in "+starconfig.Extension+")")
+	cmd.PersistentFlags().StringVar(&opts.site, "site", "", "Site in the config to act on, rather than the top level")
+
+	cmd.AddCommand(
+		newISOCommand(opts),
+		newEntrypointCommand(opts),
+		newBoardsCommand(opts),
+		newServeCommand(opts),
+		newReconcileCommand(opts),
+		newDistroCommand(opts),
+		newExportCommand(opts),
+		newDHCPConfigCommand(opts),
+		newHostsCommand(opts),
+		newConfigCommand(opts),
+		newE2ECommand(opts),
+		newTestCommand(opts),
+		newStatusCommand(opts),
+		newGrubCommand(opts),
+		newDebugCommand(opts),
+	)
 
 	return cmd
 }
@@ -78,8 +123,8 @@ func (l *logLevelFlag) Type() string {
 type logHandlerFlag string
 
 const (
-	logHandlerFlagText = logHandlerFlag("text")
-	logHandlerFlagJSON = logHandlerFlag("json")
+	logHandlerFlagText = logHandlerFlag(logging.FormatText)
+	logHandlerFlagJSON = logHandlerFlag(logging.FormatJSON)
 )
 
 var errUnrecognisedLogHandler = errors.New("invalid log format; valid values are 'text' or 'json'")
@@ -102,12 +147,10 @@ func (l *logHandlerFlag) Type() string {
 }
 
 func (l *logHandlerFlag) CreateHandler(level slog.Level) slog.Handler {
-	switch *l {
-	case logHandlerFlagText:
-		return slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
-	case logHandlerFlagJSON:
-		return slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
-	default:
+	handler, err := logging.NewHandler(string(*l), os.Stderr, &slog.HandlerOptions{Level: level})
+	if err != nil {
 		panic("invalid handler value")
 	}
+
+	return handler
 }
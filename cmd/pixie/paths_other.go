@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+const defaultConfigPath = "/etc/pixie/config.yaml"
+
+// setPlatformDefaults overrides defaults that differ between platforms. The defaults
+// in the config's tags are for Linux and other Unix-like systems, so there's nothing to
+// override.
+func setPlatformDefaults(_ *config) {}
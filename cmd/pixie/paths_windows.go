@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+var defaultConfigPath = filepath.Join(programData(), "pixie", "config.yaml")
+
+// setPlatformDefaults overrides defaults that differ between platforms, replacing the
+// Unix directories in the config's tags with their Windows equivalents
+func setPlatformDefaults(c *config) {
+	c.TempDir = filepath.Join(os.TempDir(), "pixie")
+	c.StorageDir = filepath.Join(programData(), "pixie")
+}
+
+// programData returns the directory for application data shared between users
+func programData() string {
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		return dir
+	}
+
+	return `C:\ProgramData`
+}
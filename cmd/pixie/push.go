@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/davejbax/pixie/internal/oci"
+)
+
+// pushArtifact pushes files to an OCI registry as an artifact of the given type
+func pushArtifact(opts *rootOptions, reference string, artifactType string, files ...oci.File) error {
+	ref, err := oci.ParseReference(reference)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	manifestDigest, err := oci.NewClient(nil, &opts.config.OCI).Push(ref, artifactType, files)
+	if err != nil {
+		return fmt.Errorf("failed to push to '%s': %w", ref, err)
+	}
+
+	opts.logger.Info("pushed artifact",
+		"reference", ref.String(),
+		"digest", manifestDigest,
+	)
+
+	return nil
+}
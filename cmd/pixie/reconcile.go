@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/distro"
+	"github.com/spf13/cobra"
+)
+
+type planFormatFlag string
+
+const (
+	planFormatText = planFormatFlag("text")
+	planFormatJSON = planFormatFlag("json")
+)
+
+var (
+	errUnrecognisedPlanFormat = errors.New("invalid plan format; valid values are 'text' or 'json'")
+	errReplicaReconcile       = errors.New("replicas never reconcile distros; reconcile on the primary instead")
+)
+
+func (p *planFormatFlag) Set(name string) error {
+	if name != string(planFormatText) && name != string(planFormatJSON) {
+		return errUnrecognisedPlanFormat
+	}
+
+	*p = planFormatFlag(name)
+	return nil
+}
+
+func (p *planFormatFlag) String() string {
+	return string(*p)
+}
+
+func (p *planFormatFlag) Type() string {
+	return "<" + strings.Join([]string{string(planFormatText), string(planFormatJSON)}, "|") + ">"
+}
+
+func newReconcileCommand(opts *rootOptions) *cobra.Command {
+	dryRun := false
+	format := planFormatText
+
+	cmd := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Download the latest version of each configured distro",
+		Long: `Download the latest version of each configured distro.
+
+With --dry-run, nothing is downloaded or changed. Instead, the plan of what would be
+downloaded, activated and deleted is printed, as a diff or (with --plan json) as JSON
+for CI pipelines to check.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			artifacts, err := openArtifactStore(opts.config)
+			if err != nil {
+				return err
+			}
+
+			manager, err := distro.NewManager(opts.logger.With("subsystem", "distro"), opts.config.StorageDir, artifacts, &opts.config.StorageQuota, opts.config.Distros, opts.config.MaintenanceWindows, &opts.config.OCI, nil)
+			if err != nil {
+				return fmt.Errorf("failed to create distro manager: %w", err)
+			}
+
+			if dryRun || cmd.Flags().Changed("plan") {
+				return printPlan(os.Stdout, manager, format)
+			}
+
+			replica, err := opts.config.replica()
+			if err != nil {
+				return err
+			}
+
+			if replica {
+				return errReplicaReconcile
+			}
+
+			distros, err := manager.Reconcile(opts.config.Reconcile.Parallelism)
+			if err != nil {
+				return fmt.Errorf("failed to reconcile distros: %w", err)
+			}
+
+			opts.logger.Info("reconciled distros",
+				"distros", len(distros),
+			)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print what would be downloaded, activated and deleted, without changing anything")
+	cmd.Flags().Var(&format, "plan", "Format of the dry run plan (implies --dry-run)")
+
+	return cmd
+}
+
+// printPlan checks the latest version of each distro, and prints what a reconcile would
+// do in the given format
+func printPlan(w io.Writer, manager *distro.Manager, format planFormatFlag) error {
+	plan, err := manager.Plan()
+	if err != nil {
+		return fmt.Errorf("failed to plan reconcile: %w", err)
+	}
+
+	if format == planFormatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(plan) //nolint:wrapcheck
+	}
+
+	writePlanText(w, plan)
+
+	return nil
+}
+
+// writePlanText writes the plan as a diff: '+' for versions that would be downloaded,
+// '~' for active versions that would change, and '-' for files that would be deleted or
+// distros that would no longer be served
+func writePlanText(w io.Writer, plan *distro.Plan) {
+	downloads := 0
+	regenerated := 0
+	deletes := 0
+	downloadSize := int64(0)
+	sizeKnown := true
+
+	for _, change := range plan.Changes {
+		name := change.Distro + "/" + change.Arch
+
+		switch change.Action {
+		case distro.ActionNone:
+			if change.AwaitingApproval != "" {
+				fmt.Fprintf(w, "  %s: %s awaits approval, keeping %s\n", name, shortHash(change.AwaitingApproval), shortHash(change.ActiveHash))
+			} else if change.Pinned {
+				fmt.Fprintf(w, "  %s: pinned to rolled back %s\n", name, shortHash(change.ActiveHash))
+			} else if change.Unchecked {
+				fmt.Fprintf(w, "  %s: not checked for new versions until its next check window (%s)\n", name, shortHash(change.ActiveHash))
+			} else {
+				fmt.Fprintf(w, "  %s: up to date (%s)\n", name, shortHash(change.ActiveHash))
+			}
+		case distro.ActionDownload, distro.ActionStage:
+			when := "activate"
+			if change.Action == distro.ActionStage {
+				when = "stage until the next maintenance window"
+			}
+
+			fmt.Fprintf(w, "+ %s: download %s (%s), and %s\n", name, shortHash(change.LatestHash), formatSize(change.DownloadSize), when)
+
+			downloads++
+			if change.DownloadSize < 0 {
+				sizeKnown = false
+			} else {
+				downloadSize += change.DownloadSize
+			}
+		case distro.ActionActivate:
+			fmt.Fprintf(w, "  %s: activate staged %s\n", name, shortHash(change.LatestHash))
+		case distro.ActionStaged:
+			fmt.Fprintf(w, "  %s: %s stays staged until the next maintenance window\n", name, shortHash(change.LatestHash))
+		}
+
+		if change.Regenerate {
+			fmt.Fprintf(w, "~ %s: %s -> %s, boot entries regenerated\n", name, shortHash(change.ActiveHash), shortHash(change.LatestHash))
+			regenerated++
+		}
+
+		for _, path := range change.Delete {
+			fmt.Fprintf(w, "- %s: delete %s\n", name, path)
+			deletes++
+		}
+	}
+
+	for _, name := range plan.Unconfigured {
+		fmt.Fprintf(w, "- %s: no longer configured, and won't be served (files are kept)\n", name)
+	}
+
+	total := formatSize(downloadSize)
+	if !sizeKnown && downloadSize == 0 {
+		total = formatSize(-1)
+	} else if !sizeKnown {
+		total = "at least " + total
+	}
+
+	fmt.Fprintf(w, "\nPlan: %d to download (%s), %d to regenerate, %d to delete, %d no longer configured.\n",
+		downloads, total, regenerated, deletes, len(plan.Unconfigured))
+}
+
+func shortHash(hash string) string {
+	if hash == "" {
+		return "none"
+	}
+
+	return hash[:min(len(hash), 12)]
+}
+
+func formatSize(size int64) string {
+	if size < 0 {
+		return "unknown size"
+	}
+
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
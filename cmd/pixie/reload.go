@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davejbax/pixie/internal/artifact"
+	"github.com/davejbax/pixie/internal/catalog"
+	"github.com/davejbax/pixie/internal/distro"
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/kube"
+	"github.com/davejbax/pixie/internal/oneshot"
+	"github.com/davejbax/pixie/internal/reconcile"
+	"github.com/davejbax/pixie/internal/storage"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// Editors often write a file in several steps, so changes are only applied once the
+// file has been quiet for this long
+const reloadDebounce = 500 * time.Millisecond
+
+// reloader applies changes to the config file while serving, on SIGHUP or when the
+// file (or a file it includes, a file in the hosts directory, or a definition read from
+// Kubernetes) changes.
+// Hosts, profiles, kernel arguments and
+// distros are reloaded, and generated EFI images are rebuilt from the GRUB files on
+// disk; other settings, including grub and grub_profiles, need a restart. Hosts and
+// one-shot assignments in the state store are reloaded too, so that changes made by the
+// CLI apply on SIGHUP.
+//
+// Invalid configs are rejected, and the previous config stays in use. Transfers in
+// progress are not interrupted, as the catalog only swaps what it serves next.
+type reloader struct {
+	logger *slog.Logger
+	path   string
+
+	// Site whose config is reloaded, or empty for the top level
+	site string
+
+	// Logger of the distro managers created on reload
+	distroLogger *slog.Logger
+
+	// Config that pixie started with. Settings that can't be reloaded are compared
+	// against this.
+	started *config
+
+	files     *catalog.Catalog
+	hostStore *hosts.Store
+	oneshots  *oneshot.Store
+
+	// Generated EFI images, which are discarded on reload so that changes to the GRUB
+	// files on disk are picked up
+	images *artifact.Cache
+
+	// Store that distros are kept in, which can't change without a restart
+	artifacts storage.Backend
+
+	// Recent checks of distro mirrors, shared with the managers created on reload
+	mirrors *distro.MirrorCache
+
+	// Guards current, the config last applied
+	mu      sync.Mutex
+	current *config
+
+	// Reconcile controller, if periodic reconciles are enabled
+	controller *reconcile.Controller
+
+	// Source of definitions read from Kubernetes, if enabled
+	kube *kube.Source
+}
+
+// Run watches for changes until the context is cancelled
+func (r *reloader) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	if err := r.watchSources(watcher); err != nil {
+		return err
+	}
+
+	hostsDir := r.started.HostsDir
+	if hostsDir != "" {
+		if err := os.MkdirAll(hostsDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create hosts directory: %w", err)
+		}
+
+		if err := watcher.Add(hostsDir); err != nil {
+			return fmt.Errorf("failed to watch hosts directory: %w", err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	debounce := time.NewTimer(0)
+	<-debounce.C
+
+	// A nil channel never receives, if definitions aren't read from Kubernetes
+	var kubeChanges <-chan struct{}
+	if r.kube != nil {
+		kubeChanges = r.kube.Changes()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			debounce.Stop()
+			return nil
+		case <-hup:
+			r.logger.Info("received SIGHUP, reloading config")
+			r.reload()
+			r.rewatchSources(watcher)
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			// Files in included directories are picked up as they're added and removed
+			if event.Op != fsnotify.Chmod && r.isSource(event.Name) {
+				debounce.Reset(reloadDebounce)
+			}
+
+			// Any change to a host file is applied, including removals
+			if hostsDir != "" && filepath.Dir(event.Name) == filepath.Clean(hostsDir) && isHostFile(event.Name) {
+				debounce.Reset(reloadDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+
+			r.logger.Warn("error watching config file",
+				"error", err,
+			)
+		case <-kubeChanges:
+			debounce.Reset(reloadDebounce)
+		case <-debounce.C:
+			r.logger.Info("config changed, reloading")
+			r.reload()
+			r.rewatchSources(watcher)
+		}
+	}
+}
+
+// watchSources watches the directories of the files that the current config was read
+// from, and the directories it includes. Directories are watched rather than files, so
+// that changes are still seen after editors replace a file by renaming over it.
+func (r *reloader) watchSources(watcher *fsnotify.Watcher) error {
+	r.mu.Lock()
+	directories := r.current.sources.WatchDirectories()
+	r.mu.Unlock()
+
+	for _, directory := range directories {
+		if err := watcher.Add(directory); err != nil {
+			return fmt.Errorf("failed to watch config directory '%s': %w", directory, err)
+		}
+	}
+
+	return nil
+}
+
+// rewatchSources watches any directories that a reloaded config newly includes
+func (r *reloader) rewatchSources(watcher *fsnotify.Watcher) {
+	if err := r.watchSources(watcher); err != nil {
+		r.logger.Warn("failed to watch included config files",
+			"error", err,
+		)
+	}
+}
+
+// isSource returns whether a change to the given file affects the current config
+func (r *reloader) isSource(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.current.sources.Contains(name)
+}
+
+func (r *reloader) reload() {
+	if err := r.apply(); err != nil {
+		r.logger.Error("rejected new config, keeping the previous config",
+			"path", r.path,
+			"error", err,
+		)
+	}
+}
+
+// RebuildHosts rebuilds the hosts served from the current config and the host store,
+// after the store has changed
+func (r *reloader) RebuildHosts() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hostTable, err := newHostTable(r.current, r.hostStore.Configs())
+	if err != nil {
+		return err
+	}
+
+	r.files.SetHosts(hostTable, r.current.kernelArgs())
+
+	return nil
+}
+
+func (r *reloader) apply() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := readConfig(viper.New(), r.path, r.site)
+	if err != nil {
+		return err
+	}
+
+	if r.kube != nil {
+		next, err = withKubernetes(next, r.kube.Definitions())
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := r.hostStore.Reload(); err != nil {
+		return fmt.Errorf("failed to reload host store: %w", err)
+	}
+
+	if err := r.oneshots.Reload(); err != nil {
+		return fmt.Errorf("failed to reload one-shot assignments: %w", err)
+	}
+
+	hostTable, err := newHostTable(next, r.hostStore.Configs())
+	if err != nil {
+		return err
+	}
+
+	// The storage directory and artifact store can't change without a restart, so the ones
+	// pixie started with are kept
+	manager, err := distro.NewManager(r.distroLogger, r.started.StorageDir, r.artifacts, &next.StorageQuota, next.Distros, next.MaintenanceWindows, &next.OCI, r.mirrors)
+	if err != nil {
+		return fmt.Errorf("failed to create distro manager: %w", err)
+	}
+
+	distros, err := manager.Active()
+	if err != nil {
+		return fmt.Errorf("failed to load distros: %w", err)
+	}
+
+	if requiresRestart(r.started, next) {
+		r.logger.Warn("config changes other than to hosts, profiles, kernel arguments and distros require a restart to take effect")
+	}
+
+	// The manager is replaced before the distros are, so that a reconcile still running
+	// with the old manager either finishes first, or has its distros discarded
+	if r.controller != nil {
+		r.controller.SetManager(manager)
+	}
+
+	r.files.SetDistros(distros)
+	r.files.SetHosts(hostTable, next.kernelArgs())
+
+	// Newly added distros are downloaded by the next reconcile, which is run now
+	// rather than waiting for the interval
+	if r.controller != nil {
+		r.controller.Trigger()
+	}
+
+	discarded := r.images.Len()
+	r.images.Invalidate()
+
+	r.current = next
+
+	r.logger.Info("reloaded config",
+		"hosts", len(next.Hosts),
+		"distros", len(distros),
+		"discarded_images", discarded,
+	)
+
+	return nil
+}
+
+// isHostFile returns whether the file is read from the hosts directory
+func isHostFile(name string) bool {
+	return slices.Contains([]string{".yaml", ".yml", ".json"}, filepath.Ext(name))
+}
+
+// requiresRestart returns whether the configs differ in settings that can't be reloaded
+func requiresRestart(started *config, next *config) bool {
+	strip := func(c config) config {
+		c.Distros = nil
+		c.MaintenanceWindows = nil
+		c.KernelArgs = nil
+		c.Hosts = nil
+		c.Profiles = nil
+		c.DefaultProfile = ""
+		c.sources = nil
+
+		// Sites reload their own settings, but adding or removing one needs a restart
+		c.Sites = nil
+
+		return c
+	}
+
+	return !reflect.DeepEqual(strip(*started), strip(*next)) || !slices.Equal(siteNames(started), siteNames(next))
+}
+
+// newHostTable creates the host table from the hosts in the config and hosts directory,
+// and any others (e.g. those created through the API), checking that hosts only boot
+// distros that exist, and only have automation templates in the templates directory
+func newHostTable(config *config, others []hosts.Config) (*hosts.Table, error) {
+	var directoryHosts []hosts.Config
+	if config.HostsDir != "" {
+		directory, err := hosts.OpenDirectory(config.HostsDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load hosts directory: %w", err)
+		}
+
+		directoryHosts = directory.Configs()
+	}
+
+	hostTable, err := hosts.NewTable(slices.Concat(config.Hosts, directoryHosts, others), config.Profiles, config.DefaultProfile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hosts: %w", err)
+	}
+
+	for _, host := range hostTable.Hosts() {
+		if _, ok := config.Distros[host.Distro]; host.Distro != "" && !ok {
+			return nil, fmt.Errorf("host '%s' boots distro '%s': %w", host.Name, host.Distro, errUnknownDistro)
+		}
+
+		if _, ok := config.GrubProfiles[host.GrubProfile]; host.GrubProfile != "" && !ok {
+			return nil, fmt.Errorf("host '%s' boots with GRUB profile '%s': %w", host.Name, host.GrubProfile, errUnknownGrubProfile)
+		}
+
+		if host.Automation != "" {
+			if _, err := config.Templates.TemplatePath(host.Automation); err != nil {
+				return nil, fmt.Errorf("host '%s' has invalid automation template: %w", host.Name, err)
+			}
+		}
+	}
+
+	return hostTable, nil
+}
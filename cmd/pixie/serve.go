@@ -0,0 +1,832 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/davejbax/pixie/internal/acl"
+	"github.com/davejbax/pixie/internal/api"
+	"github.com/davejbax/pixie/internal/artifact"
+	"github.com/davejbax/pixie/internal/audit"
+	"github.com/davejbax/pixie/internal/autoinstall"
+	"github.com/davejbax/pixie/internal/board"
+	"github.com/davejbax/pixie/internal/bootloader"
+	"github.com/davejbax/pixie/internal/bootsession"
+	"github.com/davejbax/pixie/internal/catalog"
+	"github.com/davejbax/pixie/internal/clients"
+	"github.com/davejbax/pixie/internal/dhcp"
+	"github.com/davejbax/pixie/internal/distro"
+	"github.com/davejbax/pixie/internal/dns"
+	"github.com/davejbax/pixie/internal/dnsreg"
+	"github.com/davejbax/pixie/internal/drain"
+	"github.com/davejbax/pixie/internal/hoststatus"
+	"github.com/davejbax/pixie/internal/httpcompress"
+	"github.com/davejbax/pixie/internal/httpserver"
+	"github.com/davejbax/pixie/internal/limiter"
+	"github.com/davejbax/pixie/internal/netif"
+	"github.com/davejbax/pixie/internal/notify"
+	"github.com/davejbax/pixie/internal/oneshot"
+	"github.com/davejbax/pixie/internal/quirks"
+	"github.com/davejbax/pixie/internal/reconcile"
+	"github.com/davejbax/pixie/internal/requestlog"
+	"github.com/davejbax/pixie/internal/sockets"
+	"github.com/davejbax/pixie/internal/status"
+	"github.com/davejbax/pixie/internal/tftp"
+	"github.com/davejbax/pixie/internal/timehint"
+	"github.com/davejbax/pixie/internal/urlsign"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+)
+
+// Paths of state stores, relative to the storage directory
+const (
+	dhcpLeasesPath = "dhcp/leases.json"
+	oneshotPath    = "hosts/oneshot.json"
+	hostStatusPath = "hosts/status.json"
+	hostsPath      = "hosts/hosts.json"
+	auditLogPath   = "audit/events.jsonl"
+
+	// Default path of the key that automation file URLs are signed with
+	urlSigningKeyPath = "keys/url-signing.key"
+)
+
+var (
+	errDHCPAndProxyDHCP = errors.New("the DHCP and ProxyDHCP servers cannot both be enabled")
+	errNoClientCA       = errors.New("the management API requires client certificates, but HTTPS with a client CA file isn't configured")
+	errNoURLLifetime    = errors.New("'signed_urls.lifetime' must be positive")
+)
+
+func newServeCommand(opts *rootOptions) *cobra.Command {
+	dryRun := false
+	format := planFormatText
+
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve bootloaders to network boot clients",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			replica, err := opts.config.replica()
+			if err != nil {
+				return err
+			}
+
+			// Print what the reconcile on startup would do, rather than serving
+			if dryRun || cmd.Flags().Changed("plan") {
+				if replica {
+					return errReplicaReconcile
+				}
+
+				artifacts, err := openArtifactStore(opts.config)
+				if err != nil {
+					return err
+				}
+
+				manager, err := distro.NewManager(opts.logger.With("subsystem", "distro"), opts.config.StorageDir, artifacts, &opts.config.StorageQuota, opts.config.Distros, opts.config.MaintenanceWindows, &opts.config.OCI, nil)
+				if err != nil {
+					return fmt.Errorf("failed to create distro manager: %w", err)
+				}
+
+				return printPlan(os.Stdout, manager, format)
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			// Once the first signal starts shutting down, a second one exits at once rather
+			// than waiting for downloads to finish
+			context.AfterFunc(ctx, stop)
+
+			// Inherited sockets are shared out between the servers of every site by
+			// address, so are taken before any site starts
+			if err := setupSockets(opts); err != nil {
+				return err
+			}
+
+			if opts.site != "" || len(opts.config.Sites) == 0 {
+				return serve(ctx, opts, replica)
+			}
+
+			return serveSites(ctx, opts)
+		},
+	}
+
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print what the reconcile on startup would download, activate and delete, and exit without serving")
+	cmd.Flags().Var(&format, "plan", "Format of the dry run plan (implies --dry-run)")
+
+	return cmd
+}
+
+// newBootloaders creates the bootloaders that are served: GRUB, each GRUB profile, and
+// U-Boot if it's enabled or a board boots with it. Their generated images are kept in
+// images.
+func newBootloaders(opts *rootOptions, images *artifact.Cache) ([]bootloader.Bootloader, error) {
+	grubConfig, err := opts.config.grubProfile("")
+	if err != nil {
+		return nil, err
+	}
+
+	grub, err := bootloader.NewGRUB(grubConfig, newEntrypointStore(opts), images)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GRUB bootloader: %w", err)
+	}
+
+	bootloaders := []bootloader.Bootloader{grub}
+
+	for _, name := range slices.Sorted(maps.Keys(opts.config.GrubProfiles)) {
+		profileConfig, err := opts.config.grubProfile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		profile, err := bootloader.NewGRUBProfile(name, profileConfig, images)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create bootloader for GRUB profile '%s': %w", name, err)
+		}
+
+		bootloaders = append(bootloaders, profile)
+	}
+
+	boards, err := board.New(opts.config.Boards)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load boards: %w", err)
+	}
+
+	if opts.config.UBoot.Enabled || slices.ContainsFunc(boards, func(b *board.Board) bool {
+		return b.Profile.Boot == board.BootProtocolUBootPXE
+	}) {
+		// A configured device tree directory lets U-Boot choose each board's own
+		deviceTree := ""
+		if opts.config.UBoot.DeviceTreeDirectory == "" {
+			deviceTree, err = board.DeviceTree(boards)
+			if err != nil {
+				return nil, fmt.Errorf("invalid boards: %w", err)
+			}
+		}
+
+		bootloaders = append(bootloaders, bootloader.NewUBoot(&opts.config.UBoot, deviceTree))
+	}
+
+	return bootloaders, nil
+}
+
+// serveSites serves the top level and each site in the config until the context is
+// cancelled. Sites are served independently, except that if any fails to start or
+// stops, they all stop.
+func serveSites(ctx context.Context, opts *rootOptions) error {
+	sites := []*rootOptions{opts}
+
+	for _, name := range siteNames(opts.config) {
+		siteOpts, err := openSite(ctx, opts, name)
+		if err != nil {
+			return err
+		}
+
+		sites = append(sites, siteOpts)
+	}
+
+	if err := checkSites(sites); err != nil {
+		return err
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+
+	for _, siteOpts := range sites {
+		replica, err := siteOpts.config.replica()
+		if err != nil {
+			return fmt.Errorf("%s: %w", describeSite(siteOpts.site), err)
+		}
+
+		eg.Go(func() error {
+			if err := serve(ctx, siteOpts, replica); err != nil {
+				return fmt.Errorf("%s: %w", describeSite(siteOpts.site), err)
+			}
+
+			return nil
+		})
+	}
+
+	return eg.Wait() //nolint:wrapcheck
+}
+
+// setupSockets takes the sockets passed by the service manager, if enabled
+func setupSockets(opts *rootOptions) error {
+	inherited, err := sockets.Setup(&opts.config.Sockets)
+	if err != nil {
+		return fmt.Errorf("failed to take inherited sockets: %w", err)
+	}
+
+	if inherited > 0 {
+		opts.logger.Info("using sockets passed by the service manager",
+			"count", inherited,
+		)
+	}
+
+	return nil
+}
+
+// serve serves until the context is cancelled. Replicas refresh distros from the artifact
+// store rather than reconciling them.
+func serve(ctx context.Context, opts *rootOptions, replica bool) error {
+	started := time.Now()
+
+	// Binding ports is checked first, as it's the likeliest thing to fail when running
+	// without root, and otherwise would only fail after distros are loaded
+	if err := sockets.Check(listenAddresses(opts.config)); err != nil {
+		return fmt.Errorf("servers can't listen on their addresses: %w", err)
+	}
+
+	// Generated EFI images are rendered once, and discarded when the config is reloaded
+	images := artifact.NewCache()
+
+	bootloaders, err := newBootloaders(opts, images)
+	if err != nil {
+		return err
+	}
+
+	artifacts, err := openArtifactStore(opts.config)
+	if err != nil {
+		return err
+	}
+
+	// Mirror checks are shared by the managers created as the config is reloaded
+	mirrors := distro.NewMirrorCache(opts.config.Reconcile.MirrorCacheTTL)
+
+	manager, err := distro.NewManager(opts.logger.With("subsystem", "distro"), opts.config.StorageDir, artifacts, &opts.config.StorageQuota, opts.config.Distros, opts.config.MaintenanceWindows, &opts.config.OCI, mirrors)
+	if err != nil {
+		return fmt.Errorf("failed to create distro manager: %w", err)
+	}
+
+	distros, err := manager.Active()
+	if err != nil {
+		return fmt.Errorf("failed to load distros: %w", err)
+	}
+
+	stateDB, err := openStateDB(opts.config)
+	if err != nil {
+		return err
+	}
+
+	if stateDB != nil {
+		defer stateDB.Close()
+	}
+
+	hostStore, err := openHostStore(opts.config, stateDB)
+	if err != nil {
+		return fmt.Errorf("failed to open host store: %w", err)
+	}
+
+	hostTable, err := newHostTable(opts.config, hostStore.Configs())
+	if err != nil {
+		return err
+	}
+
+	baseURL, err := httpBaseURL(opts.config)
+	if err != nil {
+		return err
+	}
+
+	registry, err := openRegistry(opts.logger.With("subsystem", "clients"), stateDB)
+	if err != nil {
+		return fmt.Errorf("failed to open client registry: %w", err)
+	}
+
+	quirkTable, err := quirks.NewTable(opts.config.Quirks, registry)
+	if err != nil {
+		return fmt.Errorf("failed to load client quirks: %w", err)
+	}
+
+	access, err := acl.New(&opts.config.Access, registry)
+	if err != nil {
+		return fmt.Errorf("failed to load access rules: %w", err)
+	}
+
+	// Each machine's boot is followed across DHCP, TFTP and HTTP, so that operators can
+	// see where it got stuck
+	sessions := bootsession.New(opts.logger.With("subsystem", "sessions"), &opts.config.BootSessions, registry)
+
+	requests, err := requestlog.New(opts.logger.With("subsystem", "requests"), &opts.config.RequestLog, registry, sessions)
+	if err != nil {
+		return fmt.Errorf("failed to create request logger: %w", err)
+	}
+
+	oneshots, err := openOneShotStore(opts.config, stateDB)
+	if err != nil {
+		return fmt.Errorf("failed to open one-shot assignment store: %w", err)
+	}
+
+	statuses, err := openHostStatusStore(opts.config, stateDB)
+	if err != nil {
+		return fmt.Errorf("failed to open host status store: %w", err)
+	}
+
+	events, err := audit.Open(opts.logger.With("subsystem", "audit"), filepath.Join(opts.config.StorageDir, auditLogPath))
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer events.Close()
+
+	notifier, err := notify.New(opts.logger.With("subsystem", "notify"), &opts.config.Notify)
+	if err != nil {
+		return fmt.Errorf("failed to create notifier: %w", err)
+	}
+
+	if !notifier.Empty() {
+		events.AddSink(notifier)
+	}
+
+	// The status shows how far each host last got booting, including before pixie started
+	boots := status.NewBoots()
+	if err := boots.Load(filepath.Join(opts.config.StorageDir, auditLogPath)); err != nil {
+		opts.logger.Warn("failed to read previous boots from audit log",
+			"error", err,
+		)
+	}
+
+	events.AddSink(boots)
+	events.AddSink(sessions)
+
+	files, err := catalog.New(opts.logger.With("subsystem", "catalog"), bootloaders, distros, hostTable, registry, oneshots, events, opts.config.kernelArgs(), baseURL, opts.config.staticDirs(), &opts.config.Menu, &opts.config.Templates)
+	if err != nil {
+		return fmt.Errorf("failed to create file catalog: %w", err)
+	}
+
+	interfaces, err := newInterfaceTable(opts.config)
+	if err != nil {
+		return err
+	}
+
+	if opts.config.HTTP.PublicURL == "" {
+		files.SetInterfaces(interfaces)
+	}
+
+	// Boards' boot ROMs fetch their firmware before reaching a bootloader
+	boards, err := board.New(opts.config.Boards)
+	if err != nil {
+		return fmt.Errorf("failed to load boards: %w", err)
+	}
+
+	files.SetBoards(boards)
+
+	// Hosts report their install at URLs signed with the same key as automation files,
+	// whether or not those must be signed
+	signer, err := newURLSigner(opts.config)
+	if err != nil {
+		return err
+	}
+
+	files.SetReporter(signer)
+	if opts.config.SignedURLs.Enabled {
+		files.SetSigner(signer)
+	}
+
+	// Downloads in progress are let finish once the servers stop accepting requests
+	inflight := drain.New(opts.logger.With("subsystem", "drain"), &opts.config.Drain)
+
+	server := tftp.NewServer(opts.logger.With("subsystem", "tftp"), &opts.config.TFTP, files, quirkTable, access, requests, inflight)
+
+	for _, entrypointPath := range files.EntrypointPaths() {
+		opts.logger.Info("serving bootloader entrypoint",
+			"path", entrypointPath,
+		)
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	listeners := &status.Listeners{}
+
+	if !notifier.Empty() {
+		eg.Go(func() error {
+			return notifier.Run(ctx)
+		})
+	}
+
+	eg.Go(func() error {
+		return sessions.Run(ctx)
+	})
+
+	eg.Go(func() error {
+		return listeners.Run("tftp", opts.config.TFTP.Address, func() error {
+			if err := server.ListenAndServe(ctx); err != nil {
+				return fmt.Errorf("TFTP server failed: %w", err)
+			}
+
+			return nil
+		})
+	})
+
+	httpLogger := opts.logger.With("subsystem", "http")
+	httpServer := httpserver.NewServer(httpLogger, &opts.config.HTTP, inflight)
+
+	compressor, err := httpcompress.New(&opts.config.HTTP.Compression)
+	if err != nil {
+		return fmt.Errorf("invalid HTTP compression config: %w", err)
+	}
+
+	// Handlers used by booting clients are subject to the access rules, their requests
+	// are logged, and their responses are compressed for clients that accept it
+	handleBoot := func(pattern string, handler http.Handler) {
+		httpServer.Handle(pattern, access.Middleware(httpLogger, requests.Middleware(compressor.Middleware(handler))))
+	}
+
+	handleBoot("GET "+timehint.Path, timehint.Handler())
+	handleBoot("GET "+timehint.ScriptPath, timehint.ScriptHandler(httpServer.BaseURL))
+	handleBoot("GET "+catalog.AutomationPath, files.AutomationHandler(httpServer.BaseURL))
+	handleBoot("GET "+catalog.SignedAutomationPath, files.AutomationHandler(httpServer.BaseURL))
+	handleBoot("GET /", httpServer.LimitTransfers(files.Handler(compressor)))
+
+	hostExists := func(name string) bool {
+		_, ok := files.Hosts().Get(name)
+		return ok
+	}
+
+	// Hosts phone home from their install automation, with URLs signed for them rather
+	// than API tokens
+	var registrar *dnsreg.Registrar
+	if opts.config.DNSRegistration.Enabled {
+		registrar, err = dnsreg.New(opts.logger.With("subsystem", "dnsreg"), &opts.config.DNSRegistration)
+		if err != nil {
+			return fmt.Errorf("failed to set up DNS registration: %w", err)
+		}
+	}
+
+	// Hosts are registered in DNS from the address that they report a successful
+	// install from
+	register := func(name string, client string) {
+		if clientIP, _, err := net.SplitHostPort(client); err == nil {
+			registrar.RegisterAsync(name, net.ParseIP(clientIP))
+		}
+	}
+
+	reportLogger := opts.logger.With("subsystem", "hoststatus")
+	handleBoot("POST "+oneshot.CompletePath, autoinstall.RequireReportToken(reportLogger, signer, oneshot.CompleteHandler(opts.logger.With("subsystem", "oneshot"), oneshots, func(name string, client string) {
+		event := audit.Event{Type: audit.EventInstallComplete, Host: name}
+		if clientIP, _, err := net.SplitHostPort(client); err == nil {
+			event.IP = clientIP
+		}
+
+		events.Record(event)
+		register(name, client)
+	})))
+	handleBoot("POST "+hoststatus.ReportPath, autoinstall.RequireReportToken(reportLogger, signer, hoststatus.Handler(reportLogger, statuses, hostExists, func(report *hoststatus.Report) error {
+		event := audit.Event{Type: audit.EventInstallStatus, Host: report.Host, Detail: string(report.Status)}
+		if clientIP, _, err := net.SplitHostPort(report.Client); err == nil {
+			event.IP = clientIP
+		}
+
+		if report.Message != "" {
+			event.Detail += ": " + report.Message
+		}
+
+		events.Record(event)
+
+		if report.Status != hoststatus.StatusSuccess {
+			return nil
+		}
+
+		register(report.Host, report.Client)
+
+		_, err := oneshots.Complete(report.Host, oneshot.UntilCompletion)
+		return err //nolint:wrapcheck
+	})))
+
+	reloader := &reloader{
+		logger:       opts.logger.With("subsystem", "reload"),
+		distroLogger: opts.logger.With("subsystem", "distro"),
+		path:         opts.configPath,
+		site:         opts.site,
+		started:      opts.config,
+		current:      opts.config,
+		files:        files,
+		hostStore:    hostStore,
+		oneshots:     oneshots,
+		images:       images,
+		artifacts:    artifacts,
+		mirrors:      mirrors,
+		kube:         opts.kube,
+	}
+
+	if opts.kube != nil {
+		eg.Go(func() error {
+			return opts.kube.Run(ctx)
+		})
+	}
+
+	var controller *reconcile.Controller
+	if replica {
+		controller = reconcile.NewReplicaController(opts.logger.With("subsystem", "reconcile"), &opts.config.Reconcile, manager, files.SetDistros)
+	} else if opts.config.Reconcile.Enabled {
+		controller = reconcile.NewController(opts.logger.With("subsystem", "reconcile"), &opts.config.Reconcile, manager, events, files.SetDistros)
+	}
+
+	if controller != nil {
+		eg.Go(func() error {
+			return controller.Run(ctx)
+		})
+
+		reloader.controller = controller
+
+		// Corrupted kernels and initrds are downloaded again by the next reconcile
+		files.OnCorrupt(controller.Trigger)
+	}
+
+	if opts.config.API.RequireClientCertificate && (!opts.config.HTTP.TLS.Enabled() || opts.config.HTTP.TLS.ClientCAFile == "") {
+		return errNoClientCA
+	}
+
+	var leases *dhcp.LeaseStore
+	if opts.config.DHCP.Enabled {
+		leases, err = openLeaseStore(opts.config, stateDB)
+		if err != nil {
+			return fmt.Errorf("failed to open DHCP lease store: %w", err)
+		}
+	}
+
+	managementAPI, err := api.New(opts.logger.With("subsystem", "api"), &opts.config.API, &api.Options{
+		Catalog:      files,
+		Hosts:        hostStore,
+		RebuildHosts: reloader.RebuildHosts,
+		Templates:    &opts.config.Templates,
+		OneShots:     oneshots,
+		Statuses:     statuses,
+		Clients:      registry,
+		Leases:       leases,
+		WakeOnLAN:    &opts.config.WakeOnLAN,
+		Reconciler:   controller,
+		Transfers: map[string]*limiter.Limiter{
+			"tftp": server.Transfers(),
+			"http": httpServer.Transfers(),
+		},
+		Role:      opts.config.Role,
+		Started:   started,
+		Boots:     boots,
+		Sessions:  sessions,
+		Listeners: listeners,
+		Caches: []status.CacheSource{
+			{Name: "images", Usage: func() (int, int64, error) {
+				return images.Len(), images.Size(), nil
+			}},
+			{Name: "oci_blobs", Usage: manager.BlobCacheUsage},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create management API: %w", err)
+	}
+
+	managementAPI.Register(httpServer)
+
+	eg.Go(func() error {
+		return reloader.Run(ctx)
+	})
+
+	httpAddress := opts.config.HTTP.Address
+	if opts.config.HTTP.TLS.Enabled() {
+		httpAddress += "," + opts.config.HTTP.TLS.Address
+	}
+
+	eg.Go(func() error {
+		return listeners.Run("http", httpAddress, func() error {
+			return httpServer.ListenAndServe(ctx)
+		})
+	})
+
+	// UEFI HTTP boot clients are referred to the HTTP server by DHCP
+	bootHTTP, err := bootHTTPServer(opts.config)
+	if err != nil {
+		return err
+	}
+
+	if opts.config.ProxyDHCP.Enabled {
+		proxyServer, err := dhcp.NewProxyServer(opts.logger.With("subsystem", "proxydhcp"), &opts.config.ProxyDHCP, files, bootHTTP, quirkTable, registry, events, access, interfaces)
+		if err != nil {
+			return fmt.Errorf("failed to create ProxyDHCP server: %w", err)
+		}
+
+		eg.Go(func() error {
+			return listeners.Run("proxydhcp", opts.config.ProxyDHCP.Address+","+opts.config.ProxyDHCP.BootServerAddress, func() error {
+				if err := proxyServer.ListenAndServe(ctx); err != nil {
+					return fmt.Errorf("ProxyDHCP server failed: %w", err)
+				}
+
+				return nil
+			})
+		})
+	}
+
+	if opts.config.ProxyDHCPv6.Enabled {
+		if err := serveProxyDHCPv6(ctx, opts, eg, listeners, files, quirkTable, registry, events, access); err != nil {
+			return err
+		}
+	}
+
+	if opts.config.DHCP.Enabled {
+		if opts.config.ProxyDHCP.Enabled {
+			return errDHCPAndProxyDHCP
+		}
+
+		dhcpServer, err := dhcp.NewServer(opts.logger.With("subsystem", "dhcp"), &opts.config.DHCP, leases, files, bootHTTP, quirkTable, registry, events, access, interfaces)
+		if err != nil {
+			return fmt.Errorf("failed to create DHCP server: %w", err)
+		}
+
+		eg.Go(func() error {
+			return listeners.Run("dhcp", opts.config.DHCP.Address, func() error {
+				if err := dhcpServer.ListenAndServe(ctx); err != nil {
+					return fmt.Errorf("DHCP server failed: %w", err)
+				}
+
+				return nil
+			})
+		})
+	}
+
+	if opts.config.DNS.Enabled {
+		dnsServer, err := dns.NewServer(opts.logger.With("subsystem", "dns"), &opts.config.DNS)
+		if err != nil {
+			return fmt.Errorf("failed to create DNS server: %w", err)
+		}
+
+		eg.Go(func() error {
+			return listeners.Run("dns", opts.config.DNS.Address, func() error {
+				if err := dnsServer.ListenAndServe(ctx); err != nil {
+					return fmt.Errorf("DNS server failed: %w", err)
+				}
+
+				return nil
+			})
+		})
+	}
+
+	err = eg.Wait()
+
+	inflight.Wait()
+
+	return err //nolint:wrapcheck
+}
+
+// listenAddresses returns the addresses that the enabled servers listen on. The
+// ProxyDHCPv6 server joins a multicast group instead, so isn't checked.
+func listenAddresses(config *config) []sockets.Address {
+	addresses := []sockets.Address{
+		{Setting: "tftp.address", Network: "udp", Address: config.TFTP.Address, Interface: config.TFTP.Interface},
+		{Setting: "http.address", Network: "tcp", Address: config.HTTP.Address, Interface: config.HTTP.Interface},
+	}
+
+	if config.HTTP.TLS.Enabled() {
+		addresses = append(addresses, sockets.Address{Setting: "http.tls.address", Network: "tcp", Address: config.HTTP.TLS.Address, Interface: config.HTTP.Interface})
+	}
+
+	if config.ProxyDHCP.Enabled {
+		addresses = append(addresses,
+			sockets.Address{Setting: "proxy_dhcp.address", Network: "udp4", Address: config.ProxyDHCP.Address, Interface: config.ProxyDHCP.Interface},
+			sockets.Address{Setting: "proxy_dhcp.boot_server_address", Network: "udp4", Address: config.ProxyDHCP.BootServerAddress, Interface: config.ProxyDHCP.Interface},
+		)
+	}
+
+	if config.DHCP.Enabled {
+		addresses = append(addresses, sockets.Address{Setting: "dhcp.address", Network: "udp4", Address: config.DHCP.Address, Interface: config.DHCP.Interface})
+	}
+
+	if config.DNS.Enabled {
+		addresses = append(addresses, sockets.Address{Setting: "dns.address", Network: "udp", Address: config.DNS.Address, Interface: config.DNS.Interface})
+	}
+
+	return addresses
+}
+
+// httpBaseURL returns the URL at which clients can reach the HTTP server, for use in
+// files that aren't served over HTTP themselves (such as bootloader configs served over
+// TFTP). Unless a public URL is configured, this uses the DHCP server's address.
+func httpBaseURL(config *config) (string, error) {
+	if config.HTTP.PublicURL != "" {
+		return config.HTTP.PublicURL, nil
+	}
+
+	serverIP, err := httpServerIP(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine HTTP server address: %w", err)
+	}
+
+	server, err := bootHTTPServer(config)
+	if err != nil {
+		return "", err
+	}
+
+	scheme := "http"
+	if server.TLS {
+		scheme = "https"
+	}
+
+	return scheme + "://" + net.JoinHostPort(serverIP.String(), server.Port), nil
+}
+
+// bootHTTPServer returns where clients are referred to the HTTP server: over HTTPS if
+// it's served, so that automation files and their secrets aren't sent in the clear
+func bootHTTPServer(config *config) (*dhcp.HTTPServer, error) {
+	address := config.HTTP.Address
+	if config.HTTP.TLS.Enabled() {
+		address = config.HTTP.TLS.Address
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP server address '%s': %w", address, err)
+	}
+
+	return &dhcp.HTTPServer{Port: port, TLS: config.HTTP.TLS.Enabled()}, nil
+}
+
+// newInterfaceTable returns the addresses advertised to clients on each interface
+func newInterfaceTable(config *config) (*netif.Table, error) {
+	server, err := bootHTTPServer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces, err := netif.New(config.Interfaces, server.Port, server.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'interfaces': %w", err)
+	}
+
+	return interfaces, nil
+}
+
+// newURLSigner returns the signer of automation file and report URLs, with the configured
+// key or one kept in the storage directory
+func newURLSigner(config *config) (*urlsign.Signer, error) {
+	if config.SignedURLs.Enabled && config.SignedURLs.Lifetime <= 0 {
+		return nil, errNoURLLifetime
+	}
+
+	keyFile := config.SignedURLs.KeyFile
+	if keyFile == "" {
+		keyFile = filepath.Join(config.StorageDir, urlSigningKeyPath)
+	}
+
+	key, err := urlsign.LoadKey(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load URL signing key: %w", err)
+	}
+
+	return urlsign.New(key, config.SignedURLs.Lifetime), nil
+}
+
+// httpServerIP returns the address that clients reach pixie at: that of the DHCP
+// server, or, on IPv6-only networks, that of the ProxyDHCPv6 server
+func httpServerIP(config *config) (net.IP, error) {
+	if config.ProxyDHCPv6.Enabled && !config.DHCP.Enabled && !config.ProxyDHCP.Enabled {
+		iface, err := net.InterfaceByName(config.ProxyDHCPv6.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find interface '%s': %w", config.ProxyDHCPv6.Interface, err)
+		}
+
+		return dhcp.ServerIPv6(iface, config.ProxyDHCPv6.ServerIP) //nolint:wrapcheck
+	}
+
+	configuredIP, iface := config.DHCP.ServerIP, config.DHCP.Interface
+	if config.ProxyDHCP.Enabled {
+		configuredIP, iface = config.ProxyDHCP.ServerIP, config.ProxyDHCP.Interface
+	}
+
+	return dhcp.ServerIP(configuredIP, iface) //nolint:wrapcheck
+}
+
+// serveProxyDHCPv6 starts the ProxyDHCPv6 server, which gives clients URLs on the TFTP
+// and HTTP servers
+func serveProxyDHCPv6(ctx context.Context, opts *rootOptions, eg *errgroup.Group, listeners *status.Listeners, files *catalog.Catalog, quirkTable *quirks.Table, registry *clients.Registry, events *audit.Log, access *acl.List) error {
+	_, tftpPort, err := net.SplitHostPort(opts.config.TFTP.Address)
+	if err != nil {
+		return fmt.Errorf("invalid TFTP server address '%s': %w", opts.config.TFTP.Address, err)
+	}
+
+	httpServer, err := bootHTTPServer(opts.config)
+	if err != nil {
+		return err
+	}
+
+	config := &opts.config.ProxyDHCPv6
+
+	server, err := dhcp.NewProxyServerV6(opts.logger.With("subsystem", "proxydhcpv6"), config, tftpPort, httpServer, files, quirkTable, registry, events, access)
+	if err != nil {
+		return fmt.Errorf("failed to create ProxyDHCPv6 server: %w", err)
+	}
+
+	eg.Go(func() error {
+		return listeners.Run("proxydhcpv6", "[ff02::1:2%"+config.Interface+"]:547", func() error {
+			if err := server.ListenAndServe(ctx); err != nil {
+				return fmt.Errorf("ProxyDHCPv6 server failed: %w", err)
+			}
+
+			return nil
+		})
+	})
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/configfile"
+	"github.com/davejbax/pixie/internal/sockets"
+	"github.com/davejbax/pixie/internal/storage"
+	"github.com/spf13/viper"
+)
+
+// Directory within the top-level storage directory (and prefix within a shared object
+// store) that sites keep their state and distros in by default
+const sitesDirectory = "sites"
+
+// siteOwnSettings are the top-level settings that sites don't inherit, so that each site
+// has only its own distros and hosts
+var siteOwnSettings = []string{
+	"distros",
+	"hosts",
+	"hosts_directory",
+	"profiles",
+	"default_profile",
+	"kubernetes",
+}
+
+// processSettings are the top-level settings that apply to the whole process, so can't
+// be set per site
+var processSettings = []string{
+	"sites",
+	"log",
+	"sockets",
+	"age_key_file",
+}
+
+var (
+	errUnknownSite          = errors.New("site is not in config")
+	errProcessSetting       = errors.New("setting applies to every site, so can only be set at the top level")
+	errSharedStorage        = errors.New("sites must have their own storage directories")
+	errOverlappingAddresses = errors.New("servers of different sites listen on overlapping addresses; give each site its own address or interface")
+)
+
+// siteValues returns the config values of the named site: the top-level values, without
+// those that sites set for themselves, with the site's merged over them. The storage
+// directory and, if the top level keeps distros in an object store, the prefix of the
+// store default to 'sites/<name>' within the top level's.
+func siteValues(configPath string, values map[string]any, sources *configfile.Sources, site string) (map[string]any, error) {
+	base, err := decodeConfig(viper.New(), configPath, values, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	overlay, ok := base.Sites[site]
+	if !ok {
+		return nil, fmt.Errorf("'%s': %w", site, errUnknownSite)
+	}
+
+	for key := range overlay {
+		if slices.Contains(processSettings, strings.ToLower(key)) {
+			return nil, fmt.Errorf("'sites.%s.%s': %w", site, key, errProcessSetting)
+		}
+	}
+
+	inherited := make(map[string]any)
+
+	for key, value := range values {
+		key = strings.ToLower(key)
+		if key != "sites" && !slices.Contains(siteOwnSettings, key) {
+			inherited[key] = value
+		}
+	}
+
+	overlaid := viper.New()
+	if err := overlaid.MergeConfigMap(overlay); err != nil {
+		return nil, fmt.Errorf("failed to read config of site '%s': %w", site, err)
+	}
+
+	merged := viper.New()
+	if err := merged.MergeConfigMap(inherited); err != nil {
+		return nil, fmt.Errorf("failed to read config from '%s': %w", configPath, err)
+	}
+
+	if err := merged.MergeConfigMap(overlay); err != nil {
+		return nil, fmt.Errorf("failed to read config of site '%s': %w", site, err)
+	}
+
+	if !overlaid.IsSet("storage_directory") {
+		merged.Set("storage_directory", filepath.Join(base.StorageDir, sitesDirectory, site))
+	}
+
+	if base.Artifacts.Backend == storage.BackendS3 && !overlaid.IsSet("artifact_storage.s3.prefix") {
+		merged.Set("artifact_storage.s3.prefix", path.Join(base.Artifacts.S3.Prefix, sitesDirectory, site))
+	}
+
+	return merged.AllSettings(), nil
+}
+
+// openSite returns options for operating on the named site, with its own config,
+// logger and Kubernetes source
+func openSite(ctx context.Context, opts *rootOptions, site string) (*rootOptions, error) {
+	siteConfig, err := readConfig(viper.New(), opts.configPath, site)
+	if err != nil {
+		return nil, err
+	}
+
+	siteOpts := &rootOptions{
+		logger:     opts.logger.With("site", site),
+		config:     siteConfig,
+		configPath: opts.configPath,
+		site:       site,
+	}
+
+	if err := openKubernetesSource(ctx, siteOpts); err != nil {
+		return nil, fmt.Errorf("site '%s': %w", site, err)
+	}
+
+	return siteOpts, nil
+}
+
+// checkSites checks that sites served together don't share a storage directory, or
+// listen on overlapping addresses, which would mix up their distros, state and clients
+func checkSites(sites []*rootOptions) error {
+	errs := []error{}
+
+	for i, a := range sites {
+		for _, b := range sites[i+1:] {
+			if filepath.Clean(a.config.StorageDir) == filepath.Clean(b.config.StorageDir) {
+				errs = append(errs, fmt.Errorf("%s and %s: %w", describeSite(a.site), describeSite(b.site), errSharedStorage))
+			}
+
+			for _, x := range listenAddresses(a.config) {
+				for _, y := range listenAddresses(b.config) {
+					if addressesOverlap(x, y) {
+						errs = append(errs, fmt.Errorf("'%s' of %s and '%s' of %s: %w", x.Setting, describeSite(a.site), y.Setting, describeSite(b.site), errOverlappingAddresses))
+					}
+				}
+			}
+
+			// Both ProxyDHCPv6 servers would answer each client on a shared interface
+			if a.config.ProxyDHCPv6.Enabled && b.config.ProxyDHCPv6.Enabled && a.config.ProxyDHCPv6.Interface == b.config.ProxyDHCPv6.Interface {
+				errs = append(errs, fmt.Errorf("'proxy_dhcpv6.interface' of %s and %s: %w", describeSite(a.site), describeSite(b.site), errOverlappingAddresses))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// describeSite names a site in errors
+func describeSite(site string) string {
+	if site == "" {
+		return "the top-level config"
+	}
+
+	return fmt.Sprintf("site '%s'", site)
+}
+
+// addressesOverlap returns whether sockets for both addresses would receive the same
+// traffic (or fail to be bound together): both TCP or both UDP, on the same port, with
+// the same host or one that listens on every address, and not bound to different
+// interfaces
+func addressesOverlap(a sockets.Address, b sockets.Address) bool {
+	if strings.HasPrefix(a.Network, "udp") != strings.HasPrefix(b.Network, "udp") {
+		return false
+	}
+
+	if a.Interface != "" && b.Interface != "" && a.Interface != b.Interface {
+		return false
+	}
+
+	aHost, aPort, aErr := net.SplitHostPort(a.Address)
+	bHost, bPort, bErr := net.SplitHostPort(b.Address)
+
+	if aErr != nil || bErr != nil {
+		return a.Address == b.Address
+	}
+
+	if aPort != bPort {
+		return false
+	}
+
+	unspecified := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || (ip != nil && ip.IsUnspecified())
+	}
+
+	if unspecified(aHost) || unspecified(bHost) {
+		return true
+	}
+
+	aIP, bIP := net.ParseIP(aHost), net.ParseIP(bHost)
+
+	return aHost == bHost || (aIP != nil && aIP.Equal(bIP))
+}
+
+// siteNames returns the names of the sites in the config, in order
+func siteNames(config *config) []string {
+	return slices.Sorted(maps.Keys(config.Sites))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/davejbax/pixie/internal/clients"
+	"github.com/davejbax/pixie/internal/dhcp"
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/hoststatus"
+	"github.com/davejbax/pixie/internal/oneshot"
+	"github.com/davejbax/pixie/internal/storage"
+	"github.com/davejbax/pixie/internal/store"
+)
+
+// openStateDB opens the state database if runtime state is kept in SQLite, and otherwise
+// returns nil, in which case each store uses its JSON file
+func openStateDB(config *config) (*store.DB, error) {
+	if err := config.State.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid state config: %w", err)
+	}
+
+	if config.State.Backend != store.BackendSQLite {
+		return nil, nil //nolint:nilnil
+	}
+
+	db, err := store.Open(filepath.Join(config.StorageDir, config.State.Path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database: %w", err)
+	}
+
+	return db, nil
+}
+
+// openArtifactStore opens the store that downloaded distros are kept in. Local stores
+// keep them in the storage directory.
+func openArtifactStore(config *config) (storage.Backend, error) {
+	backend, err := storage.Open(&config.Artifacts, config.StorageDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid artifact storage config: %w", err)
+	}
+
+	return backend, nil
+}
+
+func openHostStore(config *config, db *store.DB) (*hosts.Store, error) {
+	if db != nil {
+		return hosts.OpenDBStore(db) //nolint:wrapcheck
+	}
+
+	return hosts.OpenStore(filepath.Join(config.StorageDir, hostsPath)) //nolint:wrapcheck
+}
+
+func openOneShotStore(config *config, db *store.DB) (*oneshot.Store, error) {
+	if db != nil {
+		return oneshot.OpenDB(db) //nolint:wrapcheck
+	}
+
+	return oneshot.Open(filepath.Join(config.StorageDir, oneshotPath)) //nolint:wrapcheck
+}
+
+func openHostStatusStore(config *config, db *store.DB) (*hoststatus.Store, error) {
+	if db != nil {
+		return hoststatus.OpenDB(db) //nolint:wrapcheck
+	}
+
+	return hoststatus.Open(filepath.Join(config.StorageDir, hostStatusPath)) //nolint:wrapcheck
+}
+
+func openLeaseStore(config *config, db *store.DB) (*dhcp.LeaseStore, error) {
+	if db != nil {
+		return dhcp.OpenDBLeaseStore(db) //nolint:wrapcheck
+	}
+
+	return dhcp.OpenLeaseStore(filepath.Join(config.StorageDir, dhcpLeasesPath)) //nolint:wrapcheck
+}
+
+// openRegistry creates the client registry. Clients are only persisted in the state
+// database: with JSON state, the registry starts empty.
+func openRegistry(logger *slog.Logger, db *store.DB) (*clients.Registry, error) {
+	if db != nil {
+		return clients.OpenRegistry(logger, db) //nolint:wrapcheck
+	}
+
+	return clients.NewRegistry(), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/davejbax/pixie/internal/api"
+	"github.com/davejbax/pixie/internal/status"
+	"github.com/spf13/cobra"
+)
+
+// How long to wait for a running pixie to respond with its status
+const statusTimeout = 10 * time.Second
+
+type outputFormatFlag string
+
+const (
+	outputFormatTable = outputFormatFlag("table")
+	outputFormatJSON  = outputFormatFlag("json")
+)
+
+var (
+	errUnrecognisedOutputFormat = errors.New("invalid output format; valid values are 'table' or 'json'")
+	errStatusRequest            = errors.New("unsuccessful status from pixie")
+)
+
+func (o *outputFormatFlag) Set(name string) error {
+	if name != string(outputFormatTable) && name != string(outputFormatJSON) {
+		return errUnrecognisedOutputFormat
+	}
+
+	*o = outputFormatFlag(name)
+	return nil
+}
+
+func (o *outputFormatFlag) String() string {
+	return string(*o)
+}
+
+func (o *outputFormatFlag) Type() string {
+	return "<" + strings.Join([]string{string(outputFormatTable), string(outputFormatJSON)}, "|") + ">"
+}
+
+func newStatusCommand(opts *rootOptions) *cobra.Command {
+	serverURL := ""
+	token := ""
+	format := outputFormatTable
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the status of a running pixie",
+		Long: `Show the status of a running pixie: the distros it serves, when each host last
+booted, the state of its listeners, and the usage of its caches.
+
+The status is read from the management API, at ` + api.StatusPath + `. By default, this
+is the HTTP server on this machine, authenticated with the first API token in the config.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			if serverURL == "" {
+				var err error
+				if serverURL, err = localAPIURL(opts.config); err != nil {
+					return err
+				}
+			}
+
+			if token == "" && len(opts.config.API.Tokens) > 0 {
+				token = opts.config.API.Tokens[0]
+			}
+
+			body, err := fetchStatus(cmd.Context(), serverURL, token)
+			if err != nil {
+				return err
+			}
+
+			if format == outputFormatJSON {
+				_, err := os.Stdout.Write(body)
+				return err //nolint:wrapcheck
+			}
+
+			var doc status.Document
+			if err := json.Unmarshal(body, &doc); err != nil {
+				return fmt.Errorf("failed to decode status: %w", err)
+			}
+
+			return writeStatusTable(os.Stdout, &doc)
+		},
+	}
+
+	cmd.Flags().StringVar(&serverURL, "url", "", "Base URL of the running pixie's HTTP server (default: the configured HTTP address on localhost)")
+	cmd.Flags().StringVar(&token, "token", "", "API token to authenticate with (default: the first token in the config)")
+	cmd.Flags().VarP(&format, "output", "o", "Output format")
+
+	return cmd
+}
+
+// localAPIURL returns the URL of the configured HTTP server on this machine
+func localAPIURL(config *config) (string, error) {
+	host, port, err := net.SplitHostPort(config.HTTP.Address)
+	if err != nil {
+		return "", fmt.Errorf("invalid HTTP server address '%s': %w", config.HTTP.Address, err)
+	}
+
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	return "http://" + net.JoinHostPort(host, port), nil
+}
+
+func fetchStatus(ctx context.Context, serverURL string, token string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(serverURL, "/")+api.StatusPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create status request: %w", err)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request status: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s: %w", resp.Status, strings.TrimSpace(string(body)), errStatusRequest)
+	}
+
+	return body, nil
+}
+
+// writeStatusTable writes the status as a series of tables, one for each part of pixie
+func writeStatusTable(w io.Writer, doc *status.Document) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Role:\t%s\n", doc.Role)
+	fmt.Fprintf(tw, "Started:\t%s (up %s)\n", doc.StartedAt.Local().Format(time.DateTime), doc.Time.Sub(doc.StartedAt).Round(time.Second))
+
+	if doc.Reconcile != nil {
+		fmt.Fprintf(tw, "Last reconcile:\t%s\n", describeReconcile(doc.Reconcile.LastSuccess, doc.Reconcile.ConsecutiveFailures, doc.Reconcile.LastError))
+		fmt.Fprintf(tw, "Next reconcile:\t%s\n", formatTime(doc.Reconcile.NextRun))
+	}
+
+	fmt.Fprintln(tw, "\nDISTRO\tARCH\tVERSION\tHASH\tTREE\tUPDATE AVAILABLE")
+
+	for _, d := range doc.Distros {
+		update := "-"
+		if d.UpdateAvailable != "" {
+			update = shortHash(d.UpdateAvailable)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%s\n", d.Name, d.Arch, orDash(d.Version), shortHash(d.Hash), d.Tree, update)
+	}
+
+	fmt.Fprintln(tw, "\nHOST\tMAC\tDISTRO\tLAST BOOT\tSTAGE\tINSTALL")
+
+	for _, host := range doc.Hosts {
+		lastBoot, stage := "-", "-"
+		if host.LastBoot != nil {
+			lastBoot = formatTime(host.LastBoot.Time)
+			stage = string(host.LastBoot.Stage)
+		}
+
+		install := "-"
+		if host.Install != nil {
+			install = string(host.Install.Status)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", host.Name, orDash(host.MAC), orDash(host.Distro), lastBoot, stage, install)
+	}
+
+	fmt.Fprintln(tw, "\nLISTENER\tADDRESS\tSTATE\tSINCE\tERROR")
+
+	for _, listener := range doc.Listeners {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", listener.Name, listener.Address, listener.State, formatTime(listener.Since), orDash(listener.Error))
+	}
+
+	fmt.Fprintln(tw, "\nTRANSFERS\tACTIVE\tQUEUED\tSHED")
+
+	for _, service := range slices.Sorted(maps.Keys(doc.Transfers)) {
+		stats := doc.Transfers[service]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", service, stats.Active, stats.Queued, stats.Shed)
+	}
+
+	fmt.Fprintln(tw, "\nCACHE\tENTRIES\tSIZE\tERROR")
+
+	for _, cache := range doc.Caches {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", cache.Name, cache.Entries, formatSize(cache.Bytes), orDash(cache.Error))
+	}
+
+	return tw.Flush() //nolint:wrapcheck
+}
+
+func describeReconcile(lastSuccess time.Time, failures int, lastError string) string {
+	description := "never succeeded"
+	if !lastSuccess.IsZero() {
+		description = "succeeded " + formatTime(lastSuccess)
+	}
+
+	if failures > 0 {
+		description += fmt.Sprintf(", %d failures since: %s", failures, lastError)
+	}
+
+	return description
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Local().Format(time.DateTime)
+}
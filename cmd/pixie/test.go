@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"text/tabwriter"
+	"time"
+
+	"github.com/davejbax/pixie/internal/dhcp"
+	"github.com/davejbax/pixie/internal/e2e"
+	"github.com/spf13/cobra"
+)
+
+// GRUB prints its version above the menu, and when booting an entry with the menu hidden
+const defaultBootExpect = `GNU GRUB|Booting a command list|Booting '`
+
+func newTestCommand(opts *rootOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "test",
+		Short: "Check that generated images and configs boot",
+	}
+
+	cmd.AddCommand(
+		newTestBootCommand(opts),
+		newTestClientCommand(opts),
+	)
+
+	return cmd
+}
+
+func newTestBootCommand(opts *rootOptions) *cobra.Command {
+	targets := []string{}
+	isoPath := ""
+	distro := ""
+	expect := ""
+	timeout := time.Duration(0)
+	workDirectory := ""
+	firmware := map[string]string{}
+
+	cmd := &cobra.Command{
+		Use:   "boot",
+		Short: "Boot QEMU VMs from an ISO image or from pixie over the network, and check that they reach GRUB",
+		Long: `Boot QEMU VMs from an ISO image or from pixie over the network, and check that they reach GRUB.
+
+With --iso, each UEFI target boots the ISO image (see 'pixie iso'). The ISO's GRUB must
+use the serial console (grub.serial.enabled) for its menu to be seen.
+
+Otherwise, each target network boots from pixie on a private network, as in 'pixie e2e',
+with GRUB made to use the serial console. This requires root (or CAP_NET_ADMIN) and
+iproute2.
+
+Either way, QEMU is required, along with UEFI firmware images for the UEFI targets. The
+command exits nonzero if any target fails to reach the expected pattern.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			pattern, err := regexp.Compile(expect)
+			if err != nil {
+				return fmt.Errorf("invalid expect pattern: %w", err)
+			}
+
+			if workDirectory == "" {
+				workDirectory, err = os.MkdirTemp("", "pixie-test-*")
+			} else {
+				err = os.MkdirAll(workDirectory, 0o755)
+			}
+
+			if err != nil {
+				return fmt.Errorf("failed to create work directory: %w", err)
+			}
+
+			e2eOpts := &e2e.Options{
+				Targets:       targets,
+				Firmware:      firmware,
+				Expect:        pattern,
+				Timeout:       timeout,
+				WorkDirectory: workDirectory,
+			}
+
+			results, runErr := runBootTest(cmd.Context(), opts, e2eOpts, isoPath, distro)
+
+			if err := printE2EResults(results); err != nil {
+				return err
+			}
+
+			if runErr != nil {
+				return fmt.Errorf("boot test failed: %w", runErr)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&targets, "target", []string{"uefi-x64"}, "Targets to boot")
+	cmd.Flags().StringVar(&isoPath, "iso", "", "Boot this ISO image, rather than booting from pixie over the network")
+	cmd.Flags().StringVar(&distro, "distro", "", "Only serve the named distro from config when network booting")
+	cmd.Flags().StringVar(&expect, "expect", defaultBootExpect, "Pattern in the serial console output that marks a successful boot")
+	cmd.Flags().DurationVar(&timeout, "timeout", 5*time.Minute, "How long each VM has to reach the expected pattern")
+	cmd.Flags().StringVar(&workDirectory, "work-dir", "", "Directory for logs and generated config (defaults to a new temporary directory)")
+	cmd.Flags().StringToStringVar(&firmware, "firmware", map[string]string{}, "Firmware image to use for a target, as target=path")
+
+	return cmd
+}
+
+func newTestClientCommand(opts *rootOptions) *cobra.Command {
+	mac := ""
+	uuid := ""
+	arch := ""
+	bootServer := ""
+	httpURL := ""
+	entry := ""
+	dhcpTimeout := time.Duration(0)
+
+	cmd := &cobra.Command{
+		Use:   "client",
+		Short: "Act like a PXE client booting from a running pixie, and check each step of the boot",
+		Long: `Act like a PXE client booting from a running pixie, and check each step of the boot.
+
+The client broadcasts a DHCPDISCOVER with PXE options, downloads the offered boot file
+over TFTP (checking that it's an EFI image for the client's architecture), then
+downloads the GRUB config that GRUB would load for the client's MAC address, and the
+kernel and initrds of a menu entry. This tests the whole serving path without real
+hardware.
+
+Broadcasting needs root (or CAP_NET_BIND_SERVICE), and a host on the same network as
+pixie. With --boot-server, the client instead asks pixie's ProxyDHCP boot server
+(port 4011) for its boot file directly, which works from anywhere that can reach pixie.
+
+The command exits nonzero if any step fails. It doesn't need a config file, as it
+usually runs on a different host to pixie.`,
+		Args: cobra.NoArgs,
+		PersistentPreRunE: func(_ *cobra.Command, _ []string) error {
+			opts.logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			hwAddr, err := net.ParseMAC(mac)
+			if err != nil {
+				return fmt.Errorf("invalid MAC address: %w", err)
+			}
+
+			clientArch, err := dhcp.ParseClientArch(arch)
+			if err != nil {
+				return fmt.Errorf("invalid architecture: %w", err)
+			}
+
+			steps := e2e.SimulateClient(cmd.Context(), opts.logger, &e2e.ClientOptions{
+				Client:      &dhcp.PXEClient{MAC: hwAddr, Arch: clientArch, UUID: uuid},
+				BootServer:  bootServer,
+				DHCPTimeout: dhcpTimeout,
+				HTTPURL:     httpURL,
+				Entry:       entry,
+			})
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "STEP\tRESULT\tBYTES\tDURATION\tDETAIL")
+
+			var failed error
+
+			for _, step := range steps {
+				result := "pass"
+				if step.Err != nil {
+					result = "fail: " + step.Err.Error()
+					failed = step.Err
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", step.Name, result, step.Bytes, step.Duration.Round(time.Millisecond), step.Detail)
+			}
+
+			if err := w.Flush(); err != nil {
+				return fmt.Errorf("failed to write results: %w", err)
+			}
+
+			if failed != nil {
+				return fmt.Errorf("simulated boot failed: %w", failed)
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&mac, "mac", "", "MAC address of the simulated client")
+	cmd.Flags().StringVar(&uuid, "uuid", "", "SMBIOS UUID of the simulated client, sent in DHCP option 97")
+	cmd.Flags().StringVar(&arch, "arch", "efi-x64", "Architecture of the simulated client: bios, efi-ia32, efi-x64, efi-arm32 or efi-arm64")
+	cmd.Flags().StringVar(&bootServer, "boot-server", "", "Ask this PXE boot server (host:port, e.g. 'pixie.example.com:4011') for a boot file, rather than broadcasting a DHCPDISCOVER")
+	cmd.Flags().StringVar(&httpURL, "http", "", "Fetch the GRUB config, kernel and initrds over HTTP from this base URL (e.g. 'http://pixie.example.com:8080'), rather than over TFTP")
+	cmd.Flags().StringVar(&entry, "entry", "", "Title of the menu entry to fetch the kernel and initrds of (defaults to the first that boots a kernel)")
+	cmd.Flags().DurationVar(&dhcpTimeout, "dhcp-timeout", 5*time.Second, "How long to wait for DHCP offers")
+
+	_ = cmd.MarkFlagRequired("mac")
+
+	return cmd
+}
+
+func runBootTest(ctx context.Context, opts *rootOptions, e2eOpts *e2e.Options, isoPath string, distro string) ([]*e2e.Result, error) {
+	if isoPath != "" {
+		return e2e.BootISO(ctx, opts.logger, e2eOpts, isoPath) //nolint:wrapcheck
+	}
+
+	configPath, err := writeE2EConfig(e2eOpts.WorkDirectory, distro, true)
+	if err != nil {
+		return nil, err
+	}
+
+	pixiePath, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find pixie executable: %w", err)
+	}
+
+	e2eOpts.PixiePath = pixiePath
+	e2eOpts.ConfigPath = configPath
+
+	return e2e.Run(ctx, opts.logger, e2eOpts) //nolint:wrapcheck
+}
@@ -0,0 +1,195 @@
+// Package acl decides which clients pixie's boot services (TFTP, HTTP and DHCP) answer,
+// by source address and MAC prefix, so that pixie can share a network with other
+// tenants and only serve the provisioning network
+package acl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/davejbax/pixie/internal/clients"
+)
+
+// Action is what a rule does with the clients it matches
+type Action string
+
+const (
+	ActionAllow Action = "allow"
+	ActionDeny  Action = "deny"
+)
+
+var (
+	errInvalidAction = errors.New("action must be 'allow' or 'deny'")
+	errNoMatchers    = errors.New("rule must have a CIDR or MAC prefix")
+)
+
+type Config struct {
+	// Rules checked in order. The first rule matching a client decides whether it is
+	// answered.
+	Rules []Rule
+
+	// Action for clients that match no rule
+	Default Action `default:"allow"`
+}
+
+// Rule allows or denies clients matching its CIDR and MAC prefix. If both are given,
+// clients must match both.
+type Rule struct {
+	Action Action
+
+	// Source address range, e.g. '10.20.0.0/16'. DHCP clients without an address are
+	// matched by the address of the relay agent that forwarded their request, if any.
+	CIDR string
+
+	// Prefix of the client's MAC address, usually an OUI, e.g. '00:1b:21'. Services that
+	// only see the client's IP (TFTP and HTTP) find its MAC address from DHCP or the
+	// system ARP table.
+	MACPrefix string `mapstructure:"mac_prefix"`
+
+	prefix    netip.Prefix
+	macPrefix net.HardwareAddr
+}
+
+func (r *Rule) matches(ip net.IP, mac net.HardwareAddr) bool {
+	if r.prefix.IsValid() {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok || !r.prefix.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+
+	if r.macPrefix != nil && !bytes.HasPrefix(mac, r.macPrefix) {
+		return false
+	}
+
+	return true
+}
+
+// List is an access control list. A nil list allows every client.
+type List struct {
+	rules    []Rule
+	fallback Action
+	clients  *clients.Registry
+
+	// Whether any rule matches by MAC prefix, in which case clients seen only by IP
+	// must have their MAC address looked up
+	needsMAC bool
+}
+
+// New creates an access control list from the config. MAC addresses of clients seen
+// only by IP are looked up in the given registry, which may be nil.
+func New(config *Config, registry *clients.Registry) (*List, error) {
+	if err := validateAction(config.Default); err != nil {
+		return nil, fmt.Errorf("invalid default access action: %w", err)
+	}
+
+	rules := make([]Rule, len(config.Rules))
+	needsMAC := false
+
+	for i, rule := range config.Rules {
+		if err := validateAction(rule.Action); err != nil {
+			return nil, fmt.Errorf("invalid access rule %d: %w", i, err)
+		}
+
+		if rule.CIDR == "" && rule.MACPrefix == "" {
+			return nil, fmt.Errorf("invalid access rule %d: %w", i, errNoMatchers)
+		}
+
+		if rule.CIDR != "" {
+			prefix, err := netip.ParsePrefix(rule.CIDR)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR in access rule %d: %w", i, err)
+			}
+
+			rule.prefix = prefix.Masked()
+		}
+
+		if rule.MACPrefix != "" {
+			macPrefix, err := clients.ParseMACPrefix(rule.MACPrefix)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MAC prefix in access rule %d: %w", i, err)
+			}
+
+			rule.macPrefix = macPrefix
+			needsMAC = true
+		}
+
+		rules[i] = rule
+	}
+
+	return &List{
+		rules:    rules,
+		fallback: config.Default,
+		clients:  registry,
+		needsMAC: needsMAC,
+	}, nil
+}
+
+func validateAction(action Action) error {
+	if action != ActionAllow && action != ActionDeny {
+		return fmt.Errorf("'%s': %w", action, errInvalidAction)
+	}
+
+	return nil
+}
+
+// Allowed returns whether the client with the given IP and MAC address should be
+// answered. Either may be nil if unknown, in which case rules needing it don't match.
+func (l *List) Allowed(ip net.IP, mac net.HardwareAddr) bool {
+	if l == nil {
+		return true
+	}
+
+	for i := range l.rules {
+		if l.rules[i].matches(ip, mac) {
+			return l.rules[i].Action == ActionAllow
+		}
+	}
+
+	return l.fallback == ActionAllow
+}
+
+// AllowedIP returns whether the client with the given IP address should be answered,
+// looking up its MAC address if any rules need it
+func (l *List) AllowedIP(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+
+	var mac net.HardwareAddr
+	if l.needsMAC && ip != nil {
+		mac = l.clients.Lookup(ip).MAC
+	}
+
+	return l.Allowed(ip, mac)
+}
+
+// Middleware rejects HTTP requests from clients that aren't allowed
+func (l *List) Middleware(logger *slog.Logger, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ip net.IP
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ip = net.ParseIP(host)
+		}
+
+		if !l.AllowedIP(ip) {
+			logger.Debug("rejecting HTTP request from client denied by access rules",
+				"client", r.RemoteAddr,
+				"path", r.URL.Path,
+			)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
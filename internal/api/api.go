@@ -0,0 +1,400 @@
+// Package api implements pixie's management API: an HTTP+JSON API under '/api' for
+// inspecting distros and hosts, creating and updating hosts, assigning one-shot installs
+// and triggering reconciles, so that external automation can drive pixie. The API is
+// only served when clients can be authenticated, as it changes how hosts boot.
+package api
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davejbax/pixie/internal/autoinstall"
+	"github.com/davejbax/pixie/internal/bootsession"
+	"github.com/davejbax/pixie/internal/catalog"
+	"github.com/davejbax/pixie/internal/clients"
+	"github.com/davejbax/pixie/internal/dhcp"
+	"github.com/davejbax/pixie/internal/distro"
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/hoststatus"
+	"github.com/davejbax/pixie/internal/httpserver"
+	"github.com/davejbax/pixie/internal/limiter"
+	"github.com/davejbax/pixie/internal/oneshot"
+	"github.com/davejbax/pixie/internal/reconcile"
+	"github.com/davejbax/pixie/internal/status"
+	"github.com/davejbax/pixie/internal/wol"
+)
+
+const (
+	// DistrosPath lists the distros being served
+	DistrosPath = "/api/distros"
+
+	// HostsPath lists all hosts
+	HostsPath = "/api/hosts"
+
+	// HostPath is the API path of a single host: GET shows it, PUT creates or updates it,
+	// and DELETE removes it. Only hosts created through the API can be changed.
+	HostPath = "/api/hosts/{name}"
+
+	// HostConfigPath previews the bootloader config generated for a host. The optional
+	// 'path' query parameter selects a bootloader by its default config path.
+	HostConfigPath = "/api/hosts/{name}/config"
+
+	// TransfersPath shows the TFTP and HTTP transfers in progress and queued
+	TransfersPath = "/api/transfers"
+
+	// ClientsPath lists the network boot clients seen by DHCP, and when they were last
+	// seen
+	ClientsPath = "/api/clients"
+
+	// LeasesPath lists the dynamic leases of the DHCP server
+	LeasesPath = "/api/leases"
+
+	// LeaseHistoryPath lists changes to DHCP leases, newest first. The optional 'mac'
+	// query parameter selects a single client, and 'limit' limits the number of events.
+	// History is only kept in the SQLite state backend.
+	LeaseHistoryPath = "/api/leases/history"
+
+	// NetbootPath makes a host network boot once and power-cycles it (with POST),
+	// through its BMC
+	NetbootPath = "/api/hosts/{name}/netboot"
+
+	// WakePath sends a Wake-on-LAN magic packet (with POST) to the machine with the
+	// given MAC address, or to the host with the given name
+	WakePath = "/api/wake/{target}"
+
+	// SessionsPath lists boot sessions, newest first: each machine's DHCP offer and file
+	// requests, correlated across protocols. The optional 'mac', 'host' and 'state'
+	// query parameters select sessions.
+	SessionsPath = "/api/sessions"
+
+	// SessionPath shows a single boot session
+	SessionPath = "/api/sessions/{id}"
+
+	// StatusPath shows the status of pixie as a whole, as a [status.Document]
+	StatusPath = "/api/v1/status"
+)
+
+type Config struct {
+	// Bearer tokens that API clients must present. If no tokens are given and client
+	// certificates aren't required, the API isn't served.
+	Tokens []string
+
+	// File containing further tokens, one per line, so that tokens can be kept out of
+	// the config file
+	TokenFile string `mapstructure:"token_file"`
+
+	// Require API clients to connect over HTTPS with a client certificate signed by
+	// one of the HTTP server's client CAs (mutual TLS), as well as any tokens
+	RequireClientCertificate bool `mapstructure:"require_client_certificate"`
+}
+
+// Options are the parts of pixie that the API inspects and controls
+type Options struct {
+	Catalog *catalog.Catalog
+
+	// Hosts created through the API
+	Hosts *hosts.Store
+
+	// Rebuilds the host table after Hosts has changed, returning an error if the
+	// resulting hosts are invalid
+	RebuildHosts func() error
+
+	// Where hosts' automation templates are read from
+	Templates *autoinstall.Sources
+
+	OneShots *oneshot.Store
+	Statuses *hoststatus.Store
+
+	// Clients seen by DHCP
+	Clients *clients.Registry
+
+	// Leases of the DHCP server, if it is enabled
+	Leases *dhcp.LeaseStore
+
+	// Where Wake-on-LAN magic packets are sent
+	WakeOnLAN *wol.Config
+
+	// Reconcile controller, if periodic reconciles are enabled
+	Reconciler *reconcile.Controller
+
+	// Transfer limiters, keyed by the service they limit. Nil limiters are unlimited.
+	Transfers map[string]*limiter.Limiter
+
+	// Role of the instance, and when it started serving
+	Role    string
+	Started time.Time
+
+	// Latest boot stage reached by each host
+	Boots *status.Boots
+
+	// Boot sessions of all machines, including those that aren't hosts
+	Sessions *bootsession.Tracker
+
+	// Servers being run, and caches whose usage is reported in the status
+	Listeners *status.Listeners
+	Caches    []status.CacheSource
+}
+
+type API struct {
+	logger  *slog.Logger
+	config  *Config
+	options *Options
+	tokens  [][]byte
+
+	// Serialises changes to hosts, which must be validated and rolled back as a whole
+	hostsMu sync.Mutex
+}
+
+func New(logger *slog.Logger, config *Config, options *Options) (*API, error) {
+	tokens := make([][]byte, 0, len(config.Tokens))
+	for _, token := range config.Tokens {
+		tokens = append(tokens, []byte(token))
+	}
+
+	if config.TokenFile != "" {
+		fileTokens, err := readTokenFile(config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, fileTokens...)
+	}
+
+	return &API{
+		logger:  logger,
+		config:  config,
+		options: options,
+		tokens:  tokens,
+	}, nil
+}
+
+func readTokenFile(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open API token file: %w", err)
+	}
+	defer file.Close()
+
+	tokens := [][]byte{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if token := strings.TrimSpace(scanner.Text()); token != "" && !strings.HasPrefix(token, "#") {
+			tokens = append(tokens, []byte(token))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read API token file: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// Register adds the API's handlers to the server. Without tokens or client
+// certificates, anyone who can reach the server could manage pixie, so no handlers are
+// added.
+func (a *API) Register(server *httpserver.Server) {
+	if len(a.tokens) == 0 && !a.config.RequireClientCertificate {
+		a.logger.Warn("no API tokens configured and client certificates not required: the management API is disabled")
+		return
+	}
+
+	hostExists := func(name string) bool {
+		_, ok := a.options.Catalog.Hosts().Get(name)
+		return ok
+	}
+
+	handle := func(pattern string, handler http.Handler) {
+		handler = a.authenticate(handler)
+		if a.config.RequireClientCertificate {
+			handler = httpserver.RequireClientCertificate(handler)
+		}
+
+		server.Handle(pattern, handler)
+	}
+
+	handle("GET "+DistrosPath, http.HandlerFunc(a.listDistros))
+
+	handle("GET "+HostsPath, http.HandlerFunc(a.listHosts))
+	handle("GET "+HostPath, http.HandlerFunc(a.getHost))
+	handle("PUT "+HostPath, http.HandlerFunc(a.putHost))
+	handle("DELETE "+HostPath, http.HandlerFunc(a.deleteHost))
+	handle("GET "+HostConfigPath, http.HandlerFunc(a.previewConfig))
+	handle("GET "+TransfersPath, http.HandlerFunc(a.transfers))
+	handle("GET "+ClientsPath, http.HandlerFunc(a.listClients))
+	handle("GET "+SessionsPath, http.HandlerFunc(a.listSessions))
+	handle("GET "+SessionPath, http.HandlerFunc(a.getSession))
+	handle("POST "+WakePath, http.HandlerFunc(a.wake))
+	handle("POST "+NetbootPath, http.HandlerFunc(a.netboot))
+	handle("GET "+StatusPath, http.HandlerFunc(a.status))
+
+	if a.options.Leases != nil {
+		handle("GET "+LeasesPath, http.HandlerFunc(a.listLeases))
+
+		if a.options.Leases.HasHistory() {
+			handle("GET "+LeaseHistoryPath, http.HandlerFunc(a.leaseHistory))
+		}
+	}
+
+	// Methods must be given explicitly, as patterns without them conflict with 'GET /'
+	distroExists := func(name string) bool {
+		return slices.ContainsFunc(a.options.Catalog.Distros(), func(d *distro.Distro) bool {
+			return d.Name() == name
+		})
+	}
+
+	assignmentHandler := oneshot.AssignmentHandler(a.logger, a.options.OneShots, hostExists, distroExists, a.netbootHost)
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		handle(method+" "+oneshot.AssignmentPath, assignmentHandler)
+	}
+
+	// Hosts report their status with POST requests from their install automation,
+	// which can't hold API tokens, so only reading statuses is handled here
+	handle("GET "+hoststatus.Path, hoststatus.Handler(a.logger, a.options.Statuses, hostExists, nil))
+	handle("GET "+hoststatus.ListPath, hoststatus.ListHandler(a.options.Statuses))
+
+	if a.options.Reconciler != nil {
+		handle("GET "+reconcile.Path, a.options.Reconciler.Handler())
+		handle("POST "+reconcile.Path, a.options.Reconciler.Handler())
+	}
+}
+
+// authenticate requires requests to present one of the API tokens, if any are
+// configured
+func (a *API) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(a.tokens) > 0 && !a.authorised(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pixie"`)
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) authorised(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+
+	for _, candidate := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), candidate) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+type distroView struct {
+	Name string `json:"name"`
+	Arch string `json:"arch"`
+	Hash string `json:"hash"`
+
+	// Whether an installation tree is served for the distro
+	Tree bool `json:"tree"`
+
+	// Hash of a newer version awaiting approval, if the distro isn't updated
+	// automatically
+	UpdateAvailable string `json:"update_available,omitempty"`
+}
+
+func (a *API) listDistros(w http.ResponseWriter, _ *http.Request) {
+	distros := a.options.Catalog.Distros()
+
+	views := make([]distroView, 0, len(distros))
+	for _, d := range distros {
+		views = append(views, distroView{
+			Name:            d.Name(),
+			Arch:            d.Arch(),
+			Hash:            d.Hash(),
+			Tree:            d.HasTree(),
+			UpdateAvailable: d.UpdateAvailable(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *API) transfers(w http.ResponseWriter, _ *http.Request) {
+	stats := make(map[string]limiter.Stats, len(a.options.Transfers))
+	for service, transfers := range a.options.Transfers {
+		stats[service] = transfers.Stats()
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *API) status(w http.ResponseWriter, _ *http.Request) {
+	doc := &status.Document{
+		Time:      time.Now(),
+		StartedAt: a.options.Started,
+		Role:      a.options.Role,
+		Distros:   []status.Distro{},
+		Hosts:     []status.Host{},
+		Listeners: a.options.Listeners.List(),
+		Caches:    make([]status.Cache, 0, len(a.options.Caches)),
+		Transfers: make(map[string]limiter.Stats, len(a.options.Transfers)),
+	}
+
+	for _, d := range a.options.Catalog.Distros() {
+		doc.Distros = append(doc.Distros, status.Distro{
+			Name:            d.Name(),
+			Arch:            d.Arch(),
+			Version:         d.Version(),
+			Hash:            d.Hash(),
+			Tree:            d.HasTree(),
+			UpdateAvailable: d.UpdateAvailable(),
+		})
+	}
+
+	for _, host := range a.options.Catalog.Hosts().Hosts() {
+		view := status.Host{Name: host.Name, Distro: host.Distro}
+		if mac := host.MAC(); mac != nil {
+			view.MAC = mac.String()
+		}
+
+		if boot, ok := a.options.Boots.Last(host.Name); ok {
+			view.LastBoot = &boot
+		}
+
+		if report, ok := a.options.Statuses.Get(host.Name); ok {
+			view.Install = &report
+		}
+
+		doc.Hosts = append(doc.Hosts, view)
+	}
+
+	for _, cache := range a.options.Caches {
+		doc.Caches = append(doc.Caches, cache.Measure())
+	}
+
+	for service, transfers := range a.options.Transfers {
+		doc.Transfers[service] = transfers.Stats()
+	}
+
+	if a.options.Reconciler != nil {
+		reconcileStatus := a.options.Reconciler.Status()
+		doc.Reconcile = &reconcileStatus
+	}
+
+	writeJSON(w, http.StatusOK, doc)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
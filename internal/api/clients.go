@@ -0,0 +1,116 @@
+package api
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/davejbax/pixie/internal/dhcp"
+	"github.com/davejbax/pixie/internal/wol"
+)
+
+type clientView struct {
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip,omitempty"`
+	UUID     string    `json:"uuid,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func (a *API) listClients(w http.ResponseWriter, _ *http.Request) {
+	clientList := a.options.Clients.Clients()
+
+	views := make([]clientView, 0, len(clientList))
+	for _, client := range clientList {
+		view := clientView{
+			MAC:      client.MAC.String(),
+			UUID:     client.UUID,
+			LastSeen: client.LastSeen,
+		}
+
+		if client.IP != nil {
+			view.IP = client.IP.String()
+		}
+
+		views = append(views, view)
+	}
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *API) listLeases(w http.ResponseWriter, _ *http.Request) {
+	leases := a.options.Leases.Leases()
+	slices.SortFunc(leases, func(a, b dhcp.Lease) int {
+		return bytes.Compare(net.ParseIP(a.IP).To16(), net.ParseIP(b.IP).To16())
+	})
+
+	writeJSON(w, http.StatusOK, leases)
+}
+
+func (a *API) leaseHistory(w http.ResponseWriter, r *http.Request) {
+	var mac net.HardwareAddr
+	if value := r.URL.Query().Get("mac"); value != "" {
+		parsed, err := net.ParseMAC(value)
+		if err != nil {
+			http.Error(w, "invalid MAC address", http.StatusBadRequest)
+			return
+		}
+
+		mac = parsed
+	}
+
+	var limit int
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+
+		limit = parsed
+	}
+
+	events, err := a.options.Leases.History(mac, limit)
+	if err != nil {
+		a.logger.Error("failed to read DHCP lease history",
+			"error", err,
+		)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
+
+func (a *API) wake(w http.ResponseWriter, r *http.Request) {
+	target := r.PathValue("target")
+
+	mac, err := net.ParseMAC(target)
+	if err != nil {
+		host, ok := a.options.Catalog.Hosts().Get(target)
+		if !ok {
+			http.Error(w, "not a MAC address or known host", http.StatusNotFound)
+			return
+		}
+
+		if mac = host.MAC(); mac == nil {
+			http.Error(w, "host isn't matched by MAC address, so can't be woken", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := wol.Wake(a.options.WakeOnLAN, mac); err != nil {
+		a.internalError(w, "failed to send Wake-on-LAN magic packet", target, err)
+		return
+	}
+
+	a.logger.Info("woke machine through API",
+		"target", target,
+		"mac", mac.String(),
+		"client", r.RemoteAddr,
+	)
+
+	w.WriteHeader(http.StatusAccepted)
+}
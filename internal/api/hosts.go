@@ -0,0 +1,307 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/davejbax/pixie/internal/bmc"
+	"github.com/davejbax/pixie/internal/catalog"
+	"github.com/davejbax/pixie/internal/cmdline"
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/hoststatus"
+	"github.com/davejbax/pixie/internal/netroot"
+	"github.com/davejbax/pixie/internal/oneshot"
+)
+
+// maxHostSize limits the size of host bodies
+const maxHostSize = 64 * 1024
+
+var errNoBMC = errors.New("host has no BMC")
+
+// Where a host is defined
+const (
+	sourceConfig = "config"
+	sourceAPI    = "api"
+)
+
+type hostView struct {
+	Name    string `json:"name"`
+	Source  string `json:"source"`
+	Profile string `json:"profile,omitempty"`
+
+	MAC  string `json:"mac,omitempty"`
+	UUID string `json:"uuid,omitempty"`
+	CIDR string `json:"cidr,omitempty"`
+
+	Distro         string         `json:"distro,omitempty"`
+	Args           []string       `json:"args,omitempty"`
+	Automation     string         `json:"automation,omitempty"`
+	Vars           map[string]any `json:"vars,omitempty"`
+	LocalBootFirst bool           `json:"local_boot_first"`
+	MenuDefault    string         `json:"menu_default,omitempty"`
+	GrubProfile    string         `json:"grub_profile,omitempty"`
+
+	Root *netroot.Config `json:"root,omitempty"`
+
+	// The host's BMC, without its credentials
+	BMC *bmcView `json:"bmc,omitempty"`
+
+	OneShot *oneshot.Assignment `json:"oneshot,omitempty"`
+	Status  *hoststatus.Report  `json:"status,omitempty"`
+
+	// When DHCP last saw the host, if it is matched by MAC address
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+type bmcView struct {
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+}
+
+func (a *API) view(host *hosts.Host) *hostView {
+	view := &hostView{
+		Name:           host.Name,
+		Source:         sourceConfig,
+		Profile:        host.Profile,
+		UUID:           host.UUID(),
+		Distro:         host.Distro,
+		Args:           cmdline.Merge(host.ArgLayers...),
+		Automation:     host.Automation,
+		Vars:           host.Vars,
+		LocalBootFirst: host.LocalBootFirst,
+		MenuDefault:    host.MenuDefault,
+		GrubProfile:    host.GrubProfile,
+		Root:           host.Root,
+	}
+
+	if _, ok := a.options.Hosts.Get(host.Name); ok {
+		view.Source = sourceAPI
+	}
+
+	if host.BMC != nil {
+		view.BMC = &bmcView{Protocol: host.BMC.Protocol, Address: host.BMC.Address}
+	}
+
+	if mac := host.MAC(); mac != nil {
+		view.MAC = mac.String()
+
+		if client, ok := a.options.Clients.Get(mac); ok {
+			view.LastSeen = &client.LastSeen
+		}
+	}
+
+	if prefix, ok := host.CIDR(); ok {
+		view.CIDR = prefix.String()
+	}
+
+	if assignment, ok := a.options.OneShots.Get(host.Name); ok {
+		view.OneShot = &assignment
+	}
+
+	if report, ok := a.options.Statuses.Get(host.Name); ok {
+		view.Status = &report
+	}
+
+	return view
+}
+
+func (a *API) listHosts(w http.ResponseWriter, _ *http.Request) {
+	hostList := a.options.Catalog.Hosts().Hosts()
+
+	views := make([]*hostView, 0, len(hostList))
+	for _, host := range hostList {
+		views = append(views, a.view(host))
+	}
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *API) getHost(w http.ResponseWriter, r *http.Request) {
+	host, ok := a.options.Catalog.Hosts().Get(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "unknown host", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.view(host))
+}
+
+// putHost creates or updates a host from a host config, as it would be given in the
+// config file. The host's name is taken from the path.
+func (a *API) putHost(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var config hosts.Config
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHostSize))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&config); err != nil {
+		http.Error(w, "invalid host: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if config.Name != "" && config.Name != name {
+		http.Error(w, "host name in body doesn't match path", http.StatusBadRequest)
+		return
+	}
+
+	config.Name = name
+
+	// Hosts' templates are read by pixie, so mustn't let API clients read other files
+	if config.Automation != "" {
+		if _, err := a.options.Templates.TemplatePath(config.Automation); err != nil {
+			http.Error(w, "invalid automation template: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	a.hostsMu.Lock()
+	defer a.hostsMu.Unlock()
+
+	previous, existed := a.options.Hosts.Get(name)
+	if _, ok := a.options.Catalog.Hosts().Get(name); ok && !existed {
+		http.Error(w, "host is defined in the config file, and can't be changed through the API", http.StatusConflict)
+		return
+	}
+
+	if err := a.options.Hosts.Put(config); err != nil {
+		a.internalError(w, "failed to save host", name, err)
+		return
+	}
+
+	if err := a.options.RebuildHosts(); err != nil {
+		// Restore the previous hosts, which were valid
+		if existed {
+			err = errors.Join(err, a.options.Hosts.Put(previous))
+		} else {
+			err = errors.Join(err, a.options.Hosts.Delete(name))
+		}
+
+		http.Error(w, "invalid host: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.logger.Info("host saved through API",
+		"host", name,
+		"created", !existed,
+		"client", r.RemoteAddr,
+	)
+
+	host, _ := a.options.Catalog.Hosts().Get(name)
+
+	status := http.StatusOK
+	if !existed {
+		status = http.StatusCreated
+	}
+
+	writeJSON(w, status, a.view(host))
+}
+
+func (a *API) deleteHost(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	a.hostsMu.Lock()
+	defer a.hostsMu.Unlock()
+
+	previous, ok := a.options.Hosts.Get(name)
+	if !ok {
+		if _, ok := a.options.Catalog.Hosts().Get(name); ok {
+			http.Error(w, "host is defined in the config file, and can't be changed through the API", http.StatusConflict)
+		} else {
+			http.Error(w, "unknown host", http.StatusNotFound)
+		}
+
+		return
+	}
+
+	if err := a.options.Hosts.Delete(name); err != nil {
+		a.internalError(w, "failed to delete host", name, err)
+		return
+	}
+
+	if err := a.options.RebuildHosts(); err != nil {
+		err = errors.Join(err, a.options.Hosts.Put(previous))
+		http.Error(w, "failed to delete host: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.logger.Info("host deleted through API",
+		"host", name,
+		"client", r.RemoteAddr,
+	)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) previewConfig(w http.ResponseWriter, r *http.Request) {
+	config, err := a.options.Catalog.Preview(r.PathValue("name"), r.URL.Query().Get("path"))
+	if errors.Is(err, catalog.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		a.internalError(w, "failed to preview bootloader config", r.PathValue("name"), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(config)
+}
+
+func (a *API) internalError(w http.ResponseWriter, msg string, host string, err error) {
+	a.logger.Error(msg,
+		"host", host,
+		"error", err,
+	)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
+
+func (a *API) netboot(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	err := a.netbootHost(r.Context(), name)
+	switch {
+	case errors.Is(err, catalog.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errNoBMC):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "failed to network boot host: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// netbootHost makes the named host network boot once and power-cycles it through its BMC
+func (a *API) netbootHost(ctx context.Context, name string) error {
+	host, ok := a.options.Catalog.Hosts().Get(name)
+	if !ok {
+		return fmt.Errorf("host '%s': %w", name, catalog.ErrNotFound)
+	}
+
+	if host.BMC == nil {
+		return fmt.Errorf("host '%s': %w", name, errNoBMC)
+	}
+
+	if err := bmc.Netboot(ctx, host.BMC); err != nil {
+		a.logger.Warn("failed to network boot host through its BMC",
+			"host", name,
+			"error", err,
+		)
+
+		return err //nolint:wrapcheck
+	}
+
+	a.logger.Info("host set to network boot and power-cycled through its BMC",
+		"host", name,
+	)
+
+	return nil
+}
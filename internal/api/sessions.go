@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/davejbax/pixie/internal/bootsession"
+)
+
+func (a *API) listSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	mac := query.Get("mac")
+	if mac != "" {
+		parsed, err := net.ParseMAC(mac)
+		if err != nil {
+			http.Error(w, "invalid MAC address", http.StatusBadRequest)
+			return
+		}
+
+		mac = parsed.String()
+	}
+
+	sessions := []bootsession.Session{}
+
+	for _, session := range a.options.Sessions.Sessions() {
+		if (mac != "" && session.MAC != mac) ||
+			(query.Has("host") && session.Host != query.Get("host")) ||
+			(query.Has("state") && string(session.State) != query.Get("state")) {
+			continue
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (a *API) getSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.options.Sessions.Get(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, session)
+}
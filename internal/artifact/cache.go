@@ -0,0 +1,112 @@
+// Package artifact caches generated boot artifacts (such as GRUB EFI images) in memory,
+// so that each is rendered once rather than on every download
+package artifact
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Key identifies a generated artifact by everything that it is rendered from
+type Key struct {
+	Arch string
+
+	// Modules embedded into the artifact, in a stable order
+	Modules string
+
+	// Prefix that the artifact loads further files relative to
+	Prefix string
+
+	// Profile of the bootloader that renders the artifact, as profiles render different
+	// artifacts for the same arch. A bootloader's config can't change without a restart.
+	Profile string
+}
+
+// Cache holds rendered artifacts in memory. Rendered artifacts must not be modified, as
+// they are shared between all readers.
+type Cache struct {
+	mu      sync.Mutex
+	entries map[Key]*entry
+}
+
+// entry is an artifact that has been rendered, or is being rendered
+type entry struct {
+	// Closed once rendering has finished
+	done chan struct{}
+
+	data []byte
+	err  error
+}
+
+func NewCache() *Cache {
+	return &Cache{entries: make(map[Key]*entry)}
+}
+
+// Get returns the artifact with the given key, rendering it with render if it isn't
+// cached. Concurrent calls for the same key wait for a single render. Failed renders
+// aren't cached, so that they are retried by the next call.
+func (c *Cache) Get(key Key, render func(w io.Writer) error) ([]byte, error) {
+	c.mu.Lock()
+
+	if e, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		<-e.done
+
+		return e.data, e.err
+	}
+
+	e := &entry{done: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	buff := &bytes.Buffer{}
+	e.err = render(buff)
+	e.data = buff.Bytes()
+	close(e.done)
+
+	if e.err != nil {
+		c.mu.Lock()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+
+	return e.data, e.err
+}
+
+// Invalidate discards all cached artifacts, so that they are rendered again when next
+// requested. Readers of previously returned artifacts are unaffected.
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[Key]*entry)
+}
+
+// Len returns the number of cached artifacts
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+// Size returns the total size of the rendered artifacts in the cache. Artifacts still
+// being rendered aren't counted.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := int64(0)
+	for _, e := range c.entries {
+		select {
+		case <-e.done:
+			size += int64(len(e.data))
+		default:
+		}
+	}
+
+	return size
+}
@@ -0,0 +1,54 @@
+// Package atomicfile replaces files atomically and durably, so that neither readers nor
+// crashes (including power loss) can see a partially written file
+package atomicfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Write replaces the file at path with data. See [WriteFunc].
+func Write(path string, data []byte) error {
+	return WriteFunc(path, func(w io.Writer) error {
+		_, err := bytes.NewReader(data).WriteTo(w)
+		return err //nolint:wrapcheck
+	})
+}
+
+// WriteFunc replaces the file at path with what write writes. The contents are written
+// to a temporary file in the same directory, which is synced to disk and renamed over
+// path. The directory is then synced too, so that the rename survives a crash.
+//
+// Temporary files are hidden and have a '.tmp' extension, so that directories of files
+// read by extension ignore them. Errors from write are returned as is.
+func WriteFunc(path string, write func(w io.Writer) error) error {
+	directory := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(directory, "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace '%s': %w", path, err)
+	}
+
+	return syncDirectory(directory)
+}
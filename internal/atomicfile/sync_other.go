@@ -0,0 +1,24 @@
+//go:build !windows
+
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+)
+
+// syncDirectory flushes the directory's entries to disk, so that renames in it are
+// durable
+func syncDirectory(path string) error {
+	directory, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer directory.Close()
+
+	if err := directory.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+
+	return nil
+}
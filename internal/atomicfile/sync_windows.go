@@ -0,0 +1,7 @@
+package atomicfile
+
+// syncDirectory does nothing, as directories can't be synced on Windows: NTFS journals
+// renames itself
+func syncDirectory(_ string) error {
+	return nil
+}
@@ -0,0 +1,196 @@
+// Package audit records boot events (DHCP offers, bootloader, config and kernel
+// downloads, and install callbacks) to an append-only JSON Lines log, so that a
+// machine's boot timeline can be reconstructed afterwards
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of a boot event
+type EventType string
+
+const (
+	// A PXE client was offered a boot file over DHCP
+	EventDHCPOffer EventType = "dhcp_offer"
+
+	// A client downloaded a bootloader entrypoint (network boot program)
+	EventBootloader EventType = "bootloader"
+
+	// A client was served a generated bootloader config
+	EventConfig EventType = "config"
+
+	// A client downloaded a distro kernel or initrd
+	EventKernel EventType = "kernel"
+	EventInitrd EventType = "initrd"
+
+	// A host reported its install status from its install automation
+	EventInstallStatus EventType = "install_status"
+
+	// A host reported that its one-shot install completed
+	EventInstallComplete EventType = "install_complete"
+
+	// A periodic or triggered distro reconcile succeeded or failed
+	EventReconciled      EventType = "reconciled"
+	EventReconcileFailed EventType = "reconcile_failed"
+
+	// A reconcile found a newer version of a distro whose updates must be approved
+	EventDistroUpdateAvailable EventType = "distro_update_available"
+
+	// A distro kernel or initrd was refused to a client because it no longer matches its
+	// recorded checksum
+	EventArtifactCorrupt EventType = "artifact_corrupt"
+)
+
+// Event is a single boot event. Fields identifying the client are set as far as they
+// are known.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type EventType `json:"type"`
+
+	// Name of the host that the client matched, if any
+	Host string `json:"host,omitempty"`
+
+	MAC  string `json:"mac,omitempty"`
+	UUID string `json:"uuid,omitempty"`
+	IP   string `json:"ip,omitempty"`
+
+	// What was served or reported, e.g. a file path or an install status
+	Detail string `json:"detail,omitempty"`
+}
+
+// SetClient fills in the client's identity, ignoring unknown (nil or empty) values
+func (e *Event) SetClient(mac net.HardwareAddr, uuid string, ip net.IP) {
+	if mac != nil {
+		e.MAC = mac.String()
+	}
+
+	if ip != nil {
+		e.IP = ip.String()
+	}
+
+	e.UUID = uuid
+}
+
+// Sink receives events as they are recorded, e.g. to notify external systems. Send must
+// not block.
+type Sink interface {
+	Send(event Event)
+}
+
+// Log appends events to a JSON Lines file, and passes them to any sinks
+type Log struct {
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	file  *os.File
+	sinks []Sink
+}
+
+// Open opens the log at the given path for appending, creating it if it doesn't exist
+func Open(logger *slog.Logger, path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	return &Log{logger: logger, file: file}, nil
+}
+
+// AddSink passes events recorded from now on to the sink
+func (l *Log) AddSink(sink Sink) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sinks = append(l.sinks, sink)
+}
+
+// Record appends an event to the log, setting its time if unset, and passes it to the
+// log's sinks. Failures are logged
+// rather than returned, so that a broken audit log never stops clients booting. Record
+// does nothing on a nil log.
+func (l *Log) Record(event Event) {
+	if l == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		l.logger.Error("failed to encode audit event",
+			"error", err,
+		)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A single write per line, so that lines are never interleaved
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		l.logger.Error("failed to write audit event",
+			"type", event.Type,
+			"error", err,
+		)
+	}
+
+	for _, sink := range l.sinks {
+		sink.Send(event)
+	}
+}
+
+// Close closes the log
+func (l *Log) Close() error {
+	return l.file.Close() //nolint:wrapcheck
+}
+
+// Read returns the events in the log at the given path for which filter returns true,
+// oldest first. A missing log has no events.
+func Read(path string, filter func(event *Event) bool) ([]Event, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	events := []Event{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Lines that can't be decoded are skipped, as a crash may leave the last line
+		// partially written
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+
+		if filter(&event) {
+			events = append(events, event)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	return events, nil
+}
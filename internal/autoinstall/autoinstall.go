@@ -0,0 +1,269 @@
+// Package autoinstall renders install automation files (kickstart, preseed, cloud-init
+// autoinstall, Ignition, etc.) for hosts from Go templates, so that one file can serve
+// many hosts
+package autoinstall
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/hoststatus"
+	"github.com/davejbax/pixie/internal/oneshot"
+	"github.com/davejbax/pixie/internal/timehint"
+	"github.com/davejbax/pixie/internal/urlsign"
+	"gopkg.in/yaml.v3"
+)
+
+var errOddDictArgs = errors.New("dict requires an even number of arguments")
+
+// Data is passed to automation templates
+type Data struct {
+	Host *hosts.Host
+
+	// Host variables from config, for convenience also available as .Host.Vars
+	Vars map[string]any
+
+	// Base URL of pixie's HTTP server, as reached by the host
+	BaseURL string
+
+	// URL that the host should POST to when its install has finished, to complete a
+	// one-shot install. Like StatusURL, it contains a token signed for the host, so
+	// should be kept as secret as the rendered file.
+	CompleteURL string
+
+	// URL that the host can POST its install status to, e.g.
+	// 'curl -fsS -d status=success {{ .StatusURL }}'. A successful status also completes
+	// a one-shot install.
+	StatusURL string
+
+	// URLs of the driver update disks of the host's distro, e.g. for
+	// '{{ range .DriverDisks }}driverdisk --source={{ . }}{{ end }}' in kickstart files.
+	// Installers booted by pixie are also given them with 'inst.dd='.
+	DriverDisks []string
+
+	// Where templates, and the template functions for secrets and external data, read from
+	sources *Sources
+}
+
+// NewData creates the data passed to templates rendered for the host, where baseURL is
+// pixie's HTTP server as reached by the host. The URLs that the host reports its install
+// to are signed by reporter, without which they are left unsigned and can't be used.
+// Secrets and external data are read from the given sources, which may be nil.
+func NewData(host *hosts.Host, baseURL string, reporter *urlsign.Signer, sources *Sources) *Data {
+	return &Data{
+		Host:        host,
+		Vars:        host.Vars,
+		BaseURL:     baseURL,
+		CompleteURL: baseURL + reportPath(oneshot.CompletePath, host.Name, reporter),
+		StatusURL:   baseURL + reportPath(hoststatus.ReportPath, host.Name, reporter),
+		sources:     sources,
+	}
+}
+
+// Render executes the named template in the templates directory of the data's sources
+// with the data, writing the result to w
+func Render(w io.Writer, name string, data *Data) error {
+	path, err := data.sources.TemplatePath(name)
+	if err != nil {
+		return err
+	}
+
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read automation template: %w", err)
+	}
+
+	return RenderText(w, filepath.Base(path), string(text), data)
+}
+
+// RenderText executes the template text with the given data, in the same way as
+// automation files, writing the result to w. The name identifies the template in errors.
+func RenderText(w io.Writer, name string, text string, data *Data) error {
+	tmpl, err := template.New(name).
+		Funcs(FuncMap(data.BaseURL, data.sources)).
+		Parse(text)
+	if err != nil {
+		return fmt.Errorf("failed to parse automation template: %w", err)
+	}
+
+	// Render to a buffer first so that a failure part way through doesn't leave the host
+	// with a truncated file
+	buff := &bytes.Buffer{}
+	if err := tmpl.Execute(buff, data); err != nil {
+		return fmt.Errorf("failed to execute automation template: %w", err)
+	}
+
+	_, err = buff.WriteTo(w)
+	return err //nolint:wrapcheck
+}
+
+// ContentType returns the MIME type of the automation file at path, judged by its
+// extension. A trailing '.tmpl' is ignored.
+func ContentType(path string) string {
+	switch filepath.Ext(strings.TrimSuffix(path, ".tmpl")) {
+	case ".json", ".ign":
+		return "application/json"
+	case ".yaml", ".yml":
+		return "application/yaml"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// FuncMap returns the functions available to automation templates. These are a subset
+// of the commonly used sprig functions, along with those from [timehint.FuncMap], and
+// 'secret', 'env', 'vault' and 'data', which read from the given sources.
+func FuncMap(baseURL string, sources *Sources) template.FuncMap {
+	funcs := template.FuncMap{
+		// Defaults and emptiness
+		"default":  defaultValue,
+		"empty":    empty,
+		"coalesce": coalesce,
+
+		// Strings
+		"quote":      func(s any) string { return fmt.Sprintf("%q", fmt.Sprint(s)) },
+		"squote":     func(s any) string { return "'" + fmt.Sprint(s) + "'" },
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, replacement, s string) string { return strings.ReplaceAll(s, old, replacement) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       join,
+		"indent":     indent,
+		"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+
+		// Collections
+		"list": func(items ...any) []any { return items },
+		"dict": dict,
+
+		// Encoding
+		"toJson":    toJSON,
+		"toYaml":    toYAML,
+		"b64enc":    func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec":    b64dec,
+		"sha256sum": sha256sum,
+	}
+
+	maps.Copy(funcs, timehint.FuncMap(baseURL))
+	maps.Copy(funcs, sources.funcs())
+
+	return funcs
+}
+
+// defaultValue returns value, or def if value is empty. As in sprig, the default comes
+// first so that it can be used in pipelines: '{{ .Vars.disk | default "sda" }}'.
+func defaultValue(def any, value ...any) any {
+	if len(value) == 0 || empty(value[0]) {
+		return def
+	}
+
+	return value[0]
+}
+
+func empty(value any) bool {
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() { //nolint:exhaustive
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+func coalesce(values ...any) any {
+	for _, value := range values {
+		if !empty(value) {
+			return value
+		}
+	}
+
+	return nil
+}
+
+func join(sep string, items any) string {
+	v := reflect.ValueOf(items)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Sprint(items)
+	}
+
+	parts := make([]string, v.Len())
+	for i := range v.Len() {
+		parts[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+
+	return strings.Join(parts, sep)
+}
+
+func indent(spaces int, s string) string {
+	padding := strings.Repeat(" ", spaces)
+	return padding + strings.ReplaceAll(s, "\n", "\n"+padding)
+}
+
+func dict(pairs ...any) (map[string]any, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errOddDictArgs
+	}
+
+	result := make(map[string]any, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		result[fmt.Sprint(pairs[i])] = pairs[i+1]
+	}
+
+	return result, nil
+}
+
+func toJSON(value any) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode JSON: %w", err)
+	}
+
+	return string(data), nil
+}
+
+func toYAML(value any) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode YAML: %w", err)
+	}
+
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+func sha256sum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func b64dec(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode base64: %w", err)
+	}
+
+	return string(data), nil
+}
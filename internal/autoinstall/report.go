@@ -0,0 +1,47 @@
+package autoinstall
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/urlsign"
+)
+
+// reportResource returns the name of the resource that tokens in the host's report URLs
+// grant access to, which is distinct from the host's automation file
+func reportResource(host string) string {
+	return "report/" + host
+}
+
+// reportPath returns the path of a report endpoint for the host, signed by reporter if it
+// isn't nil
+func reportPath(pattern string, host string, reporter *urlsign.Signer) string {
+	token := ""
+	if reporter != nil {
+		token = reporter.PermanentToken(reportResource(host))
+	}
+
+	return strings.TrimSuffix(strings.NewReplacer("{name}", host, "{token}", token).Replace(pattern), "/")
+}
+
+// RequireReportToken wraps a handler of the endpoints that hosts report their install to,
+// so that requests are only passed on if their 'token' path value was signed by reporter
+// for the host named by their 'name' path value. Hosts are given the signed URLs in
+// [Data].
+func RequireReportToken(logger *slog.Logger, reporter *urlsign.Signer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if err := reporter.VerifyPermanent(reportResource(name), r.PathValue("token")); err != nil {
+			logger.Warn("refusing install report without a valid signed URL",
+				"host", name,
+				"client", r.RemoteAddr,
+				"error", err,
+			)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,218 @@
+package autoinstall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Extensions of data files, in the order that they're looked for
+var dataExtensions = []string{".yaml", ".yml", ".json"}
+
+const vaultTimeout = 10 * time.Second
+
+var (
+	errNoTemplates        = errors.New("no templates directory is configured")
+	errNoSecretsDirectory = errors.New("no secrets directory is configured")
+	errNoDataDirectory    = errors.New("no data directory is configured")
+	errNotLocal           = errors.New("name must be a path within the directory")
+	errEnvNotAllowed      = errors.New("environment variable doesn't have the configured prefix")
+	errNoVault            = errors.New("no Vault server is configured")
+	errVaultStatus        = errors.New("unexpected Vault response status")
+	errNoVaultKey         = errors.New("no such key in Vault secret")
+	errNoDataFile         = errors.New("no data file with this name")
+)
+
+// Sources configures where hosts' automation templates are read from, and where they
+// read secrets and external data from, so that credentials and site data needn't be
+// inlined in host variables
+type Sources struct {
+	// Directory that hosts' automation templates are read from. Hosts' 'automation' paths
+	// are relative to it, and can't refer to files outside it, so that hosts created
+	// through the API can't read arbitrary files. If empty, hosts can't have automation
+	// files.
+	TemplatesDirectory string `mapstructure:"templates_directory"`
+
+	// Directory that '{{ secret "name" }}' reads files from, e.g. a mounted Kubernetes
+	// secret. A trailing newline is removed.
+	SecretsDirectory string `mapstructure:"secrets_directory"`
+
+	// Prefix that environment variables read by '{{ env "NAME" }}' must have, so that
+	// templates can't read the rest of pixie's environment. If empty, 'env' fails.
+	EnvPrefix string `mapstructure:"env_prefix"`
+
+	// Vault server that '{{ vault "path" "key" }}' reads KV secrets from
+	Vault VaultConfig
+
+	// Directory of YAML or JSON files that '{{ data "name" }}' decodes, e.g.
+	// '{{ (data "sites").london.dns }}' for 'sites.yaml'
+	DataDirectory string `mapstructure:"data_directory"`
+}
+
+// VaultConfig configures access to a HashiCorp Vault (or OpenBao) KV version 2 engine
+type VaultConfig struct {
+	// Address of the server, e.g. 'https://vault.example.com:8200'. If empty, 'vault'
+	// fails.
+	Address string
+
+	// Token to authenticate with, or a file containing it
+	Token     string
+	TokenFile string `mapstructure:"token_file"`
+
+	// Path that the KV engine is mounted at
+	Mount string `default:"secret"`
+}
+
+// funcs returns the template functions that read from the sources
+func (s *Sources) funcs() template.FuncMap {
+	return template.FuncMap{
+		"secret": s.secret,
+		"env":    s.env,
+		"vault":  s.vault,
+		"data":   s.data,
+	}
+}
+
+// TemplatePath returns the path of the named automation template, which must be within
+// the templates directory
+func (s *Sources) TemplatePath(name string) (string, error) {
+	if s == nil || s.TemplatesDirectory == "" {
+		return "", errNoTemplates
+	}
+
+	return localPath(s.TemplatesDirectory, name)
+}
+
+// localPath returns the path of the named file within dir
+func localPath(dir string, name string) (string, error) {
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("'%s': %w", name, errNotLocal)
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+func (s *Sources) secret(name string) (string, error) {
+	if s == nil || s.SecretsDirectory == "" {
+		return "", errNoSecretsDirectory
+	}
+
+	path, err := localPath(s.SecretsDirectory, name)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %w", err)
+	}
+
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+func (s *Sources) env(name string) (string, error) {
+	if s == nil || s.EnvPrefix == "" || !strings.HasPrefix(name, s.EnvPrefix) {
+		return "", fmt.Errorf("'%s': %w", name, errEnvNotAllowed)
+	}
+
+	return os.Getenv(name), nil
+}
+
+func (s *Sources) data(name string) (any, error) {
+	if s == nil || s.DataDirectory == "" {
+		return nil, errNoDataDirectory
+	}
+
+	for _, ext := range dataExtensions {
+		path, err := localPath(s.DataDirectory, name+ext)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read data file: %w", err)
+		}
+
+		// YAML is a superset of JSON, so decodes both
+		var value any
+		if err := yaml.Unmarshal(data, &value); err != nil {
+			return nil, fmt.Errorf("failed to decode data file '%s': %w", path, err)
+		}
+
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("'%s': %w", name, errNoDataFile)
+}
+
+func (s *Sources) vault(path string, key string) (any, error) {
+	if s == nil || s.Vault.Address == "" {
+		return nil, errNoVault
+	}
+
+	token := s.Vault.Token
+	if s.Vault.TokenFile != "" {
+		data, err := os.ReadFile(s.Vault.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault token file: %w", err)
+		}
+
+		token = strings.TrimSpace(string(data))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+
+	secretURL, err := url.JoinPath(s.Vault.Address, "v1", s.Vault.Mount, "data", path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Vault address: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, secretURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Vault request: %w", err)
+	}
+
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Vault secret '%s': %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("secret '%s': %w: %s", path, errVaultStatus, resp.Status)
+	}
+
+	// KV version 2 nests the secret's keys under 'data' twice
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode Vault response: %w", err)
+	}
+
+	value, ok := body.Data.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret '%s', key '%s': %w", path, key, errNoVaultKey)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,131 @@
+// Package bmc controls hosts' baseboard management controllers over Redfish or IPMI, so
+// that a host can be told to network boot once and power-cycled, for hands-off
+// reinstalls
+package bmc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Protocols that BMCs are controlled with
+const (
+	ProtocolRedfish = "redfish"
+	ProtocolIPMI    = "ipmi"
+)
+
+const defaultTimeout = 30 * time.Second
+
+var (
+	errUnknownProtocol = errors.New("unknown BMC protocol")
+	errNoAddress       = errors.New("BMC must have an address")
+	errBothPasswords   = errors.New("BMC password may be given directly or in a file, not both")
+)
+
+// Config is a host's BMC
+type Config struct {
+	// Either 'redfish' or 'ipmi'. IPMI is spoken by running 'ipmitool', which must be
+	// installed.
+	Protocol string `mapstructure:"protocol" json:"protocol"`
+
+	// Address of the BMC: a URL such as 'https://10.0.0.10' for Redfish, or a host name
+	// or IP address (optionally with a port) for IPMI
+	Address string `mapstructure:"address" json:"address"`
+
+	Username string `mapstructure:"username" json:"username,omitempty"`
+
+	// Password, or a file containing it, so that it can be kept out of the config
+	Password     string `mapstructure:"password" json:"password,omitempty"`
+	PasswordFile string `mapstructure:"password_file" json:"password_file,omitempty"`
+
+	// Whether to skip verifying the Redfish service's TLS certificate, which is often
+	// self-signed
+	Insecure bool `mapstructure:"insecure" json:"insecure,omitempty"`
+}
+
+// Validate checks that the config is complete
+func (c *Config) Validate() error {
+	switch c.Protocol {
+	case ProtocolRedfish, ProtocolIPMI:
+	default:
+		return fmt.Errorf("'%s': %w", c.Protocol, errUnknownProtocol)
+	}
+
+	if c.Address == "" {
+		return errNoAddress
+	}
+
+	if c.Password != "" && c.PasswordFile != "" {
+		return errBothPasswords
+	}
+
+	return nil
+}
+
+// password returns the configured password, reading it from the password file if
+// needed
+func (c *Config) password() (string, error) {
+	if c.PasswordFile == "" {
+		return c.Password, nil
+	}
+
+	data, err := os.ReadFile(c.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read BMC password file: %w", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Controller is a connection to a BMC
+type Controller interface {
+	// SetNetbootOnce makes the host boot from the network on its next boot only
+	SetNetbootOnce(ctx context.Context) error
+
+	// PowerCycle restarts the host, or powers it on if it is off
+	PowerCycle(ctx context.Context) error
+}
+
+// New returns a controller for the BMC
+func New(config *Config) (Controller, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	password, err := config.password()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Protocol == ProtocolIPMI {
+		return &ipmi{config: config, password: password}, nil
+	}
+
+	return newRedfish(config, password), nil
+}
+
+// Netboot makes the host with the given BMC boot from the network once, and restarts
+// it so that it does so now
+func Netboot(ctx context.Context, config *Config) error {
+	controller, err := New(config)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	if err := controller.SetNetbootOnce(ctx); err != nil {
+		return fmt.Errorf("failed to set one-time network boot: %w", err)
+	}
+
+	if err := controller.PowerCycle(ctx); err != nil {
+		return fmt.Errorf("failed to power-cycle host: %w", err)
+	}
+
+	return nil
+}
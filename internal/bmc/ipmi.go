@@ -0,0 +1,66 @@
+package bmc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ipmi controls a BMC over IPMI v2.0 (RMCP+) by running ipmitool
+type ipmi struct {
+	config   *Config
+	password string
+}
+
+func (i *ipmi) SetNetbootOnce(ctx context.Context) error {
+	_, err := i.run(ctx, "chassis", "bootdev", "pxe")
+	return err
+}
+
+func (i *ipmi) PowerCycle(ctx context.Context) error {
+	status, err := i.run(ctx, "chassis", "power", "status")
+	if err != nil {
+		return err
+	}
+
+	// A host that's off can't be power-cycled, only powered on
+	command := "cycle"
+	if strings.HasSuffix(strings.TrimSpace(status), "off") {
+		command = "on"
+	}
+
+	_, err = i.run(ctx, "chassis", "power", command)
+
+	return err
+}
+
+// run runs an ipmitool command against the BMC, returning its output. The password is
+// passed in the environment, so that it isn't visible in the process list.
+func (i *ipmi) run(ctx context.Context, args ...string) (string, error) {
+	host, port, err := net.SplitHostPort(i.config.Address)
+	if err != nil {
+		host, port = i.config.Address, ""
+	}
+
+	cmdArgs := []string{"-I", "lanplus", "-H", host, "-U", i.config.Username, "-E"}
+	if port != "" {
+		cmdArgs = append(cmdArgs, "-p", port)
+	}
+
+	cmd := exec.CommandContext(ctx, "ipmitool", append(cmdArgs, args...)...)
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+i.password)
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ipmitool %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return string(output), nil
+}
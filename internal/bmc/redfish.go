@@ -0,0 +1,169 @@
+package bmc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Path of the Redfish collection of computer systems managed by a BMC
+const redfishSystemsPath = "/redfish/v1/Systems"
+
+// Redfish power states and reset types (DMTF Redfish schema, ComputerSystem)
+const (
+	redfishPowerOff    = "Off"
+	redfishResetOn     = "On"
+	redfishResetCycle  = "ForceRestart"
+	redfishBootPXE     = "Pxe"
+	redfishBootOnce    = "Once"
+	redfishResetAction = "#ComputerSystem.Reset"
+)
+
+var (
+	errNoSystems     = errors.New("BMC manages no computer systems")
+	errNoResetAction = errors.New("computer system has no reset action")
+	errRedfishStatus = errors.New("unexpected Redfish response status")
+)
+
+// redfish controls a BMC through its Redfish service. The first computer system that the
+// BMC manages is controlled, as BMCs of single servers manage only one.
+type redfish struct {
+	client   *http.Client
+	baseURL  string
+	username string
+	password string
+}
+
+type redfishLink struct {
+	ID string `json:"@odata.id"`
+}
+
+type redfishSystem struct {
+	PowerState string `json:"PowerState"`
+	Actions    map[string]struct {
+		Target string `json:"target"`
+	} `json:"Actions"`
+}
+
+func newRedfish(config *Config, password string) *redfish {
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+	if config.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	}
+
+	return &redfish{
+		client:   &http.Client{Transport: transport},
+		baseURL:  strings.TrimSuffix(config.Address, "/"),
+		username: config.Username,
+		password: password,
+	}
+}
+
+func (r *redfish) SetNetbootOnce(ctx context.Context) error {
+	systemPath, _, err := r.system(ctx)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]any{
+		"Boot": map[string]string{
+			"BootSourceOverrideEnabled": redfishBootOnce,
+			"BootSourceOverrideTarget":  redfishBootPXE,
+		},
+	}
+
+	return r.do(ctx, http.MethodPatch, systemPath, body, nil)
+}
+
+func (r *redfish) PowerCycle(ctx context.Context) error {
+	_, system, err := r.system(ctx)
+	if err != nil {
+		return err
+	}
+
+	action, ok := system.Actions[redfishResetAction]
+	if !ok || action.Target == "" {
+		return errNoResetAction
+	}
+
+	resetType := redfishResetCycle
+	if system.PowerState == redfishPowerOff {
+		resetType = redfishResetOn
+	}
+
+	return r.do(ctx, http.MethodPost, action.Target, map[string]string{"ResetType": resetType}, nil)
+}
+
+// system returns the path and state of the first computer system managed by the BMC
+func (r *redfish) system(ctx context.Context) (string, *redfishSystem, error) {
+	var systems struct {
+		Members []redfishLink `json:"Members"`
+	}
+
+	if err := r.do(ctx, http.MethodGet, redfishSystemsPath, nil, &systems); err != nil {
+		return "", nil, err
+	}
+
+	if len(systems.Members) == 0 {
+		return "", nil, errNoSystems
+	}
+
+	system := &redfishSystem{}
+	if err := r.do(ctx, http.MethodGet, systems.Members[0].ID, nil, system); err != nil {
+		return "", nil, err
+	}
+
+	return systems.Members[0].ID, system, nil
+}
+
+// do sends a request with the given JSON body, if any, to the path on the Redfish
+// service, decoding the JSON response into out if non-nil
+func (r *redfish) do(ctx context.Context, method string, path string, body any, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode Redfish request: %w", err)
+		}
+
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create Redfish request: %w", err)
+	}
+
+	req.SetBasicAuth(r.username, r.password)
+	req.Header.Set("Accept", "application/json")
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Redfish request to '%s' failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s '%s': %w: %s", method, path, errRedfishStatus, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode Redfish response from '%s': %w", path, err)
+	}
+
+	return nil
+}
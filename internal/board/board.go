@@ -0,0 +1,242 @@
+// Package board implements per-board quirk profiles, describing what common (mostly ARM)
+// boards need from a netboot server before and after they reach their bootloader
+package board
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// BootProtocol is the way a board loads its bootloader configuration once its firmware
+// has started
+type BootProtocol string
+
+const (
+	// The board runs UEFI firmware, and loads an EFI entrypoint image over TFTP
+	BootProtocolUEFI BootProtocol = "uefi"
+
+	// The board runs U-Boot, which requests pxelinux-style configs over TFTP
+	BootProtocolUBootPXE BootProtocol = "uboot-pxe"
+)
+
+var (
+	errUnknownProfile  = errors.New("unknown board profile")
+	errNoFirmwareDir   = errors.New("board profile requires firmware files, but no firmware directory was given")
+	errInvalidBootPath = errors.New("requested path is outside of the firmware directory")
+
+	errConflictingDeviceTrees = errors.New("boards booting U-Boot need different device trees, so U-Boot must choose one from a device tree directory")
+)
+
+// Profile describes the quirks of a family of boards
+type Profile struct {
+	Description string
+
+	// Architecture of the board, as named by GRUB (e.g. arm64)
+	Arch string
+
+	// Protocol used to load the bootloader after the firmware stage
+	Boot BootProtocol
+
+	// Files that the board's boot ROM requests over TFTP before reaching the EFI or
+	// U-Boot stage. These are served from the board's firmware directory.
+	FirmwareFiles []string
+
+	// Whether the boot ROM prefixes TFTP requests with the board's serial number,
+	// e.g. 'abcd1234/start4.elf'
+	SerialPrefix bool
+
+	// Device tree blob that should be passed to the kernel when booting via U-Boot
+	DeviceTree string
+}
+
+var profiles = map[string]*Profile{
+	"rpi4-uefi": {
+		Description: "Raspberry Pi 4 with the Pi Firmware Task Force UEFI firmware",
+		Arch:        "arm64",
+		Boot:        BootProtocolUEFI,
+		FirmwareFiles: []string{
+			"start4.elf", "fixup4.dat", "config.txt", "RPI_EFI.fd",
+			"bcm2711-rpi-4-b.dtb", "bcm2711-rpi-400.dtb", "bcm2711-rpi-cm4.dtb",
+			"overlays/miniuart-bt.dtbo", "overlays/upstream-pi4.dtbo",
+		},
+		SerialPrefix: true,
+	},
+	"rpi3-uefi": {
+		Description: "Raspberry Pi 3 with the Pi Firmware Task Force UEFI firmware",
+		Arch:        "arm64",
+		Boot:        BootProtocolUEFI,
+		FirmwareFiles: []string{
+			"bootcode.bin", "start.elf", "fixup.dat", "config.txt", "RPI_EFI.fd",
+			"bcm2710-rpi-3-b.dtb", "bcm2710-rpi-3-b-plus.dtb",
+		},
+		SerialPrefix: false,
+	},
+	"rpi4-uboot": {
+		Description: "Raspberry Pi 4 booting U-Boot from TFTP",
+		Arch:        "arm64",
+		Boot:        BootProtocolUBootPXE,
+		FirmwareFiles: []string{
+			"start4.elf", "fixup4.dat", "config.txt", "u-boot.bin", "bcm2711-rpi-4-b.dtb",
+		},
+		SerialPrefix: true,
+		DeviceTree:   "bcm2711-rpi-4-b.dtb",
+	},
+	"uboot": {
+		Description: "Generic board with U-Boot in local flash, using distroboot PXE",
+		Arch:        "arm64",
+		Boot:        BootProtocolUBootPXE,
+	},
+	"systemready": {
+		Description: "Arm SystemReady compliant board with UEFI firmware in local flash",
+		Arch:        "arm64",
+		Boot:        BootProtocolUEFI,
+	},
+}
+
+// Profiles returns the names of all built-in board profiles
+func Profiles() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// LookupProfile returns the built-in profile with the given name
+func LookupProfile(name string) (*Profile, error) {
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("'%s': %w", name, errUnknownProfile)
+	}
+
+	return profile, nil
+}
+
+// Config declares a set of boards sharing the same profile
+type Config struct {
+	// Name of a built-in profile
+	Profile string
+
+	// Local directory containing the board's firmware files
+	FirmwareDirectory string `mapstructure:"firmware_directory"`
+
+	// Extra firmware files to serve on top of those listed by the profile
+	ExtraFiles []string `mapstructure:"extra_files"`
+}
+
+// Board is a configured set of boards with a resolved profile
+type Board struct {
+	Name    string
+	Profile *Profile
+
+	firmwareDirectory string
+	files             []string
+}
+
+// New creates boards from config, resolving their profiles
+func New(configs map[string]*Config) ([]*Board, error) {
+	boards := make([]*Board, 0, len(configs))
+
+	for name, config := range configs {
+		profile, err := LookupProfile(config.Profile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid profile for board '%s': %w", name, err)
+		}
+
+		files := slices.Concat(profile.FirmwareFiles, config.ExtraFiles)
+		if len(files) > 0 && config.FirmwareDirectory == "" {
+			return nil, fmt.Errorf("invalid config for board '%s': %w", name, errNoFirmwareDir)
+		}
+
+		boards = append(boards, &Board{
+			Name:              name,
+			Profile:           profile,
+			firmwareDirectory: config.FirmwareDirectory,
+			files:             files,
+		})
+	}
+
+	// Sort for deterministic lookups
+	slices.SortFunc(boards, func(a, b *Board) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return boards, nil
+}
+
+// Resolve maps a TFTP request path to a local firmware file, if the path refers to one
+// of the board's firmware files. Serial number prefixes are stripped for profiles that
+// use them.
+func (b *Board) Resolve(requestPath string) (string, bool, error) {
+	requestPath = strings.TrimPrefix(path.Clean("/"+requestPath), "/")
+
+	candidates := []string{requestPath}
+	if b.Profile.SerialPrefix {
+		if _, rest, found := strings.Cut(requestPath, "/"); found {
+			candidates = append(candidates, rest)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if !slices.Contains(b.files, candidate) {
+			continue
+		}
+
+		localPath := filepath.Join(b.firmwareDirectory, filepath.FromSlash(candidate))
+		if rel, err := filepath.Rel(b.firmwareDirectory, localPath); err != nil || strings.HasPrefix(rel, "..") {
+			return "", false, errInvalidBootPath
+		}
+
+		return localPath, true, nil
+	}
+
+	return "", false, nil
+}
+
+// Open opens the firmware file for the given TFTP request path, if there is one
+func (b *Board) Open(requestPath string) (*os.File, bool, error) {
+	localPath, ok, err := b.Resolve(requestPath)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to open firmware file for board '%s': %w", b.Name, err)
+	}
+
+	return f, true, nil
+}
+
+// Files returns the firmware files served for the board, relative to its firmware directory
+func (b *Board) Files() []string {
+	return slices.Clone(b.files)
+}
+
+// DeviceTree returns the device tree blob that kernels booted by U-Boot on the given boards
+// should be passed, or an empty string if they need none. U-Boot requests the same configs
+// on every board, so all boards needing a device tree must need the same one.
+func DeviceTree(boards []*Board) (string, error) {
+	deviceTree := ""
+	for _, b := range boards {
+		if b.Profile.Boot != BootProtocolUBootPXE || b.Profile.DeviceTree == "" {
+			continue
+		}
+
+		if deviceTree != "" && deviceTree != b.Profile.DeviceTree {
+			return "", fmt.Errorf("'%s' and '%s': %w", deviceTree, b.Profile.DeviceTree, errConflictingDeviceTrees)
+		}
+
+		deviceTree = b.Profile.DeviceTree
+	}
+
+	return deviceTree, nil
+}
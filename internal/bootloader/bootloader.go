@@ -0,0 +1,181 @@
+// Package bootloader defines the bootloaders that pixie serves to network boot clients
+package bootloader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/davejbax/pixie/pkg/efipe"
+)
+
+var errUnsupportedMachine = errors.New("bootloader does not support machine type")
+
+// File is a file served to clients by a bootloader
+type File interface {
+	io.ReadCloser
+
+	// Size of the file in bytes
+	Size() int64
+}
+
+// MenuEntry is a single bootable entry in a generated bootloader configuration
+type MenuEntry struct {
+	Title string
+
+	// Paths to the kernel and initrd, relative to the server root. Initrd is empty if
+	// the kernel needs none.
+	Kernel string
+	Initrd string
+
+	// Files loaded into memory alongside the kernel under the given names, for kernels
+	// such as wimboot that take named files rather than an initrd. If set, Initrd is
+	// ignored.
+	NamedFiles []NamedFile
+
+	// Kernel command-line arguments
+	Args []string
+
+	// Bootloader modules loaded before booting the kernel, for bootloaders that load
+	// modules at runtime, e.g. GRUB's 'lvm'
+	Modules []string
+
+	// GRUB name of the architecture that the kernel is built for (e.g. x86_64 or
+	// arm64). If empty, the entry is assumed to be bootable on any architecture.
+	Arch string
+
+	// Whether the entry boots from local disk instead of a kernel, by handing control
+	// back to the firmware on UEFI, or chainloading the first disk's boot sector on
+	// BIOS. Kernel, Initrd and Args are ignored.
+	LocalBoot bool
+
+	// Whether Kernel is an EFI program, such as an OS loader, that is chainloaded with
+	// Args as its load options rather than booted as a Linux kernel. Initrd and
+	// NamedFiles are ignored.
+	Chainload bool
+
+	// Whether booting the entry requires a superuser's password, for entries that wipe
+	// and reinstall machines. Entries are only locked if the bootloader has superusers.
+	Locked bool
+
+	// Title of the submenu that the entry is shown in, if any. Entries in the same
+	// submenu are shown together, where the first of them appears.
+	Submenu string
+}
+
+// NamedFile is a file passed to a kernel under a given name
+type NamedFile struct {
+	Name string
+
+	// Path to the file, relative to the server root
+	Path string
+}
+
+// ConfigTarget describes the client that a configuration file is being generated for,
+// as far as can be determined from the path that was requested
+type ConfigTarget struct {
+	// MAC address of the client, if the bootloader requested a MAC-specific config
+	MAC net.HardwareAddr
+
+	// IP address of the client, if the bootloader requested an IP-specific config
+	IP net.IP
+
+	// SMBIOS UUID of the client, if known
+	UUID string
+
+	// GRUB name of the client's architecture, if known
+	Arch string
+}
+
+// EntriesForArch filters menu entries to those bootable on the given arch. If arch is
+// empty, all entries are returned.
+func EntriesForArch(entries []*MenuEntry, arch string) []*MenuEntry {
+	if arch == "" {
+		return entries
+	}
+
+	filtered := make([]*MenuEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Arch == "" || entry.Arch == arch {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered
+}
+
+// Bootloader produces everything a client needs to boot over the network: an entrypoint
+// image for each supported machine type, any auxiliary files that the entrypoint loads
+// at runtime, and a configuration file.
+//
+// All paths are relative to the root of the server the bootloader is served from, and
+// use forward slashes.
+type Bootloader interface {
+	// Machines returns the machine types that this bootloader has entrypoints for
+	Machines() []efipe.Machine
+
+	// EntrypointPath returns the path at which the entrypoint image for the given
+	// machine type is served
+	EntrypointPath(machine efipe.Machine) (string, error)
+
+	// Entrypoint opens the entrypoint image for the given machine type
+	Entrypoint(machine efipe.Machine) (File, error)
+
+	// AuxiliaryFile opens a file that the bootloader may request at runtime, such as a
+	// module. If the path does not refer to an auxiliary file, false is returned.
+	AuxiliaryFile(path string) (File, bool, error)
+
+	// AuxiliaryPaths returns the paths of all auxiliary files, e.g. so that they can be
+	// exported
+	AuxiliaryPaths() ([]string, error)
+
+	// ConfigPath returns the path at which the bootloader expects its default
+	// configuration
+	ConfigPath() string
+
+	// MACConfigPath returns the path at which the bootloader first looks for the
+	// configuration of the client with the given MAC address
+	MACConfigPath(mac net.HardwareAddr) string
+
+	// MatchConfigPath returns whether the given path is one at which the bootloader may
+	// request its configuration, and which client the configuration is for
+	MatchConfigPath(path string) (*ConfigTarget, bool)
+
+	// Config writes the bootloader configuration for the given client and menu
+	Config(w io.Writer, target *ConfigTarget, menu *Menu) error
+}
+
+type bytesFile struct {
+	*bytes.Reader
+}
+
+// NewBytesFile creates a [File] from an in-memory buffer
+func NewBytesFile(data []byte) File {
+	return &bytesFile{Reader: bytes.NewReader(data)}
+}
+
+func (*bytesFile) Close() error {
+	return nil
+}
+
+type osFile struct {
+	*os.File
+	size int64
+}
+
+// NewOSFile creates a [File] from an open file on disk
+func NewOSFile(f *os.File) (File, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	return &osFile{File: f, size: stat.Size()}, nil
+}
+
+func (f *osFile) Size() int64 {
+	return f.size
+}
@@ -0,0 +1,470 @@
+package bootloader
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/davejbax/pixie/internal/artifact"
+	"github.com/davejbax/pixie/internal/entrypoint"
+	"github.com/davejbax/pixie/pkg/efipe"
+	"github.com/davejbax/pixie/pkg/grub"
+)
+
+const (
+	// Directory that GRUB files are served from, following the layout of grub-mknetdir
+	grubDirectory = "boot/grub"
+
+	// Directory under grubDirectory that the files of each GRUB profile are served from
+	grubProfilesDirectory = "profiles"
+
+	grubConfigName = "grub.cfg"
+	grubCoreName   = "core.efi"
+
+	// ARP hardware type for ethernet, which GRUB prepends to MAC-specific config names
+	grubEthernetType = "01"
+)
+
+// GRUBTFTPPrefix is the prefix embedded into GRUB images served over TFTP. GRUB will load
+// its configuration and any additional modules relative to this.
+const GRUBTFTPPrefix = "(tftp)/" + grubDirectory
+
+var grubConfigTmpl = template.Must(template.New("grub.cfg").Funcs(template.FuncMap{
+	"quote": grubQuote,
+	"join":  strings.Join,
+	"items": grubItems,
+}).Parse(`# Generated by pixie. Do not edit.
+set timeout={{ .Timeout }}
+{{- if .Hidden }}
+set timeout_style=hidden
+{{- end }}
+{{- with .Default }}
+set default={{ quote . }}
+{{- end }}
+{{ range .Submenus }}{{ if .Title }}
+submenu {{ quote .Title }}{{ if .Restricted }} --unrestricted{{ end }} {
+{{ template "entries" . }}}
+{{ else }}{{ template "entries" . }}{{ end }}{{ end }}
+{{- define "entries" }}{{ range items .Entries }}{{ with .Condition }}
+if {{ . }}; then{{ end }}
+menuentry {{ quote .Title }}{{ if and $.Restricted (not .Locked) }} --unrestricted{{ end }} {
+{{- if eq (len .Variants) 1 }}{{ template "boot" index .Variants 0 }}
+{{- else }}{{ range $i, $variant := .Variants }}
+	{{ if $i }}elif{{ else }}if{{ end }} [ "$grub_cpu" = {{ quote $variant.Arch }} ]; then
+{{- template "boot" $variant }}{{ end }}
+	fi
+{{- end }}
+}{{ if .Condition }}
+fi{{ end }}
+{{ end }}{{ end }}
+{{- define "boot" }}
+{{- if not .LocalBoot }}{{ range .Modules }}
+	insmod {{ quote . }}{{ end }}{{ end }}
+{{- if .LocalBoot }}
+	if [ "$grub_platform" = "efi" ]; then
+		exit
+	fi
+	set root=(hd0)
+	chainloader +1
+{{- else if .Chainload }}
+	chainloader /{{ .Kernel }}{{ if .Args }} {{ join .Args " " }}{{ end }}
+{{- else }}
+	linux /{{ .Kernel }}{{ if .Args }} {{ join .Args " " }}{{ end }}
+{{- if .NamedFiles }}
+	initrd{{ range .NamedFiles }} newc:{{ .Name }}:/{{ .Path }}{{ end }}
+{{- else if .Initrd }}
+	initrd /{{ .Initrd }}
+{{- end }}
+{{- end }}
+{{- end }}`))
+
+// grubItem is a menu entry in a GRUB config. Entries with the same title for different
+// arches are offered as one item, which boots the variant for the client's arch.
+type grubItem struct {
+	Title    string
+	Locked   bool
+	Variants []*MenuEntry
+
+	// Condition under which the item is offered, if it's only bootable on some arches
+	Condition string
+}
+
+// grubItems gathers entries with the same title for different arches into items
+func grubItems(entries []*MenuEntry) []*grubItem {
+	var items []*grubItem
+	byTitle := make(map[string]*grubItem)
+
+	for _, entry := range entries {
+		if item, ok := byTitle[entry.Title]; ok && entry.Arch != "" && !slices.ContainsFunc(item.Variants, func(variant *MenuEntry) bool {
+			return variant.Arch == entry.Arch
+		}) {
+			item.Variants = append(item.Variants, entry)
+			item.Locked = item.Locked || entry.Locked
+			continue
+		}
+
+		item := &grubItem{Title: entry.Title, Locked: entry.Locked, Variants: []*MenuEntry{entry}}
+		if entry.Arch != "" {
+			byTitle[entry.Title] = item
+		}
+
+		items = append(items, item)
+	}
+
+	for _, item := range items {
+		conditions := make([]string, 0, len(item.Variants))
+		for _, variant := range item.Variants {
+			if variant.Arch != "" {
+				conditions = append(conditions, `"$grub_cpu" = `+grubQuote(variant.Arch))
+			}
+		}
+
+		if len(conditions) > 0 {
+			item.Condition = "[ " + strings.Join(conditions, " -o ") + " ]"
+		}
+	}
+
+	return items
+}
+
+// GRUB is a [Bootloader] that generates GRUB EFI images from modules on the local system
+type GRUB struct {
+	// Name of the profile that the GRUB config is from, or empty for the default config
+	profile string
+
+	// Directory that the bootloader's files are served from
+	directory string
+
+	config *grub.Config
+	store  *entrypoint.Store
+	images *artifact.Cache
+	arches map[efipe.Machine]string
+
+	// Modules read for generating images, which are read again only once they change
+	modules *grub.ModuleCache
+}
+
+var _ Bootloader = &GRUB{}
+
+// NewGRUB creates a GRUB bootloader for all arches in the config. If store is not nil,
+// the active entrypoint image in the store is served for an arch in preference to
+// generating a new one. Generated images are kept in the given cache, or generated for
+// every download if it is nil.
+func NewGRUB(config *grub.Config, store *entrypoint.Store, images *artifact.Cache) (*GRUB, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid GRUB config: %w", err)
+	}
+
+	arches := make(map[efipe.Machine]string, len(config.Arch))
+
+	for _, arch := range config.Arch {
+		machine, err := grub.MachineForArch(arch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine machine type for GRUB arch: %w", err)
+		}
+
+		arches[machine] = arch
+	}
+
+	return &GRUB{
+		directory: grubDirectory,
+		config:    config,
+		store:     store,
+		images:    images,
+		arches:    arches,
+		modules:   grub.NewModuleCache(),
+	}, nil
+}
+
+// NewGRUBProfile creates a GRUB bootloader for a named profile: an alternative GRUB
+// config, whose files are served from a directory of their own
+func NewGRUBProfile(name string, config *grub.Config, images *artifact.Cache) (*GRUB, error) {
+	g, err := NewGRUB(config, nil, images)
+	if err != nil {
+		return nil, err
+	}
+
+	g.profile = name
+	g.directory = path.Join(grubDirectory, grubProfilesDirectory, name)
+
+	return g, nil
+}
+
+// Profile returns the name of the bootloader's profile, or an empty string if it uses
+// the default GRUB config
+func (g *GRUB) Profile() string {
+	return g.profile
+}
+
+// prefix returns the prefix embedded in images, from which GRUB loads its config
+func (g *GRUB) prefix() string {
+	if g.config.Prefix != "" {
+		return g.config.Prefix
+	}
+
+	return "(tftp)/" + g.directory
+}
+
+func (g *GRUB) Machines() []efipe.Machine {
+	machines := make([]efipe.Machine, 0, len(g.arches))
+	for machine := range g.arches {
+		machines = append(machines, machine)
+	}
+
+	slices.Sort(machines)
+	return machines
+}
+
+func (g *GRUB) arch(machine efipe.Machine) (string, error) {
+	arch, ok := g.arches[machine]
+	if !ok {
+		return "", fmt.Errorf("GRUB has no arch configured for machine type 0x%02x: %w", machine, errUnsupportedMachine)
+	}
+
+	return arch, nil
+}
+
+func (g *GRUB) EntrypointPath(machine efipe.Machine) (string, error) {
+	arch, err := g.arch(machine)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(g.directory, arch+"-efi", grubCoreName), nil
+}
+
+func (g *GRUB) Entrypoint(machine efipe.Machine) (File, error) {
+	arch, err := g.arch(machine)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.store != nil {
+		state, err := g.store.State(arch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entrypoint state for arch '%s': %w", arch, err)
+		}
+
+		// Images are only generated for arches that have none installed in the store
+		if state.Active != "" {
+			f, err := g.store.Open(arch)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open entrypoint image for arch '%s': %w", arch, err)
+			}
+
+			return NewOSFile(f)
+		}
+	}
+
+	if g.images == nil {
+		buff := &bytes.Buffer{}
+		if err := g.renderImage(buff, arch); err != nil {
+			return nil, err
+		}
+
+		return NewBytesFile(buff.Bytes()), nil
+	}
+
+	key := artifact.Key{
+		Arch:    arch,
+		Modules: strings.Join(g.config.Modules, ","),
+		Prefix:  g.prefix(),
+	}
+
+	image, err := g.images.Get(key, func(w io.Writer) error {
+		return g.renderImage(w, arch)
+	})
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	return NewBytesFile(image), nil
+}
+
+// renderImage generates a GRUB EFI image for the arch from the modules on the local
+// system
+func (g *GRUB) renderImage(w io.Writer, arch string) error {
+	grubImage, cleanup, err := g.modules.NewImageFromConfig(g.config, arch, g.prefix())
+	if err != nil {
+		return fmt.Errorf("failed to create GRUB image for arch '%s': %w", arch, err)
+	}
+	defer cleanup()
+
+	efi, err := efipe.New(grubImage, grubImage.PEHeaderSize())
+	if err != nil {
+		return fmt.Errorf("failed to create EFI PE image for arch '%s': %w", arch, err)
+	}
+
+	if _, err := efi.WriteTo(w); err != nil {
+		return fmt.Errorf("failed to write EFI PE image for arch '%s': %w", arch, err)
+	}
+
+	return nil
+}
+
+// AuxiliaryFile serves GRUB modules (and other files such as fonts) from the GRUB root
+// directory, so that modules not embedded in the image can be loaded at runtime with
+// insmod
+func (g *GRUB) AuxiliaryFile(filePath string) (File, bool, error) {
+	rest, found := strings.CutPrefix(filePath, g.directory+"/")
+	if !found {
+		return nil, false, nil
+	}
+
+	platform, name, found := strings.Cut(rest, "/")
+	if !found || name == "" {
+		return nil, false, nil
+	}
+
+	arch, found := strings.CutSuffix(platform, "-efi")
+	if !found || !slices.Contains(g.config.Arch, arch) {
+		return nil, false, nil
+	}
+
+	root, err := g.config.RootDirectory(arch)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get GRUB root directory: %w", err)
+	}
+
+	// Ensure the request isn't doing path traversal
+	localPath := filepath.Join(root, filepath.FromSlash(path.Clean("/"+name)))
+	if rel, err := filepath.Rel(root, localPath); err != nil || strings.HasPrefix(rel, "..") {
+		return nil, false, nil
+	}
+
+	f, err := os.Open(localPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to open GRUB file: %w", err)
+	}
+
+	file, err := NewOSFile(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, false, err
+	}
+
+	return file, true, nil
+}
+
+// AuxiliaryPaths returns the paths of the files in the GRUB root directory of each arch,
+// which are served as auxiliary files
+func (g *GRUB) AuxiliaryPaths() ([]string, error) {
+	paths := []string{}
+
+	for _, arch := range g.config.Arch {
+		root, err := g.config.RootDirectory(arch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get GRUB root directory: %w", err)
+		}
+
+		err = filepath.WalkDir(root, func(localPath string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.Type().IsRegular() {
+				return err
+			}
+
+			rel, err := filepath.Rel(root, localPath)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			paths = append(paths, path.Join(g.directory, arch+"-efi", filepath.ToSlash(rel)))
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list GRUB files: %w", err)
+		}
+	}
+
+	return paths, nil
+}
+
+func (g *GRUB) ConfigPath() string {
+	return path.Join(g.directory, grubConfigName)
+}
+
+func (g *GRUB) MACConfigPath(mac net.HardwareAddr) string {
+	return g.ConfigPath() + "-" + grubEthernetType + "-" + strings.ReplaceAll(mac.String(), ":", "-")
+}
+
+// MatchConfigPath matches the paths that GRUB tries when loading its config over the
+// network: 'grub.cfg-01-<mac>', then 'grub.cfg-<hex IP>' (shortened one digit at a time),
+// and finally 'grub.cfg'
+func (g *GRUB) MatchConfigPath(configPath string) (*ConfigTarget, bool) {
+	if configPath == g.ConfigPath() {
+		return &ConfigTarget{}, true
+	}
+
+	suffix, found := strings.CutPrefix(configPath, g.ConfigPath()+"-")
+	if !found {
+		return nil, false
+	}
+
+	if mac, found := strings.CutPrefix(suffix, grubEthernetType+"-"); found {
+		hwAddr, err := net.ParseMAC(strings.ReplaceAll(mac, "-", ":"))
+		if err != nil {
+			return nil, false
+		}
+
+		return &ConfigTarget{MAC: hwAddr}, true
+	}
+
+	// As with U-Boot, partial IP addresses are not served, so that the client falls back
+	// to the generic config
+	if len(suffix) == net.IPv4len*2 {
+		ip, err := hex.DecodeString(suffix)
+		if err != nil {
+			return nil, false
+		}
+
+		return &ConfigTarget{IP: net.IP(ip)}, true
+	}
+
+	return nil, false
+}
+
+func (g *GRUB) Config(w io.Writer, _ *ConfigTarget, menu *Menu) error {
+	// GRUB names entries within submenus by the path of titles leading to them
+	defaultPath := ""
+	if len(menu.Entries) > 0 {
+		entry := menu.Entries[menu.defaultEntry(menu.Entries)]
+
+		defaultPath = entry.Title
+		if entry.Submenu != "" {
+			defaultPath = entry.Submenu + ">" + entry.Title
+		}
+	}
+
+	if err := grubConfigTmpl.Execute(w, struct {
+		Timeout  int
+		Hidden   bool
+		Default  string
+		Submenus []*submenu
+	}{
+		Timeout:  menu.Timeout,
+		Hidden:   menu.Hidden,
+		Default:  defaultPath,
+		Submenus: submenus(menu.Entries, len(g.config.Superusers) > 0),
+	}); err != nil {
+		return fmt.Errorf("failed to execute GRUB config template: %w", err)
+	}
+
+	return nil
+}
+
+// grubQuote quotes a string for use as a single word in a GRUB script
+func grubQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
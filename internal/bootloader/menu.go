@@ -0,0 +1,122 @@
+package bootloader
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Ways of grouping menu entries into submenus
+const (
+	SubmenusNone   = ""
+	SubmenusFamily = "family"
+	SubmenusArch   = "arch"
+)
+
+var errUnknownSubmenus = errors.New("unknown submenu grouping")
+
+// MenuConfig configures the boot menus of generated bootloader configs
+type MenuConfig struct {
+	// Seconds that the menu is shown before the default entry boots. A negative timeout
+	// waits for an entry to be chosen.
+	Timeout int `default:"10"`
+
+	// Title of the entry booted by default, e.g. 'rocky (x86_64)'. If no entry has this
+	// title, the first entry is booted. Hosts may choose their own default.
+	Default string
+
+	// Whether to hide the menu, booting the default entry unless a key is pressed before
+	// the timeout. U-Boot always shows its menu.
+	Hidden bool
+
+	// How to group distros into submenus: by 'family' (the distro's provider), by 'arch',
+	// or not at all if empty. U-Boot menus are always flat.
+	Submenus string
+
+	// Whether to title distros' entries by name alone, rather than by name and arch, so
+	// that GRUB offers each distro once and boots the build for the client's arch. Each
+	// config then reads the same on every arch of a mixed fleet.
+	DetectArch bool `mapstructure:"detect_arch"`
+
+	// Whether to offer an entry that boots from local disk in every menu, so that
+	// clients can fall through to their installed OS
+	LocalBoot bool `mapstructure:"local_boot"`
+
+	// Whether the local disk entry is booted by default for clients that aren't
+	// scheduled for an install, i.e. that don't match a host. This takes precedence
+	// over Default, and implies LocalBoot.
+	LocalBootDefault bool `mapstructure:"local_boot_default"`
+}
+
+func (c *MenuConfig) Validate() error {
+	switch c.Submenus {
+	case SubmenusNone, SubmenusFamily, SubmenusArch:
+		return nil
+	default:
+		return fmt.Errorf("'%s': %w", c.Submenus, errUnknownSubmenus)
+	}
+}
+
+// Menu is the boot menu of a generated bootloader config
+type Menu struct {
+	// Seconds before the default entry boots, or negative to wait for a choice
+	Timeout int
+
+	// Whether the menu is hidden unless a key is pressed before the timeout
+	Hidden bool
+
+	// Title of the entry booted by default. If no entry has this title, the first entry
+	// is booted.
+	Default string
+
+	Entries []*MenuEntry
+}
+
+// defaultEntry returns the index in entries of the entry booted by default
+func (m *Menu) defaultEntry(entries []*MenuEntry) int {
+	for i, entry := range entries {
+		if entry.Title == m.Default {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// submenu is a run of menu entries shown together, within a submenu if Title is set
+type submenu struct {
+	Title   string
+	Entries []*MenuEntry
+
+	// Whether the bootloader has superusers, so that entries which aren't locked must be
+	// marked as bootable by anyone
+	Restricted bool
+}
+
+// submenus groups entries into runs, gathering the entries of each submenu where the
+// first of them appears. Entries in no submenu keep their places.
+func submenus(entries []*MenuEntry, restricted bool) []*submenu {
+	var runs []*submenu
+	byTitle := make(map[string]*submenu)
+
+	for _, entry := range entries {
+		if entry.Submenu == "" {
+			if len(runs) == 0 || runs[len(runs)-1].Title != "" {
+				runs = append(runs, &submenu{Restricted: restricted})
+			}
+
+			runs[len(runs)-1].Entries = append(runs[len(runs)-1].Entries, entry)
+			continue
+		}
+
+		if run, ok := byTitle[entry.Submenu]; ok {
+			run.Entries = append(run.Entries, entry)
+			continue
+		}
+
+		run := &submenu{Title: entry.Submenu, Entries: []*MenuEntry{entry}, Restricted: restricted}
+		byTitle[entry.Submenu] = run
+		runs = append(runs, run)
+	}
+
+	return runs
+}
@@ -0,0 +1,203 @@
+package bootloader
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/davejbax/pixie/pkg/efipe"
+)
+
+const (
+	// Directory that U-Boot's PXE implementation requests configs from
+	ubootConfigDirectory = "pxelinux.cfg"
+	ubootDefaultConfig   = "default"
+
+	// ARP hardware type for ethernet, which U-Boot prepends to MAC-specific config names
+	ubootEthernetType = "01"
+)
+
+var ubootConfigTmpl = template.Must(template.New("pxelinux.cfg").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(`# Generated by pixie. Do not edit.
+menu title pixie
+timeout {{ .Timeout }}
+{{- with .Default }}
+default {{ . }}
+{{- end }}
+{{ range $i, $entry := .Entries }}
+label entry{{ $i }}
+	menu label {{ $entry.Title }}
+{{- if $entry.LocalBoot }}
+	localboot 0
+{{- else }}
+	kernel /{{ $entry.Kernel }}
+{{- with $entry.Initrd }}
+	initrd /{{ . }}
+{{- end }}
+{{- with $.DeviceTreeDirectory }}
+	fdtdir /{{ . }}
+{{- else with $.DeviceTree }}
+	fdt /{{ . }}
+{{- end }}
+{{- if $entry.Args }}
+	append {{ join $entry.Args " " }}
+{{- end }}
+{{- end }}
+{{ end }}`))
+
+// UBootConfig configures pxelinux-style configs for U-Boot clients
+type UBootConfig struct {
+	// Whether to serve U-Boot PXE configs. These are always served if any configured
+	// board boots via U-Boot.
+	Enabled bool
+
+	// GRUB name of the architecture of U-Boot clients, used to select which menu entries
+	// to offer them
+	Arch string `default:"arm64"`
+
+	// Directory containing device tree blobs, relative to the server root. If set, U-Boot
+	// loads the DTB named by its fdtfile environment variable from this directory, rather
+	// than the one that the boards' profile names.
+	DeviceTreeDirectory string `mapstructure:"fdt_directory"`
+}
+
+// UBoot is a [Bootloader] for boards running U-Boot, which is already present on the
+// client (in flash, or loaded by the board's boot ROM), so only serves configuration.
+//
+// U-Boot's PXE implementation requests configs in the following order, using the first
+// that exists: pxelinux.cfg/01-<mac>, pxelinux.cfg/<ip as hex> (dropping a hex digit
+// at a time), pxelinux.cfg/default-<arch>-<soc>-<board>, pxelinux.cfg/default-<arch>-<soc>,
+// pxelinux.cfg/default-<arch>, and finally pxelinux.cfg/default.
+type UBoot struct {
+	config *UBootConfig
+
+	// Device tree blob passed to kernels, relative to the server root, if any
+	deviceTree string
+}
+
+var _ Bootloader = &UBoot{}
+
+// NewUBoot creates a U-Boot bootloader. Unless a device tree directory is configured,
+// kernels are passed the given device tree blob, if there is one.
+func NewUBoot(config *UBootConfig, deviceTree string) *UBoot {
+	return &UBoot{config: config, deviceTree: deviceTree}
+}
+
+func (u *UBoot) Machines() []efipe.Machine {
+	return nil
+}
+
+func (u *UBoot) EntrypointPath(machine efipe.Machine) (string, error) {
+	return "", fmt.Errorf("U-Boot has no entrypoint for machine type 0x%02x: %w", machine, errUnsupportedMachine)
+}
+
+func (u *UBoot) Entrypoint(machine efipe.Machine) (File, error) {
+	return nil, fmt.Errorf("U-Boot has no entrypoint for machine type 0x%02x: %w", machine, errUnsupportedMachine)
+}
+
+func (u *UBoot) AuxiliaryFile(_ string) (File, bool, error) {
+	return nil, false, nil
+}
+
+func (u *UBoot) AuxiliaryPaths() ([]string, error) {
+	return nil, nil
+}
+
+func (u *UBoot) ConfigPath() string {
+	return path.Join(ubootConfigDirectory, ubootDefaultConfig)
+}
+
+func (u *UBoot) MACConfigPath(mac net.HardwareAddr) string {
+	return path.Join(ubootConfigDirectory, ubootEthernetType+"-"+strings.ReplaceAll(mac.String(), ":", "-"))
+}
+
+func (u *UBoot) MatchConfigPath(configPath string) (*ConfigTarget, bool) {
+	name, found := strings.CutPrefix(configPath, ubootConfigDirectory+"/")
+	if !found {
+		return nil, false
+	}
+
+	if name == ubootDefaultConfig {
+		return &ConfigTarget{}, true
+	}
+
+	if mac, found := strings.CutPrefix(name, ubootEthernetType+"-"); found {
+		hwAddr, err := net.ParseMAC(strings.ReplaceAll(mac, "-", ":"))
+		if err != nil {
+			return nil, false
+		}
+
+		return &ConfigTarget{MAC: hwAddr}, true
+	}
+
+	// U-Boot names its arch 'arm' for both 32-bit and 64-bit ARM, so we can't use this
+	// to tell clients apart, and instead rely on the configured arch
+	if strings.HasPrefix(name, ubootDefaultConfig+"-") {
+		return &ConfigTarget{}, true
+	}
+
+	// We don't serve anything for partial IP addresses, so that the client moves on to
+	// the arch-specific configs
+	if len(name) == net.IPv4len*2 {
+		ip, err := hex.DecodeString(name)
+		if err != nil {
+			return nil, false
+		}
+
+		return &ConfigTarget{IP: net.IP(ip)}, true
+	}
+
+	return nil, false
+}
+
+func (u *UBoot) Config(w io.Writer, target *ConfigTarget, menu *Menu) error {
+	arch := target.Arch
+	if arch == "" {
+		arch = u.config.Arch
+	}
+
+	// U-Boot can only pass a single initrd, so can't boot entries needing named files,
+	// and its PXE menus can only boot kernels, not chainload EFI programs
+	entries := slices.DeleteFunc(slices.Clone(EntriesForArch(menu.Entries, arch)), func(entry *MenuEntry) bool {
+		return len(entry.NamedFiles) > 0 || entry.Chainload
+	})
+
+	defaultLabel := ""
+	if len(entries) > 0 {
+		defaultLabel = fmt.Sprintf("entry%d", menu.defaultEntry(entries))
+	}
+
+	// A timeout of zero waits for an entry to be chosen, so the shortest timeout is used
+	// instead
+	timeout := 0
+	if menu.Timeout == 0 {
+		timeout = 1
+	} else if menu.Timeout > 0 {
+		timeout = menu.Timeout * 10
+	}
+
+	if err := ubootConfigTmpl.Execute(w, struct {
+		// U-Boot timeout is in tenths of a second
+		Timeout             int
+		Default             string
+		DeviceTreeDirectory string
+		DeviceTree          string
+		Entries             []*MenuEntry
+	}{
+		Timeout:             timeout,
+		Default:             defaultLabel,
+		DeviceTreeDirectory: strings.Trim(u.config.DeviceTreeDirectory, "/"),
+		DeviceTree:          strings.Trim(u.deviceTree, "/"),
+		Entries:             entries,
+	}); err != nil {
+		return fmt.Errorf("failed to execute U-Boot config template: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,415 @@
+// Package bootsession follows each machine's boot across protocols, correlating its
+// DHCP offer, bootloader download over TFTP or HTTP, and later config, kernel and
+// initrd downloads into a single boot session, so that operators can see where a boot
+// got stuck
+package bootsession
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davejbax/pixie/internal/audit"
+	"github.com/davejbax/pixie/internal/clients"
+	"github.com/davejbax/pixie/internal/hoststatus"
+	"github.com/davejbax/pixie/internal/requestlog"
+)
+
+// How often sessions are checked for stalls and expiry
+const sweepInterval = 15 * time.Second
+
+type Config struct {
+	// How long a boot may go without any request from the machine before its session is
+	// considered stalled
+	StallTimeout time.Duration `mapstructure:"stall_timeout" default:"5m"`
+
+	// How long sessions are kept after their last request
+	Retention time.Duration `default:"24h"`
+
+	// Maximum number of sessions kept. The oldest sessions are dropped first.
+	MaxSessions int `mapstructure:"max_sessions" default:"1000"`
+}
+
+// State is the state of a boot session
+type State string
+
+const (
+	// The machine is still making requests
+	StateActive State = "active"
+
+	// The machine stopped making requests before it downloaded a kernel and initrd
+	StateStalled State = "stalled"
+
+	// The machine downloaded a kernel and initrd, and then stopped making requests, as
+	// expected once it has booted them (unless it reports its install status)
+	StateBooted State = "booted"
+
+	// The machine's install automation reported success or failure
+	StateInstalled State = "installed"
+	StateFailed    State = "failed"
+)
+
+// Boot stages, in the order that a boot progresses through them
+var stages = []audit.EventType{
+	audit.EventDHCPOffer,
+	audit.EventBootloader,
+	audit.EventConfig,
+	audit.EventKernel,
+	audit.EventInitrd,
+	audit.EventInstallStatus,
+	audit.EventInstallComplete,
+}
+
+// Session is a single boot of a machine. Fields identifying the machine are set as far
+// as they are known.
+type Session struct {
+	ID string `json:"id"`
+
+	MAC  string `json:"mac,omitempty"`
+	IP   string `json:"ip,omitempty"`
+	UUID string `json:"uuid,omitempty"`
+
+	// Name of the host that the machine matched, if any
+	Host string `json:"host,omitempty"`
+
+	State State `json:"state"`
+
+	// Furthest boot stage reached
+	Stage audit.EventType `json:"stage,omitempty"`
+
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+
+	Steps []Step `json:"steps"`
+
+	// Boot stages reached by downloads in progress, by path. Downloads are recorded as
+	// boot events when they start, and added as steps when they finish.
+	downloads map[string]audit.EventType
+}
+
+// Step is a DHCP offer, file request or install report within a session
+type Step struct {
+	Time time.Time `json:"time"`
+
+	// 'dhcp', 'tftp', 'http' or 'report'
+	Protocol string `json:"protocol"`
+
+	// Boot stage that the step reached, if any
+	Stage audit.EventType `json:"stage,omitempty"`
+
+	// File requested or offered, or the reported install status
+	Detail string `json:"detail,omitempty"`
+
+	// Outcome of a file request, as logged by the request log
+	Status string `json:"status,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+}
+
+// Tracker correlates boot events and file requests into sessions, which are kept in
+// memory. It is an [audit.Sink] and a [requestlog.Sink], so that it sees events and
+// requests as they happen.
+type Tracker struct {
+	logger  *slog.Logger
+	config  *Config
+	clients *clients.Registry
+
+	mu       sync.Mutex
+	sessions []*Session
+	nextID   uint64
+}
+
+// New creates a tracker, which looks up the MAC addresses of clients that only make
+// requests by IP in the given registry (which may be nil)
+func New(logger *slog.Logger, config *Config, registry *clients.Registry) *Tracker {
+	return &Tracker{
+		logger:  logger,
+		config:  config,
+		clients: registry,
+	}
+}
+
+// Send adds a boot event to the session of the machine that it's about. DHCP offers and
+// bootloader downloads after a machine has downloaded a kernel start a new session, as
+// the machine must have rebooted.
+func (t *Tracker) Send(event audit.Event) {
+	if !slices.Contains(stages, event.Type) {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var session *Session
+
+	switch event.Type {
+	case audit.EventInstallStatus, audit.EventInstallComplete:
+		// Reports come from the installed system, often long after the boot, so they're
+		// matched to the host's latest session however old it is
+		if session = t.latest(func(s *Session) bool { return event.Host != "" && s.Host == event.Host }); session == nil {
+			return
+		}
+
+		session.Steps = append(session.Steps, Step{Time: event.Time, Protocol: "report", Stage: event.Type, Detail: event.Detail})
+		session.State = installState(event)
+	case audit.EventDHCPOffer:
+		session = t.session(event.Time, event.MAC, event.IP, true)
+		session.Steps = append(session.Steps, Step{Time: event.Time, Protocol: "dhcp", Stage: event.Type, Detail: event.Detail})
+	default:
+		session = t.session(event.Time, event.MAC, event.IP, event.Type == audit.EventBootloader)
+		session.downloads[normalisePath(event.Detail)] = event.Type
+	}
+
+	session.identify(event.MAC, event.IP, event.UUID, event.Host)
+	session.reach(event.Type)
+	session.Updated = event.Time
+}
+
+// Observe adds a file request to the session of the machine that made it
+func (t *Tracker) Observe(req *requestlog.Request) {
+	if req.ClientIP == nil {
+		return
+	}
+
+	var mac string
+	if client := t.clients.Lookup(req.ClientIP); client.MAC != nil {
+		mac = client.MAC.String()
+	}
+
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session := t.session(now, mac, req.ClientIP.String(), false)
+	session.identify(mac, req.ClientIP.String(), "", "")
+	session.Updated = now
+
+	requestPath := normalisePath(req.Path)
+
+	session.Steps = append(session.Steps, Step{
+		Time:     now.Add(-req.Duration),
+		Protocol: req.Protocol,
+		Stage:    session.downloads[requestPath],
+		Detail:   req.Path,
+		Status:   req.Status,
+		Bytes:    req.Bytes,
+	})
+
+	delete(session.downloads, requestPath)
+}
+
+// Sessions returns the sessions, newest first
+func (t *Tracker) Sessions() []Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sessions := make([]Session, 0, len(t.sessions))
+	for i := len(t.sessions) - 1; i >= 0; i-- {
+		sessions = append(sessions, t.sessions[i].copy())
+	}
+
+	return sessions
+}
+
+// Get returns the session with the given ID
+func (t *Tracker) Get(id string) (Session, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, session := range t.sessions {
+		if session.ID == id {
+			return session.copy(), true
+		}
+	}
+
+	return Session{}, false
+}
+
+// Run marks sessions that have stopped making progress as stalled or booted, and drops
+// expired sessions, until the context is cancelled
+func (t *Tracker) Run(ctx context.Context) error {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			t.sweep(now)
+		}
+	}
+}
+
+func (t *Tracker) sweep(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	kept := t.sessions[:0]
+
+	for _, session := range t.sessions {
+		if now.Sub(session.Updated) > t.config.Retention {
+			continue
+		}
+
+		kept = append(kept, session)
+
+		if session.State != StateActive || now.Sub(session.Updated) <= t.config.StallTimeout {
+			continue
+		}
+
+		if session.booted() {
+			session.State = StateBooted
+			continue
+		}
+
+		session.State = StateStalled
+
+		attrs := []any{
+			"session", session.ID,
+			"mac", session.MAC,
+			"ip", session.IP,
+			"stage", session.Stage,
+			"idle", now.Sub(session.Updated).Round(time.Second),
+		}
+
+		if session.Host != "" {
+			attrs = append(attrs, "host", session.Host)
+		}
+
+		if len(session.Steps) > 0 {
+			last := session.Steps[len(session.Steps)-1]
+			attrs = append(attrs, "last_request", last.Detail, "last_status", last.Status)
+		}
+
+		t.logger.Warn("boot session stalled", attrs...)
+	}
+
+	clear(t.sessions[len(kept):])
+	t.sessions = kept
+}
+
+// session returns the session that an event or request at the given time belongs to,
+// starting a new one if the machine has none in progress. If restart is true, a new
+// session is also started if the machine had already downloaded a kernel.
+func (t *Tracker) session(now time.Time, mac string, ip string, restart bool) *Session {
+	session := t.latest(func(s *Session) bool {
+		if mac != "" && s.MAC != "" {
+			return s.MAC == mac
+		}
+
+		return ip != "" && s.IP == ip
+	})
+
+	if session != nil && session.State == StateActive && now.Sub(session.Updated) <= t.config.StallTimeout && !(restart && session.reachedKernel()) {
+		return session
+	}
+
+	t.nextID++
+
+	session = &Session{
+		ID:        strconv.FormatUint(t.nextID, 10),
+		State:     StateActive,
+		Started:   now,
+		Updated:   now,
+		downloads: make(map[string]audit.EventType),
+	}
+
+	t.sessions = append(t.sessions, session)
+
+	if t.config.MaxSessions > 0 && len(t.sessions) > t.config.MaxSessions {
+		dropped := len(t.sessions) - t.config.MaxSessions
+		clear(t.sessions[:dropped])
+		t.sessions = t.sessions[dropped:]
+	}
+
+	return session
+}
+
+// latest returns the most recently started session matching the predicate
+func (t *Tracker) latest(match func(s *Session) bool) *Session {
+	for i := len(t.sessions) - 1; i >= 0; i-- {
+		if match(t.sessions[i]) {
+			return t.sessions[i]
+		}
+	}
+
+	return nil
+}
+
+// identify fills in what's known about the machine, ignoring unknown (empty) values
+func (s *Session) identify(mac string, ip string, uuid string, host string) {
+	if mac != "" {
+		s.MAC = mac
+	}
+
+	if ip != "" {
+		s.IP = ip
+	}
+
+	if uuid != "" {
+		s.UUID = uuid
+	}
+
+	if host != "" {
+		s.Host = host
+	}
+}
+
+// reach records that the session reached a boot stage, if it's further than before
+func (s *Session) reach(stage audit.EventType) {
+	if slices.Index(stages, stage) > slices.Index(stages, s.Stage) {
+		s.Stage = stage
+	}
+}
+
+func (s *Session) reachedKernel() bool {
+	return slices.Index(stages, s.Stage) >= slices.Index(stages, audit.EventKernel)
+}
+
+// booted returns whether the machine downloaded both a kernel and an initrd
+func (s *Session) booted() bool {
+	var kernel, initrd bool
+
+	for _, step := range s.Steps {
+		kernel = kernel || step.Stage == audit.EventKernel
+		initrd = initrd || step.Stage == audit.EventInitrd
+	}
+
+	return kernel && initrd
+}
+
+func (s *Session) copy() Session {
+	session := *s
+	session.Steps = slices.Clone(s.Steps)
+	session.downloads = nil
+
+	return session
+}
+
+// normalisePath returns a requested path as the catalog records it, as clients may or
+// may not include a leading slash, and some use backslashes
+func normalisePath(requestPath string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(requestPath, "\\", "/")), "/")
+}
+
+// installState returns the state of a session whose machine reported its install status
+func installState(event audit.Event) State {
+	if event.Type == audit.EventInstallComplete {
+		return StateInstalled
+	}
+
+	switch hoststatus.Status(strings.SplitN(event.Detail, ":", 2)[0]) {
+	case hoststatus.StatusSuccess:
+		return StateInstalled
+	case hoststatus.StatusFailure:
+		return StateFailed
+	default:
+		return StateActive
+	}
+}
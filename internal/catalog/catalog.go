@@ -0,0 +1,1208 @@
+// Package catalog resolves the files that pixie serves to network boot clients:
+// bootloader entrypoints and auxiliary files, generated bootloader configs, and distro
+// kernels and initrds. It is shared by the TFTP and HTTP servers, so that both present
+// the same tree.
+package catalog
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/davejbax/pixie/internal/audit"
+	"github.com/davejbax/pixie/internal/autoinstall"
+	"github.com/davejbax/pixie/internal/board"
+	"github.com/davejbax/pixie/internal/bootloader"
+	"github.com/davejbax/pixie/internal/clients"
+	"github.com/davejbax/pixie/internal/cmdline"
+	"github.com/davejbax/pixie/internal/distro"
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/httpcompress"
+	"github.com/davejbax/pixie/internal/netif"
+	"github.com/davejbax/pixie/internal/oneshot"
+	"github.com/davejbax/pixie/internal/storage"
+	"github.com/davejbax/pixie/internal/urlsign"
+	"github.com/davejbax/pixie/pkg/efipe"
+)
+
+const (
+	// Directory that distro kernels and initrds are served from, as
+	// 'distros/<name>/<arch>/<file>'. Installation trees are served under 'tree', driver
+	// disks under 'driverdisks', and configs for chainloaded loaders as 'boot.cfg'.
+	distroDirectory  = "distros"
+	kernelName       = "vmlinuz"
+	initrdName       = "initrd.img"
+	treeName         = "tree"
+	loaderConfigName = "boot.cfg"
+	driverDisksName  = "driverdisks"
+
+	// Directory that kernels and initrds are also served from by their SHA-256 checksum,
+	// as 'by-hash/<checksum>/<file>'. Generated configs refer to these paths where they
+	// can, so that they name exact content even across reconciles.
+	hashDirectory = "by-hash"
+
+	// Files served by checksum never change, so downstream caches may keep them forever
+	immutableCacheControl = "public, max-age=31536000, immutable"
+
+	localBootTitle = "Boot from local disk"
+
+	// AutomationPath is the HTTP path at which hosts' install automation files are served
+	AutomationPath = "/hosts/{name}/automation"
+
+	// SignedAutomationPath is the HTTP path at which automation files are served when
+	// their URLs must be signed
+	SignedAutomationPath = AutomationPath + "/{token}"
+)
+
+var (
+	// ErrNotFound is returned when a requested file doesn't exist in the catalog
+	ErrNotFound = errors.New("file not found")
+
+	// ErrAccessDenied is returned when a requested path tries to escape the catalog,
+	// e.g. with '..' segments or symlinks pointing elsewhere
+	ErrAccessDenied = errors.New("access denied")
+
+	errDuplicateBootloaderPath = errors.New("two bootloaders are served at the same path")
+)
+
+// Distro names architectures differently to GRUB in some cases
+var grubArches = map[string]string{
+	"aarch64": "arm64",
+	"amd64":   "x86_64",
+}
+
+type entrypointRef struct {
+	bootloader bootloader.Bootloader
+	machine    efipe.Machine
+}
+
+type Catalog struct {
+	logger *slog.Logger
+
+	bootloaders []bootloader.Bootloader
+	entrypoints map[string]*entrypointRef
+
+	// Boards whose boot ROMs request firmware files, which are served ahead of
+	// everything else
+	boards []*board.Board
+
+	// Guards distros, hosts and kernel arguments, which are replaced after reconciles
+	// and config reloads
+	mu      sync.RWMutex
+	distros []*distro.Distro
+	hosts   *hosts.Table
+
+	// Global kernel arguments, which distro and host arguments are merged over
+	kernelArgs []string
+
+	clients *clients.Registry
+	oneshot *oneshot.Store
+	events  *audit.Log
+
+	// Base URL of the HTTP server, used to refer hosts to their automation files
+	baseURL string
+
+	// Addresses advertised on each local interface, which override baseURL for clients
+	// on the interfaces' networks. Nil if the base URL is fixed.
+	interfaces *netif.Table
+
+	// Signs the URLs of hosts' automation files, if they must be signed
+	signer *urlsign.Signer
+
+	// Signs the URLs that hosts report their install to, if they can report
+	reporter *urlsign.Signer
+
+	// Timeout, default entry and grouping of generated boot menus
+	menu *bootloader.MenuConfig
+
+	// Where automation templates read secrets and external data from
+	templates *autoinstall.Sources
+
+	// Directories of static files, in order of precedence
+	static []*staticDir
+
+	// Called when a kernel or initrd fails verification, e.g. to trigger a reconcile
+	onCorrupt func()
+}
+
+// New creates a catalog serving the given bootloaders and distros. Hosts are matched
+// against clients using what the client registry knows about them, and are given menu
+// entries for their own distro only, or local boot once a one-shot install in the given
+// store has completed. Menu entries boot with the given global kernel arguments, merged
+// with those of the distro and host. Downloads of entrypoints, configs, kernels and
+// initrds are recorded in the audit log, if one is given. Paths are also looked up in
+// the static directories, as their precedence allows. Generated configs present their
+// entries as configured by menu, and hosts' templates read secrets and external data
+// from templates.
+func New(logger *slog.Logger, bootloaders []bootloader.Bootloader, distros []*distro.Distro, hostTable *hosts.Table, registry *clients.Registry, oneshots *oneshot.Store, events *audit.Log, kernelArgs []string, baseURL string, static []StaticDir, menu *bootloader.MenuConfig, templates *autoinstall.Sources) (*Catalog, error) {
+	if err := menu.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid boot menu: %w", err)
+	}
+
+	entrypoints := make(map[string]*entrypointRef)
+	configs := make(map[string]struct{})
+
+	for _, bl := range bootloaders {
+		for _, machine := range bl.Machines() {
+			entrypointPath, err := bl.EntrypointPath(machine)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get bootloader entrypoint path: %w", err)
+			}
+
+			if _, ok := entrypoints[entrypointPath]; ok {
+				return nil, fmt.Errorf("entrypoint '%s': %w", entrypointPath, errDuplicateBootloaderPath)
+			}
+
+			entrypoints[entrypointPath] = &entrypointRef{bootloader: bl, machine: machine}
+		}
+
+		if _, ok := configs[bl.ConfigPath()]; ok {
+			return nil, fmt.Errorf("config '%s': %w", bl.ConfigPath(), errDuplicateBootloaderPath)
+		}
+
+		configs[bl.ConfigPath()] = struct{}{}
+	}
+
+	return &Catalog{
+		logger:      logger,
+		bootloaders: bootloaders,
+		entrypoints: entrypoints,
+		distros:     sortDistros(distros),
+		hosts:       hostTable,
+		clients:     registry,
+		oneshot:     oneshots,
+		events:      events,
+		kernelArgs:  kernelArgs,
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		menu:        menu,
+		templates:   templates,
+		static:      newStaticDirs(static),
+	}, nil
+}
+
+// SetDistros replaces the distros served by the catalog, e.g. after new versions have
+// been downloaded. Transfers of files from previous versions are not interrupted.
+func (c *Catalog) SetDistros(distros []*distro.Distro) {
+	distros = sortDistros(distros)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.distros = distros
+}
+
+// SetBoards serves the firmware files of the given boards, at the paths their boot ROMs
+// request them from
+func (c *Catalog) SetBoards(boards []*board.Board) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.boards = boards
+}
+
+// SetInterfaces sets the addresses advertised on each local interface, so that clients
+// on an interface's networks are referred to the HTTP server at its address there
+// rather than the base URL
+func (c *Catalog) SetInterfaces(interfaces *netif.Table) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.interfaces = interfaces
+}
+
+// SetSigner requires hosts' automation files to be fetched at URLs signed by the signer,
+// which are generated each time a host's bootloader config is served
+func (c *Catalog) SetSigner(signer *urlsign.Signer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.signer = signer
+}
+
+// SetReporter signs the URLs that hosts' automation files report their install to with
+// the signer. Without one, hosts can't report their install.
+func (c *Catalog) SetReporter(reporter *urlsign.Signer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reporter = reporter
+}
+
+// reportSigner returns the signer of report URLs, or nil if hosts can't report
+func (c *Catalog) reportSigner() *urlsign.Signer {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.reporter
+}
+
+// urlSigner returns the signer of automation file URLs, or nil if they needn't be signed
+func (c *Catalog) urlSigner() *urlsign.Signer {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.signer
+}
+
+// clientBaseURL returns the base URL of the HTTP server as reached by the client with
+// the given IP address
+func (c *Catalog) clientBaseURL(clientIP net.IP) string {
+	c.mu.RLock()
+	interfaces := c.interfaces
+	c.mu.RUnlock()
+
+	if baseURL, ok := interfaces.BaseURL(clientIP); ok {
+		return strings.TrimSuffix(baseURL, "/")
+	}
+
+	return c.baseURL
+}
+
+// OnCorrupt sets a function called whenever a distro's kernel or initrd is refused
+// because it no longer matches its recorded checksum, e.g. to reconcile the distro so
+// that its files are downloaded again
+func (c *Catalog) OnCorrupt(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onCorrupt = fn
+}
+
+// SetHosts replaces the hosts and global kernel arguments used to generate bootloader
+// configs, e.g. after the config has been reloaded
+func (c *Catalog) SetHosts(hostTable *hosts.Table, kernelArgs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hosts = hostTable
+	c.kernelArgs = kernelArgs
+}
+
+// Hosts returns the hosts that the catalog currently serves
+func (c *Catalog) Hosts() *hosts.Table {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.hosts
+}
+
+// Distros returns the distros that the catalog currently serves, sorted by name and arch
+func (c *Catalog) Distros() []*distro.Distro {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.distros
+}
+
+func (c *Catalog) currentKernelArgs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.kernelArgs
+}
+
+func sortDistros(distros []*distro.Distro) []*distro.Distro {
+	distros = slices.Clone(distros)
+	slices.SortFunc(distros, func(a, b *distro.Distro) int {
+		return cmp.Or(cmp.Compare(a.Name(), b.Name()), cmp.Compare(a.Arch(), b.Arch()))
+	})
+
+	return distros
+}
+
+// EntrypointPaths returns the paths of all bootloader entrypoints in the catalog
+func (c *Catalog) EntrypointPaths() []string {
+	paths := make([]string, 0, len(c.entrypoints))
+	for entrypointPath := range c.entrypoints {
+		paths = append(paths, entrypointPath)
+	}
+
+	return paths
+}
+
+// profiled is a bootloader for a named profile, such as a GRUB profile, which only the
+// hosts selecting the profile are offered
+type profiled interface {
+	Profile() string
+}
+
+func bootloaderProfile(bl bootloader.Bootloader) string {
+	if p, ok := bl.(profiled); ok {
+		return p.Profile()
+	}
+
+	return ""
+}
+
+// BootFiles returns the path of the entrypoint served for each machine type. If several
+// bootloaders have entrypoints for the same machine type, the first is used. Bootloaders
+// for profiles are left out, as only hosts selecting them are offered them.
+func (c *Catalog) BootFiles() map[efipe.Machine]string {
+	bootFiles := make(map[efipe.Machine]string)
+
+	for _, bl := range c.bootloaders {
+		if bootloaderProfile(bl) != "" {
+			continue
+		}
+
+		for _, machine := range bl.Machines() {
+			if _, ok := bootFiles[machine]; ok {
+				continue
+			}
+
+			// Errors are impossible here, as all paths were resolved in New
+			if entrypointPath, err := bl.EntrypointPath(machine); err == nil {
+				bootFiles[machine] = entrypointPath
+			}
+		}
+	}
+
+	return bootFiles
+}
+
+// BootFile returns the path of the entrypoint offered to a client of the machine type:
+// that of its host's GRUB profile, if the host has one, and otherwise that in
+// [Catalog.BootFiles]
+func (c *Catalog) BootFile(machine efipe.Machine, mac net.HardwareAddr, uuid string, ip net.IP) (string, bool) {
+	if host := c.Hosts().Match(mac, uuid, ip); host != nil && host.GrubProfile != "" {
+		for _, bl := range c.bootloaders {
+			if bootloaderProfile(bl) != host.GrubProfile {
+				continue
+			}
+
+			if entrypointPath, err := bl.EntrypointPath(machine); err == nil {
+				return entrypointPath, true
+			}
+		}
+
+		c.logger.Warn("host's GRUB profile has no entrypoint for the machine type; offering the default",
+			"host", host.Name,
+			"profile", host.GrubProfile,
+			"machine", fmt.Sprintf("0x%02x", machine),
+		)
+	}
+
+	bootFile, ok := c.BootFiles()[machine]
+	return bootFile, ok
+}
+
+// Open opens the file at the given path for the client with the given IP address.
+// Paths are resolved in order against boards' firmware files, overriding static
+// directories, bootloader
+// entrypoints, distro files, loader configs, bootloader configs and auxiliary files,
+// and finally the other static directories.
+// [ErrNotFound] is returned if there is no such file, and [ErrAccessDenied] if the path
+// tries to escape the catalog.
+func (c *Catalog) Open(requestPath string, clientIP net.IP) (bootloader.File, error) {
+	// Clients may or may not include a leading slash, and some use backslashes
+	requestPath = strings.ReplaceAll(requestPath, "\\", "/")
+
+	// Cleaning would quietly resolve '..' segments, so they are refused outright
+	if slices.Contains(strings.Split(requestPath, "/"), "..") {
+		return nil, ErrAccessDenied
+	}
+
+	requestPath = strings.TrimPrefix(path.Clean("/"+requestPath), "/")
+
+	if file, ok, err := c.openFirmwareFile(requestPath); ok || err != nil {
+		return file, err
+	}
+
+	if file, ok, err := c.openStaticFile(requestPath, true); ok || err != nil {
+		return file, err
+	}
+
+	if ref, ok := c.entrypoints[requestPath]; ok {
+		file, err := ref.bootloader.Entrypoint(ref.machine)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		c.record(audit.EventBootloader, clientIP, requestPath)
+		return file, nil
+	}
+
+	if distroPath, found := strings.CutPrefix(requestPath, distroDirectory+"/"); found {
+		return c.openDistroFile(distroPath, clientIP)
+	}
+
+	if hashPath, found := strings.CutPrefix(requestPath, hashDirectory+"/"); found {
+		return c.openHashedFile(hashPath, clientIP)
+	}
+
+	if d := c.fixedLoaderConfigDistro(requestPath, clientIP); d != nil {
+		return c.loaderConfig(d, clientIP)
+	}
+
+	for _, bl := range c.bootloaders {
+		if target, ok := bl.MatchConfigPath(requestPath); ok {
+			return c.config(bl, target, requestPath, clientIP)
+		}
+
+		file, ok, err := bl.AuxiliaryFile(requestPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open bootloader file: %w", err)
+		}
+
+		if ok {
+			return file, nil
+		}
+	}
+
+	if file, ok, err := c.openStaticFile(requestPath, false); ok || err != nil {
+		return file, err
+	}
+
+	return nil, ErrNotFound
+}
+
+// openFirmwareFile opens the firmware file at the request path from the first board
+// serving it. Boot ROMs that prefix requests with their serial number are served from
+// the same files.
+func (c *Catalog) openFirmwareFile(requestPath string) (bootloader.File, bool, error) {
+	c.mu.RLock()
+	boards := c.boards
+	c.mu.RUnlock()
+
+	for _, b := range boards {
+		f, ok, err := b.Open(requestPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, false, ErrNotFound
+		} else if err != nil {
+			return nil, false, err //nolint:wrapcheck
+		} else if !ok {
+			continue
+		}
+
+		file, err := bootloader.NewOSFile(f)
+		if err != nil {
+			f.Close()
+			return nil, false, err //nolint:wrapcheck
+		}
+
+		return file, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// config generates a bootloader config for a client. Configs requested for a specific
+// client (by MAC or IP) are only served if a host matches, so that the bootloader falls
+// back to its generic config otherwise.
+func (c *Catalog) config(bl bootloader.Bootloader, target *bootloader.ConfigTarget, requestPath string, clientIP net.IP) (bootloader.File, error) {
+	specific := target.MAC != nil || target.IP != nil
+	client := c.clients.Lookup(clientIP)
+
+	if target.MAC == nil && target.IP == nil {
+		target.MAC = client.MAC
+	}
+
+	if target.IP == nil {
+		target.IP = clientIP
+	}
+
+	if target.UUID == "" && (target.MAC == nil || target.MAC.String() == client.MAC.String()) {
+		target.UUID = client.UUID
+	}
+
+	host := c.Hosts().Match(target.MAC, target.UUID, target.IP)
+	if host == nil && specific {
+		return nil, ErrNotFound
+	}
+
+	menu := c.bootMenu(host, c.clientBaseURL(clientIP))
+
+	if host != nil {
+		c.logger.Debug("serving host-specific bootloader config",
+			"host", host.Name,
+			"profile", host.Profile,
+			"distro", host.Distro,
+			"entries", len(menu.Entries),
+		)
+	}
+
+	buff := &bytes.Buffer{}
+	if err := bl.Config(buff, target, menu); err != nil {
+		return nil, fmt.Errorf("failed to generate bootloader config: %w", err)
+	}
+
+	event := audit.Event{Type: audit.EventConfig, Detail: requestPath}
+	event.SetClient(target.MAC, target.UUID, clientIP)
+	if host != nil {
+		event.Host = host.Name
+	}
+
+	c.events.Record(event)
+
+	if host != nil {
+		completed, err := c.oneshot.Complete(host.Name, oneshot.UntilFirstBoot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to complete one-shot assignment: %w", err)
+		}
+
+		if completed {
+			c.logger.Info("host booted into installer once, switching to local boot",
+				"host", host.Name,
+			)
+		}
+	}
+
+	return bootloader.NewBytesFile(buff.Bytes()), nil
+}
+
+// Preview generates the bootloader config that the named host would be served by the
+// bootloader whose default config is at configPath, or by the first bootloader if
+// configPath is empty. Unlike configs served to clients, previews don't complete
+// one-shot assignments.
+func (c *Catalog) Preview(hostName string, configPath string) ([]byte, error) {
+	host, ok := c.Hosts().Get(hostName)
+	if !ok {
+		return nil, fmt.Errorf("host '%s': %w", hostName, ErrNotFound)
+	}
+
+	var bl bootloader.Bootloader
+	for _, candidate := range c.bootloaders {
+		if configPath == "" || candidate.ConfigPath() == configPath {
+			bl = candidate
+			break
+		}
+	}
+
+	if bl == nil {
+		return nil, fmt.Errorf("bootloader config '%s': %w", configPath, ErrNotFound)
+	}
+
+	target := &bootloader.ConfigTarget{MAC: host.MAC(), UUID: host.UUID()}
+
+	buff := &bytes.Buffer{}
+	if err := bl.Config(buff, target, c.bootMenu(host, c.baseURL)); err != nil {
+		return nil, fmt.Errorf("failed to generate bootloader config: %w", err)
+	}
+
+	return buff.Bytes(), nil
+}
+
+// bootMenu returns the boot menu for the given host, or for all distros if host is nil,
+// referring to the HTTP server at baseURL
+func (c *Catalog) bootMenu(host *hosts.Host, baseURL string) *bootloader.Menu {
+	menu := &bootloader.Menu{
+		Timeout: c.menu.Timeout,
+		Hidden:  c.menu.Hidden,
+		Default: c.menu.Default,
+		Entries: c.entries(host, baseURL),
+	}
+
+	if host != nil && host.MenuDefault != "" {
+		menu.Default = host.MenuDefault
+	} else if host == nil && c.menu.LocalBootDefault {
+		menu.Default = localBootTitle
+	}
+
+	return menu
+}
+
+// entryTitle returns the title of the distro's menu entries, which names the arch unless
+// the bootloader picks the client's arch itself
+func (c *Catalog) entryTitle(d *distro.Distro) string {
+	if c.menu.DetectArch {
+		return d.Name()
+	}
+
+	return d.Name() + " (" + d.Arch() + ")"
+}
+
+// submenu returns the title of the submenu that the distro's entries are shown in, if
+// any
+func (c *Catalog) submenu(d *distro.Distro) string {
+	switch c.menu.Submenus {
+	case bootloader.SubmenusFamily:
+		return d.Family()
+	case bootloader.SubmenusArch:
+		return d.Arch()
+	default:
+		return ""
+	}
+}
+
+// entries returns the menu entries for the given host, or for all distros if host is nil
+func (c *Catalog) entries(host *hosts.Host, baseURL string) []*bootloader.MenuEntry {
+	entries := []*bootloader.MenuEntry{}
+	localBoot := &bootloader.MenuEntry{
+		Title:     localBootTitle,
+		LocalBoot: true,
+	}
+
+	// A one-shot install overrides the boot order: the installer is the only choice
+	// until the install completes, and local disk afterwards
+	pending := false
+	if host != nil {
+		if assignment, ok := c.oneshot.Get(host.Name); ok {
+			if !assignment.Pending() {
+				return []*bootloader.MenuEntry{localBoot}
+			}
+
+			pending = true
+		}
+	}
+
+	hostDistro := c.bootDistro(host)
+
+	// The first entry is the default
+	localBootFirst := host != nil && host.LocalBootFirst && !pending
+	if localBootFirst {
+		entries = append(entries, localBoot)
+	}
+
+	kernelArgs := c.currentKernelArgs()
+
+	for _, d := range c.Distros() {
+		if host != nil && (hostDistro == "" || d.Name() != hostDistro) {
+			continue
+		}
+
+		distroPath := path.Join(distroDirectory, d.Name(), d.Arch())
+
+		// wimboot takes its own arguments, and fails on unknown ones, so Linux kernel
+		// arguments aren't added
+		if wimbootFiles, ok := d.WimbootFiles(); ok {
+			layers := [][]string{d.KernelArgs()}
+			if host != nil {
+				layers = append(layers, host.ArgLayers...)
+			}
+
+			namedFiles := make([]bootloader.NamedFile, 0, len(wimbootFiles))
+			for _, file := range wimbootFiles {
+				namedFiles = append(namedFiles, bootloader.NamedFile{
+					Name: path.Base(file),
+					Path: path.Join(distroPath, treeName, file),
+				})
+			}
+
+			entries = append(entries, &bootloader.MenuEntry{
+				Title:      c.entryTitle(d),
+				Kernel:     path.Join(distroPath, kernelName),
+				NamedFiles: namedFiles,
+				Args:       cmdline.Merge(layers...),
+				Modules:    d.GrubModules(),
+				Arch:       grubArch(d.Arch()),
+				Locked:     d.Locked(),
+				Submenu:    c.submenu(d),
+			})
+
+			continue
+		}
+
+		if d.Chainload() {
+			entries = append(entries, &bootloader.MenuEntry{
+				Title:     c.entryTitle(d),
+				Kernel:    path.Join(distroPath, kernelName),
+				Args:      d.LoadOptions(c.loaderPaths(d, baseURL), c.loaderArgs(d, host, baseURL)),
+				Modules:   d.GrubModules(),
+				Arch:      grubArch(d.Arch()),
+				Chainload: true,
+				Locked:    d.Locked(),
+				Submenu:   c.submenu(d),
+			})
+
+			continue
+		}
+
+		repoURL := ""
+		if d.HasTree() {
+			repoURL = TreeURL(baseURL, d)
+		}
+
+		automationURL := ""
+		if host != nil && host.Automation != "" {
+			automationURL = c.AutomationURL(baseURL, host)
+		}
+
+		// Layers are merged in order of increasing precedence
+		layers := [][]string{slices.Concat(d.InstallArgs(repoURL, automationURL), c.driverDiskArgs(d, baseURL)), kernelArgs, d.KernelArgs()}
+		if host != nil {
+			layers = append(layers, host.ArgLayers...)
+		}
+
+		// Hosts' initrd overlays are appended as the initrd is served, so their initrds
+		// can't be served by checksum
+		initrd := ""
+		if d.HasInitrd() {
+			initrd = hashedPath(d.InitrdChecksum(), distroPath, initrdName)
+			if host != nil && len(host.InitrdFiles) > 0 {
+				initrd = path.Join(distroPath, initrdName)
+			}
+		}
+
+		entries = append(entries, &bootloader.MenuEntry{
+			Title:   c.entryTitle(d),
+			Kernel:  hashedPath(d.KernelChecksum(), distroPath, kernelName),
+			Initrd:  initrd,
+			Args:    cmdline.Merge(layers...),
+			Modules: d.GrubModules(),
+			Arch:    grubArch(d.Arch()),
+			Locked:  d.Locked(),
+			Submenu: c.submenu(d),
+		})
+	}
+
+	// Otherwise, local disk is offered last, and is only the default if the menu says so
+	if !localBootFirst && (c.menu.LocalBoot || c.menu.LocalBootDefault) {
+		entries = append(entries, localBoot)
+	}
+
+	return entries
+}
+
+func (c *Catalog) openDistroFile(distroPath string, clientIP net.IP) (bootloader.File, error) {
+	parts := strings.SplitN(distroPath, "/", 4)
+	if len(parts) < 3 {
+		return nil, ErrNotFound
+	}
+
+	d := c.distro(parts[0], parts[1])
+	if d == nil {
+		return nil, ErrNotFound
+	}
+
+	if len(parts) == 3 && parts[2] == loaderConfigName {
+		return c.loaderConfig(d, clientIP)
+	}
+
+	var file storage.Object
+	var err error
+
+	switch {
+	case len(parts) == 3 && parts[2] == kernelName:
+		file, err = d.Kernel()
+	case len(parts) == 3 && parts[2] == initrdName:
+		file, err = d.Initrd()
+	case len(parts) == 4 && parts[2] == treeName:
+		file, err = d.OpenTreeFile(parts[3])
+	case len(parts) == 4 && parts[2] == driverDisksName:
+		file, err = d.OpenDriverDisk(parts[3])
+	default:
+		return nil, ErrNotFound
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if errors.Is(err, storage.ErrOutsideRoot) {
+		return nil, ErrAccessDenied
+	} else if errors.Is(err, distro.ErrChecksumMismatch) {
+		c.corrupted(d, clientIP, distroDirectory+"/"+distroPath, err)
+		return nil, err //nolint:wrapcheck
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open distro file: %w", err)
+	}
+
+	if len(parts) == 3 && parts[2] == initrdName {
+		if file, err = c.withHostOverlay(d, file, clientIP); err != nil {
+			return nil, err
+		}
+	}
+
+	// Installation tree files are too numerous to be worth recording
+	if len(parts) == 3 {
+		eventType := audit.EventKernel
+		if parts[2] == initrdName {
+			eventType = audit.EventInitrd
+		}
+
+		c.record(eventType, clientIP, distroDirectory+"/"+distroPath)
+	}
+
+	return file, nil
+}
+
+// openHashedFile opens a distro's kernel or initrd by its checksum, given a path of the
+// form '<checksum>/<file>'. Initrds are served without hosts' overlays, so that the
+// content always matches the checksum.
+func (c *Catalog) openHashedFile(hashPath string, clientIP net.IP) (bootloader.File, error) {
+	checksum, name, found := strings.Cut(hashPath, "/")
+	if !found || checksum == "" {
+		return nil, ErrNotFound
+	}
+
+	for _, d := range c.Distros() {
+		var file storage.Object
+		var err error
+		var eventType audit.EventType
+
+		switch {
+		case name == kernelName && d.KernelChecksum() == checksum:
+			file, err = d.Kernel()
+			eventType = audit.EventKernel
+		case name == initrdName && d.InitrdChecksum() == checksum:
+			file, err = d.Initrd()
+			eventType = audit.EventInitrd
+		default:
+			continue
+		}
+
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		} else if errors.Is(err, distro.ErrChecksumMismatch) {
+			c.corrupted(d, clientIP, hashDirectory+"/"+hashPath, err)
+			return nil, err //nolint:wrapcheck
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to open distro file: %w", err)
+		}
+
+		c.record(eventType, clientIP, hashDirectory+"/"+hashPath)
+
+		return file, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+// hashedPath returns the path at which a distro file with the given checksum is served
+// by checksum, or its path in the distro's directory if its checksum isn't known
+func hashedPath(checksum string, distroPath string, name string) string {
+	if checksum == "" {
+		return path.Join(distroPath, name)
+	}
+
+	return path.Join(hashDirectory, checksum, name)
+}
+
+// loaderPaths returns where the files of a distro booted by a chainloaded loader are
+// served, with URLs on the HTTP server at baseURL
+func (c *Catalog) loaderPaths(d *distro.Distro, baseURL string) *distro.LoaderPaths {
+	distroPath := path.Join(distroDirectory, d.Name(), d.Arch())
+	treePath := "/" + path.Join(distroPath, treeName)
+
+	configPath := "/" + path.Join(distroPath, loaderConfigName)
+	if fixedPath, ok := d.LoaderConfigPath(); ok {
+		configPath = "/" + fixedPath
+	}
+
+	return &distro.LoaderPaths{
+		TreePath:   treePath,
+		TreeURL:    baseURL + treePath + "/",
+		ConfigPath: configPath,
+		ConfigURL:  baseURL + configPath,
+	}
+}
+
+// loaderArgs returns the arguments that a distro's chainloaded loader boots with for the
+// given host, which may be nil. Loaders such as ESXi's take their own arguments, so
+// Linux kernel arguments aren't added.
+func (c *Catalog) loaderArgs(d *distro.Distro, host *hosts.Host, baseURL string) []string {
+	automationURL := ""
+	if host != nil && host.Automation != "" {
+		automationURL = c.AutomationURL(baseURL, host)
+	}
+
+	layers := [][]string{d.InstallArgs(c.loaderPaths(d, baseURL).TreeURL, automationURL), d.KernelArgs()}
+	if host != nil {
+		layers = append(layers, host.ArgLayers...)
+	}
+
+	return cmdline.Merge(layers...)
+}
+
+// bootDistro returns the name of the distro that the host boots: that of its pending
+// one-shot assignment, if the assignment names one, and otherwise its own
+func (c *Catalog) bootDistro(host *hosts.Host) string {
+	if host == nil {
+		return ""
+	}
+
+	if assignment, ok := c.oneshot.Get(host.Name); ok && assignment.Pending() && assignment.Distro != "" {
+		return assignment.Distro
+	}
+
+	return host.Distro
+}
+
+// loaderConfig generates the config read by the distro's chainloaded loader for the
+// client with the given IP address. Hosts assigned the distro boot with their own
+// arguments and automation file.
+func (c *Catalog) loaderConfig(d *distro.Distro, clientIP net.IP) (bootloader.File, error) {
+	client := c.clients.Lookup(clientIP)
+
+	host := c.Hosts().Match(client.MAC, client.UUID, clientIP)
+	if host != nil && c.bootDistro(host) != d.Name() {
+		host = nil
+	}
+
+	baseURL := c.clientBaseURL(clientIP)
+	paths := c.loaderPaths(d, baseURL)
+
+	buff := &bytes.Buffer{}
+
+	ok, err := d.LoaderConfig(buff, paths, c.loaderArgs(d, host, baseURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate loader config: %w", err)
+	}
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	c.record(audit.EventConfig, clientIP, strings.TrimPrefix(paths.ConfigPath, "/"))
+
+	return bootloader.NewBytesFile(buff.Bytes()), nil
+}
+
+// fixedLoaderConfigDistro returns the distro whose loader looks for its config at the
+// given path, if any. If the loaders of several distros look in the same place, the
+// distro assigned to the client's host is preferred, and otherwise the first.
+func (c *Catalog) fixedLoaderConfigDistro(requestPath string, clientIP net.IP) *distro.Distro {
+	var candidates []*distro.Distro
+	for _, d := range c.Distros() {
+		if configPath, ok := d.LoaderConfigPath(); ok && configPath == requestPath {
+			candidates = append(candidates, d)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	client := c.clients.Lookup(clientIP)
+	if host := c.Hosts().Match(client.MAC, client.UUID, clientIP); host != nil {
+		for _, d := range candidates {
+			if d.Name() == c.bootDistro(host) {
+				return d
+			}
+		}
+	}
+
+	return candidates[0]
+}
+
+// record adds an event about the client with the given IP address to the audit log,
+// identifying the client and its host as far as possible
+func (c *Catalog) record(eventType audit.EventType, clientIP net.IP, detail string) {
+	if c.events == nil {
+		return
+	}
+
+	client := c.clients.Lookup(clientIP)
+
+	event := audit.Event{Type: eventType, Detail: detail}
+	event.SetClient(client.MAC, client.UUID, clientIP)
+
+	if host := c.Hosts().Match(client.MAC, client.UUID, clientIP); host != nil {
+		event.Host = host.Name
+	}
+
+	c.events.Record(event)
+}
+
+// corrupted reports that a distro's kernel or initrd was refused to a client because it
+// failed verification
+func (c *Catalog) corrupted(d *distro.Distro, clientIP net.IP, requestPath string, err error) {
+	c.logger.Error("refusing to serve distro file that does not match its checksum; the distro will be downloaded again",
+		"distro", d.Name(),
+		"arch", d.Arch(),
+		"path", requestPath,
+		"client", clientIP,
+		"error", err,
+	)
+
+	c.record(audit.EventArtifactCorrupt, clientIP, requestPath)
+
+	c.mu.RLock()
+	onCorrupt := c.onCorrupt
+	c.mu.RUnlock()
+
+	if onCorrupt != nil {
+		onCorrupt()
+	}
+}
+
+func (c *Catalog) distro(name string, arch string) *distro.Distro {
+	for _, d := range c.Distros() {
+		if d.Name() == name && d.Arch() == arch {
+			return d
+		}
+	}
+
+	return nil
+}
+
+// driverDiskURLs returns the URLs of the distro's driver disks, given the base URL of
+// the HTTP server
+func driverDiskURLs(d *distro.Distro, baseURL string) []string {
+	distroPath := path.Join(distroDirectory, d.Name(), d.Arch(), driverDisksName)
+
+	urls := make([]string, 0, len(d.DriverDisks()))
+	for _, disk := range d.DriverDisks() {
+		urls = append(urls, baseURL+"/"+path.Join(distroPath, disk))
+	}
+
+	return urls
+}
+
+// driverDiskArgs returns the arguments that load the distro's driver disks in its
+// installer. Hosts can remove them with '-inst.dd'.
+func (c *Catalog) driverDiskArgs(d *distro.Distro, baseURL string) []string {
+	var args []string
+	for _, diskURL := range driverDiskURLs(d, baseURL) {
+		args = append(args, "inst.dd="+diskURL)
+	}
+
+	return args
+}
+
+// templateData returns the data that the host's templates are rendered with, where
+// baseURL is the HTTP server as reached by the host
+func (c *Catalog) templateData(host *hosts.Host, baseURL string) *autoinstall.Data {
+	data := autoinstall.NewData(host, baseURL, c.reportSigner(), c.templates)
+
+	// Every arch of a distro has the same driver disks, so the first is used
+	for _, d := range c.Distros() {
+		if d.Name() == c.bootDistro(host) {
+			data.DriverDisks = driverDiskURLs(d, strings.TrimSuffix(baseURL, "/"))
+			break
+		}
+	}
+
+	return data
+}
+
+// TreeURL returns the URL at which the distro's install tree is served, given the base
+// URL of the HTTP server
+func TreeURL(baseURL string, d *distro.Distro) string {
+	return baseURL + "/" + path.Join(distroDirectory, d.Name(), d.Arch(), treeName) + "/"
+}
+
+// AutomationURL returns the URL at which the host's install automation file is served,
+// given the base URL of the HTTP server. If URLs must be signed, the URL is signed anew
+// and expires after the signer's lifetime.
+func (c *Catalog) AutomationURL(baseURL string, host *hosts.Host) string {
+	automationURL := baseURL + strings.Replace(AutomationPath, "{name}", host.Name, 1)
+	if signer := c.urlSigner(); signer != nil {
+		automationURL += "/" + signer.Token(host.Name)
+	}
+
+	return automationURL
+}
+
+// Handler returns an HTTP handler serving the catalog, with the same layout as over TFTP.
+// Pre-compressed variants of files are served in their place to clients that accept
+// them, if the compressor (which may be nil) allows.
+func (c *Catalog) Handler(compressor *httpcompress.Compressor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var clientIP net.IP
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			clientIP = net.ParseIP(host)
+		}
+
+		file, encoding, err := c.openEncoded(r.URL.Path, clientIP, compressor.Precompressed(r))
+		if errors.Is(err, ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		} else if errors.Is(err, ErrAccessDenied) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		} else if err != nil {
+			c.logger.Error("failed to open file for HTTP request",
+				"path", r.URL.Path,
+				"error", err,
+			)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		// Files served by checksum are tagged with it, so that clients resuming a transfer
+		// with If-Range get the rest of the same file
+		if hashPath, ok := strings.CutPrefix(strings.TrimPrefix(r.URL.Path, "/"), hashDirectory+"/"); ok {
+			checksum, _, _ := strings.Cut(hashPath, "/")
+			w.Header().Set("Cache-Control", immutableCacheControl)
+			w.Header().Set("ETag", `"`+checksum+`"`)
+		}
+
+		if encoding != "" {
+			httpcompress.SetEncoding(w.Header(), r.URL.Path, encoding)
+		} else if compressor.Varies() {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+
+		serveFile(w, r, file)
+	})
+}
+
+// openEncoded opens the first pre-compressed variant of a file (e.g. 'initrd.img.zst')
+// that exists in one of the given encodings, returning its encoding, or else the file
+// itself
+func (c *Catalog) openEncoded(requestPath string, clientIP net.IP, encodings []string) (bootloader.File, string, error) {
+	for _, encoding := range encodings {
+		file, err := c.Open(requestPath+httpcompress.Extension(encoding), clientIP)
+		if err == nil {
+			return file, encoding, nil
+		} else if !errors.Is(err, ErrNotFound) {
+			return nil, "", err
+		}
+	}
+
+	file, err := c.Open(requestPath, clientIP)
+
+	return file, "", err
+}
+
+// AutomationHandler returns an HTTP handler serving hosts' install automation files,
+// rendered from their templates, at [AutomationPath] and [SignedAutomationPath]. If URLs
+// must be signed, files are only served at signed URLs that haven't expired. baseURL
+// returns the URL at which the host reached the HTTP server.
+func (c *Catalog) AutomationHandler(baseURL func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, ok := c.Hosts().Get(r.PathValue("name"))
+		if !ok || host.Automation == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if signer := c.urlSigner(); signer != nil {
+			if err := signer.Verify(host.Name, r.PathValue("token")); err != nil {
+				c.logger.Warn("refusing automation file request without a valid signed URL",
+					"host", host.Name,
+					"client", r.RemoteAddr,
+					"error", err,
+				)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		buff := &bytes.Buffer{}
+		if err := autoinstall.Render(buff, host.Automation, c.templateData(host, baseURL(r))); err != nil {
+			c.logger.Error("failed to render automation file",
+				"host", host.Name,
+				"error", err,
+			)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		c.logger.Info("serving automation file to host",
+			"host", host.Name,
+			"client", r.RemoteAddr,
+		)
+
+		w.Header().Set("Content-Type", autoinstall.ContentType(host.Automation))
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = buff.WriteTo(w)
+	})
+}
+
+func grubArch(arch string) string {
+	if grubArch, ok := grubArches[arch]; ok {
+		return grubArch
+	}
+
+	return arch
+}
@@ -0,0 +1,143 @@
+package catalog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/autoinstall"
+	"github.com/davejbax/pixie/internal/bootloader"
+	"github.com/davejbax/pixie/internal/storage"
+)
+
+// Export calls fn with each file in the catalog, as it's served to a client that pixie
+// knows nothing about, so that other TFTP and HTTP servers can serve a copy of the tree.
+// Paths are passed in order, without a leading slash.
+//
+// Configs are also exported at the paths where hosts matched by MAC address look for
+// their own, and hosts' automation files at their HTTP paths. Hosts matched only by UUID
+// or IP address boot with the generic config, as they can't be told apart by path.
+// Exporting a host's config completes its one-shot assignment, as serving it does, so
+// catalogs that are exported should have no one-shot store.
+func (c *Catalog) Export(fn func(requestPath string, file bootloader.File) error) error {
+	paths, err := c.exportPaths()
+	if err != nil {
+		return err
+	}
+
+	for _, requestPath := range paths {
+		file, err := c.Open(requestPath, nil)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to open '%s': %w", requestPath, err)
+		}
+
+		err = fn(requestPath, file)
+		_ = file.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, host := range c.Hosts().Hosts() {
+		if host.Automation == "" {
+			continue
+		}
+
+		buff := &bytes.Buffer{}
+		if err := autoinstall.Render(buff, host.Automation, c.templateData(host, c.baseURL)); err != nil {
+			return fmt.Errorf("failed to render automation file of host '%s': %w", host.Name, err)
+		}
+
+		automationPath := strings.TrimPrefix(strings.Replace(AutomationPath, "{name}", host.Name, 1), "/")
+		if err := fn(automationPath, bootloader.NewBytesFile(buff.Bytes())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportPaths returns the paths that [Catalog.Export] opens. Some may not exist, such as
+// loader configs of distros whose loaders read none.
+func (c *Catalog) exportPaths() ([]string, error) {
+	paths := []string{}
+
+	for entrypointPath := range c.entrypoints {
+		paths = append(paths, entrypointPath)
+	}
+
+	for _, bl := range c.bootloaders {
+		auxiliaryPaths, err := bl.AuxiliaryPaths()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bootloader files: %w", err)
+		}
+
+		paths = append(paths, auxiliaryPaths...)
+		paths = append(paths, bl.ConfigPath())
+
+		for _, host := range c.Hosts().Hosts() {
+			if host.MAC() != nil {
+				paths = append(paths, bl.MACConfigPath(host.MAC()))
+			}
+		}
+	}
+
+	for _, d := range c.Distros() {
+		distroPath := path.Join(distroDirectory, d.Name(), d.Arch())
+
+		paths = append(paths,
+			path.Join(distroPath, kernelName),
+			path.Join(distroPath, loaderConfigName),
+		)
+
+		if d.HasInitrd() {
+			paths = append(paths, path.Join(distroPath, initrdName))
+		}
+
+		if d.KernelChecksum() != "" {
+			paths = append(paths, path.Join(hashDirectory, d.KernelChecksum(), kernelName))
+		}
+
+		if d.InitrdChecksum() != "" {
+			paths = append(paths, path.Join(hashDirectory, d.InitrdChecksum(), initrdName))
+		}
+
+		if configPath, ok := d.LoaderConfigPath(); ok {
+			paths = append(paths, configPath)
+		}
+
+		treeFiles, err := d.TreeFiles()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list installation tree of distro '%s': %w", d.Name(), err)
+		}
+
+		for _, name := range treeFiles {
+			paths = append(paths, path.Join(distroPath, treeName, name))
+		}
+
+		for _, name := range d.DriverDisks() {
+			paths = append(paths, path.Join(distroPath, driverDisksName, name))
+		}
+	}
+
+	for _, dir := range c.static {
+		names, err := storage.Files(dir.files, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list static files: %w", err)
+		}
+
+		for _, name := range names {
+			paths = append(paths, path.Join(dir.prefix, name))
+		}
+	}
+
+	slices.Sort(paths)
+
+	return slices.Compact(paths), nil
+}
@@ -0,0 +1,175 @@
+package catalog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"time"
+
+	"github.com/davejbax/pixie/internal/autoinstall"
+	"github.com/davejbax/pixie/internal/distro"
+	"github.com/davejbax/pixie/internal/hosts"
+	"github.com/davejbax/pixie/internal/initrd"
+	"github.com/davejbax/pixie/internal/storage"
+)
+
+var errSeekBeforeStart = errors.New("seek before start of file")
+
+// hostOverlay generates the archive of files appended to the host's initrd. The archive
+// is generated afresh for each request, so that changes to templates and variables
+// apply at once; the same files always produce the same archive, so that transfers
+// resumed with range requests see the same bytes. baseURL is the HTTP server as reached by
+// the host.
+func (c *Catalog) hostOverlay(host *hosts.Host, baseURL string) ([]byte, error) {
+	files := make([]initrd.File, 0, len(host.InitrdFiles))
+
+	for _, file := range host.InitrdFiles {
+		text := file.Content
+		if file.Source != "" {
+			data, err := os.ReadFile(file.Source)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read initrd file source: %w", err)
+			}
+
+			text = string(data)
+		}
+
+		buff := &bytes.Buffer{}
+		if err := autoinstall.RenderText(buff, file.Path, text, c.templateData(host, baseURL)); err != nil {
+			return nil, fmt.Errorf("failed to render initrd file '%s': %w", file.Path, err)
+		}
+
+		files = append(files, initrd.File{
+			Path:        file.Path,
+			Permissions: fs.FileMode(file.Permissions()),
+			Data:        buff.Bytes(),
+		})
+	}
+
+	buff := &bytes.Buffer{}
+	if err := initrd.Pack(buff, files); err != nil {
+		return nil, fmt.Errorf("failed to pack initrd files: %w", err)
+	}
+
+	return buff.Bytes(), nil
+}
+
+// withHostOverlay appends the overlay of the client's host to the distro's initrd, if
+// the host boots the distro and has files to add to it
+func (c *Catalog) withHostOverlay(d *distro.Distro, file storage.Object, clientIP net.IP) (storage.Object, error) {
+	client := c.clients.Lookup(clientIP)
+
+	host := c.Hosts().Match(client.MAC, client.UUID, clientIP)
+	if host == nil || len(host.InitrdFiles) == 0 || c.bootDistro(host) != d.Name() {
+		return file, nil
+	}
+
+	overlay, err := c.hostOverlay(host, c.clientBaseURL(clientIP))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	c.logger.Debug("appending host files to initrd",
+		"host", host.Name,
+		"distro", d.Name(),
+		"files", len(host.InitrdFiles),
+	)
+
+	return newAppendedFile(file, overlay), nil
+}
+
+// appendedFile is a stored file followed by extra data, such as an initrd followed by a
+// host's overlay
+type appendedFile struct {
+	base storage.Object
+	tail []byte
+
+	offset int64
+}
+
+// newAppendedFile appends the archive to the initrd, padded so that the archive starts
+// at a multiple of four bytes as the kernel requires. If the initrd is seekable, so is
+// the returned file.
+func newAppendedFile(base storage.Object, archive []byte) storage.Object {
+	padding := (4 - base.Size()%4) % 4
+	file := &appendedFile{
+		base: base,
+		tail: append(make([]byte, padding), archive...),
+	}
+
+	if _, ok := base.(io.Seeker); ok {
+		return &seekableAppendedFile{file}
+	}
+
+	return file
+}
+
+func (a *appendedFile) Size() int64 {
+	return a.base.Size() + int64(len(a.tail))
+}
+
+func (a *appendedFile) ModTime() time.Time {
+	return a.base.ModTime()
+}
+
+func (a *appendedFile) Read(p []byte) (int, error) {
+	if remaining := a.base.Size() - a.offset; remaining > 0 {
+		n, err := a.base.Read(p[:min(int64(len(p)), remaining)])
+		a.offset += int64(n)
+
+		if errors.Is(err, io.EOF) && a.offset < a.base.Size() {
+			return n, io.ErrUnexpectedEOF
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			return n, err //nolint:wrapcheck
+		}
+
+		return n, nil
+	}
+
+	tailOffset := a.offset - a.base.Size()
+	if tailOffset >= int64(len(a.tail)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, a.tail[tailOffset:])
+	a.offset += int64(n)
+
+	return n, nil
+}
+
+func (a *appendedFile) Close() error {
+	return a.base.Close() //nolint:wrapcheck
+}
+
+// seekableAppendedFile is an [appendedFile] whose stored file is seekable, so that HTTP
+// range requests can be served
+type seekableAppendedFile struct {
+	*appendedFile
+}
+
+func (s *seekableAppendedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.Size()
+	}
+
+	if offset < 0 {
+		return 0, errSeekBeforeStart
+	}
+
+	// Offsets in the tail leave the stored file at its end
+	if _, err := s.base.(io.Seeker).Seek(min(offset, s.base.Size()), io.SeekStart); err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	s.offset = offset
+
+	return offset, nil
+}
@@ -0,0 +1,128 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davejbax/pixie/internal/bootloader"
+)
+
+var (
+	errInvalidRange       = errors.New("invalid range")
+	errUnsatisfiableRange = errors.New("range not satisfiable")
+)
+
+// serveFile writes a file in response to an HTTP request. Seekable files, including
+// generated files held in memory, support range requests through [http.ServeContent].
+// Other files (such as objects streamed from S3) support requests for a single range,
+// which UEFI HTTP boot clients and GRUB use to resume transfers, by skipping up to its
+// start; requests for several ranges are answered with the whole file.
+func serveFile(w http.ResponseWriter, r *http.Request, file bootloader.File) {
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, seeker)
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	size := file.Size()
+	if size < 0 {
+		_, _ = io.Copy(w, file)
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	start, length, err := requestedRange(r, w.Header().Get("ETag"), size)
+	if errors.Is(err, errUnsatisfiableRange) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	if err != nil || length == size {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		_, _ = io.Copy(w, file)
+		return
+	}
+
+	if _, err := io.CopyN(io.Discard, file, start); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+
+	_, _ = io.CopyN(w, file, length)
+}
+
+// requestedRange returns the start and length of the single range requested of a file
+// of the given size, or the whole file if no range is requested. Ranges are ignored if
+// the request's If-Range precondition doesn't match the file's ETag (which is never the
+// case if it has none), and [errInvalidRange] is returned if the header can't be
+// parsed or requests several ranges.
+func requestedRange(r *http.Request, etag string, size int64) (int64, int64, error) {
+	header := r.Header.Get("Range")
+	if header == "" {
+		return 0, size, nil
+	}
+
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && (etag == "" || ifRange != etag) {
+		return 0, size, nil
+	}
+
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, errInvalidRange
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errInvalidRange
+	}
+
+	// A suffix range, such as '-500', requests the last bytes of the file
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, errInvalidRange
+		}
+
+		if suffix == 0 {
+			return 0, 0, errUnsatisfiableRange
+		}
+
+		suffix = min(suffix, size)
+
+		return size - suffix, suffix, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errInvalidRange
+	}
+
+	if start >= size {
+		return 0, 0, errUnsatisfiableRange
+	}
+
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, errInvalidRange
+		}
+
+		end = min(end, size-1)
+	}
+
+	return start, end - start + 1, nil
+}
@@ -0,0 +1,79 @@
+package catalog
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/bootloader"
+	"github.com/davejbax/pixie/internal/storage"
+)
+
+// StaticDir is a directory of extra files served over TFTP and HTTP, such as iPXE
+// scripts or firmware blobs
+type StaticDir struct {
+	// Directory on disk
+	Path string
+
+	// Path that the directory's files are served under, e.g. 'firmware'. Files are
+	// served at the root if empty.
+	Prefix string
+
+	// Whether the directory's files take precedence over generated files at the same
+	// paths, such as bootloader configs and entrypoints. Otherwise, files are only
+	// served at paths that nothing else is served at.
+	Override bool
+}
+
+// staticDir is a static directory ready to serve files from
+type staticDir struct {
+	prefix   string
+	files    *storage.Local
+	override bool
+}
+
+func newStaticDirs(configs []StaticDir) []*staticDir {
+	dirs := make([]*staticDir, 0, len(configs))
+	for _, config := range configs {
+		dirs = append(dirs, &staticDir{
+			prefix:   strings.Trim(path.Clean("/"+config.Prefix), "/"),
+			files:    storage.NewLocal(config.Path),
+			override: config.Override,
+		})
+	}
+
+	return dirs
+}
+
+// openStaticFile opens the file at the request path from the first static directory
+// that has it, of those that do or don't override generated files. It returns false if
+// none does.
+func (c *Catalog) openStaticFile(requestPath string, override bool) (bootloader.File, bool, error) {
+	for _, dir := range c.static {
+		if dir.override != override {
+			continue
+		}
+
+		name := requestPath
+		if dir.prefix != "" {
+			var found bool
+			if name, found = strings.CutPrefix(requestPath, dir.prefix+"/"); !found {
+				continue
+			}
+		}
+
+		file, err := dir.files.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if errors.Is(err, storage.ErrOutsideRoot) {
+			return nil, false, ErrAccessDenied
+		} else if err != nil {
+			return nil, false, err //nolint:wrapcheck
+		}
+
+		return file, true, nil
+	}
+
+	return nil, false, nil
+}
@@ -0,0 +1,294 @@
+// Package clients tracks the identity of network boot clients across protocols, so that
+// services which only see a client's IP address (such as TFTP) can find its MAC address
+// and SMBIOS UUID, as seen by DHCP
+package clients
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davejbax/pixie/internal/store"
+)
+
+var (
+	errInvalidUUID      = errors.New("invalid UUID")
+	errInvalidMACPrefix = errors.New("MAC prefix must be whole octets of two hex digits, separated by ':' or '-'")
+)
+
+// Hardware addresses are at most 20 octets long, for IP over InfiniBand
+const maxMACLength = 20
+
+// Linux ARP table, used to find the MAC address of clients that we've only seen by IP
+const arpTablePath = "/proc/net/arp"
+
+// Client is what is known about a network boot client
+type Client struct {
+	IP  net.IP
+	MAC net.HardwareAddr
+
+	// SMBIOS system UUID, if the client sent one in DHCP option 97
+	UUID string
+
+	// When DHCP last saw the client. Zero for clients only found in the ARP table.
+	LastSeen time.Time
+}
+
+// Registry records clients seen by DHCP
+type Registry struct {
+	logger *slog.Logger
+
+	// State database that clients are persisted to, if any, so that their identities
+	// and when they were last seen survive restarts
+	db *store.DB
+
+	mu    sync.Mutex
+	byIP  map[string]*Client
+	byMAC map[string]*Client
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		byIP:  make(map[string]*Client),
+		byMAC: make(map[string]*Client),
+	}
+}
+
+// OpenRegistry creates a registry of the clients in the state database, which records
+// clients to the database as they are seen
+func OpenRegistry(logger *slog.Logger, db *store.DB) (*Registry, error) {
+	stored, err := db.Clients()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load clients: %w", err)
+	}
+
+	r := NewRegistry()
+	r.logger = logger
+	r.db = db
+
+	for _, client := range stored {
+		mac, err := net.ParseMAC(client.MAC)
+		if err != nil {
+			continue
+		}
+
+		known := &Client{
+			MAC:      mac,
+			UUID:     client.UUID,
+			LastSeen: client.LastSeen,
+		}
+
+		r.byMAC[mac.String()] = known
+
+		if ip := net.ParseIP(client.IP); ip != nil {
+			known.IP = ip
+			r.byIP[ip.String()] = known
+		}
+	}
+
+	return r, nil
+}
+
+// Get returns the client with the given MAC address, if DHCP has seen it
+func (r *Registry) Get(mac net.HardwareAddr) (Client, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, ok := r.byMAC[mac.String()]
+	if !ok {
+		return Client{}, false
+	}
+
+	return *client, true
+}
+
+// Clients returns all clients seen by DHCP, sorted by MAC address
+func (r *Registry) Clients() []Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients := make([]Client, 0, len(r.byMAC))
+	for _, client := range r.byMAC {
+		clients = append(clients, *client)
+	}
+
+	slices.SortFunc(clients, func(a, b Client) int {
+		return bytes.Compare(a.MAC, b.MAC)
+	})
+
+	return clients
+}
+
+// Observe records a client. The IP address may be nil or unspecified if the client
+// doesn't have one yet.
+func (r *Registry) Observe(ip net.IP, mac net.HardwareAddr, uuid string) {
+	if r == nil || mac == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, ok := r.byMAC[mac.String()]
+	if !ok {
+		client = &Client{MAC: mac}
+		r.byMAC[mac.String()] = client
+	}
+
+	if uuid != "" {
+		client.UUID = uuid
+	}
+
+	if ip != nil && !ip.IsUnspecified() {
+		client.IP = ip
+		r.byIP[ip.String()] = client
+	}
+
+	client.LastSeen = time.Now().UTC()
+
+	if r.db != nil {
+		stored := &store.Client{
+			MAC:      client.MAC.String(),
+			UUID:     client.UUID,
+			LastSeen: client.LastSeen,
+		}
+
+		if client.IP != nil {
+			stored.IP = client.IP.String()
+		}
+
+		if err := r.db.PutClient(stored); err != nil {
+			r.logger.Warn("failed to record client",
+				"mac", client.MAC,
+				"error", err,
+			)
+		}
+	}
+}
+
+// Lookup returns what is known about the client with the given IP address. If DHCP
+// hasn't associated the IP with a client, its MAC address is looked up in the system
+// ARP table.
+func (r *Registry) Lookup(ip net.IP) *Client {
+	if r != nil {
+		r.mu.Lock()
+		client, ok := r.byIP[ip.String()]
+		r.mu.Unlock()
+
+		if ok {
+			return &Client{IP: ip, MAC: client.MAC, UUID: client.UUID, LastSeen: client.LastSeen}
+		}
+	}
+
+	mac, ok := LookupARP(ip)
+	if !ok {
+		return &Client{IP: ip}
+	}
+
+	client := &Client{IP: ip, MAC: mac}
+
+	if r != nil {
+		r.mu.Lock()
+		if known, ok := r.byMAC[mac.String()]; ok {
+			client.UUID = known.UUID
+			client.LastSeen = known.LastSeen
+		}
+		r.mu.Unlock()
+	}
+
+	return client
+}
+
+// LookupARP finds the MAC address of a neighbour in the Linux ARP table. On other
+// systems, or if the neighbour isn't in the table, false is returned.
+func LookupARP(ip net.IP) (net.HardwareAddr, bool) {
+	f, err := os.Open(arpTablePath)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	// Skip the header line
+	scanner.Scan()
+
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != ip.String() {
+			continue
+		}
+
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil {
+			return nil, false
+		}
+
+		return mac, true
+	}
+
+	return nil, false
+}
+
+// FormatUUID formats the 16 byte SMBIOS UUID sent in DHCP option 97 as dmidecode
+// displays it, i.e. with the first three fields little-endian, as SMBIOS 2.6 and later
+// store them
+func FormatUUID(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+
+	return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%x-%x",
+		b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6], b[8:10], b[10:16])
+}
+
+// ParseUUID parses a UUID as formatted by [FormatUUID], returning the 16 bytes sent in
+// DHCP option 97
+func ParseUUID(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		return nil, fmt.Errorf("'%s': %w", s, errInvalidUUID)
+	}
+
+	// The first three fields are little-endian
+	slices.Reverse(b[0:4])
+	slices.Reverse(b[4:6])
+	slices.Reverse(b[6:8])
+
+	return b, nil
+}
+
+// ParseMACPrefix parses the leading octets of a MAC address, e.g. an OUI such as
+// '00:1b:21', so that addresses can be matched against it octet by octet with
+// [bytes.HasPrefix]
+func ParseMACPrefix(s string) (net.HardwareAddr, error) {
+	octets := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ':' || r == '-'
+	})
+
+	if len(octets) == 0 || len(octets) > maxMACLength || len(octets) != strings.Count(s, ":")+strings.Count(s, "-")+1 {
+		return nil, fmt.Errorf("'%s': %w", s, errInvalidMACPrefix)
+	}
+
+	prefix := make(net.HardwareAddr, len(octets))
+	for i, octet := range octets {
+		b, err := hex.DecodeString(octet)
+		if err != nil || len(b) != 1 {
+			return nil, fmt.Errorf("'%s': %w", s, errInvalidMACPrefix)
+		}
+
+		prefix[i] = b[0]
+	}
+
+	return prefix, nil
+}
@@ -0,0 +1,63 @@
+// Package cmdline builds kernel command lines from layers of arguments, such as global,
+// per-distro, and per-host arguments
+package cmdline
+
+import "strings"
+
+// Merge merges layers of kernel arguments, with later layers taking precedence:
+//
+//   - An argument replaces all arguments with the same name from earlier layers, e.g.
+//     'console=ttyS1' in a later layer replaces 'console=tty0' in an earlier one.
+//     Arguments repeated within a single layer are all kept, since some (such as
+//     'console') are meaningful more than once.
+//   - An argument '-name' removes all arguments with that name from earlier layers.
+//
+// Arguments keep the order in which they were first given, except that replaced
+// arguments take the position of their replacement.
+func Merge(layers ...[]string) []string {
+	var merged []string
+
+	for _, layer := range layers {
+		// Names set by this layer, so that repeats within the layer aren't removed
+		replaced := make(map[string]struct{})
+
+		for _, arg := range layer {
+			if arg == "" {
+				continue
+			}
+
+			if removed, ok := strings.CutPrefix(arg, "-"); ok && removed != "" && !strings.HasPrefix(removed, "-") {
+				merged = without(merged, Name(removed))
+				continue
+			}
+
+			name := Name(arg)
+			if _, ok := replaced[name]; !ok {
+				merged = without(merged, name)
+				replaced[name] = struct{}{}
+			}
+
+			merged = append(merged, arg)
+		}
+	}
+
+	return merged
+}
+
+// Name returns the name of a kernel argument, i.e. the part before any '='. Dashes and
+// underscores are equivalent in kernel parameter names, so are normalised to '_'.
+func Name(arg string) string {
+	name, _, _ := strings.Cut(arg, "=")
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+func without(args []string, name string) []string {
+	kept := args[:0]
+	for _, arg := range args {
+		if Name(arg) != name {
+			kept = append(kept, arg)
+		}
+	}
+
+	return kept
+}
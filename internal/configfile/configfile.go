@@ -0,0 +1,387 @@
+// Package configfile reads pixie's config file along with the files that it includes,
+// so that large configs can be split up (e.g. distros in one file, hosts in another, and
+// site overrides last) and merged back into a single config
+package configfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/sops"
+	"github.com/davejbax/pixie/internal/starconfig"
+	"gopkg.in/yaml.v3"
+)
+
+// IncludeKey is the top-level key listing the files that a config file includes
+const IncludeKey = "include"
+
+// AgeKeyFileKey is the top-level key of the config file giving the file containing the
+// age key that encrypted config files and values are decrypted with
+const AgeKeyFileKey = "age_key_file"
+
+// Extensions of the files read from included directories
+var extensions = []string{".yaml", ".yml", ".json", starconfig.Extension}
+
+var (
+	errIncludeCycle     = errors.New("config file includes itself")
+	errDuplicateInclude = errors.New("config file is included more than once")
+	errInvalidInclude   = errors.New("'" + IncludeKey + "' must be a path or a list of paths")
+	errNotMap           = errors.New("config file must be a map")
+	errTypeMismatch     = errors.New("can't merge values of different types")
+)
+
+// Sources are the files and directories that a config was read from, which are watched
+// for changes while serving
+type Sources struct {
+	// Every file read, including the config file itself
+	Files []string
+
+	// Directories whose files are included (by directory, or by a glob), so that new
+	// files in them are picked up
+	Directories []string
+}
+
+// Contains returns whether a change to the given path affects the config: it's either
+// a file that was read, or a config file in an included directory
+func (s *Sources) Contains(path string) bool {
+	if s == nil {
+		return false
+	}
+
+	path = filepath.Clean(path)
+
+	return slices.Contains(s.Files, path) ||
+		(slices.Contains(s.Directories, filepath.Dir(path)) && slices.Contains(extensions, filepath.Ext(path)))
+}
+
+// WatchDirectories returns the directories to watch for changes to the sources. Files'
+// directories are watched rather than the files, so that changes are still seen after
+// editors replace a file by renaming over it.
+func (s *Sources) WatchDirectories() []string {
+	directories := slices.Clone(s.Directories)
+
+	for _, file := range s.Files {
+		if dir := filepath.Dir(file); !slices.Contains(directories, dir) {
+			directories = append(directories, dir)
+		}
+	}
+
+	return directories
+}
+
+// Load reads the config file at the given path, which may be YAML, JSON or Starlark,
+// and merges in the files that it includes.
+//
+// YAML and JSON files encrypted with SOPS using age keys are decrypted, as are values
+// in any file that are armored age files (e.g. the output of 'age -a'). The age key is
+// read from the file named by the config file's 'age_key_file' setting, which must not
+// itself be encrypted, or else from where SOPS reads it.
+//
+// The 'include' key lists paths relative to the including file, each of which is a file,
+// a glob, or a directory whose YAML, JSON and Starlark files are included in name order
+// (like a conf.d directory). Included files may include others in turn.
+//
+// The including file's own settings come first, and then each included file is merged
+// over them in order, so later files take precedence. Maps are merged key by key, lists
+// are concatenated (so that e.g. hosts can be spread across files), and other values are
+// replaced. Setting a key to null removes it.
+func Load(path string) (map[string]any, *Sources, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve config path '%s': %w", path, err)
+	}
+
+	l := &loader{sources: &Sources{}}
+
+	values, err := l.load(absolute)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return values, l.sources, nil
+}
+
+type loader struct {
+	sources *Sources
+
+	// Decrypts encrypted files and values, with the key named by the config file
+	decrypter *sops.Decrypter
+
+	// Files being loaded, from the config file down to the current include
+	stack []string
+}
+
+func (l *loader) load(path string) (map[string]any, error) {
+	if slices.Contains(l.stack, path) {
+		return nil, fmt.Errorf("'%s': %w", path, errIncludeCycle)
+	}
+
+	if slices.Contains(l.sources.Files, path) {
+		return nil, fmt.Errorf("'%s': %w", path, errDuplicateInclude)
+	}
+
+	l.sources.Files = append(l.sources.Files, path)
+
+	l.stack = append(l.stack, path)
+	defer func() {
+		l.stack = l.stack[:len(l.stack)-1]
+	}()
+
+	values, err := l.read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	includes, err := includePaths(values[IncludeKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid includes in '%s': %w", path, err)
+	}
+
+	delete(values, IncludeKey)
+
+	for _, include := range includes {
+		files, err := l.resolve(filepath.Dir(path), include)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve include '%s' in '%s': %w", include, path, err)
+		}
+
+		for _, file := range files {
+			included, err := l.load(file)
+			if err != nil {
+				return nil, err
+			}
+
+			if values, err = merge(values, included, ""); err != nil {
+				return nil, fmt.Errorf("failed to merge '%s' into '%s': %w", file, path, err)
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// resolve returns the files that an include refers to, recording included directories
+func (l *loader) resolve(directory string, include string) ([]string, error) {
+	if !filepath.IsAbs(include) {
+		include = filepath.Join(directory, include)
+	}
+
+	// A glob may match nothing, e.g. an empty conf.d directory
+	if strings.ContainsAny(include, "*?[") {
+		if info, err := os.Stat(filepath.Dir(include)); err == nil && info.IsDir() {
+			l.watch(filepath.Dir(include))
+		}
+
+		matches, err := filepath.Glob(include)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob: %w", err)
+		}
+
+		return matches, nil
+	}
+
+	info, err := os.Stat(include)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	if !info.IsDir() {
+		return []string{include}, nil
+	}
+
+	l.watch(include)
+
+	entries, err := os.ReadDir(include)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	files := []string{}
+
+	// Entries are sorted by name
+	for _, entry := range entries {
+		if !entry.IsDir() && slices.Contains(extensions, filepath.Ext(entry.Name())) {
+			files = append(files, filepath.Join(include, entry.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+func (l *loader) watch(directory string) {
+	if !slices.Contains(l.sources.Directories, directory) {
+		l.sources.Directories = append(l.sources.Directories, directory)
+	}
+}
+
+// read reads and decrypts a single config file. As JSON is a subset of YAML, both are
+// decoded as YAML.
+func (l *loader) read(path string) (map[string]any, error) {
+	values, err := l.decode(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := l.decrypter.DecryptValues(values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt config from '%s': %w", path, err)
+	}
+
+	return decrypted.(map[string]any), nil //nolint:forcetypeassert
+}
+
+func (l *loader) decode(path string) (map[string]any, error) {
+	if starconfig.IsStarlark(path) {
+		values, err := starconfig.Load(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config from '%s': %w", path, err)
+		}
+
+		l.setKeyFile(values)
+
+		return values, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config from '%s': %w", path, err)
+	}
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("failed to read config from '%s': %w", path, err)
+	}
+
+	// An empty file has no settings
+	if doc.Kind == 0 {
+		l.setKeyFile(nil)
+		return map[string]any{}, nil
+	}
+
+	// The key file can't be read from a file that needs the key to decrypt
+	if l.decrypter == nil && !sops.Encrypted(doc) {
+		var plain map[string]any
+		if err := doc.Decode(&plain); err == nil {
+			l.setKeyFile(plain)
+		}
+	}
+
+	l.setKeyFile(nil)
+
+	if err := l.decrypter.DecryptDocument(doc); err != nil {
+		return nil, fmt.Errorf("failed to decrypt config from '%s': %w", path, err)
+	}
+
+	var values any
+	if err := doc.Decode(&values); err != nil {
+		return nil, fmt.Errorf("failed to read config from '%s': %w", path, err)
+	}
+
+	if values == nil {
+		return map[string]any{}, nil
+	}
+
+	valuesMap, ok := values.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("'%s': %w", path, errNotMap)
+	}
+
+	return valuesMap, nil
+}
+
+// setKeyFile creates the decrypter, if it hasn't been already, with the age key file
+// named in the given values of the config file
+func (l *loader) setKeyFile(values map[string]any) {
+	if l.decrypter != nil {
+		return
+	}
+
+	keyFile, _ := values[AgeKeyFileKey].(string)
+	l.decrypter = sops.NewDecrypter(keyFile)
+}
+
+func includePaths(value any) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []any:
+		paths := make([]string, 0, len(value))
+
+		for _, item := range value {
+			path, ok := item.(string)
+			if !ok {
+				return nil, errInvalidInclude
+			}
+
+			paths = append(paths, path)
+		}
+
+		return paths, nil
+	default:
+		return nil, errInvalidInclude
+	}
+}
+
+// merge merges src over dst, as described by [Load]. Keys are compared case-insensitively,
+// as viper does when decoding the config.
+func merge(dst map[string]any, src map[string]any, prefix string) (map[string]any, error) {
+	merged := make(map[string]any, len(dst)+len(src))
+	for key, value := range dst {
+		merged[strings.ToLower(key)] = value
+	}
+
+	for key, value := range src {
+		key = strings.ToLower(key)
+		path := strings.TrimPrefix(prefix+"."+key, ".")
+
+		existing, ok := merged[key]
+
+		switch {
+		case value == nil:
+			delete(merged, key)
+		case !ok || existing == nil:
+			merged[key] = value
+		default:
+			mergedValue, err := mergeValue(existing, value, path)
+			if err != nil {
+				return nil, err
+			}
+
+			merged[key] = mergedValue
+		}
+	}
+
+	return merged, nil
+}
+
+func mergeValue(dst any, src any, path string) (any, error) {
+	switch dst := dst.(type) {
+	case map[string]any:
+		srcMap, ok := src.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("'%s' is a map, but is set to %T: %w", path, src, errTypeMismatch)
+		}
+
+		return merge(dst, srcMap, path)
+	case []any:
+		srcList, ok := src.([]any)
+		if !ok {
+			return nil, fmt.Errorf("'%s' is a list, but is set to %T: %w", path, src, errTypeMismatch)
+		}
+
+		return slices.Concat(dst, srcList), nil
+	default:
+		switch src.(type) {
+		case map[string]any, []any:
+			return nil, fmt.Errorf("'%s' is %T, but is set to %T: %w", path, dst, src, errTypeMismatch)
+		}
+
+		return src, nil
+	}
+}
@@ -0,0 +1,148 @@
+// Package configschema generates JSON Schemas for config structs, following the rules
+// that viper uses to decode config into them: keys are the lower-cased field names
+// unless a 'mapstructure' tag names them, and defaults come from 'default' tags
+package configschema
+
+import (
+	"encoding"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Draft is the JSON Schema dialect of generated schemas
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is a JSON Schema
+type Schema struct {
+	Schema string `json:"$schema,omitempty"`
+	Title  string `json:"title,omitempty"`
+
+	// Either a type name, or a list of them
+	Type any `json:"type,omitempty"`
+
+	Properties map[string]*Schema `json:"properties,omitempty"`
+
+	// Either a bool, or the schema of values in objects with arbitrary keys
+	AdditionalProperties any `json:"additionalProperties,omitempty"`
+
+	Items   *Schema `json:"items,omitempty"`
+	Pattern string  `json:"pattern,omitempty"`
+	Default any     `json:"default,omitempty"`
+}
+
+// Durations are given as Go duration strings (e.g. '1h30m'), or as nanoseconds
+const durationPattern = `^(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+
+var (
+	durationType        = reflect.TypeFor[time.Duration]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// Generate returns the schema of the given config, which must be a struct or a pointer
+// to one. Objects in the schema don't allow unknown keys, matching strict decoding.
+func Generate(config any, title string) *Schema {
+	schema := generate(reflect.TypeOf(config))
+	schema.Schema = Draft
+	schema.Title = title
+
+	return schema
+}
+
+func generate(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == durationType {
+		return &Schema{Type: []string{"string", "integer"}, Pattern: durationPattern}
+	}
+
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return &Schema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: generate(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: generate(t.Elem())}
+	case reflect.Struct:
+		schema := &Schema{
+			Type:                 "object",
+			Properties:           make(map[string]*Schema),
+			AdditionalProperties: false,
+		}
+		addFields(schema, t)
+
+		return schema
+	default:
+		// Interfaces and anything else may hold any value
+		return &Schema{}
+	}
+}
+
+// addFields adds the fields of the struct type t to the object schema
+func addFields(schema *Schema, t reflect.Type) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if name == "-" {
+			continue
+		}
+
+		switch {
+		case strings.Contains(options, "squash"):
+			addFields(schema, field.Type)
+			continue
+		case strings.Contains(options, "remain"):
+			schema.AdditionalProperties = true
+			continue
+		}
+
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		property := generate(field.Type)
+		if value, ok := field.Tag.Lookup("default"); ok {
+			property.Default = parseDefault(value, property)
+		}
+
+		schema.Properties[name] = property
+	}
+}
+
+// parseDefault converts a 'default' tag to a value of the property's type
+func parseDefault(value string, property *Schema) any {
+	switch property.Type {
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	case "integer":
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	case "number":
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return n
+		}
+	}
+
+	return value
+}
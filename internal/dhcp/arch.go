@@ -0,0 +1,104 @@
+package dhcp
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/davejbax/pixie/internal/clients"
+	"github.com/davejbax/pixie/pkg/efipe"
+)
+
+// ClientArch is a client system architecture type, as sent in DHCP option 93 and
+// registered by IANA ("Processor Architecture Types")
+type ClientArch uint16
+
+const (
+	ClientArchBIOS         ClientArch = 0
+	ClientArchEFIIA32      ClientArch = 6
+	ClientArchEFIBC        ClientArch = 7
+	ClientArchEFIX64       ClientArch = 9
+	ClientArchEFIARM32     ClientArch = 10
+	ClientArchEFIARM64     ClientArch = 11
+	ClientArchEFIX86HTTP   ClientArch = 15
+	ClientArchEFIX64HTTP   ClientArch = 16
+	ClientArchEFIARM32HTTP ClientArch = 18
+	ClientArchEFIARM64HTTP ClientArch = 19
+	ClientArchUnknown      ClientArch = 0xffff
+	clientArchOptionLength            = 2
+)
+
+func (a ClientArch) String() string {
+	switch a {
+	case ClientArchBIOS:
+		return "bios"
+	case ClientArchEFIIA32, ClientArchEFIX86HTTP:
+		return "efi-ia32"
+	case ClientArchEFIBC, ClientArchEFIX64, ClientArchEFIX64HTTP:
+		return "efi-x64"
+	case ClientArchEFIARM32, ClientArchEFIARM32HTTP:
+		return "efi-arm32"
+	case ClientArchEFIARM64, ClientArchEFIARM64HTTP:
+		return "efi-arm64"
+	case ClientArchUnknown:
+		return "unknown"
+	default:
+		return fmt.Sprintf("arch-%d", uint16(a))
+	}
+}
+
+// IsHTTP returns whether the client is booting over HTTP rather than TFTP
+func (a ClientArch) IsHTTP() bool {
+	switch a {
+	case ClientArchEFIX86HTTP, ClientArchEFIX64HTTP, ClientArchEFIARM32HTTP, ClientArchEFIARM64HTTP:
+		return true
+	default:
+		return false
+	}
+}
+
+// Machine returns the PE machine type of EFI images that the client can boot. BIOS
+// and unknown clients have no machine type.
+func (a ClientArch) Machine() (efipe.Machine, bool) {
+	switch a {
+	case ClientArchEFIIA32, ClientArchEFIX86HTTP:
+		return pe.IMAGE_FILE_MACHINE_I386, true
+	// Type 7 is 'EFI BC', but is in practice sent by x64 firmware
+	case ClientArchEFIBC, ClientArchEFIX64, ClientArchEFIX64HTTP:
+		return pe.IMAGE_FILE_MACHINE_AMD64, true
+	case ClientArchEFIARM32, ClientArchEFIARM32HTTP:
+		return pe.IMAGE_FILE_MACHINE_ARM, true
+	case ClientArchEFIARM64, ClientArchEFIARM64HTTP:
+		return pe.IMAGE_FILE_MACHINE_ARM64, true
+	default:
+		return 0, false
+	}
+}
+
+// ClientArch returns the architecture type that the client reported in option 93. If
+// several are given, the first is used. If the option is absent, the client is assumed
+// to be a BIOS client, as required by RFC 4578.
+func (p *Packet) ClientArch() ClientArch {
+	value, ok := p.Options[OptionClientArchitecture]
+	if !ok {
+		return ClientArchBIOS
+	}
+
+	if len(value) < clientArchOptionLength {
+		return ClientArchUnknown
+	}
+
+	return ClientArch(binary.BigEndian.Uint16(value))
+}
+
+// ClientUUID returns the client's SMBIOS UUID from the client machine identifier option
+// (RFC 4578), or an empty string if it didn't send one
+func (p *Packet) ClientUUID() string {
+	// A type byte, which is always zero, followed by the UUID
+	uuid := p.Options[OptionClientUUID]
+	if len(uuid) != 17 || uuid[0] != 0 {
+		return ""
+	}
+
+	return clients.FormatUUID(uuid[1:])
+}
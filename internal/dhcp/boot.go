@@ -0,0 +1,155 @@
+package dhcp
+
+import (
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/audit"
+	"github.com/davejbax/pixie/internal/clients"
+	"github.com/davejbax/pixie/internal/quirks"
+	"github.com/davejbax/pixie/pkg/efipe"
+)
+
+// Vendor class identifier sent by PXE clients, followed by arch and UNDI details
+const pxeVendorClass = "PXEClient"
+
+// Vendor class identifier sent by UEFI HTTP boot clients, which must be echoed in offers
+const httpVendorClass = "HTTPClient"
+
+// Vendor-specific options telling PXE clients to skip boot server discovery and
+// download the boot file in the offer immediately (PXE spec, PXE_DISCOVERY_CONTROL = 8)
+var pxeVendorOptions = []byte{6, 1, 8, 255}
+
+// BootFiles chooses the boot files offered to PXE clients
+type BootFiles interface {
+	// BootFile returns the path of the boot file for a client of the machine type,
+	// identified by its MAC address, SMBIOS UUID (if sent) and IP address (if known)
+	BootFile(machine efipe.Machine, mac net.HardwareAddr, uuid string, ip net.IP) (string, bool)
+}
+
+// HTTPServer is the HTTP server that UEFI HTTP boot clients download their boot file
+// from, at the same address as the TFTP server
+type HTTPServer struct {
+	Port string
+
+	// Whether clients are referred to the server over HTTPS
+	TLS bool
+}
+
+// fileURL returns the URL of the file on the server, as reached at serverIP
+func (h *HTTPServer) fileURL(serverIP net.IP, file string) string {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(serverIP.String(), h.Port),
+		Path:   "/" + strings.TrimPrefix(file, "/"),
+	}
+
+	if h.TLS {
+		u.Scheme = "https"
+	}
+
+	return u.String()
+}
+
+// bootOptions selects a boot file for PXE clients according to their architecture and
+// quirks, and adds it to replies
+type bootOptions struct {
+	logger *slog.Logger
+
+	bootFiles    BootFiles
+	biosBootFile string
+	quirks       *quirks.Table
+	clients      *clients.Registry
+	events       *audit.Log
+
+	// Where HTTP boot clients are referred to, or nil if they aren't offered anything
+	http *HTTPServer
+}
+
+// apply adds PXE or HTTP boot options for the client that sent p to reply, with serverIP
+// as the TFTP and HTTP server, returning false if the client is neither or there is
+// nothing to offer it. The client's quirks are remembered against its MAC address, and its identity
+// against clientIP, if known.
+func (b *bootOptions) apply(p *Packet, reply *Packet, clientIP net.IP, serverIP net.IP) bool {
+	vendorClass := string(p.Options[OptionVendorClass])
+	if !strings.HasPrefix(vendorClass, pxeVendorClass) && !strings.HasPrefix(vendorClass, httpVendorClass) {
+		return false
+	}
+
+	b.clients.Observe(clientIP, p.CHAddr, p.ClientUUID())
+
+	arch := p.ClientArch()
+
+	clientQuirks, matched := b.quirks.Match(p.CHAddr, vendorClass, uint16(arch))
+	b.quirks.Remember(p.CHAddr, clientQuirks)
+
+	if clientQuirks.ForceBIOS {
+		arch = ClientArchBIOS
+	}
+
+	logger := b.logger.With(
+		"mac", p.CHAddr.String(),
+		"arch", arch.String(),
+	)
+
+	if len(matched) > 0 {
+		logger = logger.With("quirks", matched)
+	}
+
+	bootFile, ok := clientQuirks.BootFile, clientQuirks.BootFile != ""
+	if !ok {
+		bootFile, ok = b.bootFile(arch, p, clientIP)
+	}
+
+	if !ok {
+		logger.Debug("ignoring PXE client with no boot file for its architecture")
+		return false
+	}
+
+	if arch.IsHTTP() {
+		if b.http == nil {
+			logger.Debug("ignoring HTTP boot client, as HTTP isn't served")
+			return false
+		}
+
+		bootFile = b.http.fileURL(serverIP, bootFile)
+		reply.Options[OptionVendorClass] = []byte(httpVendorClass)
+	} else {
+		reply.SIAddr = serverIP
+		reply.Options[OptionVendorClass] = []byte(pxeVendorClass)
+		reply.Options[OptionVendorSpecific] = pxeVendorOptions
+		reply.Options[OptionTFTPServerName] = []byte(serverIP.String())
+	}
+
+	reply.File = bootFile
+	reply.Options[OptionBootFileName] = []byte(bootFile)
+
+	if uuid, ok := p.Options[OptionClientUUID]; ok {
+		reply.Options[OptionClientUUID] = uuid
+	}
+
+	logger.Info("offering boot file to PXE client",
+		"file", bootFile,
+	)
+
+	event := audit.Event{Type: audit.EventDHCPOffer, Detail: bootFile}
+	event.SetClient(p.CHAddr, p.ClientUUID(), clientIP)
+	b.events.Record(event)
+
+	return true
+}
+
+func (b *bootOptions) bootFile(arch ClientArch, p *Packet, clientIP net.IP) (string, bool) {
+	if arch == ClientArchBIOS {
+		return b.biosBootFile, b.biosBootFile != ""
+	}
+
+	machine, ok := arch.Machine()
+	if !ok {
+		return "", false
+	}
+
+	return b.bootFiles.BootFile(machine, p.CHAddr, p.ClientUUID(), clientIP)
+}
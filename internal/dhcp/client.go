@@ -0,0 +1,231 @@
+package dhcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davejbax/pixie/internal/clients"
+)
+
+// Network interface type and UNDI version sent by PXE clients in option 94 (PXE 2.1)
+var pxeClientNDI = []byte{1, 2, 1}
+
+var (
+	errNoOffer         = errors.New("no PXE offer received")
+	errUnknownArchName = errors.New("unknown client architecture")
+)
+
+// PXEClient is a simulated PXE client, which asks DHCP servers for a boot file as
+// firmware would, to test the serving path without real hardware
+type PXEClient struct {
+	MAC  net.HardwareAddr
+	Arch ClientArch
+
+	// SMBIOS UUID to send in option 97, if any, as formatted by [clients.FormatUUID]
+	UUID string
+}
+
+// ParseClientArch parses an architecture as named by [ClientArch.String] (e.g.
+// 'efi-x64'), or by its number
+func ParseClientArch(name string) (ClientArch, error) {
+	for _, arch := range []ClientArch{ClientArchBIOS, ClientArchEFIIA32, ClientArchEFIX64, ClientArchEFIARM32, ClientArchEFIARM64} {
+		if arch.String() == name {
+			return arch, nil
+		}
+	}
+
+	number, err := strconv.ParseUint(name, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("'%s': %w", name, errUnknownArchName)
+	}
+
+	return ClientArch(number), nil
+}
+
+// Discover broadcasts a DHCPDISCOVER from the client on the local network, and returns
+// the offers with PXE boot options received within the wait time. This listens on the
+// DHCP client port, so needs root (or CAP_NET_BIND_SERVICE), and nothing else may be
+// using the port.
+func (c *PXEClient) Discover(ctx context.Context, wait time.Duration) ([]*Packet, error) {
+	conn, err := net.ListenPacket("udp4", ":"+strconv.Itoa(clientPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on DHCP client port: %w", err)
+	}
+	defer conn.Close()
+
+	request, err := c.packet(MessageTypeDiscover)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without an address, the client can only receive broadcast replies
+	request.Flags |= flagBroadcast
+
+	return exchange(ctx, conn, request, &net.UDPAddr{IP: net.IPv4bcast, Port: serverPort}, MessageTypeOffer, wait)
+}
+
+// RequestBootServer sends a DHCPREQUEST for a boot file directly to a PXE boot server
+// (e.g. pixie's ProxyDHCP server on port 4011), as PXE clients do after a ProxyDHCP
+// offer, and returns its acknowledgement. Unlike [PXEClient.Discover], this works from
+// another network, and needs no privileges.
+func (c *PXEClient) RequestBootServer(ctx context.Context, server string, wait time.Duration) (*Packet, error) {
+	addr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve boot server '%s': %w", server, err)
+	}
+
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for boot server replies: %w", err)
+	}
+	defer conn.Close()
+
+	request, err := c.packet(MessageTypeRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := exchange(ctx, conn, request, addr, MessageTypeAck, wait)
+	if err != nil {
+		return nil, err
+	}
+
+	return replies[0], nil
+}
+
+// packet creates a request from the client, with the options that PXE firmware sends
+func (c *PXEClient) packet(messageType MessageType) (*Packet, error) {
+	var xid [4]byte
+	if _, err := rand.Read(xid[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate transaction ID: %w", err)
+	}
+
+	arch := make([]byte, clientArchOptionLength)
+	binary.BigEndian.PutUint16(arch, uint16(c.Arch))
+
+	p := &Packet{
+		Op:     opRequest,
+		XID:    binary.BigEndian.Uint32(xid[:]),
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: net.IPv4zero,
+		CHAddr: c.MAC,
+		Options: map[OptionCode][]byte{
+			OptionMessageType: {byte(messageType)},
+			OptionParameterRequest: {
+				byte(OptionSubnetMask), byte(OptionRouter), byte(OptionDomainNameServer),
+				byte(OptionVendorSpecific), byte(OptionVendorClass), byte(OptionTFTPServerName),
+				byte(OptionBootFileName), byte(OptionClientArchitecture), byte(OptionClientNDI),
+				byte(OptionClientUUID),
+			},
+			OptionVendorClass:        []byte(fmt.Sprintf("%s:Arch:%05d:UNDI:002001", pxeVendorClass, uint16(c.Arch))),
+			OptionClientArchitecture: arch,
+			OptionClientNDI:          pxeClientNDI,
+		},
+	}
+
+	if c.UUID != "" {
+		uuid, err := clients.ParseUUID(c.UUID)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		p.Options[OptionClientUUID] = append([]byte{0}, uuid...)
+	}
+
+	return p, nil
+}
+
+// exchange sends the request, and collects replies of the given type to it until the
+// wait time has passed (or, for unicast requests, until the first reply). Only replies
+// offering a boot file are returned.
+func exchange(ctx context.Context, conn net.PacketConn, request *Packet, dest net.Addr, replyType MessageType, wait time.Duration) ([]*Packet, error) {
+	if _, err := conn.WriteTo(request.Marshal(), dest); err != nil {
+		return nil, fmt.Errorf("failed to send DHCP request to '%s': %w", dest, err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+		return nil, fmt.Errorf("failed to set read deadline: %w", err)
+	}
+
+	// Cancelling the context stops waiting for replies early
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	broadcast := dest.(*net.UDPAddr).IP.Equal(net.IPv4bcast) //nolint:forcetypeassert
+	replies := []*Packet{}
+	buff := make([]byte, maxMessageSize)
+
+	for {
+		n, _, err := conn.ReadFrom(buff)
+		if isTimeout(err) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read DHCP reply: %w", err)
+		}
+
+		reply, err := ParseReply(buff[:n])
+		if err != nil || reply.XID != request.XID || reply.MessageType() != replyType || reply.BootFile() == "" {
+			continue
+		}
+
+		replies = append(replies, reply)
+
+		if !broadcast {
+			break
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	if len(replies) == 0 {
+		return nil, fmt.Errorf("from '%s' within %s: %w", dest, wait, errNoOffer)
+	}
+
+	return replies, nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// BootFile returns the boot file offered in a reply, from option 67 or else the 'file'
+// field
+func (p *Packet) BootFile() string {
+	if file := strings.TrimRight(string(p.Options[OptionBootFileName]), "\x00"); file != "" {
+		return file
+	}
+
+	return p.File
+}
+
+// BootServer returns the address of the TFTP server offered in a reply, from the
+// 'siaddr' field, or else option 66 or the server identifier
+func (p *Packet) BootServer() string {
+	if p.SIAddr != nil && !p.SIAddr.IsUnspecified() {
+		return p.SIAddr.String()
+	}
+
+	if server := strings.TrimRight(string(p.Options[OptionTFTPServerName]), "\x00"); server != "" {
+		return server
+	}
+
+	if id := p.Options[OptionServerIdentifier]; len(id) == net.IPv4len {
+		return net.IP(id).String()
+	}
+
+	return ""
+}
@@ -0,0 +1,96 @@
+package dhcp
+
+import (
+	"net"
+
+	"github.com/davejbax/pixie/internal/netif"
+	"golang.org/x/net/ipv4"
+)
+
+// conn reads DHCPv4 requests along with the index of the interface they arrived on, and
+// sends replies out of a given interface, so that broadcast replies reach clients on
+// servers with several interfaces. Where the platform doesn't support this, interface
+// indexes are 0, and replies are routed as usual.
+type conn struct {
+	net.PacketConn
+
+	control *ipv4.PacketConn
+}
+
+func newConn(packetConn net.PacketConn) *conn {
+	c := &conn{PacketConn: packetConn}
+
+	control := ipv4.NewPacketConn(packetConn)
+	if err := control.SetControlMessage(ipv4.FlagInterface, true); err == nil {
+		c.control = control
+	}
+
+	return c
+}
+
+// readFrom reads a packet, returning the index of the interface it arrived on, if known
+func (c *conn) readFrom(b []byte) (int, net.Addr, int, error) {
+	if c.control == nil {
+		n, addr, err := c.ReadFrom(b)
+		return n, addr, 0, err //nolint:wrapcheck
+	}
+
+	n, cm, addr, err := c.control.ReadFrom(b)
+
+	ifIndex := 0
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+
+	return n, addr, ifIndex, err //nolint:wrapcheck
+}
+
+// writeTo sends a packet out of the interface with the given index, or as routed if the
+// index is 0
+func (c *conn) writeTo(b []byte, addr net.Addr, ifIndex int) error {
+	if c.control == nil || ifIndex == 0 {
+		_, err := c.WriteTo(b, addr)
+		return err //nolint:wrapcheck
+	}
+
+	_, err := c.control.WriteTo(b, &ipv4.ControlMessage{IfIndex: ifIndex}, addr)
+
+	return err //nolint:wrapcheck
+}
+
+// serverAddress is the address advertised to clients as the DHCP and TFTP server
+type serverAddress struct {
+	// Configured address, or otherwise that of the bound interface or the first local
+	// interface
+	ip net.IP
+
+	// Addresses of each interface, if they're advertised on the interface that each
+	// request arrives on, or nil
+	interfaces *netif.Table
+}
+
+// newServerAddress returns the address advertised to clients: the configured IPv4
+// address, if any, or that of the bound interface, or otherwise that of the interface
+// that each request arrives on
+func newServerAddress(configured string, iface string, interfaces *netif.Table) (*serverAddress, error) {
+	ip, err := ServerIP(configured, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	address := &serverAddress{ip: ip}
+	if configured == "" && iface == "" {
+		address.interfaces = interfaces
+	}
+
+	return address, nil
+}
+
+// on returns the address advertised to clients on the interface with the given index
+func (a *serverAddress) on(ifIndex int) net.IP {
+	if ip, ok := a.interfaces.ServerIP(ifIndex); ok {
+		return ip
+	}
+
+	return a.ip
+}
@@ -0,0 +1,362 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/davejbax/pixie/internal/atomicfile"
+	"github.com/davejbax/pixie/internal/store"
+)
+
+var (
+	errPoolExhausted  = errors.New("no free addresses in pool")
+	errNoLeaseHistory = errors.New("lease history is only kept in the state database")
+)
+
+// Changes to leases, as recorded in the lease history
+const (
+	LeaseEventOffer   = "offer"
+	LeaseEventAck     = "ack"
+	LeaseEventRelease = "release"
+	LeaseEventDecline = "decline"
+)
+
+// Lease is an address allocated to a client
+type Lease struct {
+	IP  string `json:"ip"`
+	MAC string `json:"mac,omitempty"`
+
+	Hostname string    `json:"hostname,omitempty"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// LeaseEvent is a change to a lease
+type LeaseEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	Lease
+}
+
+// LeaseStore tracks dynamic leases, persisting them to a JSON file or the state database
+// so that they survive restarts. Static leases are not stored, as they are always taken
+// from config. The state database also keeps a history of lease changes.
+type LeaseStore struct {
+	path string
+	db   *store.DB
+
+	mu sync.Mutex
+
+	// Keyed by IP address. Leases with no MAC are addresses that a client declined
+	// because they were in use by another host.
+	leases map[string]*Lease
+}
+
+// OpenLeaseStore loads the lease store at the given path, creating an empty store if it
+// doesn't exist
+func OpenLeaseStore(path string) (*LeaseStore, error) {
+	store := &LeaseStore{
+		path:   path,
+		leases: make(map[string]*Lease),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read DHCP leases: %w", err)
+	}
+
+	var leases []*Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, fmt.Errorf("failed to decode DHCP leases: %w", err)
+	}
+
+	for _, lease := range leases {
+		store.leases[lease.IP] = lease
+	}
+
+	return store, nil
+}
+
+// OpenDBLeaseStore loads the lease store from the state database
+func OpenDBLeaseStore(db *store.DB) (*LeaseStore, error) {
+	stored, err := db.Leases()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load DHCP leases: %w", err)
+	}
+
+	s := &LeaseStore{
+		db:     db,
+		leases: make(map[string]*Lease, len(stored)),
+	}
+
+	for _, lease := range stored {
+		s.leases[lease.IP] = &Lease{
+			IP:       lease.IP,
+			MAC:      lease.MAC,
+			Hostname: lease.Hostname,
+			Expiry:   lease.Expiry,
+		}
+	}
+
+	return s, nil
+}
+
+// History returns changes to leases, newest first, optionally only those of the client
+// with the given MAC address. At most limit events are returned, or all of them if limit
+// is zero. History is only available from the state database.
+func (s *LeaseStore) History(mac net.HardwareAddr, limit int) ([]LeaseEvent, error) {
+	if s.db == nil {
+		return nil, errNoLeaseHistory
+	}
+
+	var macString string
+	if mac != nil {
+		macString = mac.String()
+	}
+
+	stored, err := s.db.LeaseHistory(macString, limit)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	events := make([]LeaseEvent, 0, len(stored))
+	for _, event := range stored {
+		events = append(events, LeaseEvent{
+			Time:  event.Time,
+			Event: event.Event,
+			Lease: Lease{
+				IP:       event.IP,
+				MAC:      event.MAC,
+				Hostname: event.Hostname,
+				Expiry:   event.Expiry,
+			},
+		})
+	}
+
+	return events, nil
+}
+
+// HasHistory returns whether the store keeps a history of lease changes
+func (s *LeaseStore) HasHistory() bool {
+	return s.db != nil
+}
+
+// Leases returns all leases in the store, including expired ones
+func (s *LeaseStore) Leases() []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	leases := make([]Lease, 0, len(s.leases))
+	for _, lease := range s.leases {
+		leases = append(leases, *lease)
+	}
+
+	return leases
+}
+
+// allocate finds an address for the client: its existing lease if it has one, the
+// requested address if it is free, or otherwise the first free address in the pool.
+// The address is held for the given duration.
+func (s *LeaseStore) allocate(mac net.HardwareAddr, requested net.IP, pool *pool, hold time.Duration) (net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	if lease := s.byMAC(mac); lease != nil {
+		if lease.Expiry.Before(now.Add(hold)) {
+			lease.Expiry = now.Add(hold)
+		}
+
+		return net.ParseIP(lease.IP).To4(), s.put(LeaseEventOffer, lease)
+	}
+
+	candidate := func(ip net.IP) bool {
+		if !pool.contains(ip) {
+			return false
+		}
+
+		lease, ok := s.leases[ip.String()]
+		return !ok || lease.Expiry.Before(now)
+	}
+
+	ip := requested.To4()
+	if ip == nil || !candidate(ip) {
+		ip = nil
+
+		// Written to avoid overflow if the pool ends at the top of the address space
+		for i := pool.start; ; i++ {
+			if next := uint32ToIP(i); candidate(next) {
+				ip = next
+				break
+			}
+
+			if i == pool.end {
+				break
+			}
+		}
+	}
+
+	if ip == nil {
+		return nil, errPoolExhausted
+	}
+
+	lease := &Lease{
+		IP:     ip.String(),
+		MAC:    mac.String(),
+		Expiry: now.Add(hold),
+	}
+
+	s.leases[lease.IP] = lease
+
+	return ip, s.put(LeaseEventOffer, lease)
+}
+
+// confirm extends the client's lease on the given address, returning false if the
+// address isn't leased to the client
+func (s *LeaseStore) confirm(mac net.HardwareAddr, ip net.IP, hostname string, duration time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lease, ok := s.leases[ip.String()]
+	if !ok || lease.MAC != mac.String() {
+		return false, nil
+	}
+
+	lease.Expiry = time.Now().Add(duration)
+	if hostname != "" {
+		lease.Hostname = hostname
+	}
+
+	return true, s.put(LeaseEventAck, lease)
+}
+
+// release removes the client's lease on the given address, if it has one
+func (s *LeaseStore) release(mac net.HardwareAddr, ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lease, ok := s.leases[ip.String()]
+	if !ok || lease.MAC != mac.String() {
+		return nil
+	}
+
+	delete(s.leases, ip.String())
+
+	if s.db != nil {
+		return s.db.DeleteLease(LeaseEventRelease, storedLease(lease)) //nolint:wrapcheck
+	}
+
+	return s.save()
+}
+
+// decline marks an address as unusable for the given duration, after the client it is
+// leased to found it to be in use by another host. Declines from other clients are
+// ignored, returning false, so that a client can't take addresses out of the pool.
+func (s *LeaseStore) decline(mac net.HardwareAddr, ip net.IP, duration time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held, ok := s.leases[ip.String()]
+	if !ok || held.MAC != mac.String() {
+		return false, nil
+	}
+
+	lease := &Lease{
+		IP:     ip.String(),
+		Expiry: time.Now().Add(duration),
+	}
+
+	s.leases[lease.IP] = lease
+
+	return true, s.put(LeaseEventDecline, lease)
+}
+
+func (s *LeaseStore) byMAC(mac net.HardwareAddr) *Lease {
+	for _, lease := range s.leases {
+		if lease.MAC == mac.String() {
+			return lease
+		}
+	}
+
+	return nil
+}
+
+// put writes a changed lease to the state database, recording the event that changed it,
+// or otherwise writes the whole store to disk. The caller must hold the lock.
+func (s *LeaseStore) put(event string, lease *Lease) error {
+	if s.db != nil {
+		return s.db.PutLease(event, storedLease(lease)) //nolint:wrapcheck
+	}
+
+	return s.save()
+}
+
+func storedLease(lease *Lease) *store.Lease {
+	return &store.Lease{
+		IP:       lease.IP,
+		MAC:      lease.MAC,
+		Hostname: lease.Hostname,
+		Expiry:   lease.Expiry,
+	}
+}
+
+// save writes the store to disk. The caller must hold the lock.
+func (s *LeaseStore) save() error {
+	leases := make([]*Lease, 0, len(s.leases))
+	for _, lease := range s.leases {
+		leases = append(leases, lease)
+	}
+
+	data, err := json.Marshal(leases)
+	if err != nil {
+		return fmt.Errorf("failed to encode DHCP leases: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create DHCP lease directory: %w", err)
+	}
+
+	if err := atomicfile.Write(s.path, data); err != nil {
+		return fmt.Errorf("failed to write DHCP leases: %w", err)
+	}
+
+	return nil
+}
+
+// pool is an inclusive range of IPv4 addresses, excluding those reserved for static leases
+type pool struct {
+	start uint32
+	end   uint32
+
+	reserved map[string]struct{}
+}
+
+func (p *pool) contains(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+
+	if _, ok := p.reserved[ip4.String()]; ok {
+		return false
+	}
+
+	i := binary.BigEndian.Uint32(ip4)
+	return i >= p.start && i <= p.end
+}
+
+func uint32ToIP(i uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
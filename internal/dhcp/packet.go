@@ -0,0 +1,260 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// OptionCode is a DHCP option code, as defined by RFC 2132 and others
+type OptionCode uint8
+
+const (
+	OptionPad                OptionCode = 0
+	OptionSubnetMask         OptionCode = 1
+	OptionRouter             OptionCode = 3
+	OptionDomainNameServer   OptionCode = 6
+	OptionHostName           OptionCode = 12
+	OptionDomainName         OptionCode = 15
+	OptionVendorSpecific     OptionCode = 43
+	OptionRequestedIP        OptionCode = 50
+	OptionLeaseTime          OptionCode = 51
+	OptionMessageType        OptionCode = 53
+	OptionServerIdentifier   OptionCode = 54
+	OptionParameterRequest   OptionCode = 55
+	OptionRenewalTime        OptionCode = 58
+	OptionRebindingTime      OptionCode = 59
+	OptionVendorClass        OptionCode = 60
+	OptionClientIdentifier   OptionCode = 61
+	OptionTFTPServerName     OptionCode = 66
+	OptionBootFileName       OptionCode = 67
+	OptionUserClass          OptionCode = 77
+	OptionClientArchitecture OptionCode = 93
+	OptionClientNDI          OptionCode = 94
+	OptionClientUUID         OptionCode = 97
+	OptionEnd                OptionCode = 255
+)
+
+// MessageType is the type of a DHCP message (option 53)
+type MessageType uint8
+
+const (
+	MessageTypeDiscover MessageType = 1
+	MessageTypeOffer    MessageType = 2
+	MessageTypeRequest  MessageType = 3
+	MessageTypeDecline  MessageType = 4
+	MessageTypeAck      MessageType = 5
+	MessageTypeNak      MessageType = 6
+	MessageTypeRelease  MessageType = 7
+	MessageTypeInform   MessageType = 8
+)
+
+const (
+	opRequest = 1
+	opReply   = 2
+
+	htypeEthernet = 1
+
+	// Size of the fixed-length part of a message, up to and including the magic cookie
+	headerSize = 240
+
+	// Minimum size of a BOOTP message, which some clients (and relays) require
+	minMessageSize = 300
+
+	flagBroadcast = 1 << 15
+
+	chaddrOffset = 28
+	snameOffset  = 44
+	fileOffset   = 108
+	cookieOffset = 236
+
+	snameSize = 64
+	fileSize  = 128
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+var (
+	errMessageTooShort = errors.New("message too short")
+	errNotRequest      = errors.New("message is not a BOOTP request")
+	errNotReply        = errors.New("message is not a BOOTP reply")
+	errBadCookie       = errors.New("message does not contain the DHCP magic cookie")
+	errTruncatedOption = errors.New("option overruns message")
+)
+
+// Packet is a DHCPv4 message
+type Packet struct {
+	Op     uint8
+	XID    uint32
+	Secs   uint16
+	Flags  uint16
+	CIAddr net.IP
+	YIAddr net.IP
+	SIAddr net.IP
+	GIAddr net.IP
+	CHAddr net.HardwareAddr
+
+	ServerName string
+	File       string
+
+	Options map[OptionCode][]byte
+}
+
+// Parse parses a DHCP request message
+func Parse(message []byte) (*Packet, error) {
+	if len(message) > 0 && message[0] != opRequest {
+		return nil, errNotRequest
+	}
+
+	return parse(message)
+}
+
+// ParseReply parses a DHCP reply message, e.g. an offer received by a client
+func ParseReply(message []byte) (*Packet, error) {
+	if len(message) > 0 && message[0] != opReply {
+		return nil, errNotReply
+	}
+
+	return parse(message)
+}
+
+func parse(message []byte) (*Packet, error) {
+	if len(message) < headerSize {
+		return nil, errMessageTooShort
+	}
+
+	if !bytes.Equal(message[cookieOffset:headerSize], magicCookie) {
+		return nil, errBadCookie
+	}
+
+	hlen := int(message[2])
+	if hlen > 16 {
+		hlen = 16
+	}
+
+	p := &Packet{
+		Op:         message[0],
+		XID:        binary.BigEndian.Uint32(message[4:]),
+		Secs:       binary.BigEndian.Uint16(message[8:]),
+		Flags:      binary.BigEndian.Uint16(message[10:]),
+		CIAddr:     net.IP(bytes.Clone(message[12:16])),
+		YIAddr:     net.IP(bytes.Clone(message[16:20])),
+		SIAddr:     net.IP(bytes.Clone(message[20:24])),
+		GIAddr:     net.IP(bytes.Clone(message[24:28])),
+		CHAddr:     net.HardwareAddr(bytes.Clone(message[chaddrOffset : chaddrOffset+hlen])),
+		ServerName: cString(message[snameOffset : snameOffset+snameSize]),
+		File:       cString(message[fileOffset : fileOffset+fileSize]),
+		Options:    make(map[OptionCode][]byte),
+	}
+
+	options := message[headerSize:]
+	for i := 0; i < len(options); {
+		code := OptionCode(options[i])
+		if code == OptionEnd {
+			break
+		}
+
+		if code == OptionPad {
+			i++
+			continue
+		}
+
+		if i+1 >= len(options) || i+2+int(options[i+1]) > len(options) {
+			return nil, errTruncatedOption
+		}
+
+		length := int(options[i+1])
+
+		// Options may be split over several instances, which are concatenated (RFC 3396)
+		p.Options[code] = append(p.Options[code], options[i+2:i+2+length]...)
+		i += 2 + length
+	}
+
+	return p, nil
+}
+
+func cString(b []byte) string {
+	s, _, _ := bytes.Cut(b, []byte{0})
+	return string(s)
+}
+
+// MessageType returns the type of the message, or zero if it has none (i.e. it is a
+// plain BOOTP message)
+func (p *Packet) MessageType() MessageType {
+	if t := p.Options[OptionMessageType]; len(t) == 1 {
+		return MessageType(t[0])
+	}
+
+	return 0
+}
+
+// Reply creates a reply to the packet, with the given message type
+func (p *Packet) Reply(messageType MessageType) *Packet {
+	return &Packet{
+		Op:     opReply,
+		XID:    p.XID,
+		Flags:  p.Flags,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: p.GIAddr,
+		CHAddr: p.CHAddr,
+		Options: map[OptionCode][]byte{
+			OptionMessageType: {byte(messageType)},
+		},
+	}
+}
+
+// Marshal encodes the packet. Options are written in ascending order of code, except
+// for the message type, which is always written first.
+func (p *Packet) Marshal() []byte {
+	message := make([]byte, headerSize, minMessageSize)
+	message[0] = p.Op
+	message[1] = htypeEthernet
+	message[2] = byte(len(p.CHAddr))
+	binary.BigEndian.PutUint32(message[4:], p.XID)
+	binary.BigEndian.PutUint16(message[8:], p.Secs)
+	binary.BigEndian.PutUint16(message[10:], p.Flags)
+	copy(message[12:16], p.CIAddr.To4())
+	copy(message[16:20], p.YIAddr.To4())
+	copy(message[20:24], p.SIAddr.To4())
+	copy(message[24:28], p.GIAddr.To4())
+	copy(message[chaddrOffset:chaddrOffset+16], p.CHAddr)
+	copy(message[snameOffset:snameOffset+snameSize-1], p.ServerName)
+	copy(message[fileOffset:fileOffset+fileSize-1], p.File)
+	copy(message[cookieOffset:], magicCookie)
+
+	if t, ok := p.Options[OptionMessageType]; ok {
+		message = appendOption(message, OptionMessageType, t)
+	}
+
+	for code := OptionPad + 1; code < OptionEnd; code++ {
+		if value, ok := p.Options[code]; ok && code != OptionMessageType {
+			message = appendOption(message, code, value)
+		}
+	}
+
+	message = append(message, byte(OptionEnd))
+
+	for len(message) < minMessageSize {
+		message = append(message, byte(OptionPad))
+	}
+
+	return message
+}
+
+// appendOption appends an option, splitting it into several instances if it is longer
+// than 255 bytes (RFC 3396)
+func appendOption(message []byte, code OptionCode, value []byte) []byte {
+	for {
+		chunk := value[:min(len(value), 255)]
+		message = append(message, byte(code), byte(len(chunk)))
+		message = append(message, chunk...)
+
+		value = value[len(chunk):]
+		if len(value) == 0 {
+			return message
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/davejbax/pixie/internal/clients"
+)
+
+// MessageTypeV6 is the type of a DHCPv6 message, as defined by RFC 8415
+type MessageTypeV6 uint8
+
+const (
+	MessageTypeV6Solicit            MessageTypeV6 = 1
+	MessageTypeV6Advertise          MessageTypeV6 = 2
+	MessageTypeV6Request            MessageTypeV6 = 3
+	MessageTypeV6Reply              MessageTypeV6 = 7
+	MessageTypeV6InformationRequest MessageTypeV6 = 11
+	MessageTypeV6RelayForward       MessageTypeV6 = 12
+	MessageTypeV6RelayReply         MessageTypeV6 = 13
+)
+
+// OptionCodeV6 is a DHCPv6 option code, as defined by RFC 8415 and RFC 5970
+type OptionCodeV6 uint16
+
+const (
+	OptionV6ClientID       OptionCodeV6 = 1
+	OptionV6ServerID       OptionCodeV6 = 2
+	OptionV6RelayMessage   OptionCodeV6 = 9
+	OptionV6VendorClass    OptionCodeV6 = 16
+	OptionV6InterfaceID    OptionCodeV6 = 18
+	OptionV6BootFileURL    OptionCodeV6 = 59
+	OptionV6ClientArchType OptionCodeV6 = 61
+)
+
+const (
+	// Sizes of the fixed-length parts of client/server and relay messages
+	headerSizeV6      = 4
+	relayHeaderSizeV6 = 34
+
+	optionHeaderSizeV6 = 4
+
+	// DUID types (RFC 8415 section 11) that identify clients by MAC address or UUID
+	duidTypeLLT  = 1
+	duidTypeLL   = 3
+	duidTypeUUID = 4
+
+	// Enterprise number that PXE vendor classes are sent under (Intel's)
+	pxeEnterpriseNumber = 343
+)
+
+var errMalformedOption = errors.New("malformed option")
+
+// OptionV6 is a single DHCPv6 option. Options may be repeated, so are kept in order.
+type OptionV6 struct {
+	Code OptionCodeV6
+	Data []byte
+}
+
+// PacketV6 is a DHCPv6 client/server message or, if the type is a relay message type, a
+// relay message
+type PacketV6 struct {
+	Type MessageTypeV6
+
+	// Transaction ID of client/server messages
+	TransactionID [3]byte
+
+	// Fields of relay messages
+	HopCount    uint8
+	LinkAddress net.IP
+	PeerAddress net.IP
+
+	Options []OptionV6
+}
+
+// ParseV6 parses a DHCPv6 message
+func ParseV6(data []byte) (*PacketV6, error) {
+	if len(data) < headerSizeV6 {
+		return nil, errMessageTooShort
+	}
+
+	p := &PacketV6{Type: MessageTypeV6(data[0])}
+	offset := headerSizeV6
+
+	if p.Type == MessageTypeV6RelayForward || p.Type == MessageTypeV6RelayReply {
+		if len(data) < relayHeaderSizeV6 {
+			return nil, errMessageTooShort
+		}
+
+		p.HopCount = data[1]
+		p.LinkAddress = net.IP(data[2:18])
+		p.PeerAddress = net.IP(data[18:34])
+		offset = relayHeaderSizeV6
+	} else {
+		copy(p.TransactionID[:], data[1:4])
+	}
+
+	for offset < len(data) {
+		if len(data)-offset < optionHeaderSizeV6 {
+			return nil, errMalformedOption
+		}
+
+		code := OptionCodeV6(binary.BigEndian.Uint16(data[offset:]))
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		offset += optionHeaderSizeV6
+
+		if len(data)-offset < length {
+			return nil, errMalformedOption
+		}
+
+		p.Options = append(p.Options, OptionV6{Code: code, Data: data[offset : offset+length]})
+		offset += length
+	}
+
+	return p, nil
+}
+
+// Marshal encodes the message
+func (p *PacketV6) Marshal() []byte {
+	var data []byte
+
+	if p.Type == MessageTypeV6RelayForward || p.Type == MessageTypeV6RelayReply {
+		data = append(data, byte(p.Type), p.HopCount)
+		data = append(data, p.LinkAddress.To16()...)
+		data = append(data, p.PeerAddress.To16()...)
+	} else {
+		data = append(data, byte(p.Type))
+		data = append(data, p.TransactionID[:]...)
+	}
+
+	for _, option := range p.Options {
+		data = binary.BigEndian.AppendUint16(data, uint16(option.Code))
+		data = binary.BigEndian.AppendUint16(data, uint16(len(option.Data)))
+		data = append(data, option.Data...)
+	}
+
+	return data
+}
+
+// Option returns the data of the first option with the given code
+func (p *PacketV6) Option(code OptionCodeV6) ([]byte, bool) {
+	for _, option := range p.Options {
+		if option.Code == code {
+			return option.Data, true
+		}
+	}
+
+	return nil, false
+}
+
+// AddOption appends an option to the message
+func (p *PacketV6) AddOption(code OptionCodeV6, data []byte) {
+	p.Options = append(p.Options, OptionV6{Code: code, Data: data})
+}
+
+// Reply creates a reply of the given type to the message, with the same transaction ID
+// and client identifier
+func (p *PacketV6) Reply(messageType MessageTypeV6) *PacketV6 {
+	reply := &PacketV6{Type: messageType, TransactionID: p.TransactionID}
+
+	if clientID, ok := p.Option(OptionV6ClientID); ok {
+		reply.AddOption(OptionV6ClientID, clientID)
+	}
+
+	return reply
+}
+
+// ClientArch returns the first architecture type in the client architecture option (RFC
+// 5970). Unlike with DHCPv4, the option is required of network boot clients, so its
+// absence means the client isn't one, and false is returned.
+func (p *PacketV6) ClientArch() (ClientArch, bool) {
+	value, ok := p.Option(OptionV6ClientArchType)
+	if !ok {
+		return 0, false
+	}
+
+	if len(value) < clientArchOptionLength {
+		return ClientArchUnknown, true
+	}
+
+	return ClientArch(binary.BigEndian.Uint16(value)), true
+}
+
+// ClientMAC returns the client's MAC address, if its DUID is based on one
+func (p *PacketV6) ClientMAC() net.HardwareAddr {
+	duid, ok := p.Option(OptionV6ClientID)
+	if !ok || len(duid) < 4 {
+		return nil
+	}
+
+	// Both link-layer DUIDs have a two-byte hardware type, and DUID-LLT then a time
+	var mac []byte
+
+	switch binary.BigEndian.Uint16(duid) {
+	case duidTypeLL:
+		mac = duid[4:]
+	case duidTypeLLT:
+		if len(duid) < 8 {
+			return nil
+		}
+
+		mac = duid[8:]
+	default:
+		return nil
+	}
+
+	if binary.BigEndian.Uint16(duid[2:]) != htypeEthernet || len(mac) != 6 {
+		return nil
+	}
+
+	return net.HardwareAddr(mac)
+}
+
+// ClientUUID returns the client's UUID, if its DUID is a DUID-UUID as UEFI firmware
+// usually sends (RFC 6355). The firmware uses its SMBIOS UUID.
+func (p *PacketV6) ClientUUID() string {
+	duid, ok := p.Option(OptionV6ClientID)
+	if !ok || len(duid) != 18 || binary.BigEndian.Uint16(duid) != duidTypeUUID {
+		return ""
+	}
+
+	return clients.FormatUUID(duid[2:])
+}
+
+// vendorClassV6 encodes a vendor class option with a single vendor class data item
+func vendorClassV6(enterprise uint32, class string) []byte {
+	data := binary.BigEndian.AppendUint32(nil, enterprise)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(class)))
+
+	return append(data, class...)
+}
+
+// duidLL returns a DUID-LL identifying a server by its interface's MAC address
+func duidLL(mac net.HardwareAddr) []byte {
+	data := binary.BigEndian.AppendUint16(nil, duidTypeLL)
+	data = binary.BigEndian.AppendUint16(data, htypeEthernet)
+
+	return append(data, mac...)
+}
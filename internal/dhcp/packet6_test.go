@@ -0,0 +1,237 @@
+package dhcp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// ovmfHTTPSolicit is the SOLICIT multicast by QEMU's OVMF firmware when HTTP booting an
+// x64 UEFI client over IPv6, which identifies itself with a DUID-UUID
+var ovmfHTTPSolicit = "01a1b2c3" +
+	"00010012" + "0004" + "8a4e9c3f2b1d4e6fa0b1c2d3e4f50617" + // Client ID: DUID-UUID
+	"000800020000" + // Elapsed time
+	"0003000c" + "5e1f7a3b" + "00000000" + "00000000" + // IA_NA
+	"00060008" + "003b" + "003c" + "0017" + "0018" + // Option request
+	"00100027" + "00000157" + "0021" + "48545450436c69656e743a417263683a30303031363a554e44493a303033303136" + // Vendor class
+	"003d0002" + "0010" + // Client arch: x64 UEFI HTTP
+	"003e0003" + "010310" // Client NII: UNDI 3.16
+
+// pxeSolicit is a SOLICIT from PXE firmware identifying itself with a DUID-LLT for MAC
+// 52:54:00:12:34:56
+var pxeSolicit = "01000001" +
+	"0001000e" + "0001" + "0001" + "2b3c4d5e" + "525400123456" + // Client ID: DUID-LLT
+	"003d0002" + "0007" // Client arch: x64 UEFI
+
+// relayedSolicit is pxeSolicit relayed from link fd00::1 with an interface ID
+var relayedSolicit = "0c00" +
+	"fd000000000000000000000000000001" +
+	"fe800000000000005054" + "00fffe123456" +
+	"00120004" + "65746830" + // Interface ID: 'eth0'
+	"0009001c" + pxeSolicit // Relay message
+
+func TestParseV6(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		check   func(t *testing.T, p *PacketV6)
+		wantErr error
+	}{
+		{
+			name:    "OVMF HTTP boot solicit",
+			message: ovmfHTTPSolicit,
+			check: func(t *testing.T, p *PacketV6) {
+				t.Helper()
+
+				if p.Type != MessageTypeV6Solicit || p.TransactionID != [3]byte{0xa1, 0xb2, 0xc3} {
+					t.Errorf("header = type %d transaction %x", p.Type, p.TransactionID)
+				}
+
+				if len(p.Options) != 7 {
+					t.Errorf("len(Options) = %d, want 7", len(p.Options))
+				}
+
+				if arch, ok := p.ClientArch(); !ok || arch != ClientArchEFIX64HTTP {
+					t.Errorf("ClientArch() = %d, %t", arch, ok)
+				}
+
+				if uuid := p.ClientUUID(); uuid != "3f9c4e8a-1d2b-6f4e-a0b1-c2d3e4f50617" {
+					t.Errorf("ClientUUID() = %q", uuid)
+				}
+
+				if mac := p.ClientMAC(); mac != nil {
+					t.Errorf("ClientMAC() = %s, want none", mac)
+				}
+
+				vendorClass, _ := p.Option(OptionV6VendorClass)
+				if !bytes.Equal(vendorClass, vendorClassV6(pxeEnterpriseNumber, "HTTPClient:Arch:00016:UNDI:003016")) {
+					t.Errorf("vendor class = % x", vendorClass)
+				}
+			},
+		},
+		{
+			name:    "PXE solicit with DUID-LLT",
+			message: pxeSolicit,
+			check: func(t *testing.T, p *PacketV6) {
+				t.Helper()
+
+				if mac := p.ClientMAC(); mac.String() != "52:54:00:12:34:56" {
+					t.Errorf("ClientMAC() = %s", mac)
+				}
+
+				if uuid := p.ClientUUID(); uuid != "" {
+					t.Errorf("ClientUUID() = %q, want none", uuid)
+				}
+
+				if arch, ok := p.ClientArch(); !ok || arch != ClientArchEFIBC {
+					t.Errorf("ClientArch() = %d, %t", arch, ok)
+				}
+			},
+		},
+		{
+			name:    "relay forward",
+			message: relayedSolicit,
+			check: func(t *testing.T, p *PacketV6) {
+				t.Helper()
+
+				if p.Type != MessageTypeV6RelayForward || p.HopCount != 0 {
+					t.Errorf("header = type %d hops %d", p.Type, p.HopCount)
+				}
+
+				if !p.LinkAddress.Equal(net.ParseIP("fd00::1")) || !p.PeerAddress.Equal(net.ParseIP("fe80::5054:ff:fe12:3456")) {
+					t.Errorf("link address = %s, peer address = %s", p.LinkAddress, p.PeerAddress)
+				}
+
+				if id, _ := p.Option(OptionV6InterfaceID); string(id) != "eth0" {
+					t.Errorf("interface ID = %q", id)
+				}
+
+				relayed, ok := p.Option(OptionV6RelayMessage)
+				if !ok {
+					t.Fatal("relay message option missing")
+				}
+
+				inner, err := ParseV6(relayed)
+				if err != nil {
+					t.Fatalf("ParseV6(relay message) error = %v", err)
+				}
+
+				if mac := inner.ClientMAC(); mac.String() != "52:54:00:12:34:56" {
+					t.Errorf("relayed ClientMAC() = %s", mac)
+				}
+			},
+		},
+		{
+			name:    "no client arch",
+			message: "01000001",
+			check: func(t *testing.T, p *PacketV6) {
+				t.Helper()
+
+				if _, ok := p.ClientArch(); ok {
+					t.Error("ClientArch() found an arch")
+				}
+			},
+		},
+		{
+			name:    "short client arch",
+			message: "01000001" + "003d0001" + "00",
+			check: func(t *testing.T, p *PacketV6) {
+				t.Helper()
+
+				if arch, ok := p.ClientArch(); !ok || arch != ClientArchUnknown {
+					t.Errorf("ClientArch() = %d, %t, want unknown", arch, ok)
+				}
+			},
+		},
+		{
+			name:    "DUID-LL with non-Ethernet hardware",
+			message: "01000001" + "0001000a" + "0003" + "0006" + "525400123456",
+			check: func(t *testing.T, p *PacketV6) {
+				t.Helper()
+
+				if mac := p.ClientMAC(); mac != nil {
+					t.Errorf("ClientMAC() = %s, want none", mac)
+				}
+			},
+		},
+		{
+			name:    "shorter than header",
+			message: "01a1b2",
+			wantErr: errMessageTooShort,
+		},
+		{
+			name:    "relay shorter than header",
+			message: relayedSolicit[:2*relayHeaderSizeV6-2],
+			wantErr: errMessageTooShort,
+		},
+		{
+			name:    "truncated option header",
+			message: "01a1b2c3" + "0001",
+			wantErr: errMalformedOption,
+		},
+		{
+			name:    "option overruns message",
+			message: "01a1b2c3" + "00010012" + "0004",
+			wantErr: errMalformedOption,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := ParseV6(mustDecodeHex(t, test.message))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("ParseV6() error = %v, want %v", err, test.wantErr)
+			}
+
+			if test.check != nil {
+				test.check(t, p)
+			}
+		})
+	}
+}
+
+func TestPacketV6Marshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+	}{
+		{name: "OVMF HTTP boot solicit", message: ovmfHTTPSolicit},
+		{name: "relay forward", message: relayedSolicit},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := mustDecodeHex(t, test.message)
+
+			p, err := ParseV6(message)
+			if err != nil {
+				t.Fatalf("ParseV6() error = %v", err)
+			}
+
+			if got := p.Marshal(); !bytes.Equal(got, message) {
+				t.Errorf("Marshal() = % x, want % x", got, message)
+			}
+		})
+	}
+}
+
+func TestPacketV6Reply(t *testing.T) {
+	solicit, err := ParseV6(mustDecodeHex(t, ovmfHTTPSolicit))
+	if err != nil {
+		t.Fatalf("ParseV6() error = %v", err)
+	}
+
+	advertise := solicit.Reply(MessageTypeV6Advertise)
+	advertise.AddOption(OptionV6ServerID, duidLL(net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}))
+	advertise.AddOption(OptionV6BootFileURL, []byte("http://[fd00::1]/pixie/x86_64.efi"))
+
+	want := mustDecodeHex(t, "02a1b2c3"+
+		"00010012"+"0004"+"8a4e9c3f2b1d4e6fa0b1c2d3e4f50617"+
+		"0002000a"+"0003"+"0001"+"020000000001"+
+		"003b0021"+"687474703a2f2f5b666430303a3a315d2f70697869652f7838365f36342e656669")
+
+	if got := advertise.Marshal(); !bytes.Equal(got, want) {
+		t.Errorf("Marshal() = % x, want % x", got, want)
+	}
+}
@@ -0,0 +1,268 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// zeros returns the hex encoding of n zero bytes
+func zeros(n int) string {
+	return strings.Repeat("00", n)
+}
+
+// ovmfDiscover is the DHCPDISCOVER broadcast by QEMU's OVMF firmware when PXE booting an
+// x64 UEFI client, with MAC 52:54:00:12:34:56
+var ovmfDiscover = "010106005e1f7a3b00048000" + zeros(16) +
+	"525400123456" + zeros(10) +
+	zeros(64+128) +
+	"63825363" +
+	"350101" + // DHCPDISCOVER
+	"390205c0" + // Maximum message size: 1472
+	"37230102030405060c0d0f111216171c28292a2b3233363a3b3c4243618081828384858687" +
+	"6111008a4e9c3f2b1d4e6fa0b1c2d3e4f50617" + // Client UUID
+	"5e03010310" + // Client NDI: UNDI 3.16
+	"5d020007" + // Client arch: x64 UEFI
+	"3c20505845436c69656e743a417263683a30303030373a554e44493a303033303136" +
+	"ff"
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex fixture: %v", err)
+	}
+
+	return b
+}
+
+func TestParse(t *testing.T) {
+	// Fixed-length part of the discover, to which each message adds options
+	header := ovmfDiscover[:2*headerSize]
+
+	tests := []struct {
+		name    string
+		message string
+		check   func(t *testing.T, p *Packet)
+		wantErr error
+	}{
+		{
+			name:    "OVMF discover",
+			message: ovmfDiscover,
+			check: func(t *testing.T, p *Packet) {
+				t.Helper()
+
+				if p.Op != opRequest || p.XID != 0x5e1f7a3b || p.Secs != 4 || p.Flags != flagBroadcast {
+					t.Errorf("header = op %d xid %#x secs %d flags %#x", p.Op, p.XID, p.Secs, p.Flags)
+				}
+
+				if p.CHAddr.String() != "52:54:00:12:34:56" {
+					t.Errorf("CHAddr = %s", p.CHAddr)
+				}
+
+				if !p.CIAddr.Equal(net.IPv4zero) || !p.GIAddr.Equal(net.IPv4zero) {
+					t.Errorf("CIAddr = %s, GIAddr = %s", p.CIAddr, p.GIAddr)
+				}
+
+				if p.ServerName != "" || p.File != "" {
+					t.Errorf("ServerName = %q, File = %q", p.ServerName, p.File)
+				}
+
+				if p.MessageType() != MessageTypeDiscover {
+					t.Errorf("MessageType() = %d", p.MessageType())
+				}
+
+				if got := string(p.Options[OptionVendorClass]); got != "PXEClient:Arch:00007:UNDI:003016" {
+					t.Errorf("vendor class = %q", got)
+				}
+
+				if got := p.Options[OptionClientArchitecture]; !bytes.Equal(got, []byte{0x00, 0x07}) {
+					t.Errorf("client arch = % x", got)
+				}
+
+				if got := p.Options[OptionClientUUID]; len(got) != 17 || got[0] != 0 {
+					t.Errorf("client UUID = % x", got)
+				}
+
+				if got := len(p.Options[OptionParameterRequest]); got != 35 {
+					t.Errorf("parameter request list has %d entries", got)
+				}
+			},
+		},
+		{
+			name:    "split options are concatenated",
+			message: header + "0c03706978" + "00" + "0c026965" + "ff",
+			check: func(t *testing.T, p *Packet) {
+				t.Helper()
+
+				if got := string(p.Options[OptionHostName]); got != "pixie" {
+					t.Errorf("host name = %q, want %q", got, "pixie")
+				}
+			},
+		},
+		{
+			name:    "options end without end option",
+			message: header + "350103",
+			check: func(t *testing.T, p *Packet) {
+				t.Helper()
+
+				if p.MessageType() != MessageTypeRequest {
+					t.Errorf("MessageType() = %d", p.MessageType())
+				}
+			},
+		},
+		{
+			name:    "options after end are ignored",
+			message: header + "350101ff0c03706978",
+			check: func(t *testing.T, p *Packet) {
+				t.Helper()
+
+				if _, ok := p.Options[OptionHostName]; ok {
+					t.Error("option after end was parsed")
+				}
+			},
+		},
+		{
+			name:    "no message type",
+			message: header + "ff" + zeros(59),
+			check: func(t *testing.T, p *Packet) {
+				t.Helper()
+
+				if p.MessageType() != 0 {
+					t.Errorf("MessageType() = %d, want 0", p.MessageType())
+				}
+			},
+		},
+		{
+			name:    "shorter than header",
+			message: header[:2*headerSize-2],
+			wantErr: errMessageTooShort,
+		},
+		{
+			name:    "reply",
+			message: "02" + header[2:] + "ff",
+			wantErr: errNotRequest,
+		},
+		{
+			name:    "bad cookie",
+			message: header[:2*cookieOffset] + "63825364" + "ff",
+			wantErr: errBadCookie,
+		},
+		{
+			name:    "option overruns message",
+			message: header + "0c0570697865",
+			wantErr: errTruncatedOption,
+		},
+		{
+			name:    "option without length",
+			message: header + "0c",
+			wantErr: errTruncatedOption,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := Parse(mustDecodeHex(t, test.message))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Parse() error = %v, want %v", err, test.wantErr)
+			}
+
+			if test.check != nil {
+				test.check(t, p)
+			}
+		})
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	request, err := Parse(mustDecodeHex(t, ovmfDiscover))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	offer := request.Reply(MessageTypeOffer)
+	offer.YIAddr = net.IPv4(192, 168, 0, 50)
+	offer.SIAddr = net.IPv4(192, 168, 0, 1)
+	offer.File = "pixie/x86_64.efi"
+	offer.Options[OptionServerIdentifier] = net.IPv4(192, 168, 0, 1).To4()
+	offer.Options[OptionVendorClass] = []byte("PXEClient")
+	offer.Options[OptionSubnetMask] = net.IPv4(255, 255, 255, 0).To4()
+
+	message := offer.Marshal()
+
+	if len(message) != minMessageSize {
+		t.Errorf("len(Marshal()) = %d, want %d", len(message), minMessageSize)
+	}
+
+	wantHeader := mustDecodeHex(t, "020106005e1f7a3b00008000"+zeros(4)+"c0a80032"+"c0a80001"+zeros(4)+"525400123456"+zeros(10))
+	if !bytes.Equal(message[:chaddrOffset+16], wantHeader) {
+		t.Errorf("header = % x, want % x", message[:chaddrOffset+16], wantHeader)
+	}
+
+	if got := cString(message[fileOffset : fileOffset+fileSize]); got != offer.File {
+		t.Errorf("file = %q, want %q", got, offer.File)
+	}
+
+	// The message type comes first, then options in ascending order of code
+	wantOptions := mustDecodeHex(t, "63825363"+"350102"+"0104ffffff00"+"3604c0a80001"+"3c09505845436c69656e74"+"ff")
+	if got := message[cookieOffset : cookieOffset+len(wantOptions)]; !bytes.Equal(got, wantOptions) {
+		t.Errorf("options = % x, want % x", got, wantOptions)
+	}
+
+	for i, b := range message[cookieOffset+len(wantOptions):] {
+		if b != byte(OptionPad) {
+			t.Fatalf("padding byte %d = %#x, want 0", i, b)
+		}
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	long := bytes.Repeat([]byte{0xab}, 300)
+
+	request := &Packet{
+		Op:         opRequest,
+		XID:        0xdeadbeef,
+		Secs:       12,
+		CIAddr:     net.IPv4(10, 0, 0, 7),
+		YIAddr:     net.IPv4zero,
+		SIAddr:     net.IPv4zero,
+		GIAddr:     net.IPv4(10, 0, 0, 1),
+		CHAddr:     net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x20, 0x30},
+		ServerName: "pixie",
+		File:       "boot.efi",
+		Options: map[OptionCode][]byte{
+			OptionMessageType:      {byte(MessageTypeRequest)},
+			OptionVendorSpecific:   long,
+			OptionRequestedIP:      {10, 0, 0, 7},
+			OptionClientIdentifier: {0x01, 0x02, 0x00, 0x5e, 0x10, 0x20, 0x30},
+		},
+	}
+
+	message := request.Marshal()
+
+	// Options longer than 255 bytes are split into several instances (RFC 3396)
+	if i := bytes.Index(message, []byte{byte(OptionVendorSpecific), 255, 0xab}); i < 0 {
+		t.Fatal("long option was not split")
+	}
+
+	parsed, err := Parse(message)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if parsed.XID != request.XID || parsed.Secs != request.Secs || !parsed.CIAddr.Equal(request.CIAddr) ||
+		!parsed.GIAddr.Equal(request.GIAddr) || parsed.CHAddr.String() != request.CHAddr.String() ||
+		parsed.ServerName != request.ServerName || parsed.File != request.File {
+		t.Errorf("Parse(Marshal()) = %+v, want %+v", parsed, request)
+	}
+
+	for code, value := range request.Options {
+		if !bytes.Equal(parsed.Options[code], value) {
+			t.Errorf("option %d = % x, want % x", code, parsed.Options[code], value)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Package dhcp implements the DHCP services that pixie uses to point network boot
+// clients at their bootloaders
+package dhcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/davejbax/pixie/internal/acl"
+	"github.com/davejbax/pixie/internal/audit"
+	"github.com/davejbax/pixie/internal/clients"
+	"github.com/davejbax/pixie/internal/netif"
+	"github.com/davejbax/pixie/internal/quirks"
+	"github.com/davejbax/pixie/internal/sockets"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	maxMessageSize = 1500
+
+	serverPort = 67
+	clientPort = 68
+)
+
+var errNoServerIP = errors.New("no server IP configured, and no IPv4 address could be found on local interfaces")
+
+// ProxyConfig configures the ProxyDHCP server
+type ProxyConfig struct {
+	// Whether to run the ProxyDHCP server
+	Enabled bool
+
+	// Address to listen on for DHCP broadcasts
+	Address string `default:":67"`
+
+	// Address to listen on for requests sent directly to the PXE boot server
+	BootServerAddress string `mapstructure:"boot_server_address" default:":4011"`
+
+	// Network interface to bind both addresses to, e.g. a VLAN interface, so that only
+	// its clients are answered. Only supported on Linux.
+	Interface string
+
+	// IPv4 address of pixie's TFTP server, as given to clients. If empty, the first IPv4
+	// address of the interface is used, or, without one, that of the interface each
+	// request arrives on.
+	ServerIP string `mapstructure:"server_ip"`
+
+	// Boot file to offer legacy BIOS clients, e.g. an iPXE image served from elsewhere.
+	// If empty, BIOS clients are ignored.
+	BIOSBootFile string `mapstructure:"bios_boot_file"`
+}
+
+// ProxyServer is a ProxyDHCP server (as defined by the PXE specification), which offers
+// PXE clients a boot file and TFTP server alongside an existing DHCP server, without
+// allocating addresses
+type ProxyServer struct {
+	logger *slog.Logger
+	config *ProxyConfig
+
+	address *serverAddress
+	boot    *bootOptions
+	access  *acl.List
+}
+
+// NewProxyServer creates a ProxyDHCP server that offers clients the given boot file
+// paths according to their architecture, adjusted for any quirks in the given table.
+// PXE clients download them from the TFTP server, and HTTP boot clients from the given
+// HTTP server, if any. PXE clients are recorded in the given registry. Only clients
+// allowed by the given access list, which may be nil, are answered. Unless a server IP
+// or interface is configured, clients are told the address in the interfaces table
+// (which may be nil) of the interface that their request arrives on.
+func NewProxyServer(logger *slog.Logger, config *ProxyConfig, bootFiles BootFiles, http *HTTPServer, quirks *quirks.Table, registry *clients.Registry, events *audit.Log, access *acl.List, interfaces *netif.Table) (*ProxyServer, error) {
+	address, err := newServerAddress(config.ServerIP, config.Interface, interfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProxyServer{
+		logger:  logger,
+		config:  config,
+		address: address,
+		access:  access,
+		boot: &bootOptions{
+			logger:       logger,
+			bootFiles:    bootFiles,
+			biosBootFile: config.BIOSBootFile,
+			quirks:       quirks,
+			clients:      registry,
+			events:       events,
+			http:         http,
+		},
+	}, nil
+}
+
+// ServerIP parses the given IPv4 address or, if empty, returns the first IPv4 address of
+// the named interface, or the first non-loopback IPv4 address of a local interface if the
+// name is empty
+func ServerIP(configured string, iface string) (net.IP, error) {
+	if configured != "" {
+		ip := net.ParseIP(configured).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid server IP '%s': %w", configured, errNoServerIP)
+		}
+
+		return ip, nil
+	}
+
+	addrs, err := interfaceAddrs(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), nil
+		}
+	}
+
+	return nil, errNoServerIP
+}
+
+// interfaceAddrs returns the addresses of the named interface, or of every local
+// interface if the name is empty
+func interfaceAddrs(iface string) ([]net.Addr, error) {
+	if iface == "" {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+		}
+
+		return addrs, nil
+	}
+
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface '%s': %w", iface, err)
+	}
+
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of interface '%s': %w", iface, err)
+	}
+
+	return addrs, nil
+}
+
+// ListenAndServe listens on the configured addresses and serves requests until the
+// context is cancelled
+func (s *ProxyServer) ListenAndServe(ctx context.Context) error {
+	dhcpConn, err := sockets.ListenPacket("udp4", s.config.Address, s.config.Interface)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	bootServerConn, err := sockets.ListenPacket("udp4", s.config.BootServerAddress, s.config.Interface)
+	if err != nil {
+		_ = dhcpConn.Close()
+		return err //nolint:wrapcheck
+	}
+
+	return s.Serve(ctx, dhcpConn, bootServerConn)
+}
+
+// Serve serves DHCP broadcasts on dhcpConn, and PXE boot server requests on
+// bootServerConn, until the context is cancelled
+func (s *ProxyServer) Serve(ctx context.Context, dhcpPacketConn net.PacketConn, bootServerPacketConn net.PacketConn) error {
+	dhcpConn, bootServerConn := newConn(dhcpPacketConn), newConn(bootServerPacketConn)
+
+	s.logger.Info("ProxyDHCP server listening",
+		"address", dhcpConn.LocalAddr().String(),
+		"boot_server_address", bootServerConn.LocalAddr().String(),
+		"server_ip", s.address.ip.String(),
+		"per_interface", s.address.interfaces != nil,
+	)
+
+	eg := &errgroup.Group{}
+	eg.Go(func() error {
+		return serveConn(ctx, dhcpConn, func(p *Packet, addr net.Addr, ifIndex int) {
+			if clientAllowed(s.logger, s.access, p, addr) {
+				s.handleBroadcast(dhcpConn, p, ifIndex)
+			}
+		})
+	})
+	eg.Go(func() error {
+		return serveConn(ctx, bootServerConn, func(p *Packet, addr net.Addr, ifIndex int) {
+			if clientAllowed(s.logger, s.access, p, addr) {
+				s.handleBootServer(bootServerConn, p, addr, ifIndex)
+			}
+		})
+	})
+
+	return eg.Wait() //nolint:wrapcheck
+}
+
+// serveConn reads DHCP requests from conn until the context is cancelled, passing them
+// to handle along with the index of the interface they arrived on, if known
+func serveConn(ctx context.Context, conn *conn, handle func(p *Packet, addr net.Addr, ifIndex int)) error {
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	buff := make([]byte, maxMessageSize)
+
+	for {
+		n, addr, ifIndex, err := conn.readFrom(buff)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read DHCP request: %w", err)
+		}
+
+		p, err := Parse(buff[:n])
+		if err != nil {
+			continue
+		}
+
+		handle(p, addr, ifIndex)
+	}
+}
+
+// clientAllowed returns whether the access list allows the client that sent p from
+// addr. Clients without an address yet are matched by the address of the relay agent
+// that forwarded their request, if any.
+func clientAllowed(logger *slog.Logger, access *acl.List, p *Packet, addr net.Addr) bool {
+	var ip net.IP
+
+	switch {
+	case !p.GIAddr.Equal(net.IPv4zero):
+		ip = p.GIAddr
+	case !p.CIAddr.Equal(net.IPv4zero):
+		ip = p.CIAddr
+	default:
+		if udpAddr, ok := addr.(*net.UDPAddr); ok && !udpAddr.IP.IsUnspecified() {
+			ip = udpAddr.IP
+		}
+	}
+
+	if access.Allowed(ip, p.CHAddr) {
+		return true
+	}
+
+	logger.Debug("ignoring DHCP request from client denied by access rules",
+		"mac", p.CHAddr.String(),
+	)
+
+	return false
+}
+
+func (s *ProxyServer) handleBroadcast(conn *conn, p *Packet, ifIndex int) {
+	if p.MessageType() != MessageTypeDiscover {
+		return
+	}
+
+	reply, ok := s.reply(p, MessageTypeOffer, p.CIAddr, s.address.on(ifIndex))
+	if !ok {
+		return
+	}
+
+	// Clients have no address yet, so replies are broadcast, unless they came via a relay
+	dest := &net.UDPAddr{IP: net.IPv4bcast, Port: clientPort}
+	if !p.GIAddr.Equal(net.IPv4zero) {
+		dest = &net.UDPAddr{IP: p.GIAddr, Port: serverPort}
+	}
+
+	s.send(conn, reply, dest, ifIndex)
+}
+
+func (s *ProxyServer) handleBootServer(conn *conn, p *Packet, addr net.Addr, ifIndex int) {
+	if t := p.MessageType(); t != MessageTypeRequest && t != MessageTypeInform {
+		return
+	}
+
+	reply, ok := s.reply(p, MessageTypeAck, addr.(*net.UDPAddr).IP, s.address.on(ifIndex)) //nolint:forcetypeassert
+	if !ok {
+		return
+	}
+
+	s.send(conn, reply, addr, ifIndex)
+}
+
+// reply creates a reply offering the client its boot file on the TFTP server at
+// serverIP, returning false if the client isn't a PXE client or there is nothing to
+// offer it
+func (s *ProxyServer) reply(p *Packet, messageType MessageType, clientIP net.IP, serverIP net.IP) (*Packet, bool) {
+	reply := p.Reply(messageType)
+	reply.Options[OptionServerIdentifier] = serverIP
+
+	if !s.boot.apply(p, reply, clientIP, serverIP) {
+		return nil, false
+	}
+
+	return reply, true
+}
+
+// send sends a reply out of the interface that the request arrived on
+func (s *ProxyServer) send(conn *conn, p *Packet, addr net.Addr, ifIndex int) {
+	if err := conn.writeTo(p.Marshal(), addr, ifIndex); err != nil {
+		s.logger.Warn("failed to send DHCP reply",
+			"client", addr.String(),
+			"error", err,
+		)
+	}
+}
@@ -0,0 +1,361 @@
+package dhcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/acl"
+	"github.com/davejbax/pixie/internal/audit"
+	"github.com/davejbax/pixie/internal/clients"
+	"github.com/davejbax/pixie/internal/quirks"
+	"github.com/davejbax/pixie/internal/sockets"
+)
+
+const (
+	serverPortV6 = 547
+
+	// Relay agents can be chained; RFC 8415 limits them to 8 hops
+	maxRelayDepthV6 = 8
+)
+
+// Multicast address of all DHCPv6 servers and relay agents on a link (RFC 8415)
+var allServersAndRelaysV6 = net.ParseIP("ff02::1:2")
+
+var (
+	errNoInterfaceV6 = errors.New("an interface to listen for DHCPv6 multicasts on must be configured")
+	errNoServerIPv6  = errors.New("no server IP configured, and no global IPv6 address could be found on the interface")
+)
+
+// ProxyV6Config configures the ProxyDHCPv6 server
+type ProxyV6Config struct {
+	// Whether to run the ProxyDHCPv6 server
+	Enabled bool
+
+	// Interface to listen for DHCPv6 multicasts on. Relayed requests are answered on
+	// any interface.
+	Interface string
+
+	// IPv6 address of pixie's TFTP and HTTP servers, as given to clients in boot file
+	// URLs. If empty, the first global unicast IPv6 address of the interface is used.
+	ServerIP string `mapstructure:"server_ip"`
+}
+
+// ProxyServerV6 is the DHCPv6 counterpart of ProxyServer: it offers UEFI clients booting
+// over IPv6 a boot file URL (RFC 5970) alongside an existing DHCPv6 server or SLAAC,
+// without allocating addresses
+type ProxyServerV6 struct {
+	logger *slog.Logger
+	config *ProxyV6Config
+
+	iface    *net.Interface
+	serverIP net.IP
+	serverID []byte
+
+	tftpPort string
+	http     *HTTPServer
+
+	bootFiles BootFiles
+	quirks    *quirks.Table
+	clients   *clients.Registry
+	events    *audit.Log
+	access    *acl.List
+}
+
+// NewProxyServerV6 creates a ProxyDHCPv6 server that offers clients boot file URLs on
+// the TFTP server (listening on the given port) or the given HTTP server, according to
+// their architecture. PXE clients are recorded in the given registry. Only clients allowed by
+// the given access list, which may be nil, are answered.
+func NewProxyServerV6(logger *slog.Logger, config *ProxyV6Config, tftpPort string, http *HTTPServer, bootFiles BootFiles, quirks *quirks.Table, registry *clients.Registry, events *audit.Log, access *acl.List) (*ProxyServerV6, error) {
+	if config.Interface == "" {
+		return nil, errNoInterfaceV6
+	}
+
+	iface, err := net.InterfaceByName(config.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface '%s': %w", config.Interface, err)
+	}
+
+	serverIP, err := ServerIPv6(iface, config.ServerIP)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProxyServerV6{
+		logger:    logger,
+		config:    config,
+		iface:     iface,
+		serverIP:  serverIP,
+		serverID:  duidLL(iface.HardwareAddr),
+		tftpPort:  tftpPort,
+		http:      http,
+		bootFiles: bootFiles,
+		quirks:    quirks,
+		clients:   registry,
+		events:    events,
+		access:    access,
+	}, nil
+}
+
+// ServerIPv6 parses the given IPv6 address or, if empty, returns the first global
+// unicast IPv6 address of the interface
+func ServerIPv6(iface *net.Interface, configured string) (net.IP, error) {
+	if configured != "" {
+		ip := net.ParseIP(configured)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid server IP '%s': %w", configured, errNoServerIPv6)
+		}
+
+		return ip, nil
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of interface '%s': %w", iface.Name, err)
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsGlobalUnicast() {
+			return ipNet.IP, nil
+		}
+	}
+
+	return nil, errNoServerIPv6
+}
+
+// ListenAndServe joins the DHCPv6 servers multicast group on the configured interface
+// and serves requests until the context is cancelled
+func (s *ProxyServerV6) ListenAndServe(ctx context.Context) error {
+	addr := &net.UDPAddr{IP: allServersAndRelaysV6, Port: serverPortV6}
+
+	conn, err := sockets.ListenMulticastUDP("udp6", s.iface, addr)
+	if err != nil {
+		return fmt.Errorf("on interface '%s': %w", s.iface.Name, err)
+	}
+
+	return s.Serve(ctx, conn)
+}
+
+// Serve serves DHCPv6 requests on conn until the context is cancelled
+func (s *ProxyServerV6) Serve(ctx context.Context, conn net.PacketConn) error {
+	s.logger.Info("ProxyDHCPv6 server listening",
+		"address", conn.LocalAddr().String(),
+		"interface", s.iface.Name,
+		"server_ip", s.serverIP.String(),
+	)
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	buff := make([]byte, maxMessageSize)
+
+	for {
+		n, addr, err := conn.ReadFrom(buff)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read DHCPv6 request: %w", err)
+		}
+
+		p, err := ParseV6(buff[:n])
+		if err != nil {
+			continue
+		}
+
+		reply, ok := s.handle(p, addr, 0)
+		if !ok {
+			continue
+		}
+
+		if _, err := conn.WriteTo(reply.Marshal(), addr); err != nil {
+			s.logger.Warn("failed to send DHCPv6 reply",
+				"client", addr.String(),
+				"error", err,
+			)
+		}
+	}
+}
+
+// handle returns the reply to p, unwrapping relayed requests and wrapping the reply in
+// relay replies to match
+func (s *ProxyServerV6) handle(p *PacketV6, addr net.Addr, depth int) (*PacketV6, bool) {
+	if p.Type != MessageTypeV6RelayForward {
+		return s.reply(p, addr)
+	}
+
+	if depth >= maxRelayDepthV6 {
+		return nil, false
+	}
+
+	data, ok := p.Option(OptionV6RelayMessage)
+	if !ok {
+		return nil, false
+	}
+
+	inner, err := ParseV6(data)
+	if err != nil {
+		return nil, false
+	}
+
+	// Clients behind a relay are identified by the relay's peer address
+	innerReply, ok := s.handle(inner, &net.UDPAddr{IP: p.PeerAddress}, depth+1)
+	if !ok {
+		return nil, false
+	}
+
+	reply := &PacketV6{
+		Type:        MessageTypeV6RelayReply,
+		HopCount:    p.HopCount,
+		LinkAddress: p.LinkAddress,
+		PeerAddress: p.PeerAddress,
+	}
+
+	if interfaceID, ok := p.Option(OptionV6InterfaceID); ok {
+		reply.AddOption(OptionV6InterfaceID, interfaceID)
+	}
+
+	reply.AddOption(OptionV6RelayMessage, innerReply.Marshal())
+
+	return reply, true
+}
+
+// reply creates a reply offering the client its boot file URL, returning false if the
+// client isn't a network boot client, the message isn't for us, or there is nothing to
+// offer it
+func (s *ProxyServerV6) reply(p *PacketV6, addr net.Addr) (*PacketV6, bool) {
+	var replyType MessageTypeV6
+
+	switch p.Type {
+	case MessageTypeV6Solicit:
+		replyType = MessageTypeV6Advertise
+	case MessageTypeV6Request:
+		// Requests name the server whose advertisement the client chose
+		if serverID, ok := p.Option(OptionV6ServerID); !ok || !bytes.Equal(serverID, s.serverID) {
+			return nil, false
+		}
+
+		replyType = MessageTypeV6Reply
+	case MessageTypeV6InformationRequest:
+		replyType = MessageTypeV6Reply
+	default:
+		return nil, false
+	}
+
+	arch, ok := p.ClientArch()
+	if !ok {
+		return nil, false
+	}
+
+	mac := p.ClientMAC()
+	uuid := p.ClientUUID()
+
+	var ip net.IP
+	if udpAddr, ok := addr.(*net.UDPAddr); ok && !udpAddr.IP.IsLinkLocalUnicast() {
+		ip = udpAddr.IP
+	}
+
+	if !s.access.Allowed(ip, mac) {
+		s.logger.Debug("ignoring DHCPv6 request from client denied by access rules",
+			"mac", mac.String(),
+		)
+
+		return nil, false
+	}
+
+	s.clients.Observe(ip, mac, uuid)
+
+	vendorClass := vendorClassDataV6(p)
+	clientQuirks, matched := s.quirks.Match(mac, vendorClass, uint16(arch))
+	s.quirks.Remember(mac, clientQuirks)
+
+	logger := s.logger.With(
+		"mac", mac.String(),
+		"uuid", uuid,
+		"arch", arch.String(),
+	)
+
+	if len(matched) > 0 {
+		logger = logger.With("quirks", matched)
+	}
+
+	bootURL, ok := s.bootFileURL(arch, clientQuirks.BootFile, mac, uuid, ip)
+	if !ok {
+		logger.Debug("ignoring network boot client with no boot file for its architecture")
+		return nil, false
+	}
+
+	// HTTP boot clients only accept offers with their own vendor class
+	replyClass := pxeVendorClass
+	if arch.IsHTTP() {
+		replyClass = httpVendorClass
+	}
+
+	reply := p.Reply(replyType)
+	reply.AddOption(OptionV6ServerID, s.serverID)
+	reply.AddOption(OptionV6VendorClass, vendorClassV6(pxeEnterpriseNumber, replyClass))
+	reply.AddOption(OptionV6BootFileURL, []byte(bootURL))
+
+	logger.Info("offering boot file URL to network boot client",
+		"url", bootURL,
+	)
+
+	event := audit.Event{Type: audit.EventDHCPOffer, Detail: bootURL}
+	event.SetClient(mac, uuid, ip)
+	s.events.Record(event)
+
+	return reply, true
+}
+
+// bootFileURL returns the URL of the boot file for the client, which is the given
+// override if set: HTTP boot clients are given an HTTP URL, and others a TFTP URL
+func (s *ProxyServerV6) bootFileURL(arch ClientArch, bootFile string, mac net.HardwareAddr, uuid string, ip net.IP) (string, bool) {
+	if bootFile == "" {
+		machine, ok := arch.Machine()
+		if !ok {
+			return "", false
+		}
+
+		if bootFile, ok = s.bootFiles.BootFile(machine, mac, uuid, ip); !ok {
+			return "", false
+		}
+	}
+
+	if arch.IsHTTP() {
+		return s.http.fileURL(s.serverIP, bootFile), true
+	}
+
+	u := &url.URL{
+		Scheme: "tftp",
+		Host:   net.JoinHostPort(s.serverIP.String(), s.tftpPort),
+		Path:   "/" + strings.TrimPrefix(bootFile, "/"),
+	}
+
+	return u.String(), true
+}
+
+// vendorClassDataV6 returns the first vendor class data item of the client's vendor
+// class option, e.g. "PXEClient:Arch:00007:UNDI:003016", or an empty string if absent
+func vendorClassDataV6(p *PacketV6) string {
+	// Enterprise number, then items each prefixed with their length
+	data, ok := p.Option(OptionV6VendorClass)
+	if !ok || len(data) < 6 {
+		return ""
+	}
+
+	length := int(binary.BigEndian.Uint16(data[4:]))
+	if len(data)-6 < length {
+		return ""
+	}
+
+	return string(data[6 : 6+length])
+}
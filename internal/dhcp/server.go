@@ -0,0 +1,439 @@
+package dhcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/davejbax/pixie/internal/acl"
+	"github.com/davejbax/pixie/internal/audit"
+	"github.com/davejbax/pixie/internal/clients"
+	"github.com/davejbax/pixie/internal/netif"
+	"github.com/davejbax/pixie/internal/quirks"
+	"github.com/davejbax/pixie/internal/sockets"
+)
+
+// How long an offered address is held for, waiting for the client to request it
+const offerHoldTime = time.Minute
+
+var (
+	errInvalidAddress = errors.New("invalid IPv4 address")
+	errInvalidRange   = errors.New("range start must not be after range end")
+	errInvalidMAC     = errors.New("invalid MAC address")
+)
+
+// Config configures the authoritative DHCP server
+type Config struct {
+	// Whether to run the DHCP server. This should only be enabled on networks without
+	// another DHCP server.
+	Enabled bool
+
+	Address string `default:":67"`
+
+	// Network interface to bind to, e.g. a VLAN interface, so that only broadcasts on it
+	// are answered. Only supported on Linux.
+	Interface string
+
+	// IPv4 address of pixie, given to clients as the DHCP and TFTP server. If empty,
+	// the first IPv4 address of the interface is used, or, without one, that of the
+	// interface each request arrives on.
+	ServerIP string `mapstructure:"server_ip"`
+
+	// Inclusive range of addresses to allocate dynamically. If empty, only clients with
+	// static leases are given addresses.
+	RangeStart string `mapstructure:"range_start"`
+	RangeEnd   string `mapstructure:"range_end"`
+
+	SubnetMask string   `mapstructure:"subnet_mask" default:"255.255.255.0"`
+	Router     string   `mapstructure:"router"`
+	DNSServers []string `mapstructure:"dns_servers"`
+	DomainName string   `mapstructure:"domain_name"`
+
+	LeaseTime time.Duration `mapstructure:"lease_time" default:"1h"`
+
+	// Fixed addresses for known clients, which are always given the same address
+	StaticLeases []StaticLease `mapstructure:"static_leases"`
+
+	// Boot file to offer legacy BIOS clients. If empty, BIOS clients are given an
+	// address but no boot file.
+	BIOSBootFile string `mapstructure:"bios_boot_file"`
+}
+
+// StaticLease is a fixed address for a client
+type StaticLease struct {
+	MAC      string
+	IP       string
+	Hostname string
+}
+
+// Server is an authoritative DHCP server, which allocates addresses from a pool (or
+// static leases), and offers PXE clients their boot files
+type Server struct {
+	logger *slog.Logger
+	config *Config
+
+	address *serverAddress
+	options map[OptionCode][]byte
+	static  map[string]*StaticLease
+	pool    *pool
+	leases  *LeaseStore
+	boot    *bootOptions
+	access  *acl.List
+}
+
+// NewServer creates a DHCP server, storing dynamic leases in the given store. PXE
+// clients are offered the given boot file paths according to their architecture, and
+// are recorded in the given registry. HTTP boot clients are offered the same files on
+// the given HTTP server, if any. Only clients allowed by the given access list,
+// which may be nil, are answered. Unless a server IP or interface is configured,
+// clients are told the address in the interfaces table (which may be nil) of the
+// interface that their request arrives on.
+func NewServer(logger *slog.Logger, config *Config, leases *LeaseStore, bootFiles BootFiles, http *HTTPServer, quirks *quirks.Table, registry *clients.Registry, events *audit.Log, access *acl.List, interfaces *netif.Table) (*Server, error) {
+	address, err := newServerAddress(config.ServerIP, config.Interface, interfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := networkOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	static := make(map[string]*StaticLease, len(config.StaticLeases))
+	reserved := make(map[string]struct{}, len(config.StaticLeases))
+
+	for i := range config.StaticLeases {
+		lease := &config.StaticLeases[i]
+
+		mac, err := net.ParseMAC(lease.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("static lease %d: '%s': %w", i, lease.MAC, errInvalidMAC)
+		}
+
+		ip, err := parseIPv4(lease.IP)
+		if err != nil {
+			return nil, fmt.Errorf("static lease for '%s': %w", lease.MAC, err)
+		}
+
+		static[mac.String()] = lease
+		reserved[ip.String()] = struct{}{}
+	}
+
+	var addressPool *pool
+	if config.RangeStart != "" || config.RangeEnd != "" {
+		addressPool, err = newPool(config.RangeStart, config.RangeEnd, reserved)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Server{
+		logger:  logger,
+		config:  config,
+		address: address,
+		options: options,
+		static:  static,
+		pool:    addressPool,
+		leases:  leases,
+		access:  access,
+		boot: &bootOptions{
+			logger:       logger,
+			bootFiles:    bootFiles,
+			biosBootFile: config.BIOSBootFile,
+			quirks:       quirks,
+			clients:      registry,
+			events:       events,
+			http:         http,
+		},
+	}, nil
+}
+
+func parseIPv4(s string) (net.IP, error) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("'%s': %w", s, errInvalidAddress)
+	}
+
+	return ip, nil
+}
+
+func newPool(start string, end string, reserved map[string]struct{}) (*pool, error) {
+	startIP, err := parseIPv4(start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range start: %w", err)
+	}
+
+	endIP, err := parseIPv4(end)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range end: %w", err)
+	}
+
+	p := &pool{
+		start:    binary.BigEndian.Uint32(startIP),
+		end:      binary.BigEndian.Uint32(endIP),
+		reserved: reserved,
+	}
+
+	if p.start > p.end {
+		return nil, errInvalidRange
+	}
+
+	return p, nil
+}
+
+// networkOptions returns the options describing the network, which are sent to all clients
+func networkOptions(config *Config) (map[OptionCode][]byte, error) {
+	options := make(map[OptionCode][]byte)
+
+	mask, err := parseIPv4(config.SubnetMask)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet mask: %w", err)
+	}
+
+	options[OptionSubnetMask] = mask
+
+	if config.Router != "" {
+		router, err := parseIPv4(config.Router)
+		if err != nil {
+			return nil, fmt.Errorf("invalid router: %w", err)
+		}
+
+		options[OptionRouter] = router
+	}
+
+	if len(config.DNSServers) > 0 {
+		servers := make([]byte, 0, net.IPv4len*len(config.DNSServers))
+		for _, server := range config.DNSServers {
+			ip, err := parseIPv4(server)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DNS server: %w", err)
+			}
+
+			servers = append(servers, ip...)
+		}
+
+		options[OptionDomainNameServer] = servers
+	}
+
+	if config.DomainName != "" {
+		options[OptionDomainName] = []byte(config.DomainName)
+	}
+
+	leaseTime := uint32(config.LeaseTime.Seconds())
+	options[OptionLeaseTime] = binary.BigEndian.AppendUint32(nil, leaseTime)
+	options[OptionRenewalTime] = binary.BigEndian.AppendUint32(nil, leaseTime/2)
+	options[OptionRebindingTime] = binary.BigEndian.AppendUint32(nil, leaseTime/8*7)
+
+	return options, nil
+}
+
+// ListenAndServe listens on the configured address and serves requests until the
+// context is cancelled
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	conn, err := sockets.ListenPacket("udp4", s.config.Address, s.config.Interface)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	return s.Serve(ctx, conn)
+}
+
+// Serve serves requests received on the given connection until the context is cancelled
+func (s *Server) Serve(ctx context.Context, packetConn net.PacketConn) error {
+	conn := newConn(packetConn)
+
+	s.logger.Info("DHCP server listening",
+		"address", conn.LocalAddr().String(),
+		"server_ip", s.address.ip.String(),
+		"per_interface", s.address.interfaces != nil,
+	)
+
+	return serveConn(ctx, conn, func(p *Packet, addr net.Addr, ifIndex int) {
+		if clientAllowed(s.logger, s.access, p, addr) {
+			s.handle(conn, p, ifIndex)
+		}
+	})
+}
+
+// handle answers a request that arrived on the interface with the given index, through
+// the same interface
+func (s *Server) handle(conn *conn, p *Packet, ifIndex int) {
+	logger := s.logger.With("mac", p.CHAddr.String())
+	serverIP := s.address.on(ifIndex)
+
+	var reply *Packet
+	var err error
+
+	switch p.MessageType() {
+	case MessageTypeDiscover:
+		reply, err = s.handleDiscover(p, serverIP)
+	case MessageTypeRequest:
+		reply, err = s.handleRequest(p, serverIP)
+	case MessageTypeInform:
+		reply = s.reply(p, MessageTypeAck, nil, p.CIAddr, serverIP)
+	case MessageTypeRelease:
+		if _, ok := s.static[p.CHAddr.String()]; !ok {
+			err = s.leases.release(p.CHAddr, p.CIAddr)
+		}
+	case MessageTypeDecline:
+		if requested := net.IP(p.Options[OptionRequestedIP]); len(requested) == net.IPv4len {
+			var declined bool
+			declined, err = s.leases.decline(p.CHAddr, requested, s.config.LeaseTime)
+			if declined {
+				logger.Warn("client declined address as it is already in use",
+					"ip", requested.String(),
+				)
+			}
+		}
+	default:
+	}
+
+	if err != nil {
+		logger.Error("failed to handle DHCP request",
+			"error", err,
+		)
+		return
+	}
+
+	if reply == nil {
+		return
+	}
+
+	dest := s.destination(p, reply)
+	if err := conn.writeTo(reply.Marshal(), dest, ifIndex); err != nil {
+		logger.Warn("failed to send DHCP reply",
+			"client", dest.String(),
+			"error", err,
+		)
+	}
+}
+
+func (s *Server) handleDiscover(p *Packet, serverIP net.IP) (*Packet, error) {
+	ip, lease, err := s.allocate(p, offerHoldTime)
+	if errors.Is(err, errPoolExhausted) {
+		s.logger.Warn("no address available for DHCP client",
+			"mac", p.CHAddr.String(),
+		)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return s.reply(p, MessageTypeOffer, lease, ip, serverIP), nil
+}
+
+func (s *Server) handleRequest(p *Packet, serverIP net.IP) (*Packet, error) {
+	// Clients that selected another server's offer tell us by naming that server
+	if serverID := net.IP(p.Options[OptionServerIdentifier]); len(serverID) > 0 && !serverID.Equal(serverIP) {
+		if requested := net.IP(p.Options[OptionRequestedIP]); len(requested) == net.IPv4len {
+			return nil, s.leases.release(p.CHAddr, requested)
+		}
+
+		return nil, nil
+	}
+
+	requested := net.IP(p.Options[OptionRequestedIP])
+	if len(requested) != net.IPv4len {
+		// Renewing or rebinding clients put their address in ciaddr instead
+		requested = p.CIAddr
+	}
+
+	if lease, ok := s.static[p.CHAddr.String()]; ok {
+		if !requested.Equal(net.ParseIP(lease.IP)) {
+			return s.nak(p, serverIP), nil
+		}
+
+		return s.reply(p, MessageTypeAck, lease, requested, serverIP), nil
+	}
+
+	ok, err := s.leases.confirm(p.CHAddr, requested, string(p.Options[OptionHostName]), s.config.LeaseTime)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		s.logger.Info("refusing DHCP request for address not leased to client",
+			"mac", p.CHAddr.String(),
+			"ip", requested.String(),
+		)
+		return s.nak(p, serverIP), nil
+	}
+
+	s.logger.Info("leased address to DHCP client",
+		"mac", p.CHAddr.String(),
+		"ip", requested.String(),
+	)
+
+	return s.reply(p, MessageTypeAck, nil, requested, serverIP), nil
+}
+
+// allocate finds an address for the client, returning its static lease if it has one
+func (s *Server) allocate(p *Packet, hold time.Duration) (net.IP, *StaticLease, error) {
+	if lease, ok := s.static[p.CHAddr.String()]; ok {
+		return net.ParseIP(lease.IP).To4(), lease, nil
+	}
+
+	if s.pool == nil {
+		return nil, nil, errPoolExhausted
+	}
+
+	ip, err := s.leases.allocate(p.CHAddr, net.IP(p.Options[OptionRequestedIP]), s.pool, hold)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to allocate address: %w", err)
+	}
+
+	return ip, nil, nil
+}
+
+// reply creates a reply from the server at serverIP, giving the client the address ip
+func (s *Server) reply(p *Packet, messageType MessageType, lease *StaticLease, ip net.IP, serverIP net.IP) *Packet {
+	reply := p.Reply(messageType)
+	reply.SIAddr = serverIP
+	reply.Options[OptionServerIdentifier] = serverIP
+
+	if messageType == MessageTypeAck && p.MessageType() == MessageTypeInform {
+		// Informing clients already have an address, so get no lease
+		reply.CIAddr = p.CIAddr
+	} else {
+		reply.YIAddr = ip
+		for code, value := range s.options {
+			reply.Options[code] = value
+		}
+	}
+
+	if lease != nil && lease.Hostname != "" {
+		hostname, _, _ := strings.Cut(lease.Hostname, ".")
+		reply.Options[OptionHostName] = []byte(hostname)
+	}
+
+	// Non-PXE clients simply get no boot options
+	_ = s.boot.apply(p, reply, ip, serverIP)
+
+	return reply
+}
+
+func (s *Server) nak(p *Packet, serverIP net.IP) *Packet {
+	reply := p.Reply(MessageTypeNak)
+	reply.Options[OptionServerIdentifier] = serverIP
+	return reply
+}
+
+// destination returns the address to send a reply to (RFC 2131 section 4.1)
+func (s *Server) destination(p *Packet, reply *Packet) *net.UDPAddr {
+	if !p.GIAddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: p.GIAddr, Port: serverPort}
+	}
+
+	if reply.MessageType() != MessageTypeNak && !p.CIAddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: p.CIAddr, Port: clientPort}
+	}
+
+	// Unicasting to yiaddr would require adding an ARP entry for the client, so we
+	// always broadcast to clients without an address
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: clientPort}
+}
@@ -0,0 +1,363 @@
+package dhcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/davejbax/pixie/pkg/efipe"
+)
+
+// Formats of the config snippets that point another DHCP server's PXE clients at pixie
+const (
+	SnippetDnsmasq = "dnsmasq"
+	SnippetISC     = "isc"
+	SnippetKea     = "kea"
+)
+
+// Architecture types that pixie has boot files for, as sent in option 93, in the order
+// that snippets list them
+var snippetArches = []ClientArch{
+	ClientArchEFIIA32,
+	ClientArchEFIBC,
+	ClientArchEFIX64,
+	ClientArchEFIARM32,
+	ClientArchEFIARM64,
+	ClientArchEFIX86HTTP,
+	ClientArchEFIX64HTTP,
+	ClientArchEFIARM32HTTP,
+	ClientArchEFIARM64HTTP,
+}
+
+var errUnknownSnippetFormat = errors.New("unknown DHCP config format")
+
+// Snippet is the configuration that another DHCP server needs for its PXE clients to
+// boot from pixie, as pixie's own DHCP and ProxyDHCP servers would offer them
+type Snippet struct {
+	// IPv4 address of pixie's TFTP server
+	ServerIP net.IP
+
+	// Base URL of pixie's HTTP server, which UEFI HTTP boot clients are offered URLs on
+	BaseURL string
+
+	// Boot file for each machine type, and for legacy BIOS clients, if there is one
+	BootFiles    map[efipe.Machine]string
+	BIOSBootFile string
+
+	// Hosts whose GRUB profile has its own boot files
+	Profiles []*SnippetProfile
+}
+
+// SnippetProfile is a GRUB profile, and the MAC addresses of the hosts selecting it
+type SnippetProfile struct {
+	Name      string
+	MACs      []net.HardwareAddr
+	BootFiles map[efipe.Machine]string
+}
+
+// snippetClass is a class of clients offered the same boot file: those of the
+// architecture types in Arches, and, for profiles, with one of the profile's MAC
+// addresses
+type snippetClass struct {
+	Name   string
+	Arches []ClientArch
+	HTTP   bool
+
+	Profile string
+	MACs    []net.HardwareAddr
+
+	// Whether hosts with GRUB profiles are left out, as they have classes of their own
+	ExcludeProfiled bool
+
+	// TFTP path, or URL for HTTP clients
+	File string
+}
+
+// Write writes the snippet in the given format
+func (s *Snippet) Write(w io.Writer, format string) error {
+	switch format {
+	case SnippetDnsmasq:
+		return s.writeDnsmasq(w)
+	case SnippetISC:
+		return s.writeISC(w)
+	case SnippetKea:
+		return s.writeKea(w)
+	default:
+		return fmt.Errorf("'%s': %w", format, errUnknownSnippetFormat)
+	}
+}
+
+// classes returns the classes of clients offered each boot file, with those of hosts
+// with GRUB profiles first, and legacy BIOS clients (which profiles don't apply to) last
+func (s *Snippet) classes() []*snippetClass {
+	classes := []*snippetClass{}
+
+	for _, profile := range s.Profiles {
+		for _, class := range s.archClasses("pixie-"+profile.Name+"-", profile.BootFiles) {
+			class.Profile = profile.Name
+			class.MACs = profile.MACs
+			classes = append(classes, class)
+		}
+	}
+
+	for _, class := range s.archClasses("pixie-", s.BootFiles) {
+		class.ExcludeProfiled = len(s.Profiles) > 0
+		classes = append(classes, class)
+	}
+
+	if s.BIOSBootFile != "" {
+		classes = append(classes, &snippetClass{
+			Name:   "pixie-bios",
+			Arches: []ClientArch{ClientArchBIOS},
+			File:   s.BIOSBootFile,
+		})
+	}
+
+	return classes
+}
+
+// archClasses returns a class for each architecture that has a boot file, and for UEFI
+// HTTP boot clients of the architecture
+func (s *Snippet) archClasses(prefix string, bootFiles map[efipe.Machine]string) []*snippetClass {
+	classes := []*snippetClass{}
+	byName := make(map[string]*snippetClass)
+
+	for _, arch := range snippetArches {
+		machine, _ := arch.Machine()
+
+		bootFile, ok := bootFiles[machine]
+		if !ok {
+			continue
+		}
+
+		name := prefix + arch.String()
+		file := bootFile
+
+		if arch.IsHTTP() {
+			name += "-http"
+			file = strings.TrimSuffix(s.BaseURL, "/") + "/" + bootFile
+		}
+
+		if class, ok := byName[name]; ok {
+			class.Arches = append(class.Arches, arch)
+			continue
+		}
+
+		class := &snippetClass{Name: name, Arches: []ClientArch{arch}, HTTP: arch.IsHTTP(), File: file}
+		byName[name] = class
+		classes = append(classes, class)
+	}
+
+	return classes
+}
+
+// profiledMACs returns the MAC addresses of every host with a GRUB profile
+func (s *Snippet) profiledMACs() []net.HardwareAddr {
+	macs := []net.HardwareAddr{}
+	for _, profile := range s.Profiles {
+		macs = append(macs, profile.MACs...)
+	}
+
+	return macs
+}
+
+func (s *Snippet) writeDnsmasq(w io.Writer) error {
+	lines := []string{
+		"# PXE boot from pixie, generated by 'pixie dhcp-config dnsmasq'",
+		"# Clients are tagged by their architecture (option 93), and offered its boot file",
+	}
+
+	// Hosts with GRUB profiles are tagged with their profile
+	for _, profile := range s.Profiles {
+		for _, mac := range profile.MACs {
+			lines = append(lines,
+				"dhcp-mac=set:pixie-profiled,"+mac.String(),
+				"dhcp-mac=set:pixie-profile-"+profile.Name+","+mac.String(),
+			)
+		}
+	}
+
+	for _, class := range s.classes() {
+		lines = append(lines, "")
+
+		for _, arch := range class.Arches {
+			lines = append(lines, fmt.Sprintf("dhcp-match=set:%s,option:client-arch,%d", class.Name, arch))
+		}
+
+		tags := "tag:" + class.Name
+		if class.Profile != "" {
+			tags += ",tag:pixie-profile-" + class.Profile
+		} else if class.ExcludeProfiled {
+			tags += ",tag:!pixie-profiled"
+		}
+
+		if class.HTTP {
+			lines = append(lines,
+				fmt.Sprintf("dhcp-option-force=%s,option:vendor-class,%s", tags, httpVendorClass),
+				fmt.Sprintf("dhcp-boot=%s,%s", tags, class.File),
+			)
+
+			continue
+		}
+
+		lines = append(lines, fmt.Sprintf("dhcp-boot=%s,%s,,%s", tags, class.File, s.ServerIP))
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+
+	return err //nolint:wrapcheck
+}
+
+func (s *Snippet) writeISC(w io.Writer) error {
+	lines := []string{
+		"# PXE boot from pixie, generated by 'pixie dhcp-config isc'",
+		"# Option 93 may already be declared under another name, which can be used instead",
+		"option pixie-client-arch code 93 = unsigned integer 16;",
+	}
+
+	profiled := s.profiledMACs()
+
+	for _, class := range s.classes() {
+		arches := make([]string, 0, len(class.Arches))
+		for _, arch := range class.Arches {
+			arches = append(arches, fmt.Sprintf("option pixie-client-arch = %d", arch))
+		}
+
+		vendorClass := pxeVendorClass
+		if class.HTTP {
+			vendorClass = httpVendorClass
+		}
+
+		conditions := []string{
+			fmt.Sprintf(`substring(option vendor-class-identifier, 0, %d) = "%s"`, len(vendorClass), vendorClass),
+			"(" + strings.Join(arches, " or ") + ")",
+		}
+
+		if class.Arches[0] == ClientArchBIOS {
+			// Legacy BIOS clients may not send option 93 at all
+			conditions[1] = "(not exists pixie-client-arch or option pixie-client-arch = 0)"
+		}
+
+		if class.Profile != "" {
+			conditions = append(conditions, "("+iscMACs(class.MACs)+")")
+		} else if class.ExcludeProfiled {
+			conditions = append(conditions, "not ("+iscMACs(profiled)+")")
+		}
+
+		lines = append(lines,
+			"",
+			fmt.Sprintf(`class "%s" {`, class.Name),
+			"  match if "+strings.Join(conditions, " and ")+";",
+		)
+
+		if class.HTTP {
+			lines = append(lines, fmt.Sprintf(`  option vendor-class-identifier "%s";`, httpVendorClass))
+		} else {
+			lines = append(lines, fmt.Sprintf("  next-server %s;", s.ServerIP))
+		}
+
+		lines = append(lines,
+			fmt.Sprintf(`  filename "%s";`, class.File),
+			"}",
+		)
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+
+	return err //nolint:wrapcheck
+}
+
+// iscMACs returns an ISC dhcpd expression matching clients with any of the MAC addresses
+func iscMACs(macs []net.HardwareAddr) string {
+	matches := make([]string, 0, len(macs))
+	for _, mac := range macs {
+		matches = append(matches, "hardware = 01:"+mac.String())
+	}
+
+	return strings.Join(matches, " or ")
+}
+
+// keaClass is a client class in Kea's DHCPv4 config
+type keaClass struct {
+	Name         string          `json:"name"`
+	Test         string          `json:"test"`
+	NextServer   string          `json:"next-server,omitempty"`
+	BootFileName string          `json:"boot-file-name,omitempty"`
+	OptionData   []keaOptionData `json:"option-data,omitempty"`
+}
+
+type keaOptionData struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+func (s *Snippet) writeKea(w io.Writer) error {
+	classes := []*keaClass{}
+
+	// Hosts with GRUB profiles are grouped, so that the other classes can exclude them
+	profiled := s.profiledMACs()
+	if len(profiled) > 0 {
+		classes = append(classes, &keaClass{Name: "pixie-profiled", Test: keaMACs(profiled)})
+	}
+
+	for _, class := range s.classes() {
+		arches := make([]string, 0, len(class.Arches))
+		for _, arch := range class.Arches {
+			arches = append(arches, fmt.Sprintf("option[93].hex == 0x%04x", uint16(arch)))
+		}
+
+		vendorClass := pxeVendorClass
+		if class.HTTP {
+			vendorClass = httpVendorClass
+		}
+
+		conditions := []string{
+			fmt.Sprintf("substring(option[60].hex, 0, %d) == '%s'", len(vendorClass), vendorClass),
+			"(" + strings.Join(arches, " or ") + ")",
+		}
+
+		if class.Arches[0] == ClientArchBIOS {
+			// Legacy BIOS clients may not send option 93 at all
+			conditions[1] = "(not option[93].exists or option[93].hex == 0x0000)"
+		}
+
+		if class.Profile != "" {
+			conditions = append(conditions, "("+keaMACs(class.MACs)+")")
+		} else if class.ExcludeProfiled {
+			conditions = append(conditions, "not member('pixie-profiled')")
+		}
+
+		kea := &keaClass{Name: class.Name, Test: strings.Join(conditions, " and "), BootFileName: class.File}
+
+		if class.HTTP {
+			kea.OptionData = []keaOptionData{{Name: "vendor-class-identifier", Data: httpVendorClass}}
+		} else {
+			kea.NextServer = s.ServerIP.String()
+		}
+
+		classes = append(classes, kea)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+
+	return encoder.Encode(map[string]any{ //nolint:wrapcheck
+		"Dhcp4": map[string]any{
+			"client-classes": classes,
+		},
+	})
+}
+
+// keaMACs returns a Kea expression matching clients with any of the MAC addresses
+func keaMACs(macs []net.HardwareAddr) string {
+	matches := make([]string, 0, len(macs))
+	for _, mac := range macs {
+		matches = append(matches, "pkt4.mac == 0x"+strings.ReplaceAll(mac.String(), ":", ""))
+	}
+
+	return strings.Join(matches, " or ")
+}
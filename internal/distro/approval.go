@@ -0,0 +1,128 @@
+package distro
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"time"
+)
+
+// holdUpdates returns the downloaders for the distro's arches, with newer versions that
+// haven't been approved replaced by the versions already downloaded, if the distro's
+// updates must be approved. If record is true, newer versions are recorded in the
+// distro's history, so that they're reported until they're approved. Arches that are
+// pinned, or that haven't been downloaded yet, are left alone.
+func (m *Manager) holdUpdates(name string, downloaders map[string]downloader, pinned map[string]string, record bool) (map[string]downloader, error) {
+	if !m.manualUpdates[name] {
+		return downloaders, nil
+	}
+
+	// Downloaders may be shared through the mirror cache, so the map isn't changed
+	held := maps.Clone(downloaders)
+
+	for arch, latest := range downloaders {
+		if _, ok := pinned[arch]; ok {
+			continue
+		}
+
+		if _, ok := latest.(*knownVersion); ok {
+			continue
+		}
+
+		directory := path.Join(name, arch)
+
+		known, err := m.holdUpdate(name, directory, latest, record)
+		if err != nil {
+			return nil, fmt.Errorf("distro '%s' (%s): %w", name, arch, err)
+		}
+
+		if known != nil {
+			held[arch] = known
+		}
+	}
+
+	return held, nil
+}
+
+// holdUpdate returns the version that the distro in directory is kept at, if the latest
+// version hasn't been approved, or else nil
+func (m *Manager) holdUpdate(name string, directory string, latest downloader, record bool) (*knownVersion, error) {
+	active, err := readMetadata(m.artifacts, path.Join(directory, metadataFilename))
+	if err != nil || active == nil {
+		return nil, err
+	}
+
+	h, err := readHistory(m.artifacts, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	drifted, err := latest.HasDrifted(active)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check distro drift: %w", err)
+	}
+
+	if !drifted || h.Approved == latest.Hash() {
+		return nil, nil
+	}
+
+	if record && (h.Available == nil || h.Available.Hash != latest.Hash()) {
+		m.logger.Info("new version of distro is available, and awaits approval",
+			"distro", name,
+			"directory", directory,
+			"hash", latest.Hash(),
+		)
+
+		h.Available = &availableVersion{Hash: latest.Hash(), Detected: time.Now()}
+		if err := writeHistory(m.artifacts, directory, h); err != nil {
+			return nil, err
+		}
+	}
+
+	// A version staged before it had to be approved is still activated
+	staged, err := readMetadata(m.artifacts, path.Join(directory, stagedMetadataFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	if staged != nil {
+		return &knownVersion{hash: staged.Hash, available: latest.Hash()}, nil
+	}
+
+	return &knownVersion{hash: active.Hash, available: latest.Hash()}, nil
+}
+
+// Approve lets reconciles download and activate the newer versions of the distro's
+// arches (or the given arch) awaiting approval, returning the approved hashes by arch.
+// The versions are activated by the next reconcile, subject to maintenance windows, and
+// unless the distro is pinned.
+func (m *Manager) Approve(name string, arch string) (map[string]string, error) {
+	arches, err := m.configuredArches(name, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	approved := make(map[string]string)
+
+	for _, arch := range arches {
+		directory := path.Join(name, arch)
+
+		h, err := readHistory(m.artifacts, directory)
+		if err != nil {
+			return nil, fmt.Errorf("distro '%s' (%s): %w", name, arch, err)
+		}
+
+		if h.Available == nil {
+			continue
+		}
+
+		h.Approved = h.Available.Hash
+		if err := writeHistory(m.artifacts, directory, h); err != nil {
+			return nil, fmt.Errorf("distro '%s' (%s): %w", name, arch, err)
+		}
+
+		approved[arch] = h.Approved
+	}
+
+	return approved, nil
+}
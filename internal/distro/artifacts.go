@@ -0,0 +1,231 @@
+package distro
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const artifactsTreeDirectory = "tree"
+
+var (
+	bsdChecksumLine = regexp.MustCompile(`^SHA256 \((.+)\) = ([0-9a-fA-F]{64})$`)
+
+	errChecksumMismatch = errors.New("checksum of downloaded file does not match")
+	errNoChecksum       = errors.New("no published checksum for file")
+	errUnknownSize      = errors.New("server did not give the size of file")
+)
+
+// artifactFile is a boot artifact published at a URL
+type artifactFile struct {
+	url string
+
+	// Name of the downloaded file
+	name string
+
+	// Expected SHA-256 checksum of the file, in hex, if published
+	sha256 string
+}
+
+// artifactDownloader downloads the published boot artifacts of an image-based OS
+// release: a kernel, an initrd, and any files served from its tree
+type artifactDownloader struct {
+	fetchOptions
+
+	logger *slog.Logger
+	client *http.Client
+	hash   string
+
+	kernel artifactFile
+	initrd artifactFile
+	tree   []artifactFile
+
+	// Whether the kernel is a loader that is chainloaded. Chainloaded loaders have no
+	// initrd.
+	chainload bool
+}
+
+// artifactsHash identifies a release by the URLs and checksums of its artifacts
+func artifactsHash(files ...artifactFile) string {
+	h := sha256.New()
+	for _, file := range files {
+		fmt.Fprintf(h, "%s\n%s\n%s\n", file.url, file.name, file.sha256)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (d *artifactDownloader) Hash() string {
+	return d.hash
+}
+
+func (d *artifactDownloader) HasDrifted(meta *metadata) (bool, error) {
+	return meta.Hash != d.hash, nil
+}
+
+func (d *artifactDownloader) Download(directory string) (*metadata, error) {
+	meta := &metadata{
+		Hash:       d.hash,
+		KernelPath: d.kernel.name,
+		Chainload:  d.chainload,
+	}
+
+	if err := d.download(d.kernel, filepath.Join(directory, d.kernel.name)); err != nil {
+		return nil, fmt.Errorf("failed to download kernel: %w", err)
+	}
+
+	if !d.chainload {
+		meta.InitrdPath = d.initrd.name
+
+		if err := d.download(d.initrd, filepath.Join(directory, d.initrd.name)); err != nil {
+			return nil, fmt.Errorf("failed to download initrd: %w", err)
+		}
+	}
+
+	if len(d.tree) > 0 {
+		meta.TreePath = artifactsTreeDirectory
+
+		treeDirectory := filepath.Join(directory, artifactsTreeDirectory)
+		if err := os.MkdirAll(treeDirectory, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create directories in path '%s': %w", treeDirectory, err)
+		}
+
+		for _, file := range d.tree {
+			if err := d.download(file, filepath.Join(treeDirectory, file.name)); err != nil {
+				return nil, fmt.Errorf("failed to download '%s': %w", file.name, err)
+			}
+		}
+	}
+
+	return meta, nil
+}
+
+func (d *artifactDownloader) DownloadSize() (int64, error) {
+	files := []artifactFile{d.kernel}
+	if !d.chainload {
+		files = append(files, d.initrd)
+	}
+
+	files = append(files, d.tree...)
+
+	size := int64(0)
+	for _, file := range files {
+		length, err := contentLength(d.client, file.url)
+		if err != nil {
+			return 0, err
+		}
+
+		size += length
+	}
+
+	return size, nil
+}
+
+// download fetches the file to output, checking its checksum if one is known
+func (d *artifactDownloader) download(file artifactFile, output string) error {
+	out, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer out.Close()
+
+	if err := d.fetch(d.logger, d.client, file.url, out, "downloading boot artifact"); err != nil {
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %w", err)
+	}
+
+	// Files downloaded in ranges are only whole once every range is written, so the
+	// checksum is taken from the file rather than as it's downloaded
+	if file.sha256 != "" {
+		checksum, err := fileChecksum(output)
+		if err != nil {
+			return err
+		}
+
+		if checksum != file.sha256 {
+			return fmt.Errorf("'%s': %w", file.url, errChecksumMismatch)
+		}
+	}
+
+	return nil
+}
+
+// contentLength finds the size of the file at a URL with a HEAD request
+func contentLength(client *http.Client, url string) (int64, error) {
+	resp, err := client.Head(url)
+	if err != nil {
+		return 0, fmt.Errorf("HEAD failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, newHTTPError(resp)
+	}
+
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("'%s': %w", url, errUnknownSize)
+	}
+
+	return resp.ContentLength, nil
+}
+
+// getBSDChecksums fetches a BSD-style checksum file, with lines such as
+// 'SHA256 (bsd.rd) = <hex>', returning the SHA-256 checksum of each file by name
+func getBSDChecksums(client *http.Client, url string) (map[string]string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("GET failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHTTPError(resp)
+	}
+
+	checksums := make(map[string]string)
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		matches := bsdChecksumLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if matches != nil {
+			checksums[matches[1]] = strings.ToLower(matches[2])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", url, err)
+	}
+
+	return checksums, nil
+}
+
+// getJSON fetches and decodes a JSON document
+func getJSON(client *http.Client, url string, value any) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("GET failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHTTPError(resp)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+		return fmt.Errorf("failed to decode '%s': %w", url, err)
+	}
+
+	return nil
+}
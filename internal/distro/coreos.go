@@ -0,0 +1,142 @@
+package distro
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+const coreosRootfsName = "rootfs.img"
+
+var errCoreOSVersion = errors.New("Fedora CoreOS follows a stream, so set the 'stream' option rather than a version")
+
+// coreosArches maps arches to the names used in Fedora CoreOS stream metadata
+var coreosArches = map[string]string{
+	"x86_64":  "x86_64",
+	"amd64":   "x86_64",
+	"aarch64": "aarch64",
+	"arm64":   "aarch64",
+}
+
+// coreosProvider serves the live PXE images of Fedora CoreOS from a stream. The live
+// initramfs fetches its root file system from the tree, and Ignition fetches the host's
+// automation file.
+type coreosProvider struct {
+	fetchOptions
+
+	logger *slog.Logger
+	client *http.Client
+
+	streamURL string
+}
+
+type coreosOptions struct {
+	// Stream to follow: 'stable', 'testing' or 'next'
+	Stream string `mapstructure:"stream" default:"stable"`
+
+	// URL of the stream metadata, overriding the stream's URL, e.g. to use a local mirror
+	StreamURL string `mapstructure:"stream_url"`
+}
+
+// coreosStream is the subset of Fedora CoreOS stream metadata needed to PXE boot
+type coreosStream struct {
+	Architectures map[string]struct {
+		Artifacts struct {
+			Metal struct {
+				Release string `json:"release"`
+				Formats struct {
+					PXE struct {
+						Kernel    coreosArtifact `json:"kernel"`
+						Initramfs coreosArtifact `json:"initramfs"`
+						Rootfs    coreosArtifact `json:"rootfs"`
+					} `json:"pxe"`
+				} `json:"formats"`
+			} `json:"metal"`
+		} `json:"artifacts"`
+	} `json:"architectures"`
+}
+
+type coreosArtifact struct {
+	Location string `json:"location"`
+	SHA256   string `json:"sha256"`
+}
+
+func newCoreOS(logger *slog.Logger, version string, client *http.Client, opts *coreosOptions) (*coreosProvider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if version != "" {
+		return nil, errCoreOSVersion
+	}
+
+	streamURL := opts.StreamURL
+	if streamURL == "" {
+		streamURL = "https://builds.coreos.fedoraproject.org/streams/" + opts.Stream + ".json"
+	}
+
+	return &coreosProvider{
+		logger:    logger,
+		client:    client,
+		streamURL: streamURL,
+	}, nil
+}
+
+func (c *coreosProvider) Latest(arches []string) (map[string]downloader, error) {
+	var stream coreosStream
+	if err := getJSON(c.client, c.streamURL, &stream); err != nil {
+		return nil, fmt.Errorf("failed to get Fedora CoreOS stream metadata: %w", err)
+	}
+
+	downloaders := make(map[string]downloader, len(arches))
+
+	for _, arch := range arches {
+		coreosArch, ok := coreosArches[arch]
+		if !ok {
+			return nil, fmt.Errorf("Fedora CoreOS for arch '%s': %w", arch, errUnsupportedArch)
+		}
+
+		pxe := stream.Architectures[coreosArch].Artifacts.Metal.Formats.PXE
+		if pxe.Kernel.Location == "" || pxe.Initramfs.Location == "" || pxe.Rootfs.Location == "" {
+			return nil, fmt.Errorf("Fedora CoreOS stream has no PXE images for arch '%s': %w", arch, errUnsupportedArch)
+		}
+
+		kernel := artifactFile{url: pxe.Kernel.Location, name: "vmlinuz", sha256: pxe.Kernel.SHA256}
+		initrd := artifactFile{url: pxe.Initramfs.Location, name: "initramfs.img", sha256: pxe.Initramfs.SHA256}
+		rootfs := artifactFile{url: pxe.Rootfs.Location, name: coreosRootfsName, sha256: pxe.Rootfs.SHA256}
+
+		c.logger.Debug("found latest Fedora CoreOS release",
+			"arch", arch,
+			"release", stream.Architectures[coreosArch].Artifacts.Metal.Release,
+		)
+
+		downloaders[arch] = &artifactDownloader{
+			fetchOptions: c.fetchOptions,
+			logger:       c.logger,
+			client:       c.client,
+			hash:         artifactsHash(kernel, initrd, rootfs),
+			kernel:       kernel,
+			initrd:       initrd,
+			tree:         []artifactFile{rootfs},
+		}
+	}
+
+	return downloaders, nil
+}
+
+// The live root file system is fetched from the tree, which is given as the repo URL.
+// Ignition fetches the automation file on first boot.
+func (c *coreosProvider) installArgs(repoURL string, automationURL string) []string {
+	args := []string{"ignition.firstboot", "ignition.platform.id=metal"}
+
+	if repoURL != "" {
+		args = append(args, "coreos.live.rootfs_url="+repoURL+coreosRootfsName)
+	}
+
+	if automationURL != "" {
+		args = append(args, "ignition.config.url="+automationURL)
+	}
+
+	return args
+}
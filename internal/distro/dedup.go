@@ -0,0 +1,191 @@
+package distro
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Directory in the local artifact store that identical files of every distro version are
+// kept in once, named by their SHA-256 checksum
+const poolDirectory = ".pool"
+
+// fileID identifies a file's contents on disk, which hard links to it share
+type fileID struct {
+	device uint64
+	inode  uint64
+}
+
+// deduplicate replaces each file in the local directory of a downloaded version with a
+// hard link to the file in the pool with the same contents, adding the files that aren't
+// in the pool yet, so that files shared between versions (e.g. the same kernel in
+// consecutive point releases, or in a distro's netinstall and DVD flavours) are only
+// stored once. It returns the bytes saved.
+//
+// Files already in the pool are checked against their checksum before they're linked to,
+// so that a file corrupted on disk isn't linked into new versions; it's replaced in the
+// pool instead. Versions kept in an object store, and on systems without hard links, are
+// left as they are.
+func (m *Manager) deduplicate(local string) (int64, error) {
+	if m.quota == nil || !m.quota.Deduplicate {
+		return 0, nil
+	}
+
+	pool, ok := m.artifacts.LocalPath(poolDirectory)
+	if !ok {
+		return 0, nil
+	}
+
+	m.poolMu.Lock()
+	defer m.poolMu.Unlock()
+
+	pool = filepath.Join(pool, "sha256")
+	if err := os.MkdirAll(pool, 0o700); err != nil {
+		return 0, fmt.Errorf("failed to create directories in path '%s': %w", pool, err)
+	}
+
+	var saved int64
+
+	err := filepath.WalkDir(local, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		_, links, ok := fileLinks(info)
+		if !ok {
+			return filepath.SkipAll
+		}
+
+		// The file is already linked, e.g. to the pool by an earlier download
+		if links > 1 {
+			return nil
+		}
+
+		checksum, err := fileChecksum(name)
+		if err != nil {
+			return err
+		}
+
+		pooled := filepath.Join(pool, checksum)
+
+		matches, err := poolMatches(pooled, info.Size(), checksum)
+		if err != nil {
+			return err
+		}
+
+		if !matches {
+			if err := os.Remove(pooled); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to replace pooled file '%s': %w", pooled, err)
+			}
+
+			if err := os.Link(name, pooled); err != nil {
+				return fmt.Errorf("failed to add '%s' to pool: %w", name, err)
+			}
+
+			return nil
+		}
+
+		// The link is created beside the file, and renamed over it, so that the file is
+		// never missing
+		tmp := name + ".pool"
+		if err := os.Link(pooled, tmp); err != nil {
+			return fmt.Errorf("failed to link '%s' to pool: %w", name, err)
+		}
+
+		if err := os.Rename(tmp, name); err != nil {
+			_ = os.Remove(tmp)
+			return fmt.Errorf("failed to link '%s' to pool: %w", name, err)
+		}
+
+		saved += info.Size()
+
+		return nil
+	})
+	if err != nil {
+		return saved, fmt.Errorf("failed to deduplicate '%s': %w", local, err)
+	}
+
+	return saved, nil
+}
+
+// poolMatches returns whether the pooled file exists with the given size and checksum
+func poolMatches(pooled string, size int64, checksum string) (bool, error) {
+	info, err := os.Stat(pooled)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to stat pooled file: %w", err)
+	}
+
+	if info.Size() != size {
+		return false, nil
+	}
+
+	actual, err := fileChecksum(pooled)
+	if err != nil {
+		return false, err
+	}
+
+	return actual == checksum, nil
+}
+
+// collectPool deletes the files in the pool that no version links to any more, as the
+// versions that did have been deleted
+func (m *Manager) collectPool() {
+	local, ok := m.artifacts.LocalPath(poolDirectory)
+	if !ok {
+		return
+	}
+
+	m.poolMu.Lock()
+	defer m.poolMu.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(local, "sha256"))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			m.logger.Warn("failed to list pooled distro files",
+				"error", err,
+			)
+		}
+
+		return
+	}
+
+	var freed int64
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		if _, links, ok := fileLinks(info); !ok || links > 1 {
+			continue
+		}
+
+		name := filepath.Join(local, "sha256", entry.Name())
+		if err := os.Remove(name); err != nil {
+			m.logger.Warn("failed to delete unused pooled distro file",
+				"path", name,
+				"error", err,
+			)
+
+			continue
+		}
+
+		freed += info.Size()
+	}
+
+	if freed > 0 {
+		m.logger.Info("deleted pooled distro files that are no longer used",
+			"freed", fmt.Sprintf("%0.2fMiB", float64(freed)/bytesInMebibyte),
+		)
+	}
+}
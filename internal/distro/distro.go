@@ -1,17 +1,276 @@
 package distro
 
-import "os"
+import (
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/davejbax/pixie/internal/storage"
+)
 
 type Distro struct {
+	name       string
+	hash       string
+	provider   provider
 	kernelPath string
 	initrdPath string
+	treePath   string
 	arch       string
+	version    string
+	family     string
+	kernelArgs []string
+
+	// Whether booting the distro needs a bootloader superuser's password
+	locked bool
+
+	// GRUB modules loaded by the distro's menu entries
+	grubModules []string
+
+	// Store that the distro's files are kept in, named by the paths above
+	store storage.Backend
+
+	// Files in the installation tree that wimboot loads, if the distro boots with
+	// wimboot
+	wimbootFiles []string
+
+	// Whether the kernel is an EFI program, such as an OS loader, that is chainloaded
+	chainload bool
+
+	// Paths of the distro's driver disks, in the order that they're loaded
+	driverDisks []string
+
+	// SHA-256 checksums of the kernel and initrd, in hex, if they were recorded when the
+	// distro was downloaded
+	kernelChecksum string
+	initrdChecksum string
+
+	// Directory of the distro in the store, i.e. '<name>/<arch>'
+	directory string
+
+	// Checks the kernel and initrd against their checksums before they're served
+	verifier *verifier
+
+	// Hash of a newer version awaiting approval, if the distro isn't updated automatically
+	updateAvailable string
+}
+
+// Name of the distro, as given in config
+func (d *Distro) Name() string {
+	return d.name
+}
+
+// Arch of the distro's kernel
+func (d *Distro) Arch() string {
+	return d.arch
+}
+
+// Hash identifying the version of the distro
+func (d *Distro) Hash() string {
+	return d.hash
+}
+
+// Version of the distro, as given in config. This is empty if the provider chooses the
+// latest version itself: the hash identifies what is actually served.
+func (d *Distro) Version() string {
+	return d.version
+}
+
+// UpdateAvailable returns the hash of a newer version of the distro that a reconcile
+// found, but didn't download as the distro's updates must be approved. This is empty if
+// there's no such version.
+func (d *Distro) UpdateAvailable() string {
+	return d.updateAvailable
+}
+
+// Family of the distro, which is the name of its provider, e.g. 'rocky'
+func (d *Distro) Family() string {
+	return d.family
+}
+
+// Locked returns whether booting the distro needs the password of a bootloader
+// superuser
+func (d *Distro) Locked() bool {
+	return d.locked
+}
+
+// GrubModules returns the GRUB modules that the distro's menu entries load before
+// booting
+func (d *Distro) GrubModules() []string {
+	return d.grubModules
+}
+
+// KernelArgs returns the kernel arguments configured for the distro
+func (d *Distro) KernelArgs() []string {
+	return d.kernelArgs
+}
+
+// InstallArgs returns the kernel arguments that point the distro's installer at its
+// installation tree and automation file. Either URL may be empty.
+func (d *Distro) InstallArgs(repoURL string, automationURL string) []string {
+	return d.provider.installArgs(repoURL, automationURL)
+}
+
+// HasTree returns whether the distro has an extracted installation tree
+func (d *Distro) HasTree() bool {
+	return d.treePath != ""
+}
+
+// OpenTreeFile opens a file, by cleaned slash-separated path, in the distro's
+// installation tree. [fs.ErrNotExist] is returned if the distro has no tree, or if the
+// path is a directory.
+func (d *Distro) OpenTreeFile(name string) (storage.Object, error) {
+	if d.treePath == "" || !fs.ValidPath(name) {
+		return nil, fs.ErrNotExist
+	}
+
+	return d.store.Open(path.Join(d.treePath, name)) //nolint:wrapcheck
+}
+
+// TreeFiles returns the paths of the files in the distro's installation tree, as
+// [Distro.OpenTreeFile] takes them
+func (d *Distro) TreeFiles() ([]string, error) {
+	if d.treePath == "" {
+		return nil, nil
+	}
+
+	return storage.Files(d.store, d.treePath) //nolint:wrapcheck
+}
+
+// WimbootFiles returns the paths of the files, relative to the installation tree, that
+// wimboot loads into memory to boot Windows PE, if the distro's kernel is wimboot rather
+// than a Linux kernel
+func (d *Distro) WimbootFiles() ([]string, bool) {
+	return d.wimbootFiles, len(d.wimbootFiles) > 0
+}
+
+// Chainload returns whether the distro's kernel is an EFI program, such as an OS loader,
+// that is chainloaded rather than booted as a Linux kernel
+func (d *Distro) Chainload() bool {
+	return d.chainload
+}
+
+// LoaderPaths locates the files served to a chainloaded loader, both as paths relative
+// to the server root (as fetched over TFTP) and as URLs
+type LoaderPaths struct {
+	// Installation tree of the distro
+	TreePath string
+	TreeURL  string
+
+	// Config generated for the loader by [Distro.LoaderConfig]
+	ConfigPath string
+	ConfigURL  string
+}
+
+// LoadOptions returns the load options that the distro's loader is chainloaded with,
+// given where its files are served and the arguments to boot with
+func (d *Distro) LoadOptions(paths *LoaderPaths, args []string) []string {
+	if loader, ok := d.provider.(chainloader); ok {
+		return loader.loadOptions(paths, args)
+	}
+
+	return nil
+}
+
+// LoaderConfigPath returns the path, relative to the server root, at which the distro's
+// loader looks for its config, if it always looks in the same place rather than being
+// told where its config is in its load options
+func (d *Distro) LoaderConfigPath() (string, bool) {
+	configurer, ok := d.provider.(loaderConfigurer)
+	if !ok || configurer.loaderConfigPath() == "" {
+		return "", false
+	}
+
+	return configurer.loaderConfigPath(), true
+}
+
+// LoaderConfig writes the config read by the distro's loader, listing the files that it
+// boots and the arguments to boot with. False is returned if the distro's loader reads
+// no config.
+func (d *Distro) LoaderConfig(w io.Writer, paths *LoaderPaths, args []string) (bool, error) {
+	configurer, ok := d.provider.(loaderConfigurer)
+	if !ok || d.treePath == "" {
+		return false, nil
+	}
+
+	if err := configurer.loaderConfig(w, d.OpenTreeFile, paths, args); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DriverDisks returns the file names of the distro's driver disks, in the order that
+// its installer loads them
+func (d *Distro) DriverDisks() []string {
+	names := make([]string, 0, len(d.driverDisks))
+	for _, diskPath := range d.driverDisks {
+		names = append(names, path.Base(diskPath))
+	}
+
+	return names
+}
+
+// OpenDriverDisk opens one of the distro's driver disks, by file name. [fs.ErrNotExist]
+// is returned if the distro has no such disk.
+func (d *Distro) OpenDriverDisk(name string) (storage.Object, error) {
+	for _, diskPath := range d.driverDisks {
+		if path.Base(diskPath) == name {
+			return d.store.Open(diskPath) //nolint:wrapcheck
+		}
+	}
+
+	return nil, fs.ErrNotExist
+}
+
+// Kernel opens the distro's kernel. [ErrChecksumMismatch] is returned if it no longer
+// matches the checksum recorded when it was downloaded.
+func (d *Distro) Kernel() (storage.Object, error) {
+	return d.openVerified(d.kernelPath, d.kernelChecksum)
+}
+
+// HasInitrd returns whether the distro's kernel is booted with an initrd
+func (d *Distro) HasInitrd() bool {
+	return d.initrdPath != ""
+}
+
+// Initrd opens the distro's initrd. If the distro has none (e.g. it boots with wimboot
+// or a standalone EFI program), [fs.ErrNotExist] is returned. As with the kernel,
+// [ErrChecksumMismatch] is returned if the initrd has been corrupted.
+func (d *Distro) Initrd() (storage.Object, error) {
+	if d.initrdPath == "" {
+		return nil, fs.ErrNotExist
+	}
+
+	return d.openVerified(d.initrdPath, d.initrdChecksum)
+}
+
+// openVerified opens the named file, checking it against its recorded checksum
+func (d *Distro) openVerified(name string, checksum string) (storage.Object, error) {
+	file, err := d.store.Open(name)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	if d.verifier == nil {
+		return file, nil
+	}
+
+	if err := d.verifier.verify(file, name, checksum, d.directory, d.hash); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return file, nil
 }
 
-func (d *Distro) Kernel() (*os.File, error) {
-	return os.Open(d.kernelPath) //nolint:wrapcheck
+// KernelChecksum returns the SHA-256 checksum of the distro's kernel, in hex, or an empty
+// string if none was recorded (e.g. the distro was downloaded by an older version)
+func (d *Distro) KernelChecksum() string {
+	return d.kernelChecksum
 }
 
-func (d *Distro) Initrd() (*os.File, error) {
-	return os.Open(d.initrdPath) //nolint:wrapcheck
+// InitrdChecksum returns the SHA-256 checksum of the distro's initrd, in hex, or an empty
+// string if it has none or none was recorded
+func (d *Distro) InitrdChecksum() string {
+	return d.initrdChecksum
 }
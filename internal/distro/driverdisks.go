@@ -0,0 +1,145 @@
+package distro
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Directory that driver disks are kept in, in each version's directory
+const driverDisksDirectory = "driverdisks"
+
+var (
+	errInvalidDriverDiskURL = errors.New("driver disk URL must be an http or https URL ending in a file name")
+	errDuplicateDriverDisk  = errors.New("two driver disks have the same file name")
+)
+
+// DriverDisk is a driver update disk, such as a vendor's disk of RAID or network drivers
+// for a RHEL-family installer. Driver disks are downloaded with the distro and passed to
+// its installer with 'inst.dd='.
+type DriverDisk struct {
+	// URL of the disk image, e.g. 'https://vendor.example/dd-megaraid.iso'. The file name
+	// at the end of the URL must be unique among the distro's driver disks.
+	URL string `mapstructure:"url"`
+
+	// Expected SHA-256 checksum of the disk in hex, if known
+	SHA256 string `mapstructure:"sha256"`
+}
+
+// driverDiskFiles validates the driver disks, and describes them as files to download
+func driverDiskFiles(disks []DriverDisk) ([]artifactFile, error) {
+	files := make([]artifactFile, 0, len(disks))
+	names := make(map[string]struct{}, len(disks))
+
+	for _, disk := range disks {
+		u, err := url.Parse(disk.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("'%s': %w", disk.URL, errInvalidDriverDiskURL)
+		}
+
+		name := path.Base(u.Path)
+		if !fs.ValidPath(name) || name == "." || strings.HasSuffix(u.Path, "/") {
+			return nil, fmt.Errorf("'%s': %w", disk.URL, errInvalidDriverDiskURL)
+		}
+
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("'%s': %w", name, errDuplicateDriverDisk)
+		}
+
+		names[name] = struct{}{}
+		files = append(files, artifactFile{url: disk.URL, name: name, sha256: strings.ToLower(disk.SHA256)})
+	}
+
+	return files, nil
+}
+
+// driverDiskDownloader downloads driver disks alongside the version downloaded by
+// another downloader. Versions are identified by both the version and the disks, so that
+// adding a disk downloads the distro again.
+type driverDiskDownloader struct {
+	downloader
+
+	disks []artifactFile
+	hash  string
+
+	// Downloads the disks themselves
+	fetcher *artifactDownloader
+}
+
+func newDriverDiskDownloader(logger *slog.Logger, inner downloader, disks []artifactFile) *driverDiskDownloader {
+	hash := sha256.Sum256([]byte(inner.Hash() + "\n" + artifactsHash(disks...)))
+
+	return &driverDiskDownloader{
+		downloader: inner,
+		disks:      disks,
+		hash:       fmt.Sprintf("%x", hash),
+		fetcher: &artifactDownloader{
+			logger: logger,
+			client: http.DefaultClient,
+		},
+	}
+}
+
+func (d *driverDiskDownloader) Hash() string {
+	return d.hash
+}
+
+func (d *driverDiskDownloader) HasDrifted(meta *metadata) (bool, error) {
+	return meta.Hash != d.hash, nil
+}
+
+func (d *driverDiskDownloader) DownloadSize() (int64, error) {
+	sizer, ok := d.downloader.(sizer)
+	if !ok {
+		return -1, nil
+	}
+
+	size, err := sizer.DownloadSize()
+	if err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	for _, disk := range d.disks {
+		length, err := contentLength(d.fetcher.client, disk.url)
+		if err != nil {
+			return 0, err
+		}
+
+		size += length
+	}
+
+	return size, nil
+}
+
+func (d *driverDiskDownloader) Download(directory string) (*metadata, error) {
+	meta, err := d.downloader.Download(directory)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	disksDirectory := filepath.Join(directory, driverDisksDirectory)
+	if err := os.MkdirAll(disksDirectory, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create directories in path '%s': %w", disksDirectory, err)
+	}
+
+	meta.DriverDisks = nil
+	for _, disk := range d.disks {
+		if err := d.fetcher.download(disk, filepath.Join(disksDirectory, disk.name)); err != nil {
+			return nil, fmt.Errorf("failed to download driver disk '%s': %w", disk.name, err)
+		}
+
+		meta.DriverDisks = append(meta.DriverDisks, disk.name)
+	}
+
+	meta.Hash = d.hash
+
+	return meta, nil
+}
@@ -0,0 +1,310 @@
+package distro
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/cmdline"
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+const (
+	esxiTreeDirectory = "tree"
+
+	// Config read by the ESXi loader, relative to the tree
+	esxiBootConfigPath = "efi/boot/boot.cfg"
+)
+
+var (
+	errNoESXiISO       = errors.New("the 'iso' option must be given")
+	errESXiSingleArch  = errors.New("an ESXi ISO contains a single architecture, so exactly one arch must be given")
+	errESXiFileMissing = errors.New("file not found in ESXi ISO")
+)
+
+// esxiProvider serves the ESXi installer from a user-supplied vSphere ISO. ESXi's
+// loader (mboot.efi) is chainloaded, and reads a boot.cfg listing the kernel and modules
+// to load, so the boot.cfg from the ISO is rewritten for each client to fetch these from
+// pixie. Like Windows media, the ISO is re-ingested whenever the file changes.
+type esxiProvider struct {
+	logger *slog.Logger
+
+	isoPath string
+	http    bool
+}
+
+type esxiOptions struct {
+	// Path to a vSphere (ESXi) installer ISO
+	ISO string `mapstructure:"iso"`
+
+	// Whether the loader fetches its config and modules over HTTP rather than TFTP.
+	// This is much faster, but needs ESXi 7.0 or later and firmware with HTTP support.
+	HTTP bool `mapstructure:"http" default:"false"`
+}
+
+func newESXi(logger *slog.Logger, opts *esxiOptions) (*esxiProvider, error) {
+	if opts.ISO == "" {
+		return nil, errNoESXiISO
+	}
+
+	return &esxiProvider{
+		logger:  logger,
+		isoPath: opts.ISO,
+		http:    opts.HTTP,
+	}, nil
+}
+
+func (e *esxiProvider) Latest(arches []string) (map[string]downloader, error) {
+	if len(arches) != 1 {
+		return nil, errESXiSingleArch
+	}
+
+	info, err := os.Stat(e.isoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat ESXi ISO: %w", err)
+	}
+
+	// As with Windows ISOs, the ISO is identified by its size and modification time
+	// rather than hashed on every reconcile
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%d\n", e.isoPath, info.Size(), info.ModTime().UnixNano())
+
+	return map[string]downloader{
+		arches[0]: &esxiDownloader{
+			logger:  e.logger,
+			arch:    arches[0],
+			isoPath: e.isoPath,
+			hash:    fmt.Sprintf("%x", h.Sum(nil)),
+		},
+	}, nil
+}
+
+// ESXi takes a kickstart file as its automation file. The installer is found through
+// boot.cfg rather than an argument.
+func (e *esxiProvider) installArgs(_ string, automationURL string) []string {
+	if automationURL == "" {
+		return nil
+	}
+
+	return []string{"ks=" + automationURL}
+}
+
+// The loader takes its arguments from boot.cfg, so is only told where that is
+func (e *esxiProvider) loadOptions(paths *LoaderPaths, _ []string) []string {
+	if e.http {
+		return []string{"-c", paths.ConfigURL}
+	}
+
+	return []string{"-c", paths.ConfigPath}
+}
+
+// The loader is told where boot.cfg is, so it can be served for each distro
+func (e *esxiProvider) loaderConfigPath() string {
+	return ""
+}
+
+// loaderConfig rewrites the boot.cfg from the ISO, so that the loader fetches the kernel
+// and modules from the tree, and boots the installer with the given arguments rather
+// than from CD
+func (e *esxiProvider) loaderConfig(w io.Writer, openTree treeOpener, paths *LoaderPaths, args []string) error {
+	original, err := openTree(esxiBootConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to open ESXi boot.cfg: %w", err)
+	}
+	defer original.Close()
+
+	// Paths in boot.cfg are only relative to the prefix if they don't start with a slash
+	prefix := strings.TrimPrefix(paths.TreePath, "/")
+	if e.http {
+		prefix = paths.TreeURL
+	}
+
+	buffered := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(original)
+
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "prefix":
+			continue
+		case "kernel":
+			value = strings.TrimPrefix(value, "/")
+		case "modules":
+			modules := strings.Split(value, "---")
+			for i := range modules {
+				modules[i] = strings.TrimPrefix(strings.TrimSpace(modules[i]), "/")
+			}
+
+			value = strings.Join(modules, " --- ")
+		case "kernelopt":
+			// The installer would otherwise look for its media in a CD drive
+			opts := slices.DeleteFunc(strings.Fields(value), func(opt string) bool {
+				return strings.EqualFold(opt, "cdromBoot")
+			})
+
+			value = strings.Join(cmdline.Merge(opts, args), " ")
+		}
+
+		fmt.Fprintf(buffered, "%s=%s\n", key, value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read ESXi boot.cfg: %w", err)
+	}
+
+	fmt.Fprintf(buffered, "prefix=%s\n", prefix)
+
+	return buffered.Flush() //nolint:wrapcheck
+}
+
+type esxiDownloader struct {
+	logger  *slog.Logger
+	arch    string
+	isoPath string
+	hash    string
+}
+
+func (d *esxiDownloader) Hash() string {
+	return d.hash
+}
+
+func (d *esxiDownloader) HasDrifted(meta *metadata) (bool, error) {
+	return meta.Hash != d.hash, nil
+}
+
+// Nothing is downloaded, but the whole ISO is extracted
+func (d *esxiDownloader) DownloadSize() (int64, error) {
+	info, err := os.Stat(d.isoPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat ESXi ISO: %w", err)
+	}
+
+	return info.Size(), nil
+}
+
+func (d *esxiDownloader) Download(directory string) (*metadata, error) {
+	treeDirectory := filepath.Join(directory, esxiTreeDirectory)
+	if err := os.MkdirAll(treeDirectory, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create directories in path '%s': %w", treeDirectory, err)
+	}
+
+	disk, err := diskfs.Open(d.isoPath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ESXi ISO: %w", err)
+	}
+	defer disk.Close()
+
+	isoFS, err := disk.GetFilesystem(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ESXi ISO file system: %w", err)
+	}
+
+	count, err := extractISOTree(isoFS, "/", treeDirectory, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract ESXi ISO: %w", err)
+	}
+
+	d.logger.Info("extracted ESXi ISO",
+		"files", count,
+	)
+
+	loader := "efi/boot/bootx64.efi"
+	if d.arch == "aarch64" || d.arch == "arm64" {
+		loader = "efi/boot/bootaa64.efi"
+	}
+
+	for _, required := range []string{loader, esxiBootConfigPath} {
+		if _, err := os.Stat(filepath.Join(treeDirectory, filepath.FromSlash(required))); err != nil {
+			return nil, fmt.Errorf("'%s': %w", required, errESXiFileMissing)
+		}
+	}
+
+	return &metadata{
+		Hash:       d.hash,
+		KernelPath: path.Join(esxiTreeDirectory, loader),
+		TreePath:   esxiTreeDirectory,
+		Chainload:  true,
+	}, nil
+}
+
+// extractISOTree copies the directory at the given path in the ISO, and everything in
+// it, to output. If lower is set, names are lower-cased, e.g. as plain ISO 9660 names
+// are upper case but ESXi's boot.cfg refers to them in lower case. The number of files
+// extracted is returned.
+func extractISOTree(isoFS filesystem.FileSystem, source string, output string, lower bool) (int, error) {
+	entries, err := isoFS.ReadDir(source)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list '%s': %w", source, err)
+	}
+
+	count := 0
+
+	for _, entry := range entries {
+		entrySource := path.Join(source, entry.Name())
+		name := entry.Name()
+		if lower {
+			name = strings.ToLower(name)
+		}
+
+		entryOutput := filepath.Join(output, name)
+
+		if entry.IsDir() {
+			if err := os.MkdirAll(entryOutput, 0o700); err != nil {
+				return 0, fmt.Errorf("failed to create directories in path '%s': %w", entryOutput, err)
+			}
+
+			extracted, err := extractISOTree(isoFS, entrySource, entryOutput, lower)
+			if err != nil {
+				return 0, err
+			}
+
+			count += extracted
+			continue
+		}
+
+		if err := extractISOFile(isoFS, entrySource, entryOutput); err != nil {
+			return 0, fmt.Errorf("failed to extract '%s': %w", entrySource, err)
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+func extractISOFile(isoFS filesystem.FileSystem, source string, output string) error {
+	in, err := isoFS.OpenFile(source, os.O_RDONLY)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package distro
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/davejbax/pixie/internal/iometa"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// Files smaller than this are always downloaded over a single connection, as ranges
+	// wouldn't save much time
+	minRangedSize = 32 * bytesInMebibyte
+
+	// Size of each range of a file downloaded over several connections
+	rangeSize = 16 * bytesInMebibyte
+
+	// Attempts at downloading each range before the download fails
+	rangeAttempts = 3
+
+	// How often download progress is logged
+	progressCadence = 5 * time.Second
+)
+
+var (
+	errRangeMismatch         = errors.New("server did not return the requested range")
+	errRangeChecksum         = errors.New("checksum of downloaded range does not match")
+	errNoParallelConnections = errors.New("the provider doesn't support downloading over several connections")
+)
+
+// fetchOptions are how a provider downloads large files. They are embedded in providers
+// that download large files, and in their downloaders.
+type fetchOptions struct {
+	// Number of connections to download each file over, if the server supports range
+	// requests. Zero or one downloads over a single connection.
+	connections int
+}
+
+func (o *fetchOptions) setConnections(connections int) {
+	o.connections = connections
+}
+
+// parallelFetcher is implemented by providers that can download large files over
+// several connections at once
+type parallelFetcher interface {
+	setConnections(connections int)
+}
+
+// fetch downloads the file at url to output, logging progress with the given message.
+// Large files are downloaded in ranges over several connections at once, if configured
+// and the server supports range requests. Ranges are checked against the checksums that
+// the server gives for them in Content-Digest headers (RFC 9530), if any.
+func (o *fetchOptions) fetch(logger *slog.Logger, client *http.Client, url string, output *os.File, message string) error {
+	if o.connections > 1 {
+		size, ranged, err := rangeSupport(client, url)
+		if err != nil {
+			return err
+		}
+
+		if ranged && size >= minRangedSize {
+			return o.fetchRanges(logger, client, url, output, size, message)
+		}
+
+		logger.Debug("downloading over a single connection, as the server doesn't support ranges or the file is small",
+			"url", url,
+			"size", size,
+			"ranges", ranged,
+		)
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("GET failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHTTPError(resp)
+	}
+
+	progress := iometa.NewProgressWriter(
+		func(progress float64, written, expected int64) {
+			logProgress(logger, message, url, progress, written, expected)
+		},
+		progressCadence,
+		resp.ContentLength,
+	)
+
+	if _, err := io.Copy(io.MultiWriter(output, progress), resp.Body); err != nil {
+		return fmt.Errorf("could not read/write file: %w", err)
+	}
+
+	return nil
+}
+
+// rangeSupport finds the size of the file at url, and whether the server accepts range
+// requests for it
+func rangeSupport(client *http.Client, url string) (int64, bool, error) {
+	resp, err := client.Head(url)
+	if err != nil {
+		return 0, false, fmt.Errorf("HEAD failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, false, newHTTPError(resp)
+	}
+
+	return resp.ContentLength, resp.ContentLength > 0 && resp.Header.Get("Accept-Ranges") == "bytes", nil
+}
+
+// fetchRanges downloads the file in ranges over several connections, writing each range
+// at its offset in output
+func (o *fetchOptions) fetchRanges(logger *slog.Logger, client *http.Client, url string, output *os.File, size int64, message string) error {
+	if err := output.Truncate(size); err != nil {
+		return fmt.Errorf("failed to allocate output file: %w", err)
+	}
+
+	logger.Debug("downloading in ranges",
+		"url", url,
+		"size", size,
+		"connections", o.connections,
+	)
+
+	// Progress counts whole ranges, so that retried ranges aren't counted twice
+	downloaded := &atomic.Int64{}
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(progressCadence)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				written := downloaded.Load()
+				logProgress(logger, message, url, float64(written)/float64(size), written, size)
+			}
+		}
+	}()
+
+	eg := &errgroup.Group{}
+	eg.SetLimit(o.connections)
+
+	for start := int64(0); start < size; start += rangeSize {
+		end := min(start+rangeSize, size) - 1
+
+		eg.Go(func() error {
+			var err error
+			for attempt := 1; attempt <= rangeAttempts; attempt++ {
+				if err = fetchRange(client, url, output, start, end); err == nil {
+					downloaded.Add(end - start + 1)
+					return nil
+				}
+
+				// Client errors won't be fixed by retrying
+				var httpErr *httpError
+				if errors.As(err, &httpErr) && httpErr.status < http.StatusInternalServerError && httpErr.status != http.StatusTooManyRequests {
+					break
+				}
+
+				if attempt == rangeAttempts {
+					break
+				}
+
+				logger.Warn("failed to download range, retrying",
+					"url", url,
+					"start", start,
+					"end", end,
+					"attempt", attempt,
+					"error", err,
+				)
+			}
+
+			return fmt.Errorf("failed to download bytes %d-%d: %w", start, end, err)
+		})
+	}
+
+	return eg.Wait() //nolint:wrapcheck
+}
+
+// fetchRange downloads the bytes from start to end (inclusive) of the file at url, and
+// writes them at the same offset in output
+func fetchRange(client *http.Client, url string, output *os.File, start int64, end int64) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("GET failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return newHTTPError(resp)
+	}
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", start, end)) {
+		return fmt.Errorf("'%s' for bytes %d-%d: %w", resp.Header.Get("Content-Range"), start, end, errRangeMismatch)
+	}
+
+	checksum := sha256.New()
+	written, err := io.Copy(io.MultiWriter(io.NewOffsetWriter(output, start), checksum), io.LimitReader(resp.Body, end-start+1))
+	if err != nil {
+		return fmt.Errorf("could not read/write range: %w", err)
+	}
+
+	if written != end-start+1 {
+		return fmt.Errorf("got %d bytes: %w", written, io.ErrUnexpectedEOF)
+	}
+
+	if expected, ok := contentDigest(resp.Header.Get("Content-Digest")); ok && !bytes.Equal(expected, checksum.Sum(nil)) {
+		return errRangeChecksum
+	}
+
+	return nil
+}
+
+// contentDigest returns the SHA-256 digest in a Content-Digest header, if it has one
+func contentDigest(header string) ([]byte, bool) {
+	for _, member := range strings.Split(header, ",") {
+		encoded, ok := strings.CutPrefix(strings.TrimSpace(member), "sha-256=:")
+		if !ok {
+			continue
+		}
+
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(encoded, ":"))
+		if err != nil || len(digest) != sha256.Size {
+			return nil, false
+		}
+
+		return digest, true
+	}
+
+	return nil, false
+}
+
+func logProgress(logger *slog.Logger, message string, url string, progress float64, written int64, expected int64) {
+	logger.Info(message,
+		"progress", fmt.Sprintf("%0.2f%%", progress*100),
+		"downloaded", fmt.Sprintf("%0.2fMiB", float64(written)/bytesInMebibyte),
+		"total", fmt.Sprintf("%0.2fMiB", float64(expected)/bytesInMebibyte),
+		"url", url,
+	)
+}
+
+// fileChecksum returns the SHA-256 checksum of the file at path, in hex
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open '%s': %w", path, err)
+	}
+	defer file.Close()
+
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, file); err != nil {
+		return "", fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+
+	return fmt.Sprintf("%x", checksum.Sum(nil)), nil
+}
@@ -0,0 +1,156 @@
+package distro
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	flatcarCurrentVersion = "current"
+	flatcarVersionKey     = "FLATCAR_VERSION="
+)
+
+var (
+	errFlatcarVersionMissing = errors.New("version file does not contain FLATCAR_VERSION")
+	errUnsupportedArch       = errors.New("provider does not support arch")
+)
+
+// flatcarBoards maps arches to the names of Flatcar's boards
+var flatcarBoards = map[string]string{
+	"x86_64":  "amd64-usr",
+	"amd64":   "amd64-usr",
+	"aarch64": "arm64-usr",
+	"arm64":   "arm64-usr",
+}
+
+// flatcarProvider serves the PXE images of Flatcar Container Linux from a release
+// channel. Flatcar is configured on first boot by Ignition, which fetches the host's
+// automation file.
+type flatcarProvider struct {
+	fetchOptions
+
+	logger *slog.Logger
+	client *http.Client
+
+	baseURL *url.URL
+	version string
+}
+
+type flatcarOptions struct {
+	// Release channel: 'stable', 'beta', 'alpha' or 'lts'
+	Channel string `mapstructure:"channel" default:"stable"`
+
+	// URL of the release server, overriding the channel's server, e.g. to use a local
+	// mirror
+	MirrorURL string `mapstructure:"mirror_url"`
+}
+
+func newFlatcar(logger *slog.Logger, version string, client *http.Client, opts *flatcarOptions) (*flatcarProvider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if version == "" {
+		version = flatcarCurrentVersion
+	}
+
+	mirrorURL := opts.MirrorURL
+	if mirrorURL == "" {
+		mirrorURL = "https://" + opts.Channel + ".release.flatcar-linux.net"
+	}
+
+	baseURL, err := url.Parse(mirrorURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror URL '%s': %w", mirrorURL, err)
+	}
+
+	return &flatcarProvider{
+		logger:  logger,
+		client:  client,
+		baseURL: baseURL,
+		version: version,
+	}, nil
+}
+
+func (f *flatcarProvider) Latest(arches []string) (map[string]downloader, error) {
+	downloaders := make(map[string]downloader, len(arches))
+
+	for _, arch := range arches {
+		board, ok := flatcarBoards[arch]
+		if !ok {
+			return nil, fmt.Errorf("Flatcar for arch '%s': %w", arch, errUnsupportedArch)
+		}
+
+		// Resolve the current version, so that a release published part way through a
+		// download can't mix files from two releases
+		version := f.version
+		if version == flatcarCurrentVersion {
+			var err error
+
+			version, err = f.currentVersion(board)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check current Flatcar version for arch '%s': %w", arch, err)
+			}
+		}
+
+		releaseURL := f.baseURL.JoinPath(board, version)
+		kernel := artifactFile{url: releaseURL.JoinPath("flatcar_production_pxe.vmlinuz").String(), name: "vmlinuz"}
+		initrd := artifactFile{url: releaseURL.JoinPath("flatcar_production_pxe_image.cpio.gz").String(), name: "initrd.cpio.gz"}
+
+		downloaders[arch] = &artifactDownloader{
+			fetchOptions: f.fetchOptions,
+			logger:       f.logger,
+			client:       f.client,
+			hash:         artifactsHash(kernel, initrd),
+			kernel:       kernel,
+			initrd:       initrd,
+		}
+	}
+
+	return downloaders, nil
+}
+
+// The PXE image runs entirely from memory, so needs no repo. Ignition fetches the
+// automation file on first boot.
+func (f *flatcarProvider) installArgs(_ string, automationURL string) []string {
+	args := []string{"flatcar.first_boot=1"}
+
+	if automationURL != "" {
+		args = append(args, "ignition.config.url="+automationURL)
+	}
+
+	return args
+}
+
+// currentVersion reads the version of the current release for the board
+func (f *flatcarProvider) currentVersion(board string) (string, error) {
+	versionURL := f.baseURL.JoinPath(board, flatcarCurrentVersion, "version.txt").String()
+
+	resp, err := f.client.Get(versionURL)
+	if err != nil {
+		return "", fmt.Errorf("GET failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newHTTPError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if version, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), flatcarVersionKey); ok && version != "" {
+			return version, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read '%s': %w", versionURL, err)
+	}
+
+	return "", fmt.Errorf("'%s': %w", versionURL, errFlatcarVersionMissing)
+}
@@ -0,0 +1,181 @@
+package distro
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/diskfs/go-diskfs"
+)
+
+const (
+	freebsdTreeDirectory = "tree"
+	freebsdLoaderPath    = "boot/loader.efi"
+)
+
+// freebsdArches maps arches to the names used in FreeBSD ISO file names
+var freebsdArches = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"aarch64": "arm64-aarch64",
+	"arm64":   "arm64-aarch64",
+}
+
+// freebsdProvider serves FreeBSD from a release's bootonly ISO, whose contents are
+// extracted into the tree. The release's loader.efi is chainloaded, and loads the
+// kernel and modules from the tree over TFTP.
+type freebsdProvider struct {
+	fetchOptions
+
+	logger *slog.Logger
+	client *http.Client
+
+	mirrorURL *url.URL
+	version   string
+}
+
+type freebsdOptions struct {
+	MirrorURL string `mapstructure:"mirror_url" default:"https://download.freebsd.org/releases"`
+}
+
+func newFreeBSD(logger *slog.Logger, version string, client *http.Client, opts *freebsdOptions) (*freebsdProvider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if version == "" {
+		return nil, errNoBSDVersion
+	}
+
+	mirrorURL, err := url.Parse(opts.MirrorURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror URL '%s': %w", opts.MirrorURL, err)
+	}
+
+	return &freebsdProvider{
+		logger:    logger,
+		client:    client,
+		mirrorURL: mirrorURL,
+		version:   version,
+	}, nil
+}
+
+func (f *freebsdProvider) Latest(arches []string) (map[string]downloader, error) {
+	downloaders := make(map[string]downloader, len(arches))
+
+	for _, arch := range arches {
+		freebsdArch, ok := freebsdArches[arch]
+		if !ok {
+			return nil, fmt.Errorf("FreeBSD for arch '%s': %w", arch, errUnsupportedArch)
+		}
+
+		release := fmt.Sprintf("FreeBSD-%s-RELEASE-%s", f.version, freebsdArch)
+		imagesURL := f.mirrorURL.JoinPath("ISO-IMAGES", f.version)
+
+		checksums, err := getBSDChecksums(f.client, imagesURL.JoinPath("CHECKSUM.SHA256-"+release).String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get FreeBSD checksums for arch '%s': %w", arch, err)
+		}
+
+		isoName := release + "-bootonly.iso"
+
+		checksum, ok := checksums[isoName]
+		if !ok {
+			return nil, fmt.Errorf("'%s': %w", isoName, errNoChecksum)
+		}
+
+		iso := artifactFile{url: imagesURL.JoinPath(isoName).String(), name: isoName, sha256: checksum}
+
+		downloaders[arch] = &freebsdDownloader{
+			artifacts: &artifactDownloader{
+				fetchOptions: f.fetchOptions,
+				logger:       f.logger,
+				client:       f.client,
+				hash:         artifactsHash(iso),
+			},
+			iso: iso,
+		}
+	}
+
+	return downloaders, nil
+}
+
+// FreeBSD's installer is configured by files in its root file system rather than
+// arguments, so there are none to add
+func (f *freebsdProvider) installArgs(_ string, _ string) []string {
+	return nil
+}
+
+// The loader adds load options of the form 'name=value' to its environment, so it's
+// pointed at the tree on the TFTP server, and given the arguments as loader variables
+// (e.g. 'vfs.root.mountfrom=...' or 'console=comconsole')
+func (f *freebsdProvider) loadOptions(paths *LoaderPaths, args []string) []string {
+	return append([]string{"boot.tftproot.path=" + paths.TreePath}, args...)
+}
+
+type freebsdDownloader struct {
+	artifacts *artifactDownloader
+	iso       artifactFile
+}
+
+func (d *freebsdDownloader) Hash() string {
+	return d.artifacts.Hash()
+}
+
+func (d *freebsdDownloader) HasDrifted(meta *metadata) (bool, error) {
+	return d.artifacts.HasDrifted(meta)
+}
+
+func (d *freebsdDownloader) DownloadSize() (int64, error) {
+	return contentLength(d.artifacts.client, d.iso.url)
+}
+
+func (d *freebsdDownloader) Download(directory string) (*metadata, error) {
+	isoPath := filepath.Join(directory, "_"+d.iso.name)
+	defer os.Remove(isoPath)
+
+	if err := d.artifacts.download(d.iso, isoPath); err != nil {
+		return nil, fmt.Errorf("failed to download FreeBSD ISO: %w", err)
+	}
+
+	treeDirectory := filepath.Join(directory, freebsdTreeDirectory)
+	if err := os.MkdirAll(treeDirectory, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create directories in path '%s': %w", treeDirectory, err)
+	}
+
+	disk, err := diskfs.Open(isoPath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open FreeBSD ISO: %w", err)
+	}
+	defer disk.Close()
+
+	isoFS, err := disk.GetFilesystem(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FreeBSD ISO file system: %w", err)
+	}
+
+	// FreeBSD ISOs have Rock Ridge names, which are case-sensitive
+	count, err := extractISOTree(isoFS, "/", treeDirectory, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract FreeBSD ISO: %w", err)
+	}
+
+	d.artifacts.logger.Info("extracted FreeBSD ISO",
+		"files", count,
+	)
+
+	if _, err := os.Stat(filepath.Join(treeDirectory, filepath.FromSlash(freebsdLoaderPath))); err != nil {
+		return nil, fmt.Errorf("'%s' not found in FreeBSD ISO: %w", freebsdLoaderPath, err)
+	}
+
+	return &metadata{
+		Hash:       d.artifacts.hash,
+		KernelPath: path.Join(freebsdTreeDirectory, freebsdLoaderPath),
+		TreePath:   freebsdTreeDirectory,
+		Chainload:  true,
+	}, nil
+}
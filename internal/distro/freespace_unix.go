@@ -0,0 +1,16 @@
+//go:build unix
+
+package distro
+
+import "syscall"
+
+// freeSpace returns the bytes available to unprivileged users on the file system of the
+// given directory
+func freeSpace(directory string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(directory, &stat); err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil //nolint:gosec,unconvert
+}
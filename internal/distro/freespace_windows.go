@@ -0,0 +1,19 @@
+package distro
+
+import "golang.org/x/sys/windows"
+
+// freeSpace returns the bytes available to the current user on the volume of the given
+// directory
+func freeSpace(directory string) (int64, error) {
+	name, err := windows.UTF16PtrFromString(directory)
+	if err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	var available uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &available, nil, nil); err != nil {
+		return 0, err //nolint:wrapcheck
+	}
+
+	return int64(available), nil //nolint:gosec
+}
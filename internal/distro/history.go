@@ -0,0 +1,509 @@
+package distro
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/davejbax/pixie/internal/storage"
+)
+
+const historyFilename = "pixie-history.json"
+
+var (
+	errDistroNotConfigured = errors.New("distro isn't configured")
+	errArchNotConfigured   = errors.New("arch isn't configured for the distro")
+	errArchRequired        = errors.New("an arch must be given to roll back to a version by hash, as the distro has several arches")
+	errNoEarlierVersion    = errors.New("no earlier version in the distro's history is still stored")
+	errUnknownVersion      = errors.New("no version in the distro's history has this hash")
+	errAmbiguousVersion    = errors.New("several versions in the distro's history have hashes starting with this")
+	errVersionDeleted      = errors.New("version's files have been deleted")
+)
+
+// history is the record of the versions of a distro for an arch that have been active,
+// kept alongside its metadata
+type history struct {
+	// Versions in the order that they were activated, oldest first. Each version appears
+	// once, where it was last activated by a reconcile.
+	Versions []*historyEntry
+
+	// Hash of the version that reconciles keep active, as it was rolled back to
+	Pinned string `json:",omitempty"`
+
+	// Newer version found by a reconcile, for distros whose updates must be approved,
+	// and the hash of the version that was approved, once it has been
+	Available *availableVersion `json:",omitempty"`
+	Approved  string            `json:",omitempty"`
+}
+
+type availableVersion struct {
+	Hash     string
+	Detected time.Time
+}
+
+type historyEntry struct {
+	Hash      string
+	Version   string `json:",omitempty"`
+	Activated time.Time
+
+	// Metadata of the version, which replaces the active metadata on a rollback
+	Metadata *metadata
+}
+
+// Version is a version of a distro that has been active, as listed by [Manager.History]
+type Version struct {
+	Arch string `json:"arch"`
+	Hash string `json:"hash"`
+
+	// Version of the distro as given in config when the version was activated, which is
+	// empty if the provider chose the latest version itself
+	Version string `json:"version,omitempty"`
+
+	Activated time.Time `json:"activated"`
+
+	// SHA-256 checksums of the kernel and initrd, in hex, keyed by their paths
+	Checksums map[string]string `json:"checksums,omitempty"`
+
+	Active bool `json:"active"`
+
+	// Whether reconciles keep the version active, as it was rolled back to
+	Pinned bool `json:"pinned"`
+
+	// Whether the version's files are still stored, so that it can be rolled back to
+	Stored bool `json:"stored"`
+}
+
+func readHistory(store storage.Backend, directory string) (*history, error) {
+	data, err := store.ReadFile(path.Join(directory, historyFilename))
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && len(data) == 0) {
+		return &history{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read distro history: %w", err)
+	}
+
+	var h history
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("could not parse distro history: %w", err)
+	}
+
+	return &h, nil
+}
+
+func writeHistory(store storage.Backend, directory string, h *history) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("failed to encode distro history: %w", err)
+	}
+
+	if err := store.WriteFile(path.Join(directory, historyFilename), append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write distro history: %w", err)
+	}
+
+	return nil
+}
+
+// recordActivation adds a version that a reconcile has activated to the history of the
+// distro in directory, and deletes the versions before the last few that are kept
+func (m *Manager) recordActivation(name string, directory string, meta *metadata) error {
+	h, err := readHistory(m.artifacts, directory)
+	if err != nil {
+		return err
+	}
+
+	h.Versions = slices.DeleteFunc(h.Versions, func(entry *historyEntry) bool {
+		return entry.Hash == meta.Hash
+	})
+
+	h.Versions = append(h.Versions, &historyEntry{
+		Hash:      meta.Hash,
+		Version:   m.versions[name],
+		Activated: time.Now(),
+		Metadata:  meta,
+	})
+
+	if h.Available != nil && h.Available.Hash == meta.Hash {
+		h.Available = nil
+	}
+
+	if h.Approved == meta.Hash {
+		h.Approved = ""
+	}
+
+	if m.quota != nil && m.quota.KeepVersions >= 0 && len(h.Versions) > m.quota.KeepVersions+1 {
+		expired := h.Versions[:len(h.Versions)-m.quota.KeepVersions-1]
+		h.Versions = slices.Clone(h.Versions[len(expired):])
+
+		staged, err := readMetadata(m.artifacts, path.Join(directory, stagedMetadataFilename))
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range expired {
+			if (staged != nil && entry.Hash == staged.Hash) || m.isDownloading(path.Join(directory, entry.Hash)) {
+				continue
+			}
+
+			m.logger.Info("deleting old distro version",
+				"distro", name,
+				"directory", directory,
+				"hash", entry.Hash,
+				"activated", entry.Activated,
+			)
+
+			if err := removeTree(m.artifacts, path.Join(directory, entry.Hash)); err != nil {
+				return fmt.Errorf("failed to delete old distro version '%s': %w", entry.Hash, err)
+			}
+		}
+
+		m.collectPool()
+	}
+
+	return writeHistory(m.artifacts, directory, h)
+}
+
+// recordExisting adds the active version to the history of the distro in directory, if
+// it isn't there already, e.g. as it was activated before history was recorded. This
+// lets it be rolled back to once a newer version is activated.
+func (m *Manager) recordExisting(name string, directory string, active *metadata) error {
+	if active == nil {
+		return nil
+	}
+
+	h, err := readHistory(m.artifacts, directory)
+	if err != nil {
+		return err
+	}
+
+	if slices.ContainsFunc(h.Versions, func(entry *historyEntry) bool { return entry.Hash == active.Hash }) {
+		return nil
+	}
+
+	h.Versions = append(h.Versions, &historyEntry{
+		Hash:      active.Hash,
+		Version:   m.versions[name],
+		Activated: time.Now(),
+		Metadata:  active,
+	})
+
+	return writeHistory(m.artifacts, directory, h)
+}
+
+func (m *Manager) isDownloading(directory string) bool {
+	m.spaceMu.Lock()
+	defer m.spaceMu.Unlock()
+
+	return m.downloading[directory]
+}
+
+// removeTree removes the named file or directory, and everything within it
+func removeTree(store storage.Backend, name string) error {
+	children, err := store.List(name)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	for _, child := range children {
+		if err := removeTree(store, path.Join(name, child)); err != nil {
+			return err
+		}
+	}
+
+	return store.Remove(name) //nolint:wrapcheck
+}
+
+// pinned returns the hashes of the versions that the distro's arches are pinned to
+func (m *Manager) pinned(name string) (map[string]string, error) {
+	pinned := make(map[string]string)
+
+	for _, arch := range m.arches[name] {
+		h, err := readHistory(m.artifacts, path.Join(name, arch))
+		if err != nil {
+			return nil, fmt.Errorf("distro '%s' (%s): %w", name, arch, err)
+		}
+
+		if h.Pinned != "" {
+			pinned[arch] = h.Pinned
+		}
+	}
+
+	return pinned, nil
+}
+
+// withPins returns the downloaders for the distro's arches, with the arches pinned to a
+// version replaced by that version
+func withPins(downloaders map[string]downloader, pinned map[string]string) map[string]downloader {
+	if len(pinned) == 0 {
+		return downloaders
+	}
+
+	// Downloaders may be shared through the mirror cache, so the map isn't changed
+	downloaders = maps.Clone(downloaders)
+	if downloaders == nil {
+		downloaders = make(map[string]downloader, len(pinned))
+	}
+
+	for arch, hash := range pinned {
+		downloaders[arch] = &knownVersion{hash: hash, pinned: true}
+	}
+
+	return downloaders
+}
+
+// History returns the versions of the distro that have been active for each of its
+// arches, in the order that the arches are configured, and then by when each version
+// was last activated, oldest first
+func (m *Manager) History(name string) ([]*Version, error) {
+	arches, err := m.configuredArches(name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []*Version{}
+
+	for _, arch := range arches {
+		directory := path.Join(name, arch)
+
+		h, err := readHistory(m.artifacts, directory)
+		if err != nil {
+			return nil, fmt.Errorf("distro '%s' (%s): %w", name, arch, err)
+		}
+
+		active, err := readMetadata(m.artifacts, path.Join(directory, metadataFilename))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range h.Versions {
+			stored, err := m.isStored(path.Join(directory, entry.Hash))
+			if err != nil {
+				return nil, err
+			}
+
+			version := &Version{
+				Arch:      arch,
+				Hash:      entry.Hash,
+				Version:   entry.Version,
+				Activated: entry.Activated,
+				Active:    active != nil && active.Hash == entry.Hash,
+				Pinned:    h.Pinned == entry.Hash,
+				Stored:    stored,
+			}
+
+			if entry.Metadata != nil {
+				version.Checksums = entry.Metadata.Checksums
+			}
+
+			versions = append(versions, version)
+		}
+	}
+
+	return versions, nil
+}
+
+// Rollback makes an earlier version of the distro active again, and pins the distro to
+// it, so that reconciles keep it active until [Manager.Unpin] is called. The version is
+// the one with the given hash (or hash prefix), or if hash is empty, the latest version
+// before the active one whose files are still stored. If arch is empty, every arch of
+// the distro is rolled back, and hash must be empty unless there's only one.
+//
+// Running servers serve the version once they next reconcile, or refresh from the
+// artifact store.
+func (m *Manager) Rollback(name string, arch string, hash string) ([]*Version, error) {
+	arches, err := m.configuredArches(name, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	if hash != "" && len(arches) > 1 {
+		return nil, fmt.Errorf("distro '%s': %w", name, errArchRequired)
+	}
+
+	versions := make([]*Version, 0, len(arches))
+
+	for _, arch := range arches {
+		version, err := m.rollbackArch(name, arch, hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to roll back distro '%s' (%s): %w", name, arch, err)
+		}
+
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+func (m *Manager) rollbackArch(name string, arch string, hash string) (*Version, error) {
+	directory := path.Join(name, arch)
+
+	h, err := readHistory(m.artifacts, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := readMetadata(m.artifacts, path.Join(directory, metadataFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	var target *historyEntry
+	if hash != "" {
+		if target, err = h.find(hash); err != nil {
+			return nil, err
+		}
+
+		stored, err := m.isStored(path.Join(directory, target.Hash))
+		if err != nil {
+			return nil, err
+		}
+
+		if !stored {
+			return nil, fmt.Errorf("'%s': %w", target.Hash, errVersionDeleted)
+		}
+	} else if target, err = m.previous(directory, h, active); err != nil {
+		return nil, err
+	}
+
+	if err := writeMetadata(m.artifacts, path.Join(directory, metadataFilename), target.Metadata); err != nil {
+		return nil, fmt.Errorf("failed to write metadata for distro: %w", err)
+	}
+
+	// A staged version would be newer than the version rolled back to
+	if err := m.artifacts.Remove(path.Join(directory, stagedMetadataFilename)); err != nil {
+		return nil, fmt.Errorf("failed to remove staged metadata: %w", err)
+	}
+
+	h.Pinned = target.Hash
+	if err := writeHistory(m.artifacts, directory, h); err != nil {
+		return nil, err
+	}
+
+	return &Version{
+		Arch:      arch,
+		Hash:      target.Hash,
+		Version:   target.Version,
+		Activated: target.Activated,
+		Checksums: target.Metadata.Checksums,
+		Active:    true,
+		Pinned:    true,
+		Stored:    true,
+	}, nil
+}
+
+// find returns the version whose hash starts with the given prefix
+func (h *history) find(prefix string) (*historyEntry, error) {
+	var found *historyEntry
+
+	for _, entry := range h.Versions {
+		if !strings.HasPrefix(entry.Hash, prefix) || entry.Metadata == nil {
+			continue
+		}
+
+		if found != nil {
+			return nil, fmt.Errorf("'%s': %w", prefix, errAmbiguousVersion)
+		}
+
+		found = entry
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("'%s': %w", prefix, errUnknownVersion)
+	}
+
+	return found, nil
+}
+
+// previous returns the latest version before the active version that is still stored
+func (m *Manager) previous(directory string, h *history, active *metadata) (*historyEntry, error) {
+	end := len(h.Versions)
+	if active != nil {
+		if i := slices.IndexFunc(h.Versions, func(entry *historyEntry) bool { return entry.Hash == active.Hash }); i >= 0 {
+			end = i
+		}
+	}
+
+	for i := end - 1; i >= 0; i-- {
+		entry := h.Versions[i]
+		if entry.Metadata == nil || (active != nil && entry.Hash == active.Hash) {
+			continue
+		}
+
+		stored, err := m.isStored(path.Join(directory, entry.Hash))
+		if err != nil {
+			return nil, err
+		}
+
+		if stored {
+			return entry, nil
+		}
+	}
+
+	return nil, errNoEarlierVersion
+}
+
+// Unpin lets reconciles update the distro's arches (or the given arch) again after a
+// rollback, returning the arches that were pinned
+func (m *Manager) Unpin(name string, arch string) ([]string, error) {
+	arches, err := m.configuredArches(name, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	unpinned := []string{}
+
+	for _, arch := range arches {
+		directory := path.Join(name, arch)
+
+		h, err := readHistory(m.artifacts, directory)
+		if err != nil {
+			return nil, fmt.Errorf("distro '%s' (%s): %w", name, arch, err)
+		}
+
+		if h.Pinned == "" {
+			continue
+		}
+
+		h.Pinned = ""
+		if err := writeHistory(m.artifacts, directory, h); err != nil {
+			return nil, fmt.Errorf("distro '%s' (%s): %w", name, arch, err)
+		}
+
+		unpinned = append(unpinned, arch)
+	}
+
+	return unpinned, nil
+}
+
+// configuredArches returns the given arch of the distro, or all of its arches if arch
+// is empty, checking that they're configured
+func (m *Manager) configuredArches(name string, arch string) ([]string, error) {
+	arches, ok := m.arches[name]
+	if !ok {
+		return nil, fmt.Errorf("'%s': %w", name, errDistroNotConfigured)
+	}
+
+	if arch == "" {
+		return arches, nil
+	}
+
+	if !slices.Contains(arches, arch) {
+		return nil, fmt.Errorf("distro '%s' (%s): %w", name, arch, errArchNotConfigured)
+	}
+
+	return []string{arch}, nil
+}
+
+// isStored returns whether the named version directory has any files
+func (m *Manager) isStored(directory string) (bool, error) {
+	files, err := m.artifacts.List(directory)
+	if err != nil {
+		return false, fmt.Errorf("failed to list '%s': %w", directory, err)
+	}
+
+	return len(files) > 0, nil
+}
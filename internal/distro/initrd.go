@@ -0,0 +1,129 @@
+package distro
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/initrd"
+)
+
+// Name of a distro's initrd once it has been processed, in the version's directory
+const processedInitrdName = "initrd-processed.img"
+
+var errNoInitrdToProcess = errors.New("distro has no initrd to process")
+
+// initrdDownloader processes the initrd of the version downloaded by another downloader.
+// Versions are identified by both the version and the processing, so that changing the
+// processing (or an overlay) downloads the distro again.
+type initrdDownloader struct {
+	downloader
+
+	logger *slog.Logger
+	config *initrd.Config
+	hash   string
+}
+
+// newInitrdDownloader wraps a downloader so that the initrds it downloads are processed
+// as configured
+func newInitrdDownloader(logger *slog.Logger, inner downloader, config *initrd.Config) (*initrdDownloader, error) {
+	fingerprint, err := config.Fingerprint()
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	hash := sha256.Sum256([]byte(inner.Hash() + "\n" + fingerprint))
+
+	return &initrdDownloader{
+		downloader: inner,
+		logger:     logger,
+		config:     config,
+		hash:       fmt.Sprintf("%x", hash),
+	}, nil
+}
+
+func (d *initrdDownloader) Hash() string {
+	return d.hash
+}
+
+func (d *initrdDownloader) HasDrifted(meta *metadata) (bool, error) {
+	return meta.Hash != d.hash, nil
+}
+
+func (d *initrdDownloader) DownloadSize() (int64, error) {
+	sizer, ok := d.downloader.(sizer)
+	if !ok {
+		return -1, nil
+	}
+
+	return sizer.DownloadSize() //nolint:wrapcheck
+}
+
+func (d *initrdDownloader) Download(directory string) (*metadata, error) {
+	meta, err := d.downloader.Download(directory)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	if meta.InitrdPath == "" {
+		return nil, errNoInitrdToProcess
+	}
+
+	original := filepath.Join(directory, filepath.FromSlash(meta.InitrdPath))
+	processed := filepath.Join(directory, processedInitrdName)
+
+	d.logger.Info("processing initrd",
+		"compression", d.config.Compression,
+		"overlays", d.config.Overlays,
+	)
+
+	if err := processInitrd(processed, original, d.config); err != nil {
+		return nil, fmt.Errorf("failed to process initrd: %w", err)
+	}
+
+	// The original is kept if it's served from the installation tree as well
+	if meta.TreePath == "" || !strings.HasPrefix(meta.InitrdPath, meta.TreePath+"/") {
+		if err := os.Remove(original); err != nil {
+			return nil, fmt.Errorf("failed to remove original initrd: %w", err)
+		}
+	}
+
+	meta.Hash = d.hash
+	meta.InitrdPath = processedInitrdName
+
+	return meta, nil
+}
+
+// processInitrd writes the initrd at input to output, processed as configured
+func processInitrd(output string, input string, config *initrd.Config) error {
+	in, err := os.Open(input)
+	if err != nil {
+		return fmt.Errorf("failed to open initrd: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(output), ".initrd-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	if err := initrd.Process(out, in, config); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write initrd: %w", err)
+	}
+
+	if err := os.Rename(out.Name(), output); err != nil {
+		return fmt.Errorf("failed to move processed initrd into place: %w", err)
+	}
+
+	return nil
+}
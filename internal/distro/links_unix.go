@@ -0,0 +1,18 @@
+//go:build unix
+
+package distro
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileLinks returns the identity of a file's contents, and how many hard links it has
+func fileLinks(info fs.FileInfo) (fileID, uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, false
+	}
+
+	return fileID{device: uint64(stat.Dev), inode: stat.Ino}, uint64(stat.Nlink), true //nolint:gosec,unconvert
+}
@@ -0,0 +1,8 @@
+package distro
+
+import "io/fs"
+
+// fileLinks reports that hard links can't be counted, so files aren't deduplicated
+func fileLinks(_ fs.FileInfo) (fileID, uint64, bool) {
+	return fileID{}, 0, false
+}
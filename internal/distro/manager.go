@@ -5,6 +5,7 @@ package distro
 // and if so, create the new GRUB image and schedule deletion for some expiry period
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,23 +13,85 @@ import (
 	"io/fs"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/creasty/defaults"
+	"github.com/davejbax/pixie/internal/initrd"
+	"github.com/davejbax/pixie/internal/maintenance"
+	"github.com/davejbax/pixie/internal/oci"
+	"github.com/davejbax/pixie/internal/storage"
 	"github.com/go-viper/mapstructure/v2"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
-	providerRocky = "rocky"
+	providerRocky   = "rocky"
+	providerWindows = "windows"
+	providerTools   = "tools"
+	providerFlatcar = "flatcar"
+	providerCoreOS  = "fedora-coreos"
+	providerTalos   = "talos"
+	providerESXi    = "esxi"
+	providerFreeBSD = "freebsd"
+	providerOpenBSD = "openbsd"
+	providerOCI     = "oci"
 
-	metadataFilename = "pixie-metadata.json"
+	metadataFilename       = "pixie-metadata.json"
+	stagedMetadataFilename = "pixie-metadata.staged.json"
 )
 
 type Config struct {
-	Provider        string
-	Version         string
-	Arch            []string
+	Provider string
+	Version  string
+	Arch     []string
+
+	// Kernel arguments for this distro, merged over the global kernel arguments
+	KernelArgs []string `mapstructure:"kernel_args"`
+
+	// Whether booting this distro needs the password of a GRUB superuser, for distros
+	// whose installers wipe machines. Other entries, such as local boot, stay open.
+	Locked bool
+
+	// GRUB modules that the distro's menu entries load before booting, e.g. 'lvm',
+	// 'mdraid1x' or 'zfs'. They're also embedded in GRUB images, along with the
+	// configured GRUB modules.
+	GrubModules []string `mapstructure:"grub_modules"`
+
+	// Windows during which new versions of this distro may become active. Overrides
+	// the global maintenance windows if set.
+	MaintenanceWindows maintenance.Schedule `mapstructure:"maintenance_windows"`
+
+	// Windows during which this distro's mirror is checked for new versions, e.g. only
+	// on Sunday mornings, so that new images don't appear mid-week. Outside of them,
+	// reconciles keep the versions already downloaded (activating staged versions as
+	// usual), and distros that haven't been downloaded yet are checked regardless. If
+	// unset, the mirror is checked on every reconcile.
+	CheckWindows maintenance.Schedule `mapstructure:"check_windows"`
+
+	// Whether new versions found by reconciles are downloaded and activated
+	// automatically. If false, a new version is only reported (in the status, through
+	// the API, and by a 'distro_update_available' event) until it's approved with
+	// 'pixie distro approve', for change-controlled environments. The first version is
+	// always downloaded. Defaults to true.
+	AutoUpdate *bool `mapstructure:"auto_update"`
+
+	// Number of connections to download large files over at once, in ranges, for
+	// mirrors with high latency. Servers that don't support range requests are
+	// downloaded from over a single connection.
+	Connections int `mapstructure:"connections"`
+
+	// Processing applied to the distro's initrd once it has been downloaded, such as
+	// recompression or overlays of extra files
+	InitrdProcessing initrd.Config `mapstructure:"initrd_processing"`
+
+	// Driver update disks passed to the distro's installer, for RHEL-family distros
+	// whose installers lack drivers for a machine's storage or network controllers
+	DriverDisks []DriverDisk `mapstructure:"driver_disks"`
+
 	ProviderOptions map[string]interface{} `mapstructure:",remain"`
 }
 
@@ -43,6 +106,26 @@ type metadata struct {
 	// Path of initrd file relative to download directory
 	InitrdPath string
 
+	// Path of the extracted installation tree relative to download directory, if the
+	// provider keeps one. This is served over HTTP as the installer's repository.
+	TreePath string `json:",omitempty"`
+
+	// Files in the installation tree that wimboot loads, if the distro boots Windows PE
+	// with wimboot (at KernelPath) rather than a Linux kernel
+	WimbootFiles []string `json:",omitempty"`
+
+	// Whether the kernel is an EFI program, such as an OS loader, that is chainloaded
+	// rather than booted as a Linux kernel
+	Chainload bool `json:",omitempty"`
+
+	// File names of driver disks in the driver disks directory, in the order that the
+	// installer loads them
+	DriverDisks []string `json:",omitempty"`
+
+	// SHA-256 checksums, in hex, of the kernel and initrd, keyed by their paths. These
+	// are recorded after downloading, so that the files can be served by checksum.
+	Checksums map[string]string `json:",omitempty"`
+
 	// Arbitrary provider-specific data
 	ProviderData map[string]interface{}
 }
@@ -53,26 +136,167 @@ type downloader interface {
 	Download(directory string) (*metadata, error)
 }
 
+// sizer is implemented by downloaders that can find how much they would download,
+// without downloading it
+type sizer interface {
+	// Size in bytes of the files that Download fetches, or that it extracts if the
+	// distro is installed from a local image
+	DownloadSize() (int64, error)
+}
+
 type provider interface {
 	Latest(arch []string) (map[string]downloader, error)
+
+	// Kernel arguments telling the installer where to find its installation tree and
+	// automation file (e.g. a kickstart file). Either URL may be empty.
+	installArgs(repoURL string, automationURL string) []string
+}
+
+// chainloader is implemented by providers whose distros are booted by chainloading a
+// loader (an EFI program) rather than a Linux kernel
+type chainloader interface {
+	// Load options that the loader is chainloaded with, given where its files are served
+	// and the arguments to boot with
+	loadOptions(paths *LoaderPaths, args []string) []string
+}
+
+// loaderConfigurer is implemented by providers whose chainloaded loaders read their own
+// config, listing the files to boot and their arguments. The config is generated for
+// each client, as it's requested.
+type loaderConfigurer interface {
+	// Path relative to the server root at which the loader looks for its config, if
+	// it can't be told where the config is
+	loaderConfigPath() string
+
+	// Writes the loader config for the installation tree opened by openTree
+	loaderConfig(w io.Writer, openTree treeOpener, paths *LoaderPaths, args []string) error
 }
 
+// treeOpener opens a file in a distro's installation tree, by slash-separated path
+type treeOpener func(name string) (storage.Object, error)
+
 type Manager struct {
 	logger *slog.Logger
 
 	arches           map[string][]string
+	kernelArgs       map[string][]string
+	versions         map[string]string
+	families         map[string]string
+	locked           map[string]bool
+	grubModules      map[string][]string
+	windows          map[string]maintenance.Schedule
+	checkWindows     map[string]maintenance.Schedule
+	manualUpdates    map[string]bool
 	providers        map[string]provider
 	storageDirectory string
+	artifacts        storage.Backend
+	ociCache         *oci.Cache
+
+	// Processing of each distro's initrd, for distros whose initrds are processed
+	initrds map[string]*initrd.Config
+
+	// Driver disks downloaded with each distro, for distros that have any
+	driverDisks map[string][]artifactFile
+
+	// Recent checks of the latest version of each distro, keyed by mirrorKeys
+	mirrors    *MirrorCache
+	mirrorKeys map[string]string
+
+	// Checks served kernels and initrds against their recorded checksums
+	verifier *verifier
+
+	// Limits on the space used by the storage directory, and the space reserved for
+	// downloads in progress, which are kept by directory so that they aren't evicted
+	quota       *QuotaConfig
+	spaceMu     sync.Mutex
+	reserved    int64
+	downloading map[string]bool
+
+	// Guards the pool of deduplicated files
+	poolMu sync.Mutex
 }
 
 // NewManager creates a new distro manager. A distro manager takes a config with the
 // desired state of installed distros, and provides methods to check whether the
 // installation state matches the desired state, and to reconcile this.
-func NewManager(logger *slog.Logger, storageDirectory string, distros map[string]*Config) (*Manager, error) {
+//
+// New distro versions only become active during the given maintenance windows (or the
+// distro's own windows, if it has any). Versions downloaded outside of these windows
+// are staged, and the previous version continues to be used until a window opens.
+//
+// Downloaded distros and their metadata are kept in artifacts. The storage directory holds
+// downloads in progress and cached OCI blobs, which aren't shared. Unused versions are
+// evicted to keep the storage directory within quota, which may be nil.
+//
+// Distros pulled from OCI registries use the credentials in registries.
+//
+// Checks of the latest version of each distro are kept in mirrors, which may be nil. A
+// cache shared between managers is only used for distros whose config hasn't changed.
+func NewManager(logger *slog.Logger, storageDirectory string, artifacts storage.Backend, quota *QuotaConfig, distros map[string]*Config, windows maintenance.Schedule, registries *oci.Config, mirrors *MirrorCache) (*Manager, error) {
 	providers := make(map[string]provider)
 	arches := make(map[string][]string)
+	kernelArgs := make(map[string][]string)
+	versions := make(map[string]string)
+	families := make(map[string]string)
+	locked := make(map[string]bool)
+	grubModules := make(map[string][]string)
+	distroWindows := make(map[string]maintenance.Schedule)
+	checkWindows := make(map[string]maintenance.Schedule)
+	manualUpdates := make(map[string]bool)
+	mirrorKeys := make(map[string]string)
+	initrds := make(map[string]*initrd.Config)
+	driverDisks := make(map[string][]artifactFile)
+
+	// Registry tokens and cached blobs are shared by all distros pulled from registries
+	ociClient := oci.NewClient(nil, registries)
+	ociCache := oci.NewCache(filepath.Join(storageDirectory, ociCacheDirectory))
+
+	if err := windows.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid maintenance windows: %w", err)
+	}
 
 	for name, config := range distros {
+		mirrorKeys[name] = mirrorKey(name, config)
+		versions[name] = config.Version
+		families[name] = config.Provider
+		locked[name] = config.Locked
+		grubModules[name] = config.GrubModules
+		distroWindows[name] = windows
+		if len(config.MaintenanceWindows) > 0 {
+			if err := config.MaintenanceWindows.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid maintenance windows for distro '%s': %w", name, err)
+			}
+
+			distroWindows[name] = config.MaintenanceWindows
+		}
+
+		manualUpdates[name] = config.AutoUpdate != nil && !*config.AutoUpdate
+
+		if len(config.CheckWindows) > 0 {
+			if err := config.CheckWindows.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid check windows for distro '%s': %w", name, err)
+			}
+
+			checkWindows[name] = config.CheckWindows
+		}
+
+		if config.InitrdProcessing.Enabled() {
+			if err := config.InitrdProcessing.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid initrd processing for distro '%s': %w", name, err)
+			}
+
+			initrds[name] = &config.InitrdProcessing
+		}
+
+		if len(config.DriverDisks) > 0 {
+			files, err := driverDiskFiles(config.DriverDisks)
+			if err != nil {
+				return nil, fmt.Errorf("invalid driver disks for distro '%s': %w", name, err)
+			}
+
+			driverDisks[name] = files
+		}
+
 		switch config.Provider {
 		case providerRocky:
 			opts, err := decodeProviderConfig[rockyOptions](config.ProviderOptions)
@@ -87,20 +311,236 @@ func NewManager(logger *slog.Logger, storageDirectory string, distros map[string
 
 			providers[name] = provider
 			arches[name] = config.Arch
+			kernelArgs[name] = config.KernelArgs
+		case providerWindows:
+			opts, err := decodeProviderConfig[windowsOptions](config.ProviderOptions)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse provider config for distro '%s': %w", name, err)
+			}
+
+			provider, err := newWindows(logger.With("distro", name), nil, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create Windows provider: %w", err)
+			}
+
+			providers[name] = provider
+			arches[name] = config.Arch
+			kernelArgs[name] = config.KernelArgs
+		case providerTools:
+			opts, err := decodeProviderConfig[toolsOptions](config.ProviderOptions)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse provider config for distro '%s': %w", name, err)
+			}
+
+			provider, err := newTools(logger.With("distro", name), config.Version, nil, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create tools provider: %w", err)
+			}
+
+			providers[name] = provider
+			arches[name] = config.Arch
+			kernelArgs[name] = config.KernelArgs
+		case providerFlatcar:
+			opts, err := decodeProviderConfig[flatcarOptions](config.ProviderOptions)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse provider config for distro '%s': %w", name, err)
+			}
+
+			provider, err := newFlatcar(logger.With("distro", name), config.Version, nil, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create Flatcar provider: %w", err)
+			}
+
+			providers[name] = provider
+			arches[name] = config.Arch
+			kernelArgs[name] = config.KernelArgs
+		case providerCoreOS:
+			opts, err := decodeProviderConfig[coreosOptions](config.ProviderOptions)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse provider config for distro '%s': %w", name, err)
+			}
+
+			provider, err := newCoreOS(logger.With("distro", name), config.Version, nil, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create Fedora CoreOS provider: %w", err)
+			}
+
+			providers[name] = provider
+			arches[name] = config.Arch
+			kernelArgs[name] = config.KernelArgs
+		case providerTalos:
+			opts, err := decodeProviderConfig[talosOptions](config.ProviderOptions)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse provider config for distro '%s': %w", name, err)
+			}
+
+			provider, err := newTalos(logger.With("distro", name), config.Version, nil, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create Talos provider: %w", err)
+			}
+
+			providers[name] = provider
+			arches[name] = config.Arch
+			kernelArgs[name] = config.KernelArgs
+		case providerESXi:
+			opts, err := decodeProviderConfig[esxiOptions](config.ProviderOptions)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse provider config for distro '%s': %w", name, err)
+			}
+
+			provider, err := newESXi(logger.With("distro", name), opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create ESXi provider: %w", err)
+			}
+
+			providers[name] = provider
+			arches[name] = config.Arch
+			kernelArgs[name] = config.KernelArgs
+		case providerFreeBSD:
+			opts, err := decodeProviderConfig[freebsdOptions](config.ProviderOptions)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse provider config for distro '%s': %w", name, err)
+			}
+
+			provider, err := newFreeBSD(logger.With("distro", name), config.Version, nil, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create FreeBSD provider: %w", err)
+			}
+
+			providers[name] = provider
+			arches[name] = config.Arch
+			kernelArgs[name] = config.KernelArgs
+		case providerOpenBSD:
+			opts, err := decodeProviderConfig[openbsdOptions](config.ProviderOptions)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse provider config for distro '%s': %w", name, err)
+			}
+
+			provider, err := newOpenBSD(logger.With("distro", name), config.Version, nil, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create OpenBSD provider: %w", err)
+			}
+
+			providers[name] = provider
+			arches[name] = config.Arch
+			kernelArgs[name] = config.KernelArgs
+		case providerOCI:
+			opts, err := decodeProviderConfig[ociOptions](config.ProviderOptions)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse provider config for distro '%s': %w", name, err)
+			}
+
+			provider, err := newOCI(logger.With("distro", name), config.Version, ociClient, ociCache, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create OCI provider: %w", err)
+			}
+
+			providers[name] = provider
+			arches[name] = config.Arch
+			kernelArgs[name] = config.KernelArgs
 		default:
 			return nil, fmt.Errorf("could not create provider for distro %s: %w", name, errUnsupportedProvider)
 		}
+
+		if config.Connections > 1 {
+			fetcher, ok := providers[name].(parallelFetcher)
+			if !ok {
+				return nil, fmt.Errorf("distro '%s': %w", name, errNoParallelConnections)
+			}
+
+			fetcher.setConnections(config.Connections)
+		}
 	}
 
 	return &Manager{
 		logger: logger,
 
 		arches:           arches,
+		kernelArgs:       kernelArgs,
+		versions:         versions,
+		families:         families,
+		locked:           locked,
+		grubModules:      grubModules,
+		windows:          distroWindows,
+		checkWindows:     checkWindows,
+		manualUpdates:    manualUpdates,
 		providers:        providers,
 		storageDirectory: storageDirectory,
+		artifacts:        artifacts,
+		ociCache:         ociCache,
+		initrds:          initrds,
+		driverDisks:      driverDisks,
+		mirrors:          mirrors,
+		mirrorKeys:       mirrorKeys,
+		verifier:         newVerifier(artifacts),
+		quota:            quota,
+		downloading:      make(map[string]bool),
 	}, nil
 }
 
+// mirrorKey identifies a distro in the mirror cache by the parts of its config that
+// decide what its latest version is. Maps are formatted in key order, so equal configs
+// have equal keys.
+func mirrorKey(name string, config *Config) string {
+	described := fmt.Sprintf("%s %s %v %v", config.Provider, config.Version, config.Arch, config.ProviderOptions)
+
+	return fmt.Sprintf("%s/%x", name, sha256.Sum256([]byte(described)))
+}
+
+// latest returns the latest version of the distro for each of its arches, reusing a
+// recent check from the mirror cache if there is one
+func (m *Manager) latest(name string) (map[string]downloader, error) {
+	downloaders, cached, err := m.mirrors.latest(m.mirrorKeys[name], func() (map[string]downloader, error) {
+		m.logger.Debug("checking latest version of distro",
+			"distro", name,
+			"arches", m.arches[name],
+		)
+
+		return m.providers[name].Latest(m.arches[name]) //nolint:wrapcheck
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest version for distro %s: %w", name, err)
+	}
+
+	if cached {
+		m.logger.Debug("using recently checked latest version of distro",
+			"distro", name,
+		)
+	}
+
+	// Downloaders may be shared through the mirror cache, so they're wrapped in new maps
+	disks, hasDisks := m.driverDisks[name]
+	config, processesInitrd := m.initrds[name]
+	if !hasDisks && !processesInitrd {
+		return downloaders, nil
+	}
+
+	wrapped := make(map[string]downloader, len(downloaders))
+	for arch, inner := range downloaders {
+		logger := m.logger.With("distro", name, "arch", arch)
+
+		if hasDisks {
+			inner = newDriverDiskDownloader(logger, inner, disks)
+		}
+
+		if processesInitrd {
+			inner, err = newInitrdDownloader(logger, inner, config)
+			if err != nil {
+				return nil, fmt.Errorf("failed to process initrd of distro %s: %w", name, err)
+			}
+		}
+
+		wrapped[arch] = inner
+	}
+
+	return wrapped, nil
+}
+
+// BlobCacheUsage returns the number and total size of blobs cached from OCI registries
+func (m *Manager) BlobCacheUsage() (int, int64, error) {
+	return m.ociCache.Usage() //nolint:wrapcheck
+}
+
 func decodeProviderConfig[T interface{}](opts map[string]interface{}) (*T, error) {
 	var output T
 
@@ -108,37 +548,49 @@ func decodeProviderConfig[T interface{}](opts map[string]interface{}) (*T, error
 		return nil, fmt.Errorf("failed to set default provider options: %w", err)
 	}
 
-	if err := mapstructure.Decode(opts, &output); err != nil {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:      &output,
+		ErrorUnused: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create provider options decoder: %w", err)
+	}
+
+	if err := decoder.Decode(opts); err != nil {
 		return nil, fmt.Errorf("failed to parse provider options: %w", err)
 	}
 
 	return &output, nil
 }
 
+// Reconcile downloads the latest version of each configured distro, if it has changed,
+// and returns the active version of each. At most parallelism downloads run at once.
+// Distros outside of their check windows keep the versions already downloaded.
 func (m *Manager) Reconcile(parallelism int) ([]*Distro, error) {
 	eg := &errgroup.Group{}
 	eg.SetLimit(parallelism)
 
 	distroCh := make(chan *Distro)
 	distros := []*Distro{}
+	collected := make(chan struct{})
 
 	go func() {
+		defer close(collected)
+
 		for distro := range distroCh {
 			distros = append(distros, distro)
 		}
 	}()
 
-	for name, provider := range m.providers {
-		arches := m.arches[name]
-
-		m.logger.Debug("checking latest version of distro",
-			"distro", name,
-			"arches", arches,
-		)
-
-		downloaders, err := provider.Latest(arches)
+	for name := range m.providers {
+		downloaders, err := m.candidates(name, false)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get latest version for distro %s: %w", name, err)
+			// Let any downloads already started finish, so that they aren't left behind
+			_ = eg.Wait()
+			close(distroCh)
+			<-collected
+
+			return nil, err
 		}
 
 		for arch, downloader := range downloaders {
@@ -156,6 +608,7 @@ func (m *Manager) Reconcile(parallelism int) ([]*Distro, error) {
 
 	err := eg.Wait()
 	close(distroCh)
+	<-collected
 
 	if err != nil {
 		return nil, fmt.Errorf("reconcile failed: %w", err)
@@ -164,121 +617,442 @@ func (m *Manager) Reconcile(parallelism int) ([]*Distro, error) {
 	return distros, nil
 }
 
+// Active returns the currently active version of each configured distro and arch that
+// has been downloaded, without checking for newer versions
+func (m *Manager) Active() ([]*Distro, error) {
+	distros := []*Distro{}
+
+	for name, arches := range m.arches {
+		for _, arch := range arches {
+			directory := path.Join(name, arch)
+
+			meta, err := readMetadata(m.artifacts, path.Join(directory, metadataFilename))
+			if err != nil {
+				return nil, fmt.Errorf("could not read metadata for distro '%s': %w", name, err)
+			}
+
+			if meta == nil {
+				continue
+			}
+
+			distro, err := m.distro(meta, name, directory, arch)
+			if err != nil {
+				return nil, fmt.Errorf("could not get distro '%s' pointed to by metadata: %w", name, err)
+			}
+
+			distros = append(distros, distro)
+		}
+	}
+
+	return distros, nil
+}
+
 func (m *Manager) reconcileForArch(name string, arch string, downloader downloader) (*Distro, error) {
 	m.logger.Debug("checking whether distro needs reconciling",
 		"distro", name,
 		"arch", arch,
 	)
 
-	directory := filepath.Join(m.storageDirectory, name, arch)
-	if err := os.MkdirAll(directory, 0o700); err != nil {
-		return nil, fmt.Errorf("failed to create directories in path '%s': %w", directory, err)
+	directory := path.Join(name, arch)
+	metaFilePath := path.Join(directory, metadataFilename)
+	stagedMetaFilePath := path.Join(directory, stagedMetadataFilename)
+
+	state, err := readInstallState(m.artifacts, directory, downloader)
+	if err != nil {
+		return nil, err
 	}
 
-	metaFilePath := filepath.Join(directory, metadataFilename)
-	metaFileExists := false
+	active := state.active
 
-	if stat, err := os.Stat(metaFilePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
-		return nil, fmt.Errorf("metadata file %s stat failed: %w", metaFilePath, err)
-	} else if err == nil && stat.Size() > 0 {
-		metaFileExists = true
+	if err := m.recordExisting(name, directory, active); err != nil {
+		return nil, fmt.Errorf("failed to record distro history: %w", err)
 	}
 
-	metaFile, err := os.OpenFile(metaFilePath, os.O_CREATE|os.O_RDWR, 0o600)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open metadata: %w", err)
+	// Distro hasn't drifted! We can stop here, unless its files have been corrupted since
+	// they were downloaded
+	if state.upToDate && m.verifier.corrupted(directory, active.Hash) {
+		m.logger.Warn("distro's files do not match their checksums, and will be downloaded again",
+			"distro", name,
+			"arch", arch,
+		)
+
+		meta, err := m.download(name, arch, downloader)
+		if err != nil {
+			return nil, fmt.Errorf("download of corrupted distro failed: %w", err)
+		}
+
+		if err := writeMetadata(m.artifacts, metaFilePath, meta); err != nil {
+			return nil, fmt.Errorf("failed to write metadata for distro: %w", err)
+		}
+
+		m.verifier.repaired(directory)
+		active = meta
+	} else if state.upToDate {
+		m.logger.Info("distro is up-to-date and not drifted from desired state",
+			"distro", name,
+			"arch", arch,
+		)
 	}
-	defer metaFile.Close()
 
-	if metaFileExists {
-		var meta metadata
-		if err := json.NewDecoder(metaFile).Decode(&meta); err != nil {
-			// TODO: could proceed on here and redownload, assuming that it's corrupted?
-			return nil, fmt.Errorf("could not parse distro metadata: %w", err)
+	if state.upToDate {
+		// Any staged version must be stale, since the active version is the latest
+		if err := m.artifacts.Remove(stagedMetaFilePath); err != nil {
+			return nil, fmt.Errorf("failed to remove stale staged metadata: %w", err)
 		}
 
-		drifted, err := downloader.HasDrifted(&meta)
+		distro, err := m.distro(active, name, directory, arch)
 		if err != nil {
-			return nil, fmt.Errorf("failed to check distro drift: %w", err)
+			return nil, fmt.Errorf("could not get existing distro pointed to by metadata: %w", err)
 		}
 
-		// Distro hasn't drifted! We can stop here
-		if !drifted {
-			m.logger.Info("distro is up-to-date and not drifted from desired state",
-				"distro", name,
-				"arch", arch,
-			)
+		return distro, nil
+	}
 
-			distro, err := meta.distro(directory, arch)
-			if err != nil {
-				return nil, fmt.Errorf("could not get existing distro pointed to by metadata: %w", err)
-			}
+	// Either distro has drifted, or we don't have any metadata. We might have already
+	// downloaded the latest version and staged it, though.
+	meta := state.staged
 
-			return distro, nil
+	if meta == nil {
+		m.logger.Info("distro has drifted and will be reconciled",
+			"distro", name,
+			"arch", arch,
+		)
+
+		meta, err = m.download(name, arch, downloader)
+		if err != nil {
+			return nil, fmt.Errorf("download of distro failed: %w", err)
 		}
 	}
 
-	// Either distro has drifted, or we don't have any metadata. Reconcile by downloading!
-	m.logger.Info("distro has drifted and will be reconciled",
+	windowOpen, err := m.windows[name].Open(time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to check maintenance windows: %w", err)
+	}
+
+	// Outside of a maintenance window, we keep using the previous version (if there
+	// is one) and stage the new version to be activated once a window opens
+	if !windowOpen && active != nil {
+		if err := writeMetadata(m.artifacts, stagedMetaFilePath, meta); err != nil {
+			return nil, fmt.Errorf("failed to write staged metadata for distro: %w", err)
+		}
+
+		m.logger.Info("new distro version has been staged and will be activated in the next maintenance window",
+			"distro", name,
+			"arch", arch,
+		)
+
+		distro, err := m.distro(active, name, directory, arch)
+		if err != nil {
+			return nil, fmt.Errorf("could not get existing distro pointed to by metadata: %w", err)
+		}
+
+		return distro, nil
+	}
+
+	if err := writeMetadata(m.artifacts, metaFilePath, meta); err != nil {
+		return nil, fmt.Errorf("failed to write metadata for distro: %w", err)
+	}
+
+	if err := m.artifacts.Remove(stagedMetaFilePath); err != nil {
+		return nil, fmt.Errorf("failed to remove staged metadata: %w", err)
+	}
+
+	if err := m.recordActivation(name, directory, meta); err != nil {
+		return nil, fmt.Errorf("failed to record distro history: %w", err)
+	}
+
+	m.logger.Info("distro has been reconciled",
 		"distro", name,
 		"arch", arch,
 	)
 
-	dataDirectory := filepath.Join(directory, downloader.Hash())
-	if err := os.MkdirAll(dataDirectory, 0o700); err != nil {
-		return nil, fmt.Errorf("failed to create directories in path '%s': %w", dataDirectory, err)
+	distro, err := m.distro(meta, name, directory, arch)
+	if err != nil {
+		return nil, fmt.Errorf("could not create distro after reconciliation: %w", err)
 	}
 
-	meta, err := downloader.Download(dataDirectory)
+	return distro, nil
+}
+
+// installState is the installed state of a distro for an arch, compared with the latest
+// version
+type installState struct {
+	// Metadata of the active version, if there is one
+	active *metadata
+
+	// Whether the active version is the latest version
+	upToDate bool
+
+	// Metadata of the staged version, if it is the latest version. This is only read if
+	// the active version isn't the latest.
+	staged *metadata
+}
+
+// readInstallState reads the metadata in the distro's directory in the store, and checks
+// it against the latest version given by the downloader
+func readInstallState(store storage.Backend, directory string, downloader downloader) (*installState, error) {
+	active, err := readMetadata(store, path.Join(directory, metadataFilename))
 	if err != nil {
-		return nil, fmt.Errorf("download of distro failed: %w", err)
+		// TODO: could proceed on here and redownload, assuming that it's corrupted?
+		return nil, fmt.Errorf("could not read distro metadata: %w", err)
 	}
 
-	if err := metaFile.Truncate(0); err != nil {
-		return nil, fmt.Errorf("failed to truncate metadata file: %w", err)
+	state := &installState{active: active}
+
+	if active != nil {
+		drifted, err := downloader.HasDrifted(active)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check distro drift: %w", err)
+		}
+
+		if !drifted {
+			state.upToDate = true
+			return state, nil
+		}
 	}
 
-	if _, err := metaFile.Seek(0, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek metadata file: %w", err)
+	staged, err := readMetadata(store, path.Join(directory, stagedMetadataFilename))
+	if err != nil {
+		return nil, fmt.Errorf("could not read staged distro metadata: %w", err)
 	}
 
-	if err := json.NewEncoder(metaFile).Encode(meta); err != nil {
-		return nil, fmt.Errorf("failed to write metadata for distro: %w", err)
+	if staged != nil {
+		drifted, err := downloader.HasDrifted(staged)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check staged distro drift: %w", err)
+		}
+
+		if !drifted {
+			state.staged = staged
+		}
 	}
 
-	m.logger.Info("distro has been reconciled",
-		"distro", name,
-		"arch", arch,
+	return state, nil
+}
+
+// download downloads the downloader's version of a distro into its directory in the
+// artifact store, once there's space for it. If the store keeps files on local disk, the
+// version is downloaded in place; otherwise, it's downloaded to a temporary directory and
+// uploaded.
+func (m *Manager) download(name string, arch string, downloader downloader) (*metadata, error) {
+	release, err := m.reserveSpace(name, arch, downloader)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	directory := path.Join(name, arch, downloader.Hash())
+
+	if local, ok := m.artifacts.LocalPath(directory); ok {
+		if err := os.MkdirAll(local, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create directories in path '%s': %w", local, err)
+		}
+
+		meta, err := downloader.Download(local)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		if err := meta.recordChecksums(local); err != nil {
+			return nil, err
+		}
+
+		// A version that can't be deduplicated is still served, just without saving space
+		saved, err := m.deduplicate(local)
+		if err != nil {
+			m.logger.Warn("failed to deduplicate distro's files",
+				"directory", directory,
+				"error", err,
+			)
+		}
+
+		if saved > 0 {
+			m.logger.Info("deduplicated distro's files with those of other versions",
+				"directory", directory,
+				"saved", fmt.Sprintf("%0.2fMiB", float64(saved)/bytesInMebibyte),
+			)
+		}
+
+		return meta, nil
+	}
+
+	if err := os.MkdirAll(m.storageDirectory, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create directories in path '%s': %w", m.storageDirectory, err)
+	}
+
+	tmp, err := os.MkdirTemp(m.storageDirectory, ".download-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary download directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	meta, err := downloader.Download(tmp)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	if err := meta.recordChecksums(tmp); err != nil {
+		return nil, err
+	}
+
+	m.logger.Info("uploading distro to artifact store",
+		"directory", directory,
 	)
 
+	if err := m.artifacts.Upload(directory, tmp); err != nil {
+		return nil, fmt.Errorf("failed to upload distro: %w", err)
+	}
+
+	return meta, nil
+}
+
+// recordChecksums records the checksums of the kernel and initrd, which have been
+// downloaded into the local directory
+func (m *metadata) recordChecksums(directory string) error {
+	m.Checksums = make(map[string]string)
+
+	for _, name := range []string{m.KernelPath, m.InitrdPath} {
+		if name == "" {
+			continue
+		}
+
+		checksum, err := fileChecksum(filepath.Join(directory, filepath.FromSlash(name)))
+		if err != nil {
+			return fmt.Errorf("failed to checksum downloaded file: %w", err)
+		}
+
+		m.Checksums[name] = checksum
+	}
+
+	return nil
+}
+
+// readMetadata reads the named metadata file in the store, returning nil if it does not
+// exist or is empty
+func readMetadata(store storage.Backend, name string) (*metadata, error) {
+	data, err := store.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && len(data) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read metadata file %s: %w", name, err)
+	}
+
+	var meta metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("could not parse distro metadata: %w", err)
+	}
+
+	return &meta, nil
+}
+
+// writeMetadata atomically replaces the named metadata file in the store
+func writeMetadata(store storage.Backend, name string, meta *metadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	if err := store.WriteFile(name, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to replace metadata file: %w", err)
+	}
+
+	return nil
+}
+
+// distro creates the distro described by the metadata in directory
+func (m *Manager) distro(meta *metadata, name string, directory string, arch string) (*Distro, error) {
 	distro, err := meta.distro(directory, arch)
 	if err != nil {
-		return nil, fmt.Errorf("could not create distro after reconciliation: %w", err)
+		return nil, err
+	}
+
+	distro.name = name
+	distro.provider = m.providers[name]
+	distro.kernelArgs = m.kernelArgs[name]
+	distro.version = m.versions[name]
+	distro.family = m.families[name]
+	distro.locked = m.locked[name]
+	distro.grubModules = m.grubModules[name]
+	distro.store = m.artifacts
+	distro.directory = directory
+	distro.verifier = m.verifier
+
+	h, err := readHistory(m.artifacts, directory)
+	if err != nil {
+		return nil, err
 	}
 
+	if h.Available != nil {
+		distro.updateAvailable = h.Available.Hash
+	}
+
+	m.markUsed(path.Join(directory, meta.Hash))
+
 	return distro, nil
 }
 
 func (m *metadata) distro(directory string, arch string) (*Distro, error) {
 	// Ensure hash isn't doing path traversal
-	versionDirectory := filepath.Clean(filepath.Join(directory, m.Hash))
-	if _, err := filepath.Rel(directory, versionDirectory); err != nil {
-		return nil, errCorruptedMetadata
+	versionDirectory, err := joinWithin(directory, m.Hash)
+	if err != nil {
+		return nil, err
 	}
 
-	initrdPath := filepath.Clean(filepath.Join(versionDirectory, m.InitrdPath))
-	if _, err := filepath.Rel(versionDirectory, initrdPath); err != nil {
-		return nil, errCorruptedMetadata
+	// Distros booted with wimboot have no initrd
+	initrdPath := ""
+	if m.InitrdPath != "" {
+		initrdPath, err = joinWithin(versionDirectory, m.InitrdPath)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	kernelPath := filepath.Clean(filepath.Join(versionDirectory, m.KernelPath))
-	if _, err := filepath.Rel(versionDirectory, kernelPath); err != nil {
-		return nil, errCorruptedMetadata
+	kernelPath, err := joinWithin(versionDirectory, m.KernelPath)
+	if err != nil {
+		return nil, err
+	}
+
+	treePath := ""
+	if m.TreePath != "" {
+		treePath, err = joinWithin(versionDirectory, m.TreePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var driverDisks []string
+	for _, name := range m.DriverDisks {
+		diskPath, err := joinWithin(versionDirectory, path.Join(driverDisksDirectory, name))
+		if err != nil || path.Dir(diskPath) != path.Join(versionDirectory, driverDisksDirectory) {
+			return nil, errCorruptedMetadata
+		}
+
+		driverDisks = append(driverDisks, diskPath)
 	}
 
 	return &Distro{
+		hash:       m.Hash,
 		kernelPath: kernelPath,
 		initrdPath: initrdPath,
+		treePath:   treePath,
 		arch:       arch,
+
+		wimbootFiles: m.WimbootFiles,
+		chainload:    m.Chainload,
+		driverDisks:  driverDisks,
+
+		kernelChecksum: m.Checksums[m.KernelPath],
+		initrdChecksum: m.Checksums[m.InitrdPath],
 	}, nil
 }
+
+// joinWithin joins a slash-separated path from metadata onto directory, returning
+// [errCorruptedMetadata] if the result isn't within directory
+func joinWithin(directory string, name string) (string, error) {
+	joined := path.Join(directory, name)
+	if !strings.HasPrefix(joined, directory+"/") {
+		return "", errCorruptedMetadata
+	}
+
+	return joined, nil
+}
@@ -0,0 +1,87 @@
+package distro
+
+import (
+	"sync"
+	"time"
+)
+
+// MirrorCache keeps the latest versions found by distro providers for a while, so that
+// frequent reconciles don't check upstream mirrors every time, and risk being rate
+// limited. Concurrent checks of the same distro share a single check.
+//
+// A nil cache caches nothing.
+type MirrorCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*mirrorEntry
+}
+
+// mirrorEntry is the result of checking a distro's mirror, or a check in progress
+type mirrorEntry struct {
+	// Closed once the check has finished
+	done chan struct{}
+
+	checked     time.Time
+	downloaders map[string]downloader
+	err         error
+}
+
+// NewMirrorCache creates a cache that keeps the results of checks for the given time
+func NewMirrorCache(ttl time.Duration) *MirrorCache {
+	return &MirrorCache{
+		ttl:     ttl,
+		entries: make(map[string]*mirrorEntry),
+	}
+}
+
+// latest returns the result of check for the given key, running it only if it hasn't
+// been run within the TTL. Failed checks aren't cached, so that they are retried by the
+// next call. The returned bool is true if the result came from an earlier check.
+func (c *MirrorCache) latest(key string, check func() (map[string]downloader, error)) (map[string]downloader, bool, error) {
+	if c == nil || c.ttl <= 0 {
+		downloaders, err := check()
+		return downloaders, false, err
+	}
+
+	c.mu.Lock()
+	c.expire()
+
+	if e, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		<-e.done
+
+		return e.downloaders, true, e.err
+	}
+
+	e := &mirrorEntry{done: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	e.downloaders, e.err = check()
+	e.checked = time.Now()
+	close(e.done)
+
+	if e.err != nil {
+		c.mu.Lock()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+
+	return e.downloaders, false, e.err
+}
+
+// expire removes finished checks older than the TTL. The mutex must be held.
+func (c *MirrorCache) expire() {
+	for key, e := range c.entries {
+		select {
+		case <-e.done:
+			if time.Since(e.checked) >= c.ttl {
+				delete(c.entries, key)
+			}
+		default:
+		}
+	}
+}
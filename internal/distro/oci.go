@@ -0,0 +1,232 @@
+package distro
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/oci"
+)
+
+const (
+	ociTreeDirectory = "tree"
+
+	// Directory in the storage directory that blobs are cached in
+	ociCacheDirectory = "oci"
+)
+
+var (
+	errNoOCIReference = errors.New("a reference to the artifact is required, e.g. 'ghcr.io/example/boot:v1'")
+	errInvalidOCIFile = errors.New("invalid file name in artifact")
+)
+
+// ociProvider serves boot artifacts pushed to an OCI registry, e.g. with
+// 'oras push registry/boot:v1 vmlinuz initrd.img rootfs.squashfs'. Blobs are cached by
+// digest, so that files unchanged between versions aren't downloaded again.
+type ociProvider struct {
+	logger *slog.Logger
+	client *oci.Client
+	cache  *oci.Cache
+
+	ref  *oci.Reference
+	opts *ociOptions
+}
+
+type ociOptions struct {
+	// Reference to the artifact, e.g. 'ghcr.io/example/boot:v1'. The distro's version,
+	// if set, replaces the tag. If the reference is to an index, the manifest for each
+	// arch is used.
+	Reference string `mapstructure:"reference"`
+
+	// Titles of the files in the artifact (the file names given to ORAS) of the kernel
+	// and initrd
+	Kernel string `mapstructure:"kernel" default:"vmlinuz"`
+	Initrd string `mapstructure:"initrd" default:"initrd.img"`
+
+	// Title of a root file system image in the artifact (e.g. a squashfs), served from
+	// the tree for live systems to fetch
+	RootFS string `mapstructure:"rootfs"`
+
+	// Kernel argument that the root file system's URL is appended to. The default
+	// suits dracut's live module.
+	RootFSArg string `mapstructure:"rootfs_arg" default:"root=live:"`
+
+	// Titles of further files in the artifact to serve from the tree
+	Files []string `mapstructure:"files"`
+}
+
+func newOCI(logger *slog.Logger, version string, client *oci.Client, cache *oci.Cache, opts *ociOptions) (*ociProvider, error) {
+	if opts.Reference == "" {
+		return nil, errNoOCIReference
+	}
+
+	ref, err := oci.ParseReference(opts.Reference)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	if version != "" && ref.Digest == "" {
+		ref.Tag = version
+	}
+
+	for _, name := range append([]string{opts.Kernel, opts.Initrd, opts.RootFS}, opts.Files...) {
+		if name != "" && !validOCIFileName(name) {
+			return nil, fmt.Errorf("'%s': %w", name, errInvalidOCIFile)
+		}
+	}
+
+	return &ociProvider{
+		logger: logger,
+		client: client,
+		cache:  cache,
+		ref:    ref,
+		opts:   opts,
+	}, nil
+}
+
+// validOCIFileName returns whether a file title from an artifact can safely be used as a
+// file name
+func validOCIFileName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+func (o *ociProvider) Latest(arches []string) (map[string]downloader, error) {
+	downloaders := make(map[string]downloader, len(arches))
+
+	for _, arch := range arches {
+		manifest, manifestDigest, err := o.client.Resolve(o.ref, arch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve '%s': %w", o.ref, err)
+		}
+
+		d := &ociDownloader{
+			logger: o.logger,
+			client: o.client,
+			cache:  o.cache,
+			ref:    o.ref,
+			hash:   strings.TrimPrefix(manifestDigest, "sha256:"),
+		}
+
+		if d.kernel, err = manifest.File(o.opts.Kernel); err != nil {
+			return nil, fmt.Errorf("kernel of '%s': %w", o.ref, err)
+		}
+
+		if d.initrd, err = manifest.File(o.opts.Initrd); err != nil {
+			return nil, fmt.Errorf("initrd of '%s': %w", o.ref, err)
+		}
+
+		tree := o.opts.Files
+		if o.opts.RootFS != "" {
+			tree = append([]string{o.opts.RootFS}, tree...)
+		}
+
+		for _, name := range tree {
+			file, err := manifest.File(name)
+			if err != nil {
+				return nil, fmt.Errorf("'%s': %w", o.ref, err)
+			}
+
+			d.tree = append(d.tree, file)
+		}
+
+		downloaders[arch] = d
+	}
+
+	return downloaders, nil
+}
+
+// Live systems fetch their root file system from the tree. Other artifacts take no
+// arguments.
+func (o *ociProvider) installArgs(repoURL string, _ string) []string {
+	if o.opts.RootFS == "" || repoURL == "" {
+		return nil
+	}
+
+	return []string{o.opts.RootFSArg + repoURL + path.Base(o.opts.RootFS)}
+}
+
+type ociDownloader struct {
+	logger *slog.Logger
+	client *oci.Client
+	cache  *oci.Cache
+	ref    *oci.Reference
+
+	// Digest of the manifest, without the algorithm
+	hash string
+
+	kernel *oci.Descriptor
+	initrd *oci.Descriptor
+	tree   []*oci.Descriptor
+}
+
+func (d *ociDownloader) Hash() string {
+	return d.hash
+}
+
+func (d *ociDownloader) HasDrifted(meta *metadata) (bool, error) {
+	return meta.Hash != d.hash, nil
+}
+
+// Only blobs that aren't already cached are downloaded
+func (d *ociDownloader) DownloadSize() (int64, error) {
+	size := int64(0)
+	for _, blob := range append([]*oci.Descriptor{d.kernel, d.initrd}, d.tree...) {
+		if !d.cache.Has(blob.Digest) {
+			size += blob.Size
+		}
+	}
+
+	return size, nil
+}
+
+func (d *ociDownloader) Download(directory string) (*metadata, error) {
+	meta := &metadata{
+		Hash:       d.hash,
+		KernelPath: d.kernel.Annotations[oci.AnnotationTitle],
+		InitrdPath: d.initrd.Annotations[oci.AnnotationTitle],
+	}
+
+	if err := d.fetch(d.kernel, filepath.Join(directory, meta.KernelPath)); err != nil {
+		return nil, fmt.Errorf("failed to download kernel: %w", err)
+	}
+
+	if err := d.fetch(d.initrd, filepath.Join(directory, meta.InitrdPath)); err != nil {
+		return nil, fmt.Errorf("failed to download initrd: %w", err)
+	}
+
+	if len(d.tree) > 0 {
+		meta.TreePath = ociTreeDirectory
+
+		treeDirectory := filepath.Join(directory, ociTreeDirectory)
+		if err := os.MkdirAll(treeDirectory, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create directories in path '%s': %w", treeDirectory, err)
+		}
+
+		for _, file := range d.tree {
+			name := file.Annotations[oci.AnnotationTitle]
+			if err := d.fetch(file, filepath.Join(treeDirectory, name)); err != nil {
+				return nil, fmt.Errorf("failed to download '%s': %w", name, err)
+			}
+		}
+	}
+
+	return meta, nil
+}
+
+func (d *ociDownloader) fetch(blob *oci.Descriptor, output string) error {
+	cached := d.cache.Has(blob.Digest)
+
+	d.logger.Info("fetching artifact file",
+		"reference", d.ref.String(),
+		"file", blob.Annotations[oci.AnnotationTitle],
+		"digest", blob.Digest,
+		"size", blob.Size,
+		"cached", cached,
+	)
+
+	return d.cache.Fetch(d.client, d.ref, blob, output) //nolint:wrapcheck
+}
@@ -0,0 +1,163 @@
+package distro
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	openbsdRamdiskName = "bsd.rd"
+
+	// The OpenBSD EFI loader reads its config from this path on the TFTP server
+	openbsdBootConfigPath = "etc/boot.conf"
+
+	// Argument whose value is passed to the ramdisk kernel as boot flags
+	openbsdFlagsArg = "flags"
+)
+
+var errNoBSDVersion = errors.New("a release version must be given, e.g. '7.6'")
+
+type openbsdArch struct {
+	// Name of the arch's directory on mirrors
+	directory string
+
+	// Name of the EFI loader
+	loader string
+}
+
+var openbsdArches = map[string]openbsdArch{
+	"x86_64":  {directory: "amd64", loader: "BOOTX64.EFI"},
+	"amd64":   {directory: "amd64", loader: "BOOTX64.EFI"},
+	"aarch64": {directory: "arm64", loader: "BOOTAA64.EFI"},
+	"arm64":   {directory: "arm64", loader: "BOOTAA64.EFI"},
+}
+
+// openbsdProvider serves the OpenBSD installer. The release's EFI loader is chainloaded,
+// and reads /etc/boot.conf from the TFTP server, which pixie generates to boot the
+// installer's ramdisk kernel (bsd.rd) from the tree.
+type openbsdProvider struct {
+	fetchOptions
+
+	logger *slog.Logger
+	client *http.Client
+
+	mirrorURL *url.URL
+	version   string
+}
+
+type openbsdOptions struct {
+	MirrorURL string `mapstructure:"mirror_url" default:"https://cdn.openbsd.org/pub/OpenBSD"`
+}
+
+func newOpenBSD(logger *slog.Logger, version string, client *http.Client, opts *openbsdOptions) (*openbsdProvider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if version == "" {
+		return nil, errNoBSDVersion
+	}
+
+	mirrorURL, err := url.Parse(opts.MirrorURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror URL '%s': %w", opts.MirrorURL, err)
+	}
+
+	return &openbsdProvider{
+		logger:    logger,
+		client:    client,
+		mirrorURL: mirrorURL,
+		version:   version,
+	}, nil
+}
+
+func (o *openbsdProvider) Latest(arches []string) (map[string]downloader, error) {
+	downloaders := make(map[string]downloader, len(arches))
+
+	for _, arch := range arches {
+		openbsdArch, ok := openbsdArches[arch]
+		if !ok {
+			return nil, fmt.Errorf("OpenBSD for arch '%s': %w", arch, errUnsupportedArch)
+		}
+
+		releaseURL := o.mirrorURL.JoinPath(o.version, openbsdArch.directory)
+
+		checksums, err := getBSDChecksums(o.client, releaseURL.JoinPath("SHA256").String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get OpenBSD checksums for arch '%s': %w", arch, err)
+		}
+
+		files := make([]artifactFile, 0, 2)
+		for _, name := range []string{openbsdArch.loader, openbsdRamdiskName} {
+			checksum, ok := checksums[name]
+			if !ok {
+				return nil, fmt.Errorf("'%s' for arch '%s': %w", name, arch, errNoChecksum)
+			}
+
+			files = append(files, artifactFile{url: releaseURL.JoinPath(name).String(), name: name, sha256: checksum})
+		}
+
+		downloaders[arch] = &artifactDownloader{
+			fetchOptions: o.fetchOptions,
+			logger:       o.logger,
+			client:       o.client,
+			hash:         artifactsHash(files...),
+			kernel:       files[0],
+			tree:         files[1:],
+			chainload:    true,
+		}
+	}
+
+	return downloaders, nil
+}
+
+// The installer finds its autoinstall(8) response file through DHCP rather than
+// arguments, so there are none to add
+func (o *openbsdProvider) installArgs(_ string, _ string) []string {
+	return nil
+}
+
+// The loader takes no load options, instead reading boot.conf
+func (o *openbsdProvider) loadOptions(_ *LoaderPaths, _ []string) []string {
+	return nil
+}
+
+func (o *openbsdProvider) loaderConfigPath() string {
+	return openbsdBootConfigPath
+}
+
+// loaderConfig generates a boot.conf booting the ramdisk kernel over TFTP. Arguments of
+// the form 'name=value' become 'set' commands (e.g. 'tty=com0' sets the console), except
+// for 'flags', whose value is passed as boot flags (e.g. 'flags=-s'), as arguments
+// starting with '-' remove earlier arguments when merged.
+func (o *openbsdProvider) loaderConfig(w io.Writer, _ treeOpener, paths *LoaderPaths, args []string) error {
+	var commands strings.Builder
+	flags := ""
+
+	for _, arg := range args {
+		name, value, found := strings.Cut(arg, "=")
+		switch {
+		case !found:
+			continue
+		case name == openbsdFlagsArg:
+			flags = value
+		default:
+			fmt.Fprintf(&commands, "set %s %s\n", name, value)
+		}
+	}
+
+	fmt.Fprintf(&commands, "boot tftp:%s/%s", paths.TreePath, openbsdRamdiskName)
+	if flags != "" {
+		commands.WriteString(" " + flags)
+	}
+
+	commands.WriteString("\n")
+
+	_, err := io.WriteString(w, commands.String())
+	return err //nolint:wrapcheck
+}
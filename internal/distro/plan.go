@@ -0,0 +1,271 @@
+package distro
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"time"
+)
+
+// Action is what a reconcile would do with a distro for an arch
+type Action string
+
+const (
+	// The latest version is already active
+	ActionNone Action = "none"
+
+	// The latest version would be downloaded and activated
+	ActionDownload Action = "download"
+
+	// The latest version would be downloaded and staged, to be activated in the next
+	// maintenance window
+	ActionStage Action = "stage"
+
+	// The latest version has already been staged, and would be activated
+	ActionActivate Action = "activate"
+
+	// The latest version has already been staged, and would stay staged until the next
+	// maintenance window
+	ActionStaged Action = "staged"
+)
+
+// Change describes what a reconcile would do with a distro for an arch
+type Change struct {
+	Distro string `json:"distro"`
+	Arch   string `json:"arch"`
+	Action Action `json:"action"`
+
+	ActiveHash string `json:"active_hash,omitempty"`
+	LatestHash string `json:"latest_hash"`
+
+	// Whether the distro's mirror wouldn't be checked, as the distro is outside of its
+	// check windows. The latest version is then the one last found on the mirror.
+	Unchecked bool `json:"unchecked,omitempty"`
+
+	// Whether the distro is pinned to a version that it was rolled back to, which
+	// reconciles keep active. The latest version is then the pinned version.
+	Pinned bool `json:"pinned,omitempty"`
+
+	// Hash of a newer version that wouldn't be downloaded, as it awaits approval
+	AwaitingApproval string `json:"awaiting_approval,omitempty"`
+
+	// Size in bytes of what would be downloaded, or -1 if it isn't known
+	DownloadSize int64 `json:"download_size,omitempty"`
+
+	// Files that would be deleted
+	Delete []string `json:"delete,omitempty"`
+
+	// Whether the active version would change, so that boot entries and loader configs
+	// for the distro would be regenerated
+	Regenerate bool `json:"regenerate"`
+}
+
+// Plan describes what a reconcile would do, without having done it
+type Plan struct {
+	// Whether a reconcile would change anything, for CI pipelines to gate on
+	HasChanges bool `json:"has_changes"`
+
+	Changes []*Change `json:"changes"`
+
+	// Distros and arches (as 'distro/arch') in the storage directory that are no longer
+	// configured. Their files are kept, but they are no longer served.
+	Unconfigured []string `json:"unconfigured,omitempty"`
+}
+
+// hasChanges returns whether a reconcile would change anything
+func (p *Plan) hasChanges() bool {
+	if len(p.Unconfigured) > 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(p.Changes, func(change *Change) bool {
+		return (change.Action != ActionNone && change.Action != ActionStaged) || len(change.Delete) > 0
+	})
+}
+
+// Plan checks the latest version of each configured distro, and returns what Reconcile
+// would do, without downloading or changing anything
+func (m *Manager) Plan() (*Plan, error) {
+	names := make([]string, 0, len(m.providers))
+	for name := range m.providers {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	plan := &Plan{Changes: []*Change{}}
+
+	for _, name := range names {
+		downloaders, err := m.candidates(name, true)
+		if err != nil {
+			return nil, err
+		}
+
+		arches := make([]string, 0, len(downloaders))
+		for arch := range downloaders {
+			arches = append(arches, arch)
+		}
+
+		slices.Sort(arches)
+
+		for _, arch := range arches {
+			change, err := m.planForArch(name, arch, downloaders[arch])
+			if err != nil {
+				return nil, fmt.Errorf("failed to plan distro '%s': %w", name, err)
+			}
+
+			plan.Changes = append(plan.Changes, change)
+		}
+	}
+
+	unconfigured, err := m.unconfigured()
+	if err != nil {
+		return nil, err
+	}
+
+	plan.Unconfigured = unconfigured
+	plan.HasChanges = plan.hasChanges()
+
+	return plan, nil
+}
+
+// planForArch makes the same decisions as reconcileForArch, but only reports them
+func (m *Manager) planForArch(name string, arch string, downloader downloader) (*Change, error) {
+	directory := path.Join(name, arch)
+	stagedMetaFilePath := path.Join(directory, stagedMetadataFilename)
+
+	state, err := readInstallState(m.artifacts, directory, downloader)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &Change{
+		Distro:     name,
+		Arch:       arch,
+		Action:     ActionNone,
+		LatestHash: downloader.Hash(),
+	}
+
+	if known, ok := downloader.(*knownVersion); ok {
+		change.Unchecked = !known.pinned && known.available == ""
+		change.Pinned = known.pinned
+		change.AwaitingApproval = known.available
+	}
+
+	if state.active != nil {
+		change.ActiveHash = state.active.Hash
+	}
+
+	staged, err := m.artifacts.Open(stagedMetaFilePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open staged metadata: %w", err)
+	}
+
+	hasStaged := err == nil
+	if hasStaged {
+		_ = staged.Close()
+	}
+
+	// Any staged version is stale, and is removed
+	if state.upToDate {
+		if hasStaged {
+			change.Delete = append(change.Delete, stagedMetaFilePath)
+		}
+
+		return change, nil
+	}
+
+	windowOpen, err := m.windows[name].Open(time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to check maintenance windows: %w", err)
+	}
+
+	activate := windowOpen || state.active == nil
+
+	switch {
+	case state.staged == nil && activate:
+		change.Action = ActionDownload
+	case state.staged == nil:
+		change.Action = ActionStage
+	case activate:
+		change.Action = ActionActivate
+	default:
+		change.Action = ActionStaged
+	}
+
+	if state.staged == nil {
+		change.DownloadSize = m.downloadSize(name, arch, downloader)
+	}
+
+	if activate {
+		change.Regenerate = true
+
+		if hasStaged {
+			change.Delete = append(change.Delete, stagedMetaFilePath)
+		}
+	}
+
+	return change, nil
+}
+
+// downloadSize returns how much the downloader would download, or -1 if it isn't known
+func (m *Manager) downloadSize(name string, arch string, downloader downloader) int64 {
+	sizer, ok := downloader.(sizer)
+	if !ok {
+		return -1
+	}
+
+	size, err := sizer.DownloadSize()
+	if err != nil {
+		m.logger.Warn("failed to find download size of distro",
+			"distro", name,
+			"arch", arch,
+			"error", err,
+		)
+
+		return -1
+	}
+
+	return size
+}
+
+// unconfigured returns the distros and arches in the artifact store that have been
+// downloaded, but are no longer configured, as 'distro/arch'
+func (m *Manager) unconfigured() ([]string, error) {
+	names, err := m.artifacts.List("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list downloaded distros: %w", err)
+	}
+
+	unconfigured := []string{}
+
+	for _, name := range names {
+		arches, err := m.artifacts.List(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list downloaded arches of distro '%s': %w", name, err)
+		}
+
+		for _, arch := range arches {
+			if _, ok := m.providers[name]; ok && slices.Contains(m.arches[name], arch) {
+				continue
+			}
+
+			// The store may have other state in it too (e.g. if it's the storage
+			// directory), so only directories with distro metadata are counted
+			meta, err := readMetadata(m.artifacts, path.Join(name, arch, metadataFilename))
+			if err != nil {
+				return nil, err
+			}
+
+			if meta != nil {
+				unconfigured = append(unconfigured, name+"/"+arch)
+			}
+		}
+	}
+
+	slices.Sort(unconfigured)
+
+	return unconfigured, nil
+}
@@ -0,0 +1,276 @@
+package distro
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+var errInsufficientSpace = errors.New("not enough space in storage directory")
+
+// QuotaConfig limits the disk space used by the storage directory. Before each download,
+// the least recently used distro versions that are neither active nor staged are deleted
+// until the download fits. Versions kept in an object store are never evicted, but only
+// the last few versions of each distro are kept in either.
+type QuotaConfig struct {
+	// Maximum size in megabytes of the storage directory, including distros, cached OCI
+	// blobs and downloads in progress. Zero means no limit.
+	MaxSize int64 `mapstructure:"max_size"`
+
+	// Free space in megabytes to leave on the storage directory's file system after
+	// each download, including downloads that are uploaded to an object store
+	MinFree int64 `mapstructure:"min_free" default:"1024"`
+
+	// Number of previous versions of each distro and arch to keep once a new version is
+	// activated, so that they can be rolled back to. Older versions are deleted. Negative
+	// keeps every version, until it's evicted to stay within quota.
+	KeepVersions int `mapstructure:"keep_versions" default:"3"`
+
+	// Store files that are identical between downloaded versions (e.g. the same kernel
+	// in several releases or flavours of a distro) once, in a pool in the local artifact
+	// store that the versions hard link to. Files are pooled as they're downloaded.
+	Deduplicate bool `mapstructure:"deduplicate" default:"true"`
+}
+
+// storedVersion is a downloaded version of a distro that may be evicted
+type storedVersion struct {
+	// Local path of the version's directory
+	path string
+	size int64
+
+	// When the version was last active
+	lastUsed time.Time
+}
+
+// reserveSpace makes room in the storage directory for the downloader's download,
+// evicting unused versions as needed. The space is reserved (so that parallel downloads
+// don't count the same free space, or evict each other) until the returned function is
+// called. If the size of the download isn't known, only the space already in use is
+// checked.
+func (m *Manager) reserveSpace(name string, arch string, downloader downloader) (func(), error) {
+	if m.quota == nil || (m.quota.MaxSize <= 0 && m.quota.MinFree <= 0) {
+		return func() {}, nil
+	}
+
+	need := max(m.downloadSize(name, arch, downloader), 0)
+	directory := path.Join(name, arch, downloader.Hash())
+
+	m.spaceMu.Lock()
+	defer m.spaceMu.Unlock()
+
+	if err := os.MkdirAll(m.storageDirectory, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create directories in path '%s': %w", m.storageDirectory, err)
+	}
+
+	versions, err := m.evictableVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		used, free, err := m.spaceUsage()
+		if err != nil {
+			return nil, err
+		}
+
+		overQuota := m.quota.MaxSize > 0 && used+m.reserved+need > m.quota.MaxSize*bytesInMebibyte
+		underFree := m.quota.MinFree > 0 && free-m.reserved-need < m.quota.MinFree*bytesInMebibyte
+
+		if !overQuota && !underFree {
+			break
+		}
+
+		if len(versions) == 0 {
+			return nil, fmt.Errorf("distro '%s' (%s) needs %0.2fMiB, with %0.2fMiB in use and %0.2fMiB free, and no unused versions are left to evict: %w",
+				name, arch,
+				float64(need)/bytesInMebibyte,
+				float64(used+m.reserved)/bytesInMebibyte,
+				float64(free-m.reserved)/bytesInMebibyte,
+				errInsufficientSpace,
+			)
+		}
+
+		evicted := versions[0]
+		versions = versions[1:]
+
+		m.logger.Info("evicting least recently used distro version to make space",
+			"path", evicted.path,
+			"size", fmt.Sprintf("%0.2fMiB", float64(evicted.size)/bytesInMebibyte),
+			"last_used", evicted.lastUsed,
+		)
+
+		if err := os.RemoveAll(evicted.path); err != nil {
+			return nil, fmt.Errorf("failed to evict distro version '%s': %w", evicted.path, err)
+		}
+
+		m.collectPool()
+	}
+
+	m.reserved += need
+	m.downloading[directory] = true
+
+	return func() {
+		m.spaceMu.Lock()
+		defer m.spaceMu.Unlock()
+
+		m.reserved -= need
+		delete(m.downloading, directory)
+	}, nil
+}
+
+// spaceUsage returns the bytes used by the storage directory, and the bytes free on its
+// file system
+func (m *Manager) spaceUsage() (int64, int64, error) {
+	free, err := freeSpace(m.storageDirectory)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to find free space in '%s': %w", m.storageDirectory, err)
+	}
+
+	used, err := directorySize(m.storageDirectory)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return used, free, nil
+}
+
+// evictableVersions returns the versions of distros in the local artifact store that are
+// neither active nor staged, least recently used first
+func (m *Manager) evictableVersions() ([]*storedVersion, error) {
+	if _, ok := m.artifacts.LocalPath(""); !ok {
+		return nil, nil
+	}
+
+	names, err := m.artifacts.List("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list downloaded distros: %w", err)
+	}
+
+	versions := []*storedVersion{}
+
+	for _, name := range names {
+		arches, err := m.artifacts.List(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list downloaded arches of distro '%s': %w", name, err)
+		}
+
+		for _, arch := range arches {
+			archVersions, err := m.unusedVersions(path.Join(name, arch))
+			if err != nil {
+				return nil, err
+			}
+
+			versions = append(versions, archVersions...)
+		}
+	}
+
+	slices.SortFunc(versions, func(a *storedVersion, b *storedVersion) int {
+		return a.lastUsed.Compare(b.lastUsed)
+	})
+
+	return versions, nil
+}
+
+// unusedVersions returns the versions in a distro's directory that are neither active,
+// staged nor being downloaded. Directories without distro metadata (e.g. other state kept in the storage
+// directory) are ignored.
+func (m *Manager) unusedVersions(directory string) ([]*storedVersion, error) {
+	active, err := readMetadata(m.artifacts, path.Join(directory, metadataFilename))
+	if err != nil || active == nil {
+		return nil, err
+	}
+
+	staged, err := readMetadata(m.artifacts, path.Join(directory, stagedMetadataFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	hashes, err := m.artifacts.List(directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions in '%s': %w", directory, err)
+	}
+
+	versions := []*storedVersion{}
+
+	for _, hash := range hashes {
+		if hash == active.Hash || (staged != nil && hash == staged.Hash) || m.downloading[path.Join(directory, hash)] {
+			continue
+		}
+
+		local, _ := m.artifacts.LocalPath(path.Join(directory, hash))
+
+		info, err := os.Stat(local)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		size, err := directorySize(local)
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, &storedVersion{path: local, size: size, lastUsed: info.ModTime()})
+	}
+
+	return versions, nil
+}
+
+// markUsed records that the version in directory is active, so that it's among the last
+// to be evicted once it no longer is
+func (m *Manager) markUsed(directory string) {
+	local, ok := m.artifacts.LocalPath(directory)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(local, now, now); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		m.logger.Warn("failed to record use of distro version",
+			"path", local,
+			"error", err,
+		)
+	}
+}
+
+// directorySize returns the total size of the files within a local directory. Files
+// linked more than once in the directory (e.g. to the pool) are only counted once.
+func directorySize(directory string) (int64, error) {
+	var size int64
+
+	seen := make(map[fileID]bool)
+
+	err := filepath.WalkDir(directory, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			if id, links, ok := fileLinks(info); ok && links > 1 {
+				if seen[id] {
+					return nil
+				}
+
+				seen[id] = true
+			}
+
+			size += info.Size()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to find size of '%s': %w", directory, err)
+	}
+
+	return size, nil
+}
@@ -117,6 +117,20 @@ func (r *rockyProvider) Latest(arches []string) (map[string]downloader, error) {
 	return downloaders, nil
 }
 
+func (r *rockyProvider) installArgs(repoURL string, automationURL string) []string {
+	var args []string
+
+	if repoURL != "" {
+		args = append(args, "inst.repo="+repoURL)
+	}
+
+	if automationURL != "" {
+		args = append(args, "inst.ks="+automationURL)
+	}
+
+	return args
+}
+
 func (r *rockyProvider) latestVersion() (*semver.Version, *url.URL, error) {
 	pubVersions, err := r.listDirectory(r.mirrorURL.JoinPath(rockyPubPath), rockyVersionLink)
 	if err != nil {
@@ -367,6 +381,10 @@ func (d *rockyDownloader) HasDrifted(meta *metadata) (bool, error) {
 	return drifted, nil
 }
 
+func (d *rockyDownloader) DownloadSize() (int64, error) {
+	return contentLength(d.client, d.isoURL.String())
+}
+
 func (d *rockyDownloader) Download(directory string) (*metadata, error) {
 	isoFile, err := os.OpenFile(filepath.Join(directory, "_rocky_download.iso"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
 	if err != nil {
@@ -0,0 +1,149 @@
+package distro
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"time"
+)
+
+var errNotChecked = errors.New("distro can't be downloaded outside of its check windows")
+
+// candidates returns the version of the distro for each of its arches that reconciles
+// bring it up to date with. Arches pinned by a rollback keep the version rolled back to,
+// and distros whose updates must be approved keep their version until a newer one is.
+// Otherwise, this is the latest version on the distro's mirror, unless the distro is
+// outside of its check windows, in which case it's the version last found on the
+// mirror: the staged version if there is one, or else the active version.
+//
+// The mirror is checked regardless for distros with an arch that hasn't been downloaded,
+// or whose files have been corrupted, as they would otherwise go unserved.
+//
+// Newer versions awaiting approval are recorded in the distro's history, unless only
+// planning a reconcile.
+func (m *Manager) candidates(name string, planning bool) (map[string]downloader, error) {
+	pinned, err := m.pinned(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pinned) > 0 {
+		m.logger.Info("keeping rolled back versions of distro until it's unpinned",
+			"distro", name,
+			"arches", slices.Sorted(maps.Keys(pinned)),
+		)
+
+		if len(pinned) == len(m.arches[name]) {
+			return withPins(nil, pinned), nil
+		}
+	}
+
+	downloaders, err := m.scheduled(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if downloaders, err = m.holdUpdates(name, downloaders, pinned, !planning); err != nil {
+		return nil, err
+	}
+
+	return withPins(downloaders, pinned), nil
+}
+
+// scheduled returns the versions that the distro is brought up to date with, by its
+// check windows, as described by [Manager.candidates]
+func (m *Manager) scheduled(name string) (map[string]downloader, error) {
+	windows, ok := m.checkWindows[name]
+	if !ok {
+		return m.latest(name)
+	}
+
+	now := time.Now()
+
+	open, err := windows.Open(now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check whether distro '%s' is in a check window: %w", name, err)
+	}
+
+	if open || len(m.arches[name]) == 0 {
+		return m.latest(name)
+	}
+
+	downloaders := make(map[string]downloader, len(m.arches[name]))
+
+	for _, arch := range m.arches[name] {
+		directory := path.Join(name, arch)
+
+		meta, err := readMetadata(m.artifacts, path.Join(directory, stagedMetadataFilename))
+		if err != nil {
+			return nil, fmt.Errorf("could not read staged metadata for distro '%s': %w", name, err)
+		}
+
+		active, err := readMetadata(m.artifacts, path.Join(directory, metadataFilename))
+		if err != nil {
+			return nil, fmt.Errorf("could not read metadata for distro '%s': %w", name, err)
+		}
+
+		if active == nil || m.verifier.corrupted(directory, active.Hash) {
+			return m.latest(name)
+		}
+
+		if meta == nil {
+			meta = active
+		}
+
+		downloaders[arch] = &knownVersion{hash: meta.Hash}
+	}
+
+	next, _ := windows.NextOpening(now)
+
+	m.logger.Info("not checking distro's mirror for new versions outside of its check windows",
+		"distro", name,
+		"next_check", next,
+	)
+
+	return downloaders, nil
+}
+
+// NextCheck returns when the check window of a distro next opens, or the zero time if
+// no distro has check windows
+func (m *Manager) NextCheck(t time.Time) time.Time {
+	var next time.Time
+
+	for _, windows := range m.checkWindows {
+		// Windows are validated when the manager is created
+		opening, _ := windows.NextOpening(t)
+
+		if next.IsZero() || (!opening.IsZero() && opening.Before(next)) {
+			next = opening
+		}
+	}
+
+	return next
+}
+
+// knownVersion is a version of a distro that has already been downloaded: the version
+// last found on its mirror, the version that it's pinned to, or the version that it's
+// kept at until a newer version is approved
+type knownVersion struct {
+	hash   string
+	pinned bool
+
+	// Hash of the newer version awaiting approval
+	available string
+}
+
+func (k *knownVersion) Hash() string {
+	return k.hash
+}
+
+func (k *knownVersion) HasDrifted(meta *metadata) (bool, error) {
+	return meta.Hash != k.hash, nil
+}
+
+// Download is never needed, as the version has already been downloaded
+func (k *knownVersion) Download(_ string) (*metadata, error) {
+	return nil, errNotChecked
+}
@@ -0,0 +1,119 @@
+package distro
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+var errNoTalosVersion = errors.New("a Talos version must be given, e.g. 'v1.9.0', as machine configs are specific to a version")
+
+// talosArches maps arches to the names used in Talos release assets
+var talosArches = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+}
+
+// talosProvider serves the PXE images of a Talos Linux release, either the default
+// images from GitHub or those of an Image Factory schematic (e.g. with extra system
+// extensions). Talos fetches its machine config from the host's automation file.
+type talosProvider struct {
+	fetchOptions
+
+	logger *slog.Logger
+	client *http.Client
+
+	releaseURL *url.URL
+
+	// Factory images name their kernel 'kernel-<arch>' rather than 'vmlinuz-<arch>'
+	kernelPrefix string
+}
+
+type talosOptions struct {
+	// Image Factory schematic ID. If unset, the default images are downloaded from the
+	// release on GitHub.
+	Schematic string `mapstructure:"schematic"`
+
+	// URL of the Image Factory
+	FactoryURL string `mapstructure:"factory_url" default:"https://factory.talos.dev"`
+
+	// URL of the GitHub releases of Talos, used if there is no schematic
+	ReleasesURL string `mapstructure:"releases_url" default:"https://github.com/siderolabs/talos/releases/download"`
+}
+
+func newTalos(logger *slog.Logger, version string, client *http.Client, opts *talosOptions) (*talosProvider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if version == "" {
+		return nil, errNoTalosVersion
+	}
+
+	rawURL := opts.ReleasesURL
+	kernelPrefix := "vmlinuz"
+
+	if opts.Schematic != "" {
+		rawURL = opts.FactoryURL
+		kernelPrefix = "kernel"
+	}
+
+	baseURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Talos download URL '%s': %w", rawURL, err)
+	}
+
+	releaseURL := baseURL.JoinPath(version)
+	if opts.Schematic != "" {
+		releaseURL = baseURL.JoinPath("image", opts.Schematic, version)
+	}
+
+	return &talosProvider{
+		logger:       logger,
+		client:       client,
+		releaseURL:   releaseURL,
+		kernelPrefix: kernelPrefix,
+	}, nil
+}
+
+func (t *talosProvider) Latest(arches []string) (map[string]downloader, error) {
+	downloaders := make(map[string]downloader, len(arches))
+
+	for _, arch := range arches {
+		talosArch, ok := talosArches[arch]
+		if !ok {
+			return nil, fmt.Errorf("Talos for arch '%s': %w", arch, errUnsupportedArch)
+		}
+
+		kernel := artifactFile{url: t.releaseURL.JoinPath(t.kernelPrefix + "-" + talosArch).String(), name: "vmlinuz"}
+		initrd := artifactFile{url: t.releaseURL.JoinPath("initramfs-" + talosArch + ".xz").String(), name: "initramfs.xz"}
+
+		downloaders[arch] = &artifactDownloader{
+			fetchOptions: t.fetchOptions,
+			logger:       t.logger,
+			client:       t.client,
+			hash:         artifactsHash(kernel, initrd),
+			kernel:       kernel,
+			initrd:       initrd,
+		}
+	}
+
+	return downloaders, nil
+}
+
+// Talos runs from its initramfs, so needs no repo. The arguments besides the machine
+// config are those that Talos requires of every bootloader; a console may be added
+// with the distro's kernel arguments.
+func (t *talosProvider) installArgs(_ string, automationURL string) []string {
+	args := []string{"talos.platform=metal", "init_on_alloc=1", "slab_nomerge", "pti=on"}
+
+	if automationURL != "" {
+		args = append(args, "talos.config="+automationURL)
+	}
+
+	return args
+}
@@ -0,0 +1,288 @@
+package distro
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Utility tools served by the tools provider
+const (
+	toolMemtest    = "memtest86+"
+	toolGParted    = "gparted"
+	toolClonezilla = "clonezilla"
+)
+
+const toolsTreeDirectory = "tree"
+
+var (
+	errUnknownTool         = errors.New("tool must be one of 'memtest86+', 'gparted' or 'clonezilla'")
+	errToolUnsupportedArch = errors.New("tool is not available for arch")
+	errToolFileMissing     = errors.New("file not found in tool archive")
+)
+
+// tool describes where to download a utility tool, and which files of its release
+// archive are needed to boot it
+type tool struct {
+	// Version downloaded if the distro has none configured
+	defaultVersion string
+
+	// Template of the release archive URL, given the version
+	urlTmpl *template.Template
+
+	// Supported arches, mapped to the path of the kernel (or EFI program) in the archive
+	kernels map[string]string
+
+	// Path of the initrd in the archive, if the tool has one
+	initrd string
+
+	// Files of a Debian live system, extracted into the tree and fetched by the live
+	// initrd over HTTP
+	liveFiles []string
+}
+
+var tools = map[string]*tool{
+	toolMemtest: {
+		defaultVersion: "7.20",
+		urlTmpl:        template.Must(template.New("memtest").Parse("https://memtest.org/download/v{{ .Version }}/mt86plus_{{ .Version }}.binaries.zip")),
+		kernels:        map[string]string{"x86_64": "memtest64.efi"},
+	},
+	toolGParted: {
+		defaultVersion: "1.6.0-10",
+		urlTmpl:        template.Must(template.New("gparted").Parse("https://downloads.sourceforge.net/gparted/gparted-live-{{ .Version }}-amd64.zip")),
+		kernels:        map[string]string{"x86_64": "live/vmlinuz"},
+		initrd:         "live/initrd.img",
+		liveFiles:      []string{"live/filesystem.squashfs"},
+	},
+	toolClonezilla: {
+		defaultVersion: "3.2.0-5",
+		urlTmpl:        template.Must(template.New("clonezilla").Parse("https://downloads.sourceforge.net/clonezilla/clonezilla-live-{{ .Version }}-amd64.zip")),
+		kernels:        map[string]string{"x86_64": "live/vmlinuz"},
+		initrd:         "live/initrd.img",
+		liveFiles:      []string{"live/filesystem.squashfs"},
+	},
+}
+
+// toolsProvider serves a utility tool, such as memtest86+, from its upstream release
+// archive. Tools are pinned to a version, so only change when the version (or URL) in
+// the config changes.
+type toolsProvider struct {
+	fetchOptions
+
+	logger *slog.Logger
+	client *http.Client
+
+	name string
+	tool *tool
+	url  string
+}
+
+type toolsOptions struct {
+	// Tool to serve: 'memtest86+', 'gparted' or 'clonezilla'
+	Tool string `mapstructure:"tool" default:"memtest86+"`
+
+	// URL of the tool's release archive, overriding the upstream download URL for the
+	// version, e.g. to use a local mirror
+	URL string `mapstructure:"url"`
+}
+
+func newTools(logger *slog.Logger, version string, client *http.Client, opts *toolsOptions) (*toolsProvider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	t, ok := tools[opts.Tool]
+	if !ok {
+		return nil, fmt.Errorf("'%s': %w", opts.Tool, errUnknownTool)
+	}
+
+	url := opts.URL
+	if url == "" {
+		if version == "" {
+			version = t.defaultVersion
+		}
+
+		buff := &bytes.Buffer{}
+		if err := t.urlTmpl.Execute(buff, struct{ Version string }{Version: version}); err != nil {
+			return nil, fmt.Errorf("failed to execute tool URL template: %w", err)
+		}
+
+		url = buff.String()
+	}
+
+	return &toolsProvider{
+		logger: logger,
+		client: client,
+		name:   opts.Tool,
+		tool:   t,
+		url:    url,
+	}, nil
+}
+
+func (p *toolsProvider) Latest(arches []string) (map[string]downloader, error) {
+	downloaders := make(map[string]downloader, len(arches))
+
+	for _, arch := range arches {
+		kernel, ok := p.tool.kernels[arch]
+		if !ok {
+			return nil, fmt.Errorf("%s for arch '%s': %w", p.name, arch, errToolUnsupportedArch)
+		}
+
+		h := sha256.New()
+		fmt.Fprintf(h, "%s\n%s\n", p.url, arch)
+
+		downloaders[arch] = &toolsDownloader{
+			fetchOptions: p.fetchOptions,
+			logger:       p.logger,
+			client:       p.client,
+			tool:         p.tool,
+			url:          p.url,
+			kernel:       kernel,
+			hash:         fmt.Sprintf("%x", h.Sum(nil)),
+		}
+	}
+
+	return downloaders, nil
+}
+
+// Live systems fetch their root file system from the tree, which is given as the repo
+// URL. Other tools take no arguments.
+func (p *toolsProvider) installArgs(repoURL string, _ string) []string {
+	if len(p.tool.liveFiles) == 0 || repoURL == "" {
+		return nil
+	}
+
+	return []string{
+		"boot=live",
+		"union=overlay",
+		"components",
+		"noswap",
+		"fetch=" + repoURL + path.Base(p.tool.liveFiles[0]),
+	}
+}
+
+type toolsDownloader struct {
+	fetchOptions
+
+	logger *slog.Logger
+	client *http.Client
+	tool   *tool
+	url    string
+	kernel string
+	hash   string
+}
+
+func (d *toolsDownloader) Hash() string {
+	return d.hash
+}
+
+func (d *toolsDownloader) HasDrifted(meta *metadata) (bool, error) {
+	return meta.Hash != d.hash, nil
+}
+
+func (d *toolsDownloader) DownloadSize() (int64, error) {
+	return contentLength(d.client, d.url)
+}
+
+func (d *toolsDownloader) Download(directory string) (*metadata, error) {
+	archive, err := os.CreateTemp(directory, "_tool_download-*.zip")
+	if err != nil {
+		return nil, fmt.Errorf("could not create archive file: %w", err)
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	if err := d.fetch(d.logger, d.client, d.url, archive, "downloading tool"); err != nil {
+		return nil, fmt.Errorf("failed to download tool archive: %w", err)
+	}
+
+	info, err := archive.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat tool archive: %w", err)
+	}
+
+	reader, err := zip.NewReader(archive, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tool archive: %w", err)
+	}
+
+	meta := &metadata{Hash: d.hash}
+
+	meta.KernelPath = path.Base(d.kernel)
+	if err := extractZipFile(reader, d.kernel, filepath.Join(directory, meta.KernelPath)); err != nil {
+		return nil, err
+	}
+
+	if d.tool.initrd != "" {
+		meta.InitrdPath = path.Base(d.tool.initrd)
+		if err := extractZipFile(reader, d.tool.initrd, filepath.Join(directory, meta.InitrdPath)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(d.tool.liveFiles) > 0 {
+		meta.TreePath = toolsTreeDirectory
+
+		treeDirectory := filepath.Join(directory, toolsTreeDirectory)
+		if err := os.MkdirAll(treeDirectory, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create directories in path '%s': %w", treeDirectory, err)
+		}
+
+		for _, file := range d.tool.liveFiles {
+			if err := extractZipFile(reader, file, filepath.Join(treeDirectory, path.Base(file))); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return meta, nil
+}
+
+// extractZipFile extracts the file at the given path in the archive to output. Paths
+// are matched case-insensitively, and may be nested in a top-level directory, as some
+// release archives are.
+func extractZipFile(reader *zip.Reader, name string, output string) error {
+	var file *zip.File
+	for _, candidate := range reader.File {
+		if strings.EqualFold(candidate.Name, name) || strings.HasSuffix(strings.ToLower(candidate.Name), "/"+strings.ToLower(name)) {
+			file = candidate
+			break
+		}
+	}
+
+	if file == nil {
+		return fmt.Errorf("'%s': %w", name, errToolFileMissing)
+	}
+
+	in, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open '%s' in tool archive: %w", name, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to extract '%s' from tool archive: %w", name, err)
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %w", err)
+	}
+
+	return nil
+}
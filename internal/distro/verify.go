@@ -0,0 +1,125 @@
+package distro
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/davejbax/pixie/internal/storage"
+)
+
+// ErrChecksumMismatch is returned when a stored kernel or initrd no longer matches the
+// checksum recorded when it was downloaded, e.g. because the storage has corrupted it
+var ErrChecksumMismatch = errors.New("stored file does not match its recorded checksum")
+
+// verifier checks stored kernels and initrds against their recorded checksums before
+// they're served. Results are cached by each file's size and modification time, so that
+// a file is only hashed again once it has been rewritten.
+type verifier struct {
+	store storage.Backend
+
+	mu    sync.Mutex
+	files map[string]*verification
+
+	// Hashes of the versions whose files failed verification, keyed by distro
+	// directory. The next reconcile downloads these versions again.
+	corrupt map[string]string
+}
+
+// verification is the cached result of verifying a stored file
+type verification struct {
+	mu sync.Mutex
+
+	checksum string
+	size     int64
+	modTime  time.Time
+	ok       bool
+}
+
+func newVerifier(store storage.Backend) *verifier {
+	return &verifier{
+		store:   store,
+		files:   make(map[string]*verification),
+		corrupt: make(map[string]string),
+	}
+}
+
+// verify checks that the opened file matches checksum, hashing it again (from a second
+// reader) only if it has changed since it was last verified. Files without a recorded
+// checksum aren't checked. [ErrChecksumMismatch] is returned if the file doesn't match,
+// and the version in directory is marked to be downloaded again.
+func (v *verifier) verify(file storage.Object, name string, checksum string, directory string, hash string) error {
+	if checksum == "" {
+		return nil
+	}
+
+	v.mu.Lock()
+	result, ok := v.files[name]
+	if !ok {
+		result = &verification{}
+		v.files[name] = result
+	}
+	v.mu.Unlock()
+
+	// Concurrent requests for the same file wait for a single hash of it
+	result.mu.Lock()
+	defer result.mu.Unlock()
+
+	if result.checksum != checksum || result.size != file.Size() || !result.modTime.Equal(file.ModTime()) {
+		actual, err := v.checksum(name)
+		if err != nil {
+			return err
+		}
+
+		result.checksum = checksum
+		result.size = file.Size()
+		result.modTime = file.ModTime()
+		result.ok = actual == checksum
+	}
+
+	if !result.ok {
+		v.mu.Lock()
+		v.corrupt[directory] = hash
+		v.mu.Unlock()
+
+		return fmt.Errorf("'%s': %w", name, ErrChecksumMismatch)
+	}
+
+	return nil
+}
+
+// checksum returns the SHA-256 checksum of the named stored file, in hex
+func (v *verifier) checksum(name string) (string, error) {
+	file, err := v.store.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to open '%s' to verify it: %w", name, err)
+	}
+	defer file.Close()
+
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, file); err != nil {
+		return "", fmt.Errorf("failed to read '%s' to verify it: %w", name, err)
+	}
+
+	return fmt.Sprintf("%x", checksum.Sum(nil)), nil
+}
+
+// corrupted returns whether the version with the given hash in directory has files that
+// failed verification
+func (v *verifier) corrupted(directory string, hash string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.corrupt[directory] == hash
+}
+
+// repaired records that the version in directory has been downloaded again
+func (v *verifier) repaired(directory string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.corrupt, directory)
+}
@@ -0,0 +1,303 @@
+package distro
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+const (
+	windowsTreeDirectory = "tree"
+	wimbootName          = "wimboot"
+
+	// wimboot is tens of kilobytes, so anything much larger isn't wimboot
+	maxWimbootSize = 16 * 1024 * 1024
+)
+
+var (
+	errNoWindowsISO       = errors.New("the 'iso' option must be given")
+	errNoWimbootSHA256    = errors.New("the 'wimboot_sha256' option must be given as a hex SHA-256 checksum")
+	errWindowsSingleArch  = errors.New("a Windows ISO contains a single architecture, so exactly one arch must be given")
+	errWindowsFileMissing = errors.New("file not found in the ISO 9660 file system of the ISO (UDF-only images are not supported)")
+	errWimbootTooLarge    = errors.New("wimboot is implausibly large")
+)
+
+// windowsBootFile is a file that wimboot loads, as found on Windows installation media
+type windowsBootFile struct {
+	// Path on the ISO, matched case-insensitively
+	source string
+
+	// Name that the file is given to wimboot under
+	name string
+
+	// Optional files are left out if the ISO doesn't have them
+	optional bool
+}
+
+// windowsBootFiles returns the files that wimboot needs to boot Windows PE on the given
+// arch. The EFI boot manager is optional, as wimboot can extract it from boot.wim.
+func windowsBootFiles(arch string) []windowsBootFile {
+	bootManager := "bootx64.efi"
+	if arch == "aarch64" || arch == "arm64" {
+		bootManager = "bootaa64.efi"
+	}
+
+	return []windowsBootFile{
+		{source: "efi/boot/" + bootManager, name: bootManager, optional: true},
+		{source: "efi/microsoft/boot/bcd", name: "BCD"},
+		{source: "boot/boot.sdi", name: "boot.sdi"},
+		{source: "sources/boot.wim", name: "boot.wim"},
+	}
+}
+
+// windowsProvider serves Windows PE from a user-supplied Windows ISO, booted with
+// wimboot. Windows media can't be downloaded automatically, so the ISO is re-ingested
+// whenever the file changes.
+type windowsProvider struct {
+	logger *slog.Logger
+	client *http.Client
+
+	isoPath       string
+	wimbootURL    string
+	wimbootSHA256 string
+}
+
+type windowsOptions struct {
+	// Path to a Windows installation or Windows PE ISO
+	ISO string `mapstructure:"iso"`
+
+	// URL to download wimboot from
+	WimbootURL string `mapstructure:"wimboot_url" default:"https://github.com/ipxe/wimboot/releases/download/v2.8.0/wimboot"`
+
+	// Expected SHA-256 checksum of wimboot, in hex, e.g. from 'sha256sum' of a copy that
+	// you trust. Required, as clients run wimboot as it was downloaded; the distro fails
+	// to ingest if the download doesn't match.
+	WimbootSHA256 string `mapstructure:"wimboot_sha256"`
+}
+
+func newWindows(logger *slog.Logger, client *http.Client, opts *windowsOptions) (*windowsProvider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if opts.ISO == "" {
+		return nil, errNoWindowsISO
+	}
+
+	if digest, err := hex.DecodeString(opts.WimbootSHA256); err != nil || len(digest) != sha256.Size {
+		return nil, errNoWimbootSHA256
+	}
+
+	return &windowsProvider{
+		logger:        logger,
+		client:        client,
+		isoPath:       opts.ISO,
+		wimbootURL:    opts.WimbootURL,
+		wimbootSHA256: strings.ToLower(opts.WimbootSHA256),
+	}, nil
+}
+
+func (w *windowsProvider) Latest(arches []string) (map[string]downloader, error) {
+	if len(arches) != 1 {
+		return nil, errWindowsSingleArch
+	}
+
+	info, err := os.Stat(w.isoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat Windows ISO: %w", err)
+	}
+
+	// wimboot is small enough to fetch on every reconcile, so that the distro is
+	// identified by what it actually boots with, rather than by a URL whose contents
+	// can change
+	wimboot, err := w.fetchWimboot()
+	if err != nil {
+		return nil, fmt.Errorf("failed to download wimboot: %w", err)
+	}
+
+	wimbootSHA256 := fmt.Sprintf("%x", sha256.Sum256(wimboot))
+	if wimbootSHA256 != w.wimbootSHA256 {
+		return nil, fmt.Errorf("'%s': %w", w.wimbootURL, errChecksumMismatch)
+	}
+
+	// Hashing the whole ISO on every reconcile would be slow, so it's identified by its
+	// size and modification time instead
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%d\n%s\n", w.isoPath, info.Size(), info.ModTime().UnixNano(), wimbootSHA256)
+
+	return map[string]downloader{
+		arches[0]: &windowsDownloader{
+			logger:  w.logger,
+			arch:    arches[0],
+			isoPath: w.isoPath,
+			wimboot: wimboot,
+			hash:    fmt.Sprintf("%x", h.Sum(nil)),
+		},
+	}, nil
+}
+
+// fetchWimboot downloads wimboot into memory
+func (w *windowsProvider) fetchWimboot() ([]byte, error) {
+	resp, err := w.client.Get(w.wimbootURL)
+	if err != nil {
+		return nil, fmt.Errorf("GET failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHTTPError(resp)
+	}
+
+	wimboot, err := io.ReadAll(io.LimitReader(resp.Body, maxWimbootSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wimboot: %w", err)
+	}
+
+	if len(wimboot) > maxWimbootSize {
+		return nil, errWimbootTooLarge
+	}
+
+	return wimboot, nil
+}
+
+// Windows PE is configured through files in the WIM rather than kernel arguments, so
+// there are none to add
+func (w *windowsProvider) installArgs(_ string, _ string) []string {
+	return nil
+}
+
+type windowsDownloader struct {
+	logger  *slog.Logger
+	arch    string
+	isoPath string
+	hash    string
+
+	// wimboot, as downloaded when the hash was taken
+	wimboot []byte
+}
+
+func (d *windowsDownloader) Hash() string {
+	return d.hash
+}
+
+func (d *windowsDownloader) HasDrifted(meta *metadata) (bool, error) {
+	return meta.Hash != d.hash, nil
+}
+
+// The boot files are extracted from the ISO, so only wimboot is downloaded
+func (d *windowsDownloader) DownloadSize() (int64, error) {
+	return int64(len(d.wimboot)), nil
+}
+
+func (d *windowsDownloader) Download(directory string) (*metadata, error) {
+	treeDirectory := filepath.Join(directory, windowsTreeDirectory)
+	if err := os.MkdirAll(treeDirectory, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create directories in path '%s': %w", treeDirectory, err)
+	}
+
+	disk, err := diskfs.Open(d.isoPath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Windows ISO: %w", err)
+	}
+	defer disk.Close()
+
+	isoFS, err := disk.GetFilesystem(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Windows ISO file system: %w", err)
+	}
+
+	files := []string{}
+
+	for _, file := range windowsBootFiles(d.arch) {
+		found, err := extractWindowsFile(isoFS, file.source, filepath.Join(treeDirectory, file.name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract '%s' from Windows ISO: %w", file.source, err)
+		}
+
+		if !found {
+			if file.optional {
+				continue
+			}
+
+			return nil, fmt.Errorf("'%s': %w", file.source, errWindowsFileMissing)
+		}
+
+		d.logger.Info("extracted file from Windows ISO",
+			"file", file.source,
+		)
+
+		files = append(files, file.name)
+	}
+
+	if err := os.WriteFile(filepath.Join(directory, wimbootName), d.wimboot, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write wimboot: %w", err)
+	}
+
+	return &metadata{
+		Hash:         d.hash,
+		KernelPath:   wimbootName,
+		TreePath:     windowsTreeDirectory,
+		WimbootFiles: files,
+	}, nil
+}
+
+// extractWindowsFile copies the file at the given slash-separated path in the ISO to
+// output, matching path components case-insensitively, as ISO 9660 names are upper
+// case. False is returned if the file doesn't exist.
+func extractWindowsFile(isoFS filesystem.FileSystem, source string, output string) (bool, error) {
+	resolved := "/"
+
+	for _, component := range strings.Split(source, "/") {
+		entries, err := isoFS.ReadDir(resolved)
+		if err != nil {
+			return false, fmt.Errorf("failed to list '%s': %w", resolved, err)
+		}
+
+		found := false
+		for _, entry := range entries {
+			if strings.EqualFold(entry.Name(), component) {
+				resolved = path.Join(resolved, entry.Name())
+				found = true
+
+				break
+			}
+		}
+
+		if !found {
+			return false, nil
+		}
+	}
+
+	in, err := isoFS.OpenFile(resolved, os.O_RDONLY)
+	if err != nil {
+		return false, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return false, fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return false, fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	if err := out.Close(); err != nil {
+		return false, fmt.Errorf("failed to close output file: %w", err)
+	}
+
+	return true, nil
+}
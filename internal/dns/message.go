@@ -0,0 +1,176 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+type recordType uint16
+
+const (
+	recordTypeA    recordType = 1
+	recordTypeAAAA recordType = 28
+	recordTypeANY  recordType = 255
+)
+
+const classIN = 1
+
+type rcode uint16
+
+const (
+	rcodeNoError        rcode = 0
+	rcodeFormatError    rcode = 1
+	rcodeNameError      rcode = 3
+	rcodeNotImplemented rcode = 4
+)
+
+const (
+	headerSize = 12
+
+	// Maximum size of a response over UDP, for clients that don't use EDNS (RFC 1035
+	// section 4.2.1)
+	maxUDPSize = 512
+
+	flagResponse      = 1 << 15
+	flagAuthoritative = 1 << 10
+	flagTruncated     = 1 << 9
+	flagRecursionDes  = 1 << 8
+	opcodeMask        = 0xf << 11
+
+	// Compression pointer to the question name, which always follows the header
+	questionNamePointer = 0xc000 | headerSize
+
+	maxLabelLength = 63
+)
+
+var (
+	errMessageTooShort    = errors.New("message too short")
+	errNotQuery           = errors.New("message is not a query")
+	errInvalidName        = errors.New("invalid name in question")
+	errUnsupportedQuery   = errors.New("only single-question queries are supported")
+	errCompressedQuestion = errors.New("compressed names are not supported in questions")
+)
+
+type question struct {
+	id    uint16
+	flags uint16
+
+	// Lowercase name without a trailing dot
+	name  string
+	qtype recordType
+	class uint16
+
+	// Raw question section, echoed back in responses
+	raw []byte
+}
+
+func parseQuestion(message []byte) (*question, error) {
+	if len(message) < headerSize {
+		return nil, errMessageTooShort
+	}
+
+	flags := binary.BigEndian.Uint16(message[2:])
+	if flags&flagResponse != 0 {
+		return nil, errNotQuery
+	}
+
+	if binary.BigEndian.Uint16(message[4:]) != 1 {
+		return nil, errUnsupportedQuery
+	}
+
+	labels := []string{}
+	offset := headerSize
+
+	for {
+		if offset >= len(message) {
+			return nil, errMessageTooShort
+		}
+
+		length := int(message[offset])
+		offset++
+
+		if length == 0 {
+			break
+		}
+
+		if length > maxLabelLength {
+			return nil, errCompressedQuestion
+		}
+
+		if offset+length > len(message) {
+			return nil, errInvalidName
+		}
+
+		labels = append(labels, string(message[offset:offset+length]))
+		offset += length
+	}
+
+	if offset+4 > len(message) {
+		return nil, errMessageTooShort
+	}
+
+	return &question{
+		id:    binary.BigEndian.Uint16(message),
+		flags: flags,
+		name:  strings.ToLower(strings.Join(labels, ".")),
+		qtype: recordType(binary.BigEndian.Uint16(message[offset:])),
+		class: binary.BigEndian.Uint16(message[offset+2:]),
+		raw:   message[headerSize : offset+4],
+	}, nil
+}
+
+type answer struct {
+	rtype recordType
+	data  []byte
+}
+
+// response builds a response to the question with the given answers. If the response
+// would exceed maxSize, the answers are dropped and the truncated flag is set, so that
+// the client can retry over TCP.
+func (q *question) response(code rcode, answers []answer, ttl uint32, maxSize int) []byte {
+	flags := flagResponse | flagAuthoritative | (q.flags & (opcodeMask | flagRecursionDes)) | uint16(code)
+
+	size := headerSize + len(q.raw)
+	for _, a := range answers {
+		size += 12 + len(a.data)
+	}
+
+	if size > maxSize {
+		flags |= flagTruncated
+		answers = nil
+	}
+
+	message := make([]byte, headerSize, size)
+	binary.BigEndian.PutUint16(message, q.id)
+	binary.BigEndian.PutUint16(message[2:], flags)
+	binary.BigEndian.PutUint16(message[4:], 1)
+	binary.BigEndian.PutUint16(message[6:], uint16(len(answers))) //nolint:gosec
+	message = append(message, q.raw...)
+
+	for _, a := range answers {
+		message = binary.BigEndian.AppendUint16(message, questionNamePointer)
+		message = binary.BigEndian.AppendUint16(message, uint16(a.rtype))
+		message = binary.BigEndian.AppendUint16(message, classIN)
+		message = binary.BigEndian.AppendUint32(message, ttl)
+		message = binary.BigEndian.AppendUint16(message, uint16(len(a.data))) //nolint:gosec
+		message = append(message, a.data...)
+	}
+
+	return message
+}
+
+// errorResponse builds a response with no question section, for messages that could
+// not be parsed
+func errorResponse(message []byte, code rcode) []byte {
+	if len(message) < headerSize {
+		return nil
+	}
+
+	response := make([]byte, headerSize)
+	copy(response, message[:4])
+	flags := flagResponse | (binary.BigEndian.Uint16(message[2:]) & (opcodeMask | flagRecursionDes)) | uint16(code)
+	binary.BigEndian.PutUint16(response[2:], flags)
+
+	return response
+}
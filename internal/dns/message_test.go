@@ -0,0 +1,206 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// digQuery is the query sent by 'dig example.com' (id 0x1234): recursion desired, the
+// AD bit set, and an EDNS OPT record with a client cookie in the additional section
+var digQuery = []byte{
+	0x12, 0x34, 0x01, 0x20, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+	0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+	0x00, 0x01, 0x00, 0x01,
+	0x00, 0x00, 0x29, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c,
+	0x00, 0x0a, 0x00, 0x08, 0x5e, 0x4c, 0x2a, 0x1f, 0x9b, 0x03, 0x77, 0xd0,
+}
+
+func TestParseQuestion(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		want    *question
+		wantErr error
+	}{
+		{
+			name:    "dig query with EDNS",
+			message: digQuery,
+			want: &question{
+				id:    0x1234,
+				flags: 0x0120,
+				name:  "example.com",
+				qtype: recordTypeA,
+				class: classIN,
+				raw:   digQuery[headerSize:29],
+			},
+		},
+		{
+			name: "name is lowercased",
+			message: []byte{
+				0xbe, 0xef, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x05, 'P', 'i', 'X', 'i', 'E', 0x03, 'L', 'A', 'N', 0x00,
+				0x00, 0x1c, 0x00, 0x01,
+			},
+			want: &question{
+				id:    0xbeef,
+				flags: 0x0100,
+				name:  "pixie.lan",
+				qtype: recordTypeAAAA,
+				class: classIN,
+			},
+		},
+		{
+			name:    "header only",
+			message: digQuery[:headerSize],
+			wantErr: errMessageTooShort,
+		},
+		{
+			name:    "shorter than header",
+			message: digQuery[:headerSize-1],
+			wantErr: errMessageTooShort,
+		},
+		{
+			name:    "missing type and class",
+			message: digQuery[:25],
+			wantErr: errMessageTooShort,
+		},
+		{
+			name:    "truncated label",
+			message: digQuery[:17],
+			wantErr: errInvalidName,
+		},
+		{
+			name: "response",
+			message: []byte{
+				0x12, 0x34, 0x81, 0x80, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x01, 0x00, 0x01,
+			},
+			wantErr: errNotQuery,
+		},
+		{
+			name: "two questions",
+			message: []byte{
+				0x12, 0x34, 0x01, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x01, 0x00, 0x01,
+				0x00, 0x00, 0x1c, 0x00, 0x01,
+			},
+			wantErr: errUnsupportedQuery,
+		},
+		{
+			name: "compressed name",
+			message: []byte{
+				0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01,
+			},
+			wantErr: errCompressedQuestion,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseQuestion(test.message)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("parseQuestion() error = %v, want %v", err, test.wantErr)
+			}
+
+			if test.wantErr != nil {
+				return
+			}
+
+			if test.want.raw == nil {
+				test.want.raw = test.message[headerSize:]
+			}
+
+			if got.id != test.want.id || got.flags != test.want.flags || got.name != test.want.name ||
+				got.qtype != test.want.qtype || got.class != test.want.class || !bytes.Equal(got.raw, test.want.raw) {
+				t.Errorf("parseQuestion() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQuestionResponse(t *testing.T) {
+	q, err := parseQuestion(digQuery)
+	if err != nil {
+		t.Fatalf("parseQuestion() error = %v", err)
+	}
+
+	header := []byte{0x12, 0x34}
+	question := digQuery[headerSize:29]
+
+	tests := []struct {
+		name    string
+		code    rcode
+		answers []answer
+		maxSize int
+		want    [][]byte
+	}{
+		{
+			name:    "A answer",
+			code:    rcodeNoError,
+			answers: []answer{{rtype: recordTypeA, data: []byte{192, 168, 0, 1}}},
+			maxSize: maxUDPSize,
+			want: [][]byte{
+				header, {0x85, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00},
+				question,
+				{0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x04, 192, 168, 0, 1},
+			},
+		},
+		{
+			name:    "name error",
+			code:    rcodeNameError,
+			maxSize: maxUDPSize,
+			want: [][]byte{
+				header, {0x85, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+				question,
+			},
+		},
+		{
+			name:    "truncated",
+			code:    rcodeNoError,
+			answers: []answer{{rtype: recordTypeAAAA, data: make([]byte, 16)}},
+			maxSize: headerSize + len(question),
+			want: [][]byte{
+				header, {0x87, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+				question,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := bytes.Join(test.want, nil)
+			if got := q.response(test.code, test.answers, 60, test.maxSize); !bytes.Equal(got, want) {
+				t.Errorf("response() = % x, want % x", got, want)
+			}
+		})
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		want    []byte
+	}{
+		{
+			name:    "keeps ID and recursion desired",
+			message: digQuery,
+			want:    []byte{0x12, 0x34, 0x81, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			name:    "shorter than header",
+			message: digQuery[:4],
+			want:    nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := errorResponse(test.message, rcodeFormatError); !bytes.Equal(got, test.want) {
+				t.Errorf("errorResponse() = % x, want % x", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+// Package dns implements a small authoritative DNS responder for provisioning networks
+// that have no DNS of their own, resolving pixie's hostname and configured aliases
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/davejbax/pixie/internal/sockets"
+)
+
+const maxMessageSize = 65535
+
+var (
+	errNoAddresses  = errors.New("no addresses configured, and none could be found on local interfaces")
+	errInvalidAlias = errors.New("alias target is neither an IP address nor a known name")
+)
+
+type Config struct {
+	// Whether to run the DNS server
+	Enabled bool
+
+	Address string `default:":53"`
+
+	// Network interface to bind to, e.g. a VLAN interface, so that only its clients are
+	// served. Only supported on Linux.
+	Interface string
+
+	// Name that resolves to pixie itself
+	Hostname string `default:"pixie"`
+
+	// Addresses that Hostname resolves to. If empty, the addresses of all non-loopback
+	// local interfaces are used.
+	Addresses []string
+
+	// Additional names, such as for package mirrors proxied by pixie
+	Aliases []Alias
+
+	// TTL of answers
+	TTL time.Duration `default:"60s"`
+}
+
+// Alias is an additional name served by the DNS server. Note that this isn't a map in
+// the config, as names contain dots, which the config loader treats as key separators.
+type Alias struct {
+	Name string
+
+	// IP address, or another name (e.g. the pixie hostname or another alias), that the
+	// alias resolves to
+	Target string
+}
+
+type Server struct {
+	logger *slog.Logger
+	config *Config
+
+	records map[string][]net.IP
+}
+
+// NewServer creates a DNS server, resolving the configured names up front
+func NewServer(logger *slog.Logger, config *Config) (*Server, error) {
+	addresses, err := hostAddresses(config.Addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	records := map[string][]net.IP{
+		normalizeName(config.Hostname): addresses,
+	}
+
+	for _, alias := range config.Aliases {
+		ips, err := resolveAlias(config, alias.Target, addresses)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alias '%s': %w", alias.Name, err)
+		}
+
+		records[normalizeName(alias.Name)] = ips
+	}
+
+	return &Server{
+		logger:  logger,
+		config:  config,
+		records: records,
+	}, nil
+}
+
+func hostAddresses(configured []string) ([]net.IP, error) {
+	addresses := make([]net.IP, 0, len(configured))
+
+	for _, address := range configured {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address '%s': %w", address, errInvalidAlias)
+		}
+
+		addresses = append(addresses, ip)
+	}
+
+	if len(addresses) > 0 {
+		return addresses, nil
+	}
+
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+
+	for _, addr := range interfaceAddrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		addresses = append(addresses, ipNet.IP)
+	}
+
+	if len(addresses) == 0 {
+		return nil, errNoAddresses
+	}
+
+	return addresses, nil
+}
+
+// resolveAlias resolves an alias target to IP addresses. Targets naming other aliases
+// are followed, up to a fixed depth to avoid loops.
+func resolveAlias(config *Config, target string, hostAddresses []net.IP) ([]net.IP, error) {
+	for range len(config.Aliases) + 1 {
+		if ip := net.ParseIP(target); ip != nil {
+			return []net.IP{ip}, nil
+		}
+
+		if normalizeName(target) == normalizeName(config.Hostname) {
+			return hostAddresses, nil
+		}
+
+		next, ok := lookupAlias(config.Aliases, target)
+		if !ok {
+			break
+		}
+
+		target = next
+	}
+
+	return nil, fmt.Errorf("'%s': %w", target, errInvalidAlias)
+}
+
+func lookupAlias(aliases []Alias, name string) (string, bool) {
+	for _, alias := range aliases {
+		if normalizeName(alias.Name) == normalizeName(name) {
+			return alias.Target, true
+		}
+	}
+
+	return "", false
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// ListenAndServe listens on the configured address and serves requests until the
+// context is cancelled
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	conn, err := sockets.ListenPacket("udp", s.config.Address, s.config.Interface)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	return s.Serve(ctx, conn)
+}
+
+// Serve serves queries received on the given connection until the context is cancelled
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	s.logger.Info("DNS server listening",
+		"address", conn.LocalAddr().String(),
+	)
+
+	buff := make([]byte, maxMessageSize)
+
+	for {
+		n, addr, err := conn.ReadFrom(buff)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read DNS query: %w", err)
+		}
+
+		response := s.respond(bytes.Clone(buff[:n]), addr)
+		if response == nil {
+			continue
+		}
+
+		if _, err := conn.WriteTo(response, addr); err != nil {
+			s.logger.Debug("failed to send DNS response",
+				"client", addr.String(),
+				"error", err,
+			)
+		}
+	}
+}
+
+func (s *Server) respond(message []byte, addr net.Addr) []byte {
+	q, err := parseQuestion(message)
+	if errors.Is(err, errNotQuery) {
+		return nil
+	} else if err != nil {
+		s.logger.Debug("ignoring invalid DNS query",
+			"client", addr.String(),
+			"error", err,
+		)
+		return errorResponse(message, rcodeFormatError)
+	}
+
+	if q.flags&opcodeMask != 0 || q.class != classIN {
+		return q.response(rcodeNotImplemented, nil, 0, maxUDPSize)
+	}
+
+	ips, ok := s.records[q.name]
+	if !ok {
+		s.logger.Debug("DNS query for unknown name",
+			"client", addr.String(),
+			"name", q.name,
+		)
+		return q.response(rcodeNameError, nil, 0, maxUDPSize)
+	}
+
+	answers := make([]answer, 0, len(ips))
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if q.qtype == recordTypeA || q.qtype == recordTypeANY {
+				answers = append(answers, answer{rtype: recordTypeA, data: ip4})
+			}
+		} else if q.qtype == recordTypeAAAA || q.qtype == recordTypeANY {
+			answers = append(answers, answer{rtype: recordTypeAAAA, data: ip.To16()})
+		}
+	}
+
+	return q.response(rcodeNoError, answers, uint32(s.config.TTL.Seconds()), maxUDPSize)
+}
@@ -0,0 +1,169 @@
+// Package dnsreg registers hosts' names and addresses in DNS once they report a
+// successful install, by RFC 2136 dynamic update or by calling a webhook, so that
+// provisioning pipelines needn't do it by hand
+package dnsreg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const registerTimeout = 30 * time.Second
+
+var (
+	errNoDomain      = errors.New("a domain is required")
+	errNoBackend     = errors.New("an RFC 2136 server or a webhook URL is required")
+	errWebhookStatus = errors.New("webhook returned an unsuccessful status")
+)
+
+// Config configures DNS registration
+type Config struct {
+	// Whether to register hosts when they report a successful install
+	Enabled bool
+
+	// Domain that host names are registered under, e.g. 'lab.example.com'
+	Domain string
+
+	// TTL of registered records, in seconds
+	TTL uint32 `default:"300"`
+
+	// DNS server to send dynamic updates to
+	RFC2136 RFC2136Config `mapstructure:"rfc2136"`
+
+	// Webhook that registrations are sent to as JSON, e.g. for an IPAM system's API
+	Webhook WebhookConfig
+}
+
+// WebhookConfig sends registrations as HTTP requests, with a JSON body of the form
+// '{"host": "web1", "fqdn": "web1.lab.example.com", "ip": "10.0.0.5"}'
+type WebhookConfig struct {
+	URL    string
+	Method string `default:"POST"`
+
+	// Extra request headers, e.g. for authentication
+	Headers map[string]string
+}
+
+// Registrar registers hosts in DNS
+type Registrar struct {
+	logger *slog.Logger
+	config *Config
+	client *http.Client
+}
+
+// New creates a registrar
+func New(logger *slog.Logger, config *Config) (*Registrar, error) {
+	if config.Domain == "" {
+		return nil, errNoDomain
+	}
+
+	if config.RFC2136.Server == "" && config.Webhook.URL == "" {
+		return nil, errNoBackend
+	}
+
+	return &Registrar{
+		logger: logger,
+		config: config,
+		client: &http.Client{},
+	}, nil
+}
+
+// FQDN returns the fully qualified name that the host is registered under
+func (r *Registrar) FQDN(name string) string {
+	return strings.ToLower(name + "." + strings.Trim(r.config.Domain, "."))
+}
+
+// RegisterAsync registers the host in the background, logging the outcome, so that the
+// host's request isn't held up by a slow DNS server
+func (r *Registrar) RegisterAsync(name string, ip net.IP) {
+	if r == nil {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), registerTimeout)
+		defer cancel()
+
+		if err := r.Register(ctx, name, ip); err != nil {
+			r.logger.Warn("failed to register host in DNS",
+				"host", name,
+				"ip", ip.String(),
+				"error", err,
+			)
+
+			return
+		}
+
+		r.logger.Info("registered host in DNS",
+			"host", name,
+			"fqdn", r.FQDN(name),
+			"ip", ip.String(),
+		)
+	}()
+}
+
+// Register points the host's name at the given IP address, replacing any previous
+// address of the same family
+func (r *Registrar) Register(ctx context.Context, name string, ip net.IP) error {
+	var errs []error
+
+	if r.config.RFC2136.Server != "" {
+		if err := r.update(ctx, r.FQDN(name), ip); err != nil {
+			errs = append(errs, fmt.Errorf("dynamic update failed: %w", err))
+		}
+	}
+
+	if r.config.Webhook.URL != "" {
+		if err := r.callWebhook(ctx, name, ip); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (r *Registrar) callWebhook(ctx context.Context, name string, ip net.IP) error {
+	payload, err := json.Marshal(map[string]string{
+		"host": name,
+		"fqdn": r.FQDN(name),
+		"ip":   ip.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.config.Webhook.Method, r.config.Webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pixie")
+
+	for header, value := range r.config.Webhook.Headers {
+		req.Header.Set(header, value)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %w", resp.Status, errWebhookStatus)
+	}
+
+	return nil
+}
@@ -0,0 +1,290 @@
+package dnsreg
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"time"
+)
+
+// RFC2136Config configures dynamic updates (RFC 2136), signed with TSIG (RFC 8945)
+type RFC2136Config struct {
+	// Address of the primary server for the zone, e.g. 'ns1.example.com:53'
+	Server string
+
+	// Zone to update. Defaults to the registration domain.
+	Zone string
+
+	// Name and base64 secret of the TSIG key to sign updates with, as configured on the
+	// server. Updates are unsigned if no key is given.
+	TSIGKey    string `mapstructure:"tsig_key"`
+	TSIGSecret string `mapstructure:"tsig_secret"`
+
+	// TSIG algorithm: 'hmac-sha256', 'hmac-sha512' or 'hmac-sha1'
+	TSIGAlgorithm string `mapstructure:"tsig_algorithm" default:"hmac-sha256"`
+}
+
+const (
+	opcodeUpdate = 5
+
+	typeA    = 1
+	typeSOA  = 6
+	typeAAAA = 28
+	typeTSIG = 250
+
+	classIN  = 1
+	classANY = 255
+
+	// Seconds of clock skew that the server allows between it and us
+	tsigFudge = 300
+
+	headerSize = 12
+	rcodeMask  = 0xf
+
+	maxMessageSize = 512
+)
+
+var (
+	errUnknownAlgorithm = errors.New("unknown TSIG algorithm")
+	errInvalidSecret    = errors.New("TSIG secret must be base64")
+	errIDMismatch       = errors.New("response doesn't match update")
+	errUpdateRefused    = errors.New("server refused update")
+	errLabelTooLong     = errors.New("name has a label longer than 63 bytes")
+)
+
+// Names of the response codes that updates commonly fail with
+var rcodeNames = map[int]string{
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// update replaces the name's A or AAAA records with the given address
+func (r *Registrar) update(ctx context.Context, fqdn string, ip net.IP) error {
+	config := &r.config.RFC2136
+
+	zone := config.Zone
+	if zone == "" {
+		zone = r.config.Domain
+	}
+
+	message, id, err := r.updateMessage(zone, fqdn, ip)
+	if err != nil {
+		return err
+	}
+
+	server := config.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	dialer := &net.Dialer{}
+
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return fmt.Errorf("failed to dial '%s': %w", server, err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(message); err != nil {
+		return fmt.Errorf("failed to send update: %w", err)
+	}
+
+	response := make([]byte, maxMessageSize)
+
+	n, err := conn.Read(response)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if n < headerSize || binary.BigEndian.Uint16(response) != id {
+		return errIDMismatch
+	}
+
+	if code := int(binary.BigEndian.Uint16(response[2:]) & rcodeMask); code != 0 {
+		name, ok := rcodeNames[code]
+		if !ok {
+			name = fmt.Sprintf("rcode %d", code)
+		}
+
+		return fmt.Errorf("%w: %s", errUpdateRefused, name)
+	}
+
+	return nil
+}
+
+// updateMessage builds an update message that deletes the name's records of the
+// address's type and adds the address, signed if a TSIG key is configured
+func (r *Registrar) updateMessage(zone string, fqdn string, ip net.IP) ([]byte, uint16, error) {
+	zoneName, err := encodeName(zone)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	name, err := encodeName(fqdn)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rtype := uint16(typeAAAA)
+	rdata := ip.To16()
+
+	if ip4 := ip.To4(); ip4 != nil {
+		rtype, rdata = typeA, ip4
+	}
+
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, 0, fmt.Errorf("failed to generate message ID: %w", err)
+	}
+
+	id := binary.BigEndian.Uint16(idBytes)
+
+	// Header: one zone, no prerequisites, two updates
+	message := binary.BigEndian.AppendUint16(nil, id)
+	message = binary.BigEndian.AppendUint16(message, opcodeUpdate<<11)
+	message = binary.BigEndian.AppendUint16(message, 1)
+	message = binary.BigEndian.AppendUint16(message, 0)
+	message = binary.BigEndian.AppendUint16(message, 2)
+	message = binary.BigEndian.AppendUint16(message, 0)
+
+	// Zone section
+	message = append(message, zoneName...)
+	message = binary.BigEndian.AppendUint16(message, typeSOA)
+	message = binary.BigEndian.AppendUint16(message, classIN)
+
+	// Delete the RRset of the address's type (RFC 2136 section 2.5.2)
+	message = appendRecord(message, name, rtype, classANY, 0, nil)
+
+	// Add the new record
+	message = appendRecord(message, name, rtype, classIN, r.config.TTL, rdata)
+
+	if r.config.RFC2136.TSIGKey == "" {
+		return message, id, nil
+	}
+
+	message, err = r.sign(message, id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return message, id, nil
+}
+
+// sign appends a TSIG record to the message (RFC 8945 section 4)
+func (r *Registrar) sign(message []byte, id uint16) ([]byte, error) {
+	config := &r.config.RFC2136
+	algorithm := strings.ToLower(config.TSIGAlgorithm)
+
+	newHash, ok := tsigAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("'%s': %w", config.TSIGAlgorithm, errUnknownAlgorithm)
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(config.TSIGSecret)
+	if err != nil {
+		return nil, errInvalidSecret
+	}
+
+	keyName, err := encodeName(config.TSIGKey)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithmName, err := encodeName(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	timeSigned := uint64(time.Now().Unix()) //nolint:gosec
+
+	// The MAC covers the message, then the TSIG record's variables (section 4.3.3)
+	variables := append([]byte{}, keyName...)
+	variables = binary.BigEndian.AppendUint16(variables, classANY)
+	variables = binary.BigEndian.AppendUint32(variables, 0)
+	variables = append(variables, algorithmName...)
+	variables = appendUint48(variables, timeSigned)
+	variables = binary.BigEndian.AppendUint16(variables, tsigFudge)
+	variables = binary.BigEndian.AppendUint16(variables, 0)
+	variables = binary.BigEndian.AppendUint16(variables, 0)
+
+	mac := hmac.New(newHash, secret)
+	mac.Write(message)
+	mac.Write(variables)
+	sum := mac.Sum(nil)
+
+	rdata := append([]byte{}, algorithmName...)
+	rdata = appendUint48(rdata, timeSigned)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum))) //nolint:gosec
+	rdata = append(rdata, sum...)
+	rdata = binary.BigEndian.AppendUint16(rdata, id)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	signed := appendRecord(message, keyName, typeTSIG, classANY, 0, rdata)
+
+	// The TSIG record is in the additional section
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])+1)
+
+	return signed, nil
+}
+
+func appendRecord(message []byte, name []byte, rtype uint16, class uint16, ttl uint32, rdata []byte) []byte {
+	message = append(message, name...)
+	message = binary.BigEndian.AppendUint16(message, rtype)
+	message = binary.BigEndian.AppendUint16(message, class)
+	message = binary.BigEndian.AppendUint32(message, ttl)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(rdata))) //nolint:gosec
+
+	return append(message, rdata...)
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	return append(b, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// encodeName encodes a domain name in wire format, lower-cased as TSIG requires
+func encodeName(name string) ([]byte, error) {
+	var encoded []byte
+
+	for _, label := range strings.Split(strings.Trim(strings.ToLower(name), "."), ".") {
+		if label == "" {
+			continue
+		}
+
+		if len(label) > 63 {
+			return nil, fmt.Errorf("'%s': %w", name, errLabelTooLong)
+		}
+
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+
+	return append(encoded, 0), nil
+}
@@ -0,0 +1,300 @@
+// Package drain lets file transfers in progress finish when pixie shuts down, so that a
+// machine's initrd download isn't cut off halfway. Servers stop accepting requests when
+// they're stopped, and the [Tracker] then waits for the transfers they'd already started.
+package drain
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often progress is logged while waiting for transfers to finish
+	progressInterval = 5 * time.Second
+
+	// Bytes of an HTTP response copied between updates of its progress
+	progressChunkSize = 1 << 20
+)
+
+type Config struct {
+	// How long to wait on shutdown for transfers in progress to finish, before exiting
+	// anyway. Zero exits without waiting. A second SIGTERM or interrupt exits at once.
+	Timeout time.Duration `default:"1m"`
+}
+
+// Tracker tracks the file transfers in progress. A nil tracker tracks nothing.
+type Tracker struct {
+	logger *slog.Logger
+	config *Config
+
+	mu        sync.Mutex
+	transfers map[*Transfer]struct{}
+
+	// Signalled whenever a transfer finishes
+	finished chan struct{}
+}
+
+// Transfer is a file being sent to a client
+type Transfer struct {
+	tracker *Tracker
+
+	protocol string
+	client   string
+	path     string
+	started  time.Time
+
+	// Size of the file, if known, and the bytes sent so far
+	size atomic.Int64
+	sent atomic.Int64
+}
+
+// New creates a tracker
+func New(logger *slog.Logger, config *Config) *Tracker {
+	return &Tracker{
+		logger:    logger,
+		config:    config,
+		transfers: make(map[*Transfer]struct{}),
+		finished:  make(chan struct{}, 1),
+	}
+}
+
+// Start records that a transfer of the file at the given path to the client has
+// started. The size may be zero if it isn't known. [Transfer.Done] must be called once
+// the transfer finishes, successfully or not.
+func (t *Tracker) Start(protocol string, client net.IP, path string, size int64) *Transfer {
+	if t == nil {
+		return nil
+	}
+
+	transfer := &Transfer{
+		tracker:  t,
+		protocol: protocol,
+		client:   client.String(),
+		path:     path,
+		started:  time.Now(),
+	}
+	transfer.size.Store(size)
+
+	t.mu.Lock()
+	t.transfers[transfer] = struct{}{}
+	t.mu.Unlock()
+
+	return transfer
+}
+
+// Add records that n more bytes have been sent
+func (tr *Transfer) Add(n int64) {
+	if tr != nil {
+		tr.sent.Add(n)
+	}
+}
+
+// Done records that the transfer has finished
+func (tr *Transfer) Done() {
+	if tr == nil {
+		return
+	}
+
+	tr.tracker.mu.Lock()
+	delete(tr.tracker.transfers, tr)
+	tr.tracker.mu.Unlock()
+
+	select {
+	case tr.tracker.finished <- struct{}{}:
+	default:
+	}
+}
+
+// Timeout returns how long [Tracker.Wait] waits for transfers to finish
+func (t *Tracker) Timeout() time.Duration {
+	if t == nil {
+		return 0
+	}
+
+	return t.config.Timeout
+}
+
+// Wait waits for the transfers in progress to finish, up to the configured timeout,
+// logging their progress. It should be called once the servers have stopped accepting
+// requests, so that no more transfers start.
+func (t *Tracker) Wait() {
+	if t == nil {
+		return
+	}
+
+	count, sent, size := t.progress()
+	if count == 0 {
+		return
+	}
+
+	t.logger.Info("waiting for transfers in progress to finish before exiting",
+		"transfers", count,
+		"sent", sent,
+		"size", size,
+		"timeout", t.config.Timeout,
+	)
+
+	deadline := time.NewTimer(t.config.Timeout)
+	defer deadline.Stop()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	start := time.Now()
+
+	for {
+		select {
+		case <-t.finished:
+			if count, _, _ := t.progress(); count == 0 {
+				t.logger.Info("all transfers finished",
+					"waited", time.Since(start).Round(time.Millisecond),
+				)
+
+				return
+			}
+		case <-ticker.C:
+			count, sent, size := t.progress()
+			t.logger.Info("still waiting for transfers to finish",
+				"transfers", count,
+				"sent", sent,
+				"size", size,
+				"remaining", (t.config.Timeout - time.Since(start)).Round(time.Second),
+			)
+		case <-deadline.C:
+			t.abandon()
+			return
+		}
+	}
+}
+
+// progress returns the number of transfers in progress, the bytes they've sent, and
+// the total size of those whose size is known
+func (t *Tracker) progress() (int, int64, int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var sent, size int64
+	for transfer := range t.transfers {
+		sent += transfer.sent.Load()
+		size += transfer.size.Load()
+	}
+
+	return len(t.transfers), sent, size
+}
+
+// abandon logs the transfers that didn't finish in time
+func (t *Tracker) abandon() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for transfer := range t.transfers {
+		t.logger.Warn("exiting with transfer in progress, as it didn't finish in time",
+			"protocol", transfer.protocol,
+			"client", transfer.client,
+			"path", transfer.path,
+			"sent", transfer.sent.Load(),
+			"size", transfer.size.Load(),
+			"duration", time.Since(transfer.started).Round(time.Second),
+		)
+	}
+}
+
+// Middleware tracks each request handled by next as a transfer
+func (t *Tracker) Middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ip net.IP
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ip = net.ParseIP(host)
+		}
+
+		transfer := t.Start("http", ip, r.URL.Path, 0)
+		defer transfer.Done()
+
+		next.ServeHTTP(&progressWriter{ResponseWriter: w, transfer: transfer}, r)
+	})
+}
+
+// progressWriter records the bytes of a response as they're written, and its size once
+// its headers are
+type progressWriter struct {
+	http.ResponseWriter
+
+	transfer    *Transfer
+	wroteHeader bool
+}
+
+func (p *progressWriter) WriteHeader(status int) {
+	if !p.wroteHeader {
+		p.wroteHeader = true
+
+		if size, err := strconv.ParseInt(p.Header().Get("Content-Length"), 10, 64); err == nil {
+			p.transfer.size.Store(size)
+		}
+	}
+
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+
+	n, err := p.ResponseWriter.Write(data)
+	p.transfer.Add(int64(n))
+
+	return n, err //nolint:wrapcheck
+}
+
+// ReadFrom copies with the underlying writer, so that files are still sent with
+// sendfile where possible. Copying in chunks records progress while a large file is
+// sent: a limited reader (as used for files) is split into limited readers of the same
+// file, which sendfile can still unwrap.
+func (p *progressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+
+	limited, ok := src.(*io.LimitedReader)
+	if !ok {
+		limited = &io.LimitedReader{R: src, N: math.MaxInt64}
+	}
+
+	var total int64
+
+	for limited.N > 0 {
+		chunk := &io.LimitedReader{R: limited.R, N: min(limited.N, progressChunkSize)}
+
+		n, err := io.Copy(p.ResponseWriter, chunk)
+		limited.N -= n
+		total += n
+		p.transfer.Add(n)
+
+		if err != nil {
+			return total, err //nolint:wrapcheck
+		}
+
+		// A chunk that wasn't used up means the reader is exhausted
+		if chunk.N > 0 {
+			break
+		}
+	}
+
+	return total, nil
+}
+
+// Unwrap lets [http.ResponseController] reach the underlying writer
+func (p *progressWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
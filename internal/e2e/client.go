@@ -0,0 +1,374 @@
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/davejbax/pixie/internal/dhcp"
+	"github.com/davejbax/pixie/internal/tftp"
+)
+
+var (
+	errNotFound       = errors.New("not found")
+	errWrongMachine   = errors.New("boot file is for a different machine type")
+	errNoBootEntry    = errors.New("no menu entry boots a kernel")
+	errUnexpectedHTTP = errors.New("unexpected HTTP status")
+)
+
+// GRUB's names for the CPUs of client architectures, as tested by '$grub_cpu' in menu
+// entries with a variant for each arch
+var grubCPUs = map[dhcp.ClientArch]string{
+	dhcp.ClientArchEFIIA32:  "i386",
+	dhcp.ClientArchEFIX64:   "x86_64",
+	dhcp.ClientArchEFIARM32: "arm",
+	dhcp.ClientArchEFIARM64: "arm64",
+}
+
+// ClientOptions configures a simulated network boot client
+type ClientOptions struct {
+	Client *dhcp.PXEClient
+
+	// PXE boot server (e.g. pixie's ProxyDHCP server, on port 4011) to ask for a boot
+	// file directly. If empty, a DHCPDISCOVER is broadcast on the local network instead.
+	BootServer string
+
+	// How long to wait for DHCP offers
+	DHCPTimeout time.Duration
+
+	// Base URL of pixie's HTTP server. If set, the GRUB config, kernel and initrds are
+	// fetched over HTTP, as by GRUB images with an HTTP prefix; otherwise they're fetched
+	// over TFTP from the boot server.
+	HTTPURL string
+
+	// Title of the menu entry whose kernel and initrds are fetched. If empty, the first
+	// entry that boots a kernel is used.
+	Entry string
+}
+
+// ClientStep is the outcome of one step of a simulated boot
+type ClientStep struct {
+	Name     string
+	Detail   string
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+// SimulateClient acts like a PXE client booting GRUB from pixie: it asks for a boot file
+// over DHCP, downloads it over TFTP, then downloads the GRUB config that GRUB would load,
+// and the kernel and initrds of a menu entry. Steps are returned up to and including the
+// first that failed.
+func SimulateClient(ctx context.Context, logger *slog.Logger, opts *ClientOptions) []*ClientStep {
+	sim := &simulation{logger: logger, opts: opts}
+
+	offer, step := sim.dhcp(ctx)
+	if sim.add(step) {
+		return sim.steps
+	}
+
+	bootServer := offer.BootServer()
+	bootFile := offer.BootFile()
+
+	if sim.add(sim.bootFile(ctx, bootServer, bootFile)) {
+		return sim.steps
+	}
+
+	// GRUB's prefix is the directory above its platform directory, e.g. 'boot/grub' for
+	// 'boot/grub/x86_64-efi/core.efi'
+	prefix := path.Dir(path.Dir(strings.TrimPrefix(bootFile, "/")))
+
+	config, step := sim.config(ctx, bootServer, prefix)
+	if sim.add(step) {
+		return sim.steps
+	}
+
+	kernel, initrds, err := bootFiles(config, opts.Entry, grubCPUs[opts.Client.Arch])
+	if err != nil {
+		sim.add(&ClientStep{Name: "menu", Err: err})
+		return sim.steps
+	}
+
+	if sim.add(sim.fetch(ctx, "kernel", bootServer, kernel, io.Discard)) {
+		return sim.steps
+	}
+
+	for _, initrd := range initrds {
+		if sim.add(sim.fetch(ctx, "initrd", bootServer, initrd, io.Discard)) {
+			break
+		}
+	}
+
+	return sim.steps
+}
+
+type simulation struct {
+	logger *slog.Logger
+	opts   *ClientOptions
+	steps  []*ClientStep
+}
+
+// add records a step, returning true if it failed
+func (s *simulation) add(step *ClientStep) bool {
+	s.steps = append(s.steps, step)
+
+	if step.Err != nil {
+		s.logger.Error("simulated boot step failed",
+			"step", step.Name,
+			"detail", step.Detail,
+			"error", step.Err,
+		)
+
+		return true
+	}
+
+	s.logger.Info("simulated boot step succeeded",
+		"step", step.Name,
+		"detail", step.Detail,
+		"bytes", step.Bytes,
+		"duration", step.Duration,
+	)
+
+	return false
+}
+
+// dhcp gets a boot file offer, preferring an offer from an authoritative server (which
+// also gives the client an address) where several servers reply
+func (s *simulation) dhcp(ctx context.Context) (*dhcp.Packet, *ClientStep) {
+	step := &ClientStep{Name: "dhcp"}
+	start := time.Now()
+
+	var offers []*dhcp.Packet
+
+	if s.opts.BootServer != "" {
+		ack, err := s.opts.Client.RequestBootServer(ctx, s.opts.BootServer, s.opts.DHCPTimeout)
+		if err == nil {
+			offers = append(offers, ack)
+		}
+
+		step.Err = err
+	} else {
+		offers, step.Err = s.opts.Client.Discover(ctx, s.opts.DHCPTimeout)
+	}
+
+	step.Duration = time.Since(start)
+
+	if step.Err != nil {
+		return nil, step
+	}
+
+	offer := offers[0]
+	for _, candidate := range offers {
+		if !candidate.YIAddr.IsUnspecified() {
+			offer = candidate
+			break
+		}
+	}
+
+	step.Detail = fmt.Sprintf("%s from %s", offer.BootFile(), offer.BootServer())
+	if !offer.YIAddr.IsUnspecified() {
+		step.Detail += fmt.Sprintf(", address %s", offer.YIAddr)
+	}
+
+	return offer, step
+}
+
+// bootFile downloads the boot file over TFTP, and checks that an EFI boot file is for
+// the client's machine type
+func (s *simulation) bootFile(ctx context.Context, server string, bootFile string) *ClientStep {
+	buff := &bytes.Buffer{}
+
+	step := s.fetchTFTP(ctx, "boot_file", server, bootFile, buff)
+	if step.Err != nil {
+		return step
+	}
+
+	machine, ok := s.opts.Client.Arch.Machine()
+	if !ok {
+		return step
+	}
+
+	file, err := pe.NewFile(bytes.NewReader(buff.Bytes()))
+	if err != nil {
+		step.Err = fmt.Errorf("boot file isn't a PE image: %w", err)
+		return step
+	}
+	defer file.Close()
+
+	if file.Machine != uint16(machine) {
+		step.Err = fmt.Errorf("machine type is 0x%04x, expected 0x%04x: %w", file.Machine, uint16(machine), errWrongMachine)
+	}
+
+	return step
+}
+
+// config downloads the GRUB config for the client, trying the paths that GRUB does: by
+// MAC address, and then the generic config
+func (s *simulation) config(ctx context.Context, server string, prefix string) (string, *ClientStep) {
+	mac := strings.ReplaceAll(s.opts.Client.MAC.String(), ":", "-")
+
+	var step *ClientStep
+
+	for _, name := range []string{"grub.cfg-01-" + mac, "grub.cfg"} {
+		buff := &bytes.Buffer{}
+
+		step = s.fetch(ctx, "config", server, path.Join(prefix, name), buff)
+		if step.Err == nil {
+			return buff.String(), step
+		}
+
+		if !errors.Is(step.Err, tftp.ErrNotFound) && !errors.Is(step.Err, errNotFound) {
+			break
+		}
+	}
+
+	return "", step
+}
+
+// fetch downloads a file over HTTP if a URL is configured, or else over TFTP
+func (s *simulation) fetch(ctx context.Context, name string, server string, filePath string, w io.Writer) *ClientStep {
+	if s.opts.HTTPURL == "" {
+		return s.fetchTFTP(ctx, name, server, filePath, w)
+	}
+
+	step := &ClientStep{Name: name, Detail: "http " + filePath}
+	start := time.Now()
+
+	defer func() {
+		step.Duration = time.Since(start)
+	}()
+
+	url := strings.TrimSuffix(s.opts.HTTPURL, "/") + "/" + strings.TrimPrefix(filePath, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		step.Err = fmt.Errorf("failed to create request: %w", err)
+		return step
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		step.Err = fmt.Errorf("failed to get '%s': %w", url, err)
+		return step
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		step.Err = fmt.Errorf("'%s': %w", url, errNotFound)
+		return step
+	case resp.StatusCode != http.StatusOK:
+		step.Err = fmt.Errorf("'%s' returned %s: %w", url, resp.Status, errUnexpectedHTTP)
+		return step
+	}
+
+	step.Bytes, err = io.Copy(w, resp.Body)
+	if err != nil {
+		step.Err = fmt.Errorf("failed to read '%s': %w", url, err)
+	}
+
+	return step
+}
+
+func (s *simulation) fetchTFTP(ctx context.Context, name string, server string, filePath string, w io.Writer) *ClientStep {
+	step := &ClientStep{Name: name, Detail: "tftp " + filePath}
+	start := time.Now()
+
+	step.Bytes, step.Err = tftp.Get(ctx, server, filePath, w, 0)
+	step.Duration = time.Since(start)
+
+	return step
+}
+
+// bootFiles returns the kernel and initrds of the menu entry with the given title (or
+// the first that boots a kernel) in a GRUB config generated by pixie. For entries with
+// a variant for each arch, the variant for the given GRUB CPU is used.
+func bootFiles(config string, title string, cpu string) (string, []string, error) {
+	var (
+		entry   string
+		matches = true
+		kernel  string
+		initrds []string
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "menuentry":
+			if kernel != "" {
+				return kernel, initrds, nil
+			}
+
+			entry = grubUnquote(strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "menuentry"))
+			matches = true
+		case "if", "elif":
+			// Variants are chosen by '[ "$grub_cpu" = 'x86_64' ]'
+			if len(fields) >= 5 && fields[2] == `"$grub_cpu"` {
+				matches = grubUnquote(fields[4]) == cpu
+			}
+		case "linux", "linuxefi":
+			if len(fields) >= 2 && matches && (title == "" || entry == title) {
+				kernel = fields[1]
+			}
+		case "initrd", "initrdefi":
+			if kernel == "" || !matches || (title != "" && entry != title) {
+				continue
+			}
+
+			for _, initrd := range fields[1:] {
+				// Named initrds are given as 'newc:<name>:<path>'
+				if named, ok := strings.CutPrefix(initrd, "newc:"); ok {
+					_, initrd, _ = strings.Cut(named, ":")
+				}
+
+				initrds = append(initrds, initrd)
+			}
+		}
+	}
+
+	if kernel == "" {
+		return "", nil, errNoBootEntry
+	}
+
+	return kernel, initrds, nil
+}
+
+// grubUnquote returns the first word of s, without the single quotes that pixie writes
+// GRUB words in. Quotes within the word are escaped by closing the quotes, writing an
+// escaped quote, and reopening them.
+func grubUnquote(s string) string {
+	s = strings.TrimSpace(s)
+
+	rest, ok := strings.CutPrefix(s, "'")
+	if !ok {
+		word, _, _ := strings.Cut(s, " ")
+		return word
+	}
+
+	word := &strings.Builder{}
+
+	for {
+		quoted, after, _ := strings.Cut(rest, "'")
+		word.WriteString(quoted)
+
+		if rest, ok = strings.CutPrefix(after, `\''`); !ok {
+			return word.String()
+		}
+
+		word.WriteByte('\'')
+	}
+}
@@ -0,0 +1,304 @@
+// Package e2e runs end-to-end boot tests: ephemeral QEMU VMs network boot from a pixie
+// instance on a private network namespace (on Linux), or boot a pixie ISO image, and are
+// checked to reach a given point in the boot process. A simulated client can also walk through a
+// boot against a running pixie, without VMs.
+package e2e
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// Network used on the private bridge (on Linux). Pixie takes the first address.
+	serverIP      = "10.213.0.1"
+	dhcpRangeFrom = "10.213.0.100"
+	dhcpRangeTo   = "10.213.0.199"
+
+	pollInterval = time.Second
+	vmMemory     = "2048"
+)
+
+var (
+	errUnknownTarget   = errors.New("unknown target")
+	errTimeout         = errors.New("timed out waiting for boot marker in serial console")
+	errVMExited        = errors.New("VM exited before reaching boot marker")
+	errTargetsFailed   = errors.New("one or more targets failed to boot")
+	errMissingBinary   = errors.New("required program not found in PATH")
+	errMissingFirmware = errors.New("firmware image not found")
+	errISOUnsupported  = errors.New("ISO images only boot on UEFI targets")
+)
+
+// Target is a type of VM to boot
+type Target struct {
+	Name string
+
+	// QEMU system emulator binary
+	QEMU string
+
+	// Machine-specific QEMU arguments, not including networking. The firmware path is
+	// substituted for '{firmware}'.
+	Args []string
+
+	// Default path of the firmware image, if the target needs one
+	Firmware string
+
+	// QEMU network device model
+	NIC string
+}
+
+var targets = map[string]*Target{
+	"uefi-x64": {
+		Name:     "uefi-x64",
+		QEMU:     "qemu-system-x86_64",
+		Args:     []string{"-machine", "q35", "-drive", "if=pflash,format=raw,readonly=on,file={firmware}"},
+		Firmware: "/usr/share/OVMF/OVMF_CODE.fd",
+		NIC:      "virtio-net-pci",
+	},
+	"bios-x64": {
+		Name: "bios-x64",
+		QEMU: "qemu-system-x86_64",
+		Args: []string{"-machine", "pc"},
+		NIC:  "e1000",
+	},
+	"uefi-aa64": {
+		Name:     "uefi-aa64",
+		QEMU:     "qemu-system-aarch64",
+		Args:     []string{"-machine", "virt", "-cpu", "cortex-a57", "-bios", "{firmware}"},
+		Firmware: "/usr/share/AAVMF/AAVMF_CODE.fd",
+		NIC:      "virtio-net-pci",
+	},
+}
+
+// Targets returns the names of all known targets
+func Targets() []string {
+	return []string{"uefi-x64", "bios-x64", "uefi-aa64"}
+}
+
+// DefaultTargets returns the names of the targets booted unless others are asked for.
+// pixie doesn't provide a BIOS bootloader, so BIOS targets are left out: they can only
+// boot when a BIOS boot file is configured. ARM64 targets are left out too, as pixie
+// can't build GRUB images for them.
+func DefaultTargets() []string {
+	return []string{"uefi-x64"}
+}
+
+// Options configures an end-to-end test run
+type Options struct {
+	// Path of the pixie binary to run, and the config it should be run with. The config
+	// must serve DHCP on the test network (see [ServerIP] and [DHCPRange]). Unused when
+	// booting ISO images.
+	PixiePath  string
+	ConfigPath string
+
+	// Names of targets to boot
+	Targets []string
+
+	// Firmware image to use for targets, overriding their defaults
+	Firmware map[string]string
+
+	// Pattern that, once it appears on a VM's serial console, marks a successful boot
+	Expect *regexp.Regexp
+
+	// How long each VM has to reach the expected pattern
+	Timeout time.Duration
+
+	// Directory in which to write logs
+	WorkDirectory string
+}
+
+// Result is the outcome of booting a single target
+type Result struct {
+	Target   string
+	Err      error
+	Duration time.Duration
+
+	// Path of the serial console log
+	LogPath string
+}
+
+// ServerIP returns the address that pixie must serve on in the test network
+func ServerIP() string {
+	return serverIP
+}
+
+// DHCPRange returns the range of addresses that pixie must allocate to VMs
+func DHCPRange() (string, string) {
+	return dhcpRangeFrom, dhcpRangeTo
+}
+
+// BootISO boots a VM for each target from the ISO image, without a network. Only UEFI
+// targets are supported, as pixie's ISO images only contain EFI entrypoints. An error is
+// returned if any target failed.
+func BootISO(ctx context.Context, logger *slog.Logger, opts *Options, isoPath string) ([]*Result, error) {
+	if err := checkPrerequisites(opts); err != nil {
+		return nil, err
+	}
+
+	for _, name := range opts.Targets {
+		if targets[name].Firmware == "" {
+			return nil, fmt.Errorf("target '%s': %w", name, errISOUnsupported)
+		}
+	}
+
+	if _, err := os.Stat(isoPath); err != nil {
+		return nil, fmt.Errorf("failed to find ISO image: %w", err)
+	}
+
+	// A SCSI CD-ROM works on every machine type, unlike QEMU's default IDE one
+	media := []string{
+		"-drive", "if=none,id=cd0,media=cdrom,readonly=on,format=raw,file=" + isoPath,
+		"-device", "virtio-scsi-pci,id=scsi0",
+		"-device", "scsi-cd,bus=scsi0.0,drive=cd0",
+		"-nic", "none",
+	}
+
+	results := make([]*Result, len(opts.Targets))
+	eg := &errgroup.Group{}
+
+	for i, name := range opts.Targets {
+		eg.Go(func() error {
+			results[i] = boot(ctx, logger, opts, targets[name], nil, media)
+			return nil
+		})
+	}
+
+	return wait(eg, results)
+}
+
+// wait waits for the group booting targets, returning an error if any target failed
+func wait(eg *errgroup.Group, results []*Result) ([]*Result, error) {
+	_ = eg.Wait()
+
+	for _, result := range results {
+		if result.Err != nil {
+			return results, errTargetsFailed
+		}
+	}
+
+	return results, nil
+}
+
+func checkPrerequisites(opts *Options, required ...string) error {
+	for _, name := range opts.Targets {
+		target, ok := targets[name]
+		if !ok {
+			return fmt.Errorf("'%s': %w", name, errUnknownTarget)
+		}
+
+		required = append(required, target.QEMU)
+
+		if firmware := opts.firmware(target); firmware != "" {
+			if _, err := os.Stat(firmware); err != nil {
+				return fmt.Errorf("target '%s': '%s': %w", name, firmware, errMissingFirmware)
+			}
+		}
+	}
+
+	for _, program := range required {
+		if _, err := exec.LookPath(program); err != nil {
+			return fmt.Errorf("'%s': %w", program, errMissingBinary)
+		}
+	}
+
+	return nil
+}
+
+func (o *Options) firmware(target *Target) string {
+	if firmware, ok := o.Firmware[target.Name]; ok {
+		return firmware
+	}
+
+	return target.Firmware
+}
+
+// boot boots a VM for the target, waiting for the expected pattern to appear on its
+// serial console. QEMU is run with the given command prefix, and media are the arguments
+// giving it something to boot from.
+func boot(ctx context.Context, logger *slog.Logger, opts *Options, target *Target, prefix []string, media []string) *Result {
+	start := time.Now()
+	result := &Result{
+		Target:  target.Name,
+		LogPath: filepath.Join(opts.WorkDirectory, target.Name+".log"),
+	}
+
+	logger = logger.With("target", target.Name)
+
+	vmCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	args := append(slices.Clone(prefix), target.QEMU)
+	for _, arg := range target.Args {
+		args = append(args, strings.ReplaceAll(arg, "{firmware}", opts.firmware(target)))
+	}
+
+	args = append(args,
+		"-m", vmMemory,
+		"-display", "none",
+		"-no-reboot",
+		"-serial", "file:"+result.LogPath,
+	)
+	args = append(args, media...)
+
+	vm := exec.CommandContext(vmCtx, args[0], args[1:]...)
+	vm.WaitDelay = 5 * time.Second
+
+	if err := vm.Start(); err != nil {
+		result.Err = fmt.Errorf("failed to start VM: %w", err)
+		return result
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- vm.Wait()
+	}()
+
+	defer func() {
+		cancel()
+		<-exited
+	}()
+
+	logger.Info("started VM")
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-vmCtx.Done():
+			result.Err = errTimeout
+		case err := <-exited:
+			exited <- err
+
+			result.Err = errVMExited
+			if err != nil {
+				result.Err = fmt.Errorf("%w: %w", errVMExited, err)
+			}
+		case <-ticker.C:
+			output, err := os.ReadFile(result.LogPath)
+			if err != nil || !opts.Expect.Match(output) {
+				continue
+			}
+		}
+
+		result.Duration = time.Since(start)
+
+		logger.Info("VM finished",
+			"duration", result.Duration,
+			"error", result.Err,
+		)
+
+		return result
+	}
+}
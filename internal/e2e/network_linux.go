@@ -0,0 +1,138 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	bridgeName = "pixie0"
+	serverCIDR = serverIP + "/24"
+)
+
+// Run creates a private network namespace, runs pixie in it, and boots a VM for each
+// target. All resources are cleaned up before returning. An error is returned if the
+// environment could not be set up, or if any target failed.
+func Run(ctx context.Context, logger *slog.Logger, opts *Options) ([]*Result, error) {
+	if err := checkPrerequisites(opts, "ip"); err != nil {
+		return nil, err
+	}
+
+	namespace := "pixie-e2e-" + strconv.Itoa(os.Getpid())
+
+	if err := createNetwork(ctx, namespace, len(opts.Targets)); err != nil {
+		_ = run(context.WithoutCancel(ctx), "ip", "netns", "delete", namespace)
+		return nil, err
+	}
+
+	defer func() {
+		if err := run(context.WithoutCancel(ctx), "ip", "netns", "delete", namespace); err != nil {
+			logger.Warn("failed to delete network namespace",
+				"namespace", namespace,
+				"error", err,
+			)
+		}
+	}()
+
+	pixieLog, err := os.Create(filepath.Join(opts.WorkDirectory, "pixie.log"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pixie log: %w", err)
+	}
+	defer pixieLog.Close()
+
+	pixieCtx, stopPixie := context.WithCancel(ctx)
+	defer stopPixie()
+
+	pixie := exec.CommandContext(pixieCtx, "ip", "netns", "exec", namespace, opts.PixiePath, "--config", opts.ConfigPath, "--level", "debug", "serve")
+	pixie.Stdout = pixieLog
+	pixie.Stderr = pixieLog
+	pixie.Cancel = func() error { return pixie.Process.Signal(os.Interrupt) }
+	pixie.WaitDelay = 10 * time.Second
+
+	if err := pixie.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start pixie: %w", err)
+	}
+
+	defer func() {
+		stopPixie()
+		_ = pixie.Wait()
+	}()
+
+	logger.Info("started pixie in network namespace",
+		"namespace", namespace,
+		"log", pixieLog.Name(),
+	)
+
+	results := make([]*Result, len(opts.Targets))
+	eg := &errgroup.Group{}
+
+	for i, name := range opts.Targets {
+		eg.Go(func() error {
+			prefix := []string{"ip", "netns", "exec", namespace}
+			media := []string{
+				"-netdev", "tap,id=net0,ifname=" + tapName(i) + ",script=no,downscript=no",
+				// Locally administered MAC, unique per target
+				"-device", fmt.Sprintf("%s,netdev=net0,mac=52:54:00:e2:e0:%02x", targets[name].NIC, i),
+				"-boot", "n",
+			}
+
+			results[i] = boot(ctx, logger, opts, targets[name], prefix, media)
+			return nil
+		})
+	}
+
+	return wait(eg, results)
+}
+
+// createNetwork creates a network namespace with a bridge, to which pixie is attached,
+// and a tap device per VM
+func createNetwork(ctx context.Context, namespace string, taps int) error {
+	commands := [][]string{
+		{"ip", "netns", "add", namespace},
+		{"ip", "-n", namespace, "link", "set", "lo", "up"},
+		{"ip", "-n", namespace, "link", "add", bridgeName, "type", "bridge"},
+		{"ip", "-n", namespace, "addr", "add", serverCIDR, "dev", bridgeName},
+		{"ip", "-n", namespace, "link", "set", bridgeName, "up"},
+		// Broadcast DHCP replies need a route, and there's nothing else in the namespace
+		{"ip", "-n", namespace, "route", "add", "default", "dev", bridgeName},
+	}
+
+	for i := range taps {
+		tap := tapName(i)
+		commands = append(commands,
+			[]string{"ip", "-n", namespace, "tuntap", "add", tap, "mode", "tap"},
+			[]string{"ip", "-n", namespace, "link", "set", tap, "master", bridgeName},
+			[]string{"ip", "-n", namespace, "link", "set", tap, "up"},
+		)
+	}
+
+	for _, command := range commands {
+		if err := run(ctx, command[0], command[1:]...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func tapName(i int) string {
+	return "tap" + strconv.Itoa(i)
+}
+
+func run(ctx context.Context, name string, args ...string) error {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("'%s %v' failed: %w: %s", name, args, err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package e2e
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+var errNetworkUnsupported = errors.New("network boot tests need Linux network namespaces; boot an ISO image instead")
+
+// Run would boot VMs from pixie on a private network, which is only supported on Linux
+func Run(_ context.Context, _ *slog.Logger, _ *Options) ([]*Result, error) {
+	return nil, errNetworkUnsupported
+}
@@ -0,0 +1,376 @@
+// Package entrypoint stores built EFI entrypoint images in A/B slots, so that the image
+// served to clients can be switched back to the previous known-good build without
+// having to rebuild it
+package entrypoint
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/davejbax/pixie/internal/atomicfile"
+)
+
+type Slot string
+
+const (
+	SlotA Slot = "a"
+	SlotB Slot = "b"
+
+	// SlotStaged holds an image that has been installed but not yet activated, until
+	// [Store.Promote] moves it into the inactive slot. It can't be switched to directly.
+	SlotStaged Slot = "staged"
+
+	stateFilename = "state.json"
+)
+
+var (
+	errInvalidSlot     = errors.New("invalid slot; valid values are 'a' or 'b'")
+	errSlotEmpty       = errors.New("slot does not contain an image")
+	errNoActiveImage   = errors.New("no entrypoint image has been installed for arch")
+	errInvalidArchName = errors.New("invalid arch name")
+)
+
+// ParseSlot converts a user-provided slot name into a [Slot]
+func ParseSlot(name string) (Slot, error) {
+	switch Slot(name) {
+	case SlotA, SlotB:
+		return Slot(name), nil
+	default:
+		return "", errInvalidSlot
+	}
+}
+
+// Other returns the opposite slot to this one
+func (s Slot) Other() Slot {
+	if s == SlotA {
+		return SlotB
+	}
+
+	return SlotA
+}
+
+// SlotInfo describes an image that has been installed into a slot
+type SlotInfo struct {
+	BuiltAt time.Time
+	Size    int64
+	SHA256  string
+}
+
+// State is the persisted state of the slots for a single arch
+type State struct {
+	Active Slot
+	Slots  map[Slot]*SlotInfo
+
+	// Slot containing an image that has been installed but not yet activated, if any.
+	// This is always [SlotStaged], so that staging an image never replaces the one that
+	// [Store.Rollback] switches back to.
+	Staged Slot `json:",omitempty"`
+}
+
+type Store struct {
+	directory string
+}
+
+// NewStore creates a store that keeps entrypoint images under the given directory,
+// with one subdirectory per arch
+func NewStore(directory string) *Store {
+	return &Store{directory: directory}
+}
+
+func (s *Store) archDirectory(arch string) (string, error) {
+	// Ensure arch isn't doing path traversal
+	if arch == "" || arch != filepath.Base(arch) || arch == "." || arch == ".." {
+		return "", errInvalidArchName
+	}
+
+	return filepath.Join(s.directory, arch), nil
+}
+
+func (s *Store) imagePath(arch string, slot Slot) (string, error) {
+	directory, err := s.archDirectory(arch)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(directory, string(slot)+".efi"), nil
+}
+
+// Install writes the image into the inactive slot for the given arch and, if activate
+// is true, makes it the active slot. The previously active image is kept in the other
+// slot, so that it can be switched back to with [Store.Switch] or [Store.Rollback].
+//
+// If activate is false, the image is written into [SlotStaged] instead, and can later be
+// activated with [Store.Promote]. If there is no active image yet, the image is always
+// activated. Activating an image discards any staged one, which would be older.
+func (s *Store) Install(arch string, image io.WriterTo, activate bool) (Slot, error) {
+	directory, err := s.archDirectory(arch)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create directories in path '%s': %w", directory, err)
+	}
+
+	state, err := s.State(arch)
+	if err != nil {
+		return "", err
+	}
+
+	activate = activate || state.Active == ""
+
+	slot := SlotStaged
+	if activate {
+		slot = inactiveSlot(state)
+	}
+
+	path, err := s.imagePath(arch, slot)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	written := int64(0)
+	err = atomicfile.WriteFunc(path, func(w io.Writer) (err error) {
+		written, err = image.WriteTo(io.MultiWriter(w, hash))
+		return err //nolint:wrapcheck
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to write entrypoint image into slot: %w", err)
+	}
+
+	state.Slots[slot] = &SlotInfo{
+		BuiltAt: time.Now().UTC(),
+		Size:    written,
+		SHA256:  fmt.Sprintf("%x", hash.Sum(nil)),
+	}
+	if activate {
+		if err := s.discardStaged(arch, state); err != nil {
+			return "", err
+		}
+
+		state.Active = slot
+	} else {
+		state.Staged = slot
+	}
+
+	if err := s.writeState(arch, state); err != nil {
+		return "", err
+	}
+
+	return slot, nil
+}
+
+// inactiveSlot returns the slot that an image should be activated into, keeping the
+// active image as the one to roll back to
+func inactiveSlot(state *State) Slot {
+	if state.Active == "" {
+		return SlotA
+	}
+
+	return state.Active.Other()
+}
+
+// discardStaged removes the staged image for the arch, if there is one
+func (s *Store) discardStaged(arch string, state *State) error {
+	if state.Staged == "" {
+		return nil
+	}
+
+	path, err := s.imagePath(arch, SlotStaged)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove staged entrypoint image: %w", err)
+	}
+
+	delete(state.Slots, SlotStaged)
+	state.Staged = ""
+
+	return nil
+}
+
+// Promote activates the staged image for the given arch, if there is one, returning
+// whether an image was activated. The staged image is moved into the inactive slot, so
+// that the previously active image is kept to roll back to.
+func (s *Store) Promote(arch string) (bool, error) {
+	state, err := s.State(arch)
+	if err != nil {
+		return false, err
+	}
+
+	if state.Staged == "" {
+		return false, nil
+	}
+
+	stagedPath, err := s.imagePath(arch, SlotStaged)
+	if err != nil {
+		return false, err
+	}
+
+	slot := inactiveSlot(state)
+	path, err := s.imagePath(arch, slot)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.Rename(stagedPath, path); err != nil {
+		return false, fmt.Errorf("failed to move staged entrypoint image into slot: %w", err)
+	}
+
+	state.Slots[slot] = state.Slots[SlotStaged]
+	delete(state.Slots, SlotStaged)
+	state.Active = slot
+	state.Staged = ""
+
+	// Writing the state also makes the rename durable, as they're in the same directory
+	if err := s.writeState(arch, state); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// State returns the slot state for the given arch. If no images have been installed,
+// the returned state will have no active slot.
+func (s *Store) State(arch string) (*State, error) {
+	directory, err := s.archDirectory(arch)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{Slots: make(map[Slot]*SlotInfo)}
+
+	data, err := os.ReadFile(filepath.Join(directory, stateFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read entrypoint state: %w", err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("entrypoint state for arch '%s' is corrupted: %w", arch, err)
+	}
+
+	if state.Slots == nil {
+		state.Slots = make(map[Slot]*SlotInfo)
+	}
+
+	return state, nil
+}
+
+// Arches lists all arches that have at least one installed image
+func (s *Store) Arches() ([]string, error) {
+	entries, err := os.ReadDir(s.directory)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list entrypoint directory: %w", err)
+	}
+
+	arches := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(s.directory, entry.Name(), stateFilename)); err == nil {
+			arches = append(arches, entry.Name())
+		}
+	}
+
+	return arches, nil
+}
+
+// Switch makes the given slot the one that is served for the arch. The switch is
+// atomic: readers will either see the old or the new slot, never a partial image.
+func (s *Store) Switch(arch string, slot Slot) error {
+	if _, err := ParseSlot(string(slot)); err != nil {
+		return err
+	}
+
+	state, err := s.State(arch)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := state.Slots[slot]; !ok {
+		return fmt.Errorf("cannot switch arch '%s' to slot '%s': %w", arch, slot, errSlotEmpty)
+	}
+
+	state.Active = slot
+
+	return s.writeState(arch, state)
+}
+
+// Rollback switches the arch back to whichever slot is not currently active,
+// returning the newly active slot. Any staged image stays staged.
+func (s *Store) Rollback(arch string) (Slot, error) {
+	state, err := s.State(arch)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Active == "" {
+		return "", errNoActiveImage
+	}
+
+	slot := state.Active.Other()
+	if err := s.Switch(arch, slot); err != nil {
+		return "", err
+	}
+
+	return slot, nil
+}
+
+// ImagePath returns the path of the image in the given slot for the given arch
+func (s *Store) ImagePath(arch string, slot Slot) (string, error) {
+	return s.imagePath(arch, slot)
+}
+
+// Open opens the image in the active slot for the given arch
+func (s *Store) Open(arch string) (*os.File, error) {
+	state, err := s.State(arch)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.Active == "" {
+		return nil, fmt.Errorf("cannot open entrypoint for arch '%s': %w", arch, errNoActiveImage)
+	}
+
+	path, err := s.imagePath(arch, state.Active)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path) //nolint:wrapcheck
+}
+
+func (s *Store) writeState(arch string, state *State) error {
+	directory, err := s.archDirectory(arch)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode entrypoint state: %w", err)
+	}
+
+	// The state is replaced atomically, so that the switch is too
+	if err := atomicfile.Write(filepath.Join(directory, stateFilename), data); err != nil {
+		return fmt.Errorf("failed to write entrypoint state: %w", err)
+	}
+
+	return nil
+}
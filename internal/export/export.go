@@ -0,0 +1,290 @@
+// Package export copies the files that pixie serves into a directory, so that existing
+// TFTP and HTTP servers (such as dnsmasq or nginx) can serve them instead of pixie.
+// Files that are already up to date aren't written again, and files that pixie no
+// longer serves can be deleted.
+package export
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/davejbax/pixie/internal/bootloader"
+)
+
+var errNotDirectory = errors.New("a directory is in the way")
+
+// Options controls how the destination directory is brought up to date
+type Options struct {
+	// Delete files in the destination that pixie doesn't serve
+	Delete bool
+
+	// Only print what would be written and deleted
+	DryRun bool
+}
+
+// Result counts the changes made by an export
+type Result struct {
+	Written   int
+	Unchanged int
+	Deleted   int
+
+	// Bytes of the files written
+	Bytes int64
+}
+
+// Exporter writes files into a destination directory
+type Exporter struct {
+	logger  *slog.Logger
+	dest    string
+	options *Options
+
+	// Where dry runs print the files that would be written and deleted
+	plan io.Writer
+
+	// Local paths of the files exported so far, which aren't deleted
+	exported map[string]bool
+	result   Result
+}
+
+// modTimer is a file that knows when it was last modified, such as a stored distro file.
+// Generated files don't, and are compared by content instead.
+type modTimer interface {
+	ModTime() time.Time
+}
+
+// New creates an exporter into the dest directory. Dry runs print the files that would
+// be written (as '+ <path>') and deleted (as '- <path>') to plan.
+func New(logger *slog.Logger, dest string, options *Options, plan io.Writer) *Exporter {
+	return &Exporter{
+		logger:   logger,
+		dest:     dest,
+		options:  options,
+		plan:     plan,
+		exported: make(map[string]bool),
+	}
+}
+
+// Write exports the file at the given slash-separated path, unless the destination
+// already has the same file. Files whose modification time is known are compared by
+// size and modification time, which is copied to the destination; others are compared
+// by content.
+func (e *Exporter) Write(requestPath string, file bootloader.File) error {
+	target := filepath.Join(e.dest, filepath.FromSlash(requestPath))
+	e.exported[target] = true
+
+	var modTime time.Time
+	if timed, ok := file.(modTimer); ok {
+		modTime = timed.ModTime()
+	}
+
+	info, err := os.Stat(target)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to stat '%s': %w", target, err)
+	}
+
+	if info != nil && info.IsDir() {
+		return fmt.Errorf("'%s': %w", target, errNotDirectory)
+	}
+
+	sameSize := info != nil && info.Size() == file.Size()
+
+	if sameSize && !modTime.IsZero() && info.ModTime().Unix() == modTime.Unix() {
+		e.result.Unchanged++
+		return nil
+	}
+
+	if e.options.DryRun {
+		if sameSize && modTime.IsZero() {
+			same, err := sameContent(target, file)
+			if err != nil {
+				return err
+			}
+
+			if same {
+				e.result.Unchanged++
+				return nil
+			}
+		}
+
+		fmt.Fprintf(e.plan, "+ %s\n", requestPath)
+
+		e.result.Written++
+		e.result.Bytes += file.Size()
+
+		return nil
+	}
+
+	written, err := e.replace(target, file, sameSize && modTime.IsZero(), modTime)
+	if err != nil {
+		return err
+	}
+
+	if !written {
+		e.result.Unchanged++
+		return nil
+	}
+
+	e.logger.Debug("wrote file",
+		"path", requestPath,
+		"size", file.Size(),
+	)
+
+	e.result.Written++
+	e.result.Bytes += file.Size()
+
+	return nil
+}
+
+// replace writes the file to a temporary file beside target, and renames it over target.
+// If compare is set, target is left as it is if its contents are the same, and false is
+// returned.
+func (e *Exporter) replace(target string, file bootloader.File, compare bool, modTime time.Time) (bool, error) {
+	//nolint:gosec // Other servers read the exported files, usually as another user
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return false, fmt.Errorf("failed to create directories in path '%s': %w", filepath.Dir(target), err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".pixie-export-*")
+	if err != nil {
+		return false, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	checksum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, checksum), file); err != nil {
+		return false, fmt.Errorf("failed to write '%s': %w", target, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("failed to write '%s': %w", target, err)
+	}
+
+	if compare {
+		existing, err := fileChecksum(target)
+		if err != nil {
+			return false, err
+		}
+
+		if bytes.Equal(existing, checksum.Sum(nil)) {
+			return false, nil
+		}
+	}
+
+	//nolint:gosec // Other servers read the exported files, usually as another user
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return false, fmt.Errorf("failed to set permissions of '%s': %w", target, err)
+	}
+
+	if !modTime.IsZero() {
+		if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+			return false, fmt.Errorf("failed to set modification time of '%s': %w", target, err)
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return false, fmt.Errorf("failed to replace '%s': %w", target, err)
+	}
+
+	return true, nil
+}
+
+// Finish deletes the files in the destination that weren't exported, if enabled, along
+// with directories left empty, and returns what the export changed
+func (e *Exporter) Finish() (*Result, error) {
+	if !e.options.Delete {
+		return &e.result, nil
+	}
+
+	directories := []string{}
+
+	err := filepath.WalkDir(e.dest, func(localPath string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && localPath == e.dest {
+			return filepath.SkipAll
+		} else if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if localPath != e.dest {
+				directories = append(directories, localPath)
+			}
+
+			return nil
+		}
+
+		if e.exported[localPath] {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(e.dest, localPath)
+
+		e.result.Deleted++
+
+		if e.options.DryRun {
+			fmt.Fprintf(e.plan, "- %s\n", filepath.ToSlash(rel))
+
+			return nil
+		}
+
+		e.logger.Debug("deleted file",
+			"path", filepath.ToSlash(rel),
+		)
+
+		return os.Remove(localPath) //nolint:wrapcheck
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete files that aren't exported: %w", err)
+	}
+
+	if e.options.DryRun {
+		return &e.result, nil
+	}
+
+	// Subdirectories come after their parents in the walk, so are removed first. Those
+	// with files left in them fail to be removed, and are kept.
+	for _, directory := range slices.Backward(directories) {
+		_ = os.Remove(directory)
+	}
+
+	return &e.result, nil
+}
+
+// sameContent returns whether the local file has the same contents as the file
+func sameContent(localPath string, file bootloader.File) (bool, error) {
+	existing, err := fileChecksum(localPath)
+	if err != nil {
+		return false, err
+	}
+
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, file); err != nil {
+		return false, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return bytes.Equal(existing, checksum.Sum(nil)), nil
+}
+
+func fileChecksum(localPath string) ([]byte, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%s': %w", localPath, err)
+	}
+	defer file.Close()
+
+	checksum := sha256.New()
+	if _, err := io.Copy(checksum, file); err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", localPath, err)
+	}
+
+	return checksum.Sum(nil), nil
+}
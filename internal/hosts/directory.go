@@ -0,0 +1,191 @@
+package hosts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/atomicfile"
+	"gopkg.in/yaml.v3"
+)
+
+var errNameMismatch = errors.New("host name doesn't match file name")
+
+// Extension of host files written to a directory. Files ending in '.yml' or '.json' are
+// read too.
+const directoryExtension = ".yaml"
+
+// Directory holds host configs as files in a directory, one host per YAML or JSON file
+// named after the host, so that hosts can be managed by tools (such as the CLI) or
+// configuration management without editing the config file
+type Directory struct {
+	path    string
+	configs map[string]Config
+
+	// Files that each host was read from
+	files map[string]string
+}
+
+// OpenDirectory reads the host files in the directory at the given path. A missing
+// directory has no hosts.
+func OpenDirectory(path string) (*Directory, error) {
+	d := &Directory{
+		path:    path,
+		configs: make(map[string]Config),
+		files:   make(map[string]string),
+	}
+
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return d, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read hosts directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || !slices.Contains([]string{".yaml", ".yml", ".json"}, ext) {
+			continue
+		}
+
+		file := filepath.Join(path, entry.Name())
+
+		config, err := readHostFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		// Hosts are named after their file, so that a file can't silently shadow another
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if config.Name == "" {
+			config.Name = name
+		} else if config.Name != name {
+			return nil, fmt.Errorf("'%s' has name '%s': %w", file, config.Name, errNameMismatch)
+		}
+
+		if other, ok := d.files[config.Name]; ok {
+			return nil, fmt.Errorf("host '%s' in '%s' and '%s': %w", config.Name, other, file, errDuplicateName)
+		}
+
+		d.configs[config.Name] = config
+		d.files[config.Name] = file
+	}
+
+	return d, nil
+}
+
+// readHostFile reads a host config from a YAML or JSON file. Files use the same keys as
+// hosts in the config file. As JSON is a subset of YAML, both are decoded as YAML, and
+// then through the host's JSON tags.
+func readHostFile(file string) (Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read host file: %w", err)
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return Config{}, fmt.Errorf("failed to decode host file '%s': %w", file, err)
+	}
+
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to decode host file '%s': %w", file, err)
+	}
+
+	var config Config
+
+	decoder := json.NewDecoder(strings.NewReader(string(encoded)))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&config); err != nil {
+		return Config{}, fmt.Errorf("failed to decode host file '%s': %w", file, err)
+	}
+
+	return config, nil
+}
+
+// Get returns the config of the host with the given name, if it is in the directory
+func (d *Directory) Get(name string) (Config, bool) {
+	config, ok := d.configs[name]
+	return config, ok
+}
+
+// Configs returns all host configs in the directory, sorted by name
+func (d *Directory) Configs() []Config {
+	configs := make([]Config, 0, len(d.configs))
+	for _, config := range d.configs {
+		configs = append(configs, config)
+	}
+
+	slices.SortFunc(configs, func(a, b Config) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return configs
+}
+
+// Put writes a host config to the directory as YAML, replacing any with the same name
+func (d *Directory) Put(config Config) error {
+	if !validName(config.Name) {
+		return fmt.Errorf("'%s': %w", config.Name, errInvalidName)
+	}
+
+	// Encode through the JSON tags, so that the file uses the same keys as are read
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode host: %w", err)
+	}
+
+	var values map[string]any
+	if err := json.Unmarshal(encoded, &values); err != nil {
+		return fmt.Errorf("failed to encode host: %w", err)
+	}
+
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("failed to encode host: %w", err)
+	}
+
+	if err := os.MkdirAll(d.path, 0o755); err != nil {
+		return fmt.Errorf("failed to create hosts directory: %w", err)
+	}
+
+	file, ok := d.files[config.Name]
+	if !ok {
+		file = filepath.Join(d.path, config.Name+directoryExtension)
+	}
+
+	// pixie reloading the directory ignores the temporary file, which has an extension
+	// that isn't read
+	if err := atomicfile.Write(file, data); err != nil {
+		return fmt.Errorf("failed to write host: %w", err)
+	}
+
+	d.configs[config.Name] = config
+	d.files[config.Name] = file
+
+	return nil
+}
+
+// Delete removes the host with the given name from the directory
+func (d *Directory) Delete(name string) error {
+	file, ok := d.files[name]
+	if !ok {
+		return nil
+	}
+
+	if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove host file: %w", err)
+	}
+
+	delete(d.configs, name)
+	delete(d.files, name)
+
+	return nil
+}
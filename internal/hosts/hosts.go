@@ -0,0 +1,603 @@
+// Package hosts matches network boot clients to per-host configuration, so that
+// different machines can boot different things from one pixie instance
+package hosts
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/davejbax/pixie/internal/bmc"
+	"github.com/davejbax/pixie/internal/netroot"
+)
+
+var (
+	errNoName         = errors.New("host must have a name")
+	errDuplicateName  = errors.New("name is used more than once")
+	errInvalidName    = errors.New("host name may only contain letters, digits, '-', '_' and '.'")
+	errNoMatchers     = errors.New("host must have a MAC address, UUID, or CIDR")
+	errNoDistro       = errors.New("host must have a distro, or boot from local disk first")
+	errUnknownProfile = errors.New("unknown profile")
+	errProfileCycle   = errors.New("profile inherits from itself")
+	errReservedName   = errors.New("host name is reserved for the default profile")
+	errInvalidUUID    = errors.New("invalid UUID")
+	errDuplicateMatch = errors.New("two hosts match the same MAC address or UUID")
+
+	errInvalidInitrdPath    = errors.New("initrd file path must be absolute and clean, e.g. '/etc/hostname'")
+	errInitrdContentSources = errors.New("initrd file may have content or a source, not both")
+	errInvalidInitrdMode    = errors.New("initrd file mode must be octal permissions, e.g. '0600'")
+)
+
+// DefaultHostName is the name given to clients that match no host, and are booted using
+// the default profile
+const DefaultHostName = "default"
+
+// Placeholder for the host's name in kernel arguments
+const namePlaceholder = "{name}"
+
+// Settings are what a host boots. They may be given on a host directly, or on a profile
+// that hosts share.
+type Settings struct {
+	// Name of the distro to boot
+	Distro string `json:"distro,omitempty"`
+
+	// Additional kernel command line arguments. These are merged over those of any
+	// inherited profile, in the same way as distro arguments are merged over global ones.
+	// '{name}' is replaced by the host's name, and '{vars.NAME}' by its variable NAME,
+	// e.g. 'hostname={name}.{vars.rack}.example.com'.
+	Args []string `json:"args,omitempty"`
+
+	// Layers of arguments from inherited profiles, root first
+	argLayers [][]string
+
+	// Path of an install automation file (e.g. a kickstart file) to serve to the host,
+	// relative to the templates directory. The file is rendered as a Go template, with
+	// access to the host's variables.
+	Automation string `json:"automation,omitempty"`
+
+	// Variables for the automation template. These are merged with those of any
+	// inherited profile, overriding variables of the same name. Note that the config
+	// loader lower-cases variable names.
+	Vars map[string]any `json:"vars,omitempty"`
+
+	// Whether to boot from local disk by default, offering the distro as a second
+	// choice. This is useful for machines that should only be reinstalled on request.
+	LocalBootFirst *bool `mapstructure:"local_boot_first" json:"local_boot_first,omitempty"`
+
+	// Title of the menu entry booted by default, overriding the menu's default, e.g.
+	// 'Boot from local disk'
+	MenuDefault string `mapstructure:"menu_default" json:"menu_default,omitempty"`
+
+	// Name of the GRUB profile that the host boots with, rather than the default GRUB
+	// config
+	GrubProfile string `mapstructure:"grub_profile" json:"grub_profile,omitempty"`
+
+	// Root file system mounted over the network, for diskless hosts that run the distro
+	// from a shared server rather than installing it. Paths and names may contain
+	// '{name}', which is replaced by the host's name.
+	Root *netroot.Config `mapstructure:"root" json:"root,omitempty"`
+
+	// Baseboard management controller of the host, through which it can be made to
+	// network boot and power-cycled when assigned an install
+	BMC *bmc.Config `mapstructure:"bmc" json:"bmc,omitempty"`
+
+	// Extra files appended to the host's initrd, such as SSH keys, network config or
+	// registration tokens, so that installers can be customised without rebuilding the
+	// distro. These are merged with those of any inherited profile, by path.
+	InitrdFiles []InitrdFile `mapstructure:"initrd_files" json:"initrd_files,omitempty"`
+}
+
+// InitrdFile is a file added to a host's initramfs
+type InitrdFile struct {
+	// Absolute path of the file in the initramfs, e.g. '/root/.ssh/authorized_keys'.
+	// Missing parent directories are created.
+	Path string `json:"path"`
+
+	// Contents of the file. This is rendered as a Go template, in the same way as
+	// automation files.
+	Content string `json:"content,omitempty"`
+
+	// Path of a template on pixie's disk to render as the file's contents, instead of
+	// Content
+	Source string `json:"source,omitempty"`
+
+	// Permissions of the file in octal, e.g. '0600'. Defaults to '0644'.
+	Mode string `json:"mode,omitempty"`
+}
+
+// Permissions returns the permissions of the file, which must have been validated
+func (f *InitrdFile) Permissions() uint32 {
+	if f.Mode == "" {
+		return 0o644
+	}
+
+	mode, _ := strconv.ParseUint(f.Mode, 8, 32)
+
+	return uint32(mode)
+}
+
+func (f *InitrdFile) validate() error {
+	if !path.IsAbs(f.Path) || path.Clean(f.Path) != f.Path || f.Path == "/" {
+		return fmt.Errorf("'%s': %w", f.Path, errInvalidInitrdPath)
+	}
+
+	if f.Content != "" && f.Source != "" {
+		return fmt.Errorf("'%s': %w", f.Path, errInitrdContentSources)
+	}
+
+	if f.Mode != "" {
+		if mode, err := strconv.ParseUint(f.Mode, 8, 32); err != nil || mode > 0o777 {
+			return fmt.Errorf("'%s': %w", f.Path, errInvalidInitrdMode)
+		}
+	}
+
+	return nil
+}
+
+// merge applies the settings in other on top of s
+func (s *Settings) merge(other *Settings) {
+	if other.Distro != "" {
+		s.Distro = other.Distro
+	}
+
+	s.argLayers = append(slices.Clone(s.argLayers), other.argLayers...)
+	if len(other.Args) > 0 {
+		s.argLayers = append(s.argLayers, other.Args)
+	}
+
+	if other.Automation != "" {
+		s.Automation = other.Automation
+	}
+
+	if other.LocalBootFirst != nil {
+		s.LocalBootFirst = other.LocalBootFirst
+	}
+
+	if other.MenuDefault != "" {
+		s.MenuDefault = other.MenuDefault
+	}
+
+	if other.GrubProfile != "" {
+		s.GrubProfile = other.GrubProfile
+	}
+
+	if other.Root != nil {
+		s.Root = other.Root
+	}
+
+	if other.BMC != nil {
+		s.BMC = other.BMC
+	}
+
+	if len(other.InitrdFiles) > 0 {
+		s.InitrdFiles = slices.DeleteFunc(slices.Clone(s.InitrdFiles), func(file InitrdFile) bool {
+			return slices.ContainsFunc(other.InitrdFiles, func(override InitrdFile) bool {
+				return override.Path == file.Path
+			})
+		})
+
+		s.InitrdFiles = append(s.InitrdFiles, other.InitrdFiles...)
+	}
+
+	if len(other.Vars) > 0 {
+		s.Vars = maps.Clone(s.Vars)
+		if s.Vars == nil {
+			s.Vars = make(map[string]any, len(other.Vars))
+		}
+
+		maps.Copy(s.Vars, other.Vars)
+	}
+}
+
+// Profile is a named set of settings shared by a group of hosts, e.g. a rack or lab
+type Profile struct {
+	Name string
+
+	// Name of a profile whose settings this profile extends
+	Inherit string
+
+	Settings `mapstructure:",squash"`
+}
+
+// Config describes a host, or a range of hosts, and what they should boot. Clients are
+// matched by MAC address first, then SMBIOS UUID, then the most specific CIDR containing
+// their IP address.
+type Config struct {
+	// Name of the host, used in logs and URLs
+	Name string `json:"name"`
+
+	// MAC address of the host's boot interface
+	MAC string `json:"mac,omitempty"`
+
+	// SMBIOS system UUID of the host, as shown by dmidecode
+	UUID string `json:"uuid,omitempty"`
+
+	// Range of IP addresses that this config applies to, e.g. '10.0.1.0/24'. Together
+	// with a profile, this allows a group of hosts to be configured at once.
+	CIDR string `json:"cidr,omitempty"`
+
+	// Name of a profile to take settings from. Settings given on the host override
+	// those of the profile.
+	Profile string `json:"profile,omitempty"`
+
+	Settings `mapstructure:",squash"`
+}
+
+// Host is a validated host config, with its profile's settings applied
+type Host struct {
+	Name string
+
+	// Name of the profile that the host's settings were taken from, if any
+	Profile string
+
+	Distro string
+
+	// Layers of kernel arguments, from the root profile down to the host itself. These
+	// are kept separate so that each layer can override or remove arguments (see
+	// [cmdline.Merge]). Arguments mounting a network root come first.
+	ArgLayers [][]string
+
+	Automation     string
+	Vars           map[string]any
+	LocalBootFirst bool
+
+	// Title of the menu entry booted by default, if the host overrides the menu's default
+	MenuDefault string
+
+	// Name of the GRUB profile that the host boots with, if not the default
+	GrubProfile string
+
+	// Root file system mounted over the network, if the host is diskless
+	Root *netroot.Config
+
+	// Baseboard management controller of the host, if it has one
+	BMC *bmc.Config
+
+	// Files appended to the host's initrd
+	InitrdFiles []InitrdFile
+
+	mac    net.HardwareAddr
+	uuid   string
+	prefix netip.Prefix
+}
+
+// Table is a set of hosts that clients can be matched against
+type Table struct {
+	hosts  []*Host
+	byName map[string]*Host
+
+	// Host for clients that match no other, if there is a default profile
+	fallback *Host
+}
+
+// NewTable validates the given host configs and profiles, and creates a table from them.
+// If defaultProfile is not empty, clients that match no host are booted using that
+// profile.
+func NewTable(configs []Config, profiles []Profile, defaultProfile string) (*Table, error) {
+	resolved, err := resolveProfiles(profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &Table{byName: make(map[string]*Host, len(configs))}
+	macs := make(map[string]struct{})
+	uuids := make(map[string]struct{})
+
+	if defaultProfile != "" {
+		settings, ok := resolved[defaultProfile]
+		if !ok {
+			return nil, fmt.Errorf("default profile '%s': %w", defaultProfile, errUnknownProfile)
+		}
+
+		fallback, err := newHost(&Config{Name: DefaultHostName, Profile: defaultProfile}, settings)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default profile '%s': %w", defaultProfile, err)
+		}
+
+		table.fallback = fallback
+	}
+
+	for i := range configs {
+		if configs[i].Name == DefaultHostName {
+			return nil, fmt.Errorf("host '%s': %w", configs[i].Name, errReservedName)
+		}
+
+		settings := &Settings{}
+		if configs[i].Profile != "" {
+			profile, ok := resolved[configs[i].Profile]
+			if !ok {
+				return nil, fmt.Errorf("host '%s' uses profile '%s': %w", configs[i].Name, configs[i].Profile, errUnknownProfile)
+			}
+
+			settings.merge(profile)
+		}
+
+		settings.merge(&configs[i].Settings)
+
+		host, err := newHost(&configs[i], settings)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host '%s': %w", configs[i].Name, err)
+		}
+
+		if _, ok := table.byName[host.Name]; ok {
+			return nil, fmt.Errorf("host '%s': %w", host.Name, errDuplicateName)
+		}
+
+		if host.mac != nil {
+			if _, ok := macs[host.mac.String()]; ok {
+				return nil, fmt.Errorf("host '%s': %w", host.Name, errDuplicateMatch)
+			}
+
+			macs[host.mac.String()] = struct{}{}
+		}
+
+		if host.uuid != "" {
+			if _, ok := uuids[host.uuid]; ok {
+				return nil, fmt.Errorf("host '%s': %w", host.Name, errDuplicateMatch)
+			}
+
+			uuids[host.uuid] = struct{}{}
+		}
+
+		table.hosts = append(table.hosts, host)
+		table.byName[host.Name] = host
+	}
+
+	return table, nil
+}
+
+// resolveProfiles applies inheritance to profiles, returning the full settings of each
+func resolveProfiles(profiles []Profile) (map[string]*Settings, error) {
+	byName := make(map[string]*Profile, len(profiles))
+	for i := range profiles {
+		if profiles[i].Name == "" {
+			return nil, fmt.Errorf("invalid profile: %w", errNoName)
+		}
+
+		if _, ok := byName[profiles[i].Name]; ok {
+			return nil, fmt.Errorf("profile '%s': %w", profiles[i].Name, errDuplicateName)
+		}
+
+		byName[profiles[i].Name] = &profiles[i]
+	}
+
+	resolved := make(map[string]*Settings, len(profiles))
+
+	for name := range byName {
+		// Walk up to the root, then apply settings from the root down
+		var chain []*Profile
+		seen := make(map[string]struct{})
+
+		for current := name; current != ""; {
+			if _, ok := seen[current]; ok {
+				return nil, fmt.Errorf("profile '%s': %w", name, errProfileCycle)
+			}
+
+			seen[current] = struct{}{}
+
+			profile, ok := byName[current]
+			if !ok {
+				return nil, fmt.Errorf("profile '%s' inherits from '%s': %w", name, current, errUnknownProfile)
+			}
+
+			chain = append(chain, profile)
+			current = profile.Inherit
+		}
+
+		settings := &Settings{}
+		for i := len(chain) - 1; i >= 0; i-- {
+			settings.merge(&chain[i].Settings)
+		}
+
+		resolved[name] = settings
+	}
+
+	return resolved, nil
+}
+
+func newHost(config *Config, settings *Settings) (*Host, error) {
+	host := &Host{
+		Name:           config.Name,
+		Profile:        config.Profile,
+		Distro:         settings.Distro,
+		ArgLayers:      expandArgLayers(settings.argLayers, config.Name, settings.Vars),
+		Automation:     settings.Automation,
+		Vars:           settings.Vars,
+		LocalBootFirst: settings.LocalBootFirst != nil && *settings.LocalBootFirst,
+		MenuDefault:    settings.MenuDefault,
+		GrubProfile:    settings.GrubProfile,
+		Root:           settings.Root,
+		BMC:            settings.BMC,
+		InitrdFiles:    settings.InitrdFiles,
+	}
+
+	if config.Name == "" {
+		return nil, errNoName
+	}
+
+	if !validName(config.Name) {
+		return nil, errInvalidName
+	}
+
+	if config.MAC == "" && config.UUID == "" && config.CIDR == "" && config.Name != DefaultHostName {
+		return nil, errNoMatchers
+	}
+
+	if host.Distro == "" && !host.LocalBootFirst {
+		return nil, errNoDistro
+	}
+
+	if host.Root != nil {
+		if err := host.Root.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid root: %w", err)
+		}
+
+		host.ArgLayers = append([][]string{host.Root.Args(host.Name)}, host.ArgLayers...)
+	}
+
+	if host.BMC != nil {
+		if err := host.BMC.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid BMC: %w", err)
+		}
+	}
+
+	for i := range host.InitrdFiles {
+		if err := host.InitrdFiles[i].validate(); err != nil {
+			return nil, fmt.Errorf("invalid initrd file: %w", err)
+		}
+	}
+
+	if config.MAC != "" {
+		mac, err := net.ParseMAC(config.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse MAC address: %w", err)
+		}
+
+		host.mac = mac
+	}
+
+	if config.UUID != "" {
+		uuid := strings.ToLower(config.UUID)
+		if len(uuid) != 36 || strings.Trim(uuid, "0123456789abcdef-") != "" {
+			return nil, fmt.Errorf("'%s': %w", config.UUID, errInvalidUUID)
+		}
+
+		host.uuid = uuid
+	}
+
+	if config.CIDR != "" {
+		prefix, err := netip.ParsePrefix(config.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CIDR: %w", err)
+		}
+
+		host.prefix = prefix.Masked()
+	}
+
+	return host, nil
+}
+
+// expandArgLayers replaces the placeholders for the host's name and variables in its
+// kernel arguments. Placeholders of unknown variables are left as they are.
+func expandArgLayers(layers [][]string, name string, vars map[string]any) [][]string {
+	replacements := []string{namePlaceholder, name}
+	for key, value := range vars {
+		replacements = append(replacements, "{vars."+key+"}", fmt.Sprint(value))
+	}
+
+	replacer := strings.NewReplacer(replacements...)
+
+	expanded := make([][]string, len(layers))
+	for i, layer := range layers {
+		expanded[i] = make([]string, len(layer))
+		for j, arg := range layer {
+			expanded[i][j] = replacer.Replace(arg)
+		}
+	}
+
+	return expanded
+}
+
+// validName returns whether a host name is safe to use in URLs and file names
+func validName(name string) bool {
+	return name != "" && strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") == ""
+}
+
+// Match returns the host config for the client with the given MAC address, UUID, and IP
+// address, any of which may be empty. If no host matches, the default host is returned,
+// or nil if there is no default profile.
+func (t *Table) Match(mac net.HardwareAddr, uuid string, ip net.IP) *Host {
+	if t == nil {
+		return nil
+	}
+
+	if host := t.match(mac, uuid, ip); host != nil {
+		return host
+	}
+
+	return t.fallback
+}
+
+func (t *Table) match(mac net.HardwareAddr, uuid string, ip net.IP) *Host {
+	if mac != nil {
+		for _, host := range t.hosts {
+			if host.mac != nil && host.mac.String() == mac.String() {
+				return host
+			}
+		}
+	}
+
+	if uuid != "" {
+		for _, host := range t.hosts {
+			if host.uuid != "" && host.uuid == strings.ToLower(uuid) {
+				return host
+			}
+		}
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil
+	}
+
+	var best *Host
+	for _, host := range t.hosts {
+		if !host.prefix.IsValid() || !host.prefix.Contains(addr.Unmap()) {
+			continue
+		}
+
+		if best == nil || host.prefix.Bits() > best.prefix.Bits() {
+			best = host
+		}
+	}
+
+	return best
+}
+
+// MAC returns the MAC address that the host is matched by, if any
+func (h *Host) MAC() net.HardwareAddr {
+	return h.mac
+}
+
+// UUID returns the SMBIOS UUID that the host is matched by, if any
+func (h *Host) UUID() string {
+	return h.uuid
+}
+
+// CIDR returns the range of IP addresses that the host is matched by, if any
+func (h *Host) CIDR() (netip.Prefix, bool) {
+	return h.prefix, h.prefix.IsValid()
+}
+
+// Get returns the host with the given name
+func (t *Table) Get(name string) (*Host, bool) {
+	if t == nil {
+		return nil, false
+	}
+
+	if name == DefaultHostName && t.fallback != nil {
+		return t.fallback, true
+	}
+
+	host, ok := t.byName[name]
+	return host, ok
+}
+
+// Hosts returns all hosts in the table, including the default host if there is one
+func (t *Table) Hosts() []*Host {
+	if t == nil {
+		return nil
+	}
+
+	if t.fallback != nil {
+		return append(slices.Clone(t.hosts), t.fallback)
+	}
+
+	return t.hosts
+}
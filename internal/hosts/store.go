@@ -0,0 +1,190 @@
+package hosts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/davejbax/pixie/internal/atomicfile"
+	"github.com/davejbax/pixie/internal/store"
+)
+
+// Store holds host configs created at runtime (e.g. through the API) rather than in the
+// config file, persisting them to a JSON file or the state database so that they survive
+// restarts
+type Store struct {
+	path string
+	db   *store.DB
+
+	mu      sync.Mutex
+	configs map[string]Config
+}
+
+// OpenStore loads the store at the given path, creating an empty store if it doesn't
+// exist
+func OpenStore(path string) (*Store, error) {
+	store := &Store{
+		path:    path,
+		configs: make(map[string]Config),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read hosts: %w", err)
+	}
+
+	var configs []Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to decode hosts: %w", err)
+	}
+
+	for _, config := range configs {
+		store.configs[config.Name] = config
+	}
+
+	return store, nil
+}
+
+// OpenDBStore loads the store from the state database
+func OpenDBStore(db *store.DB) (*Store, error) {
+	stored, err := db.HostConfigs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hosts: %w", err)
+	}
+
+	s := &Store{
+		db:      db,
+		configs: make(map[string]Config, len(stored)),
+	}
+
+	for name, data := range stored {
+		var config Config
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to decode host '%s': %w", name, err)
+		}
+
+		s.configs[name] = config
+	}
+
+	return s, nil
+}
+
+// Reload replaces the configs in memory with those persisted, e.g. after another process
+// (such as the CLI) has changed them
+func (s *Store) Reload() error {
+	var (
+		fresh *Store
+		err   error
+	)
+
+	if s.db != nil {
+		fresh, err = OpenDBStore(s.db)
+	} else {
+		fresh, err = OpenStore(s.path)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.configs = fresh.configs
+
+	return nil
+}
+
+// Get returns the config of the host with the given name, if it is in the store
+func (s *Store) Get(name string) (Config, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, ok := s.configs[name]
+	return config, ok
+}
+
+// Configs returns all host configs in the store, sorted by name
+func (s *Store) Configs() []Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sorted()
+}
+
+// Put adds a host config to the store, replacing any with the same name
+func (s *Store) Put(config Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.configs[config.Name] = config
+
+	if s.db != nil {
+		data, err := json.Marshal(config)
+		if err != nil {
+			return fmt.Errorf("failed to encode host: %w", err)
+		}
+
+		return s.db.PutHostConfig(config.Name, data) //nolint:wrapcheck
+	}
+
+	return s.save()
+}
+
+// Delete removes the host with the given name from the store
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.configs[name]; !ok {
+		return nil
+	}
+
+	delete(s.configs, name)
+
+	if s.db != nil {
+		return s.db.DeleteHostConfig(name) //nolint:wrapcheck
+	}
+
+	return s.save()
+}
+
+// sorted returns the configs sorted by name. The caller must hold the lock.
+func (s *Store) sorted() []Config {
+	configs := make([]Config, 0, len(s.configs))
+	for _, config := range s.configs {
+		configs = append(configs, config)
+	}
+
+	slices.SortFunc(configs, func(a, b Config) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return configs
+}
+
+// save writes the store to disk. The caller must hold the lock.
+func (s *Store) save() error {
+	data, err := json.Marshal(s.sorted())
+	if err != nil {
+		return fmt.Errorf("failed to encode hosts: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create hosts directory: %w", err)
+	}
+
+	if err := atomicfile.Write(s.path, data); err != nil {
+		return fmt.Errorf("failed to write hosts: %w", err)
+	}
+
+	return nil
+}
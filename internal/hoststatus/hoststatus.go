@@ -0,0 +1,180 @@
+// Package hoststatus records the results of installs, as reported by hosts phoning home
+// from their install automation (e.g. a kickstart %post section)
+package hoststatus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/davejbax/pixie/internal/atomicfile"
+	"github.com/davejbax/pixie/internal/store"
+)
+
+var errInvalidStatus = errors.New("invalid status, expected 'success', 'failure' or 'running'")
+
+// Status is the state of a host's install
+type Status string
+
+const (
+	StatusRunning Status = "running"
+	StatusSuccess Status = "success"
+	StatusFailure Status = "failure"
+)
+
+// ParseStatus parses a reported status
+func ParseStatus(s string) (Status, error) {
+	switch status := Status(s); status {
+	case StatusRunning, StatusSuccess, StatusFailure:
+		return status, nil
+	default:
+		return "", fmt.Errorf("'%s': %w", s, errInvalidStatus)
+	}
+}
+
+// Report is the latest status reported by a host
+type Report struct {
+	Host    string `json:"host"`
+	Status  Status `json:"status"`
+	Message string `json:"message,omitempty"`
+
+	// Address that the report came from
+	Client string `json:"client,omitempty"`
+
+	Time time.Time `json:"time"`
+}
+
+// Store holds the latest report from each host, persisting them to a JSON file or the
+// state database so that they survive restarts
+type Store struct {
+	path string
+	db   *store.DB
+
+	mu      sync.Mutex
+	reports map[string]*Report
+}
+
+// Open loads the store at the given path, creating an empty store if it doesn't exist
+func Open(path string) (*Store, error) {
+	store := &Store{
+		path:    path,
+		reports: make(map[string]*Report),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read host status reports: %w", err)
+	}
+
+	var reports []*Report
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return nil, fmt.Errorf("failed to decode host status reports: %w", err)
+	}
+
+	for _, report := range reports {
+		store.reports[report.Host] = report
+	}
+
+	return store, nil
+}
+
+// OpenDB loads the store from the state database
+func OpenDB(db *store.DB) (*Store, error) {
+	stored, err := db.HostStatuses()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load host status reports: %w", err)
+	}
+
+	s := &Store{
+		db:      db,
+		reports: make(map[string]*Report, len(stored)),
+	}
+
+	for _, status := range stored {
+		s.reports[status.Host] = &Report{
+			Host:    status.Host,
+			Status:  Status(status.Status),
+			Message: status.Message,
+			Client:  status.Client,
+			Time:    status.Time,
+		}
+	}
+
+	return s, nil
+}
+
+// Get returns the latest report from the host, if it has made one
+func (s *Store) Get(host string) (Report, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report, ok := s.reports[host]
+	if !ok {
+		return Report{}, false
+	}
+
+	return *report, true
+}
+
+// Reports returns the latest report from every host that has made one
+func (s *Store) Reports() []Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reports := make([]Report, 0, len(s.reports))
+	for _, report := range s.reports {
+		reports = append(reports, *report)
+	}
+
+	return reports
+}
+
+// Record stores a report, replacing the host's previous one
+func (s *Store) Record(report Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reports[report.Host] = &report
+
+	if s.db != nil {
+		return s.db.PutHostStatus(&store.HostStatus{ //nolint:wrapcheck
+			Host:    report.Host,
+			Status:  string(report.Status),
+			Message: report.Message,
+			Client:  report.Client,
+			Time:    report.Time,
+		})
+	}
+
+	return s.save()
+}
+
+// save writes the store to disk. The caller must hold the lock.
+func (s *Store) save() error {
+	reports := make([]*Report, 0, len(s.reports))
+	for _, report := range s.reports {
+		reports = append(reports, report)
+	}
+
+	data, err := json.Marshal(reports)
+	if err != nil {
+		return fmt.Errorf("failed to encode host status reports: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create host status directory: %w", err)
+	}
+
+	if err := atomicfile.Write(s.path, data); err != nil {
+		return fmt.Errorf("failed to write host status reports: %w", err)
+	}
+
+	return nil
+}
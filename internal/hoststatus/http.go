@@ -0,0 +1,132 @@
+package hoststatus
+
+import (
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// Path is the API path of a host's status. GET returns the latest report.
+	Path = "/api/hosts/{name}/status"
+
+	// ReportPath is POSTed to by hosts with 'status' and an optional 'message', given as
+	// form values, query parameters, or a JSON object. The token is signed for the host,
+	// so that other clients can't report on its behalf.
+	ReportPath = Path + "/{token}"
+
+	// ListPath is the API path listing the latest report from every host
+	ListPath = "/api/status"
+)
+
+// maxReportSize limits the size of report bodies, since they come from unauthenticated
+// clients
+const maxReportSize = 64 * 1024
+
+// Handler serves the host status API. known reports whether a host with the given name
+// exists, and onReport, if not nil, is called with each report once it is recorded.
+func Handler(logger *slog.Logger, store *Store, known func(name string) bool, onReport func(report *Report) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !known(name) {
+			http.Error(w, "unknown host", http.StatusNotFound)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			report, ok := store.Get(name)
+			if !ok {
+				http.Error(w, "host has not reported a status", http.StatusNotFound)
+				return
+			}
+
+			writeJSON(w, report)
+			return
+		}
+
+		report, err := parseReport(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		report.Host = name
+		report.Client = r.RemoteAddr
+		report.Time = time.Now().UTC()
+
+		if err := store.Record(*report); err != nil {
+			logger.Error("failed to record host status",
+				"host", name,
+				"error", err,
+			)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("host reported install status",
+			"host", name,
+			"status", report.Status,
+			"message", report.Message,
+			"client", r.RemoteAddr,
+		)
+
+		if onReport != nil {
+			if err := onReport(report); err != nil {
+				logger.Error("failed to handle host status report",
+					"host", name,
+					"error", err,
+				)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ListHandler serves the latest report from every host, sorted by host name
+func ListHandler(store *Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		reports := store.Reports()
+		slices.SortFunc(reports, func(a, b Report) int {
+			return strings.Compare(a.Host, b.Host)
+		})
+
+		writeJSON(w, reports)
+	})
+}
+
+func parseReport(w http.ResponseWriter, r *http.Request) (*Report, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxReportSize)
+
+	var body struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+	} else {
+		body.Status = r.FormValue("status")
+		body.Message = r.FormValue("message")
+	}
+
+	status, err := ParseStatus(body.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Report{Status: status, Message: body.Message}, nil
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
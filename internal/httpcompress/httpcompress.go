@@ -0,0 +1,264 @@
+// Package httpcompress compresses HTTP responses with gzip or zstd for clients that
+// accept it, which speeds up transfers over slow links such as out-of-band management
+// networks
+package httpcompress
+
+import (
+	"cmp"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+var errUnknownEncoding = errors.New("unknown content encoding")
+
+// File extensions of pre-compressed variants of files, by encoding
+var extensions = map[string]string{
+	EncodingGzip: ".gz",
+	EncodingZstd: ".zst",
+}
+
+// Media types compressed on the fly, besides 'text/*'. Kernels, initrds and EFI images
+// are mostly compressed already, so they're only served compressed from pre-compressed
+// variants.
+var compressibleTypes = []string{
+	"application/json",
+	"application/xml",
+	"application/yaml",
+	"application/x-sh",
+	"application/x-shellscript",
+}
+
+type Config struct {
+	// Whether to compress generated bootloader configs, install automation files,
+	// scripts and other text responses, for clients that accept it
+	Enabled bool
+
+	// Encodings to use, most preferred first: 'zstd' and/or 'gzip'. Clients' own
+	// preferences, given by quality values in Accept-Encoding, take precedence.
+	Encodings []string `default:"[\"zstd\", \"gzip\"]"`
+
+	// Responses smaller than this many bytes are sent uncompressed
+	MinSize int `mapstructure:"min_size" default:"1024"`
+
+	// Whether to serve pre-compressed variants of files (e.g. 'initrd.img.zst' or
+	// 'image.iso.gz' alongside 'image.iso' in a static directory) in their place, to
+	// clients that accept the encoding. This applies even if Enabled is false.
+	Precompressed bool
+}
+
+// Compressor negotiates encodings with clients and compresses responses. A nil
+// compressor compresses nothing.
+type Compressor struct {
+	encodings     []string
+	minSize       int
+	onTheFly      bool
+	precompressed bool
+}
+
+// New creates a compressor. It returns nil if neither compression on the fly nor
+// pre-compressed variants are enabled.
+func New(config *Config) (*Compressor, error) {
+	if !config.Enabled && !config.Precompressed {
+		return nil, nil //nolint:nilnil
+	}
+
+	for _, encoding := range config.Encodings {
+		if _, ok := extensions[encoding]; !ok {
+			return nil, fmt.Errorf("'%s': %w", encoding, errUnknownEncoding)
+		}
+	}
+
+	return &Compressor{
+		encodings:     config.Encodings,
+		minSize:       config.MinSize,
+		onTheFly:      config.Enabled,
+		precompressed: config.Precompressed,
+	}, nil
+}
+
+// Negotiate returns the configured encodings that the request accepts, in order of the
+// client's preference and then the configured order. Encodings that the client doesn't
+// name (or refuses with 'q=0') are omitted, unless accepted by a '*' wildcard.
+func (c *Compressor) Negotiate(r *http.Request) []string {
+	if c == nil {
+		return nil
+	}
+
+	header := strings.Join(r.Header.Values("Accept-Encoding"), ",")
+	if header == "" {
+		return nil
+	}
+
+	qualities := make(map[string]float64)
+
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+
+		quality := 1.0
+
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		qualities[strings.ToLower(strings.TrimSpace(name))] = quality
+	}
+
+	accepted := []string{}
+
+	for _, encoding := range c.encodings {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+
+		if ok && quality > 0 {
+			accepted = append(accepted, encoding)
+		}
+	}
+
+	// Sorting is stable, so equally preferred encodings keep the configured order
+	slices.SortStableFunc(accepted, func(a string, b string) int {
+		return cmp.Compare(qualityOf(qualities, b), qualityOf(qualities, a))
+	})
+
+	return accepted
+}
+
+// qualityOf returns the client's preference for the encoding, as given by name or by
+// wildcard
+func qualityOf(qualities map[string]float64, encoding string) float64 {
+	if quality, ok := qualities[encoding]; ok {
+		return quality
+	}
+
+	return qualities["*"]
+}
+
+// Precompressed returns the encodings of pre-compressed variants that may be served in
+// place of a file for the request, most preferred first, or nil if pre-compressed
+// variants aren't enabled
+func (c *Compressor) Precompressed(r *http.Request) []string {
+	if c == nil || !c.precompressed || r.Method != http.MethodGet {
+		return nil
+	}
+
+	return c.Negotiate(r)
+}
+
+// Varies returns whether responses for files may be pre-compressed variants, and so
+// depend on the request's Accept-Encoding
+func (c *Compressor) Varies() bool {
+	return c != nil && c.precompressed
+}
+
+// Extension returns the file extension of pre-compressed variants in the encoding
+func Extension(encoding string) string {
+	return extensions[encoding]
+}
+
+// SetEncoding sets the headers of a response whose body is in the given encoding, such
+// as a pre-compressed variant of the file at requestPath. The content type is that of
+// the uncompressed file, and the ETag (if any) is changed so that it doesn't match that
+// of the uncompressed file.
+func SetEncoding(header http.Header, requestPath string, encoding string) {
+	header.Set("Content-Encoding", encoding)
+	addVary(header)
+
+	if header.Get("Content-Type") == "" {
+		contentType := mime.TypeByExtension(path.Ext(requestPath))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		header.Set("Content-Type", contentType)
+	}
+
+	if etag := header.Get("ETag"); strings.HasSuffix(etag, `"`) {
+		header.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+encoding+`"`)
+	}
+}
+
+// addVary marks a response as depending on the request's Accept-Encoding
+func addVary(header http.Header) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Accept-Encoding") {
+				return
+			}
+		}
+	}
+
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// Middleware compresses text responses of next for clients that accept it. Responses
+// that are already encoded, partial, or not successful are sent as they are.
+func (c *Compressor) Middleware(next http.Handler) http.Handler {
+	if c == nil || !c.onTheFly {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings := c.Negotiate(r)
+		if len(encodings) == 0 || r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		writer := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encodings[0],
+			minSize:        c.minSize,
+			status:         http.StatusOK,
+		}
+		defer writer.close()
+
+		next.ServeHTTP(writer, r)
+	})
+}
+
+// compressible returns whether the response's content is worth compressing, by its
+// media type
+func compressible(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") || slices.Contains(compressibleTypes, mediaType)
+}
+
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingZstd:
+		encoder, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+
+		return encoder, nil
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("'%s': %w", encoding, errUnknownEncoding)
+	}
+}
@@ -0,0 +1,172 @@
+package httpcompress
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+type writerMode int
+
+const (
+	// The body is buffered until it's known whether it's worth compressing
+	modeUndecided writerMode = iota
+	modeIdentity
+	modeCompressed
+)
+
+// compressWriter compresses a response as it's written, if its headers show that it's
+// compressible. Bodies of unknown length are buffered until they reach the minimum size,
+// so that small responses are sent as they are.
+type compressWriter struct {
+	http.ResponseWriter
+
+	encoding string
+	minSize  int
+
+	mode        writerMode
+	status      int
+	wroteHeader bool
+	checked     bool
+	buffered    []byte
+	encoder     io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.status = status
+	w.wroteHeader = true
+
+	// Handlers that set the content type before the status (such as those serving files)
+	// can be checked straight away, so that files that aren't compressed keep using
+	// sendfile. Otherwise the type is sniffed from the body once it's written.
+	if status != http.StatusOK || w.Header().Get("Content-Type") != "" {
+		w.check(nil)
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.checked {
+		w.check(data)
+	}
+
+	switch w.mode {
+	case modeIdentity:
+		return w.ResponseWriter.Write(data) //nolint:wrapcheck
+	case modeCompressed:
+		return w.encoder.Write(data) //nolint:wrapcheck
+	}
+
+	w.buffered = append(w.buffered, data...)
+	if len(w.buffered) >= w.minSize {
+		if err := w.start(modeCompressed); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+// ReadFrom copies with the underlying writer if the response isn't compressed, so that
+// files are still sent with sendfile where possible
+func (w *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.mode == modeIdentity {
+		return io.Copy(w.ResponseWriter, src) //nolint:wrapcheck
+	}
+
+	return io.Copy(writerOnly{w}, src) //nolint:wrapcheck
+}
+
+// Unwrap lets [http.ResponseController] reach the underlying writer
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// check decides whether to compress the response from its status and headers, sniffing
+// the content type from the start of the body if the handler hasn't set one
+func (w *compressWriter) check(data []byte) {
+	w.checked = true
+
+	header := w.Header()
+
+	if header.Get("Content-Type") == "" && len(data) > 0 {
+		header.Set("Content-Type", http.DetectContentType(data))
+	}
+
+	if w.status != http.StatusOK || header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" || !compressible(header) {
+		_ = w.start(modeIdentity)
+		return
+	}
+
+	addVary(header)
+
+	if length := header.Get("Content-Length"); length != "" {
+		mode := modeCompressed
+		if size, err := strconv.Atoi(length); err == nil && size < w.minSize {
+			mode = modeIdentity
+		}
+
+		_ = w.start(mode)
+	}
+}
+
+// start writes the headers for the mode, followed by any buffered body
+func (w *compressWriter) start(mode writerMode) error {
+	w.mode = mode
+
+	if mode == modeCompressed {
+		header := w.Header()
+		header.Del("Content-Length")
+		SetEncoding(header, "", w.encoding)
+
+		encoder, err := newEncoder(w.encoding, w.ResponseWriter)
+		if err != nil {
+			// Nothing has been sent yet, so the response can still go uncompressed
+			header.Del("Content-Encoding")
+			w.mode = modeIdentity
+		} else {
+			w.encoder = encoder
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if len(w.buffered) == 0 {
+		return nil
+	}
+
+	buffered := w.buffered
+	w.buffered = nil
+
+	var err error
+	if w.mode == modeCompressed {
+		_, err = w.encoder.Write(buffered)
+	} else {
+		_, err = w.ResponseWriter.Write(buffered)
+	}
+
+	return err //nolint:wrapcheck
+}
+
+// close sends what remains of the response once the handler has returned
+func (w *compressWriter) close() {
+	switch w.mode {
+	case modeUndecided:
+		_ = w.start(modeIdentity)
+	case modeCompressed:
+		_ = w.encoder.Close()
+	case modeIdentity:
+	}
+}
+
+// writerOnly hides a writer's ReadFrom method, so that [io.Copy] doesn't call it again
+type writerOnly struct {
+	io.Writer
+}
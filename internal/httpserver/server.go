@@ -0,0 +1,204 @@
+// Package httpserver implements the HTTP server that pixie uses to serve installer
+// files, generated install scripts, and utility endpoints to clients
+package httpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/davejbax/pixie/internal/drain"
+	"github.com/davejbax/pixie/internal/httpcompress"
+	"github.com/davejbax/pixie/internal/limiter"
+	"github.com/davejbax/pixie/internal/sockets"
+	"golang.org/x/sync/errgroup"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+type Config struct {
+	Address string `default:":8080"`
+
+	// Network interface to bind the HTTP and HTTPS listeners to, e.g. a VLAN interface, so
+	// that only its clients are served. Only supported on Linux.
+	Interface string
+
+	// Base URL at which clients can reach the server, e.g. 'http://pixie.example.com:8080'.
+	// This is used in generated files that refer back to pixie. If empty, it is derived
+	// from the host of each request.
+	PublicURL string `mapstructure:"public_url"`
+
+	// HTTPS, for UEFI HTTPS Boot and the management API
+	TLS TLSConfig `mapstructure:"tls"`
+
+	// Maximum number of file downloads in progress at once. Further downloads are
+	// queued, taking turns between clients. Zero means no limit.
+	MaxTransfers int `mapstructure:"max_transfers" default:"128"`
+
+	// Maximum number of downloads to queue when MaxTransfers are in progress. Further
+	// downloads are refused with '503 Service Unavailable'.
+	MaxQueued int `mapstructure:"max_queued" default:"512"`
+
+	// How long a download may wait in the queue before it is refused
+	QueueTimeout time.Duration `mapstructure:"queue_timeout" default:"30s"`
+
+	// Compression of responses for clients that accept it
+	Compression httpcompress.Config `mapstructure:"compression"`
+}
+
+type Server struct {
+	logger    *slog.Logger
+	config    *Config
+	mux       *http.ServeMux
+	transfers *limiter.Limiter
+
+	// Downloads in progress, which are let finish on shutdown
+	inflight *drain.Tracker
+}
+
+// NewServer creates a server. Downloads are tracked by the given drain tracker, which
+// may be nil.
+func NewServer(logger *slog.Logger, config *Config, inflight *drain.Tracker) *Server {
+	mux := http.NewServeMux()
+
+	if config.TLS.CAFile != "" {
+		mux.Handle("GET "+CACertPath, caCertHandler(logger, config.TLS.CAFile, false))
+		mux.Handle("GET "+CACertDERPath, caCertHandler(logger, config.TLS.CAFile, true))
+	}
+
+	return &Server{
+		logger:    logger,
+		config:    config,
+		mux:       mux,
+		transfers: limiter.New(config.MaxTransfers, config.MaxQueued, config.QueueTimeout),
+		inflight:  inflight,
+	}
+}
+
+// LimitTransfers limits the number of requests handled by the handler at once, for
+// handlers serving large files. All handlers limited by a server share its limit. The
+// requests are tracked as downloads, so that they're let finish on shutdown.
+func (s *Server) LimitTransfers(handler http.Handler) http.Handler {
+	return s.transfers.Middleware(s.inflight.Middleware(handler))
+}
+
+// Transfers returns the limiter of file downloads in progress, which is nil if
+// downloads aren't limited
+func (s *Server) Transfers() *limiter.Limiter {
+	return s.transfers
+}
+
+// Handle registers a handler for the given pattern, as with [http.ServeMux.Handle]
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// BaseURL returns the URL that clients should use to reach the server, for the given
+// request. Requests made over HTTPS get an HTTPS URL, unless a public URL is configured.
+func (s *Server) BaseURL(r *http.Request) string {
+	if s.config.PublicURL != "" {
+		return strings.TrimSuffix(s.config.PublicURL, "/")
+	}
+
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+
+	return "http://" + r.Host
+}
+
+// ListenAndServe listens on the configured address, and the HTTPS address if TLS is
+// configured, and serves requests until the context is cancelled, at which point
+// in-flight requests are given a short time to complete (or the drain timeout, for
+// downloads)
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	var certs *certificates
+	if s.config.TLS.Enabled() {
+		var err error
+		if certs, err = newCertificates(s.logger, &s.config.TLS); err != nil {
+			return err
+		}
+	}
+
+	listener, err := sockets.Listen("tcp", s.config.Address, s.config.Interface)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	var tlsListener net.Listener
+	if certs != nil {
+		if tlsListener, err = sockets.Listen("tcp", s.config.TLS.Address, s.config.Interface); err != nil {
+			_ = listener.Close()
+			return err //nolint:wrapcheck
+		}
+	}
+
+	// If either server fails, the other is shut down
+	eg, ctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		return s.serve(ctx, listener, nil)
+	})
+
+	if tlsListener != nil {
+		eg.Go(func() error {
+			return s.serve(ctx, tlsListener, &tls.Config{
+				MinVersion:         tls.VersionTLS12,
+				GetConfigForClient: certs.configForClient,
+			})
+		})
+	}
+
+	return eg.Wait() //nolint:wrapcheck
+}
+
+// serve serves requests on the listener until the context is cancelled, using TLS if
+// tlsConfig is non-nil
+func (s *Server) serve(ctx context.Context, listener net.Listener, tlsConfig *tls.Config) error {
+	server := &http.Server{
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+		TLSConfig:         tlsConfig,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), max(shutdownTimeout, s.inflight.Timeout()))
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			s.logger.Warn("failed to shut down HTTP server gracefully",
+				"error", err,
+			)
+		}
+	}()
+
+	s.logger.Info("HTTP server listening",
+		"address", listener.Addr().String(),
+		"tls", tlsConfig != nil,
+	)
+
+	if tlsConfig != nil {
+		// The certificate comes from the TLS config, so no files are given here
+		err := server.ServeTLS(listener, "", "")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("HTTPS server failed: %w", err)
+		}
+
+		return nil
+	}
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("HTTP server failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// CACertPath serves the CA certificate configured for the server in PEM format
+	CACertPath = "/.well-known/pixie/ca.pem"
+
+	// CACertDERPath serves the CA certificate in DER format, which is what firmware
+	// setup menus usually expect when enrolling a certificate
+	CACertDERPath = "/.well-known/pixie/ca.cer"
+)
+
+// How often certificate files are checked for changes, at most
+const certCheckInterval = 10 * time.Second
+
+var (
+	errNoKeyFile      = errors.New("a key file must be given with the certificate file")
+	errNoCertificates = errors.New("no PEM certificates found")
+)
+
+type TLSConfig struct {
+	// Address to serve HTTPS on. HTTPS is only served if a certificate is given, and
+	// plain HTTP continues to be served on the main address for clients (such as GRUB)
+	// that can't use HTTPS.
+	Address string `default:":8443"`
+
+	// PEM certificate chain and private key to serve HTTPS with. They are reloaded when
+	// the files change, so that renewed certificates are used without a restart.
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+
+	// PEM bundle of CA certificates that client certificates are verified against.
+	// Clients that present no certificate are still served, except by handlers that
+	// require one, such as the management API if configured to.
+	ClientCAFile string `mapstructure:"client_ca_file"`
+
+	// PEM CA certificate to serve at CACertPath, so that it can be enrolled into
+	// client firmware for UEFI HTTPS Boot
+	CAFile string `mapstructure:"ca_file"`
+}
+
+// Enabled returns whether HTTPS is configured
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// certificates provides the TLS config for each connection, reloading the certificate
+// and client CAs when their files change. If reloading fails, the previous files stay
+// in use.
+type certificates struct {
+	logger *slog.Logger
+	config *TLSConfig
+
+	mu       sync.Mutex
+	current  *tls.Config
+	versions map[string]fileVersion
+	checked  time.Time
+}
+
+// fileVersion identifies a version of a file, to detect changes
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func newCertificates(logger *slog.Logger, config *TLSConfig) (*certificates, error) {
+	if config.KeyFile == "" {
+		return nil, errNoKeyFile
+	}
+
+	c := &certificates{
+		logger: logger,
+		config: config,
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// files returns the files that the TLS config is loaded from
+func (c *certificates) files() []string {
+	files := []string{c.config.CertFile, c.config.KeyFile}
+	if c.config.ClientCAFile != "" {
+		files = append(files, c.config.ClientCAFile)
+	}
+
+	return files
+}
+
+func (c *certificates) load() error {
+	versions := make(map[string]fileVersion)
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to stat TLS file: %w", err)
+		}
+
+		versions[file] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		// UEFI HTTPS Boot supports TLS 1.2, so nothing older is needed
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+	}
+
+	if c.config.ClientCAFile != "" {
+		data, err := os.ReadFile(c.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("invalid client CA file '%s': %w", c.config.ClientCAFile, errNoCertificates)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	c.current = config
+	c.versions = versions
+
+	return nil
+}
+
+// changed returns whether any of the files have changed since they were loaded
+func (c *certificates) changed() bool {
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// Files may briefly be missing while being replaced, so this is only a
+			// change once they reappear
+			continue
+		}
+
+		if version := (fileVersion{modTime: info.ModTime(), size: info.Size()}); version != c.versions[file] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// configForClient returns the TLS config to use for a connection, for
+// [tls.Config.GetConfigForClient]
+func (c *certificates) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+
+		if c.changed() {
+			if err := c.load(); err != nil {
+				c.logger.Error("failed to reload TLS certificate, keeping the previous certificate",
+					"error", err,
+				)
+			} else {
+				c.logger.Info("reloaded TLS certificate")
+			}
+		}
+	}
+
+	return c.current, nil
+}
+
+// RequireClientCertificate rejects requests that weren't made over TLS with a client
+// certificate verified against the client CAs
+func RequireClientCertificate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// caCertHandler serves the CA certificate file, in DER format if der is true. The file
+// is read for each request, so that it can be replaced without a restart.
+func caCertHandler(logger *slog.Logger, path string, der bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logger.Error("failed to read CA certificate",
+				"path", path,
+				"error", err,
+			)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !der {
+			w.Header().Set("Content-Type", "application/x-pem-file")
+			_, _ = w.Write(data)
+			return
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			logger.Error("CA certificate file contains no PEM certificate",
+				"path", path,
+			)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/pkix-cert")
+		_, _ = w.Write(block.Bytes)
+	})
+}
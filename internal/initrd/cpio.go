@@ -0,0 +1,240 @@
+package initrd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Magic at the start of each header in a 'newc' cpio archive, the only format that
+	// Linux unpacks into its initramfs. The CRC variant ends in '2'.
+	cpioMagic    = "07070"
+	cpioTrailer  = "TRAILER!!!"
+	headerLength = 110
+
+	// Longest name accepted when reading an archive, which is PATH_MAX in Linux
+	maxNameSize = 4096
+
+	// Modes in cpio headers, which are the traditional Unix ones
+	modeDir     = 0o040000
+	modeRegular = 0o100000
+	modeSymlink = 0o120000
+)
+
+var (
+	errInvalidCPIO         = errors.New("invalid cpio archive")
+	errUnsupportedFileType = errors.New("only directories, regular files and symlinks can be packed")
+)
+
+// cpioWriter writes a 'newc' cpio archive
+type cpioWriter struct {
+	w     io.Writer
+	inode int64
+
+	// Bytes written so far, to pad entries to four bytes
+	written int64
+}
+
+func (c *cpioWriter) write(data []byte) error {
+	n, err := c.w.Write(data)
+	c.written += int64(n)
+
+	return err //nolint:wrapcheck
+}
+
+func (c *cpioWriter) pad() error {
+	return c.write(make([]byte, (4-c.written%4)%4))
+}
+
+// writeEntry writes a header for the named file, followed by size bytes of data
+func (c *cpioWriter) writeEntry(name string, mode int64, modTime time.Time, size int64, data io.Reader) error {
+	c.inode++
+
+	// Fields are all eight hex digits: inode, mode, uid, gid, nlink, mtime, filesize,
+	// devmajor, devminor, rdevmajor, rdevminor, namesize and check. Files are owned by
+	// root, whoever owned them on pixie's disk.
+	header := fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		c.inode, mode, 0, 0, 1, max(modTime.Unix(), 0), size, 0, 0, 0, 0, len(name)+1, 0)
+
+	if err := c.write([]byte(header + name + "\x00")); err != nil {
+		return err
+	}
+
+	if err := c.pad(); err != nil {
+		return err
+	}
+
+	if size > 0 {
+		n, err := io.Copy(c.w, io.LimitReader(data, size))
+		c.written += n
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		if n != size {
+			return fmt.Errorf("'%s' changed while being packed: %w", name, io.ErrUnexpectedEOF)
+		}
+	}
+
+	return c.pad()
+}
+
+// close writes the trailer that ends the archive
+func (c *cpioWriter) close() error {
+	return c.writeEntry(cpioTrailer, 0, time.Unix(0, 0), 0, nil)
+}
+
+// packDirectory writes the contents of the directory as a cpio archive, with paths
+// relative to the directory (so that it's unpacked over the root of the initramfs)
+func packDirectory(w io.Writer, directory string) error {
+	archive := &cpioWriter{w: w}
+
+	err := filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(directory, path)
+		if err != nil || name == "." {
+			return err //nolint:wrapcheck
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		perm := int64(permissions(info))
+		name = filepath.ToSlash(name)
+
+		switch {
+		case info.IsDir():
+			return archive.writeEntry(name, modeDir|perm, info.ModTime(), 0, nil)
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			// Targets are unpacked on Linux, so always use slashes
+			target = filepath.ToSlash(target)
+
+			return archive.writeEntry(name, modeSymlink|0o777, info.ModTime(), int64(len(target)), bytes.NewReader([]byte(target)))
+		case info.Mode().IsRegular():
+			file, err := os.Open(path)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+			defer file.Close()
+
+			return archive.writeEntry(name, modeRegular|perm, info.ModTime(), info.Size(), file)
+		default:
+			return fmt.Errorf("'%s': %w", path, errUnsupportedFileType)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pack directory '%s': %w", directory, err)
+	}
+
+	return archive.close()
+}
+
+// File is a file packed into an archive by [Pack]
+type File struct {
+	// Absolute, slash-separated path of the file in the initramfs
+	Path string
+
+	// Permissions of the file
+	Permissions fs.FileMode
+
+	Data []byte
+}
+
+// Pack writes the files as an uncompressed cpio archive, along with any parent
+// directories that they need. Everything is owned by root and has no modification time,
+// so that the same files always produce the same archive.
+func Pack(w io.Writer, files []File) error {
+	archive := &cpioWriter{w: w}
+	epoch := time.Unix(0, 0)
+
+	directories := make(map[string]struct{})
+	for _, file := range files {
+		for dir := path.Dir(file.Path); dir != "/" && dir != "."; dir = path.Dir(dir) {
+			directories[dir] = struct{}{}
+		}
+	}
+
+	// Sorted paths list parents before their children
+	for _, dir := range slices.Sorted(maps.Keys(directories)) {
+		if err := archive.writeEntry(strings.TrimPrefix(dir, "/"), modeDir|0o755, epoch, 0, nil); err != nil {
+			return fmt.Errorf("failed to write directory '%s': %w", dir, err)
+		}
+	}
+
+	for _, file := range files {
+		mode := modeRegular | int64(file.Permissions.Perm())
+		if err := archive.writeEntry(strings.TrimPrefix(file.Path, "/"), mode, epoch, int64(len(file.Data)), bytes.NewReader(file.Data)); err != nil {
+			return fmt.Errorf("failed to write file '%s': %w", file.Path, err)
+		}
+	}
+
+	return archive.close()
+}
+
+// copyCPIO copies a single uncompressed cpio archive from r to w, up to and including
+// its trailer, leaving r at the end of the archive
+func copyCPIO(w io.Writer, r io.Reader) error {
+	archive := &cpioWriter{w: w}
+	header := make([]byte, headerLength)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return fmt.Errorf("failed to read header: %w", err)
+		}
+
+		if string(header[:5]) != cpioMagic {
+			return fmt.Errorf("bad magic at offset %d: %w", archive.written, errInvalidCPIO)
+		}
+
+		fileSize, err := strconv.ParseInt(string(header[54:62]), 16, 64)
+		if err != nil {
+			return fmt.Errorf("bad file size at offset %d: %w", archive.written, errInvalidCPIO)
+		}
+
+		nameSize, err := strconv.ParseInt(string(header[94:102]), 16, 64)
+		if err != nil || nameSize < 1 || nameSize > maxNameSize {
+			return fmt.Errorf("bad name size at offset %d: %w", archive.written, errInvalidCPIO)
+		}
+
+		// The header and name are padded together, and the file's data on its own
+		name := make([]byte, nameSize+(4-(headerLength+nameSize)%4)%4)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return fmt.Errorf("failed to read name: %w", err)
+		}
+
+		if err := archive.write(append(header, name...)); err != nil {
+			return err
+		}
+
+		copied, err := io.CopyN(w, r, fileSize+(4-fileSize%4)%4)
+		archive.written += copied
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+
+		if string(name[:nameSize-1]) == cpioTrailer {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,359 @@
+// Package initrd post-processes Linux initrds before they are served: recompressing them
+// (e.g. with zstd, which decompresses faster than the gzip or xz they are usually
+// published with), and appending overlays of extra files such as drivers or SSH keys.
+//
+// An initrd is a series of cpio archives, each of which may be compressed, that the
+// kernel unpacks one after another into its initramfs; later archives replace files in
+// earlier ones. Overlays are appended as further archives, so the original is unchanged.
+package initrd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionXZ   = "xz"
+)
+
+var (
+	errUnknownCompression = errors.New("unknown compression; valid values are 'none', 'gzip', 'zstd' or 'xz'")
+	errUnknownFormat      = errors.New("unrecognised initrd format")
+	errTrailingData       = errors.New("unrecognised data after compressed archive")
+)
+
+// Magic numbers at the start of each compressed format that the kernel may unpack. Only
+// those that can be decompressed here are recognised.
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicXZ    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicBzip2 = []byte("BZh")
+)
+
+// Config describes how a distro's initrd is processed. The initrd is served unchanged
+// if neither option is set.
+type Config struct {
+	// Compression to recompress the initrd with: 'none', 'gzip', 'zstd' or 'xz'. The
+	// kernel must have been built with support for it. If empty, the initrd is left as
+	// it was published. Uncompressed archives at the start of the initrd, such as early
+	// microcode, are always left uncompressed.
+	Compression string `mapstructure:"compression"`
+
+	// Paths of overlays appended to the initrd: either directories, which are packed
+	// into archives whose root is the root of the initramfs, or cpio archives (which may
+	// be compressed). Directories are compressed with the configured compression, or
+	// gzip if none is configured.
+	Overlays []string `mapstructure:"overlays"`
+}
+
+// Enabled returns whether the initrd is processed at all
+func (c *Config) Enabled() bool {
+	return c.Compression != "" || len(c.Overlays) > 0
+}
+
+func (c *Config) Validate() error {
+	switch c.Compression {
+	case "", CompressionNone, CompressionGzip, CompressionZstd, CompressionXZ:
+		return nil
+	default:
+		return fmt.Errorf("'%s': %w", c.Compression, errUnknownCompression)
+	}
+}
+
+// Fingerprint identifies the processing, including the contents of overlays, so that
+// initrds are processed again when an overlay changes
+func (c *Config) Fingerprint() (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", c.Compression)
+
+	for _, overlay := range c.Overlays {
+		fmt.Fprintf(h, "overlay %s\n", overlay)
+
+		err := filepath.WalkDir(overlay, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			fmt.Fprintf(h, "%s %s %d\n", filepath.ToSlash(path), info.Mode(), info.Size())
+
+			switch {
+			case info.Mode()&fs.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err //nolint:wrapcheck
+				}
+
+				fmt.Fprintf(h, "%s\n", target)
+			case info.Mode().IsRegular():
+				file, err := os.Open(path)
+				if err != nil {
+					return err //nolint:wrapcheck
+				}
+				defer file.Close()
+
+				if _, err := io.Copy(h, file); err != nil {
+					return err //nolint:wrapcheck
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to read initrd overlay '%s': %w", overlay, err)
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Process writes the initrd read from r to w, recompressed and with overlays appended
+// as configured
+func Process(w io.Writer, r io.Reader, config *Config) error {
+	out := &alignedWriter{w: w}
+	in := bufio.NewReader(r)
+
+	if config.Compression == "" {
+		if _, err := io.Copy(out, in); err != nil {
+			return fmt.Errorf("failed to copy initrd: %w", err)
+		}
+	} else if err := recompress(out, in, config.Compression); err != nil {
+		return err
+	}
+
+	for _, overlay := range config.Overlays {
+		if err := appendOverlay(out, overlay, config.Compression); err != nil {
+			return fmt.Errorf("failed to append initrd overlay '%s': %w", overlay, err)
+		}
+	}
+
+	return nil
+}
+
+// recompress copies each archive in the initrd to out, decompressing any compressed
+// archives and compressing them again with the given compression
+func recompress(out *alignedWriter, in *bufio.Reader, compression string) error {
+	for {
+		// Archives may be followed by zeroes, which the kernel skips
+		magic, err := skipZeroes(in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read initrd: %w", err)
+		}
+
+		if bytes.HasPrefix(magic, []byte(cpioMagic)) {
+			if err := out.align(); err != nil {
+				return fmt.Errorf("failed to write initrd: %w", err)
+			}
+
+			if err := copyCPIO(out, in); err != nil {
+				return fmt.Errorf("failed to copy uncompressed archive in initrd: %w", err)
+			}
+
+			continue
+		}
+
+		decompressed, err := decompress(in, magic)
+		if err != nil {
+			return err
+		}
+
+		if err := compressArchive(out, decompressed, compression); err != nil {
+			return fmt.Errorf("failed to recompress initrd: %w", err)
+		}
+
+		// Decompressors read up to the end of their input, so a compressed archive must
+		// be the last in the initrd. This is how initrds are usually built.
+		if _, err := skipZeroes(in); !errors.Is(err, io.EOF) {
+			return errTrailingData
+		}
+
+		return nil
+	}
+}
+
+// skipZeroes discards zero bytes from in, returning the bytes that follow them (which
+// are at most as long as the longest magic number)
+func skipZeroes(in *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := in.ReadByte()
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		if b != 0 {
+			if err := in.UnreadByte(); err != nil {
+				return nil, err //nolint:wrapcheck
+			}
+
+			magic, err := in.Peek(len(magicXZ))
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, err //nolint:wrapcheck
+			}
+
+			return magic, nil
+		}
+	}
+}
+
+// decompress returns a reader of the decompressed contents of the archive at the start
+// of in, whose format is identified by its magic number
+func decompress(in *bufio.Reader, magic []byte) (io.Reader, error) {
+	var (
+		reader io.Reader
+		err    error
+	)
+
+	switch {
+	case bytes.HasPrefix(magic, magicGzip):
+		reader, err = gzip.NewReader(in)
+	case bytes.HasPrefix(magic, magicZstd):
+		var decoder *zstd.Decoder
+		decoder, err = zstd.NewReader(in, zstd.WithDecoderConcurrency(1))
+		reader = decoder
+	case bytes.HasPrefix(magic, magicXZ):
+		reader, err = xz.NewReader(in)
+	case bytes.HasPrefix(magic, magicBzip2):
+		reader = bzip2.NewReader(in)
+	default:
+		return nil, fmt.Errorf("magic %x: %w", magic, errUnknownFormat)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress initrd: %w", err)
+	}
+
+	return reader, nil
+}
+
+// compressArchive compresses the contents of r as a single archive at the end of out
+func compressArchive(out *alignedWriter, r io.Reader, compression string) error {
+	if err := out.align(); err != nil {
+		return err
+	}
+
+	var (
+		writer io.WriteCloser
+		err    error
+	)
+
+	switch compression {
+	case CompressionNone:
+		_, err := io.Copy(out, r)
+		return err //nolint:wrapcheck
+	case CompressionGzip:
+		writer, err = gzip.NewWriterLevel(out, gzip.BestCompression)
+	case CompressionZstd:
+		writer, err = zstd.NewWriter(out, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	case CompressionXZ:
+		// The kernel's xz decompressor doesn't support the default CRC64 checks
+		writer, err = xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(out)
+	default:
+		return fmt.Errorf("'%s': %w", compression, errUnknownCompression)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to create compressor: %w", err)
+	}
+
+	if _, err := io.Copy(writer, r); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	return writer.Close() //nolint:wrapcheck
+}
+
+// appendOverlay appends the overlay at path to out, packing it first if it's a
+// directory
+func appendOverlay(out *alignedWriter, path string, compression string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	if info.IsDir() {
+		if compression == "" {
+			compression = CompressionGzip
+		}
+
+		packed, w := io.Pipe()
+		go func() {
+			w.CloseWithError(packDirectory(w, path))
+		}()
+		defer packed.Close()
+
+		return compressArchive(out, packed, compression)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	defer file.Close()
+
+	// Archives are appended as they are, but are checked to be something that the
+	// kernel can unpack, rather than failing at boot
+	in := bufio.NewReader(file)
+	magic, err := in.Peek(len(magicXZ))
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	if !bytes.HasPrefix(magic, []byte(cpioMagic)) {
+		if _, err := decompress(in, magic); err != nil {
+			return err
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	if err := out.align(); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, file)
+	return err //nolint:wrapcheck
+}
+
+// alignedWriter counts the bytes written to it, so that each archive can be started at
+// a multiple of four bytes, as the kernel requires
+type alignedWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (a *alignedWriter) Write(data []byte) (int, error) {
+	n, err := a.w.Write(data)
+	a.written += int64(n)
+
+	return n, err //nolint:wrapcheck
+}
+
+// align pads the output with zeroes to a multiple of four bytes
+func (a *alignedWriter) align() error {
+	_, err := a.Write(make([]byte, (4-a.written%4)%4))
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package initrd
+
+import "io/fs"
+
+// permissions returns the permissions that a packed file has in the initramfs, which
+// are those it has on disk
+func permissions(info fs.FileInfo) fs.FileMode {
+	return info.Mode().Perm()
+}
@@ -0,0 +1,10 @@
+package initrd
+
+import "io/fs"
+
+// permissions returns the permissions that a packed file has in the initramfs. Windows
+// has no execute permission, and overlays often contain scripts, so everything is
+// executable, and writable only by its owner.
+func permissions(_ fs.FileInfo) fs.FileMode {
+	return 0o755
+}
@@ -0,0 +1,209 @@
+package kube
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where Kubernetes mounts the pod's service account credentials
+const serviceAccountDirectory = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+var (
+	errNotInCluster = errors.New("not running in a Kubernetes cluster (KUBERNETES_SERVICE_HOST is unset)")
+	errStatus       = errors.New("unsuccessful status from the Kubernetes API")
+	errWatchExpired = errors.New("watch expired")
+	errInvalidCA    = errors.New("no certificates found in cluster CA")
+)
+
+// client is a minimal client for the Kubernetes API, authenticating as the pod's
+// service account
+type client struct {
+	baseURL   string
+	http      *http.Client
+	tokenFile string
+	namespace string
+}
+
+// newInClusterClient creates a client from the environment and service account of the
+// pod that pixie runs in
+func newInClusterClient() (*client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" {
+		return nil, errNotInCluster
+	}
+
+	if port == "" {
+		port = "443"
+	}
+
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDirectory, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errInvalidCA
+	}
+
+	namespace, err := os.ReadFile(filepath.Join(serviceAccountDirectory, "namespace"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pod namespace: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+
+	return &client{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		http:      &http.Client{Transport: transport},
+		tokenFile: filepath.Join(serviceAccountDirectory, "token"),
+		namespace: strings.TrimSpace(string(namespace)),
+	}, nil
+}
+
+// object is the part of a Kubernetes object that pixie reads
+type object struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+
+	// Entries of a ConfigMap
+	Data map[string]string `json:"data,omitempty"`
+
+	// Spec of a custom resource
+	Spec map[string]any `json:"spec,omitempty"`
+}
+
+type objectList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+
+	Items []object `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// status is returned by the API on errors, including as the object of a watch event
+// of type 'ERROR'
+type status struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (c *client) list(ctx context.Context, path string, query url.Values) (*objectList, error) {
+	resp, err := c.do(ctx, path, query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list objectList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode list of '%s': %w", path, err)
+	}
+
+	return &list, nil
+}
+
+// watch streams changes to the objects at path since resourceVersion, until the API
+// server ends the watch or the context is cancelled. [errWatchExpired] is returned if
+// the resource version is too old to watch from, and the objects must be listed again.
+func (c *client) watch(ctx context.Context, path string, query url.Values, resourceVersion string, handle func(eventType string, obj *object)) error {
+	watchQuery := url.Values{}
+	for key, values := range query {
+		watchQuery[key] = values
+	}
+
+	watchQuery.Set("watch", "true")
+	watchQuery.Set("resourceVersion", resourceVersion)
+
+	resp, err := c.do(ctx, path, watchQuery)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var event watchEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("failed to decode watch event: %w", err)
+		}
+
+		if event.Type == "ERROR" {
+			var st status
+			if err := json.Unmarshal(event.Object, &st); err == nil && st.Code == http.StatusGone {
+				return errWatchExpired
+			}
+
+			return fmt.Errorf("watch of '%s' failed: %s: %w", path, st.Message, errStatus)
+		}
+
+		var obj object
+		if err := json.Unmarshal(event.Object, &obj); err != nil {
+			return fmt.Errorf("failed to decode watched object: %w", err)
+		}
+
+		handle(event.Type, &obj)
+	}
+
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("watch of '%s' failed: %w", path, err)
+	}
+
+	return nil
+}
+
+func (c *client) do(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	// Projected service account tokens are rotated, so the token is read for each request
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes API request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to the Kubernetes API failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		var st status
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&st); err != nil || st.Message == "" {
+			st.Message = resp.Status
+		}
+
+		return nil, fmt.Errorf("GET %s: %s: %w", path, st.Message, errStatus)
+	}
+
+	return resp, nil
+}
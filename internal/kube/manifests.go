@@ -0,0 +1,79 @@
+package kube
+
+// Manifests defines pixie's custom resources, and a role granting what pixie reads.
+// Specs aren't validated by the API server: they have the same keys as distros and
+// hosts in the config file, and are checked by pixie when they're read.
+const Manifests = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: distros.` + Group + `
+spec:
+  group: ` + Group + `
+  scope: Namespaced
+  names:
+    kind: Distro
+    listKind: DistroList
+    plural: distros
+    singular: distro
+  versions:
+    - name: ` + Version + `
+      served: true
+      storage: true
+      additionalPrinterColumns:
+        - name: Provider
+          type: string
+          jsonPath: .spec.provider
+        - name: Version
+          type: string
+          jsonPath: .spec.version
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              x-kubernetes-preserve-unknown-fields: true
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: hosts.` + Group + `
+spec:
+  group: ` + Group + `
+  scope: Namespaced
+  names:
+    kind: Host
+    listKind: HostList
+    plural: hosts
+    singular: host
+  versions:
+    - name: ` + Version + `
+      served: true
+      storage: true
+      additionalPrinterColumns:
+        - name: MAC
+          type: string
+          jsonPath: .spec.mac
+        - name: Distro
+          type: string
+          jsonPath: .spec.distro
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              x-kubernetes-preserve-unknown-fields: true
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: pixie
+rules:
+  - apiGroups: [""]
+    resources: [configmaps]
+    verbs: [get, list, watch]
+  - apiGroups: [` + Group + `]
+    resources: [distros, hosts]
+    verbs: [get, list, watch]
+`
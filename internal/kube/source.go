@@ -0,0 +1,298 @@
+// Package kube reads distro and host definitions from the Kubernetes cluster that pixie
+// runs in, from a ConfigMap or from custom resources, and watches them for changes
+package kube
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// API group and version of pixie's custom resources
+const (
+	Group   = "pixie.davejbax.github.io"
+	Version = "v1alpha1"
+)
+
+// Delay before listing again after a watch fails
+const retryDelay = 10 * time.Second
+
+type Config struct {
+	// Whether to read definitions from the cluster that pixie runs in
+	Enabled bool
+
+	// Namespace to read from. Defaults to the namespace of pixie's pod.
+	Namespace string
+
+	// Name of a ConfigMap whose YAML or JSON entries are merged into the config. Entries
+	// may set 'distros', 'hosts', 'profiles', 'kernel_args', 'default_profile' and
+	// 'maintenance_windows'. No ConfigMap is read if this is empty.
+	ConfigMap string `mapstructure:"config_map"`
+
+	// Whether to read Distro and Host custom resources, as defined by the manifests from
+	// 'pixie config crds'
+	CustomResources bool `mapstructure:"custom_resources"`
+}
+
+// Fragment is a config fragment from an entry of the ConfigMap
+type Fragment struct {
+	Key  string
+	Data string
+}
+
+// Resource is a custom resource, whose spec has the same keys as the corresponding
+// section of the config file
+type Resource struct {
+	Name string
+	Spec map[string]any
+}
+
+// Definitions are what has been read from the cluster, each sorted by key or name
+type Definitions struct {
+	Fragments []Fragment
+	Distros   []Resource
+	Hosts     []Resource
+}
+
+// collection is a set of watched objects of one kind
+type collection struct {
+	path  string
+	query url.Values
+
+	// Objects by name, guarded by the source's mutex
+	objects map[string]object
+}
+
+// Source keeps the definitions read from the cluster up to date
+type Source struct {
+	logger *slog.Logger
+	client *client
+
+	configMap *collection
+	distros   *collection
+	hosts     *collection
+
+	mu      sync.Mutex
+	changes chan struct{}
+}
+
+// NewSource creates a source reading from the cluster that pixie runs in. Nothing is
+// read until [Source.Sync] or [Source.Run] is called.
+func NewSource(logger *slog.Logger, config *Config) (*Source, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = client.namespace
+	}
+
+	source := &Source{
+		logger:  logger,
+		client:  client,
+		changes: make(chan struct{}, 1),
+	}
+
+	if config.ConfigMap != "" {
+		source.configMap = &collection{
+			path:  "/api/v1/namespaces/" + url.PathEscape(namespace) + "/configmaps",
+			query: url.Values{"fieldSelector": {"metadata.name=" + config.ConfigMap}},
+		}
+	}
+
+	if config.CustomResources {
+		prefix := "/apis/" + Group + "/" + Version + "/namespaces/" + url.PathEscape(namespace)
+
+		source.distros = &collection{path: prefix + "/distros"}
+		source.hosts = &collection{path: prefix + "/hosts"}
+	}
+
+	return source, nil
+}
+
+func (s *Source) collections() []*collection {
+	collections := []*collection{}
+	for _, c := range []*collection{s.configMap, s.distros, s.hosts} {
+		if c != nil {
+			collections = append(collections, c)
+		}
+	}
+
+	return collections
+}
+
+// Sync reads all definitions from the cluster. Definitions read by Sync aren't signalled
+// as changes, as the caller has them already.
+func (s *Source) Sync(ctx context.Context) error {
+	for _, c := range s.collections() {
+		if _, err := s.sync(ctx, c); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-s.changes:
+	default:
+	}
+
+	return nil
+}
+
+// Changes receives a value whenever the definitions have changed
+func (s *Source) Changes() <-chan struct{} {
+	return s.changes
+}
+
+// Run watches the definitions for changes until the context is cancelled. Failed
+// watches are retried, so this only returns once the context is cancelled.
+func (s *Source) Run(ctx context.Context) error {
+	eg, ctx := errgroup.WithContext(ctx)
+
+	for _, c := range s.collections() {
+		eg.Go(func() error {
+			s.watch(ctx, c)
+			return nil
+		})
+	}
+
+	return eg.Wait() //nolint:wrapcheck
+}
+
+// Definitions returns the definitions last read from the cluster
+func (s *Source) Definitions() *Definitions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	definitions := &Definitions{}
+
+	if s.configMap != nil {
+		for _, obj := range s.configMap.objects {
+			for key, data := range obj.Data {
+				definitions.Fragments = append(definitions.Fragments, Fragment{Key: key, Data: data})
+			}
+		}
+
+		slices.SortFunc(definitions.Fragments, func(a, b Fragment) int {
+			return strings.Compare(a.Key, b.Key)
+		})
+	}
+
+	if s.distros != nil {
+		definitions.Distros = resources(s.distros.objects)
+		definitions.Hosts = resources(s.hosts.objects)
+	}
+
+	return definitions
+}
+
+func resources(objects map[string]object) []Resource {
+	resources := make([]Resource, 0, len(objects))
+	for name, obj := range objects {
+		resources = append(resources, Resource{Name: name, Spec: obj.Spec})
+	}
+
+	slices.SortFunc(resources, func(a, b Resource) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return resources
+}
+
+// sync lists the objects in the collection, returning the resource version to watch
+// from
+func (s *Source) sync(ctx context.Context, c *collection) (string, error) {
+	list, err := s.client.list(ctx, c.path, c.query)
+	if err != nil {
+		return "", err
+	}
+
+	objects := make(map[string]object, len(list.Items))
+	for _, obj := range list.Items {
+		objects[obj.Metadata.Name] = obj
+	}
+
+	s.update(func() {
+		c.objects = objects
+	})
+
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch keeps the collection up to date until the context is cancelled. Watches are
+// resumed from the last resource version seen when the API server ends them, and the
+// collection is listed again if that's too old.
+func (s *Source) watch(ctx context.Context, c *collection) {
+	for ctx.Err() == nil {
+		resourceVersion, err := s.sync(ctx, c)
+
+		for err == nil && ctx.Err() == nil {
+			err = s.client.watch(ctx, c.path, c.query, resourceVersion, func(eventType string, obj *object) {
+				resourceVersion = obj.Metadata.ResourceVersion
+
+				s.update(func() {
+					objects := make(map[string]object, len(c.objects))
+					for name, existing := range c.objects {
+						objects[name] = existing
+					}
+
+					switch eventType {
+					case "ADDED", "MODIFIED":
+						objects[obj.Metadata.Name] = *obj
+					case "DELETED":
+						delete(objects, obj.Metadata.Name)
+					}
+
+					c.objects = objects
+				})
+			})
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, errWatchExpired) {
+			continue
+		}
+
+		s.logger.Warn("failed to watch Kubernetes resources, retrying",
+			"path", c.path,
+			"error", err,
+			"retry_in", retryDelay,
+		)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// update applies a change to the collections, signalling a change if the definitions
+// are different afterwards
+func (s *Source) update(change func()) {
+	before := s.Definitions()
+
+	s.mu.Lock()
+	change()
+	s.mu.Unlock()
+
+	if reflect.DeepEqual(before, s.Definitions()) {
+		return
+	}
+
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,249 @@
+// Package limiter limits the number of transfers in progress at once, queueing further
+// transfers fairly between clients, so that many machines booting at once (e.g. a rack
+// powering on) can't exhaust pixie's file descriptors or memory
+package limiter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded is returned when a transfer can't start, as the queue is full or the
+// transfer waited too long
+var ErrOverloaded = errors.New("too many transfers in progress")
+
+// Seconds that shed HTTP clients are asked to wait before retrying
+const retryAfter = "5"
+
+// Limiter limits the number of transfers in progress. Transfers that can't start
+// immediately are queued per client, and queued clients take turns, so that one client
+// making many requests can't starve the others. A nil limiter has no limits.
+type Limiter struct {
+	maxActive int
+	maxQueued int
+	timeout   time.Duration
+
+	mu     sync.Mutex
+	active int
+	queued int
+	queues map[string][]*waiter
+
+	// Clients with queued transfers, in the order that they take turns
+	order []string
+
+	shed uint64
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// Stats describes the transfers in progress and queued
+type Stats struct {
+	Active       int `json:"active"`
+	MaxTransfers int `json:"max_transfers"`
+
+	Queued        int `json:"queued"`
+	QueuedClients int `json:"queued_clients"`
+	MaxQueued     int `json:"max_queued"`
+
+	// Transfers refused since pixie started, as the queue was full or they waited too
+	// long
+	Shed uint64 `json:"shed"`
+}
+
+// New creates a limiter allowing maxActive transfers at once, with up to maxQueued
+// more waiting for up to timeout each. If maxActive is zero, transfers are unlimited.
+// If timeout is zero, queued transfers wait until their context is done.
+func New(maxActive int, maxQueued int, timeout time.Duration) *Limiter {
+	if maxActive <= 0 {
+		return nil
+	}
+
+	return &Limiter{
+		maxActive: maxActive,
+		maxQueued: maxQueued,
+		timeout:   timeout,
+		queues:    make(map[string][]*waiter),
+	}
+}
+
+// Acquire waits for a transfer by the given client (usually its IP address) to be
+// allowed to start. The returned function must be called once the transfer finishes.
+// [ErrOverloaded] is returned if the transfer is shed.
+func (l *Limiter) Acquire(ctx context.Context, client string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+
+	if l.active < l.maxActive && l.queued == 0 {
+		l.active++
+		l.mu.Unlock()
+
+		return l.releaser(), nil
+	}
+
+	if l.queued >= l.maxQueued {
+		l.shed++
+		l.mu.Unlock()
+
+		return nil, ErrOverloaded
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	if len(l.queues[client]) == 0 {
+		l.order = append(l.order, client)
+	}
+
+	l.queues[client] = append(l.queues[client], w)
+	l.queued++
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.ready:
+		return l.releaser(), nil
+	case <-timeout:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The transfer may have been allowed to start while giving up
+	if w.granted {
+		return l.releaser(), nil
+	}
+
+	l.dequeue(client, w)
+	l.shed++
+
+	return nil, ErrOverloaded
+}
+
+// releaser returns a function that ends a transfer, starting the next queued transfer
+func (l *Limiter) releaser() func() {
+	once := sync.Once{}
+
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.active--
+			l.grantNext()
+		})
+	}
+}
+
+// grantNext starts queued transfers while there is room, taking one from each client
+// in turn
+func (l *Limiter) grantNext() {
+	for l.active < l.maxActive && len(l.order) > 0 {
+		client := l.order[0]
+		l.order = l.order[1:]
+
+		queue := l.queues[client]
+		w := queue[0]
+
+		if len(queue) == 1 {
+			delete(l.queues, client)
+		} else {
+			l.queues[client] = queue[1:]
+			l.order = append(l.order, client)
+		}
+
+		l.queued--
+		l.active++
+
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// dequeue removes a waiter that gave up from its client's queue
+func (l *Limiter) dequeue(client string, w *waiter) {
+	queue := l.queues[client]
+	for i := range queue {
+		if queue[i] != w {
+			continue
+		}
+
+		queue = append(queue[:i], queue[i+1:]...)
+		l.queued--
+
+		break
+	}
+
+	if len(queue) > 0 {
+		l.queues[client] = queue
+		return
+	}
+
+	delete(l.queues, client)
+
+	for i := range l.order {
+		if l.order[i] == client {
+			l.order = append(l.order[:i], l.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Stats returns the current state of the limiter. A nil limiter has zero stats.
+func (l *Limiter) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return Stats{
+		Active:        l.active,
+		MaxTransfers:  l.maxActive,
+		Queued:        l.queued,
+		QueuedClients: len(l.order),
+		MaxQueued:     l.maxQueued,
+		Shed:          l.shed,
+	}
+}
+
+// Middleware limits the HTTP requests handled by next, queueing them per client IP.
+// Shed requests get a 503 response asking the client to retry later.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+
+		release, err := l.Acquire(r.Context(), client)
+		if err != nil {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "server busy, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// levelHandler drops records below the level of its logger's subsystem, or the global
+// level if the subsystem has none
+type levelHandler struct {
+	next  slog.Handler
+	level slog.Level
+
+	global slog.Level
+	levels map[string]slog.Level
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.next.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.next.Handle(ctx, record) //nolint:wrapcheck
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handler := *h
+	handler.next = h.next.WithAttrs(attrs)
+
+	for _, attr := range attrs {
+		if attr.Key != SubsystemKey {
+			continue
+		}
+
+		handler.level = h.global
+		if level, ok := h.levels[attr.Value.String()]; ok {
+			handler.level = level
+		}
+	}
+
+	return &handler
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	handler := *h
+	handler.next = h.next.WithGroup(name)
+
+	return &handler
+}
+
+// multiHandler passes records to each of several handlers
+type multiHandler struct {
+	sinks []slog.Handler
+}
+
+func (h *multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, sink := range h.sinks {
+		if sink.Enabled(ctx, level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *multiHandler) Handle(ctx context.Context, record slog.Record) error {
+	var errs []error
+
+	for _, sink := range h.sinks {
+		if sink.Enabled(ctx, record.Level) {
+			errs = append(errs, sink.Handle(ctx, record.Clone()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (h *multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	sinks := make([]slog.Handler, 0, len(h.sinks))
+	for _, sink := range h.sinks {
+		sinks = append(sinks, sink.WithAttrs(attrs))
+	}
+
+	return &multiHandler{sinks: sinks}
+}
+
+func (h *multiHandler) WithGroup(name string) slog.Handler {
+	sinks := make([]slog.Handler, 0, len(h.sinks))
+	for _, sink := range h.sinks {
+		sinks = append(sinks, sink.WithGroup(name))
+	}
+
+	return &multiHandler{sinks: sinks}
+}
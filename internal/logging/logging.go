@@ -0,0 +1,154 @@
+// Package logging builds pixie's logger. Levels can be set per subsystem, as named by
+// loggers' 'subsystem' attribute, and logs can also be written to a rotated file.
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// SubsystemKey is the attribute naming the subsystem that a logger belongs to
+const SubsystemKey = "subsystem"
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	errUnknownFormat     = errors.New("unknown log format; valid values are 'text' or 'json'")
+	errInvalidMaxSize    = errors.New("log file max_size must be positive")
+	errInvalidMaxBackups = errors.New("log file max_backups must not be negative")
+)
+
+type Config struct {
+	// Levels of subsystems, e.g. 'tftp: debug' or 'distro: warn', overriding the level
+	// set by '--level' for loggers with that subsystem
+	Levels map[string]string
+
+	// File that logs are written to as well as stderr
+	File FileConfig
+}
+
+type FileConfig struct {
+	// Path of the file. If empty, logs are only written to stderr.
+	Path string
+
+	// Either 'text' or 'json'
+	Format string `default:"json"`
+
+	// Size in megabytes at which the file is rotated
+	MaxSize int `mapstructure:"max_size" default:"100"`
+
+	// Number of rotated files to keep, named after the file with '.1', '.2', and so on
+	MaxBackups int `mapstructure:"max_backups" default:"5"`
+}
+
+func (c *Config) Validate() error {
+	if _, err := c.levels(); err != nil {
+		return err
+	}
+
+	if c.File.Path == "" {
+		return nil
+	}
+
+	if _, err := NewHandler(c.File.Format, io.Discard, nil); err != nil {
+		return err
+	}
+
+	if c.File.MaxSize <= 0 {
+		return errInvalidMaxSize
+	}
+
+	if c.File.MaxBackups < 0 {
+		return errInvalidMaxBackups
+	}
+
+	return nil
+}
+
+func (c *Config) levels() (map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level, len(c.Levels))
+
+	for subsystem, name := range c.Levels {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return nil, fmt.Errorf("invalid log level '%s' for subsystem '%s': %w", name, subsystem, err)
+		}
+
+		levels[subsystem] = level
+	}
+
+	return levels, nil
+}
+
+// NewHandler creates a handler writing records to w in the given format: 'text' or
+// 'json'
+func NewHandler(format string, w io.Writer, opts *slog.HandlerOptions) (slog.Handler, error) {
+	switch format {
+	case FormatText:
+		return slog.NewTextHandler(w, opts), nil
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("'%s': %w", format, errUnknownFormat)
+	}
+}
+
+// New creates a logger writing to stderr in the given format, and to the configured
+// file if there is one. Records are logged at the given level, unless their logger's
+// subsystem has a level of its own. The returned closer closes the file.
+func New(config *Config, level slog.Level, format string) (*slog.Logger, io.Closer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	levels, _ := config.levels()
+
+	// Sinks see every record that any subsystem logs, and the records are filtered by
+	// subsystem before reaching them
+	lowest := level
+	for _, subsystemLevel := range levels {
+		lowest = min(lowest, subsystemLevel)
+	}
+
+	sinkOpts := &slog.HandlerOptions{Level: lowest}
+
+	stderr, err := NewHandler(format, os.Stderr, sinkOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sinks := []slog.Handler{stderr}
+	closer := io.Closer(nopCloser{})
+
+	if config.File.Path != "" {
+		file, err := openRotatingFile(config.File.Path, int64(config.File.MaxSize)<<20, config.File.MaxBackups)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+
+		sink, _ := NewHandler(config.File.Format, file, sinkOpts)
+		sinks = append(sinks, sink)
+		closer = file
+	}
+
+	handler := &levelHandler{
+		next:   &multiHandler{sinks: sinks},
+		level:  level,
+		global: level,
+		levels: levels,
+	}
+
+	return slog.New(handler), closer, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,227 @@
+// Package maintenance implements maintenance windows: periods of time during which
+// updated artifacts are allowed to become active
+package maintenance
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidDay      = errors.New("invalid day of week")
+	errInvalidDuration = errors.New("window duration must be positive and at most a week")
+)
+
+// Days of the week may be given either in full or as their three-letter abbreviation
+var daysOfWeek = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// Window is a recurring period of time, starting at a given time of day on the given
+// days of the week
+type Window struct {
+	// Days of the week on which the window opens, e.g. 'sat' or 'sunday'. If empty,
+	// the window opens every day.
+	Days []string
+
+	// Time of day at which the window opens, in 24 hour HH:MM format. Defaults to midnight.
+	Start string
+
+	// How long the window stays open for
+	Duration time.Duration
+
+	// IANA time zone name that Start is relative to. Defaults to local time.
+	Timezone string
+}
+
+// Schedule is a set of maintenance windows. An empty schedule is considered to
+// always be open.
+type Schedule []Window
+
+// Validate checks that all windows in the schedule are well-formed
+func (s Schedule) Validate() error {
+	for i := range s {
+		if _, err := s[i].days(); err != nil {
+			return fmt.Errorf("invalid maintenance window %d: %w", i, err)
+		}
+
+		if _, err := s[i].start(); err != nil {
+			return fmt.Errorf("invalid maintenance window %d: %w", i, err)
+		}
+
+		if _, err := s[i].location(); err != nil {
+			return fmt.Errorf("invalid maintenance window %d: %w", i, err)
+		}
+
+		if s[i].Duration <= 0 || s[i].Duration > 7*24*time.Hour {
+			return fmt.Errorf("invalid maintenance window %d: %w", i, errInvalidDuration)
+		}
+	}
+
+	return nil
+}
+
+// Open returns whether any window in the schedule is open at the given time
+func (s Schedule) Open(t time.Time) (bool, error) {
+	if len(s) == 0 {
+		return true, nil
+	}
+
+	for i := range s {
+		open, err := s[i].Open(t)
+		if err != nil {
+			return false, err
+		}
+
+		if open {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// NextOpening returns when a window in the schedule next opens after the given time, or
+// the zero time if the schedule is empty
+func (s Schedule) NextOpening(t time.Time) (time.Time, error) {
+	var next time.Time
+
+	for i := range s {
+		opening, err := s[i].NextOpening(t)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if next.IsZero() || opening.Before(next) {
+			next = opening
+		}
+	}
+
+	return next, nil
+}
+
+// NextOpening returns when the window next opens after the given time
+func (w *Window) NextOpening(t time.Time) (time.Time, error) {
+	days, err := w.days()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	start, err := w.start()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	loc, err := w.location()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	t = t.In(loc)
+
+	// The window opens on at least one day of the week, so it opens again within a week
+	// of t (possibly later on the same day of the week as t)
+	for daysAhead := 0; ; daysAhead++ {
+		day := t.AddDate(0, 0, daysAhead)
+		opening := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc).Add(start)
+
+		if len(days) > 0 {
+			if _, ok := days[opening.Weekday()]; !ok {
+				continue
+			}
+		}
+
+		if opening.After(t) {
+			return opening, nil
+		}
+	}
+}
+
+// Open returns whether the window is open at the given time
+func (w *Window) Open(t time.Time) (bool, error) {
+	days, err := w.days()
+	if err != nil {
+		return false, err
+	}
+
+	start, err := w.start()
+	if err != nil {
+		return false, err
+	}
+
+	loc, err := w.location()
+	if err != nil {
+		return false, err
+	}
+
+	t = t.In(loc)
+
+	// A window may have opened on a previous day and still be open (e.g. if it opens
+	// at 23:00 and lasts three hours), so check every opening that could still cover t
+	maxDaysBack := int(w.Duration/(24*time.Hour)) + 1
+	for daysBack := 0; daysBack <= maxDaysBack; daysBack++ {
+		day := t.AddDate(0, 0, -daysBack)
+		opening := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc).Add(start)
+
+		if len(days) > 0 {
+			if _, ok := days[opening.Weekday()]; !ok {
+				continue
+			}
+		}
+
+		if !t.Before(opening) && t.Before(opening.Add(w.Duration)) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (w *Window) days() (map[time.Weekday]struct{}, error) {
+	days := make(map[time.Weekday]struct{}, len(w.Days))
+
+	for _, name := range w.Days {
+		day, ok := daysOfWeek[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("'%s': %w", name, errInvalidDay)
+		}
+
+		days[day] = struct{}{}
+	}
+
+	return days, nil
+}
+
+func (w *Window) start() (time.Duration, error) {
+	if w.Start == "" {
+		return 0, nil
+	}
+
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return 0, fmt.Errorf("invalid start time '%s': %w", w.Start, err)
+	}
+
+	return time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute, nil
+}
+
+func (w *Window) location() (*time.Location, error) {
+	if w.Timezone == "" {
+		return time.Local, nil
+	}
+
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone '%s': %w", w.Timezone, err)
+	}
+
+	return loc, nil
+}
@@ -0,0 +1,143 @@
+// Package netif chooses the address that pixie advertises to each client on servers with
+// several network interfaces (or VLAN sub-interfaces), so that clients are told to reach
+// pixie at an address on their own network rather than on whichever interface is first.
+package netif
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+var (
+	errInvalidServerIP  = errors.New("invalid IPv4 address")
+	errInvalidPublicURL = errors.New("invalid public URL")
+)
+
+// Config overrides what is advertised to clients on an interface
+type Config struct {
+	// IPv4 address given to DHCP clients on the interface as the DHCP and TFTP server.
+	// If empty, the interface's first IPv4 address is used.
+	ServerIP string `mapstructure:"server_ip"`
+
+	// Base URL of the HTTP server for clients on the interface's networks. If empty, the
+	// interface's address on the client's network is used, with the HTTP server's port
+	// (or its HTTPS port, if HTTPS is served).
+	PublicURL string `mapstructure:"public_url"`
+}
+
+// Table finds the interface that each client reaches pixie through, and the addresses
+// advertised on it. A nil table knows no interfaces.
+type Table struct {
+	interfaces map[string]*Config
+	httpPort   string
+	https      bool
+}
+
+// New creates a table of the addresses advertised on each interface, with overrides by
+// interface name. URLs derived from interfaces' addresses use the given HTTP port, and
+// HTTPS if https is true.
+func New(interfaces map[string]*Config, httpPort string, https bool) (*Table, error) {
+	for name, config := range interfaces {
+		if config == nil {
+			continue
+		}
+
+		if config.ServerIP != "" && net.ParseIP(config.ServerIP).To4() == nil {
+			return nil, fmt.Errorf("interface '%s': '%s': %w", name, config.ServerIP, errInvalidServerIP)
+		}
+
+		if config.PublicURL != "" {
+			if u, err := url.Parse(config.PublicURL); err != nil || u.Host == "" {
+				return nil, fmt.Errorf("interface '%s': '%s': %w", name, config.PublicURL, errInvalidPublicURL)
+			}
+		}
+	}
+
+	return &Table{interfaces: interfaces, httpPort: httpPort, https: https}, nil
+}
+
+// ServerIP returns the IPv4 address advertised to DHCP clients on the interface with the
+// given index, e.g. as received with their request
+func (t *Table) ServerIP(ifIndex int) (net.IP, bool) {
+	if t == nil || ifIndex == 0 {
+		return nil, false
+	}
+
+	iface, err := net.InterfaceByIndex(ifIndex)
+	if err != nil {
+		return nil, false
+	}
+
+	if config := t.interfaces[iface.Name]; config != nil && config.ServerIP != "" {
+		return net.ParseIP(config.ServerIP).To4(), true
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), true
+		}
+	}
+
+	return nil, false
+}
+
+// BaseURL returns the base URL of the HTTP server advertised to the client with the given
+// IP address: that of the local interface on the client's network. Clients that aren't
+// on the network of a local interface (e.g. those behind a router) have none.
+func (t *Table) BaseURL(clientIP net.IP) (string, bool) {
+	if t == nil || clientIP == nil {
+		return "", false
+	}
+
+	iface, localIP, ok := localInterface(clientIP)
+	if !ok {
+		return "", false
+	}
+
+	if config := t.interfaces[iface.Name]; config != nil && config.PublicURL != "" {
+		return config.PublicURL, true
+	}
+
+	scheme := "http"
+	if t.https {
+		scheme = "https"
+	}
+
+	return scheme + "://" + net.JoinHostPort(localIP.String(), t.httpPort), true
+}
+
+// localInterface returns the local interface on the network of the IP address, and the
+// interface's address on that network
+func localInterface(ip net.IP) (*net.Interface, net.IP, bool) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, false
+	}
+
+	for i := range interfaces {
+		iface := &interfaces[i]
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.Contains(ip) {
+				return iface, ipNet.IP, true
+			}
+		}
+	}
+
+	return nil, nil, false
+}
@@ -0,0 +1,209 @@
+// Package netroot describes root file systems mounted over the network by diskless
+// hosts, and generates the kernel arguments (in dracut's syntax) that mount them, along
+// with /etc/exports lines for NFS servers
+package netroot
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Placeholder for the host's name in paths, target names and initiator names, so
+	// that hosts sharing a profile can each have their own root
+	namePlaceholder = "{name}"
+
+	defaultISCSIPort = 3260
+)
+
+var (
+	errBothRoots       = errors.New("root may be mounted over NFS or iSCSI, not both")
+	errInvalidNFSRoot  = errors.New("NFS root must be given as 'server:/path'")
+	errNoISCSIServer   = errors.New("iSCSI root must have a server")
+	errNoISCSITarget   = errors.New("iSCSI root must have a target name")
+	errNoISCSIDevice   = errors.New("iSCSI root must have the device to mount as root, e.g. 'LABEL=root'")
+	errInvalidISCSILUN = errors.New("iSCSI LUN must not be negative")
+)
+
+// Config is a root file system mounted over the network, by NFS or iSCSI
+type Config struct {
+	// NFS export to mount as root, as 'server:/path'
+	NFS string `mapstructure:"nfs" json:"nfs,omitempty"`
+
+	// NFS mount options, e.g. 'vers=4.2'
+	NFSOptions []string `mapstructure:"nfs_options" json:"nfs_options,omitempty"`
+
+	// iSCSI target whose LUN holds the root file system
+	ISCSI *ISCSIConfig `mapstructure:"iscsi" json:"iscsi,omitempty"`
+
+	// Whether to mount the root file system read-only, e.g. when it's shared by many
+	// hosts that keep their state in memory
+	ReadOnly bool `mapstructure:"read_only" json:"read_only,omitempty"`
+
+	// Clients allowed to mount the NFS export, as given in generated /etc/exports lines
+	// (e.g. '10.0.1.0/24'). Defaults to the host's CIDR if it has one, or '*'.
+	ExportClients string `mapstructure:"export_clients" json:"export_clients,omitempty"`
+}
+
+// ISCSIConfig is an iSCSI target holding a root file system
+type ISCSIConfig struct {
+	// Address of the iSCSI server
+	Server string `mapstructure:"server" json:"server"`
+
+	// TCP port of the iSCSI server, if not the default
+	Port int `mapstructure:"port" json:"port,omitempty"`
+
+	// Name of the target, e.g. 'iqn.2025-01.com.example:roots.{name}'
+	Target string `mapstructure:"target" json:"target"`
+
+	LUN int `mapstructure:"lun" json:"lun,omitempty"`
+
+	// Initiator name of the host, e.g. 'iqn.2025-01.com.example:{name}'. If empty, the
+	// initiator name is taken from the iBFT or DHCP.
+	Initiator string `mapstructure:"initiator" json:"initiator,omitempty"`
+
+	// Device to mount as root once the target is attached, e.g. 'LABEL=root'
+	Device string `mapstructure:"device" json:"device"`
+}
+
+// Validate checks that the config describes a single, complete root
+func (c *Config) Validate() error {
+	if c.NFS != "" && c.ISCSI != nil {
+		return errBothRoots
+	}
+
+	if c.NFS != "" {
+		server, exportPath, found := strings.Cut(c.NFS, ":")
+		if !found || server == "" || !strings.HasPrefix(exportPath, "/") {
+			return fmt.Errorf("'%s': %w", c.NFS, errInvalidNFSRoot)
+		}
+	}
+
+	if c.ISCSI != nil {
+		switch {
+		case c.ISCSI.Server == "":
+			return errNoISCSIServer
+		case c.ISCSI.Target == "":
+			return errNoISCSITarget
+		case c.ISCSI.Device == "":
+			return errNoISCSIDevice
+		case c.ISCSI.LUN < 0:
+			return errInvalidISCSILUN
+		}
+	}
+
+	return nil
+}
+
+// Args returns the kernel arguments that mount the root for the named host. The network
+// is brought up by DHCP in the initramfs, which host arguments can override (e.g. with
+// a static 'ip=').
+func (c *Config) Args(hostName string) []string {
+	var args []string
+
+	switch {
+	case c.NFS != "":
+		root := "nfs:" + expand(c.NFS, hostName)
+		if len(c.NFSOptions) > 0 {
+			root += ":" + strings.Join(c.NFSOptions, ",")
+		}
+
+		args = append(args, "root="+root)
+	case c.ISCSI != nil:
+		port := ""
+		if c.ISCSI.Port != 0 && c.ISCSI.Port != defaultISCSIPort {
+			port = strconv.Itoa(c.ISCSI.Port)
+		}
+
+		// netroot=iscsi:<server>:<protocol>:<port>:<LUN>:<target>
+		args = append(args,
+			"root="+c.ISCSI.Device,
+			fmt.Sprintf("netroot=iscsi:%s::%s:%d:%s", c.ISCSI.Server, port, c.ISCSI.LUN, expand(c.ISCSI.Target, hostName)),
+		)
+
+		if c.ISCSI.Initiator != "" {
+			args = append(args, "rd.iscsi.initiator="+expand(c.ISCSI.Initiator, hostName))
+		}
+	default:
+		return nil
+	}
+
+	if c.ReadOnly {
+		args = append(args, "ro")
+	} else {
+		args = append(args, "rw")
+	}
+
+	return append(args, "ip=dhcp", "rd.neednet=1")
+}
+
+// Export is an NFS root exported to a client, as in /etc/exports
+type Export struct {
+	Path string
+
+	// Clients allowed to mount the export, with their options, e.g.
+	// '10.0.1.0/24(rw,no_root_squash)'
+	Client string
+}
+
+// Export returns the export of the named host's NFS root, if the root is mounted over
+// NFS. The export is only allowed to the host's CIDR, if given, unless the config says
+// otherwise.
+func (c *Config) Export(hostName string, cidr netip.Prefix) (*Export, bool) {
+	if c.NFS == "" {
+		return nil, false
+	}
+
+	_, exportPath, _ := strings.Cut(expand(c.NFS, hostName), ":")
+
+	clients := c.ExportClients
+	if clients == "" {
+		clients = "*"
+		if cidr.IsValid() {
+			clients = cidr.String()
+		}
+	}
+
+	mode := "rw"
+	if c.ReadOnly {
+		mode = "ro"
+	}
+
+	// Diskless roots are owned by root, so root mustn't be squashed
+	return &Export{
+		Path:   exportPath,
+		Client: clients + "(" + mode + ",sync,no_subtree_check,no_root_squash)",
+	}, true
+}
+
+// ExportsFile renders exports as /etc/exports lines, with one line per path listing
+// each of its clients once
+func ExportsFile(exports []*Export) string {
+	paths := []string{}
+	clients := make(map[string][]string)
+
+	for _, export := range exports {
+		if _, ok := clients[export.Path]; !ok {
+			paths = append(paths, export.Path)
+		}
+
+		if !slices.Contains(clients[export.Path], export.Client) {
+			clients[export.Path] = append(clients[export.Path], export.Client)
+		}
+	}
+
+	var b strings.Builder
+	for _, exportPath := range paths {
+		fmt.Fprintf(&b, "%s %s\n", exportPath, strings.Join(clients[exportPath], " "))
+	}
+
+	return b.String()
+}
+
+func expand(s string, hostName string) string {
+	return strings.ReplaceAll(s, namePlaceholder, hostName)
+}
@@ -0,0 +1,220 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"text/template"
+
+	"github.com/davejbax/pixie/internal/audit"
+)
+
+// MQTT 3.1.1 control packet types, in the high nibble of the first byte
+const (
+	mqttConnect    = 0x10
+	mqttConnAck    = 0x20
+	mqttPublish    = 0x30
+	mqttDisconnect = 0xe0
+)
+
+// Keep alive sent in CONNECT. Connections only last for a single publish.
+const mqttKeepAlive = 30
+
+var (
+	errNoBroker         = errors.New("a broker address is required")
+	errNoTopic          = errors.New("a topic is required")
+	errMQTTConnRefused  = errors.New("MQTT broker refused connection")
+	errMQTTUnexpected   = errors.New("unexpected packet from MQTT broker")
+	errMQTTTooLarge     = errors.New("MQTT packet too large")
+	errMQTTStringLength = errors.New("MQTT string too long")
+)
+
+// MQTTConfig publishes events to an MQTT broker, using MQTT 3.1.1 with QoS 0
+type MQTTConfig struct {
+	TargetConfig `mapstructure:",squash"`
+
+	// Address of the broker, as host:port
+	Broker string
+
+	// Topic to publish to, as a Go template executed with the event, e.g.
+	// 'pixie/{{ .Type }}'
+	Topic string
+
+	ClientID string `mapstructure:"client_id" default:"pixie"`
+	Username string
+	Password string
+}
+
+type mqtt struct {
+	config *MQTTConfig
+	topic  *template.Template
+}
+
+func newMQTT(config *MQTTConfig) (*mqtt, error) {
+	if config.Broker == "" {
+		return nil, errNoBroker
+	}
+
+	if config.Topic == "" {
+		return nil, errNoTopic
+	}
+
+	topic, err := parseTemplate("topic", config.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mqtt{config: config, topic: topic}, nil
+}
+
+// send connects to the broker, publishes the payload and disconnects. As the publish is
+// QoS 0, the broker doesn't acknowledge it, but TCP ordering ensures that it is received
+// before the disconnect.
+func (m *mqtt) send(ctx context.Context, event *audit.Event, payload []byte) error {
+	topic, err := renderPayload(m.topic, event)
+	if err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", m.config.Broker)
+	if err != nil {
+		return fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	connect, err := m.connectPacket()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(connect); err != nil {
+		return fmt.Errorf("failed to send MQTT CONNECT: %w", err)
+	}
+
+	if err := readConnAck(conn); err != nil {
+		return err
+	}
+
+	publish := &bytes.Buffer{}
+	if err := writeMQTTString(publish, string(topic)); err != nil {
+		return err
+	}
+
+	publish.Write(payload)
+
+	packet, err := mqttPacket(mqttPublish, publish.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		return fmt.Errorf("failed to send MQTT PUBLISH: %w", err)
+	}
+
+	if _, err := conn.Write([]byte{mqttDisconnect, 0}); err != nil {
+		return fmt.Errorf("failed to send MQTT DISCONNECT: %w", err)
+	}
+
+	return nil
+}
+
+func (m *mqtt) connectPacket() ([]byte, error) {
+	// Clean session
+	flags := byte(0x02)
+	if m.config.Username != "" {
+		flags |= 0x80
+	}
+
+	if m.config.Password != "" {
+		flags |= 0x40
+	}
+
+	body := &bytes.Buffer{}
+	_ = writeMQTTString(body, "MQTT")
+	body.WriteByte(4) // Protocol level for 3.1.1
+	body.WriteByte(flags)
+	_ = binary.Write(body, binary.BigEndian, uint16(mqttKeepAlive))
+
+	// The payload has the client ID, and then the username and password if present
+	fields := []string{m.config.ClientID}
+	if m.config.Username != "" {
+		fields = append(fields, m.config.Username)
+	}
+
+	if m.config.Password != "" {
+		fields = append(fields, m.config.Password)
+	}
+
+	for _, field := range fields {
+		if err := writeMQTTString(body, field); err != nil {
+			return nil, err
+		}
+	}
+
+	return mqttPacket(mqttConnect, body.Bytes())
+}
+
+func readConnAck(r io.Reader) error {
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(r, ack); err != nil {
+		return fmt.Errorf("failed to read MQTT CONNACK: %w", err)
+	}
+
+	if ack[0] != mqttConnAck || ack[1] != 2 {
+		return fmt.Errorf("packet type 0x%02x: %w", ack[0], errMQTTUnexpected)
+	}
+
+	if ack[3] != 0 {
+		return fmt.Errorf("return code %d: %w", ack[3], errMQTTConnRefused)
+	}
+
+	return nil
+}
+
+// mqttPacket prepends the fixed header to a packet body
+func mqttPacket(header byte, body []byte) ([]byte, error) {
+	// The remaining length is a variable length integer of up to four bytes
+	length := len(body)
+	if length > 268435455 {
+		return nil, errMQTTTooLarge
+	}
+
+	packet := []byte{header}
+	for {
+		b := byte(length % 128)
+		length /= 128
+
+		if length > 0 {
+			b |= 0x80
+		}
+
+		packet = append(packet, b)
+
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(packet, body...), nil
+}
+
+// writeMQTTString writes a string prefixed with its two byte length
+func writeMQTTString(buff *bytes.Buffer, s string) error {
+	if len(s) > 0xffff {
+		return errMQTTStringLength
+	}
+
+	_ = binary.Write(buff, binary.BigEndian, uint16(len(s)))
+	buff.WriteString(s)
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davejbax/pixie/internal/audit"
+)
+
+func TestMQTTPacketRemainingLength(t *testing.T) {
+	// Boundaries of each encoded length, from the table in MQTT 3.1.1 section 2.2.3. The
+	// largest lengths are left out, as they need bodies of hundreds of megabytes.
+	tests := []struct {
+		length int
+		want   []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+
+	for _, test := range tests {
+		packet, err := mqttPacket(mqttPublish, make([]byte, test.length))
+		if err != nil {
+			t.Fatalf("mqttPacket(%d bytes) error = %v", test.length, err)
+		}
+
+		header := append([]byte{mqttPublish}, test.want...)
+		if !bytes.Equal(packet[:len(header)], header) || len(packet) != len(header)+test.length {
+			t.Errorf("mqttPacket(%d bytes) header = % x, want % x", test.length, packet[:len(header)], header)
+		}
+	}
+}
+
+func TestMQTTConnectPacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		config MQTTConfig
+		want   []byte
+	}{
+		{
+			name:   "anonymous",
+			config: MQTTConfig{ClientID: "pixie"},
+			want: []byte("\x10\x11" +
+				"\x00\x04MQTT\x04\x02\x00\x1e" +
+				"\x00\x05pixie"),
+		},
+		{
+			name:   "username and password",
+			config: MQTTConfig{ClientID: "pixie", Username: "boot", Password: "s3cret"},
+			want: []byte("\x10\x1f" +
+				"\x00\x04MQTT\x04\xc2\x00\x1e" +
+				"\x00\x05pixie" +
+				"\x00\x04boot" +
+				"\x00\x06s3cret"),
+		},
+		{
+			name:   "username only",
+			config: MQTTConfig{ClientID: "pixie", Username: "boot"},
+			want: []byte("\x10\x17" +
+				"\x00\x04MQTT\x04\x82\x00\x1e" +
+				"\x00\x05pixie" +
+				"\x00\x04boot"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &mqtt{config: &test.config}
+
+			got, err := m.connectPacket()
+			if err != nil {
+				t.Fatalf("connectPacket() error = %v", err)
+			}
+
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("connectPacket() = % x, want % x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadConnAck(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  []byte
+		wantErr error
+	}{
+		{
+			name:   "accepted",
+			packet: []byte{0x20, 0x02, 0x00, 0x00},
+		},
+		{
+			name:   "accepted with session present",
+			packet: []byte{0x20, 0x02, 0x01, 0x00},
+		},
+		{
+			name:    "not authorised",
+			packet:  []byte{0x20, 0x02, 0x00, 0x05},
+			wantErr: errMQTTConnRefused,
+		},
+		{
+			name:    "not a CONNACK",
+			packet:  []byte{0x90, 0x03, 0x00, 0x01},
+			wantErr: errMQTTUnexpected,
+		},
+		{
+			name:    "wrong remaining length",
+			packet:  []byte{0x20, 0x03, 0x00, 0x00},
+			wantErr: errMQTTUnexpected,
+		},
+		{
+			name:    "connection closed",
+			packet:  []byte{0x20, 0x02},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := readConnAck(bytes.NewReader(test.packet)); !errors.Is(err, test.wantErr) {
+				t.Errorf("readConnAck() error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestMQTTSend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+
+		connect := make([]byte, 19)
+		if _, err := io.ReadFull(conn, connect); err != nil {
+			received <- nil
+			return
+		}
+
+		_, _ = conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+
+		rest, _ := io.ReadAll(conn)
+		received <- append(connect, rest...)
+	}()
+
+	m, err := newMQTT(&MQTTConfig{
+		Broker:   listener.Addr().String(),
+		Topic:    "pixie/{{ .Type }}",
+		ClientID: "pixie",
+	})
+	if err != nil {
+		t.Fatalf("newMQTT() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := m.send(ctx, &audit.Event{Type: audit.EventInstallComplete}, []byte(`{"host":"web1"}`)); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+
+	want := []byte("\x10\x11\x00\x04MQTT\x04\x02\x00\x1e\x00\x05pixie" +
+		"\x30\x27\x00\x16pixie/install_complete{\"host\":\"web1\"}" +
+		"\xe0\x00")
+
+	if got := <-received; !bytes.Equal(got, want) {
+		t.Errorf("broker received % x, want % x", got, want)
+	}
+}
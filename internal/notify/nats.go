@@ -0,0 +1,147 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+
+	"github.com/davejbax/pixie/internal/audit"
+)
+
+var (
+	errNoServer       = errors.New("a server address is required")
+	errNoSubject      = errors.New("a subject is required")
+	errInvalidSubject = errors.New("subject must not contain whitespace")
+	errNATSError      = errors.New("NATS server returned an error")
+	errNATSUnexpected = errors.New("unexpected message from NATS server")
+)
+
+// NATSConfig publishes events to a NATS subject
+type NATSConfig struct {
+	TargetConfig `mapstructure:",squash"`
+
+	// Address of the server, as host:port
+	Server string
+
+	// Subject to publish to, as a Go template executed with the event, e.g.
+	// 'pixie.{{ .Type }}'
+	Subject string
+
+	// Credentials, if the server requires them: either a token, or a username and
+	// password
+	Token    string
+	Username string
+	Password string
+}
+
+type nats struct {
+	config  *NATSConfig
+	subject *template.Template
+}
+
+func newNATS(config *NATSConfig) (*nats, error) {
+	if config.Server == "" {
+		return nil, errNoServer
+	}
+
+	if config.Subject == "" {
+		return nil, errNoSubject
+	}
+
+	subject, err := parseTemplate("subject", config.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nats{config: config, subject: subject}, nil
+}
+
+// natsConnect is the body of the NATS CONNECT message
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	Token    string `json:"auth_token,omitempty"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+}
+
+// send connects to the server, publishes the payload, and waits for the server to answer
+// a PING, which it only does after processing the publish
+func (n *nats) send(ctx context.Context, event *audit.Event, payload []byte) error {
+	subject, err := renderPayload(n.subject, event)
+	if err != nil {
+		return err
+	}
+
+	if strings.ContainsAny(string(subject), " \t\r\n") {
+		return fmt.Errorf("'%s': %w", subject, errInvalidSubject)
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", n.config.Server)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS server: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	// The server greets clients with INFO
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read NATS INFO: %w", err)
+	}
+
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("'%s': %w", strings.TrimSpace(line), errNATSUnexpected)
+	}
+
+	connect, err := json.Marshal(&natsConnect{
+		Name:    "pixie",
+		Lang:    "go",
+		Version: "1.0.0",
+		Token:   n.config.Token,
+		User:    n.config.Username,
+		Pass:    n.config.Password,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode NATS CONNECT: %w", err)
+	}
+
+	message := fmt.Sprintf("CONNECT %s\r\nPUB %s %d\r\n%s\r\nPING\r\n", connect, subject, len(payload), payload)
+	if _, err := conn.Write([]byte(message)); err != nil {
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read NATS response: %w", err)
+		}
+
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("%s: %w", line, errNATSError)
+		case line == "PING":
+			if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+				return fmt.Errorf("failed to answer NATS PING: %w", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Package notify sends boot events (such as a host downloading its kernel, an install
+// completing, or a reconcile failing) to external systems: HTTP webhooks, MQTT brokers
+// and NATS servers. Payloads are templated, so that they can match what an inventory
+// system or chat service expects, and failed deliveries are retried.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/creasty/defaults"
+	"github.com/davejbax/pixie/internal/audit"
+)
+
+var errUnknownEvent = errors.New("unknown event type")
+
+// Event types that targets can subscribe to
+var eventTypes = []audit.EventType{
+	audit.EventDHCPOffer,
+	audit.EventBootloader,
+	audit.EventConfig,
+	audit.EventKernel,
+	audit.EventInitrd,
+	audit.EventInstallStatus,
+	audit.EventInstallComplete,
+	audit.EventReconciled,
+	audit.EventReconcileFailed,
+	audit.EventDistroUpdateAvailable,
+	audit.EventArtifactCorrupt,
+}
+
+type Config struct {
+	Webhooks []WebhookConfig
+	MQTT     []MQTTConfig `mapstructure:"mqtt"`
+	NATS     []NATSConfig `mapstructure:"nats"`
+
+	// Number of events queued for each target before further events are dropped, e.g.
+	// while a target is down and deliveries are being retried
+	QueueSize int `mapstructure:"queue_size" default:"256"`
+}
+
+// TargetConfig is the configuration shared by all kinds of target
+type TargetConfig struct {
+	// Event types to send, e.g. 'kernel', 'install_complete' or 'reconcile_failed'. If
+	// empty, all events are sent.
+	Events []string
+
+	// Go template of the payload, executed with the event. The 'json' function encodes a
+	// value as JSON, e.g. '{"text": {{ json .Host }}}'. If empty, the event is sent as
+	// JSON.
+	Template string
+
+	// Number of times a failed delivery is retried
+	Retries int `default:"3"`
+
+	// Delay before the first retry, doubling with each further retry
+	RetryDelay time.Duration `mapstructure:"retry_delay" default:"5s"`
+
+	// Time allowed for each delivery attempt
+	Timeout time.Duration `default:"10s"`
+}
+
+// sender delivers a payload to a target
+type sender interface {
+	send(ctx context.Context, event *audit.Event, payload []byte) error
+}
+
+// target is a destination for events, with its own queue so that a slow or failing
+// target doesn't hold up the others
+type target struct {
+	name    string
+	config  TargetConfig
+	sender  sender
+	payload *template.Template
+	queue   chan audit.Event
+}
+
+// Notifier sends events to targets. It is an [audit.Sink].
+type Notifier struct {
+	logger  *slog.Logger
+	targets []*target
+}
+
+var _ audit.Sink = &Notifier{}
+
+func New(logger *slog.Logger, config *Config) (*Notifier, error) {
+	n := &Notifier{logger: logger}
+
+	for i := range config.Webhooks {
+		webhook := config.Webhooks[i]
+		if err := defaults.Set(&webhook); err != nil {
+			return nil, fmt.Errorf("failed to set webhook defaults: %w", err)
+		}
+
+		s, err := newWebhook(&webhook)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook %d: %w", i, err)
+		}
+
+		if err := n.add(fmt.Sprintf("webhook[%d]", i), webhook.TargetConfig, s, config.QueueSize); err != nil {
+			return nil, fmt.Errorf("invalid webhook %d: %w", i, err)
+		}
+	}
+
+	for i := range config.MQTT {
+		mqtt := config.MQTT[i]
+		if err := defaults.Set(&mqtt); err != nil {
+			return nil, fmt.Errorf("failed to set MQTT defaults: %w", err)
+		}
+
+		s, err := newMQTT(&mqtt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MQTT target %d: %w", i, err)
+		}
+
+		if err := n.add(fmt.Sprintf("mqtt[%d]", i), mqtt.TargetConfig, s, config.QueueSize); err != nil {
+			return nil, fmt.Errorf("invalid MQTT target %d: %w", i, err)
+		}
+	}
+
+	for i := range config.NATS {
+		nats := config.NATS[i]
+		if err := defaults.Set(&nats); err != nil {
+			return nil, fmt.Errorf("failed to set NATS defaults: %w", err)
+		}
+
+		s, err := newNATS(&nats)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NATS target %d: %w", i, err)
+		}
+
+		if err := n.add(fmt.Sprintf("nats[%d]", i), nats.TargetConfig, s, config.QueueSize); err != nil {
+			return nil, fmt.Errorf("invalid NATS target %d: %w", i, err)
+		}
+	}
+
+	return n, nil
+}
+
+func (n *Notifier) add(name string, config TargetConfig, s sender, queueSize int) error {
+	for _, event := range config.Events {
+		if !slices.Contains(eventTypes, audit.EventType(event)) {
+			return fmt.Errorf("'%s': %w", event, errUnknownEvent)
+		}
+	}
+
+	payload, err := parseTemplate(name, config.Template)
+	if err != nil {
+		return err
+	}
+
+	n.targets = append(n.targets, &target{
+		name:    name,
+		config:  config,
+		sender:  s,
+		payload: payload,
+		queue:   make(chan audit.Event, max(queueSize, 1)),
+	})
+
+	return nil
+}
+
+// Empty returns whether the notifier has no targets
+func (n *Notifier) Empty() bool {
+	return len(n.targets) == 0
+}
+
+// Send queues the event for each target subscribed to it. If a target's queue is full,
+// the event is dropped for that target.
+func (n *Notifier) Send(event audit.Event) {
+	for _, t := range n.targets {
+		if len(t.config.Events) > 0 && !slices.Contains(t.config.Events, string(event.Type)) {
+			continue
+		}
+
+		select {
+		case t.queue <- event:
+		default:
+			n.logger.Warn("dropping event, as notification queue is full",
+				"target", t.name,
+				"type", event.Type,
+				"host", event.Host,
+			)
+		}
+	}
+}
+
+// Run delivers queued events until the context is cancelled
+func (n *Notifier) Run(ctx context.Context) error {
+	wg := sync.WaitGroup{}
+
+	for _, t := range n.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.run(ctx, t)
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+func (n *Notifier) run(ctx context.Context, t *target) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-t.queue:
+			if err := n.deliver(ctx, t, &event); err != nil && ctx.Err() == nil {
+				n.logger.Error("failed to deliver event",
+					"target", t.name,
+					"type", event.Type,
+					"host", event.Host,
+					"error", err,
+				)
+			}
+		}
+	}
+}
+
+// deliver sends the event to the target, retrying failures with exponential backoff
+func (n *Notifier) deliver(ctx context.Context, t *target, event *audit.Event) error {
+	payload, err := renderPayload(t.payload, event)
+	if err != nil {
+		return err
+	}
+
+	delay := t.config.RetryDelay
+
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, t.config.Timeout)
+		err = t.sender.send(attemptCtx, event, payload)
+		cancel()
+
+		if err == nil || attempt >= t.config.Retries {
+			return err
+		}
+
+		n.logger.Warn("failed to deliver event, retrying",
+			"target", t.name,
+			"type", event.Type,
+			"retry_in", delay,
+			"error", err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err() //nolint:wrapcheck
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+// parseTemplate parses a payload or topic template. Empty templates return nil.
+func parseTemplate(name string, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
+		"json": func(value any) (string, error) {
+			data, err := json.Marshal(value)
+			return string(data), err //nolint:wrapcheck
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+// renderPayload executes the payload template with the event, or encodes the event as
+// JSON if there is no template
+func renderPayload(tmpl *template.Template, event *audit.Event) ([]byte, error) {
+	if tmpl == nil {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode event: %w", err)
+		}
+
+		return data, nil
+	}
+
+	buff := &bytes.Buffer{}
+	if err := tmpl.Execute(buff, event); err != nil {
+		return nil, fmt.Errorf("failed to execute payload template: %w", err)
+	}
+
+	return buff.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/davejbax/pixie/internal/audit"
+)
+
+var (
+	errNoURL         = errors.New("a URL is required")
+	errWebhookStatus = errors.New("webhook returned an unsuccessful status")
+)
+
+// WebhookConfig sends events as HTTP requests
+type WebhookConfig struct {
+	TargetConfig `mapstructure:",squash"`
+
+	URL    string
+	Method string `default:"POST"`
+
+	// Extra request headers, e.g. for authentication
+	Headers map[string]string
+
+	ContentType string `mapstructure:"content_type" default:"application/json"`
+}
+
+type webhook struct {
+	config *WebhookConfig
+	client *http.Client
+}
+
+func newWebhook(config *WebhookConfig) (*webhook, error) {
+	if config.URL == "" {
+		return nil, errNoURL
+	}
+
+	return &webhook{
+		config: config,
+		client: &http.Client{},
+	}, nil
+}
+
+func (w *webhook) send(ctx context.Context, _ *audit.Event, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, w.config.Method, w.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", w.config.ContentType)
+	req.Header.Set("User-Agent", "pixie")
+
+	for name, value := range w.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so that the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %w", resp.Status, errWebhookStatus)
+	}
+
+	return nil
+}
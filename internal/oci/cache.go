@@ -0,0 +1,162 @@
+package oci
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Cache keeps blobs by their digest, so that blobs shared by several artifacts, or left
+// unchanged between versions of an artifact, are only downloaded once
+type Cache struct {
+	directory string
+}
+
+func NewCache(directory string) *Cache {
+	return &Cache{directory: directory}
+}
+
+// path returns where the blob with the given digest is kept. Digests are validated
+// before they reach here, but the path is checked anyway, as digests come from remote
+// manifests.
+func (c *Cache) path(blobDigest string) (string, error) {
+	if !digestPattern.MatchString(blobDigest) {
+		return "", fmt.Errorf("'%s': %w", blobDigest, errInvalidReference)
+	}
+
+	algorithm, encoded, _ := strings.Cut(blobDigest, ":")
+
+	return filepath.Join(c.directory, "blobs", algorithm, encoded), nil
+}
+
+// Has returns whether the blob with the given digest is in the cache
+func (c *Cache) Has(blobDigest string) bool {
+	path, err := c.path(blobDigest)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(path)
+
+	return err == nil
+}
+
+// Fetch downloads the blob into the cache, if it isn't already there, and then links
+// (or, across file systems, copies) it to output
+func (c *Cache) Fetch(client *Client, ref *Reference, blob *Descriptor, output string) error {
+	path, err := c.path(blob.Digest)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		if err := c.download(client, ref, blob, path); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to stat cached blob: %w", err)
+	}
+
+	if err := os.Remove(output); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to replace '%s': %w", output, err)
+	}
+
+	if err := os.Link(path, output); err == nil {
+		return nil
+	}
+
+	return copyFile(path, output)
+}
+
+// download fetches a blob into the cache. Blobs are written to a temporary file and
+// renamed once their digest has been checked, so that the cache only has whole blobs.
+func (c *Cache) download(client *Client, ref *Reference, blob *Descriptor, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create blob cache directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".blob-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary blob file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := client.FetchBlob(ref, blob, tmp); err != nil {
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close blob file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to move blob into cache: %w", err)
+	}
+
+	return nil
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return fmt.Errorf("failed to open cached blob: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy cached blob: %w", err)
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %w", err)
+	}
+
+	return nil
+}
+
+// Usage returns the number and total size of the cached blobs. An empty cache has no
+// directory, and so no usage.
+func (c *Cache) Usage() (int, int64, error) {
+	blobs := 0
+	size := int64(0)
+
+	err := filepath.WalkDir(filepath.Join(c.directory, "blobs"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Temporary files are blobs still being downloaded
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".blob-") {
+			return nil
+		}
+
+		// Blobs may be removed while the cache is walked
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		blobs++
+		size += info.Size()
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, fmt.Errorf("failed to read blob cache: %w", err)
+	}
+
+	return blobs, size, nil
+}
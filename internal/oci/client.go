@@ -0,0 +1,472 @@
+// Package oci pulls and pushes artifacts from OCI registries, such as files pushed with
+// ORAS, using the OCI distribution API
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Largest manifest that is read. Registries commonly reject manifests larger than this.
+const maxManifestSize = 4 * 1024 * 1024
+
+var (
+	errRegistryStatus   = errors.New("registry returned an unsuccessful status")
+	errDigestMismatch   = errors.New("digest of content does not match")
+	errUnauthorized     = errors.New("registry rejected credentials")
+	errUnknownChallenge = errors.New("unsupported authentication challenge from registry")
+	errNoToken          = errors.New("token service returned no token")
+	errNoUploadLocation = errors.New("registry did not return an upload location")
+)
+
+// Config has the credentials and settings of registries that artifacts are pulled from
+// and pushed to
+type Config struct {
+	// Registries that aren't listed are used anonymously, over HTTPS
+	Registries []RegistryConfig
+}
+
+type RegistryConfig struct {
+	// Host of the registry, as in references, e.g. 'ghcr.io' or 'registry.local:5000'
+	Host string
+
+	Username string
+	Password string
+
+	// Connect over HTTP rather than HTTPS, e.g. for a registry on the local network
+	PlainHTTP bool `mapstructure:"plain_http"`
+}
+
+// registry returns the config of the registry with the given host
+func (c *Config) registry(host string) *RegistryConfig {
+	for i := range c.Registries {
+		if c.Registries[i].Host == host {
+			return &c.Registries[i]
+		}
+	}
+
+	return &RegistryConfig{Host: host}
+}
+
+// Client makes requests to registries, authenticating as each registry asks
+type Client struct {
+	client *http.Client
+	config *Config
+
+	mu sync.Mutex
+
+	// Authorization header values by registry and scope
+	authorizations map[string]string
+}
+
+func NewClient(client *http.Client, config *Config) *Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if config == nil {
+		config = &Config{}
+	}
+
+	return &Client{
+		client:         client,
+		config:         config,
+		authorizations: make(map[string]string),
+	}
+}
+
+// Resolve fetches the manifest that the reference points to, returning it and its
+// digest. If the reference is to an index of manifests for several platforms, the
+// manifest for the given arch is returned.
+func (c *Client) Resolve(ref *Reference, arch string) (*Manifest, string, error) {
+	data, mediaType, err := c.fetchManifest(ref, ref.version())
+	if err != nil {
+		return nil, "", err
+	}
+
+	manifestDigest := digest(data)
+
+	if ref.Digest != "" && manifestDigest != ref.Digest {
+		return nil, "", fmt.Errorf("manifest of '%s': %w", ref, errDigestMismatch)
+	}
+
+	if mediaType == MediaTypeIndex || mediaType == mediaTypeDockerList {
+		var idx index
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return nil, "", fmt.Errorf("failed to decode index of '%s': %w", ref, err)
+		}
+
+		descriptor, err := idx.selectPlatform(arch)
+		if err != nil {
+			return nil, "", fmt.Errorf("'%s': %w", ref, err)
+		}
+
+		data, mediaType, err = c.fetchManifest(ref, descriptor.Digest)
+		if err != nil {
+			return nil, "", err
+		}
+
+		manifestDigest = digest(data)
+		if manifestDigest != descriptor.Digest {
+			return nil, "", fmt.Errorf("manifest of '%s' for arch '%s': %w", ref, arch, errDigestMismatch)
+		}
+	}
+
+	if mediaType != MediaTypeManifest {
+		return nil, "", fmt.Errorf("'%s' is '%s': %w", ref, mediaType, errUnsupportedManifest)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, "", fmt.Errorf("failed to decode manifest of '%s': %w", ref, err)
+	}
+
+	return &manifest, manifestDigest, nil
+}
+
+func (c *Client) fetchManifest(ref *Reference, version string) ([]byte, string, error) {
+	resp, err := c.do(ref, false, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, c.url(ref, "manifests", version), nil)
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		req.Header.Set("Accept", strings.Join([]string{MediaTypeManifest, MediaTypeIndex, mediaTypeDockerList}, ", "))
+
+		return req, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", statusError(resp)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest of '%s': %w", ref, err)
+	}
+
+	// The media type is in the manifest too, but the header is what registries go by
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+
+	return data, strings.TrimSpace(mediaType), nil
+}
+
+// FetchBlob writes the blob with the given descriptor to w, checking its digest
+func (c *Client) FetchBlob(ref *Reference, blob *Descriptor, w io.Writer) error {
+	resp, err := c.do(ref, false, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, c.url(ref, "blobs", blob.Digest), nil) //nolint:wrapcheck
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+
+	hash := sha256.New()
+
+	written, err := io.Copy(io.MultiWriter(w, hash), io.LimitReader(resp.Body, blob.Size+1))
+	if err != nil {
+		return fmt.Errorf("failed to read blob '%s': %w", blob.Digest, err)
+	}
+
+	if written != blob.Size || "sha256:"+hex.EncodeToString(hash.Sum(nil)) != blob.Digest {
+		return fmt.Errorf("blob '%s': %w", blob.Digest, errDigestMismatch)
+	}
+
+	return nil
+}
+
+// PushBlob uploads the blob with the given descriptor, unless the registry already has
+// it
+func (c *Client) PushBlob(ref *Reference, blob *Descriptor, content io.ReadSeeker) error {
+	resp, err := c.do(ref, true, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, c.url(ref, "blobs", blob.Digest), nil) //nolint:wrapcheck
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	resp, err = c.do(ref, true, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, c.url(ref, "blobs", "uploads")+"/", nil) //nolint:wrapcheck
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return statusError(resp)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("failed to start upload of blob '%s': %w", blob.Digest, errNoUploadLocation)
+	}
+
+	query := location.Query()
+	query.Set("digest", blob.Digest)
+	location.RawQuery = query.Encode()
+
+	resp, err = c.do(ref, true, func() (*http.Request, error) {
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		req, err := http.NewRequest(http.MethodPut, location.String(), io.NopCloser(content))
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		req.ContentLength = blob.Size
+		req.Header.Set("Content-Type", "application/octet-stream")
+
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return statusError(resp)
+	}
+
+	return nil
+}
+
+// PushManifest uploads a manifest, and tags it with the reference's tag, returning its
+// digest
+func (c *Client) PushManifest(ref *Reference, manifest []byte, mediaType string) (string, error) {
+	resp, err := c.do(ref, true, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, c.url(ref, "manifests", ref.version()), strings.NewReader(string(manifest)))
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		req.Header.Set("Content-Type", mediaType)
+
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", statusError(resp)
+	}
+
+	return digest(manifest), nil
+}
+
+func (c *Client) url(ref *Reference, kind string, name string) string {
+	scheme := "https"
+	if c.config.registry(ref.Registry).PlainHTTP {
+		scheme = "http"
+	}
+
+	return (&url.URL{
+		Scheme: scheme,
+		Host:   ref.host(),
+		Path:   "/v2/" + ref.Repository + "/" + kind + "/" + name,
+	}).String()
+}
+
+// do makes a request, authenticating and retrying it if the registry asks. Requests are
+// created by newRequest, so that a request with a body can be made again.
+func (c *Client) do(ref *Reference, push bool, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	scope := "repository:" + ref.Repository + ":pull"
+	if push {
+		scope += ",push"
+	}
+
+	key := ref.Registry + " " + scope
+
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create registry request: %w", err)
+		}
+
+		c.mu.Lock()
+		authorization := c.authorizations[key]
+		c.mu.Unlock()
+
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		req.Header.Set("User-Agent", "pixie")
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("registry request failed: %w", err)
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			return resp, nil
+		}
+
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		// The credentials from the challenge were rejected
+		if attempt > 0 {
+			return nil, fmt.Errorf("'%s': %w", ref.Registry, errUnauthorized)
+		}
+
+		authorization, err = c.authenticate(ref, scope, challenge)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		c.authorizations[key] = authorization
+		c.mu.Unlock()
+	}
+}
+
+// authenticate answers the registry's challenge, returning the Authorization header to
+// make requests with
+func (c *Client) authenticate(ref *Reference, scope string, challenge string) (string, error) {
+	registry := c.config.registry(ref.Registry)
+
+	scheme, params := parseChallenge(challenge)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		credentials := base64.StdEncoding.EncodeToString([]byte(registry.Username + ":" + registry.Password))
+		return "Basic " + credentials, nil
+	case "bearer":
+		token, err := c.fetchToken(registry, params, scope)
+		if err != nil {
+			return "", err
+		}
+
+		return "Bearer " + token, nil
+	default:
+		return "", fmt.Errorf("'%s': %w", challenge, errUnknownChallenge)
+	}
+}
+
+// fetchToken gets a token from the token service named in a bearer challenge, as
+// anonymous or with the registry's credentials
+func (c *Client) fetchToken(registry *RegistryConfig, params map[string]string, scope string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm '%s': %w", params["realm"], errUnknownChallenge)
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %w", err)
+	}
+
+	if registry.Username != "" {
+		req.SetBasicAuth(registry.Username, registry.Password)
+	}
+
+	req.Header.Set("User-Agent", "pixie")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("token service '%s': %w", realm.Host, errUnauthorized)
+	} else if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+
+	if body.Token != "" {
+		return body.Token, nil
+	} else if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+
+	return "", errNoToken
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// 'Bearer realm="https://auth.example.com/token",service="registry.example.com"'
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := make(map[string]string)
+
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		var name string
+		name, rest, _ = strings.Cut(rest, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		value := ""
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				end = len(rest) - 1
+			}
+
+			value = rest[1 : end+1]
+			rest = rest[min(end+2, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			rest = "," + rest
+		}
+
+		params[name] = value
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), ","))
+	}
+
+	return scheme, params
+}
+
+func statusError(resp *http.Response) error {
+	status := resp.Status
+
+	// Registries explain errors in the body
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if message := strings.TrimSpace(string(body)); message != "" {
+		status += " (" + message + ")"
+	}
+
+	return fmt.Errorf("%s %s: %s: %w", resp.Request.Method, resp.Request.URL, status, errRegistryStatus)
+}
@@ -0,0 +1,122 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Media types of manifests and blobs
+const (
+	MediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+
+	// Docker's manifest list, which registries such as Docker Hub serve for multi-arch
+	// images instead of an OCI index
+	mediaTypeDockerList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// Config of artifacts that have none, as pushed by ORAS
+	MediaTypeEmpty = "application/vnd.oci.empty.v1+json"
+
+	// Files in artifacts that don't give a more specific type
+	MediaTypeFile = "application/octet-stream"
+)
+
+// AnnotationTitle names the file that a layer holds. ORAS sets this to the name of each
+// file that it pushes.
+const AnnotationTitle = "org.opencontainers.image.title"
+
+var (
+	errUnsupportedManifest = errors.New("unsupported manifest media type")
+	errNoPlatform          = errors.New("no manifest for platform in index")
+	errNoFile              = errors.New("no layer with title in artifact")
+)
+
+// The empty JSON object, which is the config blob of artifacts without a config
+var emptyConfig = []byte("{}")
+
+// Descriptor points at a blob or manifest by its digest
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *Platform         `json:"platform,omitempty"`
+}
+
+// Platform is the OS and architecture that a manifest in an index is for
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// Manifest is an OCI image manifest. ORAS artifacts are image manifests with an
+// artifact type, an empty config, and a layer for each file.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// index is an OCI image index (or Docker manifest list), listing a manifest per platform
+type index struct {
+	Manifests []Descriptor `json:"manifests"`
+}
+
+// File returns the layer holding the file with the given title
+func (m *Manifest) File(title string) (*Descriptor, error) {
+	i := slices.IndexFunc(m.Layers, func(layer Descriptor) bool {
+		return layer.Annotations[AnnotationTitle] == title
+	})
+	if i < 0 {
+		return nil, fmt.Errorf("'%s': %w", title, errNoFile)
+	}
+
+	return &m.Layers[i], nil
+}
+
+// platformArches maps arch names used in pixie configs to OCI architectures
+var platformArches = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+}
+
+// selectPlatform returns the manifest in the index for the given arch
+func (i *index) selectPlatform(arch string) (*Descriptor, error) {
+	ociArch, ok := platformArches[arch]
+	if !ok {
+		ociArch = arch
+	}
+
+	for _, manifest := range i.Manifests {
+		if manifest.Platform != nil && manifest.Platform.Architecture == ociArch {
+			return &manifest, nil
+		}
+	}
+
+	return nil, fmt.Errorf("arch '%s': %w", arch, errNoPlatform)
+}
+
+// digest returns the digest of the content, in the form used by registries
+func digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func encodeManifest(manifest *Manifest) ([]byte, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	return data, nil
+}
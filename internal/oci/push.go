@@ -0,0 +1,119 @@
+package oci
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Artifact types of the outputs that pixie pushes
+const (
+	ArtifactTypeISO = "application/vnd.pixie.iso.v1"
+	ArtifactTypeEFI = "application/vnd.pixie.efi.v1"
+)
+
+// AnnotationCreated is when an artifact was pushed
+const AnnotationCreated = "org.opencontainers.image.created"
+
+// File is a file pushed as a layer of an artifact
+type File struct {
+	Path string
+
+	// Title of the file in the artifact. Defaults to the file's base name.
+	Title string
+
+	// Media type of the layer. Defaults to [MediaTypeFile].
+	MediaType string
+}
+
+// Push uploads files as an artifact of the given type, in the same form as ORAS, so that
+// 'oras pull' (or pixie's OCI distro provider) can fetch them. The artifact is tagged
+// with the reference's tag, and its manifest's digest is returned.
+func (c *Client) Push(ref *Reference, artifactType string, files []File) (string, error) {
+	config := &Descriptor{
+		MediaType: MediaTypeEmpty,
+		Digest:    digest(emptyConfig),
+		Size:      int64(len(emptyConfig)),
+	}
+
+	if err := c.PushBlob(ref, config, bytes.NewReader(emptyConfig)); err != nil {
+		return "", fmt.Errorf("failed to push artifact config: %w", err)
+	}
+
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		ArtifactType:  artifactType,
+		Config:        *config,
+		Layers:        []Descriptor{},
+		Annotations: map[string]string{
+			AnnotationCreated: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+
+	for _, file := range files {
+		layer, err := c.pushFile(ref, file)
+		if err != nil {
+			return "", err
+		}
+
+		manifest.Layers = append(manifest.Layers, *layer)
+	}
+
+	data, err := encodeManifest(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	manifestDigest, err := c.PushManifest(ref, data, MediaTypeManifest)
+	if err != nil {
+		return "", fmt.Errorf("failed to push manifest: %w", err)
+	}
+
+	return manifestDigest, nil
+}
+
+func (c *Client) pushFile(ref *Reference, file File) (*Descriptor, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%s': %w", file.Path, err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash '%s': %w", file.Path, err)
+	}
+
+	title := file.Title
+	if title == "" {
+		title = filepath.Base(file.Path)
+	}
+
+	mediaType := file.MediaType
+	if mediaType == "" {
+		mediaType = MediaTypeFile
+	}
+
+	layer := &Descriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+		Size:      size,
+		Annotations: map[string]string{
+			AnnotationTitle: title,
+		},
+	}
+
+	if err := c.PushBlob(ref, layer, f); err != nil {
+		return nil, fmt.Errorf("failed to push '%s': %w", file.Path, err)
+	}
+
+	return layer, nil
+}
@@ -0,0 +1,112 @@
+package oci
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	dockerHub         = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+	defaultTag        = "latest"
+)
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestPattern     = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+	errInvalidReference = errors.New("invalid OCI reference")
+)
+
+// Reference names an artifact in a registry, e.g. 'ghcr.io/example/talos:v1.9.0' or
+// 'registry.local:5000/boot/kernel@sha256:...'
+type Reference struct {
+	// Host (and port) of the registry
+	Registry   string
+	Repository string
+
+	// Tag of the artifact. Ignored if Digest is set.
+	Tag    string
+	Digest string
+}
+
+// ParseReference parses a reference. As with Docker, references without a registry are
+// on Docker Hub, and references with neither a tag nor a digest are tagged 'latest'.
+func ParseReference(s string) (*Reference, error) {
+	ref := &Reference{}
+	rest := s
+
+	if name, digest, ok := strings.Cut(rest, "@"); ok {
+		if !digestPattern.MatchString(digest) {
+			return nil, fmt.Errorf("'%s' has unsupported digest: %w", s, errInvalidReference)
+		}
+
+		ref.Digest = digest
+		rest = name
+	}
+
+	// A tag follows the last colon, unless that colon is part of the registry's port
+	if i := strings.LastIndex(rest, ":"); i >= 0 && !strings.Contains(rest[i+1:], "/") {
+		ref.Tag = rest[i+1:]
+		rest = rest[:i]
+
+		if !tagPattern.MatchString(ref.Tag) {
+			return nil, fmt.Errorf("'%s' has invalid tag: %w", s, errInvalidReference)
+		}
+	}
+
+	// The first component is a registry if it looks like a host name
+	registry, repository, ok := strings.Cut(rest, "/")
+	if !ok || (!strings.ContainsAny(registry, ".:") && registry != "localhost") {
+		registry = dockerHub
+		repository = rest
+	}
+
+	if registry == dockerHub && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+
+	if !repositoryPattern.MatchString(repository) {
+		return nil, fmt.Errorf("'%s' has invalid repository: %w", s, errInvalidReference)
+	}
+
+	ref.Registry = registry
+	ref.Repository = repository
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+
+	return ref, nil
+}
+
+// String formats the reference, with its digest if it has one
+func (r *Reference) String() string {
+	name := r.Registry + "/" + r.Repository
+	if r.Digest != "" {
+		return name + "@" + r.Digest
+	}
+
+	return name + ":" + r.Tag
+}
+
+// version returns the tag or digest that the manifest is fetched by
+func (r *Reference) version() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+
+	return r.Tag
+}
+
+// host returns the host that the registry's API is served from
+func (r *Reference) host() string {
+	if r.Registry == dockerHub {
+		return dockerHubRegistry
+	}
+
+	return r.Registry
+}
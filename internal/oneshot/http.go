@@ -0,0 +1,148 @@
+package oneshot
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	// AssignmentPath is the API path for a host's one-shot assignment: GET shows it, PUT
+	// creates it (with optional 'until' and 'distro' query parameters, and 'netboot=true'
+	// to also network boot the host through its BMC), and DELETE removes it
+	AssignmentPath = "/api/hosts/{name}/oneshot"
+
+	// CompletePath is POSTed to by hosts at the end of their install, e.g. from a
+	// kickstart %post section. The token is signed for the host, so that other clients
+	// can't complete its install.
+	CompletePath = "/hosts/{name}/complete/{token}"
+)
+
+// AssignmentHandler serves the one-shot assignment API. known reports whether a host
+// with the given name exists, and knownDistro whether a distro does. netboot, if not
+// nil, makes the named host network boot now, when asked to with new assignments.
+func AssignmentHandler(logger *slog.Logger, store *Store, known func(name string) bool, knownDistro func(name string) bool, netboot func(ctx context.Context, name string) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !known(name) {
+			http.Error(w, "unknown host", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			assignment, ok := store.Get(name)
+			if !ok {
+				http.Error(w, "host has no one-shot assignment", http.StatusNotFound)
+				return
+			}
+
+			writeJSON(w, http.StatusOK, assignment)
+		case http.MethodPut:
+			until, err := ParseUntil(r.URL.Query().Get("until"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			distro := r.URL.Query().Get("distro")
+			if distro != "" && !knownDistro(distro) {
+				http.Error(w, "unknown distro", http.StatusBadRequest)
+				return
+			}
+
+			boot := r.URL.Query().Get("netboot") == "true"
+			if boot && netboot == nil {
+				http.Error(w, "network booting hosts isn't supported", http.StatusBadRequest)
+				return
+			}
+
+			assignment, err := store.Assign(name, until, distro)
+			if err != nil {
+				logger.Error("failed to save one-shot assignment",
+					"host", name,
+					"error", err,
+				)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			logger.Info("host assigned one-shot install",
+				"host", name,
+				"until", until,
+				"distro", distro,
+			)
+
+			// The assignment stands even if the host can't be booted now, as it can
+			// still be booted by other means
+			if boot {
+				if err := netboot(r.Context(), name); err != nil {
+					http.Error(w, "host assigned, but failed to network boot it: "+err.Error(), http.StatusBadGateway)
+					return
+				}
+			}
+
+			writeJSON(w, http.StatusOK, assignment)
+		case http.MethodDelete:
+			if err := store.Clear(name); err != nil {
+				logger.Error("failed to clear one-shot assignment",
+					"host", name,
+					"error", err,
+				)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			logger.Info("host one-shot assignment cleared",
+				"host", name,
+			)
+
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// CompleteHandler marks a host's one-shot install as complete when the host reports in.
+// onComplete, if not nil, is called with the name of each host whose install completes,
+// and the address that it reported from.
+func CompleteHandler(logger *slog.Logger, store *Store, onComplete func(name string, client string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		completed, err := store.Complete(name, UntilCompletion)
+		if err != nil {
+			logger.Error("failed to complete one-shot assignment",
+				"host", name,
+				"error", err,
+			)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if !completed {
+			http.Error(w, "host has no pending one-shot assignment", http.StatusNotFound)
+			return
+		}
+
+		logger.Info("host reported install complete, switching to local boot",
+			"host", name,
+			"client", r.RemoteAddr,
+		)
+
+		if onComplete != nil {
+			onComplete(name, r.RemoteAddr)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,275 @@
+// Package oneshot tracks one-shot boot assignments: hosts that should network boot into
+// their installer once, and then boot from local disk, so that they aren't reinstalled
+// on every reboot
+package oneshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/davejbax/pixie/internal/atomicfile"
+	"github.com/davejbax/pixie/internal/store"
+)
+
+var errInvalidUntil = errors.New("invalid one-shot condition, expected 'completion' or 'first-boot'")
+
+// Until is the event after which a host stops booting into its installer
+type Until string
+
+const (
+	// The host reports that its install has finished, by requesting [CompletePath]
+	UntilCompletion Until = "completion"
+
+	// The host's bootloader config has been served once with the installer in it
+	UntilFirstBoot Until = "first-boot"
+)
+
+// ParseUntil parses a one-shot condition. An empty string means [UntilCompletion].
+func ParseUntil(s string) (Until, error) {
+	switch Until(s) {
+	case "", UntilCompletion:
+		return UntilCompletion, nil
+	case UntilFirstBoot:
+		return UntilFirstBoot, nil
+	default:
+		return "", fmt.Errorf("'%s': %w", s, errInvalidUntil)
+	}
+}
+
+// Assignment is a one-shot boot of a host into its installer
+type Assignment struct {
+	Host    string    `json:"host"`
+	Until   Until     `json:"until"`
+	Created time.Time `json:"created"`
+
+	// Distro to boot instead of the host's own, if any
+	Distro string `json:"distro,omitempty"`
+
+	// When the install completed. Once set, the host boots from local disk.
+	Completed *time.Time `json:"completed,omitempty"`
+}
+
+// Pending returns whether the host should still boot into its installer
+func (a *Assignment) Pending() bool {
+	return a.Completed == nil
+}
+
+// Store holds one-shot assignments, persisting them to a JSON file or the state database
+// so that they survive restarts
+type Store struct {
+	path string
+	db   *store.DB
+
+	mu          sync.Mutex
+	assignments map[string]*Assignment
+}
+
+// Open loads the store at the given path, creating an empty store if it doesn't exist
+func Open(path string) (*Store, error) {
+	store := &Store{
+		path:        path,
+		assignments: make(map[string]*Assignment),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read one-shot assignments: %w", err)
+	}
+
+	var assignments []*Assignment
+	if err := json.Unmarshal(data, &assignments); err != nil {
+		return nil, fmt.Errorf("failed to decode one-shot assignments: %w", err)
+	}
+
+	for _, assignment := range assignments {
+		store.assignments[assignment.Host] = assignment
+	}
+
+	return store, nil
+}
+
+// OpenDB loads the store from the state database
+func OpenDB(db *store.DB) (*Store, error) {
+	stored, err := db.OneShots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load one-shot assignments: %w", err)
+	}
+
+	s := &Store{
+		db:          db,
+		assignments: make(map[string]*Assignment, len(stored)),
+	}
+
+	for _, assignment := range stored {
+		s.assignments[assignment.Host] = &Assignment{
+			Host:      assignment.Host,
+			Until:     Until(assignment.Until),
+			Distro:    assignment.Distro,
+			Created:   assignment.Created,
+			Completed: assignment.Completed,
+		}
+	}
+
+	return s, nil
+}
+
+// Reload replaces the assignments in memory with those persisted, e.g. after another
+// process (such as the CLI) has changed them
+func (s *Store) Reload() error {
+	var (
+		fresh *Store
+		err   error
+	)
+
+	if s.db != nil {
+		fresh, err = OpenDB(s.db)
+	} else {
+		fresh, err = Open(s.path)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.assignments = fresh.assignments
+
+	return nil
+}
+
+// Get returns the host's assignment, if it has one
+func (s *Store) Get(host string) (Assignment, bool) {
+	if s == nil {
+		return Assignment{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	assignment, ok := s.assignments[host]
+	if !ok {
+		return Assignment{}, false
+	}
+
+	return *assignment, true
+}
+
+// Assignments returns all assignments in the store
+func (s *Store) Assignments() []Assignment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	assignments := make([]Assignment, 0, len(s.assignments))
+	for _, assignment := range s.assignments {
+		assignments = append(assignments, *assignment)
+	}
+
+	return assignments
+}
+
+// Assign flags the host to boot into its installer once, replacing any existing
+// assignment. If distro is not empty, the host boots that distro's installer rather than
+// its own.
+func (s *Store) Assign(host string, until Until, distro string) (Assignment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	assignment := &Assignment{
+		Host:    host,
+		Until:   until,
+		Created: time.Now().UTC(),
+		Distro:  distro,
+	}
+
+	s.assignments[host] = assignment
+
+	return *assignment, s.persist(host)
+}
+
+// Clear removes the host's assignment, so that it boots as configured again
+func (s *Store) Clear(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.assignments[host]; !ok {
+		return nil
+	}
+
+	delete(s.assignments, host)
+	return s.persist(host)
+}
+
+// Complete marks the host's pending assignment as complete, if it has one whose
+// condition matches. It returns whether an assignment was completed.
+func (s *Store) Complete(host string, until Until) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	assignment, ok := s.assignments[host]
+	if !ok || !assignment.Pending() || assignment.Until != until {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	assignment.Completed = &now
+
+	return true, s.persist(host)
+}
+
+// persist writes the host's assignment, or its removal, to the state database, or
+// otherwise writes the whole store to disk. The caller must hold the lock.
+func (s *Store) persist(host string) error {
+	if s.db == nil {
+		return s.save()
+	}
+
+	assignment, ok := s.assignments[host]
+	if !ok {
+		return s.db.DeleteOneShot(host) //nolint:wrapcheck
+	}
+
+	return s.db.PutOneShot(&store.OneShot{ //nolint:wrapcheck
+		Host:      assignment.Host,
+		Until:     string(assignment.Until),
+		Distro:    assignment.Distro,
+		Created:   assignment.Created,
+		Completed: assignment.Completed,
+	})
+}
+
+// save writes the store to disk. The caller must hold the lock.
+func (s *Store) save() error {
+	assignments := make([]*Assignment, 0, len(s.assignments))
+	for _, assignment := range s.assignments {
+		assignments = append(assignments, assignment)
+	}
+
+	data, err := json.Marshal(assignments)
+	if err != nil {
+		return fmt.Errorf("failed to encode one-shot assignments: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create one-shot assignment directory: %w", err)
+	}
+
+	if err := atomicfile.Write(s.path, data); err != nil {
+		return fmt.Errorf("failed to write one-shot assignments: %w", err)
+	}
+
+	return nil
+}
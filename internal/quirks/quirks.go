@@ -0,0 +1,213 @@
+// Package quirks implements a table of workarounds for buggy network boot firmware,
+// matched against clients by DHCP vendor class, client architecture or MAC address
+// prefix
+package quirks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davejbax/pixie/internal/clients"
+)
+
+var errNoMatchers = errors.New("rule must have a vendor class, client architecture or MAC prefix")
+
+// Quirks are the adjustments made to how pixie serves a client
+type Quirks struct {
+	// Maximum TFTP block size to negotiate with the client. Zero means no limit.
+	MaxBlockSize int `mapstructure:"max_block_size"`
+
+	// Whether to refuse the TFTP windowsize option (RFC 7440), for clients that
+	// request it but can't cope with more than one block in flight
+	DisableWindowSize bool `mapstructure:"disable_window_size"`
+
+	// Whether to offer the BIOS boot file, even if the client claims to be UEFI
+	ForceBIOS bool `mapstructure:"force_bios"`
+
+	// Boot file to offer instead of the one chosen for the client's architecture, e.g.
+	// 'undionly.kpxe' for old BIOS option ROMs that can't cope with the usual one
+	BootFile string `mapstructure:"boot_file"`
+}
+
+// merge applies the quirks in other on top of q, taking the most conservative value
+// of each
+func (q *Quirks) merge(other *Quirks) {
+	if other.MaxBlockSize > 0 && (q.MaxBlockSize == 0 || other.MaxBlockSize < q.MaxBlockSize) {
+		q.MaxBlockSize = other.MaxBlockSize
+	}
+
+	q.DisableWindowSize = q.DisableWindowSize || other.DisableWindowSize
+	q.ForceBIOS = q.ForceBIOS || other.ForceBIOS
+
+	// There's no most conservative boot file, so the first rule to set one wins
+	if q.BootFile == "" {
+		q.BootFile = other.BootFile
+	}
+}
+
+// Rule applies quirks to clients matching its vendor class, client architectures and MAC
+// prefix. If several are given, clients must match all of them.
+//
+// The vendor class and architecture are only seen by DHCP and ProxyDHCP, which remember
+// the quirks they match for TFTP. TFTP finds these by the client's MAC address, looked
+// up by IP in the client registry. ProxyDHCP never learns clients' IPs, so for its
+// clients the MAC is found in the system ARP table instead, which is only read on Linux.
+type Rule struct {
+	// Name of the rule, for logging
+	Name string
+
+	// Prefix of the DHCP vendor class identifier (option 60), e.g.
+	// 'PXEClient:Arch:00007:UNDI:003016'
+	VendorClass string `mapstructure:"vendor_class"`
+
+	// Client system architecture types (DHCP option 93, or DHCPv6 option 61), any of
+	// which the client must report, e.g. 0 for BIOS or 7 for x64 UEFI
+	ClientArch []uint16 `mapstructure:"client_arch"`
+
+	// Prefix of the client's MAC address, usually an OUI, e.g. '00:1b:21'
+	MACPrefix string `mapstructure:"mac_prefix"`
+
+	Quirks `mapstructure:",squash"`
+
+	macPrefix net.HardwareAddr
+}
+
+// matches returns whether the client matches the rule. The vendor class and architecture
+// are only known to DHCP; other services can only match MAC prefix rules.
+func (r *Rule) matches(mac net.HardwareAddr, vendorClass string, arch uint16, dhcpKnown bool) bool {
+	if r.VendorClass != "" && (!dhcpKnown || !strings.HasPrefix(vendorClass, r.VendorClass)) {
+		return false
+	}
+
+	if len(r.ClientArch) > 0 && (!dhcpKnown || !slices.Contains(r.ClientArch, arch)) {
+		return false
+	}
+
+	if r.macPrefix != nil && !bytes.HasPrefix(mac, r.macPrefix) {
+		return false
+	}
+
+	return true
+}
+
+// How long quirks matched by DHCP are remembered for. This covers the firmware's TFTP
+// transfers that follow its DHCP exchange, and those of the bootloader it loads.
+const rememberFor = time.Hour
+
+// Table is a set of quirk rules. Quirks matched by DHCP are remembered against the
+// client's MAC address, so that they can also be applied by services (such as TFTP)
+// that only see the client's IP, once the client registry has found its MAC address.
+type Table struct {
+	rules   []Rule
+	clients *clients.Registry
+
+	mu         sync.Mutex
+	remembered map[string]*rememberedQuirks
+}
+
+type rememberedQuirks struct {
+	quirks  *Quirks
+	expires time.Time
+}
+
+// NewTable creates a quirk table from the given rules, which looks up the MAC addresses
+// of clients seen by IP in the given registry
+func NewTable(rules []Rule, registry *clients.Registry) (*Table, error) {
+	rules = slices.Clone(rules)
+
+	for i := range rules {
+		if rules[i].VendorClass == "" && rules[i].MACPrefix == "" && len(rules[i].ClientArch) == 0 {
+			return nil, fmt.Errorf("invalid quirk rule '%s': %w", rules[i].Name, errNoMatchers)
+		}
+
+		if rules[i].MACPrefix != "" {
+			macPrefix, err := clients.ParseMACPrefix(rules[i].MACPrefix)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MAC prefix in quirk rule '%s': %w", rules[i].Name, err)
+			}
+
+			rules[i].macPrefix = macPrefix
+		}
+	}
+
+	return &Table{
+		rules:      rules,
+		clients:    registry,
+		remembered: make(map[string]*rememberedQuirks),
+	}, nil
+}
+
+// Match returns the combined quirks of all rules matching the client, given its DHCP
+// vendor class and client architecture type, and the names of the rules that matched
+func (t *Table) Match(mac net.HardwareAddr, vendorClass string, arch uint16) (*Quirks, []string) {
+	return t.match(mac, vendorClass, arch, true)
+}
+
+func (t *Table) match(mac net.HardwareAddr, vendorClass string, arch uint16, dhcpKnown bool) (*Quirks, []string) {
+	quirks := &Quirks{}
+	var names []string
+
+	if t == nil {
+		return quirks, nil
+	}
+
+	for i := range t.rules {
+		if t.rules[i].matches(mac, vendorClass, arch, dhcpKnown) {
+			quirks.merge(&t.rules[i].Quirks)
+			names = append(names, t.rules[i].Name)
+		}
+	}
+
+	return quirks, names
+}
+
+// Remember associates quirks with a client's MAC address, for an hour. Quirks that have
+// expired are forgotten, so that the table doesn't grow with every client ever seen.
+func (t *Table) Remember(mac net.HardwareAddr, quirks *Quirks) {
+	if t == nil || len(mac) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	maps.DeleteFunc(t.remembered, func(_ string, remembered *rememberedQuirks) bool {
+		return now.After(remembered.expires)
+	})
+
+	t.remembered[mac.String()] = &rememberedQuirks{quirks: quirks, expires: now.Add(rememberFor)}
+}
+
+// ForIP returns the quirks for the client with the given IP address, whose MAC address
+// is looked up in the client registry, or failing that the system ARP table. Quirks
+// remembered from DHCP are preferred; otherwise, the MAC address is matched against MAC
+// prefix rules.
+func (t *Table) ForIP(ip net.IP) *Quirks {
+	if t == nil {
+		return &Quirks{}
+	}
+
+	mac := t.clients.Lookup(ip).MAC
+	if mac == nil {
+		return &Quirks{}
+	}
+
+	t.mu.Lock()
+	remembered, ok := t.remembered[mac.String()]
+	t.mu.Unlock()
+
+	if ok && time.Now().Before(remembered.expires) {
+		return remembered.quirks
+	}
+
+	quirks, _ := t.match(mac, "", 0, false)
+	return quirks
+}
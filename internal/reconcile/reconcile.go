@@ -0,0 +1,334 @@
+// Package reconcile runs distro reconciliation periodically while pixie is serving, so
+// that distro artifacts are kept up to date without restarting
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/davejbax/pixie/internal/audit"
+	"github.com/davejbax/pixie/internal/distro"
+)
+
+// Path is the API path for reconciliation: GET returns the [Status], and POST triggers a
+// reconcile immediately
+const Path = "/api/reconcile"
+
+type Config struct {
+	// Whether to reconcile distros periodically while serving
+	Enabled bool
+
+	// Time between reconciles
+	Interval time.Duration `default:"6h"`
+
+	// Maximum random delay added to each interval, so that many pixie instances don't
+	// hit distro mirrors at the same time
+	Jitter time.Duration `default:"10m"`
+
+	// Delay before retrying a failed reconcile. This doubles with each consecutive
+	// failure, up to the interval.
+	RetryDelay time.Duration `mapstructure:"retry_delay" default:"1m"`
+
+	// Maximum number of downloads to run at once
+	Parallelism int `default:"2"`
+
+	// Time between refreshes of the active distros from the artifact store, on replicas
+	RefreshInterval time.Duration `mapstructure:"refresh_interval" default:"1m"`
+
+	// How long the latest version found on a distro's mirror is trusted for, so that
+	// frequent reconciles (including those triggered through the API) don't check the
+	// mirror each time. Zero checks the mirror on every reconcile.
+	MirrorCacheTTL time.Duration `mapstructure:"mirror_cache_ttl" default:"30m"`
+}
+
+// Status describes the controller's progress, for operators and monitoring
+type Status struct {
+	Running bool `json:"running"`
+
+	LastAttempt  time.Time     `json:"last_attempt"`
+	LastSuccess  time.Time     `json:"last_success"`
+	LastDuration time.Duration `json:"last_duration_ns"`
+	LastError    string        `json:"last_error,omitempty"`
+
+	// Number of reconciles that have failed since the last success
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	NextRun time.Time `json:"next_run"`
+}
+
+// Controller reconciles distros on an interval, and on demand
+type Controller struct {
+	logger *slog.Logger
+	config *Config
+
+	// Whether the controller only refreshes the active distros, rather than reconciling
+	replica bool
+
+	// Called with the active distros after each successful reconcile
+	onReconciled func([]*distro.Distro)
+
+	// Log that the outcome of each reconcile is recorded to
+	events *audit.Log
+
+	trigger chan struct{}
+
+	mu      sync.Mutex
+	manager *distro.Manager
+	status  Status
+
+	// Hashes of the distro versions awaiting approval that have been announced, keyed by
+	// distro and arch, so that each is announced once
+	announced map[string]string
+}
+
+func NewController(logger *slog.Logger, config *Config, manager *distro.Manager, events *audit.Log, onReconciled func([]*distro.Distro)) *Controller {
+	return &Controller{
+		logger:       logger,
+		config:       config,
+		manager:      manager,
+		events:       events,
+		onReconciled: onReconciled,
+		trigger:      make(chan struct{}, 1),
+		announced:    make(map[string]string),
+	}
+}
+
+// NewReplicaController creates a controller for a replica, which never downloads distros
+// itself. Instead, it refreshes the active distros from the artifact store that the
+// primary downloads them to, every refresh interval.
+func NewReplicaController(logger *slog.Logger, config *Config, manager *distro.Manager, onRefreshed func([]*distro.Distro)) *Controller {
+	controller := NewController(logger, config, manager, nil, onRefreshed)
+	controller.replica = true
+
+	return controller
+}
+
+// Run reconciles distros until the context is cancelled. The first reconcile happens
+// immediately, and another happens when any distro's check window opens.
+func (c *Controller) Run(ctx context.Context) error {
+	delay := time.Duration(0)
+
+	for {
+		c.setNextRun(time.Now().Add(delay))
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-c.trigger:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		delay = c.reconcile()
+	}
+}
+
+// Trigger requests a reconcile as soon as possible. If one is already requested, this
+// does nothing.
+func (c *Controller) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// SetManager replaces the manager used by future reconciles, e.g. after the config has
+// been reloaded. A reconcile in progress continues with the previous manager, but the
+// distros it finds are discarded rather than passed on, since they're from the old
+// config.
+func (c *Controller) SetManager(manager *distro.Manager) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.manager = manager
+}
+
+// Status returns the controller's current status
+func (c *Controller) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status
+}
+
+// reconcile runs a single reconcile, returning the delay until the next
+func (c *Controller) reconcile() time.Duration {
+	start := time.Now()
+
+	c.mu.Lock()
+	c.status.Running = true
+	c.status.LastAttempt = start
+	manager := c.manager
+	c.mu.Unlock()
+
+	var distros []*distro.Distro
+	var err error
+
+	if c.replica {
+		c.logger.Debug("refreshing distros from artifact store")
+		distros, err = manager.Active()
+	} else {
+		c.logger.Info("reconciling distros")
+		distros, err = manager.Reconcile(c.config.Parallelism)
+	}
+
+	duration := time.Since(start)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.status.Running = false
+	c.status.LastDuration = duration
+
+	if err != nil && c.replica {
+		c.status.ConsecutiveFailures++
+		c.status.LastError = err.Error()
+
+		c.logger.Error("failed to refresh distros from artifact store",
+			"error", err,
+			"failures", c.status.ConsecutiveFailures,
+		)
+
+		return c.config.RefreshInterval
+	} else if err != nil {
+		c.status.ConsecutiveFailures++
+		c.status.LastError = err.Error()
+
+		delay := c.retryDelay(c.status.ConsecutiveFailures)
+
+		c.logger.Error("failed to reconcile distros",
+			"error", err,
+			"failures", c.status.ConsecutiveFailures,
+			"retry_in", delay,
+		)
+
+		c.events.Record(audit.Event{Type: audit.EventReconcileFailed, Detail: err.Error()})
+
+		return delay
+	}
+
+	c.status.ConsecutiveFailures = 0
+	c.status.LastError = ""
+	c.status.LastSuccess = time.Now()
+
+	// Distros found with a manager that has since been replaced would overwrite those of
+	// the new config
+	superseded := manager != c.manager
+	if superseded {
+		c.logger.Debug("discarding distros from a manager replaced during the reconcile")
+	}
+
+	// Refreshes are frequent, and change nothing themselves, so they aren't recorded
+	if c.replica {
+		if c.onReconciled != nil && !superseded {
+			c.onReconciled(distros)
+		}
+
+		return c.config.RefreshInterval
+	}
+
+	c.logger.Info("reconciled distros",
+		"distros", len(distros),
+		"duration", duration,
+	)
+
+	c.events.Record(audit.Event{Type: audit.EventReconciled, Detail: fmt.Sprintf("%d distros", len(distros))})
+	c.announceUpdates(distros)
+
+	if c.onReconciled != nil && !superseded {
+		c.onReconciled(distros)
+	}
+
+	return c.nextDelay(manager)
+}
+
+// nextDelay returns the delay after a successful reconcile: the interval, or less if a
+// distro's check window opens sooner, so that the distro is checked during the window
+func (c *Controller) nextDelay(manager *distro.Manager) time.Duration {
+	delay := c.config.Interval + c.jitter()
+
+	if next := manager.NextCheck(time.Now()); !next.IsZero() {
+		delay = min(delay, time.Until(next)+c.jitter())
+	}
+
+	return delay
+}
+
+// announceUpdates records an event for each newer distro version awaiting approval that
+// hasn't been announced yet
+func (c *Controller) announceUpdates(distros []*distro.Distro) {
+	for _, d := range distros {
+		key := d.Name() + "/" + d.Arch()
+		update := d.UpdateAvailable()
+
+		if update == "" {
+			delete(c.announced, key)
+			continue
+		}
+
+		if c.announced[key] == update {
+			continue
+		}
+
+		c.announced[key] = update
+
+		c.events.Record(audit.Event{
+			Type:   audit.EventDistroUpdateAvailable,
+			Detail: fmt.Sprintf("%s %s -> %s", key, d.Hash(), update),
+		})
+	}
+}
+
+// retryDelay returns the delay after the given number of consecutive failures
+func (c *Controller) retryDelay(failures int) time.Duration {
+	delay := c.config.RetryDelay
+	for i := 1; i < failures && delay < c.config.Interval; i++ {
+		delay *= 2
+	}
+
+	return min(delay, c.config.Interval) + c.jitter()
+}
+
+func (c *Controller) jitter() time.Duration {
+	if c.config.Jitter <= 0 {
+		return 0
+	}
+
+	return rand.N(c.config.Jitter) //nolint:gosec
+}
+
+func (c *Controller) setNextRun(next time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.status.NextRun = next
+}
+
+// Handler serves the controller's status, and triggers reconciles on POST
+func (c *Controller) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+
+		if r.Method == http.MethodPost {
+			c.Trigger()
+			c.logger.Info("reconcile requested",
+				"client", r.RemoteAddr,
+			)
+
+			status = http.StatusAccepted
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(c.Status())
+	})
+}
@@ -0,0 +1,182 @@
+// Package requestlog logs each file request served over TFTP and HTTP, identifying the
+// client as far as possible, so that operators can see how far a machine got booting
+package requestlog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/davejbax/pixie/internal/clients"
+)
+
+type Config struct {
+	// Whether to log each TFTP and HTTP request
+	Enabled bool `default:"true"`
+
+	// Level that requests are logged at: 'debug', 'info', 'warn' or 'error'. Requests are
+	// only shown if pixie's log level (set by '--level') is at or below this.
+	Level string `default:"info"`
+}
+
+// Request is a single request, once it has been handled
+type Request struct {
+	// 'tftp' or 'http'
+	Protocol string
+
+	ClientIP net.IP
+	Path     string
+
+	// Outcome of the request: the response status code for HTTP, or for TFTP one of
+	// 'complete', 'not_found', 'access_violation', 'busy', 'aborted' or 'failed'
+	Status string
+
+	// Bytes of the file sent to the client
+	Bytes int64
+
+	Duration time.Duration
+}
+
+// Sink receives requests as they're handled, whether or not they're logged, e.g. to
+// follow clients' boots. Observe must not block.
+type Sink interface {
+	Observe(req *Request)
+}
+
+// Logger logs requests, and passes them to its sinks. A nil logger logs nothing.
+type Logger struct {
+	logger  *slog.Logger
+	enabled bool
+	level   slog.Level
+	clients *clients.Registry
+	sinks   []Sink
+}
+
+// New creates a request logger, which looks up the MAC addresses of clients in the
+// given registry (which may be nil). Requests are passed to the sinks even if request
+// logging is disabled. It returns nil if request logging is disabled and there are no
+// sinks.
+func New(logger *slog.Logger, config *Config, registry *clients.Registry, sinks ...Sink) (*Logger, error) {
+	if !config.Enabled && len(sinks) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+		return nil, fmt.Errorf("invalid request log level '%s': %w", config.Level, err)
+	}
+
+	return &Logger{
+		logger:  logger,
+		enabled: config.Enabled,
+		level:   level,
+		clients: registry,
+		sinks:   sinks,
+	}, nil
+}
+
+// Log logs a request that has been handled
+func (l *Logger) Log(req *Request) {
+	if l == nil {
+		return
+	}
+
+	for _, sink := range l.sinks {
+		sink.Observe(req)
+	}
+
+	if !l.enabled || !l.logger.Enabled(context.Background(), l.level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("protocol", req.Protocol),
+		slog.String("client_ip", req.ClientIP.String()),
+	}
+
+	// The MAC address is only known if DHCP or the ARP table associates it with the IP
+	if client := l.clients.Lookup(req.ClientIP); client.MAC != nil {
+		attrs = append(attrs, slog.String("mac", client.MAC.String()))
+	}
+
+	attrs = append(attrs,
+		slog.String("path", req.Path),
+		slog.String("status", req.Status),
+		slog.Int64("bytes", req.Bytes),
+		slog.Duration("duration", req.Duration),
+	)
+
+	l.logger.LogAttrs(context.Background(), l.level, "request", attrs...)
+}
+
+// Middleware logs each request handled by next
+func (l *Logger) Middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r)
+
+		var ip net.IP
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ip = net.ParseIP(host)
+		}
+
+		l.Log(&Request{
+			Protocol: "http",
+			ClientIP: ip,
+			Path:     r.URL.Path,
+			Status:   strconv.Itoa(recorder.status),
+			Bytes:    recorder.bytes,
+			Duration: time.Since(start),
+		})
+	})
+}
+
+// responseRecorder records the status and size of a response as it is written
+type responseRecorder struct {
+	http.ResponseWriter
+
+	status      int
+	wroteHeader bool
+	bytes       int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += int64(n)
+
+	return n, err //nolint:wrapcheck
+}
+
+// ReadFrom copies with the underlying writer, so that files are still sent with
+// sendfile where possible
+func (r *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(r.ResponseWriter, src)
+	r.bytes += n
+
+	return n, err //nolint:wrapcheck
+}
+
+// Unwrap lets [http.ResponseController] reach the underlying writer
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
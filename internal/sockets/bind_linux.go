@@ -0,0 +1,35 @@
+package sockets
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// listenConfig returns the config of sockets bound to the named interface, or of
+// unbound sockets if the name is empty. Sockets bound to an interface only receive
+// packets that arrive on it, and send through it.
+func listenConfig(iface string) *net.ListenConfig {
+	if iface == "" {
+		return &net.ListenConfig{}
+	}
+
+	return &net.ListenConfig{
+		Control: func(_ string, _ string, conn syscall.RawConn) error {
+			var bindErr error
+
+			err := conn.Control(func(fd uintptr) {
+				bindErr = syscall.BindToDevice(int(fd), iface)
+			})
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+
+			if bindErr != nil {
+				return fmt.Errorf("failed to bind to interface '%s': %w", iface, bindErr)
+			}
+
+			return nil
+		},
+	}
+}
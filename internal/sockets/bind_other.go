@@ -0,0 +1,26 @@
+//go:build !linux
+
+package sockets
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var errBindUnsupported = errors.New("binding sockets to an interface is only supported on Linux")
+
+// listenConfig returns the config of unbound sockets. Binding to an interface isn't
+// supported, so sockets that should be bound to one fail to be created.
+func listenConfig(iface string) *net.ListenConfig {
+	if iface == "" {
+		return &net.ListenConfig{}
+	}
+
+	return &net.ListenConfig{
+		Control: func(_ string, _ string, _ syscall.RawConn) error {
+			return fmt.Errorf("'%s': %w", iface, errBindUnsupported)
+		},
+	}
+}
@@ -0,0 +1,251 @@
+// Package sockets opens the sockets that pixie's servers listen on. Sockets inherited
+// from the service manager (by systemd's socket activation protocol) are used where one
+// matches a server's address, so that pixie can serve privileged ports without running
+// as root. Failures to bind privileged ports explain how to do so.
+//
+// Sockets can be bound to a network interface (e.g. a VLAN interface), so that servers
+// on the same port only see the traffic of their interface, including broadcasts.
+package sockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+const (
+	// File descriptor of the first inherited socket, after stdin, stdout and stderr
+	listenFDsStart = 3
+
+	// Ports below this need privileges to bind, unless the OS is configured otherwise
+	privilegedPorts = 1024
+)
+
+var (
+	errPrivilegedPort  = errors.New("binding ports below 1024 needs root or the CAP_NET_BIND_SERVICE capability")
+	errInvalidListenFD = errors.New("invalid LISTEN_FDS")
+)
+
+// How to bind privileged ports without running as root, appended to errors binding them
+const privilegedPortHint = "to run pixie without root, either grant the capability " +
+	"('setcap cap_net_bind_service=+ep' on the binary, or AmbientCapabilities=CAP_NET_BIND_SERVICE " +
+	"in a systemd unit), pass the socket by systemd socket activation with sockets.inherit " +
+	"enabled, lower the net.ipv4.ip_unprivileged_port_start sysctl, or listen on an " +
+	"unprivileged port and redirect the standard port to it"
+
+type Config struct {
+	// Use sockets passed by the service manager (systemd socket activation, with
+	// LISTEN_FDS) for servers whose address matches one. Servers without a matching
+	// socket bind their own.
+	Inherit bool
+}
+
+// Address is an address that a server listens on
+type Address struct {
+	// Config setting that the address comes from, e.g. 'tftp.address'
+	Setting string
+
+	// 'tcp', 'udp', 'udp4' or 'udp6'
+	Network string
+	Address string
+
+	// Network interface that the socket is bound to, if any
+	Interface string
+}
+
+// inherited are the sockets passed to pixie that haven't been used yet
+var inherited = struct {
+	mu          sync.Mutex
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+}{}
+
+// Setup takes the sockets passed by the service manager, if enabled, returning how many
+// there were. It must be called before the servers listen.
+func Setup(config *Config) (int, error) {
+	if !config.Inherit {
+		return 0, nil
+	}
+
+	// The sockets are only for this process, not any that it starts
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("'%s': %w", os.Getenv("LISTEN_FDS"), errInvalidListenFD)
+	}
+
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+
+		// Both functions duplicate the socket, so the original is closed either way
+		if listener, err := net.FileListener(file); err == nil {
+			inherited.listeners = append(inherited.listeners, listener)
+		} else if conn, err := net.FilePacketConn(file); err == nil {
+			inherited.packetConns = append(inherited.packetConns, conn)
+		} else {
+			_ = file.Close()
+			return 0, fmt.Errorf("inherited socket %d is neither a stream nor a datagram socket: %w", fd, err)
+		}
+
+		_ = file.Close()
+	}
+
+	return count, nil
+}
+
+// Listen returns an inherited stream socket bound to the address, or else listens on it,
+// bound to the named interface if it isn't empty. Inherited sockets are used as they
+// are, so the service manager must bind them to the interface.
+func Listen(network string, address string, iface string) (net.Listener, error) {
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	for i, listener := range inherited.listeners {
+		if matches(listener.Addr(), address) {
+			inherited.listeners = slices.Delete(inherited.listeners, i, i+1)
+			return listener, nil
+		}
+	}
+
+	listener, err := listenConfig(iface).Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, explain(address, err)
+	}
+
+	return listener, nil
+}
+
+// ListenPacket returns an inherited datagram socket bound to the address, or else
+// listens on it, bound to the named interface if it isn't empty
+func ListenPacket(network string, address string, iface string) (net.PacketConn, error) {
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	for i, conn := range inherited.packetConns {
+		if matches(conn.LocalAddr(), address) {
+			inherited.packetConns = slices.Delete(inherited.packetConns, i, i+1)
+			return conn, nil
+		}
+	}
+
+	conn, err := listenConfig(iface).ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, explain(address, err)
+	}
+
+	return conn, nil
+}
+
+// ListenMulticastUDP joins the multicast group on the interface, as
+// [net.ListenMulticastUDP] does. Multicast sockets can't be inherited, as joining the
+// group is part of creating them.
+func ListenMulticastUDP(network string, iface *net.Interface, addr *net.UDPAddr) (*net.UDPConn, error) {
+	conn, err := net.ListenMulticastUDP(network, iface, addr)
+	if err != nil {
+		return nil, explain(addr.String(), err)
+	}
+
+	return conn, nil
+}
+
+// Check returns whether the servers will be able to listen on their addresses, by
+// binding each address that no inherited socket matches and closing it again. Errors
+// for every address that can't be bound are returned, naming their settings.
+func Check(addresses []Address) error {
+	errs := []error{}
+
+	for _, address := range addresses {
+		if err := check(address); err != nil {
+			errs = append(errs, fmt.Errorf("'%s': %w", address.Setting, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func check(address Address) error {
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	if address.Network == "tcp" {
+		if slices.ContainsFunc(inherited.listeners, func(l net.Listener) bool { return matches(l.Addr(), address.Address) }) {
+			return nil
+		}
+
+		listener, err := listenConfig(address.Interface).Listen(context.Background(), address.Network, address.Address)
+		if err != nil {
+			return explain(address.Address, err)
+		}
+
+		return listener.Close() //nolint:wrapcheck
+	}
+
+	if slices.ContainsFunc(inherited.packetConns, func(c net.PacketConn) bool { return matches(c.LocalAddr(), address.Address) }) {
+		return nil
+	}
+
+	conn, err := listenConfig(address.Interface).ListenPacket(context.Background(), address.Network, address.Address)
+	if err != nil {
+		return explain(address.Address, err)
+	}
+
+	return conn.Close() //nolint:wrapcheck
+}
+
+// matches returns whether a socket's address is the configured address. A configured
+// address without a host only matches sockets bound to every address.
+func matches(socketAddr net.Addr, address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	var ip net.IP
+
+	switch socketAddr := socketAddr.(type) {
+	case *net.TCPAddr:
+		ip = socketAddr.IP
+		if strconv.Itoa(socketAddr.Port) != port {
+			return false
+		}
+	case *net.UDPAddr:
+		ip = socketAddr.IP
+		if strconv.Itoa(socketAddr.Port) != port {
+			return false
+		}
+	default:
+		return false
+	}
+
+	if host == "" {
+		return ip == nil || ip.IsUnspecified()
+	}
+
+	return ip.Equal(net.ParseIP(host))
+}
+
+// explain adds a hint on running without root to errors binding privileged ports
+func explain(address string, err error) error {
+	_, portString, _ := net.SplitHostPort(address)
+
+	if port, portErr := strconv.Atoi(portString); portErr == nil && port < privilegedPorts && errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("failed to listen on '%s': %w: %w (%s)", address, err, errPrivilegedPort, privilegedPortHint)
+	}
+
+	return fmt.Errorf("failed to listen on '%s': %w", address, err)
+}
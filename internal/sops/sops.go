@@ -0,0 +1,440 @@
+// Package sops decrypts config files encrypted with SOPS using age keys, and single
+// values encrypted with age, so that configs holding secrets (such as BMC passwords, API
+// tokens and password hashes) can be kept in version control
+package sops
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// MetadataKey is the top-level key of SOPS-encrypted files that holds the encrypted
+// data key and the MAC of the file's values
+const MetadataKey = "sops"
+
+// Environment variables that SOPS reads age keys from, which are used if no key file is
+// configured
+const (
+	keyEnv     = "SOPS_AGE_KEY"
+	keyFileEnv = "SOPS_AGE_KEY_FILE"
+)
+
+// Length of the nonces that SOPS encrypts values with, which is longer than AES-GCM's
+// standard nonce
+const nonceSize = 32
+
+var (
+	errNoKey          = errors.New("no age key to decrypt with: set 'age_key_file', " + keyFileEnv + " or " + keyEnv)
+	errNoAgeRecipient = errors.New("file isn't encrypted for any age recipients, which are the only keys supported")
+	errInvalidValue   = errors.New("invalid encrypted value")
+	errUnknownType    = errors.New("unknown type of encrypted value")
+	errNoMAC          = errors.New("file has no MAC")
+	errMACMismatch    = errors.New("MAC doesn't match the file's values, which may have been tampered with")
+)
+
+// metadata is the part of SOPS's metadata that's needed to decrypt files with age
+type metadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+
+	LastModified     string `yaml:"lastmodified"`
+	MAC              string `yaml:"mac"`
+	MACOnlyEncrypted bool   `yaml:"mac_only_encrypted"`
+}
+
+// Decrypter decrypts files and values with age identities. The identities are read when
+// first needed, so that configs without encrypted values need no key.
+type Decrypter struct {
+	keyFile string
+
+	once       sync.Once
+	identities []age.Identity
+	err        error
+}
+
+// NewDecrypter creates a decrypter with the age identities in the given file. If keyFile
+// is empty, identities are read from where SOPS reads them: the SOPS_AGE_KEY and
+// SOPS_AGE_KEY_FILE environment variables, and 'sops/age/keys.txt' in the user's config
+// directory.
+func NewDecrypter(keyFile string) *Decrypter {
+	return &Decrypter{keyFile: keyFile}
+}
+
+// Encrypted returns whether the parsed YAML or JSON document was encrypted by SOPS
+func Encrypted(doc *yaml.Node) bool {
+	_, ok := mappingValue(root(doc), MetadataKey)
+	return ok
+}
+
+// DecryptDocument decrypts the values of a parsed YAML or JSON document encrypted by
+// SOPS in place, checking them against the document's MAC, and removes SOPS's metadata.
+// Documents that aren't encrypted are left alone.
+func (d *Decrypter) DecryptDocument(doc *yaml.Node) error {
+	if !Encrypted(doc) {
+		return nil
+	}
+
+	top := root(doc)
+	metadataNode, _ := mappingValue(top, MetadataKey)
+
+	meta := &metadata{}
+	if err := metadataNode.Decode(meta); err != nil {
+		return fmt.Errorf("invalid SOPS metadata: %w", err)
+	}
+
+	dataKey, err := d.dataKey(meta)
+	if err != nil {
+		return err
+	}
+
+	// Values are hashed in the order they appear in, as SOPS does
+	hash := sha512.New()
+
+	for i := 0; i+1 < len(top.Content); i += 2 {
+		if top.Content[i].Value == MetadataKey {
+			continue
+		}
+
+		if err := decryptNode(top.Content[i+1], []string{top.Content[i].Value}, dataKey, hash, meta.MACOnlyEncrypted); err != nil {
+			return err
+		}
+	}
+
+	if meta.MAC == "" {
+		return errNoMAC
+	}
+
+	mac, _, err := decryptValue(meta.MAC, dataKey, meta.LastModified)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt MAC: %w", err)
+	}
+
+	if !strings.EqualFold(mac, fmt.Sprintf("%X", hash.Sum(nil))) {
+		return errMACMismatch
+	}
+
+	removeMappingKey(top, MetadataKey)
+
+	return nil
+}
+
+// DecryptValues returns the value with every string within it that's an armored age
+// file decrypted, with any trailing newline removed
+func (d *Decrypter) DecryptValues(value any) (any, error) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, item := range value {
+			decrypted, err := d.DecryptValues(item)
+			if err != nil {
+				return nil, fmt.Errorf("'%s': %w", key, err)
+			}
+
+			value[key] = decrypted
+		}
+	case []any:
+		for i, item := range value {
+			decrypted, err := d.DecryptValues(item)
+			if err != nil {
+				return nil, err
+			}
+
+			value[i] = decrypted
+		}
+	case string:
+		if !strings.HasPrefix(strings.TrimSpace(value), armor.Header) {
+			return value, nil
+		}
+
+		plaintext, err := d.decrypt(strings.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+
+		return strings.TrimSuffix(string(plaintext), "\n"), nil
+	}
+
+	return value, nil
+}
+
+// dataKey returns the key that the document's values are encrypted with, which is
+// encrypted for each of the document's age recipients
+func (d *Decrypter) dataKey(meta *metadata) ([]byte, error) {
+	if len(meta.Age) == 0 {
+		return nil, errNoAgeRecipient
+	}
+
+	errs := []error{}
+
+	for _, recipient := range meta.Age {
+		key, err := d.decrypt(strings.NewReader(recipient.Enc))
+		if err == nil {
+			return key, nil
+		}
+
+		errs = append(errs, fmt.Errorf("recipient '%s': %w", recipient.Recipient, err))
+	}
+
+	return nil, fmt.Errorf("failed to decrypt data key: %w", errors.Join(errs...))
+}
+
+// decrypt decrypts an armored age file
+func (d *Decrypter) decrypt(r io.Reader) ([]byte, error) {
+	identities, err := d.loadIdentities()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := age.Decrypt(armor.NewReader(r), identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	data, err := io.ReadAll(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+
+	return data, nil
+}
+
+func (d *Decrypter) loadIdentities() ([]age.Identity, error) {
+	d.once.Do(func() {
+		d.identities, d.err = readIdentities(d.keyFile)
+	})
+
+	return d.identities, d.err
+}
+
+// readIdentities reads the age identities in the key file, or, if it's empty, those
+// that SOPS would use
+func readIdentities(keyFile string) ([]age.Identity, error) {
+	if keyFile != "" {
+		return readIdentityFile(keyFile)
+	}
+
+	identities := []age.Identity{}
+
+	if key := os.Getenv(keyEnv); key != "" {
+		parsed, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid age key in %s: %w", keyEnv, err)
+		}
+
+		identities = append(identities, parsed...)
+	}
+
+	if path := os.Getenv(keyFileEnv); path != "" {
+		parsed, err := readIdentityFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, parsed...)
+	}
+
+	if configDir, err := os.UserConfigDir(); err == nil {
+		path := filepath.Join(configDir, "sops", "age", "keys.txt")
+		if _, err := os.Stat(path); err == nil {
+			parsed, err := readIdentityFile(path)
+			if err != nil {
+				return nil, err
+			}
+
+			identities = append(identities, parsed...)
+		}
+	}
+
+	if len(identities) == 0 {
+		return nil, errNoKey
+	}
+
+	return identities, nil
+}
+
+func readIdentityFile(path string) ([]age.Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age key file: %w", err)
+	}
+
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid age key file '%s': %w", path, err)
+	}
+
+	return identities, nil
+}
+
+// decryptNode decrypts the values in the node in place, adding them to the hash. As in
+// SOPS, each value is authenticated with the keys of the maps it's in, and list items
+// with those of the list.
+func decryptNode(node *yaml.Node, path []string, dataKey []byte, hash io.Writer, macOnlyEncrypted bool) error {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := decryptNode(item, path, dataKey, hash, macOnlyEncrypted); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := decryptNode(node.Content[i+1], append(path, node.Content[i].Value), dataKey, hash, macOnlyEncrypted); err != nil {
+				return err
+			}
+		}
+	case yaml.AliasNode:
+		return decryptNode(node.Alias, path, dataKey, hash, macOnlyEncrypted)
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return nil
+		}
+
+		encrypted := strings.HasPrefix(node.Value, "ENC[")
+		if encrypted {
+			plaintext, tag, err := decryptValue(node.Value, dataKey, strings.Join(path, ":")+":")
+			if err != nil {
+				return fmt.Errorf("'%s': %w", strings.Join(path, "."), err)
+			}
+
+			node.Value, node.Tag, node.Style = plaintext, tag, 0
+		}
+
+		if encrypted || !macOnlyEncrypted {
+			if _, err := hash.Write(macBytes(node)); err != nil {
+				return err //nolint:wrapcheck
+			}
+		}
+	}
+
+	return nil
+}
+
+// decryptValue decrypts a value encrypted by SOPS, of the form
+// 'ENC[AES256_GCM,data:...,iv:...,tag:...,type:...]', returning it along with its YAML
+// tag
+func decryptValue(value string, dataKey []byte, additionalData string) (string, string, error) {
+	inner, ok := strings.CutPrefix(value, "ENC[AES256_GCM,")
+	if !ok || !strings.HasSuffix(inner, "]") {
+		return "", "", errInvalidValue
+	}
+
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimSuffix(inner, "]"), ",") {
+		name, fieldValue, _ := strings.Cut(field, ":")
+		fields[name] = fieldValue
+	}
+
+	data, dataErr := base64.StdEncoding.DecodeString(fields["data"])
+	iv, ivErr := base64.StdEncoding.DecodeString(fields["iv"])
+	tag, tagErr := base64.StdEncoding.DecodeString(fields["tag"])
+
+	if err := errors.Join(dataErr, ivErr, tagErr); err != nil || len(iv) != nonceSize {
+		return "", "", errInvalidValue
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid data key: %w", err)
+	}
+
+	gcm, err := cipher.NewGCMWithNonceSize(block, nonceSize)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decrypt value: %w", err)
+	}
+
+	switch fields["type"] {
+	case "str", "bytes":
+		return string(plaintext), "!!str", nil
+	case "int":
+		return string(plaintext), "!!int", nil
+	case "float":
+		return string(plaintext), "!!float", nil
+	case "bool":
+		return string(plaintext), "!!bool", nil
+	default:
+		return "", "", fmt.Errorf("'%s': %w", fields["type"], errUnknownType)
+	}
+}
+
+// macBytes returns the bytes that SOPS hashes for a value in its MAC, which spells
+// booleans as Python does
+func macBytes(node *yaml.Node) []byte {
+	var value any
+	if err := node.Decode(&value); err != nil {
+		return []byte(node.Value)
+	}
+
+	switch value := value.(type) {
+	case bool:
+		if value {
+			return []byte("True")
+		}
+
+		return []byte("False")
+	case int:
+		return []byte(strconv.Itoa(value))
+	case float64:
+		return []byte(strconv.FormatFloat(value, 'f', -1, 64))
+	default:
+		return []byte(node.Value)
+	}
+}
+
+// root returns the top-level mapping of a document, or nil if it has none
+func root(doc *yaml.Node) *yaml.Node {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) == 1 {
+		doc = doc.Content[0]
+	}
+
+	if doc.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	return doc
+}
+
+// mappingValue returns the value of the key in a mapping node
+func mappingValue(mapping *yaml.Node, key string) (*yaml.Node, bool) {
+	if mapping == nil {
+		return nil, false
+	}
+
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1], true
+		}
+	}
+
+	return nil, false
+}
+
+func removeMappingKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
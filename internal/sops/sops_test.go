@@ -0,0 +1,372 @@
+package sops
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v3"
+)
+
+// The fixtures in testdata are encrypted for the age identity in testdata/age.key. They
+// follow the layout written by 'sops --encrypt --age': config.sops.yaml with the
+// default settings, and mac-only-encrypted.sops.yaml with '--encrypted-regex
+// ^password$ --mac-only-encrypted'.
+const testKeyFile = "testdata/age.key"
+
+// testDataKey is the data key that the values in TestDecryptValue are encrypted with
+const testDataKey = "5b694eef70b1432404b7c3690f243669bd6e62eb520c091d63fee41415689170"
+
+func TestDecryptDocument(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		edit    func(string) string
+		keyFile string
+		want    map[string]any
+		wantErr error
+	}{
+		{
+			name:    "default settings",
+			file:    "testdata/config.sops.yaml",
+			keyFile: testKeyFile,
+			want: map[string]any{
+				"server": map[string]any{"hostname": "dhcp.example.com"},
+				"tftp":   map[string]any{"max_block_size": 1468},
+				"hosts": []any{
+					map[string]any{
+						"name":   "rack-01",
+						"bmc":    map[string]any{"password": "hunter2", "insecure": true},
+						"weight": 0.5,
+					},
+				},
+				"api":                 map[string]any{"tokens": []any{"tok-aaaa", "tok-bbbb"}},
+				"comment_unencrypted": "managed by ops",
+			},
+		},
+		{
+			name:    "unencrypted value changed",
+			file:    "testdata/config.sops.yaml",
+			edit:    replace("managed by ops", "managed by someone else"),
+			keyFile: testKeyFile,
+			wantErr: errMACMismatch,
+		},
+		{
+			name: "encrypted values swapped",
+			file: "testdata/config.sops.yaml",
+			edit: func(doc string) string {
+				lines := strings.Split(doc, "\n")
+				tokens := lineIndex(lines, "    tokens:")
+				lines[tokens+1], lines[tokens+2] = lines[tokens+2], lines[tokens+1]
+
+				return strings.Join(lines, "\n")
+			},
+			keyFile: testKeyFile,
+			wantErr: errMACMismatch,
+		},
+		{
+			name: "no MAC",
+			file: "testdata/config.sops.yaml",
+			edit: func(doc string) string {
+				lines := strings.Split(doc, "\n")
+				mac := lineIndex(lines, "    mac: ")
+
+				return strings.Join(append(lines[:mac], lines[mac+1:]...), "\n")
+			},
+			keyFile: testKeyFile,
+			wantErr: errNoMAC,
+		},
+		{
+			name: "no age recipients",
+			file: "testdata/config.sops.yaml",
+			edit: func(doc string) string {
+				return strings.Replace(doc, "    age:\n", "    pgp:\n", 1)
+			},
+			keyFile: testKeyFile,
+			wantErr: errNoAgeRecipient,
+		},
+		{
+			name:    "MAC only covers encrypted values",
+			file:    "testdata/mac-only-encrypted.sops.yaml",
+			keyFile: testKeyFile,
+			want: map[string]any{
+				"bmc": map[string]any{"username": "admin", "password": "hunter2"},
+			},
+		},
+		{
+			name:    "MAC only covers encrypted values, unencrypted value changed",
+			file:    "testdata/mac-only-encrypted.sops.yaml",
+			edit:    replace("username: admin", "username: root"),
+			keyFile: testKeyFile,
+			want: map[string]any{
+				"bmc": map[string]any{"username": "root", "password": "hunter2"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			text := string(data)
+			if tt.edit != nil {
+				text = tt.edit(text)
+			}
+
+			doc := &yaml.Node{}
+			if err := yaml.Unmarshal([]byte(text), doc); err != nil {
+				t.Fatal(err)
+			}
+
+			if !Encrypted(doc) {
+				t.Fatal("Encrypted() = false, want true")
+			}
+
+			err = NewDecrypter(tt.keyFile).DecryptDocument(doc)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("DecryptDocument() error = %v, want %v", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("DecryptDocument() error = %v", err)
+			}
+
+			if Encrypted(doc) {
+				t.Error("metadata wasn't removed")
+			}
+
+			got := map[string]any{}
+			if err := doc.Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecryptDocument() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptDocumentWrongKey(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "age.key")
+	if err := os.WriteFile(keyFile, []byte(identity.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile("testdata/config.sops.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	err = NewDecrypter(keyFile).DecryptDocument(doc)
+	if err == nil || !strings.Contains(err.Error(), "failed to decrypt data key") {
+		t.Fatalf("DecryptDocument() error = %v, want failure to decrypt data key", err)
+	}
+}
+
+func TestDecryptDocumentNotEncrypted(t *testing.T) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte("server:\n    hostname: dhcp.example.com\n"), doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if Encrypted(doc) {
+		t.Fatal("Encrypted() = true, want false")
+	}
+
+	// No key is needed for documents that aren't encrypted
+	if err := NewDecrypter("testdata/missing.key").DecryptDocument(doc); err != nil {
+		t.Fatalf("DecryptDocument() error = %v", err)
+	}
+}
+
+func TestDecryptValue(t *testing.T) {
+	dataKey, err := hex.DecodeString(testDataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		value          string
+		additionalData string
+		want           string
+		wantTag        string
+		wantErr        error
+		fails          bool
+	}{
+		{
+			name:           "string",
+			value:          "ENC[AES256_GCM,data:dLbxOaA=,iv:grVqlvy6CgQIKwkNxUhVP/+yBgNo6x3mbuBCb6O5JDQ=,tag:qdOBNzRJ3eNSoMUVW3BdJQ==,type:str]",
+			additionalData: "value:",
+			want:           "hello",
+			wantTag:        "!!str",
+		},
+		{
+			name:           "int",
+			value:          "ENC[AES256_GCM,data:E4E=,iv:XRdzbk91LMt0i7KRg+HyHfvqGIE032EpRB8PT2VRAlg=,tag:SvztNGIUjLsP1jd7pPKWAQ==,type:int]",
+			additionalData: "value:",
+			want:           "42",
+			wantTag:        "!!int",
+		},
+		{
+			name:           "bool",
+			value:          "ENC[AES256_GCM,data:oblU73I=,iv:r1uy62dFSiyHa4tUyYC22nvG8UQ1G6RbzeOYtkXXwq0=,tag:9Cl1GHKa41N9ZPxD/1N++g==,type:bool]",
+			additionalData: "value:",
+			want:           "False",
+			wantTag:        "!!bool",
+		},
+		{
+			name:           "float",
+			value:          "ENC[AES256_GCM,data:PNAx,iv:+4VdrqfS2/Ce+/s5R+T9QnnG2oX+izzmIPRjvLxVIfA=,tag:qwUI9SggRvVj6bhjLcUiMg==,type:float]",
+			additionalData: "value:",
+			want:           "2.5",
+			wantTag:        "!!float",
+		},
+		{
+			name:           "bytes",
+			value:          "ENC[AES256_GCM,data:FDqr3A==,iv:NzhrBEkcUVMdC4iBtjdiJzRD5vD65NJoDlMDxYPtEUM=,tag:cCJspTZZdGkTKwJ35bR6/w==,type:bytes]",
+			additionalData: "value:",
+			want:           "aGk=",
+			wantTag:        "!!str",
+		},
+		{
+			name:           "unknown type",
+			value:          "ENC[AES256_GCM,data:Wg==,iv:sMXfGREeaRqO0xFbYFV3sVsLYv1zVVWg32ij64JgMTs=,tag:wIGHitRDUpiUTUb5sEL6Cw==,type:dict]",
+			additionalData: "value:",
+			wantErr:        errUnknownType,
+		},
+		{
+			name:           "wrong path",
+			value:          "ENC[AES256_GCM,data:dLbxOaA=,iv:grVqlvy6CgQIKwkNxUhVP/+yBgNo6x3mbuBCb6O5JDQ=,tag:qdOBNzRJ3eNSoMUVW3BdJQ==,type:str]",
+			additionalData: "other:",
+			fails:          true,
+		},
+		{
+			name:           "standard nonce size",
+			value:          "ENC[AES256_GCM,data:dLbxOaA=,iv:grVqlvy6CgQIKwkN,tag:qdOBNzRJ3eNSoMUVW3BdJQ==,type:str]",
+			additionalData: "value:",
+			wantErr:        errInvalidValue,
+		},
+		{
+			name:           "invalid base64",
+			value:          "ENC[AES256_GCM,data:dLbx!,iv:grVqlvy6CgQIKwkNxUhVP/+yBgNo6x3mbuBCb6O5JDQ=,tag:qdOBNzRJ3eNSoMUVW3BdJQ==,type:str]",
+			additionalData: "value:",
+			wantErr:        errInvalidValue,
+		},
+		{
+			name:           "other cipher",
+			value:          "ENC[AES128_GCM,data:dLbxOaA=,iv:grVqlvy6CgQIKwkNxUhVP/+yBgNo6x3mbuBCb6O5JDQ=,tag:qdOBNzRJ3eNSoMUVW3BdJQ==,type:str]",
+			additionalData: "value:",
+			wantErr:        errInvalidValue,
+		},
+		{
+			name:           "unterminated",
+			value:          "ENC[AES256_GCM,data:dLbxOaA=,iv:grVqlvy6CgQIKwkNxUhVP/+yBgNo6x3mbuBCb6O5JDQ=,tag:qdOBNzRJ3eNSoMUVW3BdJQ==,type:str",
+			additionalData: "value:",
+			wantErr:        errInvalidValue,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, tag, err := decryptValue(tt.value, dataKey, tt.additionalData)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("decryptValue() error = %v, want %v", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if tt.fails {
+				if err == nil {
+					t.Fatal("decryptValue() succeeded, want failure")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("decryptValue() error = %v", err)
+			}
+
+			if got != tt.want || tag != tt.wantTag {
+				t.Errorf("decryptValue() = %q, %q, want %q, %q", got, tag, tt.want, tt.wantTag)
+			}
+		})
+	}
+}
+
+func TestDecryptValues(t *testing.T) {
+	armored, err := os.ReadFile("testdata/value.age")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := map[string]any{
+		"bmc": map[string]any{
+			"username": "admin",
+			"password": string(armored),
+		},
+		"tokens": []any{string(armored), "plain"},
+		"port":   623,
+	}
+
+	got, err := NewDecrypter(testKeyFile).DecryptValues(value)
+	if err != nil {
+		t.Fatalf("DecryptValues() error = %v", err)
+	}
+
+	want := map[string]any{
+		"bmc": map[string]any{
+			"username": "admin",
+			"password": "s3cret",
+		},
+		"tokens": []any{"s3cret", "plain"},
+		"port":   623,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecryptValues() = %v, want %v", got, want)
+	}
+}
+
+func replace(old, replacement string) func(string) string {
+	return func(doc string) string {
+		return strings.Replace(doc, old, replacement, 1)
+	}
+}
+
+// lineIndex returns the index of the first line with the prefix
+func lineIndex(lines []string, prefix string) int {
+	for i, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			return i
+		}
+	}
+
+	return -1
+}
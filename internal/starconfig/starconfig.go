@@ -0,0 +1,176 @@
+// Package starconfig evaluates pixie configuration written in Starlark, for configs
+// that are easier to express with loops, functions, and shared definitions than with
+// plain YAML
+package starconfig
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Extension is the file extension of Starlark config files
+const Extension = ".star"
+
+// Name of the global variable that a config script must assign the config to
+const configGlobal = "config"
+
+var (
+	errNoConfig          = errors.New("script does not define a global '" + configGlobal + "'")
+	errUnsupportedValue  = errors.New("unsupported value type")
+	errNonStringKey      = errors.New("dict keys must be strings")
+	errIntegerOutOfRange = errors.New("integer out of range")
+	errLoadCycle         = errors.New("cycle in load graph")
+)
+
+// Load evaluates the Starlark config script at the given path, returning the value of
+// its 'config' global as plain Go values (maps, slices, strings, numbers, and bools).
+// The result has the same structure as a YAML config, and is validated in the same way.
+//
+// Scripts may load() other Starlark files, relative to the directory of the script
+// doing the loading.
+func Load(path string) (map[string]any, error) {
+	loader := &loader{cache: make(map[string]*loadEntry)}
+
+	thread := &starlark.Thread{Name: path, Load: loader.load}
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Starlark config: %w", err)
+	}
+
+	globals, err := starlark.ExecFileOptions(syntax.LegacyFileOptions(), thread, path, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate Starlark config: %w", err)
+	}
+
+	value, ok := globals[configGlobal]
+	if !ok {
+		return nil, errNoConfig
+	}
+
+	converted, err := toGo(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Starlark config: %w", err)
+	}
+
+	config, ok := converted.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("'%s' must be a dict, not %s: %w", configGlobal, value.Type(), errUnsupportedValue)
+	}
+
+	return config, nil
+}
+
+type loadEntry struct {
+	globals starlark.StringDict
+	err     error
+}
+
+type loader struct {
+	// A nil entry signals that the module is currently being loaded
+	cache map[string]*loadEntry
+}
+
+func (l *loader) load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	// Each thread is named after the path of the script it executes, so relative loads
+	// are resolved against the directory of the loading script
+	path := module
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(thread.Name), path)
+	}
+
+	entry, ok := l.cache[path]
+	if ok {
+		if entry == nil {
+			return nil, fmt.Errorf("'%s': %w", module, errLoadCycle)
+		}
+
+		return entry.globals, entry.err
+	}
+
+	l.cache[path] = nil
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("failed to read '%s': %w", module, err)
+		l.cache[path] = &loadEntry{err: err}
+		return nil, err
+	}
+
+	child := &starlark.Thread{Name: path, Load: thread.Load}
+	globals, err := starlark.ExecFileOptions(syntax.LegacyFileOptions(), child, path, source, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to evaluate '%s': %w", module, err)
+	}
+
+	l.cache[path] = &loadEntry{globals: globals, err: err}
+	return globals, err
+}
+
+// toGo converts a Starlark value to the equivalent plain Go value
+func toGo(value starlark.Value) (any, error) {
+	switch v := value.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Bytes:
+		// Bytes are indexable, so must be handled before lists and tuples
+		return string(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok || i > math.MaxInt || i < math.MinInt {
+			return nil, fmt.Errorf("%s: %w", v.String(), errIntegerOutOfRange)
+		}
+
+		return int(i), nil
+	case starlark.Float:
+		return float64(v), nil
+	case *starlark.Dict:
+		m := make(map[string]any, v.Len())
+		for _, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("key %s: %w", item[0].String(), errNonStringKey)
+			}
+
+			converted, err := toGo(item[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", string(key), err)
+			}
+
+			m[string(key)] = converted
+		}
+
+		return m, nil
+	case starlark.Indexable:
+		// Lists and tuples
+		s := make([]any, v.Len())
+		for i := range v.Len() {
+			converted, err := toGo(v.Index(i))
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+
+			s[i] = converted
+		}
+
+		return s, nil
+	default:
+		return nil, fmt.Errorf("%s: %w", value.Type(), errUnsupportedValue)
+	}
+}
+
+// IsStarlark returns whether the given config path refers to a Starlark config
+func IsStarlark(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), Extension)
+}
@@ -0,0 +1,71 @@
+package status
+
+import (
+	"sync"
+
+	"github.com/davejbax/pixie/internal/audit"
+)
+
+// Boots keeps the latest boot stage reached by each host. It is an [audit.Sink], so
+// that it sees boot events as they're recorded.
+type Boots struct {
+	mu   sync.Mutex
+	last map[string]Boot
+}
+
+func NewBoots() *Boots {
+	return &Boots{last: make(map[string]Boot)}
+}
+
+// Load reads the latest boots from the audit log at the given path, so that boots from
+// before pixie started are known
+func (b *Boots) Load(path string) error {
+	// Events are recorded as they're read, rather than collected, as the log may be large
+	_, err := audit.Read(path, func(event *audit.Event) bool {
+		b.Send(*event)
+		return false
+	})
+
+	return err //nolint:wrapcheck
+}
+
+// Send records the event, if it is a boot event of a known host
+func (b *Boots) Send(event audit.Event) {
+	if event.Host == "" || !isBootStage(event.Type) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if last, ok := b.last[event.Host]; ok && last.Time.After(event.Time) {
+		return
+	}
+
+	b.last[event.Host] = Boot{
+		Time:   event.Time,
+		Stage:  event.Type,
+		Detail: event.Detail,
+		MAC:    event.MAC,
+		IP:     event.IP,
+	}
+}
+
+// Last returns the latest boot stage reached by the host, if it has booted
+func (b *Boots) Last(host string) (Boot, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	boot, ok := b.last[host]
+
+	return boot, ok
+}
+
+func isBootStage(eventType audit.EventType) bool {
+	switch eventType {
+	case audit.EventBootloader, audit.EventConfig, audit.EventKernel, audit.EventInitrd:
+		return true
+	default:
+		return false
+	}
+}
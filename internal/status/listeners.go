@@ -0,0 +1,81 @@
+package status
+
+import (
+	"sync"
+	"time"
+)
+
+// ListenerState is whether a listener is serving
+type ListenerState string
+
+const (
+	ListenerRunning ListenerState = "running"
+	ListenerStopped ListenerState = "stopped"
+	ListenerFailed  ListenerState = "failed"
+)
+
+// Listener is a server that pixie runs, such as the TFTP or DHCP server
+type Listener struct {
+	Name    string        `json:"name"`
+	Address string        `json:"address"`
+	State   ListenerState `json:"state"`
+
+	// Why the listener failed, if it did
+	Error string `json:"error,omitempty"`
+
+	// When the listener entered its current state
+	Since time.Time `json:"since"`
+}
+
+// Listeners tracks the state of the servers that pixie runs
+type Listeners struct {
+	mu        sync.Mutex
+	listeners []*Listener
+}
+
+// Run runs a server until it returns, tracking it as a listener with the given name and
+// address
+func (l *Listeners) Run(name string, address string, serve func() error) error {
+	listener := &Listener{Name: name, Address: address}
+
+	l.mu.Lock()
+	l.listeners = append(l.listeners, listener)
+	listener.setState(ListenerRunning, nil)
+	l.mu.Unlock()
+
+	err := serve()
+
+	l.mu.Lock()
+	if err != nil {
+		listener.setState(ListenerFailed, err)
+	} else {
+		listener.setState(ListenerStopped, nil)
+	}
+	l.mu.Unlock()
+
+	return err
+}
+
+// setState changes the state of the listener. The mutex of its listeners must be held.
+func (listener *Listener) setState(state ListenerState, err error) {
+	listener.State = state
+	listener.Since = time.Now()
+	listener.Error = ""
+
+	if err != nil {
+		listener.Error = err.Error()
+	}
+}
+
+// List returns the listeners, in the order they were started
+func (l *Listeners) List() []Listener {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	listeners := make([]Listener, 0, len(l.listeners))
+	for _, listener := range l.listeners {
+		listeners = append(listeners, *listener)
+	}
+
+	return listeners
+}
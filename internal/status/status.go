@@ -0,0 +1,106 @@
+// Package status describes the state of a running pixie in a single document (its
+// distros, hosts, listeners and caches), so that operators and dashboards can triage it
+// at a glance
+package status
+
+import (
+	"time"
+
+	"github.com/davejbax/pixie/internal/audit"
+	"github.com/davejbax/pixie/internal/hoststatus"
+	"github.com/davejbax/pixie/internal/limiter"
+	"github.com/davejbax/pixie/internal/reconcile"
+)
+
+// Document is the status of a running pixie
+type Document struct {
+	Time      time.Time `json:"time"`
+	StartedAt time.Time `json:"started_at"`
+
+	// Role of the instance: 'primary' or 'replica'
+	Role string `json:"role"`
+
+	Distros   []Distro   `json:"distros"`
+	Hosts     []Host     `json:"hosts"`
+	Listeners []Listener `json:"listeners"`
+	Caches    []Cache    `json:"caches"`
+
+	// Transfers in progress and queued, keyed by the service they're limited by
+	Transfers map[string]limiter.Stats `json:"transfers"`
+
+	// Status of periodic reconciles (or, on replicas, refreshes), if they're enabled
+	Reconcile *reconcile.Status `json:"reconcile,omitempty"`
+}
+
+// Distro is a distro being served
+type Distro struct {
+	Name string `json:"name"`
+	Arch string `json:"arch"`
+
+	// Version as given in config, if any
+	Version string `json:"version,omitempty"`
+
+	Hash string `json:"hash"`
+	Tree bool   `json:"tree"`
+
+	// Hash of a newer version awaiting approval, if the distro isn't updated
+	// automatically
+	UpdateAvailable string `json:"update_available,omitempty"`
+}
+
+// Host is a configured host, and how far it last got booting
+type Host struct {
+	Name   string `json:"name"`
+	MAC    string `json:"mac,omitempty"`
+	Distro string `json:"distro,omitempty"`
+
+	LastBoot *Boot              `json:"last_boot,omitempty"`
+	Install  *hoststatus.Report `json:"install,omitempty"`
+}
+
+// Cache is the usage of a cache kept by pixie
+type Cache struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+
+	// Why the usage couldn't be measured, if it couldn't
+	Error string `json:"error,omitempty"`
+}
+
+// CacheSource measures the usage of a cache, returning its number of entries and their
+// total size
+type CacheSource struct {
+	Name  string
+	Usage func() (int, int64, error)
+}
+
+// Measure returns the cache's current usage
+func (s *CacheSource) Measure() Cache {
+	cache := Cache{Name: s.Name}
+
+	entries, size, err := s.Usage()
+	if err != nil {
+		cache.Error = err.Error()
+	} else {
+		cache.Entries = entries
+		cache.Bytes = size
+	}
+
+	return cache
+}
+
+// Boot is the latest stage of booting that a host reached
+type Boot struct {
+	Time time.Time `json:"time"`
+
+	// Last event recorded for the host's boot: 'bootloader', 'config', 'kernel' or
+	// 'initrd'
+	Stage audit.EventType `json:"stage"`
+
+	// What was served at that stage, e.g. a file path
+	Detail string `json:"detail,omitempty"`
+
+	MAC string `json:"mac,omitempty"`
+	IP  string `json:"ip,omitempty"`
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/davejbax/pixie/internal/atomicfile"
+)
+
+// Local keeps files in a directory on the local file system
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+func (l *Local) path(name string) (string, error) {
+	if name == "" {
+		name = "."
+	}
+
+	if !fs.ValidPath(name) {
+		return "", fmt.Errorf("'%s': %w", name, errInvalidName)
+	}
+
+	return filepath.Join(l.root, filepath.FromSlash(name)), nil
+}
+
+type localObject struct {
+	*os.File
+	size    int64
+	modTime time.Time
+}
+
+func (o *localObject) Size() int64 {
+	return o.size
+}
+
+func (o *localObject) ModTime() time.Time {
+	return o.modTime
+}
+
+// Open opens the named file. [ErrOutsideRoot] is returned if symlinks resolve to a path
+// outside of the root. The object is an [io.ReadSeeker], so that range requests can be
+// served from it.
+func (l *Local) Open(name string) (Object, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := filepath.EvalSymlinks(l.root)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, ErrOutsideRoot
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		_ = f.Close()
+		return nil, fs.ErrNotExist
+	}
+
+	return &localObject{File: f, size: stat.Size(), modTime: stat.ModTime()}, nil
+}
+
+func (l *Local) ReadFile(name string) ([]byte, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(path) //nolint:wrapcheck
+}
+
+// WriteFile atomically replaces the named file with data
+func (l *Local) WriteFile(name string, data []byte) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create directories in path '%s': %w", filepath.Dir(path), err)
+	}
+
+	if err := atomicfile.Write(path, data); err != nil {
+		return fmt.Errorf("failed to write '%s': %w", name, err)
+	}
+
+	return nil
+}
+
+func (l *Local) Remove(name string) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove '%s': %w", name, err)
+	}
+
+	return nil
+}
+
+func (l *Local) List(directory string) ([]string, error) {
+	path, err := l.path(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files have no children, just like directories that don't exist
+	if stat, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) || (err == nil && !stat.IsDir()) {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list '%s': %w", directory, err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	slices.Sort(names)
+
+	return names, nil
+}
+
+// Upload copies the files within localDirectory. Nothing is copied if localDirectory is
+// already the named directory.
+func (l *Local) Upload(directory string, localDirectory string) error {
+	path, err := l.path(directory)
+	if err != nil {
+		return err
+	}
+
+	if filepath.Clean(path) == filepath.Clean(localDirectory) {
+		return nil
+	}
+
+	return filepath.WalkDir(localDirectory, func(file string, entry fs.DirEntry, err error) error { //nolint:wrapcheck
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(localDirectory, file)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		output := filepath.Join(path, rel)
+
+		if entry.IsDir() {
+			return os.MkdirAll(output, 0o700) //nolint:wrapcheck
+		}
+
+		return copyFile(file, output)
+	})
+}
+
+func (l *Local) LocalPath(name string) (string, bool) {
+	path, err := l.path(name)
+	if err != nil {
+		return "", false
+	}
+
+	return path, true
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %w", from, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create '%s': %w", to, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy '%s': %w", from, err)
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close '%s': %w", to, err)
+	}
+
+	return nil
+}
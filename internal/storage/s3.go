@@ -0,0 +1,441 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+const (
+	s3Service = "s3"
+
+	// Hash of an empty payload, sent with requests that have no body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	errNoEndpoint = errors.New("an S3 endpoint is required")
+	errNoBucket   = errors.New("an S3 bucket is required")
+	errS3Status   = errors.New("object store returned an unsuccessful status")
+)
+
+// S3Config configures an S3-compatible object store, such as Amazon S3, MinIO, Ceph or
+// Cloudflare R2
+type S3Config struct {
+	// URL of the store's S3 API, e.g. 'https://s3.eu-west-2.amazonaws.com' or
+	// 'http://minio.local:9000'
+	Endpoint string
+
+	Region string `default:"us-east-1"`
+	Bucket string
+
+	// Prefix of the keys that artifacts are kept under, so that a bucket can be shared
+	Prefix string
+
+	// Credentials. If unset, requests are anonymous, e.g. for instances that only serve
+	// artifacts from a public bucket.
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+
+	// Address the bucket in the URL's path rather than as a subdomain of the endpoint,
+	// as self-hosted stores such as MinIO usually need
+	PathStyle bool `mapstructure:"path_style"`
+}
+
+func (c *S3Config) validate() error {
+	if c.Endpoint == "" {
+		return errNoEndpoint
+	}
+
+	if c.Bucket == "" {
+		return errNoBucket
+	}
+
+	if _, err := url.Parse(c.Endpoint); err != nil {
+		return fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+
+	return nil
+}
+
+// S3 keeps files as objects in an S3-compatible object store. Objects are streamed from
+// the store as they are read.
+type S3 struct {
+	config   *S3Config
+	client   *http.Client
+	signer   *v4.Signer
+	endpoint *url.URL
+}
+
+func NewS3(config *S3Config) (*S3, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+
+	return &S3{
+		config:   config,
+		client:   &http.Client{},
+		signer:   v4.NewSigner(),
+		endpoint: endpoint,
+	}, nil
+}
+
+func (s *S3) key(name string) (string, error) {
+	if name != "" && !fs.ValidPath(name) {
+		return "", fmt.Errorf("'%s': %w", name, errInvalidName)
+	}
+
+	return strings.TrimPrefix(path.Join(strings.Trim(s.config.Prefix, "/"), name), "/"), nil
+}
+
+type s3Object struct {
+	io.ReadCloser
+	size    int64
+	modTime time.Time
+}
+
+func (o *s3Object) Size() int64 {
+	return o.size
+}
+
+func (o *s3Object) ModTime() time.Time {
+	return o.modTime
+}
+
+func (s *S3) Open(name string) (Object, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(http.MethodGet, key, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fs.ErrNotExist
+	} else if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3StatusError(resp)
+	}
+
+	// Objects are only ever replaced whole, so their modification time changes whenever
+	// their content does
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return &s3Object{ReadCloser: resp.Body, size: resp.ContentLength, modTime: modTime}, nil
+}
+
+func (s *S3) ReadFile(name string) ([]byte, error) {
+	object, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", name, err)
+	}
+
+	return data, nil
+}
+
+// WriteFile puts the object. Puts are atomic in S3.
+func (s *S3) WriteFile(name string, data []byte) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+
+	return s.put(key, bytes.NewReader(data), int64(len(data)), sha256Hex(data))
+}
+
+func (s *S3) Remove(name string) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodDelete, key, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Deleting a key that doesn't exist succeeds, but some stores answer with 404
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3StatusError(resp)
+	}
+
+	return nil
+}
+
+type listBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// List lists the keys under the directory, with '/' as the delimiter
+func (s *S3) List(directory string) ([]string, error) {
+	prefix, err := s.key(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	names := []string{}
+	token := ""
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, s3StatusError(resp)
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode object listing: %w", err)
+		}
+
+		for _, content := range result.Contents {
+			names = append(names, strings.TrimPrefix(content.Key, prefix))
+		}
+
+		for _, common := range result.CommonPrefixes {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(common.Prefix, prefix), "/"))
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+
+		token = result.NextContinuationToken
+	}
+
+	slices.Sort(names)
+
+	return names, nil
+}
+
+// Upload puts each file within localDirectory as an object
+func (s *S3) Upload(directory string, localDirectory string) error {
+	prefix, err := s.key(directory)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(localDirectory, func(file string, entry fs.DirEntry, err error) error { //nolint:wrapcheck
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(localDirectory, file)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+
+		return s.upload(path.Join(prefix, filepath.ToSlash(rel)), file)
+	})
+}
+
+// upload puts a local file as an object. The file is read twice: once to sign its hash,
+// and once to send it.
+func (s *S3) upload(key string, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("failed to open '%s': %w", file, err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return fmt.Errorf("failed to hash '%s': %w", file, err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind '%s': %w", file, err)
+	}
+
+	return s.put(key, f, size, hex.EncodeToString(hash.Sum(nil)))
+}
+
+func (s *S3) put(key string, body io.Reader, size int64, payloadHash string) error {
+	resp, err := s.do(http.MethodPut, key, nil, &sizedBody{Reader: body, size: size}, payloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3StatusError(resp)
+	}
+
+	return nil
+}
+
+// LocalPath returns false, as objects aren't kept on the local file system
+func (s *S3) LocalPath(_ string) (string, bool) {
+	return "", false
+}
+
+type sizedBody struct {
+	io.Reader
+	size int64
+}
+
+// do makes a signed request for the object with the given key, or for the bucket if the
+// key is empty
+func (s *S3) do(method string, key string, query url.Values, body *sizedBody, payloadHash string) (*http.Response, error) {
+	u := *s.endpoint
+	u.RawQuery = query.Encode()
+
+	objectPath := "/" + key
+	if s.config.PathStyle {
+		objectPath = "/" + s.config.Bucket + objectPath
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+
+	// Keys are escaped as the signature expects, rather than as Go would escape them
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = awsEscapePath(u.Path)
+
+	var reader io.Reader
+	if body != nil {
+		reader = body.Reader
+	}
+
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create object store request: %w", err)
+	}
+
+	if body != nil {
+		req.ContentLength = body.size
+	}
+
+	req.Header.Set("User-Agent", "pixie")
+
+	if s.config.AccessKeyID != "" {
+		if err := s.sign(req, payloadHash, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("object store request failed: %w", err)
+	}
+
+	return resp, nil
+}
+
+// sign signs a request with AWS Signature Version 4
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) error {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	credentials := aws.Credentials{
+		AccessKeyID:     s.config.AccessKeyID,
+		SecretAccessKey: s.config.SecretAccessKey,
+	}
+
+	// Paths are already escaped as S3 expects, so mustn't be escaped again
+	if err := s.signer.SignHTTP(req.Context(), credentials, req, payloadHash, s3Service, s.config.Region, now, func(options *v4.SignerOptions) {
+		options.DisableURIPathEscaping = true
+	}); err != nil {
+		return fmt.Errorf("failed to sign object store request: %w", err)
+	}
+
+	return nil
+}
+
+// awsEscapePath percent-encodes every byte of a path except unreserved characters and
+// slashes, as AWS signatures require
+func awsEscapePath(s string) string {
+	escaped := &strings.Builder{}
+
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '.', b == '_', b == '~', b == '/':
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func s3StatusError(resp *http.Response) error {
+	status := resp.Status
+
+	// Stores explain errors in an XML body
+	var body struct {
+		Code    string
+		Message string
+	}
+
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body); err == nil && body.Code != "" {
+		status += " (" + body.Code + ": " + body.Message + ")"
+	}
+
+	return fmt.Errorf("%s %s: %s: %w", resp.Request.Method, resp.Request.URL.Path, status, errS3Status)
+}
@@ -0,0 +1,132 @@
+// Package storage keeps distro artifacts either on local disk or in an S3-compatible
+// object store, so that several pixie instances can share one set of artifacts
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"path"
+)
+
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+var (
+	// ErrOutsideRoot is returned when a name resolves (e.g. through a symlink) to a file
+	// outside of the store
+	ErrOutsideRoot = errors.New("path resolves outside of the store")
+
+	errInvalidName    = errors.New("invalid name")
+	errUnknownBackend = errors.New("unknown storage backend")
+)
+
+// Config selects where distro artifacts are kept
+type Config struct {
+	// Either 'local', to keep artifacts in the storage directory, or 's3', to keep them
+	// in an S3-compatible object store that several pixie instances can share
+	Backend string `default:"local"`
+
+	S3 S3Config `mapstructure:"s3"`
+}
+
+func (c *Config) Validate() error {
+	switch c.Backend {
+	case BackendLocal:
+		return nil
+	case BackendS3:
+		return c.S3.validate()
+	default:
+		return fmt.Errorf("'%s': %w", c.Backend, errUnknownBackend)
+	}
+}
+
+// Object is a stored file opened for reading
+type Object interface {
+	io.ReadCloser
+
+	// Size of the object in bytes
+	Size() int64
+
+	// ModTime returns when the object was last written, or the zero time if the backend
+	// doesn't know
+	ModTime() time.Time
+}
+
+// Backend stores files by slash-separated names relative to its root, e.g.
+// 'talos/x86_64/pixie-metadata.json'
+type Backend interface {
+	// Open opens the named file. [fs.ErrNotExist] is returned if there is no such file,
+	// or if the name is a directory.
+	Open(name string) (Object, error)
+
+	// ReadFile returns the contents of the named file. [fs.ErrNotExist] is returned if
+	// there is no such file.
+	ReadFile(name string) ([]byte, error)
+
+	// WriteFile replaces the named file. Readers see either the previous or the new
+	// contents, never a partially written file.
+	WriteFile(name string, data []byte) error
+
+	// Remove removes the named file, if it exists
+	Remove(name string) error
+
+	// List returns the names (relative to directory, and sorted) of the files and
+	// directories directly within the named directory. The root is named ''. Nothing is
+	// returned if there is no such directory.
+	List(directory string) ([]string, error)
+
+	// Upload copies the files within a local directory into the named directory
+	Upload(directory string, localDirectory string) error
+
+	// LocalPath returns where the named file is kept, if the backend keeps files on the
+	// local file system. Files can then be written in place, rather than uploaded.
+	LocalPath(name string) (string, bool)
+}
+
+// Open returns the configured backend. Local backends keep files in localDirectory.
+func Open(config *Config, localDirectory string) (Backend, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Backend == BackendS3 {
+		return NewS3(&config.S3)
+	}
+
+	return NewLocal(localDirectory), nil
+}
+
+// Files returns the names (relative to directory, and sorted) of the files within the
+// named directory and its subdirectories. Empty directories are listed as files, as
+// backends such as object stores can't tell them apart.
+func Files(backend Backend, directory string) ([]string, error) {
+	names, err := backend.List(directory)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	files := []string{}
+
+	for _, name := range names {
+		children, err := Files(backend, path.Join(directory, name))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(children) == 0 {
+			files = append(files, name)
+			continue
+		}
+
+		for _, child := range children {
+			files = append(files, path.Join(name, child))
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// Client is a network boot client, as last seen by DHCP
+type Client struct {
+	MAC      string
+	IP       string
+	UUID     string
+	LastSeen time.Time
+}
+
+// Clients returns all clients that have been seen
+func (d *DB) Clients() ([]Client, error) {
+	rows, err := d.db.Query("SELECT mac, ip, uuid, last_seen FROM clients ORDER BY mac")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query clients: %w", err)
+	}
+	defer rows.Close()
+
+	clients := []Client{}
+	for rows.Next() {
+		var (
+			client   Client
+			lastSeen string
+		)
+
+		if err := rows.Scan(&client.MAC, &client.IP, &client.UUID, &lastSeen); err != nil {
+			return nil, fmt.Errorf("failed to read client: %w", err)
+		}
+
+		if client.LastSeen, err = parseTime(lastSeen); err != nil {
+			return nil, err
+		}
+
+		clients = append(clients, client)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read clients: %w", err)
+	}
+
+	return clients, nil
+}
+
+// PutClient stores a client, replacing any with the same MAC address
+func (d *DB) PutClient(client *Client) error {
+	if _, err := d.db.Exec(
+		"INSERT OR REPLACE INTO clients (mac, ip, uuid, last_seen) VALUES (?, ?, ?, ?)",
+		client.MAC, client.IP, client.UUID, formatTime(client.LastSeen),
+	); err != nil {
+		return fmt.Errorf("failed to store client: %w", err)
+	}
+
+	return nil
+}
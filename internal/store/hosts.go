@@ -0,0 +1,51 @@
+package store
+
+import "fmt"
+
+// HostConfigs returns the JSON configs of hosts created at runtime, keyed by name. Host
+// configs are stored as JSON, as their schema belongs to the config file.
+func (d *DB) HostConfigs() (map[string][]byte, error) {
+	rows, err := d.db.Query("SELECT name, config FROM hosts")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query hosts: %w", err)
+	}
+	defer rows.Close()
+
+	configs := make(map[string][]byte)
+	for rows.Next() {
+		var (
+			name   string
+			config []byte
+		)
+
+		if err := rows.Scan(&name, &config); err != nil {
+			return nil, fmt.Errorf("failed to read host: %w", err)
+		}
+
+		configs[name] = config
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read hosts: %w", err)
+	}
+
+	return configs, nil
+}
+
+// PutHostConfig stores a host's JSON config, replacing any with the same name
+func (d *DB) PutHostConfig(name string, config []byte) error {
+	if _, err := d.db.Exec("INSERT OR REPLACE INTO hosts (name, config) VALUES (?, ?)", name, string(config)); err != nil {
+		return fmt.Errorf("failed to store host: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteHostConfig removes the host with the given name, if it is stored
+func (d *DB) DeleteHostConfig(name string) error {
+	if _, err := d.db.Exec("DELETE FROM hosts WHERE name = ?", name); err != nil {
+		return fmt.Errorf("failed to delete host: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// How long lease history is kept for
+const leaseHistoryRetention = 90 * 24 * time.Hour
+
+// Lease is a stored DHCP lease
+type Lease struct {
+	IP       string
+	MAC      string
+	Hostname string
+	Expiry   time.Time
+}
+
+// LeaseEvent is a change to a lease, recorded in the lease history
+type LeaseEvent struct {
+	Time  time.Time
+	Event string
+	Lease
+}
+
+// Leases returns all stored leases, including expired ones
+func (d *DB) Leases() ([]Lease, error) {
+	rows, err := d.db.Query("SELECT ip, mac, hostname, expiry FROM dhcp_leases ORDER BY ip")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DHCP leases: %w", err)
+	}
+	defer rows.Close()
+
+	leases := []Lease{}
+	for rows.Next() {
+		var (
+			lease  Lease
+			expiry string
+		)
+
+		if err := rows.Scan(&lease.IP, &lease.MAC, &lease.Hostname, &expiry); err != nil {
+			return nil, fmt.Errorf("failed to read DHCP lease: %w", err)
+		}
+
+		if lease.Expiry, err = parseTime(expiry); err != nil {
+			return nil, err
+		}
+
+		leases = append(leases, lease)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read DHCP leases: %w", err)
+	}
+
+	return leases, nil
+}
+
+// PutLease stores a lease, replacing any for the same address, and records the event
+// that changed it in the lease history
+func (d *DB) PutLease(event string, lease *Lease) error {
+	return d.leaseTx(event, lease, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			"INSERT OR REPLACE INTO dhcp_leases (ip, mac, hostname, expiry) VALUES (?, ?, ?, ?)",
+			lease.IP, lease.MAC, lease.Hostname, formatTime(lease.Expiry),
+		)
+
+		return err //nolint:wrapcheck
+	})
+}
+
+// DeleteLease removes the lease on the lease's address, and records the event that
+// removed it in the lease history
+func (d *DB) DeleteLease(event string, lease *Lease) error {
+	return d.leaseTx(event, lease, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM dhcp_leases WHERE ip = ?", lease.IP)
+		return err //nolint:wrapcheck
+	})
+}
+
+// leaseTx changes a lease and records the change in the lease history atomically,
+// pruning history older than the retention period
+func (d *DB) leaseTx(event string, lease *Lease, change func(tx *sql.Tx) error) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin DHCP lease transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := change(tx); err != nil {
+		return fmt.Errorf("failed to store DHCP lease: %w", err)
+	}
+
+	now := time.Now()
+
+	if _, err := tx.Exec(
+		"INSERT INTO dhcp_lease_history (time, event, ip, mac, hostname, expiry) VALUES (?, ?, ?, ?, ?, ?)",
+		formatTime(now), event, lease.IP, lease.MAC, lease.Hostname, formatTime(lease.Expiry),
+	); err != nil {
+		return fmt.Errorf("failed to record DHCP lease history: %w", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM dhcp_lease_history WHERE time < ?", formatTime(now.Add(-leaseHistoryRetention))); err != nil {
+		return fmt.Errorf("failed to prune DHCP lease history: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit DHCP lease: %w", err)
+	}
+
+	return nil
+}
+
+// LeaseHistory returns recorded lease events, newest first. If mac is not empty, only
+// the events of that client are returned. At most limit events are returned, or all of
+// them if limit is zero.
+func (d *DB) LeaseHistory(mac string, limit int) ([]LeaseEvent, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := d.db.Query(
+		"SELECT time, event, ip, mac, hostname, expiry FROM dhcp_lease_history WHERE ? = '' OR mac = ? ORDER BY id DESC LIMIT ?",
+		mac, mac, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DHCP lease history: %w", err)
+	}
+	defer rows.Close()
+
+	events := []LeaseEvent{}
+	for rows.Next() {
+		var (
+			event     LeaseEvent
+			t, expiry string
+		)
+
+		if err := rows.Scan(&t, &event.Event, &event.IP, &event.MAC, &event.Hostname, &expiry); err != nil {
+			return nil, fmt.Errorf("failed to read DHCP lease event: %w", err)
+		}
+
+		if event.Time, err = parseTime(t); err != nil {
+			return nil, err
+		}
+
+		if event.Expiry, err = parseTime(expiry); err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read DHCP lease history: %w", err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,59 @@
+package store
+
+// migrations are applied in order, each exactly once. Never edit a migration once
+// released: add a new one instead.
+var migrations = []string{
+	`
+CREATE TABLE oneshot_assignments (
+	host      TEXT PRIMARY KEY,
+	until     TEXT NOT NULL,
+	created   TEXT NOT NULL,
+	completed TEXT
+);
+
+CREATE TABLE host_statuses (
+	host    TEXT PRIMARY KEY,
+	status  TEXT NOT NULL,
+	message TEXT NOT NULL DEFAULT '',
+	client  TEXT NOT NULL DEFAULT '',
+	time    TEXT NOT NULL
+);
+
+-- Host configs created through the API, as JSON
+CREATE TABLE hosts (
+	name   TEXT PRIMARY KEY,
+	config TEXT NOT NULL
+);
+
+CREATE TABLE dhcp_leases (
+	ip       TEXT PRIMARY KEY,
+	mac      TEXT NOT NULL DEFAULT '',
+	hostname TEXT NOT NULL DEFAULT '',
+	expiry   TEXT NOT NULL
+);
+
+CREATE TABLE dhcp_lease_history (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	time     TEXT NOT NULL,
+	event    TEXT NOT NULL,
+	ip       TEXT NOT NULL,
+	mac      TEXT NOT NULL DEFAULT '',
+	hostname TEXT NOT NULL DEFAULT '',
+	expiry   TEXT NOT NULL
+);
+
+CREATE INDEX dhcp_lease_history_mac ON dhcp_lease_history (mac, time);
+CREATE INDEX dhcp_lease_history_time ON dhcp_lease_history (time);
+
+CREATE TABLE clients (
+	mac       TEXT PRIMARY KEY,
+	ip        TEXT NOT NULL DEFAULT '',
+	uuid      TEXT NOT NULL DEFAULT '',
+	last_seen TEXT NOT NULL
+);
+`,
+	`
+-- Distro booted by a one-shot assignment instead of the host's own
+ALTER TABLE oneshot_assignments ADD COLUMN distro TEXT NOT NULL DEFAULT '';
+`,
+}
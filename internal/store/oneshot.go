@@ -0,0 +1,75 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// OneShot is a stored one-shot boot assignment
+type OneShot struct {
+	Host      string
+	Until     string
+	Distro    string
+	Created   time.Time
+	Completed *time.Time
+}
+
+// OneShots returns all stored one-shot assignments
+func (d *DB) OneShots() ([]OneShot, error) {
+	rows, err := d.db.Query("SELECT host, until, distro, created, completed FROM oneshot_assignments ORDER BY host")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query one-shot assignments: %w", err)
+	}
+	defer rows.Close()
+
+	assignments := []OneShot{}
+	for rows.Next() {
+		var (
+			assignment OneShot
+			created    string
+			completed  sql.NullString
+		)
+
+		if err := rows.Scan(&assignment.Host, &assignment.Until, &assignment.Distro, &created, &completed); err != nil {
+			return nil, fmt.Errorf("failed to read one-shot assignment: %w", err)
+		}
+
+		if assignment.Created, err = parseTime(created); err != nil {
+			return nil, err
+		}
+
+		if assignment.Completed, err = parseNullTime(completed); err != nil {
+			return nil, err
+		}
+
+		assignments = append(assignments, assignment)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read one-shot assignments: %w", err)
+	}
+
+	return assignments, nil
+}
+
+// PutOneShot stores an assignment, replacing any for the same host
+func (d *DB) PutOneShot(assignment *OneShot) error {
+	if _, err := d.db.Exec(
+		"INSERT OR REPLACE INTO oneshot_assignments (host, until, distro, created, completed) VALUES (?, ?, ?, ?, ?)",
+		assignment.Host, assignment.Until, assignment.Distro, formatTime(assignment.Created), formatNullTime(assignment.Completed),
+	); err != nil {
+		return fmt.Errorf("failed to store one-shot assignment: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteOneShot removes the host's assignment, if it has one
+func (d *DB) DeleteOneShot(host string) error {
+	if _, err := d.db.Exec("DELETE FROM oneshot_assignments WHERE host = ?", host); err != nil {
+		return fmt.Errorf("failed to delete one-shot assignment: %w", err)
+	}
+
+	return nil
+}
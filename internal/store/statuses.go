@@ -0,0 +1,60 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// HostStatus is the latest install status reported by a host
+type HostStatus struct {
+	Host    string
+	Status  string
+	Message string
+	Client  string
+	Time    time.Time
+}
+
+// HostStatuses returns the latest status reported by every host that has reported one
+func (d *DB) HostStatuses() ([]HostStatus, error) {
+	rows, err := d.db.Query("SELECT host, status, message, client, time FROM host_statuses ORDER BY host")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query host statuses: %w", err)
+	}
+	defer rows.Close()
+
+	statuses := []HostStatus{}
+	for rows.Next() {
+		var (
+			status HostStatus
+			t      string
+		)
+
+		if err := rows.Scan(&status.Host, &status.Status, &status.Message, &status.Client, &t); err != nil {
+			return nil, fmt.Errorf("failed to read host status: %w", err)
+		}
+
+		if status.Time, err = parseTime(t); err != nil {
+			return nil, err
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read host statuses: %w", err)
+	}
+
+	return statuses, nil
+}
+
+// PutHostStatus stores a status, replacing the host's previous one
+func (d *DB) PutHostStatus(status *HostStatus) error {
+	if _, err := d.db.Exec(
+		"INSERT OR REPLACE INTO host_statuses (host, status, message, client, time) VALUES (?, ?, ?, ?, ?)",
+		status.Host, status.Status, status.Message, status.Client, formatTime(status.Time),
+	); err != nil {
+		return fmt.Errorf("failed to store host status: %w", err)
+	}
+
+	return nil
+}
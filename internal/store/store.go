@@ -0,0 +1,169 @@
+// Package store persists pixie's runtime state (one-shot assignments, install statuses,
+// hosts created through the API, DHCP leases and their history, and when clients were
+// last seen) in a SQLite database. Desired state stays in the config file: the store
+// only holds what pixie learns or is told while it runs.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	// Pure Go SQLite driver, so that pixie doesn't need cgo
+	_ "modernc.org/sqlite"
+)
+
+// Backends that runtime state can be kept in
+const (
+	// A JSON file per kind of state in the storage directory
+	BackendJSON = "json"
+
+	// A single SQLite database in the storage directory
+	BackendSQLite = "sqlite"
+)
+
+var (
+	errUnknownBackend = errors.New("state backend must be 'json' or 'sqlite'")
+	errTooNew         = errors.New("refusing to use a state database from a newer version")
+)
+
+type Config struct {
+	// Where runtime state is kept: 'json' or 'sqlite'. State isn't copied between
+	// backends, so changing the backend starts from empty state.
+	Backend string `mapstructure:"backend" default:"json"`
+
+	// Path of the SQLite database, relative to the storage directory
+	Path string `mapstructure:"path" default:"state.db"`
+}
+
+// Validate checks that the backend is known
+func (c *Config) Validate() error {
+	switch c.Backend {
+	case BackendJSON, BackendSQLite:
+		return nil
+	default:
+		return fmt.Errorf("'%s': %w", c.Backend, errUnknownBackend)
+	}
+}
+
+// DB is a SQLite state database
+type DB struct {
+	db *sql.DB
+}
+
+// Open opens the database at the given path, creating it if it doesn't exist, and
+// migrates it to the latest schema
+func Open(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create state database directory: %w", err)
+	}
+
+	// Wait rather than fail when another process (e.g. the CLI while pixie is serving)
+	// holds the lock, and use a write-ahead log so that readers don't block writers
+	dsn := (&url.URL{
+		Scheme:   "file",
+		Path:     path,
+		RawQuery: "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)",
+	}).String()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database: %w", err)
+	}
+
+	// SQLite allows a single writer, so serialise access rather than retrying on
+	// SQLITE_BUSY within the process
+	db.SetMaxOpenConns(1)
+
+	store := &DB{db: db}
+	if err := store.migrate(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (d *DB) Close() error {
+	return d.db.Close() //nolint:wrapcheck
+}
+
+// migrate applies the migrations that the database hasn't had yet. The number applied is
+// kept in SQLite's user_version.
+func (d *DB) migrate() error {
+	var version int
+	if err := d.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read state database version: %w", err)
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("state database version %d is newer than this version of pixie (%d): %w", version, len(migrations), errTooNew)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := d.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", i+1, err)
+		}
+
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+
+		// PRAGMA doesn't accept parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", i+1, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// Times are stored as RFC 3339 text in UTC, so that they're readable with the sqlite3
+// shell. Unlike time.RFC3339Nano, the layout always has nine fractional digits, so that
+// times are the same width and compare correctly as text (e.g. in retention queries).
+const timeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time in state database: %w", err)
+	}
+
+	return t, nil
+}
+
+func formatNullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+
+	return sql.NullString{String: formatTime(*t), Valid: true}
+}
+
+func parseNullTime(s sql.NullString) (*time.Time, error) {
+	if !s.Valid {
+		return nil, nil //nolint:nilnil
+	}
+
+	t, err := parseTime(s.String)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
@@ -0,0 +1,207 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// How long the client waits for each packet from the server, and how many times it
+	// resends its last packet before giving up
+	clientTimeout = 5 * time.Second
+	clientRetries = 5
+
+	defaultPort = "69"
+)
+
+var (
+	// ErrNotFound is returned by [Get] when the server doesn't have the requested file
+	ErrNotFound = errors.New("file not found on TFTP server")
+
+	errServerError = errors.New("TFTP server returned an error")
+	errNoResponse  = errors.New("TFTP server stopped responding")
+)
+
+// Get downloads a file from a TFTP server, as a network boot client would, writing it
+// to w and returning its size. The server's port defaults to 69. A block size larger
+// than the default is requested if blockSize is positive, which the server may refuse.
+func Get(ctx context.Context, server string, filename string, w io.Writer, blockSize int) (int64, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, defaultPort)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve TFTP server '%s': %w", server, err)
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to listen for TFTP replies: %w", err)
+	}
+	defer conn.Close()
+
+	// Cancelling the context interrupts waiting for the next packet
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	options := []option{}
+	if blockSize > 0 {
+		options = append(options, option{name: optionBlockSize, value: strconv.Itoa(blockSize)})
+	}
+
+	transfer := &clientTransfer{
+		conn:      conn,
+		w:         w,
+		send:      readRequestPacket(filename, options),
+		sendTo:    addr,
+		blockSize: defaultBlockSize,
+		expected:  1,
+	}
+
+	size, err := transfer.run(ctx)
+	if err != nil {
+		return size, fmt.Errorf("failed to get '%s' from '%s': %w", filename, server, err)
+	}
+
+	return size, nil
+}
+
+// clientTransfer is the state of a download by [Get]
+type clientTransfer struct {
+	conn *net.UDPConn
+	w    io.Writer
+
+	// Last packet sent, which is resent if the server doesn't respond, and where to
+	// send it. Once the server replies, packets go to the port that it replied from.
+	send   []byte
+	sendTo *net.UDPAddr
+	peer   *net.UDPAddr
+
+	blockSize int
+	expected  uint16
+	written   int64
+}
+
+func (t *clientTransfer) run(ctx context.Context) (int64, error) {
+	buff := make([]byte, opcodeSize+blockSize+maxBlockSize)
+	retries := 0
+
+	for {
+		if _, err := t.conn.WriteToUDP(t.send, t.sendTo); err != nil {
+			return t.written, fmt.Errorf("failed to send packet: %w", err)
+		}
+
+		if err := t.conn.SetReadDeadline(time.Now().Add(clientTimeout)); err != nil {
+			return t.written, fmt.Errorf("failed to set read deadline: %w", err)
+		}
+
+		n, from, err := t.conn.ReadFromUDP(buff)
+		if ctx.Err() != nil {
+			return t.written, ctx.Err() //nolint:wrapcheck
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if retries++; retries > clientRetries {
+				return t.written, errNoResponse
+			}
+
+			continue
+		} else if err != nil {
+			return t.written, fmt.Errorf("failed to read packet: %w", err)
+		}
+
+		// Packets from anywhere other than the server's transfer port are ignored
+		if t.peer != nil && (!from.IP.Equal(t.peer.IP) || from.Port != t.peer.Port) {
+			continue
+		}
+
+		t.peer = from
+		t.sendTo = from
+		retries = 0
+
+		done, err := t.receive(buff[:n])
+		if err != nil || done {
+			return t.written, err
+		}
+	}
+}
+
+// receive handles a packet from the server, returning true once the last block has
+// been written (and acknowledged)
+func (t *clientTransfer) receive(packet []byte) (bool, error) {
+	if len(packet) < opcodeSize {
+		return false, errPacketTooShort
+	}
+
+	switch opcode(binary.BigEndian.Uint16(packet)) {
+	case opcodeOACK:
+		fields := bytes.Split(packet[opcodeSize:], []byte{0})
+		for i := 0; i+1 < len(fields); i += 2 {
+			if string(bytes.ToLower(fields[i])) == optionBlockSize {
+				if size, err := strconv.Atoi(string(fields[i+1])); err == nil {
+					t.blockSize = size
+				}
+			}
+		}
+
+		t.send = ackPacket(0)
+
+		return false, nil
+	case opcodeERROR:
+		if len(packet) < opcodeSize+2 {
+			return false, errPacketTooShort
+		}
+
+		code := ErrorCode(binary.BigEndian.Uint16(packet[opcodeSize:]))
+		message, _, _ := bytes.Cut(packet[opcodeSize+2:], []byte{0})
+
+		if code == ErrorCodeFileNotFound {
+			return false, fmt.Errorf("%s: %w", message, ErrNotFound)
+		}
+
+		return false, fmt.Errorf("error code %d (%s): %w", code, message, errServerError)
+	case opcodeDATA:
+		if len(packet) < opcodeSize+blockSize {
+			return false, errPacketTooShort
+		}
+
+		// Duplicates of earlier blocks are acknowledged again by resending the last ACK
+		if binary.BigEndian.Uint16(packet[opcodeSize:]) != t.expected {
+			return false, nil
+		}
+
+		data := packet[opcodeSize+blockSize:]
+
+		n, err := t.w.Write(data)
+		t.written += int64(n)
+
+		if err != nil {
+			return false, fmt.Errorf("failed to write block %d: %w", t.expected, err)
+		}
+
+		t.send = ackPacket(t.expected)
+		t.expected++
+
+		if len(data) < t.blockSize {
+			// The final ACK isn't retried: the server resends the last block if it's lost,
+			// but the file is complete either way
+			_, _ = t.conn.WriteToUDP(t.send, t.sendTo)
+			return true, nil
+		}
+
+		return false, nil
+	default:
+		return false, errUnexpectedPacket
+	}
+}
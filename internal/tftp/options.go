@@ -0,0 +1,100 @@
+package tftp
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/davejbax/pixie/internal/quirks"
+)
+
+// Options negotiated with clients (RFC 2347)
+const (
+	optionBlockSize  = "blksize"    // RFC 2348
+	optionTimeout    = "timeout"    // RFC 2349
+	optionSize       = "tsize"      // RFC 2349
+	optionWindowSize = "windowsize" // RFC 7440
+)
+
+// Valid ranges of option values
+const (
+	minBlockSize  = 8
+	maxBlockSize  = 65464
+	minTimeout    = 1
+	maxTimeout    = 255
+	minWindowSize = 1
+	maxWindowSize = 65535
+)
+
+// transferOptions are the parameters of a single transfer
+type transferOptions struct {
+	blockSize  int
+	windowSize int
+	timeout    time.Duration
+}
+
+// option is an option accepted by the server, to be sent back in an OACK packet
+type option struct {
+	name  string
+	value string
+}
+
+// negotiate chooses the transfer parameters for a request, within the limits of the
+// server config and the client's quirks. It returns the options accepted, which are
+// empty if the client requested none that the server supports; in that case the
+// transfer uses the RFC 1350 defaults, and no OACK is sent.
+func (s *Server) negotiate(req *readRequest, size int64, clientQuirks *quirks.Quirks) (*transferOptions, []option) {
+	opts := &transferOptions{
+		blockSize:  defaultBlockSize,
+		windowSize: 1,
+		timeout:    s.config.Timeout,
+	}
+
+	accepted := []option{}
+
+	if requested, ok := parseOption(req.options, optionBlockSize, minBlockSize, maxBlockSize); ok {
+		opts.blockSize = min(requested, s.config.MaxBlockSize)
+		if clientQuirks.MaxBlockSize > 0 {
+			opts.blockSize = min(opts.blockSize, clientQuirks.MaxBlockSize)
+		}
+
+		opts.blockSize = max(opts.blockSize, minBlockSize)
+		accepted = append(accepted, option{optionBlockSize, strconv.Itoa(opts.blockSize)})
+	}
+
+	if requested, ok := parseOption(req.options, optionTimeout, minTimeout, maxTimeout); ok {
+		opts.timeout = time.Duration(requested) * time.Second
+		accepted = append(accepted, option{optionTimeout, strconv.Itoa(requested)})
+	}
+
+	// Clients request the size with a value of zero, and the server replies with the
+	// actual size
+	if _, ok := req.options[optionSize]; ok && size >= 0 {
+		accepted = append(accepted, option{optionSize, strconv.FormatInt(size, 10)})
+	}
+
+	// Leaving the option out of the OACK refuses it, so the client falls back to a
+	// window of one block
+	if requested, ok := parseOption(req.options, optionWindowSize, minWindowSize, maxWindowSize); ok &&
+		!clientQuirks.DisableWindowSize && s.config.MaxWindowSize > 1 {
+		opts.windowSize = min(requested, s.config.MaxWindowSize)
+		accepted = append(accepted, option{optionWindowSize, strconv.Itoa(opts.windowSize)})
+	}
+
+	return opts, accepted
+}
+
+// parseOption returns the value of a numeric option, if the client requested it with a
+// value in the valid range. Invalid options are ignored, as RFC 2347 allows.
+func parseOption(options map[string]string, name string, lower int, upper int) (int, bool) {
+	value, ok := options[name]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lower || n > upper {
+		return 0, false
+	}
+
+	return n, true
+}
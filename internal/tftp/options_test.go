@@ -0,0 +1,349 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/davejbax/pixie/internal/quirks"
+)
+
+// Read requests sent by common PXE clients
+var (
+	// Intel PXE option ROM fetching its NBP, asking only for its size
+	intelRRQ = []byte("\x00\x01pxelinux.0\x00octet\x00tsize\x000\x00")
+
+	// iPXE, which asks for the size and a block size filling an Ethernet frame
+	ipxeRRQ = []byte("\x00\x01undionly.kpxe\x00octet\x00blksize\x001432\x00tsize\x000\x00")
+
+	// EDK2 (OVMF) UEFI firmware, which also requests windowed transfers
+	edk2RRQ = []byte("\x00\x01pixie/x86_64.efi\x00octet\x00blksize\x001468\x00windowsize\x004\x00tsize\x000\x00")
+)
+
+func TestParseReadRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  []byte
+		want    *readRequest
+		wantErr error
+	}{
+		{
+			name:   "Intel PXE ROM",
+			packet: intelRRQ,
+			want: &readRequest{
+				filename: "pxelinux.0",
+				mode:     "octet",
+				options:  map[string]string{"tsize": "0"},
+			},
+		},
+		{
+			name:   "iPXE",
+			packet: ipxeRRQ,
+			want: &readRequest{
+				filename: "undionly.kpxe",
+				mode:     "octet",
+				options:  map[string]string{"blksize": "1432", "tsize": "0"},
+			},
+		},
+		{
+			name:   "EDK2",
+			packet: edk2RRQ,
+			want: &readRequest{
+				filename: "pixie/x86_64.efi",
+				mode:     "octet",
+				options:  map[string]string{"blksize": "1468", "windowsize": "4", "tsize": "0"},
+			},
+		},
+		{
+			name:   "no options, upper case mode",
+			packet: []byte("\x00\x01grub.cfg\x00OCTET\x00"),
+			want: &readRequest{
+				filename: "grub.cfg",
+				mode:     "octet",
+				options:  map[string]string{},
+			},
+		},
+		{
+			name:   "upper case option names",
+			packet: []byte("\x00\x01grub.cfg\x00octet\x00BLKSIZE\x00512\x00"),
+			want: &readRequest{
+				filename: "grub.cfg",
+				mode:     "octet",
+				options:  map[string]string{"blksize": "512"},
+			},
+		},
+		{
+			name:   "option without value is ignored",
+			packet: []byte("\x00\x01grub.cfg\x00octet\x00tsize\x00"),
+			want: &readRequest{
+				filename: "grub.cfg",
+				mode:     "octet",
+				options:  map[string]string{},
+			},
+		},
+		{
+			name:    "empty",
+			packet:  []byte{},
+			wantErr: errPacketTooShort,
+		},
+		{
+			name:    "write request",
+			packet:  []byte("\x00\x02grub.cfg\x00octet\x00"),
+			wantErr: errUnexpectedPacket,
+		},
+		{
+			name:    "unterminated mode",
+			packet:  []byte("\x00\x01grub.cfg\x00octet"),
+			wantErr: errUnterminated,
+		},
+		{
+			name:    "missing mode",
+			packet:  []byte("\x00\x01grub.cfg\x00"),
+			wantErr: errUnterminated,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseReadRequest(test.packet)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("parseReadRequest() error = %v, want %v", err, test.wantErr)
+			}
+
+			if test.wantErr != nil {
+				return
+			}
+
+			if got.filename != test.want.filename || got.mode != test.want.mode || !maps.Equal(got.options, test.want.options) {
+				t.Errorf("parseReadRequest() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	config := &Config{
+		Timeout:       5 * time.Second,
+		MaxBlockSize:  1468,
+		MaxWindowSize: 16,
+	}
+
+	tests := []struct {
+		name         string
+		config       *Config
+		packet       []byte
+		size         int64
+		quirks       quirks.Quirks
+		want         transferOptions
+		wantAccepted []option
+	}{
+		{
+			name:         "Intel PXE ROM",
+			packet:       intelRRQ,
+			size:         42,
+			want:         transferOptions{blockSize: defaultBlockSize, windowSize: 1, timeout: 5 * time.Second},
+			wantAccepted: []option{{"tsize", "42"}},
+		},
+		{
+			name:         "iPXE",
+			packet:       ipxeRRQ,
+			size:         70000,
+			want:         transferOptions{blockSize: 1432, windowSize: 1, timeout: 5 * time.Second},
+			wantAccepted: []option{{"blksize", "1432"}, {"tsize", "70000"}},
+		},
+		{
+			name:         "EDK2",
+			packet:       edk2RRQ,
+			size:         1 << 20,
+			want:         transferOptions{blockSize: 1468, windowSize: 4, timeout: 5 * time.Second},
+			wantAccepted: []option{{"blksize", "1468"}, {"tsize", "1048576"}, {"windowsize", "4"}},
+		},
+		{
+			name:         "block size above server maximum",
+			packet:       []byte("\x00\x01a\x00octet\x00blksize\x0065464\x00"),
+			want:         transferOptions{blockSize: 1468, windowSize: 1, timeout: 5 * time.Second},
+			wantAccepted: []option{{"blksize", "1468"}},
+		},
+		{
+			name:         "block size limited by quirks",
+			packet:       edk2RRQ,
+			size:         10,
+			quirks:       quirks.Quirks{MaxBlockSize: 512},
+			want:         transferOptions{blockSize: 512, windowSize: 4, timeout: 5 * time.Second},
+			wantAccepted: []option{{"blksize", "512"}, {"tsize", "10"}, {"windowsize", "4"}},
+		},
+		{
+			name:         "windowing disabled by quirks",
+			packet:       edk2RRQ,
+			size:         10,
+			quirks:       quirks.Quirks{DisableWindowSize: true},
+			want:         transferOptions{blockSize: 1468, windowSize: 1, timeout: 5 * time.Second},
+			wantAccepted: []option{{"blksize", "1468"}, {"tsize", "10"}},
+		},
+		{
+			name:         "windowing disabled by config",
+			config:       &Config{Timeout: 5 * time.Second, MaxBlockSize: 1468, MaxWindowSize: 1},
+			packet:       edk2RRQ,
+			size:         10,
+			want:         transferOptions{blockSize: 1468, windowSize: 1, timeout: 5 * time.Second},
+			wantAccepted: []option{{"blksize", "1468"}, {"tsize", "10"}},
+		},
+		{
+			name:         "window size above server maximum",
+			packet:       []byte("\x00\x01a\x00octet\x00windowsize\x0064\x00"),
+			want:         transferOptions{blockSize: defaultBlockSize, windowSize: 16, timeout: 5 * time.Second},
+			wantAccepted: []option{{"windowsize", "16"}},
+		},
+		{
+			name:         "timeout",
+			packet:       []byte("\x00\x01a\x00octet\x00timeout\x002\x00"),
+			want:         transferOptions{blockSize: defaultBlockSize, windowSize: 1, timeout: 2 * time.Second},
+			wantAccepted: []option{{"timeout", "2"}},
+		},
+		{
+			name:         "size of file with unknown size is refused",
+			packet:       intelRRQ,
+			size:         -1,
+			want:         transferOptions{blockSize: defaultBlockSize, windowSize: 1, timeout: 5 * time.Second},
+			wantAccepted: []option{},
+		},
+		{
+			name:         "invalid values are ignored",
+			packet:       []byte("\x00\x01a\x00octet\x00blksize\x004\x00timeout\x00256\x00windowsize\x00many\x00"),
+			want:         transferOptions{blockSize: defaultBlockSize, windowSize: 1, timeout: 5 * time.Second},
+			wantAccepted: []option{},
+		},
+		{
+			name:         "unknown options are ignored",
+			packet:       []byte("\x00\x01a\x00octet\x00multicast\x00\x00"),
+			want:         transferOptions{blockSize: defaultBlockSize, windowSize: 1, timeout: 5 * time.Second},
+			wantAccepted: []option{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := parseReadRequest(test.packet)
+			if err != nil {
+				t.Fatalf("parseReadRequest() error = %v", err)
+			}
+
+			s := &Server{config: config}
+			if test.config != nil {
+				s.config = test.config
+			}
+
+			got, accepted := s.negotiate(req, test.size, &test.quirks)
+			if *got != test.want {
+				t.Errorf("negotiate() options = %+v, want %+v", *got, test.want)
+			}
+
+			if !slices.Equal(accepted, test.wantAccepted) {
+				t.Errorf("negotiate() accepted = %v, want %v", accepted, test.wantAccepted)
+			}
+		})
+	}
+}
+
+func TestOACKPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []option
+		want    []byte
+	}{
+		{
+			name:    "iPXE",
+			options: []option{{"blksize", "1432"}, {"tsize", "70000"}},
+			want:    []byte("\x00\x06blksize\x001432\x00tsize\x0070000\x00"),
+		},
+		{
+			name:    "no options",
+			options: nil,
+			want:    []byte("\x00\x06"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := oackPacket(test.options); !bytes.Equal(got, test.want) {
+				t.Errorf("oackPacket() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseAck(t *testing.T) {
+	tests := []struct {
+		name       string
+		packet     []byte
+		want       uint16
+		wantErr    error
+		wantCode   ErrorCode
+		wantMsg    string
+		wantRemote bool
+	}{
+		{
+			name:   "ACK of OACK",
+			packet: []byte{0x00, 0x04, 0x00, 0x00},
+			want:   0,
+		},
+		{
+			name:   "ACK",
+			packet: []byte{0x00, 0x04, 0x12, 0x34},
+			want:   0x1234,
+		},
+		{
+			name:       "client aborts after tsize",
+			packet:     []byte("\x00\x05\x00\x00TFTP Aborted\x00"),
+			wantRemote: true,
+			wantCode:   ErrorCodeUndefined,
+			wantMsg:    "TFTP Aborted",
+		},
+		{
+			name:       "client refuses options",
+			packet:     []byte("\x00\x05\x00\x08\x00"),
+			wantRemote: true,
+			wantCode:   8,
+		},
+		{
+			name:    "short",
+			packet:  []byte{0x00, 0x04, 0x00},
+			wantErr: errPacketTooShort,
+		},
+		{
+			name:    "DATA",
+			packet:  []byte{0x00, 0x03, 0x00, 0x01},
+			wantErr: errUnexpectedPacket,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseAck(test.packet)
+
+			if test.wantRemote {
+				var remote *remoteError
+				if !errors.As(err, &remote) {
+					t.Fatalf("parseAck() error = %v, want remote error", err)
+				}
+
+				if remote.code != test.wantCode || remote.message != test.wantMsg {
+					t.Errorf("parseAck() remote error = %d %q, want %d %q", remote.code, remote.message, test.wantCode, test.wantMsg)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("parseAck() error = %v, want %v", err, test.wantErr)
+			}
+
+			if got != test.want {
+				t.Errorf("parseAck() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
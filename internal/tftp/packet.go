@@ -0,0 +1,177 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type opcode uint16
+
+const (
+	opcodeRRQ   opcode = 1
+	opcodeWRQ   opcode = 2
+	opcodeDATA  opcode = 3
+	opcodeACK   opcode = 4
+	opcodeERROR opcode = 5
+	opcodeOACK  opcode = 6
+)
+
+// ErrorCode is a TFTP error code, as defined by RFC 1350
+type ErrorCode uint16
+
+const (
+	ErrorCodeUndefined        ErrorCode = 0
+	ErrorCodeFileNotFound     ErrorCode = 1
+	ErrorCodeAccessViolation  ErrorCode = 2
+	ErrorCodeDiskFull         ErrorCode = 3
+	ErrorCodeIllegalOperation ErrorCode = 4
+	ErrorCodeUnknownTID       ErrorCode = 5
+)
+
+const (
+	// Default block size defined by RFC 1350
+	defaultBlockSize = 512
+
+	opcodeSize = 2
+	blockSize  = 2
+)
+
+var (
+	errPacketTooShort   = errors.New("packet too short")
+	errUnterminated     = errors.New("packet contains unterminated string")
+	errUnexpectedPacket = errors.New("unexpected packet type")
+)
+
+type readRequest struct {
+	filename string
+	mode     string
+	options  map[string]string
+}
+
+func parseReadRequest(packet []byte) (*readRequest, error) {
+	if len(packet) < opcodeSize {
+		return nil, errPacketTooShort
+	}
+
+	if opcode(binary.BigEndian.Uint16(packet)) != opcodeRRQ {
+		return nil, errUnexpectedPacket
+	}
+
+	fields := bytes.Split(packet[opcodeSize:], []byte{0})
+
+	// A nul-terminated final field leaves an empty trailing element
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return nil, errUnterminated
+	}
+
+	fields = fields[:len(fields)-1]
+
+	req := &readRequest{
+		filename: string(fields[0]),
+		mode:     strings.ToLower(string(fields[1])),
+		options:  make(map[string]string),
+	}
+
+	// Options (RFC 2347) are pairs of nul-terminated strings following the mode
+	for i := 2; i+1 < len(fields); i += 2 {
+		req.options[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+
+	return req, nil
+}
+
+// readRequestPacket creates a read request for the file in octet mode, with the given
+// options
+func readRequestPacket(filename string, options []option) []byte {
+	packet := make([]byte, opcodeSize)
+	binary.BigEndian.PutUint16(packet, uint16(opcodeRRQ))
+
+	packet = append(packet, filename...)
+	packet = append(packet, 0)
+	packet = append(packet, "octet"...)
+	packet = append(packet, 0)
+
+	for _, opt := range options {
+		packet = append(packet, opt.name...)
+		packet = append(packet, 0)
+		packet = append(packet, opt.value...)
+		packet = append(packet, 0)
+	}
+
+	return packet
+}
+
+func ackPacket(block uint16) []byte {
+	packet := make([]byte, opcodeSize+blockSize)
+	binary.BigEndian.PutUint16(packet, uint16(opcodeACK))
+	binary.BigEndian.PutUint16(packet[opcodeSize:], block)
+
+	return packet
+}
+
+func dataPacket(block uint16, data []byte) []byte {
+	packet := make([]byte, opcodeSize+blockSize+len(data))
+	binary.BigEndian.PutUint16(packet, uint16(opcodeDATA))
+	binary.BigEndian.PutUint16(packet[opcodeSize:], block)
+	copy(packet[opcodeSize+blockSize:], data)
+
+	return packet
+}
+
+// oackPacket creates an option acknowledgement packet (RFC 2347) for the given options
+func oackPacket(options []option) []byte {
+	packet := make([]byte, opcodeSize)
+	binary.BigEndian.PutUint16(packet, uint16(opcodeOACK))
+
+	for _, opt := range options {
+		packet = append(packet, opt.name...)
+		packet = append(packet, 0)
+		packet = append(packet, opt.value...)
+		packet = append(packet, 0)
+	}
+
+	return packet
+}
+
+func errorPacket(code ErrorCode, message string) []byte {
+	packet := make([]byte, opcodeSize+2, opcodeSize+2+len(message)+1)
+	binary.BigEndian.PutUint16(packet, uint16(opcodeERROR))
+	binary.BigEndian.PutUint16(packet[opcodeSize:], uint16(code))
+	packet = append(packet, message...)
+	packet = append(packet, 0)
+
+	return packet
+}
+
+// parseAck parses an ACK packet, returning the acknowledged block number. If the packet
+// is an ERROR packet, a [*remoteError] is returned.
+func parseAck(packet []byte) (uint16, error) {
+	if len(packet) < opcodeSize+blockSize {
+		return 0, errPacketTooShort
+	}
+
+	switch opcode(binary.BigEndian.Uint16(packet)) {
+	case opcodeACK:
+		return binary.BigEndian.Uint16(packet[opcodeSize:]), nil
+	case opcodeERROR:
+		message, _, _ := bytes.Cut(packet[opcodeSize+2:], []byte{0})
+		return 0, &remoteError{
+			code:    ErrorCode(binary.BigEndian.Uint16(packet[opcodeSize:])),
+			message: string(message),
+		}
+	default:
+		return 0, errUnexpectedPacket
+	}
+}
+
+type remoteError struct {
+	code    ErrorCode
+	message string
+}
+
+func (e *remoteError) Error() string {
+	return fmt.Sprintf("client sent error code %d: %s", e.code, e.message)
+}
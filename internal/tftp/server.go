@@ -0,0 +1,466 @@
+// Package tftp implements a read-only TFTP server for serving bootloaders to
+// network boot clients
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/davejbax/pixie/internal/acl"
+	"github.com/davejbax/pixie/internal/catalog"
+	"github.com/davejbax/pixie/internal/drain"
+	"github.com/davejbax/pixie/internal/limiter"
+	"github.com/davejbax/pixie/internal/quirks"
+	"github.com/davejbax/pixie/internal/requestlog"
+	"github.com/davejbax/pixie/internal/sockets"
+)
+
+const maxPacketSize = 65536
+
+// Outcomes of requests, as logged by the request logger
+const (
+	statusComplete        = "complete"
+	statusNotFound        = "not_found"
+	statusAccessViolation = "access_violation"
+	statusBusy            = "busy"
+	statusAborted         = "aborted"
+	statusFailed          = "failed"
+)
+
+var (
+	errUnsupportedMode = errors.New("only octet mode transfers are supported")
+	errTooManyRetries  = errors.New("client did not acknowledge block after retrying")
+)
+
+type Config struct {
+	Address string `default:":69"`
+
+	// Network interface to bind to, e.g. a VLAN interface, so that only its clients are
+	// served. Only supported on Linux.
+	Interface string
+
+	// How long to wait for a client to acknowledge a block before resending it, unless
+	// the client requests a different timeout (RFC 2349)
+	Timeout time.Duration `default:"5s"`
+
+	// How many times to resend a block before giving up on the transfer
+	Retries int `default:"5"`
+
+	// Largest block size to agree to when clients request one (RFC 2348). The default
+	// fills an Ethernet frame without IP fragmentation. Clients that don't request a
+	// block size get 512 bytes.
+	MaxBlockSize int `mapstructure:"max_block_size" default:"1468"`
+
+	// Largest number of blocks to send before waiting for an acknowledgement, when
+	// clients request windowed transfers (RFC 7440). 1 disables windowing.
+	MaxWindowSize int `mapstructure:"max_window_size" default:"16"`
+
+	// Maximum number of transfers in progress at once. Further requests are queued,
+	// taking turns between clients. Zero means no limit.
+	MaxTransfers int `mapstructure:"max_transfers" default:"64"`
+
+	// Maximum number of requests to queue when MaxTransfers are in progress. Further
+	// requests are refused.
+	MaxQueued int `mapstructure:"max_queued" default:"256"`
+
+	// How long a request may wait in the queue before it is refused
+	QueueTimeout time.Duration `mapstructure:"queue_timeout" default:"10s"`
+}
+
+type Server struct {
+	logger *slog.Logger
+	config *Config
+
+	catalog *catalog.Catalog
+	quirks  *quirks.Table
+	access  *acl.List
+
+	// Logs each request once it has been handled
+	requests *requestlog.Logger
+
+	transfers *limiter.Limiter
+
+	// Transfers in progress, which are let finish on shutdown
+	inflight *drain.Tracker
+
+	// Address that transfer sockets listen on: any port on the listening socket's IP, so
+	// that replies come from the address clients sent their requests to
+	transferAddress string
+
+	// Addresses of clients with a request being handled, so that requests that clients
+	// resend while queued don't start further transfers
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+// NewServer creates a TFTP server that serves files from the given catalog. Transfers
+// are adjusted for client quirks in the given table, and clients are only answered if
+// the given access list allows them. Requests are logged to the given request logger,
+// and transfers are tracked by the given drain tracker. Any of these may be nil.
+func NewServer(logger *slog.Logger, config *Config, files *catalog.Catalog, quirks *quirks.Table, access *acl.List, requests *requestlog.Logger, inflight *drain.Tracker) *Server {
+	return &Server{
+		logger:    logger,
+		config:    config,
+		catalog:   files,
+		quirks:    quirks,
+		access:    access,
+		requests:  requests,
+		transfers: limiter.New(config.MaxTransfers, config.MaxQueued, config.QueueTimeout),
+		inflight:  inflight,
+		pending:   make(map[string]struct{}),
+	}
+}
+
+// Transfers returns the limiter of transfers in progress, which is nil if transfers
+// aren't limited
+func (s *Server) Transfers() *limiter.Limiter {
+	return s.transfers
+}
+
+// ListenAndServe listens on the configured address and serves requests until the
+// context is cancelled
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	conn, err := sockets.ListenPacket("udp", s.config.Address, s.config.Interface)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	return s.Serve(ctx, conn)
+}
+
+// Serve serves requests received on the given connection until the context is
+// cancelled. Requests still queued are then refused, but transfers in progress carry on,
+// so that they can be waited for with the server's drain tracker.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	s.transferAddress = ":0"
+	if udpAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && !udpAddr.IP.IsUnspecified() {
+		s.transferAddress = net.JoinHostPort(udpAddr.IP.String(), "0")
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	s.logger.Info("TFTP server listening",
+		"address", conn.LocalAddr().String(),
+	)
+
+	buff := make([]byte, maxPacketSize)
+
+	for {
+		n, addr, err := conn.ReadFrom(buff)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read TFTP request: %w", err)
+		}
+
+		packet := bytes.Clone(buff[:n])
+		go s.handleRequest(ctx, packet, addr)
+	}
+}
+
+// startPending records that a request from addr is being handled, returning false if
+// one already is
+func (s *Server) startPending(addr net.Addr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pending[addr.String()]; ok {
+		return false
+	}
+
+	s.pending[addr.String()] = struct{}{}
+
+	return true
+}
+
+func (s *Server) endPending(addr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pending, addr.String())
+}
+
+// listenTransfer opens a socket for a transfer on its own port (transfer ID), bound to
+// the same interface and IP as the listening socket
+func (s *Server) listenTransfer() (net.PacketConn, error) {
+	return sockets.ListenPacket("udp", s.transferAddress, s.config.Interface) //nolint:wrapcheck
+}
+
+// refuse sends an error to a client without starting a transfer
+func (s *Server) refuse(addr net.Addr, code ErrorCode, msg string) {
+	conn, err := s.listenTransfer()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	s.sendError(conn, addr, code, msg)
+}
+
+func (s *Server) handleRequest(ctx context.Context, packet []byte, addr net.Addr) {
+	logger := s.logger.With("client", addr.String())
+
+	var clientIP net.IP
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		clientIP = udpAddr.IP
+	}
+
+	// Denied clients get no reply at all, as if pixie weren't on their network
+	if !s.access.AllowedIP(clientIP) {
+		logger.Debug("ignoring TFTP request from client denied by access rules")
+		return
+	}
+
+	if !s.startPending(addr) {
+		logger.Debug("ignoring resent TFTP request")
+		return
+	}
+	defer s.endPending(addr)
+
+	req, err := parseReadRequest(packet)
+	if err != nil {
+		logger.Debug("ignoring invalid TFTP request",
+			"error", err,
+		)
+		s.refuse(addr, ErrorCodeIllegalOperation, "only read requests are supported")
+		return
+	}
+
+	logger = logger.With("path", req.filename)
+
+	logged := &requestlog.Request{Protocol: "tftp", ClientIP: clientIP, Path: req.filename, Status: statusFailed}
+	start := time.Now()
+
+	defer func() {
+		logged.Duration = time.Since(start)
+		s.requests.Log(logged)
+	}()
+
+	// Requests are queued before the transfer socket is created, so that queued requests
+	// don't hold file descriptors
+	release, err := s.transfers.Acquire(ctx, clientIP.String())
+	if err != nil {
+		logger.Warn("refusing TFTP request, as too many transfers are in progress",
+			"max_transfers", s.config.MaxTransfers,
+			"max_queued", s.config.MaxQueued,
+		)
+		s.refuse(addr, ErrorCodeUndefined, "server busy, try again later")
+		logged.Status = statusBusy
+		return
+	}
+	defer release()
+
+	// Each transfer takes place on its own port (transfer ID)
+	conn, err := s.listenTransfer()
+	if err != nil {
+		logger.Error("failed to create TFTP transfer socket",
+			"error", err,
+		)
+		return
+	}
+	defer conn.Close()
+
+	clientQuirks := &quirks.Quirks{}
+	if clientIP != nil {
+		clientQuirks = s.quirks.ForIP(clientIP)
+	}
+
+	if req.mode != "octet" {
+		s.sendError(conn, addr, ErrorCodeIllegalOperation, errUnsupportedMode.Error())
+		return
+	}
+
+	file, err := s.catalog.Open(req.filename, clientIP)
+	if errors.Is(err, catalog.ErrNotFound) {
+		logger.Debug("TFTP client requested nonexistent file")
+		s.sendError(conn, addr, ErrorCodeFileNotFound, "file not found")
+		logged.Status = statusNotFound
+		return
+	} else if errors.Is(err, catalog.ErrAccessDenied) {
+		logger.Warn("TFTP client requested path outside of served files")
+		s.sendError(conn, addr, ErrorCodeAccessViolation, "access violation")
+		logged.Status = statusAccessViolation
+		return
+	} else if err != nil {
+		logger.Error("failed to open file for TFTP transfer",
+			"error", err,
+		)
+		s.sendError(conn, addr, ErrorCodeUndefined, "internal server error")
+		return
+	}
+	defer file.Close()
+
+	transfer := s.inflight.Start("tftp", clientIP, req.filename, file.Size())
+	defer transfer.Done()
+
+	opts, accepted := s.negotiate(req, file.Size(), clientQuirks)
+	logger = logger.With(
+		"block_size", opts.blockSize,
+		"window_size", opts.windowSize,
+	)
+
+	if len(accepted) > 0 {
+		// The client acknowledges the options with an ACK of block 0
+		if _, err := s.sendWindow(conn, addr, [][]byte{oackPacket(accepted)}, 0, opts.timeout); err != nil {
+			// Many PXE clients request only the size, then abort and request the file
+			// again, so this is expected
+			var remote *remoteError
+			if errors.As(err, &remote) {
+				logger.Debug("TFTP client aborted after option negotiation",
+					"error", err,
+				)
+				logged.Status = statusAborted
+			} else {
+				logger.Warn("TFTP option negotiation failed",
+					"error", err,
+				)
+			}
+
+			return
+		}
+	}
+
+	sent, err := s.transfer(conn, addr, file, opts, transfer)
+	logged.Bytes = sent
+
+	if err != nil {
+		logger.Warn("TFTP transfer failed",
+			"error", err,
+		)
+
+		var remote *remoteError
+		if errors.As(err, &remote) {
+			logged.Status = statusAborted
+		}
+
+		return
+	}
+
+	logged.Status = statusComplete
+
+	logger.Debug("TFTP transfer complete",
+		"size", file.Size(),
+	)
+}
+
+// transfer sends the file to the client, returning the number of bytes that the client
+// acknowledged, and recording them in the transfer's progress
+func (s *Server) transfer(conn net.PacketConn, addr net.Addr, file io.Reader, opts *transferOptions, progress *drain.Transfer) (int64, error) {
+	// Packets sent but not yet acknowledged, starting with block first
+	window := make([][]byte, 0, opts.windowSize)
+	first := uint16(1)
+	next := uint16(1)
+	done := false
+	sent := int64(0)
+
+	for {
+		for !done && len(window) < opts.windowSize {
+			data := make([]byte, opts.blockSize)
+
+			n, err := io.ReadFull(file, data)
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				s.sendError(conn, addr, ErrorCodeUndefined, "failed to read file")
+				return sent, fmt.Errorf("failed to read file: %w", err)
+			}
+
+			// Block numbers wrap around for files of more than 65535 blocks, which most
+			// clients support
+			window = append(window, dataPacket(next, data[:n]))
+			next++
+
+			// A block shorter than the block size signals the end of the transfer
+			done = n < len(data)
+		}
+
+		acked, err := s.sendWindow(conn, addr, window, first, opts.timeout)
+		if err != nil {
+			return sent, err
+		}
+
+		for _, packet := range window[:acked] {
+			size := int64(len(packet) - opcodeSize - blockSize)
+			sent += size
+			progress.Add(size)
+		}
+
+		window = window[acked:]
+		first += uint16(acked) //nolint:gosec
+
+		if done && len(window) == 0 {
+			return sent, nil
+		}
+	}
+}
+
+// sendWindow sends a window of packets, the first of which is for block first, and
+// waits for the client to acknowledge at least one of them, resending the window if the
+// acknowledgement times out. It returns the number of packets acknowledged.
+func (s *Server) sendWindow(conn net.PacketConn, addr net.Addr, packets [][]byte, first uint16, timeout time.Duration) (int, error) {
+	buff := make([]byte, maxPacketSize)
+
+	for attempt := 0; attempt <= s.config.Retries; attempt++ {
+		for _, packet := range packets {
+			if _, err := conn.WriteTo(packet, addr); err != nil {
+				return 0, fmt.Errorf("failed to send block %d: %w", first, err)
+			}
+		}
+
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return 0, fmt.Errorf("failed to set read deadline: %w", err)
+		}
+
+		for {
+			n, from, err := conn.ReadFrom(buff)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+
+				return 0, fmt.Errorf("failed to read acknowledgement: %w", err)
+			}
+
+			// Packets from anyone other than our client are rejected (RFC 1350 section 4)
+			if from.String() != addr.String() {
+				s.sendError(conn, from, ErrorCodeUnknownTID, "unknown transfer ID")
+				continue
+			}
+
+			acked, err := parseAck(buff[:n])
+			if err != nil {
+				return 0, fmt.Errorf("transfer aborted: %w", err)
+			}
+
+			// An acknowledgement of a block covers every block before it in the window
+			if count := int(acked-first) + 1; count >= 1 && count <= len(packets) {
+				return count, nil
+			}
+
+			// Ignore duplicate acknowledgements of earlier blocks rather than resending,
+			// to avoid the Sorcerer's Apprentice bug
+		}
+	}
+
+	return 0, fmt.Errorf("block %d: %w", first, errTooManyRetries)
+}
+
+func (s *Server) sendError(conn net.PacketConn, addr net.Addr, code ErrorCode, message string) {
+	if _, err := conn.WriteTo(errorPacket(code, message), addr); err != nil {
+		s.logger.Debug("failed to send TFTP error packet",
+			"client", addr.String(),
+			"error", err,
+		)
+	}
+}
@@ -0,0 +1,115 @@
+// Package timehint helps installers bootstrap their clocks from pixie, for machines
+// with dead CMOS batteries and no NTP access, where TLS and Secure Boot would otherwise
+// fail on certificate validity checks
+package timehint
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Format for 'date -u -s', understood by both GNU coreutils and busybox
+const dateFormat = "2006-01-02 15:04:05"
+
+const (
+	// Path of the time endpoint, relative to the HTTP server root
+	Path = "/time"
+
+	// Path of the fixup script endpoint, relative to the HTTP server root
+	ScriptPath = "/time.sh"
+)
+
+var fixupTmpl = template.Must(template.New("fixup").Funcs(template.FuncMap{
+	"shellQuote": shellQuote,
+}).Parse(`# Set the clock from pixie if it is behind, e.g. due to a dead CMOS battery
+pixie_time="$(curl -fsS {{ shellQuote .URL }} 2>/dev/null || wget -qO- {{ shellQuote .URL }} 2>/dev/null || echo {{ .Fallback }})"
+if [ "$(date -u +%s)" -lt "$pixie_time" ]; then
+	date -u -s "@$pixie_time"
+	hwclock --systohc --utc || true
+fi
+`))
+
+// Handler serves the current time. The format is chosen by the 'format' query parameter:
+// 'unix' for seconds since the epoch, 'date' for a string suitable for 'date -u -s', or
+// RFC 3339 by default.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().UTC()
+
+		var body string
+
+		switch r.URL.Query().Get("format") {
+		case "unix":
+			body = strconv.FormatInt(now.Unix(), 10)
+		case "date":
+			body = now.Format(dateFormat)
+		case "", "rfc3339":
+			body = now.Format(time.RFC3339)
+		default:
+			http.Error(w, "unknown time format", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = fmt.Fprintln(w, body)
+	})
+}
+
+// ScriptHandler serves the snippet produced by [Fixup] as a shell script, so that early
+// install scripts can run 'curl -fsS http://pixie/time.sh | sh'
+func ScriptHandler(baseURL func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		script, err := Fixup(baseURL(r))
+		if err != nil {
+			http.Error(w, "failed to generate script", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/x-shellscript")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = fmt.Fprint(w, "#!/bin/sh\n"+script)
+	})
+}
+
+// Fixup returns a POSIX shell snippet that sets the system and hardware clocks from the
+// time endpoint at baseURL, if the system clock is behind. If the endpoint can't be
+// reached, the time at which the snippet was generated is used instead.
+func Fixup(baseURL string) (string, error) {
+	buff := &bytes.Buffer{}
+	if err := fixupTmpl.Execute(buff, struct {
+		URL      string
+		Fallback int64
+	}{
+		URL:      baseURL + Path + "?format=unix",
+		Fallback: time.Now().Unix(),
+	}); err != nil {
+		return "", fmt.Errorf("failed to execute time fixup template: %w", err)
+	}
+
+	return buff.String(), nil
+}
+
+// shellQuote quotes s as a single shell word. The base URL is derived from the request's
+// Host header, so mustn't be trusted to be free of shell metacharacters.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// FuncMap returns template functions for install scripts: 'now' returns the current UTC
+// time, and 'timeFixup' returns the snippet produced by [Fixup]
+func FuncMap(baseURL string) template.FuncMap {
+	return template.FuncMap{
+		"now": func() time.Time {
+			return time.Now().UTC()
+		},
+		"timeFixup": func() (string, error) {
+			return Fixup(baseURL)
+		},
+	}
+}
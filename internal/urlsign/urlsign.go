@@ -0,0 +1,161 @@
+// Package urlsign signs URLs of files that contain secrets, such as hosts' install
+// automation files, with tokens that expire, so that the files can only be fetched by
+// clients recently given their URL rather than by anyone who can reach the server
+package urlsign
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Length of generated signing keys, in bytes
+const keySize = 32
+
+var (
+	errNoToken      = errors.New("URL isn't signed")
+	errInvalidToken = errors.New("invalid URL signature")
+	errExpiredToken = errors.New("signed URL has expired")
+	errShortKey     = errors.New("signing key is too short")
+)
+
+type Config struct {
+	// Require hosts' automation files to be fetched at signed URLs that expire, which are
+	// put in hosts' kernel arguments each time their bootloader config is served, rather
+	// than at fixed URLs that anyone who can reach the HTTP server can fetch
+	Enabled bool
+
+	// How long signed URLs are valid for after the bootloader config containing them is
+	// served. Installers must fetch their automation file within this time.
+	Lifetime time.Duration `default:"1h"`
+
+	// File containing the key that URLs are signed with, which is created with a random
+	// key if it doesn't exist. Defaults to 'keys/url-signing.key' in the storage
+	// directory. Changing the key invalidates every URL signed with the old one.
+	KeyFile string `mapstructure:"key_file"`
+}
+
+// Signer creates and checks tokens granting access to a resource until they expire
+type Signer struct {
+	key      []byte
+	lifetime time.Duration
+}
+
+// New creates a signer whose tokens are valid for the given lifetime
+func New(key []byte, lifetime time.Duration) *Signer {
+	return &Signer{key: key, lifetime: lifetime}
+}
+
+// LoadKey reads the signing key from the file at path, first writing a random key to
+// the file if it doesn't exist
+func LoadKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return createKey(path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) < keySize {
+		return nil, fmt.Errorf("'%s': %w (must be at least %d bytes)", path, errShortKey, keySize)
+	}
+
+	return key, nil
+}
+
+// createKey writes a random key, readable only by pixie, to the file at path
+func createKey(path string) ([]byte, error) {
+	raw := make([]byte, keySize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	key := []byte(base64.RawURLEncoding.EncodeToString(raw))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create signing key directory: %w", err)
+	}
+
+	if err := os.WriteFile(path, key, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write signing key: %w", err)
+	}
+
+	return key, nil
+}
+
+// Token returns a token granting access to the named resource until the signer's
+// lifetime has elapsed. Tokens contain only URL-safe characters that need no quoting in
+// bootloader configs or kernel arguments.
+func (s *Signer) Token(resource string) string {
+	expires := strconv.FormatInt(time.Now().Add(s.lifetime).Unix(), 10)
+
+	return expires + "." + s.signature(resource, expires)
+}
+
+// Verify checks that the token was created by the signer for the named resource, and
+// hasn't expired
+func (s *Signer) Verify(resource string, token string) error {
+	if token == "" {
+		return errNoToken
+	}
+
+	expires, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return errInvalidToken
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(s.signature(resource, expires))) {
+		return errInvalidToken
+	}
+
+	expiry, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errInvalidToken
+	}
+
+	if time.Now().Unix() > expiry {
+		return fmt.Errorf("%w at %s", errExpiredToken, time.Unix(expiry, 0).UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// PermanentToken returns a token granting access to the named resource for as long as
+// the signing key is unchanged, for URLs that must stay valid for an unknown time, such
+// as those that installers report to once they finish. Permanent tokens are never
+// accepted by [Signer.Verify], nor expiring tokens by [Signer.VerifyPermanent].
+func (s *Signer) PermanentToken(resource string) string {
+	return s.signature(resource, "")
+}
+
+// VerifyPermanent checks that the token was created by [Signer.PermanentToken] for the
+// named resource
+func (s *Signer) VerifyPermanent(resource string, token string) error {
+	if token == "" {
+		return errNoToken
+	}
+
+	if !hmac.Equal([]byte(token), []byte(s.PermanentToken(resource))) {
+		return errInvalidToken
+	}
+
+	return nil
+}
+
+// signature returns the signature of the resource's name and expiry time
+func (s *Signer) signature(resource string, expires string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(resource + "\x00" + expires))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
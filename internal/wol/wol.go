@@ -0,0 +1,59 @@
+// Package wol sends Wake-on-LAN magic packets, so that powered-off machines can be
+// woken to network boot, e.g. after being assigned a one-shot install
+package wol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Number of times the MAC address is repeated in a magic packet, after the sync stream
+const macRepetitions = 16
+
+var errNotEthernet = errors.New("MAC address must be 6 bytes long for Wake-on-LAN")
+
+// Config configures where magic packets are sent
+type Config struct {
+	// Address that magic packets are sent to: the limited broadcast address by default,
+	// or e.g. a subnet's directed broadcast address, or a relay that forwards packets to
+	// machines' networks
+	Address string `default:"255.255.255.255:9"`
+}
+
+// MagicPacket returns the magic packet that wakes the machine with the given MAC address:
+// six 0xff bytes, followed by the MAC address repeated 16 times
+func MagicPacket(mac net.HardwareAddr) ([]byte, error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("'%s': %w", mac, errNotEthernet)
+	}
+
+	packet := bytes.Repeat([]byte{0xff}, 6)
+	for range macRepetitions {
+		packet = append(packet, mac...)
+	}
+
+	return packet, nil
+}
+
+// Wake sends a magic packet for the machine with the given MAC address to the configured
+// address
+func Wake(config *Config, mac net.HardwareAddr) error {
+	packet, err := MagicPacket(mac)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return fmt.Errorf("failed to dial '%s': %w", config.Address, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(packet); err != nil {
+		return fmt.Errorf("failed to send magic packet to '%s': %w", config.Address, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package efipe
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	errNotPE32Plus            = errors.New("not a PE32+ image")
+	errRelocationsOutOfBounds = errors.New("base relocations are outside of any section")
+	errInvalidRelocationBlock = errors.New("invalid base relocation block")
+)
+
+// Layout describes the headers, sections and base relocations of a PE image, as read
+// back from a file, for inspecting an image when it doesn't boot
+type Layout struct {
+	Machine    Machine
+	Subsystem  uint16
+	Entrypoint uint32
+	BaseOfCode uint32
+
+	SizeOfImage   uint32
+	SizeOfHeaders uint32
+
+	Sections []pe.SectionHeader
+
+	// Base relocations applied by the PE loader, by the page that they're in
+	RelocationBlocks []*LayoutRelocationBlock
+}
+
+// LayoutRelocationBlock is a block of base relocations within one page of an image
+type LayoutRelocationBlock struct {
+	PageRVA     uint32
+	Relocations []*Relocation
+}
+
+// ReadLayout reads the layout of the PE32+ image in r, such as one written by [Image].
+// Relocations' file offsets are relative virtual addresses, which are the same thing
+// for the sections that relocations apply to in images that pixie writes.
+func ReadLayout(r io.ReaderAt) (*Layout, error) {
+	file, err := pe.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PE file: %w", err)
+	}
+	defer file.Close()
+
+	optHeader, ok := file.OptionalHeader.(*pe.OptionalHeader64)
+	if !ok {
+		return nil, errNotPE32Plus
+	}
+
+	layout := &Layout{
+		Machine:       Machine(file.Machine),
+		Subsystem:     optHeader.Subsystem,
+		Entrypoint:    optHeader.AddressOfEntryPoint,
+		BaseOfCode:    optHeader.BaseOfCode,
+		SizeOfImage:   optHeader.SizeOfImage,
+		SizeOfHeaders: optHeader.SizeOfHeaders,
+	}
+
+	for _, section := range file.Sections {
+		layout.Sections = append(layout.Sections, section.SectionHeader)
+	}
+
+	directory := optHeader.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_BASERELOC]
+	if directory.Size == 0 {
+		return layout, nil
+	}
+
+	data, err := readRVA(file, directory.VirtualAddress, directory.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	layout.RelocationBlocks, err = parseRelocationBlocks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return layout, nil
+}
+
+// readRVA reads size bytes at the relative virtual address rva, which must be within a
+// single section
+func readRVA(file *pe.File, rva uint32, size uint32) ([]byte, error) {
+	for _, section := range file.Sections {
+		if rva < section.VirtualAddress || rva+size > section.VirtualAddress+max(section.VirtualSize, section.Size) {
+			continue
+		}
+
+		data := make([]byte, size)
+		if _, err := section.ReadAt(data, int64(rva-section.VirtualAddress)); err != nil {
+			return nil, fmt.Errorf("failed to read section '%s': %w", section.Name, err)
+		}
+
+		return data, nil
+	}
+
+	return nil, errRelocationsOutOfBounds
+}
+
+// parseRelocationBlocks parses the contents of a base relocation table. Padding entries
+// are omitted.
+func parseRelocationBlocks(data []byte) ([]*LayoutRelocationBlock, error) {
+	var blocks []*LayoutRelocationBlock
+
+	for len(data) >= 8 {
+		pageRVA := binary.LittleEndian.Uint32(data[0:4])
+		blockSize := binary.LittleEndian.Uint32(data[4:8])
+
+		if blockSize < 8 || blockSize > uint32(len(data)) {
+			return nil, fmt.Errorf("block at page 0x%x has size %d: %w", pageRVA, blockSize, errInvalidRelocationBlock)
+		}
+
+		block := &LayoutRelocationBlock{PageRVA: pageRVA}
+
+		for entry := data[8:blockSize]; len(entry) >= 2; entry = entry[2:] {
+			value := binary.LittleEndian.Uint16(entry)
+
+			kind := RelocationType(value >> 12)
+			if kind == ImageRelBasedAbsolute {
+				continue
+			}
+
+			block.Relocations = append(block.Relocations, &Relocation{
+				Kind:       kind,
+				FileOffset: uint64(pageRVA) + uint64(value&0x0FFF),
+			})
+		}
+
+		blocks = append(blocks, block)
+		data = data[blockSize:]
+	}
+
+	return blocks, nil
+}
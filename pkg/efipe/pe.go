@@ -55,6 +55,7 @@ var (
 	errInvalidHeaderSize    = errors.New("PE file header size must be aligned to UEFI page size")
 )
 
+// Image is a PE file wrapping an [Executable], ready to be written out
 type Image struct {
 	dos       *dosImage
 	header    *pe.FileHeader
@@ -63,6 +64,7 @@ type Image struct {
 	sections  []Section
 }
 
+// Machine is a PE machine type, e.g. [pe.IMAGE_FILE_MACHINE_AMD64]
 type Machine uint16
 
 // Executable defines a relocatable executable that will be the
@@ -91,6 +93,10 @@ type Executable interface {
 	//  1. Sections must be defined in virtual address order
 	//  2. Section virtual addresses must be aligned to [UEFIPageSize]
 	//  3. Section physical addresses must be aligned to [UEFIPageSize]
+	//
+	// A section's size in the file may be less than its virtual size, e.g. if it ends
+	// with uninitialised data, which the PE loader zeroes. Its physical address is then
+	// less than its virtual address.
 	Sections() SectionList
 
 	// PE machine type
@@ -101,15 +107,21 @@ type Executable interface {
 	Relocations() []*Relocation
 }
 
+// SectionHeadersSize returns the size of the headers of the given number of sections,
+// plus the relocation section that every image has
 func SectionHeadersSize(numSections uint32) uint32 {
 	// +1 as we'll have a relocation section
 	return SectionHeaderSize * (numSections + 1)
 }
 
+// PEHeaderSize returns the size of the whole PE header of an image with the given number
+// of sections, aligned to [UEFIPageSize]
 func PEHeaderSize(numSections uint32) uint32 {
 	return align.Address(FixedHeaderSize+SectionHeadersSize(numSections), UEFIPageSize)
 }
 
+// New wraps the executable in a PE file with a header of the given size, which must be
+// aligned to [UEFIPageSize] and be the size that the executable's addresses allow for
 func New(program Executable, headerSize uint32) (*Image, error) {
 	if headerSize%UEFIPageSize != 0 {
 		return nil, errInvalidHeaderSize
@@ -121,17 +133,22 @@ func New(program Executable, headerSize uint32) (*Image, error) {
 	}
 
 	dataSectionSize := uint32(0)
+	bssSectionSize := uint32(0)
 	for _, section := range program.Sections() {
 		header := section.Header()
+		if header.Characteristics&pe.IMAGE_SCN_CNT_UNINITIALIZED_DATA > 0 {
+			bssSectionSize += header.VirtualSize
+			continue
+		}
+
 		if header.Characteristics&pe.IMAGE_SCN_CNT_INITIALIZED_DATA > 0 {
 			dataSectionSize += header.Size
 		}
-	}
 
-	bssSectionSize := uint32(0)
-	if bssSection, found := program.Sections().GetByName(SectionBSS); found {
-		// TODO: do we use virtual size here?
-		bssSectionSize = bssSection.Header().Size
+		// Data sections may end with uninitialised data that isn't in the file
+		if header.VirtualSize > header.Size {
+			bssSectionSize += header.VirtualSize - header.Size
+		}
 	}
 
 	optHeader := pe.OptionalHeader64{
@@ -194,9 +211,10 @@ func New(program Executable, headerSize uint32) (*Image, error) {
 	sections := program.Sections()
 
 	if len(program.Relocations()) > 0 {
-		lastSection := sections[len(sections)-1]
-		relocStart := align.Address(lastSection.Header().Offset+lastSection.Header().Size, UEFIPageSize)
-		relocSection := newRelocationSection(program.Relocations(), relocStart)
+		lastSection := sections[len(sections)-1].Header()
+		relocStart := align.Address(lastSection.VirtualAddress+lastSection.VirtualSize, UEFIPageSize)
+		relocFileStart := align.Address(lastSection.Offset+lastSection.Size, UEFIPageSize)
+		relocSection := newRelocationSection(program.Relocations(), relocStart, relocFileStart)
 		sections = append(sections, relocSection)
 
 		optHeader.SizeOfImage += relocSection.Header().Size
@@ -72,14 +72,15 @@ func (b *relocationBlock) WriteTo(w io.Writer) (int64, error) {
 }
 
 type relocationSection struct {
-	blocks []*relocationBlock
-	offset uint32
-	size   uint32
+	blocks     []*relocationBlock
+	offset     uint32
+	fileOffset uint32
+	size       uint32
 }
 
 var _ Section = &relocationSection{}
 
-func newRelocationSection(relocs []*Relocation, offset uint32) *relocationSection {
+func newRelocationSection(relocs []*Relocation, offset uint32, fileOffset uint32) *relocationSection {
 	relocsByPageRVA := make(map[uint32][]*Relocation)
 
 	// Bucket relocations by their (4k) page. Each of these will become a relocation block
@@ -133,9 +134,10 @@ func newRelocationSection(relocs []*Relocation, offset uint32) *relocationSectio
 	}
 
 	return &relocationSection{
-		blocks: blocks,
-		size:   alignedTotalSize,
-		offset: offset,
+		blocks:     blocks,
+		size:       alignedTotalSize,
+		offset:     offset,
+		fileOffset: fileOffset,
 	}
 }
 
@@ -145,7 +147,7 @@ func (s *relocationSection) Header() pe.SectionHeader {
 		VirtualSize:    s.size,
 		VirtualAddress: s.offset,
 		Size:           s.size,
-		Offset:         s.offset,
+		Offset:         s.fileOffset,
 
 		// These fields are all unused for executables or otherwise deprecated
 		PointerToRelocations: 0,
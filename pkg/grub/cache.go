@@ -0,0 +1,188 @@
+package grub
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/davejbax/pixie/internal/iometa"
+)
+
+const moddepName = "moddep.lst"
+
+// ModuleCache keeps the dependency lists, modules and kernels read from GRUB root
+// directories, so that building images for several hosts or prefixes reads and parses
+// each file once. A cached file is read again if its modification time or size changes.
+// A ModuleCache is safe for concurrent use; a nil ModuleCache reads files every time.
+type ModuleCache struct {
+	mu           sync.Mutex
+	dependencies map[string]*cachedDependencies
+	files        map[string]*cachedFile
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+type cachedDependencies struct {
+	version      fileVersion
+	dependencies ModuleDependencies
+}
+
+type cachedFile struct {
+	version fileVersion
+	data    []byte
+}
+
+// NewModuleCache creates an empty cache
+func NewModuleCache() *ModuleCache {
+	return &ModuleCache{
+		dependencies: make(map[string]*cachedDependencies),
+		files:        make(map[string]*cachedFile),
+	}
+}
+
+// NewImageFromConfig is [NewImageFromConfig], reading the kernel and modules through the
+// cache
+func (c *ModuleCache) NewImageFromConfig(config *Config, arch string, prefix string) (*Image, func(), error) {
+	return imageFromConfig(config, arch, prefix, c)
+}
+
+// NewBaseImageFromConfig is [NewBaseImageFromConfig], reading the kernel and modules
+// through the cache
+func (c *ModuleCache) NewBaseImageFromConfig(config *Config, arch string) (*BaseImage, func(), error) {
+	return newBaseImageFromConfig(config, arch, c)
+}
+
+func statVersion(path string) (fileVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}, err //nolint:wrapcheck
+	}
+
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// Dependencies returns the dependency list in the root directory's moddep.lst
+func (c *ModuleCache) Dependencies(root string) (ModuleDependencies, error) {
+	path := filepath.Join(root, moddepName)
+
+	if c == nil {
+		return readDependencies(path)
+	}
+
+	version, err := statVersion(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat GRUB moddep.lst file: %w", err)
+	}
+
+	c.mu.Lock()
+	cached, ok := c.dependencies[path]
+	c.mu.Unlock()
+
+	if ok && cached.version == version {
+		return cached.dependencies, nil
+	}
+
+	dependencies, err := readDependencies(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.dependencies[path] = &cachedDependencies{version: version, dependencies: dependencies}
+	c.mu.Unlock()
+
+	return dependencies, nil
+}
+
+func readDependencies(path string) (ModuleDependencies, error) {
+	moddepFile, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GRUB moddep.lst file: %w", err)
+	}
+	defer moddepFile.Close()
+
+	dependencies, err := NewDependencyList(moddepFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read GRUB moddep.lst: %w", err)
+	}
+
+	return dependencies, nil
+}
+
+// Module returns the named module from the root directory, as [NewModuleFromDirectory]
+// does, but with its contents read into memory
+func (c *ModuleCache) Module(root string, module string) (*Module, error) {
+	if c == nil {
+		return NewModuleFromDirectory(root, module)
+	}
+
+	data, err := c.readFile(filepath.Join(root, module+".mod"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read module '%s' from root '%s': %w", module, root, err)
+	}
+
+	return &Module{
+		name:        module,
+		objType:     ObjTypeElf,
+		payloadSize: uint32(len(data)),
+		open: func() (io.ReadCloser, error) {
+			return &iometa.Closifier{Reader: bytes.NewReader(data)}, nil
+		},
+	}, nil
+}
+
+// kernel opens the GRUB kernel in the root directory. The returned function closes it.
+func (c *ModuleCache) kernel(root string) (io.ReaderAt, func(), error) {
+	path := filepath.Join(root, kernelImageName)
+
+	if c == nil {
+		kernel, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err //nolint:wrapcheck
+		}
+
+		return kernel, func() { _ = kernel.Close() }, nil
+	}
+
+	data, err := c.readFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bytes.NewReader(data), func() {}, nil
+}
+
+// readFile returns the contents of the file, reading it if it isn't cached or has
+// changed. Cached contents are never modified, so can be shared between images.
+func (c *ModuleCache) readFile(path string) ([]byte, error) {
+	version, err := statVersion(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	cached, ok := c.files[path]
+	c.mu.Unlock()
+
+	if ok && cached.version == version {
+		return cached.data, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	c.mu.Lock()
+	c.files[path] = &cachedFile{version: version, data: data}
+	c.mu.Unlock()
+
+	return data, nil
+}
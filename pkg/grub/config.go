@@ -0,0 +1,266 @@
+package grub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/creasty/defaults"
+	"github.com/davejbax/pixie/pkg/efipe"
+)
+
+const kernelImageName = "kernel.img"
+
+// Config selects the GRUB installation, modules and settings that images are built
+// from. Use [DefaultConfig] for a config with the defaults filled in.
+type Config struct {
+	// Directory containing kernel.img, moddep.lst and the modules. '{{ .Arch }}' is
+	// replaced with the arch that an image is built for. If empty, the directories
+	// that distros install GRUB to are searched, e.g. '/usr/lib/grub/arm64-efi' or
+	// '/usr/share/grub2/arm64-efi'.
+	Root string
+
+	// Modules to include in images, along with their dependencies
+	Modules []string `default:"[\"normal\", \"tftp\", \"http\", \"linux\", \"fat\", \"iso9660\"]"`
+
+	// GRUB target architectures to build images for. Only x86_64 is supported for now:
+	// arm64 and other arches are rejected when the config is validated.
+	Arch []string `default:"[\"x86_64\"]"`
+
+	// Users who may boot locked menu entries and edit entries. Their passwords are
+	// embedded in images, rather than in the config that images load.
+	Superusers []Superuser
+
+	// Serial console that GRUB's menu is shown on, alongside the screen
+	Serial SerialConfig
+
+	// Prefix embedded in images, overriding the one chosen for how they're served, e.g.
+	// '(http,192.0.2.1)/boot/grub'. GRUB loads its config and modules from the prefix.
+	Prefix string
+
+	// Commands embedded in images, which GRUB runs before loading its config
+	EmbeddedConfig string `mapstructure:"embedded_config"`
+
+	// Check when building images that GRUB will be able to link every module as it loads
+	// it: that the modules match the kernel, and each symbol they use is defined by the
+	// kernel or an earlier module. Incompatible modules then fail the build rather than
+	// the boot. GRUB still links the modules itself at boot.
+	CheckModules bool `mapstructure:"check_modules"`
+}
+
+// Validate checks that images can be built for the arches, and that the superusers and
+// serial console are valid
+func (c *Config) Validate() error {
+	for _, arch := range c.Arch {
+		if err := validateArch(arch); err != nil {
+			return fmt.Errorf("invalid arch: %w", err)
+		}
+	}
+
+	if err := validateSuperusers(c.Superusers); err != nil {
+		return err
+	}
+
+	if err := c.Serial.validate(); err != nil {
+		return fmt.Errorf("invalid serial console: %w", err)
+	}
+
+	return nil
+}
+
+// embeddedConfig returns the config embedded in images, which GRUB runs before loading
+// its config file, or an empty string if none is needed
+func (c *Config) embeddedConfig() string {
+	config := ""
+	if c.Serial.Enabled {
+		config += serialConfig(&c.Serial)
+	}
+
+	if len(c.Superusers) > 0 {
+		config += passwordConfig(c.Superusers)
+	}
+
+	if c.EmbeddedConfig != "" {
+		config += strings.TrimSuffix(c.EmbeddedConfig, "\n") + "\n"
+	}
+
+	return config
+}
+
+// DefaultConfig returns a config with the default modules and arch, which searches for
+// its root directory
+func DefaultConfig() *Config {
+	config := &Config{}
+	if err := defaults.Set(config); err != nil {
+		panic(fmt.Sprintf("GRUB config defaults are invalid: %v", err))
+	}
+
+	return config
+}
+
+var errNoRoot = errors.New("no GRUB root directory found")
+
+// Directories that distros install GRUB's EFI modules to, searched in order when no
+// root directory is configured
+var defaultRoots = []string{
+	"/usr/lib/grub/{{ .Arch }}-efi",
+	"/usr/lib/grub2/{{ .Arch }}-efi",
+	"/usr/share/grub2/{{ .Arch }}-efi",
+	"/usr/share/grub/{{ .Arch }}-efi",
+	"/usr/local/lib/grub/{{ .Arch }}-efi",
+}
+
+type rootTemplateOptions struct {
+	Arch string
+}
+
+// RootDirectory returns the directory containing the GRUB kernel and modules for the
+// given arch: the configured root, or else the first of the directories that distros
+// install GRUB to which has a kernel for the arch. Arches may be given by their Linux
+// names (e.g. aarch64), which are translated to GRUB's. If there's no kernel, the error
+// lists every directory that was searched.
+func (c *Config) RootDirectory(arch string) (string, error) {
+	candidates := defaultRoots
+	if c.Root != "" {
+		candidates = []string{c.Root}
+	}
+
+	probed := make([]string, 0, len(candidates))
+
+	for _, candidate := range candidates {
+		root, err := renderRoot(candidate, grubArch(arch))
+		if err != nil {
+			return "", err
+		}
+
+		if _, err := os.Stat(filepath.Join(root, kernelImageName)); err != nil {
+			probed = append(probed, root)
+			continue
+		}
+
+		return root, nil
+	}
+
+	return "", fmt.Errorf("no %s for arch '%s' in %s: %w", kernelImageName, arch, strings.Join(probed, ", "), errNoRoot)
+}
+
+// renderRoot renders the root directory template for the GRUB arch
+func renderRoot(rootTemplate string, arch string) (string, error) {
+	rootBuff := &bytes.Buffer{}
+	rootTmpl, err := template.New("root").Parse(rootTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse GRUB root path template: %w", err)
+	}
+
+	if err := rootTmpl.Execute(rootBuff, &rootTemplateOptions{
+		Arch: arch,
+	}); err != nil {
+		return "", fmt.Errorf("failed to execute GRUB root path template: %w", err)
+	}
+
+	return rootBuff.String(), nil
+}
+
+// NewImageFromConfig builds a GRUB image for the arch (e.g. x86_64 or arm64) from the
+// configured GRUB root directory. GRUB reads its config and further modules from prefix,
+// e.g. '(tftp)' or '(cd0)'. The returned function closes the kernel, and must only be
+// called once the image has been written.
+func NewImageFromConfig(config *Config, arch string, prefix string) (*Image, func(), error) {
+	return imageFromConfig(config, arch, prefix, nil)
+}
+
+// NewBaseImageFromConfig lays out a GRUB image for the arch as [NewImageFromConfig]
+// does, but without a prefix, so that images for several prefixes can be made from it
+// with [BaseImage.WithPrefix]. The returned function closes the kernel, and must only be
+// called once all such images have been written.
+func NewBaseImageFromConfig(config *Config, arch string) (*BaseImage, func(), error) {
+	return newBaseImageFromConfig(config, arch, nil)
+}
+
+// imageFromConfig builds an image as [NewImageFromConfig] does, reading files through
+// the cache, which may be nil
+func imageFromConfig(config *Config, arch string, prefix string, cache *ModuleCache) (*Image, func(), error) {
+	base, cleanup, err := newBaseImageFromConfig(config, arch, cache)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return base.WithPrefix(prefix), cleanup, nil
+}
+
+// newBaseImageFromConfig builds a base image as [NewBaseImageFromConfig] does, reading
+// files through the cache, which may be nil
+func newBaseImageFromConfig(config *Config, arch string, cache *ModuleCache) (*BaseImage, func(), error) {
+	// TODO: definitely split up this function
+	if err := config.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid GRUB config: %w", err)
+	}
+
+	if err := validateArch(arch); err != nil {
+		return nil, nil, err
+	}
+
+	root, err := config.RootDirectory(arch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	moddep, err := cache.Dependencies(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	moduleNames := slices.Clone(config.Modules)
+	if len(config.Superusers) > 0 {
+		moduleNames = append(moduleNames, passwordModule)
+	}
+
+	if config.Serial.Enabled {
+		moduleNames = append(moduleNames, serialModules...)
+	}
+
+	modulesWithDependencies, err := moddep.Resolve(moduleNames)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not resolve module dependencies: %w", err)
+	}
+
+	modules := make([]*Module, 0, len(modulesWithDependencies)+1)
+
+	for _, moduleName := range modulesWithDependencies {
+		module, err := cache.Module(root, moduleName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load module '%s' from root %s: %w", moduleName, root, err)
+		}
+
+		modules = append(modules, module)
+	}
+
+	if embedded := config.embeddedConfig(); embedded != "" {
+		modules = append(modules, NewConfigModule(embedded))
+	}
+
+	kernel, closeKernel, err := cache.kernel(root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open GRUB kernel for arch '%s': %w", arch, err)
+	}
+
+	base, err := NewBaseImage(kernel, modules, efipe.UEFIPageSize)
+	if err != nil {
+		closeKernel()
+		return nil, nil, fmt.Errorf("failed to create GRUB image: %w", err)
+	}
+
+	if config.CheckModules {
+		if err := CheckModules(kernel, modules); err != nil {
+			closeKernel()
+			return nil, nil, fmt.Errorf("GRUB modules in %s can't be linked with its kernel: %w", root, err)
+		}
+	}
+
+	return base, closeKernel, nil
+}
@@ -0,0 +1,237 @@
+// Package grub builds GRUB EFI images from a GRUB kernel.img and modules, in the same
+// way as grub-mkimage but without needing GRUB's tools: the kernel's ELF sections are
+// laid out and relocated for loading as a PE file, and the modules are appended as a
+// section that GRUB loads at startup. Wrap an [Image] with [efipe.New] to write it out.
+//
+// Most callers want [NewImageFromConfig], which reads the kernel and modules from an
+// installed GRUB's directory, e.g. /usr/lib/grub/x86_64-efi.
+package grub
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/davejbax/pixie/internal/align"
+	"github.com/davejbax/pixie/pkg/efipe"
+)
+
+const (
+	// Name of unreferenced BSS start symbol
+	symbBssStart = "__bss_start"
+
+	// Name of special unreferenced 'end' symbol
+	symbEnd = "end"
+
+	// Name of the entrypoint symbol
+	symbStart = "_start"
+)
+
+var (
+	errUnrecognizedSymbol = errors.New("unrecognised symbol defined relative to SHN_UNDEF")
+	errNoEntrypoint       = errors.New("image has no entrypoint")
+)
+
+// Image is a GRUB kernel with modules, laid out as an [efipe.Executable]. An Image reads
+// lazily from the kernel it was created from, which must stay open until the image has
+// been written.
+type Image struct {
+	file            *elf.File
+	headerSize      uint32
+	size            uint32
+	symbols         []elf.Symbol
+	virtualSections []*virtualSection
+	relocations     []*efipe.Relocation
+	modules         *moduleSection
+}
+
+var _ efipe.Executable = &Image{}
+
+// BaseImage is a GRUB kernel with modules, laid out once so that images differing only
+// in their prefix (e.g. for network boot and for an ISO) can be made from it cheaply.
+// Like an [Image], a BaseImage reads lazily from its kernel.
+type BaseImage struct {
+	file            *elf.File
+	headerSize      uint32
+	alignment       uint32
+	symbols         []elf.Symbol
+	virtualSections []*virtualSection
+	relocations     []*efipe.Relocation
+	modules         []*Module
+
+	// End of the kernel's sections, where the modules start
+	end uint32
+
+	// End of the kernel's sections in the image file, which is before end when the
+	// kernel has uninitialised data, as that takes no space in the file
+	fileEnd uint32
+}
+
+// NewImage lays out the GRUB kernel.img ELF file read from r, with the given modules in
+// the order that GRUB should load them; modules must be given after their
+// dependencies (see [ModuleDependencies.Resolve]). Sections are aligned to alignment,
+// which must be a power of two: [efipe.UEFIPageSize] for images that UEFI firmware loads.
+func NewImage(r io.ReaderAt, mods []*Module, alignment uint32) (*Image, error) {
+	base, err := NewBaseImage(r, mods, alignment)
+	if err != nil {
+		return nil, err
+	}
+
+	return base.image(base.modules), nil
+}
+
+// NewBaseImage lays out the kernel and modules as [NewImage] does, without a prefix.
+// Use [BaseImage.WithPrefix] to make images from it.
+func NewBaseImage(r io.ReaderAt, mods []*Module, alignment uint32) (*BaseImage, error) {
+	elfFile, err := elf.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ELF file: %w", err)
+	}
+
+	if !isMachineSupported(elfFile.Machine) {
+		return nil, errUnsupportedELFMachineType
+	}
+
+	// Allow enough room for 3 sections -- .text, .data, and mods (even though we
+	// might not have mods!)
+	headerSize := efipe.PEHeaderSize(3)
+
+	virtualSections, err := layoutVirtualSections(elfFile, headerSize, alignment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lay out sections: %w", err)
+	}
+
+	symbs, err := relocateSymbols(elfFile, virtualSections)
+	if err != nil {
+		return nil, fmt.Errorf("failed to relocate symbols: %w", err)
+	}
+
+	relocs, err := relocateAddresses(elfFile, virtualSections, symbs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to relocate addresses: %w", err)
+	}
+
+	foundStart := false
+	for _, symb := range symbs {
+		if symb.Name == symbStart {
+			foundStart = true
+			break
+		}
+	}
+
+	if !foundStart {
+		return nil, errNoEntrypoint
+	}
+
+	lastSection := virtualSections[len(virtualSections)-1]
+	// Realign the end of the sections to whatever the requested boundary is
+	end := align.Address(uint32(lastSection.offset+lastSection.size), alignment)
+	fileEnd := align.Address(uint32(lastSection.fileOffset+lastSection.fileSize), alignment)
+
+	return &BaseImage{
+		file:            elfFile,
+		headerSize:      headerSize,
+		alignment:       alignment,
+		symbols:         symbs,
+		virtualSections: virtualSections,
+		relocations:     relocs,
+		modules:         mods,
+		end:             end,
+		fileEnd:         fileEnd,
+	}, nil
+}
+
+// WithPrefix returns an image of the base with the prefix that GRUB reads its config and
+// further modules from, e.g. '(tftp)' or '(cd0)'. Images made from the same base share
+// its kernel and modules, and can be written concurrently.
+func (b *BaseImage) WithPrefix(prefix string) *Image {
+	return b.image(append(slices.Clone(b.modules), NewPrefixModule(prefix)))
+}
+
+func (b *BaseImage) image(mods []*Module) *Image {
+	end := b.end
+
+	var moduleSection *moduleSection
+
+	if len(mods) > 0 {
+		moduleSection = newModuleSection(mods, end, b.fileEnd, b.alignment)
+		end = align.Address(end+moduleSection.Header().VirtualSize, b.alignment)
+	}
+
+	return &Image{
+		file:            b.file,
+		headerSize:      b.headerSize,
+		size:            end,
+		symbols:         b.symbols,
+		virtualSections: b.virtualSections,
+		relocations:     b.relocations,
+		modules:         moduleSection,
+	}
+}
+
+// PEHeaderSize returns the size of the PE header that the image's addresses allow for,
+// which must be passed to [efipe.New]
+func (i *Image) PEHeaderSize() uint32 {
+	return i.headerSize
+}
+
+// Entrypoint returns the address of GRUB's '_start' symbol
+func (i *Image) Entrypoint() uint32 {
+	for _, symb := range i.symbols {
+		if symb.Name == symbStart {
+			return uint32(symb.Value)
+		}
+	}
+
+	panic("could not find entrypoint symbol")
+}
+
+// BaseOfCode returns the address of the kernel's .text section
+func (i *Image) BaseOfCode() uint32 {
+	for _, virt := range i.virtualSections {
+		if virt.kind == virtualSectionTypeText {
+			return uint32(virt.offset)
+		}
+	}
+
+	panic("no .text section found")
+}
+
+// Machine returns the PE machine type matching the kernel's ELF machine type
+func (i *Image) Machine() efipe.Machine {
+	machine, err := efipeMachine(i.file.Machine)
+	if err != nil {
+		panic(fmt.Sprintf("could not convert ELF machine type to EFI PE machine: %v", err))
+	}
+
+	return machine
+}
+
+// Sections returns the kernel's sections, followed by the modules section if the image
+// has any modules
+func (i *Image) Sections() efipe.SectionList {
+	sections := make([]efipe.Section, 0, len(i.virtualSections))
+
+	for _, section := range i.virtualSections {
+		sections = append(sections, section)
+	}
+
+	if i.modules != nil {
+		sections = append(sections, i.modules)
+	}
+
+	return sections
+}
+
+// Size returns the size of the image once loaded, including the PE header
+func (i *Image) Size() uint32 {
+	return i.size
+}
+
+// Relocations returns the kernel's absolute address relocations, which the PE loader
+// applies
+func (i *Image) Relocations() []*efipe.Relocation {
+	return i.relocations
+}
@@ -0,0 +1,204 @@
+package grub
+
+import (
+	"debug/elf"
+	"fmt"
+	"strconv"
+)
+
+// Layout describes how an [Image] lays out the GRUB kernel and modules, for inspecting
+// an image when it doesn't boot. Addresses are relative to the start of the image,
+// including its PE header.
+type Layout struct {
+	HeaderSize uint32
+	Size       uint32
+	Entrypoint uint32
+
+	// Sections of the image that the kernel's ELF sections are placed in, in address
+	// order
+	Sections []*LayoutSection
+
+	// Kernel symbols, with their values before and after relocation
+	Symbols []*LayoutSymbol
+
+	// Relocations applied to the kernel's sections
+	Relocations []*LayoutRelocation
+
+	// Objects in the modules section, in the order that GRUB loads them
+	Modules []*LayoutModule
+}
+
+// LayoutSection is a section of the image (e.g. '.text'), made of ELF sections
+type LayoutSection struct {
+	Name    string
+	Address uint64
+	Size    uint64
+
+	ELFSections []*LayoutELFSection
+}
+
+// LayoutELFSection is an ELF section of the kernel, as placed in a section of the image
+type LayoutELFSection struct {
+	Name  string
+	Index int
+
+	// Address in the ELF file, and in the image
+	OriginalAddress uint64
+	Address         uint64
+	Size            uint64
+
+	Relocations int
+}
+
+// LayoutSymbol is a symbol of the kernel
+type LayoutSymbol struct {
+	Name    string
+	Section string
+
+	OriginalValue uint64
+	Value         uint64
+}
+
+// LayoutRelocation is an ELF relocation of an address in one of the kernel's sections
+type LayoutRelocation struct {
+	Section string
+	Type    string
+	Symbol  string
+	Addend  int64
+
+	// Address being relocated, in the image
+	Address uint64
+
+	// Whether the PE loader must also relocate the address, because it's absolute
+	Loader bool
+}
+
+// LayoutModule is an object in the image's modules section
+type LayoutModule struct {
+	Name string
+	Type ObjType
+	Size uint32
+}
+
+// Layout returns how the image lays out the kernel and modules
+func (i *Image) Layout() (*Layout, error) {
+	layout := &Layout{
+		HeaderSize: i.headerSize,
+		Size:       i.size,
+		Entrypoint: i.Entrypoint(),
+	}
+
+	loaderOffsets := make(map[uint64]bool, len(i.relocations))
+	for _, reloc := range i.relocations {
+		loaderOffsets[reloc.FileOffset] = true
+	}
+
+	for _, virt := range i.virtualSections {
+		section := &LayoutSection{Name: virt.kind.Name(), Address: virt.offset, Size: virt.size}
+
+		for _, elfSection := range virt.realSections {
+			section.ELFSections = append(section.ELFSections, &LayoutELFSection{
+				Name:            elfSection.Name,
+				Index:           elfSection.index,
+				OriginalAddress: elfSection.Addr,
+				Address:         elfSection.addrInFile,
+				Size:            elfSection.Size,
+				Relocations:     len(elfSection.relocations),
+			})
+
+			for _, reloc := range elfSection.relocations {
+				symbol := ""
+				if int(reloc.symbIndex) < len(i.symbols) {
+					symbol = i.symbols[reloc.symbIndex].Name
+				}
+
+				layout.Relocations = append(layout.Relocations, &LayoutRelocation{
+					Section: elfSection.Name,
+					Type:    relocationTypeName(i.file.Machine, reloc.typ),
+					Symbol:  symbol,
+					Addend:  reloc.addend,
+					Address: reloc.fileOffset,
+					Loader:  loaderOffsets[reloc.fileOffset],
+				})
+			}
+		}
+
+		layout.Sections = append(layout.Sections, section)
+	}
+
+	original, err := i.file.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get symbols in file: %w", err)
+	}
+
+	// The relocated symbols start with the undefined symbol, which the original symbols
+	// omit
+	for index, symb := range i.symbols[1:] {
+		layoutSymbol := &LayoutSymbol{
+			Name:    symb.Name,
+			Section: i.sectionName(symb.Section),
+			Value:   symb.Value,
+		}
+
+		if index < len(original) {
+			layoutSymbol.OriginalValue = original[index].Value
+		}
+
+		layout.Symbols = append(layout.Symbols, layoutSymbol)
+	}
+
+	if i.modules != nil {
+		for _, mod := range i.modules.mods {
+			layout.Modules = append(layout.Modules, &LayoutModule{Name: mod.name, Type: mod.objType, Size: mod.payloadSize})
+		}
+	}
+
+	return layout, nil
+}
+
+func (i *Image) sectionName(index elf.SectionIndex) string {
+	switch {
+	case index == elf.SHN_UNDEF:
+		return "UND"
+	case index == elf.SHN_ABS:
+		return "ABS"
+	case int(index) < len(i.file.Sections):
+		return i.file.Sections[index].Name
+	default:
+		return strconv.Itoa(int(index))
+	}
+}
+
+func relocationTypeName(machine elf.Machine, typ uint32) string {
+	switch machine {
+	case elf.EM_X86_64:
+		return elf.R_X86_64(typ).String()
+	default:
+		return strconv.FormatUint(uint64(typ), 10)
+	}
+}
+
+func (t ObjType) String() string {
+	switch t {
+	case ObjTypeElf:
+		return "elf"
+	case ObjTypeMemdisk:
+		return "memdisk"
+	case ObjTypeConfig:
+		return "config"
+	case ObjTypePrefix:
+		return "prefix"
+	case ObjTypePubKey:
+		return "pubkey"
+	case ObjTypeDTB:
+		return "dtb"
+	case ObjTypeDisableShimLock:
+		return "disable_shim_lock"
+	case ObjTypeGPGPubKey:
+		return "gpg_pubkey"
+	case ObjTypeX509PubKey:
+		return "x509_pubkey"
+	default:
+		return strconv.FormatUint(uint64(t), 10)
+	}
+}
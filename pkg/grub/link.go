@@ -0,0 +1,223 @@
+package grub
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Section of a module listing the modules that it depends on
+const sectionModDeps = ".moddeps"
+
+var (
+	errModuleNotRelocatable   = errors.New("module isn't a relocatable ELF object")
+	errModuleMachine          = errors.New("module is built for a different machine to the kernel")
+	errModuleDependency       = errors.New("module depends on a module that isn't loaded before it")
+	errUndefinedModuleSymbol  = errors.New("symbol isn't defined by the kernel or any module loaded before it")
+	errUnsupportedModuleReloc = errors.New("relocation type isn't supported by GRUB's module loader")
+)
+
+// Relocation types that GRUB's module loader applies, by machine
+var moduleRelocations = map[elf.Machine]map[uint32]bool{
+	elf.EM_X86_64: {
+		uint32(elf.R_X86_64_64):    true,
+		uint32(elf.R_X86_64_PC32):  true,
+		uint32(elf.R_X86_64_PLT32): true,
+		uint32(elf.R_X86_64_PC64):  true,
+		uint32(elf.R_X86_64_32):    true,
+		uint32(elf.R_X86_64_32S):   true,
+	},
+}
+
+// CheckModules checks that GRUB will be able to link each of the modules as it loads
+// them at boot, in order, with the kernel read from r: that each is built for the
+// kernel's machine with relocations that GRUB applies, its dependencies are loaded
+// before it, and every symbol it uses is defined by the kernel or a module loaded
+// before it. Every problem found is returned, so that incompatible modules (e.g. from a
+// different GRUB build to the kernel) are caught when an image is built rather than
+// when a machine fails to boot it.
+//
+// GRUB's kernel only loads modules as ELF objects, linking them itself, so modules are
+// still embedded unlinked.
+func CheckModules(r io.ReaderAt, mods []*Module) error {
+	kernel, err := elf.NewFile(r)
+	if err != nil {
+		return fmt.Errorf("failed to read ELF file: %w", err)
+	}
+
+	kernelSymbols, err := kernel.Symbols()
+	if err != nil {
+		return fmt.Errorf("failed to read kernel symbols: %w", err)
+	}
+
+	// GRUB's symbol table starts with the kernel's exported symbols, and each module's
+	// global symbols are added to it as the module is loaded
+	defined := make(map[string]bool)
+	for _, symb := range kernelSymbols {
+		if symb.Section != elf.SHN_UNDEF && elf.ST_BIND(symb.Info) != elf.STB_LOCAL {
+			defined[symb.Name] = true
+		}
+	}
+
+	loaded := make(map[string]bool)
+	errs := []error{}
+
+	for _, mod := range mods {
+		if mod.objType != ObjTypeElf {
+			continue
+		}
+
+		modErrs, err := mod.check(kernel.Machine, defined, loaded)
+		if err != nil {
+			return fmt.Errorf("failed to check module '%s': %w", mod.name, err)
+		}
+
+		for _, modErr := range modErrs {
+			errs = append(errs, fmt.Errorf("module '%s': %w", mod.name, modErr))
+		}
+
+		loaded[mod.name] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+// check returns the problems GRUB would have linking the module, given the symbols
+// defined and modules loaded before it, and adds the module's own global symbols to
+// defined. An error is returned if the module can't be read at all.
+func (m *Module) check(machine elf.Machine, defined map[string]bool, loaded map[string]bool) ([]error, error) {
+	payload, err := m.open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open module for reading: %w", err)
+	}
+	defer payload.Close()
+
+	data, err := io.ReadAll(io.LimitReader(payload, int64(m.payloadSize)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read module payload: %w", err)
+	}
+
+	obj, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return []error{fmt.Errorf("%w: %w", errModuleNotRelocatable, err)}, nil
+	}
+
+	if obj.Type != elf.ET_REL {
+		return []error{errModuleNotRelocatable}, nil
+	}
+
+	if obj.Machine != machine {
+		return []error{fmt.Errorf("%w: %s, not %s", errModuleMachine, obj.Machine, machine)}, nil
+	}
+
+	errs := []error{}
+
+	if deps := obj.Section(sectionModDeps); deps != nil {
+		depData, err := deps.Data()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read module dependencies: %w", err)
+		}
+
+		for _, dep := range strings.Split(string(depData), "\x00") {
+			if dep != "" && !loaded[dep] {
+				errs = append(errs, fmt.Errorf("'%s': %w", dep, errModuleDependency))
+			}
+		}
+	}
+
+	symbols, err := obj.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, fmt.Errorf("failed to read module symbols: %w", err)
+	}
+
+	for _, symb := range symbols {
+		switch elf.ST_TYPE(symb.Info) {
+		case elf.STT_NOTYPE, elf.STT_OBJECT, elf.STT_FUNC:
+		default:
+			continue
+		}
+
+		if symb.Section == elf.SHN_UNDEF && symb.Name != "" && !defined[symb.Name] {
+			errs = append(errs, fmt.Errorf("'%s': %w", symb.Name, errUndefinedModuleSymbol))
+		}
+	}
+
+	errs = append(errs, checkModuleRelocations(obj)...)
+
+	// A module's symbols are only available to those loaded after it
+	for _, symb := range symbols {
+		if symb.Section != elf.SHN_UNDEF && elf.ST_BIND(symb.Info) != elf.STB_LOCAL {
+			defined[symb.Name] = true
+		}
+	}
+
+	return errs, nil
+}
+
+// checkModuleRelocations returns an error for each relocation type in the module that
+// GRUB's module loader doesn't apply
+func checkModuleRelocations(obj *elf.File) []error {
+	supported := moduleRelocations[obj.Machine]
+	unsupported := make(map[uint32]bool)
+	errs := []error{}
+
+	for _, section := range obj.Sections {
+		if section.Type != elf.SHT_RELA && section.Type != elf.SHT_REL {
+			continue
+		}
+
+		// Only sections that are loaded are relocated, e.g. not debug info
+		if int(section.Info) >= len(obj.Sections) || obj.Sections[section.Info].Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+
+		data, err := section.Data()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read relocation section '%s': %w", section.Name, err))
+			continue
+		}
+
+		for _, typ := range relocationTypes(obj, section, data) {
+			if !supported[typ] && !unsupported[typ] {
+				unsupported[typ] = true
+				errs = append(errs, fmt.Errorf("%s: %w", relocationName(obj.Machine, typ), errUnsupportedModuleReloc))
+			}
+		}
+	}
+
+	return errs
+}
+
+// relocationTypes returns the type of each entry in a relocation section
+func relocationTypes(obj *elf.File, section *elf.Section, data []byte) []uint32 {
+	if obj.Class != elf.ELFCLASS64 {
+		return nil
+	}
+
+	// Entries of 64-bit objects start with an 8-byte offset followed by the 8-byte info,
+	// whose low 32 bits are the type
+	entrySize := 16
+	if section.Type == elf.SHT_RELA {
+		entrySize = 24
+	}
+
+	types := make([]uint32, 0, len(data)/entrySize)
+	for offset := 0; offset+entrySize <= len(data); offset += entrySize {
+		info := obj.ByteOrder.Uint64(data[offset+8 : offset+16])
+		types = append(types, elf.R_TYPE64(info))
+	}
+
+	return types
+}
+
+// relocationName returns the name of the relocation type, for errors
+func relocationName(machine elf.Machine, typ uint32) string {
+	if machine == elf.EM_X86_64 {
+		return elf.R_X86_64(typ).String()
+	}
+
+	return fmt.Sprintf("relocation type %d", typ)
+}
@@ -0,0 +1,82 @@
+package grub
+
+import (
+	"debug/elf"
+	"debug/pe"
+	"errors"
+	"fmt"
+
+	"github.com/davejbax/pixie/pkg/efipe"
+)
+
+var errUnsupportedELFMachineType = errors.New("unsupported ELF machine type")
+
+func isMachineSupported(m elf.Machine) bool {
+	// TODO aarch64 support
+	return m == elf.EM_X86_64
+}
+
+func efipeMachine(m elf.Machine) (efipe.Machine, error) {
+	switch m {
+	case elf.EM_X86_64:
+		return pe.IMAGE_FILE_MACHINE_AMD64, nil
+	// case elf.EM_AARCH64: TODO aarch64 support
+	// 	return pe.IMAGE_FILE_MACHINE_ARM64, nil
+	default:
+		return 0, errUnsupportedELFMachineType
+	}
+}
+
+var (
+	errUnsupportedArch = errors.New("unsupported GRUB arch")
+	errUnbuildableArch = errors.New("images can only be built for x86_64")
+)
+
+// GRUB names some arches differently to Linux and Go
+var archAliases = map[string]string{
+	"aarch64": "arm64",
+	"amd64":   "x86_64",
+	"x64":     "x86_64",
+	"ia32":    "i386",
+}
+
+// grubArch returns GRUB's name for the arch, which may be given by another name
+func grubArch(arch string) string {
+	if alias, ok := archAliases[arch]; ok {
+		return alias
+	}
+
+	return arch
+}
+
+// MachineForArch returns the PE machine type of images built for the given GRUB target
+// arch (e.g. x86_64 or arm64). Linux's names for arches, such as aarch64, are accepted
+// too.
+func MachineForArch(arch string) (efipe.Machine, error) {
+	switch grubArch(arch) {
+	case "x86_64":
+		return pe.IMAGE_FILE_MACHINE_AMD64, nil
+	case "i386":
+		return pe.IMAGE_FILE_MACHINE_I386, nil
+	case "arm64":
+		return pe.IMAGE_FILE_MACHINE_ARM64, nil
+	case "arm":
+		return pe.IMAGE_FILE_MACHINE_ARM, nil
+	default:
+		return 0, fmt.Errorf("'%s': %w", arch, errUnsupportedArch)
+	}
+}
+
+// validateArch checks that images can be built for the arch: the kernel is relocated
+// into a PE image, which only x86_64 kernels can be so far
+func validateArch(arch string) error {
+	if _, err := MachineForArch(arch); err != nil {
+		return err
+	}
+
+	if grubArch(arch) != "x86_64" {
+		return fmt.Errorf("'%s': %w", arch, errUnbuildableArch)
+	}
+
+	return nil
+}
@@ -18,6 +18,8 @@ import (
 	"github.com/lunixbochs/struc"
 )
 
+// ModuleDependencies maps GRUB modules to the modules they depend on, as read from
+// GRUB's moddep.lst
 type ModuleDependencies map[string][]string
 
 var (
@@ -34,6 +36,7 @@ const (
 	sectionMods = "mods"
 )
 
+// NewDependencyList reads a dependency list in the format of GRUB's moddep.lst
 func NewDependencyList(r io.Reader) (ModuleDependencies, error) {
 	list := make(ModuleDependencies)
 	scanner := bufio.NewScanner(r)
@@ -118,13 +121,20 @@ const (
 	ObjTypeX509PubKey
 )
 
+// Module is an object embedded in a GRUB image: a module, or the prefix or config that
+// GRUB starts with
 type Module struct {
+	// Name of the module, or the prefix embedded by a prefix module
+	name string
+
 	objType ObjType
 	// Size of module payload, not including headers etc.
 	payloadSize uint32
 	open        func() (io.ReadCloser, error)
 }
 
+// NewModuleFromDirectory returns the named module (e.g. 'normal') from a GRUB directory
+// of '.mod' files. The file is read when the image is written.
 func NewModuleFromDirectory(directory string, module string) (*Module, error) {
 	path := filepath.Join(directory, module+".mod")
 
@@ -134,6 +144,7 @@ func NewModuleFromDirectory(directory string, module string) (*Module, error) {
 	}
 
 	return &Module{
+		name:        module,
 		objType:     ObjTypeElf, // TODO: make this a param? Do we ever want to read a non-elf file from disk?
 		payloadSize: uint32(stat.Size()),
 		open: func() (io.ReadCloser, error) {
@@ -142,6 +153,24 @@ func NewModuleFromDirectory(directory string, module string) (*Module, error) {
 	}, nil
 }
 
+// ModuleSizeError is returned when writing an image if a module's payload is no longer
+// the size that it was when the image was laid out, e.g. because the module's file was
+// replaced by a GRUB upgrade in between. Writing the payload anyway would misplace every
+// following module.
+type ModuleSizeError struct {
+	Module   string
+	Expected uint32
+	Actual   int64
+}
+
+func (e *ModuleSizeError) Error() string {
+	return fmt.Sprintf("module '%s' changed size since the image was laid out: expected %d bytes, found %d", e.Module, e.Expected, e.Actual)
+}
+
+// Size of the chunks that module payloads are streamed in, so that large modules (e.g.
+// memdisks) are never read into memory whole
+const moduleChunkSize = 64 * 1024
+
 const (
 	moduleInfoMagic        = 0x676d696d    // gmim (GRUB module info magic)
 	moduleInfoStructSize   = 4 + 4 + 8 + 8 // size of info structure
@@ -169,12 +198,13 @@ type moduleHeader struct {
 	Size uint32
 }
 
-func newStaticModule(objType ObjType, data []byte, unalignedLength uint32) *Module {
+func newStaticModule(name string, objType ObjType, data []byte, unalignedLength uint32) *Module {
 	length := align.Address(unalignedLength, voidPointerAlignment)
 	paddedData := make([]byte, length)
 	copy(paddedData, data)
 
 	return &Module{
+		name:        name,
 		objType:     objType,
 		payloadSize: length,
 		open: func() (io.ReadCloser, error) {
@@ -183,14 +213,16 @@ func newStaticModule(objType ObjType, data []byte, unalignedLength uint32) *Modu
 	}
 }
 
+// NewPrefixModule returns the prefix that GRUB reads its config and modules from
 func NewPrefixModule(prefix string) *Module {
 	// Length + 1 for nul byte (C-style string)
-	return newStaticModule(ObjTypePrefix, []byte(prefix), uint32(len(prefix)+1))
+	return newStaticModule(prefix, ObjTypePrefix, []byte(prefix), uint32(len(prefix)+1))
 }
 
+// NewConfigModule returns a config that GRUB runs before reading its config file
 func NewConfigModule(config string) *Module {
 	// Length + 1 for nul byte (C-style string)
-	return newStaticModule(ObjTypeConfig, []byte(config), uint32(len(config)+1))
+	return newStaticModule("", ObjTypeConfig, []byte(config), uint32(len(config)+1))
 }
 
 type moduleSection struct {
@@ -198,6 +230,10 @@ type moduleSection struct {
 
 	offset uint32
 
+	// Offset of the section in the image file, which is before its address when the
+	// kernel has uninitialised data
+	fileOffset uint32
+
 	// Actual size of module info + all module headers + all module payloads
 	realSize uint64
 
@@ -212,7 +248,7 @@ func (s *moduleSection) Header() pe.SectionHeader {
 		VirtualSize:          s.virtualSize,
 		VirtualAddress:       s.offset,
 		Size:                 s.virtualSize,
-		Offset:               s.offset,
+		Offset:               s.fileOffset,
 		PointerToRelocations: 0,
 		PointerToLineNumbers: 0,
 		NumberOfRelocations:  0,
@@ -236,27 +272,55 @@ func (s *moduleSection) WriteTo(w io.Writer) (int64, error) {
 		return int64(cw.BytesWritten()), err
 	}
 
+	chunk := make([]byte, moduleChunkSize)
+
 	for _, mod := range s.mods {
 		header := &moduleHeader{Typ: mod.objType, Size: moduleHeaderStructSize + mod.payloadSize}
 		if err := struc.PackWithOptions(cw, header, &struc.Options{Order: binary.LittleEndian}); err != nil {
 			return int64(cw.BytesWritten()), err
 		}
 
-		payload, err := mod.open()
-		if err != nil {
-			return int64(cw.BytesWritten()), fmt.Errorf("failed to open module for reading: %w", err)
-		}
-		defer payload.Close()
-
-		if _, err := io.Copy(cw, payload); err != nil {
-			return int64(cw.BytesWritten()), fmt.Errorf("failed to read module payload: %w", err)
+		if err := mod.writePayload(cw, chunk); err != nil {
+			return int64(cw.BytesWritten()), err
 		}
 	}
 
 	return int64(cw.BytesWritten()), nil
 }
 
-func newModuleSection(mods []*Module, offset uint32, alignment uint32) *moduleSection {
+// writePayload streams the module's payload to w through the chunk buffer, checking that
+// it's still the size that it was laid out with
+func (m *Module) writePayload(w io.Writer, chunk []byte) error {
+	payload, err := m.open()
+	if err != nil {
+		return fmt.Errorf("failed to open module for reading: %w", err)
+	}
+	defer payload.Close()
+
+	// The limit also stops the payload from being copied without the chunk buffer
+	written, err := io.CopyBuffer(w, io.LimitReader(payload, int64(m.payloadSize)), chunk)
+	if err != nil {
+		return fmt.Errorf("failed to read module payload: %w", err)
+	}
+
+	if written < int64(m.payloadSize) {
+		return &ModuleSizeError{Module: m.name, Expected: m.payloadSize, Actual: written}
+	}
+
+	// Anything left over means the payload has grown
+	extra, err := io.CopyBuffer(io.Discard, payload, chunk)
+	if err != nil {
+		return fmt.Errorf("failed to read module payload: %w", err)
+	}
+
+	if extra > 0 {
+		return &ModuleSizeError{Module: m.name, Expected: m.payloadSize, Actual: written + extra}
+	}
+
+	return nil
+}
+
+func newModuleSection(mods []*Module, offset uint32, fileOffset uint32, alignment uint32) *moduleSection {
 	totalSize := uint64(0)
 	for _, mod := range mods {
 		totalSize += uint64(mod.payloadSize) + moduleHeaderStructSize
@@ -265,5 +329,5 @@ func newModuleSection(mods []*Module, offset uint32, alignment uint32) *moduleSe
 
 	virtualSize := align.Address(offset+uint32(totalSize), alignment) - offset
 
-	return &moduleSection{mods: mods, offset: offset, realSize: totalSize, virtualSize: virtualSize}
+	return &moduleSection{mods: mods, offset: offset, fileOffset: fileOffset, realSize: totalSize, virtualSize: virtualSize}
 }
@@ -0,0 +1,145 @@
+package grub
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Parameters matching those of grub-mkpasswd-pbkdf2
+	pbkdf2Iterations = 10000
+	pbkdf2SaltSize   = 64
+	pbkdf2KeySize    = 64
+
+	pbkdf2Prefix = "grub.pbkdf2.sha512."
+
+	// Module providing the password_pbkdf2 command, which is embedded in images for
+	// which superusers are configured
+	passwordModule = "password_pbkdf2"
+)
+
+var (
+	errNoSuperuserName   = errors.New("superuser must have a name")
+	errInvalidUserName   = errors.New("superuser name may only contain letters, digits, '-', '_' and '.'")
+	errInvalidPassword   = errors.New("password hash must be a PBKDF2 hash from 'pixie grub hash-password' or grub-mkpasswd-pbkdf2")
+	errDuplicateUserName = errors.New("superuser name is used more than once")
+)
+
+// Superuser is a GRUB user who may boot locked menu entries, and edit entries or use the
+// GRUB shell. Once any superusers are configured, only unlocked entries can be booted
+// without a password.
+type Superuser struct {
+	Name string
+
+	// PBKDF2 hash of the user's password, from 'pixie grub hash-password' or
+	// grub-mkpasswd-pbkdf2, e.g. 'grub.pbkdf2.sha512.10000.<salt>.<hash>'
+	PasswordHash string `mapstructure:"password_hash"`
+}
+
+func (s *Superuser) validate() error {
+	if s.Name == "" {
+		return errNoSuperuserName
+	}
+
+	if strings.Trim(s.Name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") != "" {
+		return fmt.Errorf("'%s': %w", s.Name, errInvalidUserName)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(s.PasswordHash, pbkdf2Prefix), ".")
+	if !strings.HasPrefix(s.PasswordHash, pbkdf2Prefix) || len(parts) != 3 {
+		return fmt.Errorf("superuser '%s': %w", s.Name, errInvalidPassword)
+	}
+
+	for _, part := range parts[1:] {
+		if _, err := hex.DecodeString(part); err != nil || part == "" {
+			return fmt.Errorf("superuser '%s': %w", s.Name, errInvalidPassword)
+		}
+	}
+
+	return nil
+}
+
+// validateSuperusers checks that superusers have valid names and password hashes
+func validateSuperusers(superusers []Superuser) error {
+	seen := make(map[string]struct{}, len(superusers))
+
+	for i := range superusers {
+		if err := superusers[i].validate(); err != nil {
+			return err
+		}
+
+		if _, ok := seen[superusers[i].Name]; ok {
+			return fmt.Errorf("'%s': %w", superusers[i].Name, errDuplicateUserName)
+		}
+
+		seen[superusers[i].Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// passwordConfig returns the config embedded in images to set up the superusers. As it
+// is embedded, the config file loaded over the network can't remove the passwords.
+func passwordConfig(superusers []Superuser) string {
+	names := make([]string, 0, len(superusers))
+	for _, user := range superusers {
+		names = append(names, user.Name)
+	}
+
+	config := &strings.Builder{}
+	fmt.Fprintf(config, "set superusers=\"%s\"\n", strings.Join(names, " "))
+
+	for _, user := range superusers {
+		fmt.Fprintf(config, "password_pbkdf2 %s %s\n", user.Name, user.PasswordHash)
+	}
+
+	return config.String()
+}
+
+// HashPassword hashes a password in the same format as grub-mkpasswd-pbkdf2, for use as
+// a superuser's password hash
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, pbkdf2SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := pbkdf2SHA512([]byte(password), salt, pbkdf2Iterations, pbkdf2KeySize)
+
+	return fmt.Sprintf("%s%d.%s.%s", pbkdf2Prefix, pbkdf2Iterations, strings.ToUpper(hex.EncodeToString(salt)), strings.ToUpper(hex.EncodeToString(key))), nil
+}
+
+// pbkdf2SHA512 derives a key from a password as in RFC 8018, using HMAC-SHA512
+func pbkdf2SHA512(password []byte, salt []byte, iterations int, keySize int) []byte {
+	prf := hmac.New(sha512.New, password)
+	key := make([]byte, 0, keySize)
+
+	for block := uint32(1); len(key) < keySize; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		_ = binary.Write(prf, binary.BigEndian, block)
+
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keySize]
+}
@@ -9,7 +9,7 @@ import (
 	"io"
 	"log/slog"
 
-	"github.com/davejbax/pixie/internal/efipe"
+	"github.com/davejbax/pixie/pkg/efipe"
 	"github.com/lunixbochs/struc"
 )
 
@@ -7,10 +7,11 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"slices"
 
 	"github.com/davejbax/pixie/internal/align"
-	"github.com/davejbax/pixie/internal/efipe"
 	"github.com/davejbax/pixie/internal/iometa"
+	"github.com/davejbax/pixie/pkg/efipe"
 )
 
 type elfSection struct {
@@ -37,13 +38,40 @@ const (
 )
 
 type virtualSection struct {
-	offset       uint64
-	size         uint64
+	offset uint64
+	size   uint64
+
+	// Offset and size of the section's contents in the image file. Uninitialised data at
+	// the end of the section (i.e. BSS) only counts towards its virtual size, as the PE
+	// loader zeroes it, so the file doesn't contain it.
+	fileOffset uint64
+	fileSize   uint64
+
 	kind         virtualSectionType
 	realSections []*elfSection
 }
 
-func layoutVirtualSections(f *elf.File, headerSize uint32, alignment uint32) []*virtualSection {
+var (
+	errConstructorsUnsupported = errors.New("kernel has constructors, which GRUB never runs")
+	errInvalidSectionGroup     = errors.New("invalid section group")
+)
+
+// Types of unallocated sections that are only needed for linking or debugging (e.g.
+// '.comment' and '.debug_info', which are PROGBITS), so are expected to be left out of
+// the image
+var linkOnlySectionTypes = []elf.SectionType{
+	elf.SHT_NULL,
+	elf.SHT_PROGBITS,
+	elf.SHT_SYMTAB,
+	elf.SHT_STRTAB,
+	elf.SHT_REL,
+	elf.SHT_RELA,
+	elf.SHT_GROUP,
+	elf.SHT_SYMTAB_SHNDX,
+	elf.SHT_NOTE,
+}
+
+func layoutVirtualSections(f *elf.File, headerSize uint32, alignment uint32) ([]*virtualSection, error) {
 	textSections := []*elfSection{}
 	dataSections := []*elfSection{}
 	bssSections := []*elfSection{}
@@ -52,41 +80,94 @@ func layoutVirtualSections(f *elf.File, headerSize uint32, alignment uint32) []*
 		hasExecInstr := section.Flags&elf.SHF_EXECINSTR > 0
 		hasAlloc := section.Flags&elf.SHF_ALLOC > 0
 
+		if err := checkSection(f, section); err != nil {
+			return nil, err
+		}
+
 		isection := &elfSection{Section: *section, index: sectionIndex}
 
 		switch {
 		case hasExecInstr && hasAlloc:
 			textSections = append(textSections, isection)
 		case !hasExecInstr && hasAlloc:
+			// Init and fini arrays are laid out as data, as grub-mkimage does: they're
+			// only arrays of (relocated) pointers
 			if section.Type == elf.SHT_NOBITS {
 				bssSections = append(bssSections, isection)
 			} else {
 				dataSections = append(dataSections, isection)
 			}
+		case slices.Contains(linkOnlySectionTypes, section.Type):
+			slog.Debug("excluding section only needed for linking",
+				"section", section.Name,
+				"type", section.Type,
+			)
 		default:
 			slog.Warn("excluding section (not text/data/BSS)",
 				"section", section.Name,
+				"type", section.Type,
 			)
 		}
 	}
 
 	// Concat sections of the same type in a specific order: first .text, then
-	// .data, then .bss (which is also placed in the virtual .data section, following GRUB behaviour)
+	// .data, then .bss (which is also placed in the virtual .data section, following GRUB
+	// behaviour). Placing .bss last means that it's left out of the file.
 	addr := uint64(headerSize)
+	fileAddr := uint64(headerSize)
 	dataSections = append(dataSections, bssSections...)
 
 	virtualSections := make([]*virtualSection, 2)
-	virtualSections[0], addr = createVirtualSection(addr, textSections, uint64(alignment), virtualSectionTypeText)
-	virtualSections[1], addr = createVirtualSection(addr, dataSections, uint64(alignment), virtualSectionTypeData) //nolint:ineffassign,staticcheck
+	virtualSections[0], addr, fileAddr = createVirtualSection(addr, fileAddr, textSections, uint64(alignment), virtualSectionTypeText)
+	virtualSections[1], addr, fileAddr = createVirtualSection(addr, fileAddr, dataSections, uint64(alignment), virtualSectionTypeData) //nolint:ineffassign,staticcheck
 
-	return virtualSections
+	return virtualSections, nil
 }
 
-func createVirtualSection(addr uint64, sourceSections []*elfSection, alignment uint64, kind virtualSectionType) (*virtualSection, uint64) {
+// checkSection rejects sections that can't be laid out correctly. Constructors are
+// rejected because GRUB's kernel has no startup code to run them, so an image with them
+// would boot with uninitialised state. COMDAT and other section groups only tell the
+// linker which sections to keep together: their members are laid out as any other
+// section, so groups are only checked for members that don't exist.
+func checkSection(f *elf.File, section *elf.Section) error {
+	switch section.Type {
+	case elf.SHT_INIT_ARRAY, elf.SHT_PREINIT_ARRAY:
+		if section.Size > 0 {
+			return fmt.Errorf("section '%s': %w", section.Name, errConstructorsUnsupported)
+		}
+	case elf.SHT_GROUP:
+		data, err := section.Data()
+		if err != nil {
+			return fmt.Errorf("failed to read section group '%s': %w", section.Name, err)
+		}
+
+		if len(data)%4 != 0 || len(data) < 4 {
+			return fmt.Errorf("section group '%s' has size %d: %w", section.Name, len(data), errInvalidSectionGroup)
+		}
+
+		// The first word is the group's flags (e.g. GRP_COMDAT); the rest are members
+		for offset := 4; offset < len(data); offset += 4 {
+			member := f.ByteOrder.Uint32(data[offset:])
+			if member == 0 || int(member) >= len(f.Sections) {
+				return fmt.Errorf("section group '%s' has member %d: %w", section.Name, member, errInvalidSectionGroup)
+			}
+		}
+	}
+
+	return nil
+}
+
+// createVirtualSection lays out the sections at addr in memory and fileAddr in the image
+// file, returning the virtual section and the (aligned) memory and file addresses that
+// follow it
+func createVirtualSection(addr uint64, fileAddr uint64, sourceSections []*elfSection, alignment uint64, kind virtualSectionType) (*virtualSection, uint64, uint64) {
 	addr = align.Address(addr, alignment)
-	virt := &virtualSection{kind: kind, offset: addr}
+	virt := &virtualSection{kind: kind, offset: addr, fileOffset: align.Address(fileAddr, alignment)}
 	relocatedSections := make([]*elfSection, 0, len(sourceSections))
 
+	// End of the last section with contents in the file
+	dataEnd := addr
+
 	for _, section := range sourceSections {
 		if section.Addralign > 0 {
 			addr = align.Address(addr, section.Addralign)
@@ -102,15 +183,20 @@ func createVirtualSection(addr uint64, sourceSections []*elfSection, alignment u
 		)
 
 		addr += section.Size
+
+		if section.Type != elf.SHT_NOBITS {
+			dataEnd = addr
+		}
 	}
 
 	// Align the end of the section to the given alignment as well
 	addr = align.Address(addr, alignment)
 
 	virt.size = addr - virt.offset
+	virt.fileSize = align.Address(dataEnd, alignment) - virt.offset
 	virt.realSections = relocatedSections
 
-	return virt, addr
+	return virt, addr, virt.fileOffset + virt.fileSize
 }
 
 var errBSSSymbolButNoBSSSection = errors.New("BSS symbol found but no BSS virtual section created")
@@ -219,8 +305,8 @@ func (s *virtualSection) Header() pe.SectionHeader {
 		Name:           s.kind.Name(),
 		VirtualSize:    uint32(s.size),
 		VirtualAddress: uint32(s.offset),
-		Size:           uint32(s.size),
-		Offset:         uint32(s.offset),
+		Size:           uint32(s.fileSize),
+		Offset:         uint32(s.fileOffset),
 
 		// Always set to zero for executables
 		PointerToRelocations: 0,
@@ -239,7 +325,14 @@ func (s *virtualSection) WriteTo(w io.Writer) (int64, error) {
 
 	initialAddr := s.realSections[0].addrInFile
 
-	for _, section := range s.realSections {
+	// Uninitialised data after the last section with contents isn't in the file; any
+	// before it must be written as zeros to keep the following sections in place
+	written := s.realSections
+	for len(written) > 0 && written[len(written)-1].Type == elf.SHT_NOBITS {
+		written = written[:len(written)-1]
+	}
+
+	for _, section := range written {
 		// If there's padding before the start of this section, write it now
 		if uint64(cw.BytesWritten()) < section.addrInFile-initialAddr {
 			if err := iometa.WriteZeros(cw, int(section.addrInFile-initialAddr)-cw.BytesWritten()); err != nil {
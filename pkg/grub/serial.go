@@ -0,0 +1,69 @@
+package grub
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Modules providing the serial and terminal_input/terminal_output commands, which are
+// embedded in images that use a serial console
+var serialModules = []string{"serial", "terminal"}
+
+var (
+	errInvalidSerialSpeed = errors.New("serial console speed must be positive")
+	errInvalidSerialUnit  = errors.New("serial console unit must not be negative")
+	errNoSerialDevice     = errors.New("serial console must have a kernel device, e.g. 'ttyS0'")
+)
+
+// SerialConfig configures a serial console, for headless machines. GRUB shows its menu
+// on the serial port as well as the screen, and kernels booted from generated menus log
+// to the serial port.
+type SerialConfig struct {
+	Enabled bool
+
+	// Number of the serial port as GRUB counts them, where 0 is the first port (COM1)
+	Unit int
+
+	// Name of the serial port in the kernel, e.g. 'ttyS0', or 'ttyAMA0' on many ARM
+	// machines
+	Device string `default:"ttyS0"`
+
+	// Baud rate of the serial port
+	Speed int `default:"115200"`
+}
+
+func (c *SerialConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.Unit < 0 {
+		return errInvalidSerialUnit
+	}
+
+	if c.Speed <= 0 {
+		return errInvalidSerialSpeed
+	}
+
+	if c.Device == "" {
+		return errNoSerialDevice
+	}
+
+	return nil
+}
+
+// KernelArgs returns the arguments that make kernels log to the serial console, as
+// well as the screen. The serial console comes last, so that it becomes /dev/console.
+func (c *SerialConfig) KernelArgs() []string {
+	if !c.Enabled {
+		return nil
+	}
+
+	return []string{"console=tty0", fmt.Sprintf("console=%s,%dn8", c.Device, c.Speed)}
+}
+
+// serialConfig returns the config embedded in images to use the serial console
+// alongside the screen
+func serialConfig(serial *SerialConfig) string {
+	return fmt.Sprintf("serial --unit=%d --speed=%d\nterminal_input serial console\nterminal_output serial console\n", serial.Unit, serial.Speed)
+}
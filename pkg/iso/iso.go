@@ -1,3 +1,7 @@
+// Package iso builds bootable ISO images for UEFI machines. The EFI entrypoints (e.g.
+// GRUB images from [github.com/davejbax/pixie/pkg/grub]) are put on a FAT EFI system
+// partition image, which El Torito points the firmware at; other files go in the
+// ISO 9660 filesystem.
 package iso
 
 import (
@@ -9,7 +13,7 @@ import (
 	"strings"
 
 	"github.com/davejbax/pixie/internal/align"
-	"github.com/davejbax/pixie/internal/efipe"
+	"github.com/davejbax/pixie/pkg/efipe"
 	"github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/backend/file"
 	"github.com/diskfs/go-diskfs/disk"
@@ -38,23 +42,45 @@ const (
 	espBootDirectory = "/EFI/BOOT"
 )
 
+// Builder collects the entrypoints and files of an ISO image. A Builder isn't safe for
+// concurrent use.
 type Builder struct {
 	tempDir     string
+	opts        *Options
 	entrypoints map[efipe.Machine]Entrypoint
+
+	// Files in the ISO filesystem alongside the ESP, such as a GRUB config
+	files []*File
+}
+
+// File is a file in the ISO filesystem
+type File struct {
+	// Slash-separated path of the file, relative to the root of the ISO filesystem
+	Path string
+
+	Size int64
+	Open func() (io.ReadCloser, error)
 }
 
-func NewBuilder(tempDir string) *Builder {
+// NewBuilder creates a builder that writes intermediate images to tempDir, or the
+// default temporary directory if it's empty. Use [DefaultOptions] for the default
+// volume metadata.
+func NewBuilder(tempDir string, opts *Options) *Builder {
 	return &Builder{
 		tempDir:     tempDir,
+		opts:        opts,
 		entrypoints: make(map[efipe.Machine]Entrypoint),
 	}
 }
 
+// Entrypoint is an EFI application, such as an [efipe.Image]
 type Entrypoint interface {
 	io.WriterTo
 	Size() uint32
 }
 
+// AddEFIEntrypoint adds the default EFI application for the machine type, which must be
+// x86_64, i386, arm64 or arm. Only one entrypoint can be added per machine type.
 func (b *Builder) AddEFIEntrypoint(image Entrypoint, machine efipe.Machine) error {
 	if _, ok := b.entrypoints[machine]; ok {
 		return errEntrypointAlreadyExists
@@ -64,6 +90,11 @@ func (b *Builder) AddEFIEntrypoint(image Entrypoint, machine efipe.Machine) erro
 	return nil
 }
 
+// AddFile adds a file to the ISO filesystem, which GRUB can read from '(cd0)'
+func (b *Builder) AddFile(file *File) {
+	b.files = append(b.files, file)
+}
+
 func (b *Builder) entrypointSizes() []uint32 {
 	sizes := make([]uint32, 0, len(b.entrypoints))
 	for _, entrypoint := range b.entrypoints {
@@ -72,7 +103,13 @@ func (b *Builder) entrypointSizes() []uint32 {
 	return sizes
 }
 
+// Build validates the options, and writes the ISO image to output. File contents are
+// read while the image is built.
 func (b *Builder) Build(output io.Writer) error {
+	if err := b.opts.Validate(); err != nil {
+		return fmt.Errorf("invalid ISO options: %w", err)
+	}
+
 	espFile, err := os.CreateTemp(b.tempDir, "esp-*.img")
 	if err != nil {
 		return fmt.Errorf("failed to create temporary FAT ESP file for writing: %w", err)
@@ -81,9 +118,9 @@ func (b *Builder) Build(output io.Writer) error {
 	defer os.Remove(espFile.Name())
 
 	// Guess the size we'll need for the ESP FAT file based on very dubious logic
-	espSize := uint64(guessSize(b.entrypointSizes(), fatOverheadPerFile, fatOverhead, fatAlign))
+	espSize := max(uint64(guessSize(b.entrypointSizes(), fatOverheadPerFile, fatOverhead, fatAlign)), fat32MinSize)
 
-	if err := espFile.Truncate(int64(max(espSize, fat32MinSize))); err != nil {
+	if err := espFile.Truncate(int64(espSize)); err != nil {
 		return fmt.Errorf("failed to resize FAT image: %w", err)
 	}
 
@@ -99,7 +136,12 @@ func (b *Builder) Build(output io.Writer) error {
 	defer os.Remove(isoFile.Name())
 
 	// Guess the size of the ISO based on even more dubious logic
-	isoSize := guessSize([]uint64{espSize}, isoOverheadPerFile, isoOverhead, isoBlockSize)
+	fileSizes := []uint64{espSize}
+	for _, file := range b.files {
+		fileSizes = append(fileSizes, uint64(file.Size))
+	}
+
+	isoSize := guessSize(fileSizes, isoOverheadPerFile, isoOverhead, isoBlockSize)
 
 	if err := isoFile.Truncate(int64(isoSize)); err != nil {
 		return fmt.Errorf("failed to resize ISO image: %w", err)
@@ -170,7 +212,7 @@ func (b *Builder) buildISO(f *os.File, esp io.Reader) error {
 	isoFs, err := isoDisk.CreateFilesystem(disk.FilesystemSpec{
 		Partition:   0, // 0 = create filesystem on entire image
 		FSType:      filesystem.TypeISO9660,
-		VolumeLabel: "pixie",
+		VolumeLabel: b.opts.VolumeIdentifier,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create ISO filesystem: %w", err)
@@ -185,13 +227,21 @@ func (b *Builder) buildISO(f *os.File, esp io.Reader) error {
 		return fmt.Errorf("failed to write ESP image file: %w", err)
 	}
 
+	for _, file := range b.files {
+		if err := writeFile(isoFs, file); err != nil {
+			return fmt.Errorf("failed to write '%s' to ISO filesystem: %w", file.Path, err)
+		}
+	}
+
 	iso, ok := isoFs.(*iso9660.FileSystem)
 	if !ok {
 		panic("ISO filesystem should be iso9660.FileSystem, but it is not; possible bug in go-diskfs")
 	}
 
 	if err := iso.Finalize(iso9660.FinalizeOptions{
-		VolumeIdentifier: "pixie",
+		RockRidge:        b.opts.RockRidge,
+		DeepDirectories:  b.opts.DeepDirectories,
+		VolumeIdentifier: b.opts.VolumeIdentifier,
 		ElTorito: &iso9660.ElTorito{
 			Platform: iso9660.EFI,
 			Entries: []*iso9660.ElToritoEntry{
@@ -206,6 +256,36 @@ func (b *Builder) buildISO(f *os.File, esp io.Reader) error {
 		return fmt.Errorf("failed to finalize ISO: %w", err)
 	}
 
+	if err := b.opts.writeVolumeMetadata(f, isoBlockSize); err != nil {
+		return fmt.Errorf("failed to write ISO volume metadata: %w", err)
+	}
+
+	return nil
+}
+
+// writeFile writes the file to the filesystem, creating any parent directories
+func writeFile(fs filesystem.FileSystem, file *File) error {
+	if dir := path.Dir("/" + file.Path); dir != "/" {
+		if err := mkdirs(fs, dir); err != nil {
+			return err
+		}
+	}
+
+	contents, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+
+	output, err := fs.OpenFile("/"+file.Path, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	if _, err := io.Copy(output, contents); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
 	return nil
 }
 
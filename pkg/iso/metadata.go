@@ -0,0 +1,132 @@
+package iso
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/creasty/defaults"
+)
+
+const (
+	// The primary volume descriptor is always the first volume descriptor, which
+	// starts at sector 16 (after the system area)
+	primaryVolumeDescriptorSector = 16
+
+	// Offsets and lengths of the identifier fields within the primary volume descriptor,
+	// as defined by ECMA-119 section 8.4
+	pvdSystemIdentifierOffset      = 8
+	pvdSystemIdentifierLength      = 32
+	pvdVolumeIdentifierLength      = 32
+	pvdVolumeSetIdentifierOffset   = 190
+	pvdPublisherIdentifierOffset   = 318
+	pvdPreparerIdentifierOffset    = 446
+	pvdApplicationIdentifierOffset = 574
+	pvdLongIdentifierLength        = 128
+
+	// d-characters are the only characters allowed in the volume identifier
+	dCharacters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
+
+	// a-characters are allowed in the other identifier fields
+	aCharacters = dCharacters + " !\"%&'()*+,-./:;<=>?"
+)
+
+var (
+	errIdentifierTooLong      = errors.New("identifier exceeds maximum length")
+	errIdentifierInvalidChars = errors.New("identifier contains characters not permitted by ISO 9660")
+)
+
+// Options controls the volume metadata and filename extensions of the generated ISO
+type Options struct {
+	// Volume identifier (label) of the ISO. Must consist of at most 32 upper-case
+	// letters, digits, and underscores.
+	VolumeIdentifier string `mapstructure:"volume_identifier" default:"PIXIE"`
+
+	// Volume set, publisher, data preparer, and application identifiers. Each of
+	// these is at most 128 characters long.
+	VolumeSetIdentifier   string `mapstructure:"volume_set_identifier"`
+	Publisher             string `mapstructure:"publisher"`
+	Preparer              string `mapstructure:"preparer" default:"PIXIE"`
+	ApplicationIdentifier string `mapstructure:"application_identifier" default:"PIXIE"`
+
+	// System identifier, at most 32 characters long
+	SystemIdentifier string `mapstructure:"system_identifier"`
+
+	// Whether to add Rock Ridge extensions, which provide long (and lower-case) filenames.
+	// Joliet extensions aren't supported, as go-diskfs can't write the supplementary
+	// volume descriptor they require.
+	RockRidge bool `mapstructure:"rock_ridge" default:"true"`
+
+	// Whether to allow directory hierarchies deeper than the 8 levels allowed by ISO 9660
+	DeepDirectories bool `mapstructure:"deep_directories"`
+}
+
+// DefaultOptions returns options with the default volume metadata, and Rock Ridge
+// extensions enabled
+func DefaultOptions() *Options {
+	opts := &Options{}
+	if err := defaults.Set(opts); err != nil {
+		panic(fmt.Sprintf("ISO option defaults are invalid: %v", err))
+	}
+
+	return opts
+}
+
+// Validate checks that the options conform to the character set and length restrictions
+// of ISO 9660
+func (o *Options) Validate() error {
+	fields := []struct {
+		name    string
+		value   string
+		length  int
+		charset string
+	}{
+		{"volume identifier", o.VolumeIdentifier, pvdVolumeIdentifierLength, dCharacters},
+		{"system identifier", o.SystemIdentifier, pvdSystemIdentifierLength, aCharacters},
+		{"volume set identifier", o.VolumeSetIdentifier, pvdLongIdentifierLength, dCharacters},
+		{"publisher", o.Publisher, pvdLongIdentifierLength, aCharacters},
+		{"preparer", o.Preparer, pvdLongIdentifierLength, aCharacters},
+		{"application identifier", o.ApplicationIdentifier, pvdLongIdentifierLength, aCharacters},
+	}
+
+	for _, field := range fields {
+		if len(field.value) > field.length {
+			return fmt.Errorf("%s '%s' is longer than %d characters: %w", field.name, field.value, field.length, errIdentifierTooLong)
+		}
+
+		if strings.Trim(field.value, field.charset) != "" {
+			return fmt.Errorf("%s '%s' is invalid: %w", field.name, field.value, errIdentifierInvalidChars)
+		}
+	}
+
+	return nil
+}
+
+// writeVolumeMetadata overwrites the identifier fields of the primary volume descriptor,
+// since go-diskfs doesn't allow us to set these directly
+func (o *Options) writeVolumeMetadata(w io.WriterAt, blockSize int64) error {
+	pvdOffset := primaryVolumeDescriptorSector * blockSize
+
+	fields := []struct {
+		value  string
+		offset int64
+		length int
+	}{
+		{o.SystemIdentifier, pvdSystemIdentifierOffset, pvdSystemIdentifierLength},
+		{o.VolumeSetIdentifier, pvdVolumeSetIdentifierOffset, pvdLongIdentifierLength},
+		{o.Publisher, pvdPublisherIdentifierOffset, pvdLongIdentifierLength},
+		{o.Preparer, pvdPreparerIdentifierOffset, pvdLongIdentifierLength},
+		{o.ApplicationIdentifier, pvdApplicationIdentifierOffset, pvdLongIdentifierLength},
+	}
+
+	for _, field := range fields {
+		// Identifier fields are padded with spaces rather than nul bytes
+		padded := field.value + strings.Repeat(" ", field.length-len(field.value))
+		if _, err := w.WriteAt([]byte(padded), pvdOffset+field.offset); err != nil {
+			return fmt.Errorf("failed to write volume descriptor field: %w", err)
+		}
+	}
+
+	return nil
+}